@@ -0,0 +1,1012 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+
+	"copycat-imap/copycat"
+)
+
+const searchResults = 50
+
+// commands can be run instead of a sync with: copycat-imap <command> [flags] [args]
+var commands = map[string]func(args []string){
+	"batch":     batch,
+	"cache":     cache,
+	"check":     check,
+	"checksums": checksums,
+	"config":    configCommand,
+	"diff":      diff,
+	"discover":  discover,
+	"list":      list,
+	"logs":      logs,
+	"loadgen":   loadgen,
+	"resync":    resync,
+	"route":     route,
+	"search":    search,
+	"serve":     serve,
+	"service":   serviceCommand,
+	"setup":     setup,
+	"verify":    verify,
+}
+
+// discover will find the IMAP server of each email address in the args.
+func discover(args []string) {
+	if len(args) == 0 {
+		log.Print("usage: copycat-imap discover <email address>...")
+		os.Exit(1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "address\thost\tmethod\tsource\tdomain")
+	failed := false
+	for _, email := range args {
+		found, err := copycat.Discover(email, "")
+		if err != nil {
+			fmt.Fprintf(w, "%s\t\t\t%s\n", email, err.Error())
+			failed = true
+			continue
+		}
+		// a host outside the domain is only used with -allow-discovered-host
+		domain := "in"
+		if found.Foreign {
+			domain = "outside"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", email, found.Host, found.Method, found.Source, domain)
+	}
+	w.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// search will query the -index for messages matching the args.
+func search(args []string) {
+	if len(*indexURL) == 0 {
+		log.Print("The -index parameter is required to search.")
+		os.Exit(1)
+	}
+
+	index, err := copycat.NewIndexSink(*indexURL)
+	errCheck(err, "Index")
+
+	msgs, err := index.Search(strings.Join(args, " "), searchResults)
+	if err != nil {
+		log.Printf("Problems searching the index: %s", err.Error())
+		os.Exit(1)
+	}
+
+	for _, msg := range msgs {
+		fmt.Printf("%s\t%s\t%s\t%s\n", msg.InternalDate.Format("2006-01-02 15:04"), msg.From, msg.Subject, msg.MessageId)
+	}
+}
+
+// loadgen will append synthetic messages to the destination inbox so syncs
+// can be benchmarked against it. The number of messages is the only arg.
+func loadgen(args []string) {
+	if len(args) != 1 {
+		log.Print("usage: copycat-imap loadgen -dst-id=... -dst-pw=... -dst-host=... [-sizes=...] <count>")
+		os.Exit(1)
+	}
+	count, err := strconv.Atoi(args[0])
+	errCheck(err, "Count")
+
+	dist, err := copycat.ParseSizeDistribution(*sizes)
+	errCheck(err, "Sizes")
+
+	dstInfo, err := copycat.NewInboxInfo(*dstId, *dstPw, *dstHost)
+	errCheck(err, "Destination Info")
+
+	conn, err := copycat.GetConnection(dstInfo, false)
+	errCheck(err, "Destination Connection")
+	defer conn.Logout(20 * time.Second)
+
+	if err = copycat.LoadGen(conn, count, dist, time.Now().UnixNano()); err != nil {
+		log.Printf("Problems generating messages: %s", err.Error())
+		os.Exit(1)
+	}
+}
+
+// check will log in to the source and each destination and print what it finds out
+// about them. It exits with a status of 1 if any of them have a problem, so it can be
+// used before a migration or as a monitoring probe.
+func check(args []string) {
+	srcInfo, dstInfos := inboxes()
+
+	var failed bool
+	for _, info := range append([]copycat.InboxInfo{srcInfo}, dstInfos...) {
+		health, err := copycat.Check(info)
+		if err != nil {
+			fmt.Printf("%s on %s: FAILED: %s\n", info.User, info.Host, err.Error())
+			failed = true
+			continue
+		}
+		fmt.Println(health)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// list will print the source's folder tree with the number of messages in each folder
+// and about how much space they take up, to help with picking folders and policies.
+func list(args []string) {
+	srcInfo, _ := inboxes()
+	conn, err := copycat.GetConnection(srcInfo, true)
+	errCheck(err, "Source Connection")
+	defer conn.Logout(20 * time.Second)
+
+	summaries, delim, err := copycat.SummarizeFolders(conn, true)
+	if err != nil {
+		log.Printf("Problems listing the source folders: %s", err.Error())
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "folder\tmessages\tsize")
+	var messages uint32
+	var size int64
+	for _, summary := range summaries {
+		name := strings.Repeat("  ", summary.Depth) + summary.Leaf(delim)
+		if summary.Parent {
+			fmt.Fprintf(w, "%s\t\t\n", name)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", name, summary.Messages, copycat.FormatSize(summary.Size))
+		messages += summary.Messages
+		if size >= 0 && summary.Size >= 0 {
+			size += summary.Size
+		} else {
+			size = -1
+		}
+	}
+	fmt.Fprintf(w, "total\t%d\t%s\n", messages, copycat.FormatSize(size))
+	w.Flush()
+}
+
+// configCommand checks the -config-file, the -folder-policies and -routes files and the
+// flags given with them for mistakes ("config validate"), printing where each one is.
+// It exits with 1 if any would stop a run or copy messages somewhere they shouldn't go.
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "validate" {
+		log.Print("usage: copycat-imap config validate -config-file=<file> [flags]")
+		os.Exit(1)
+	}
+	// the flags after "validate" weren't parsed yet
+	flag.CommandLine.Parse(args[1:])
+
+	var problems []copycat.ConfigProblem
+	var dstHosts []string
+	if len(*configFile) > 0 {
+		raw, err := ioutil.ReadFile(*configFile)
+		errCheck(err, "Config File")
+		needSource := len(*importDir) == 0 && len(*srcEWS) == 0 && len(*srcGraph) == 0 && len(*srcPOP3) == 0 && len(*srcNNTP) == 0
+		problems = append(problems, copycat.LintConfig(*configFile, raw, needSource)...)
+		var config copycat.Config
+		if json.Unmarshal(raw, &config) == nil {
+			for _, dst := range config.Dest {
+				dstHosts = append(dstHosts, dst.Host)
+			}
+		}
+	} else if len(*dstHost) > 0 {
+		dstHosts = append(dstHosts, *dstHost)
+	}
+	var envConfig copycat.Config
+	if err := envConfig.ApplyEnv(os.Environ()); err != nil {
+		problems = append(problems, copycat.ConfigProblem{Message: err.Error()})
+	}
+
+	var policies []copycat.FolderPolicy
+	if len(*folderPolicies) > 0 {
+		var err error
+		if policies, err = copycat.LoadFolderPolicies(*folderPolicies); err != nil {
+			problems = append(problems, copycat.ConfigProblem{Message: err.Error()})
+		}
+		problems = append(problems, copycat.LintFolderPolicies(*folderPolicies, policies)...)
+	}
+	if len(*routes) > 0 {
+		loaded, err := copycat.LoadRoutes(*routes)
+		if err != nil {
+			problems = append(problems, copycat.ConfigProblem{Message: err.Error()})
+		}
+		problems = append(problems, copycat.LintRoutes(*routes, loaded, policies, dstHosts)...)
+	}
+	problems = append(problems, lintFlags()...)
+
+	errors := 0
+	for _, problem := range problems {
+		fmt.Println(problem)
+		if !problem.Warning {
+			errors++
+		}
+	}
+	fmt.Printf("%d error(s), %d warning(s)\n", errors, len(problems)-errors)
+	if errors > 0 {
+		os.Exit(1)
+	}
+}
+
+// lintFlags finds flags that conflict or have values setOptions would refuse.
+func lintFlags() []copycat.ConfigProblem {
+	var problems []copycat.ConfigProblem
+	conflict := func(warning bool, format string, args ...interface{}) {
+		problems = append(problems, copycat.ConfigProblem{Warning: warning, Message: fmt.Sprintf(format, args...)})
+	}
+	if *byteExact && (*repairMIME || *generateIds || len(*filters) > 0) {
+		conflict(false, "-byte-exact with -repair-mime, -generate-ids or -filter, which change the messages")
+	}
+	if *purge && *expungeSource {
+		conflict(true, "-purge with -expunge-source: messages expunged from the source are purged from the destinations on the next run")
+	}
+	if *quicksync && *idle {
+		conflict(true, "-quick is ignored with -idle, the sync before idling is always a full one")
+	}
+	if !*sync && !*idle {
+		conflict(true, "-sync=false without -idle does nothing")
+	}
+	if *folders && *parallelFolders**conns > *maxConns {
+		conflict(true, "-parallel-folders=%d with -c=%d needs %d connections to each server, more than -max-conns=%d, so folders will wait for each other", *parallelFolders, *conns, *parallelFolders**conns, *maxConns)
+	}
+	if *cacheMaxSize > 0 && *maxMessageSize > 0 && *cacheMaxSize >= *maxMessageSize {
+		conflict(true, "-cache-max-size is no smaller than -max-message-size, so it never applies")
+	}
+	if _, err := copycat.ParseAddressPreference(*preferIP); err != nil {
+		conflict(false, "-prefer-ip: %s", err.Error())
+	}
+	switch *groupware {
+	case copycat.GroupwareSync, copycat.GroupwareSkip, copycat.GroupwareExport:
+	default:
+		conflict(false, "-groupware: expected 'skip' or 'export', not %q", *groupware)
+	}
+	switch *headerParsing {
+	case copycat.HeaderLenient, copycat.HeaderStrict:
+	default:
+		conflict(false, "-header-parsing: expected 'lenient' or 'strict', not %q", *headerParsing)
+	}
+	if len(*logFile) > 0 && len(*logTarget) > 0 {
+		conflict(true, "-log-target is ignored with -log")
+	}
+	if *reportFormat != "text" && *reportFormat != "json" {
+		conflict(false, "-report-format: expected 'text' or 'json', not %q", *reportFormat)
+	}
+	if len(*window) > 0 {
+		if _, err := copycat.ParseTimeWindow(*window); err != nil {
+			conflict(false, "-window: %s", err.Error())
+		}
+	}
+	return problems
+}
+
+// route will print where each message in the folders would be copied to in the first
+// destination under the -routes, without copying anything. The folders are the args, or
+// every folder with -folders. The INBOX is looked at by default.
+func route(args []string) {
+	setOptions()
+	if len(copycat.Routes) == 0 {
+		log.Print("The -routes parameter is required to plan routes.")
+		os.Exit(1)
+	}
+	srcInfo, dstInfos := inboxes()
+	names := commandFolders(srcInfo, args)
+
+	src, err := copycat.GetConnection(srcInfo, true)
+	errCheck(err, "Source Connection")
+	dst, err := copycat.GetConnection(dstInfos[0], true)
+	errCheck(err, "Destination Connection")
+	dstNames, err := copycat.DestinationFolders(src, dst, dstInfos[0], names)
+	errCheck(err, "Destination Folders")
+	src.Logout(20 * time.Second)
+	dst.Logout(20 * time.Second)
+
+	var routed int
+	for _, folder := range names {
+		conn, err := copycat.GetFolderConnection(srcInfo, folder, true)
+		if err != nil {
+			log.Printf("Unable to open folder %s in %s: %s. skipping!", folder, srcInfo.User, err.Error())
+			continue
+		}
+		decisions, err := copycat.PlanRoutes(conn, dstNames[folder])
+		conn.Logout(20 * time.Second)
+		if err != nil {
+			log.Printf("Problems routing the messages of folder %s: %s", folder, err.Error())
+			continue
+		}
+		for _, decision := range decisions {
+			rule := "default"
+			if decision.Routed {
+				rule = "routed"
+				routed++
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", folder, decision.MessageId, decision.From, decision.Subject, rule, decision.Dest)
+		}
+	}
+	log.Printf("%d message(s) would be routed", routed)
+}
+
+// resync copies just the messages listed in the file given as the only arg ("-" for
+// stdin) again, without listing the folders. See copycat.ParseResyncList for the format.
+func resync(args []string) {
+	if len(args) != 1 {
+		log.Print("usage: copycat-imap resync [flags] <list file>")
+		os.Exit(1)
+	}
+	var list io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		errCheck(err, "List")
+		defer f.Close()
+		list = f
+	}
+	targets, err := copycat.ParseResyncList(list)
+	errCheck(err, "List")
+	if len(targets) == 0 {
+		log.Print("nothing to resync")
+		return
+	}
+
+	setOptions()
+	srcInfo, dstInfos := inboxes()
+	report := copycat.NewReport()
+	copycat.RunReport = report
+	copycat.Progress = copycat.Progress.And(report.Handle)
+	var execFilters []string
+	if len(*filters) > 0 {
+		execFilters = strings.Split(*filters, ",")
+	}
+	log.Printf("resyncing %d messages", len(targets))
+	err = copycat.Resync(srcInfo, dstInfos, targets, transformers(report, execFilters), *generateIds)
+	printReport(report)
+	if err != nil {
+		log.Printf("Problems resyncing: %s", err.Error())
+		os.Exit(1)
+	}
+}
+
+// serve will accept sync jobs over HTTP at the address given as the only arg, and over
+// gRPC at -grpc, and run them, -jobs at a time, with the options from the flags. Jobs are
+// kept in the -db so they're picked up again after a restart. See copycat.JobQueue for
+// the API. Every request needs one of the -api-tokens.
+func serve(args []string) {
+	if len(args) != 1 || len(*apiTokens) == 0 {
+		log.Print("usage: copycat-imap serve -api-tokens=<file> [-jobs=2] [flags] <address>")
+		os.Exit(1)
+	}
+	tokens, err := copycat.LoadAPITokens(*apiTokens)
+	errCheck(err, "API Tokens")
+	setOptions()
+	report := copycat.NewReport()
+	copycat.RunReport = report
+
+	store, err := copycat.NewCache(*dbFile)
+	errCheck(err, "Job Store")
+	defer store.Close()
+
+	var tenants map[string]copycat.TenantLimits
+	if len(*tenantLimits) > 0 {
+		tenants, err = copycat.LoadTenantLimits(*tenantLimits)
+		errCheck(err, "Tenant Limits")
+	}
+
+	key, err := copycat.ResolveCredential(*jobKey)
+	errCheck(err, "Job Key")
+	// set before there's a queue, since the jobs it resumes start right away
+	var queueMu gosync.Mutex
+	var queue *copycat.JobQueue
+	copycat.Progress = copycat.Progress.And(func(e copycat.Event) {
+		queueMu.Lock()
+		q := queue
+		queueMu.Unlock()
+		q.Handle(e)
+	})
+	q, err := copycat.NewPersistentJobQueue(*jobs, tenants, store, []byte(key), runJob(report))
+	errCheck(err, "Job Store")
+	queueMu.Lock()
+	queue = q
+	queueMu.Unlock()
+	queue.Tokens = tokens
+	queue.Filters = copycat.ParseFlags(*jobFilters)
+	// a cancel stops the jobs running, not the ones submitted after it
+	queue.Rearm = true
+	copycat.Controls.OnReload(func() {
+		flagsMu.RLock()
+		file := *tenantLimits
+		flagsMu.RUnlock()
+		if len(file) == 0 {
+			return
+		}
+		tenants, err := copycat.LoadTenantLimits(file)
+		if err != nil {
+			log.Printf("Unable to reload the tenant limits: %s", err.Error())
+			return
+		}
+		queue.SetTenants(tenants)
+	})
+	reloadOnHangup()
+
+	// not the DefaultServeMux, which has the debug endpoints on it
+	mux := http.NewServeMux()
+	mux.Handle("/jobs", queue)
+	mux.Handle("/jobs/", queue)
+	mux.Handle("/control/", tokens.Admin(copycat.Controls))
+	if len(*grpcAddr) > 0 {
+		listener, err := net.Listen("tcp", *grpcAddr)
+		errCheck(err, "gRPC")
+		log.Printf("accepting jobs over gRPC on %s", *grpcAddr)
+		go func() {
+			if err := queue.GRPCServer().Serve(listener); err != nil {
+				log.Printf("Problems serving jobs over gRPC: %s", err.Error())
+				os.Exit(1)
+			}
+		}()
+	}
+	notifySystemd()
+	log.Printf("accepting jobs on %s", args[0])
+	if err := http.ListenAndServe(args[0], mux); err != nil {
+		log.Printf("Problems serving jobs: %s", err.Error())
+		os.Exit(1)
+	}
+}
+
+// runJob returns the JobRunner of the serve and batch commands, which syncs the job's
+// inboxes with the flags' options.
+func runJob(report *copycat.Report) copycat.JobRunner {
+	return func(spec copycat.JobSpec, limits copycat.TenantLimits) error {
+		copycat.Systemd.Status("running the job for %s", spec.Source.User)
+		// the flags the job uses, read once so a reload can't change them part way
+		flagsMu.RLock()
+		var execFilters []string
+		if len(*filters) > 0 {
+			execFilters = strings.Split(*filters, ",")
+		}
+		transform := transformers(report, append(execFilters, spec.Filters...))
+		jobConns, jobParallel, jobMaxConns := limits.Conns(*conns), *parallelFolders, limits.Conns(*maxConns)
+		jobDB, jobGenerateIds := *dbFile, *generateIds
+		flagsMu.RUnlock()
+		if limits.Limiter != nil {
+			// last, so it's held back by the size that's actually appended
+			transform = append(transform, limits.Limiter)
+		}
+		if spec.Folders {
+			return copycat.SyncFolders(spec.Source, spec.Dest, nil, jobConns, jobParallel, jobMaxConns, spec.Purge, jobDB, transform, jobGenerateIds)
+		}
+		cat, err := copycat.NewCopyCat(spec.Source, spec.Dest, jobConns, true, false)
+		defer cat.Close()
+		if err != nil {
+			return err
+		}
+		return cat.Sync(nil, spec.Purge, jobDB, 0, transform, jobGenerateIds)
+	}
+}
+
+// batch makes a sync job for each user in a CSV from a job template and either prints
+// them as JSON, to POST to a serve command's /jobs, or runs them -jobs at a time.
+func batch(args []string) {
+	if len(args) != 3 || (args[0] != "print" && args[0] != "run") {
+		log.Print("usage: copycat-imap batch [flags] print|run <template.json> <users.csv>")
+		os.Exit(1)
+	}
+	tmpl, err := ioutil.ReadFile(args[1])
+	errCheck(err, "Job Template")
+	csvFile, err := os.Open(args[2])
+	errCheck(err, "Users")
+	users, err := copycat.ReadBatchUsers(csvFile)
+	csvFile.Close()
+	errCheck(err, "Users")
+	specs, err := copycat.ExpandJobs(tmpl, users)
+	if err != nil {
+		errCheck(fmt.Errorf("%s: %s", args[2], err.Error()), "Users")
+	}
+
+	if args[0] == "print" {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, spec := range specs {
+			errCheck(encoder.Encode(spec), "Job")
+		}
+		return
+	}
+
+	setOptions()
+	report := copycat.NewReport()
+	copycat.RunReport = report
+	var tenants map[string]copycat.TenantLimits
+	if len(*tenantLimits) > 0 {
+		tenants, err = copycat.LoadTenantLimits(*tenantLimits)
+		errCheck(err, "Tenant Limits")
+	}
+	copycat.Progress = copycat.Progress.And(report.Handle)
+	queue := copycat.NewJobQueue(*jobs, tenants, runJob(report))
+	for _, spec := range specs {
+		spec.Local = true
+		_, err := queue.Submit(spec)
+		errCheck(err, "Job")
+	}
+	queue.Wait()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "source\tstate\ttook\terror")
+	failed := false
+	for _, job := range queue.List() {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", job.Spec.Source.User, job.State, job.Finished.Sub(job.Started).Truncate(time.Second), job.Error)
+		failed = failed || job.State != copycat.JobDone
+	}
+	w.Flush()
+	printReport(report)
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// inboxes reads the source and destination login info from the -config-file or the flags.
+func inboxes() (src copycat.InboxInfo, dsts []copycat.InboxInfo) {
+	if len(*configFile) > 0 || copycat.ConfigInEnv(os.Environ()) {
+		var config copycat.Config
+		if len(*configFile) > 0 {
+			configBytes, err := ioutil.ReadFile(*configFile)
+			errCheck(err, "Config File")
+			errCheck(json.Unmarshal(configBytes, &config), "Config File")
+		}
+		errCheck(config.ApplyEnv(os.Environ()), "Environment")
+		errCheck(config.Source.DiscoverHost(), "Source Host")
+		errCheck(config.Source.Validate(), "Source Creds")
+		for i := range config.Dest {
+			errCheck(config.Dest[i].DiscoverHost(), "Destination Host")
+			errCheck(config.Dest[i].Validate(), "Destination Creds")
+		}
+		return config.Source, config.Dest
+	}
+
+	src = copycat.InboxInfo{User: *srcId, Pw: *srcPw, Host: *srcHost, Admin: *srcAdmin}
+	errCheck(src.DiscoverHost(), "Source Host")
+	errCheck(src.Validate(), "Source Info")
+	dst := copycat.InboxInfo{User: *dstId, Pw: *dstPw, Host: *dstHost, Admin: *dstAdmin, Root: *dstRoot}
+	errCheck(dst.DiscoverHost(), "Destination Host")
+	errCheck(dst.Validate(), "Destination Info")
+	return src, []copycat.InboxInfo{dst}
+}
+
+// commandFolders returns the folders a command should look at: the args, every folder
+// in the source with -folders, or just the INBOX.
+func commandFolders(srcInfo copycat.InboxInfo, args []string) []string {
+	if *folders {
+		conn, err := copycat.GetConnection(srcInfo, true)
+		errCheck(err, "Source Connection")
+		defer conn.Logout(20 * time.Second)
+		names, err := copycat.ListFolders(conn)
+		errCheck(err, "Source Folders")
+		return names
+	}
+	if len(args) == 0 {
+		return []string{"INBOX"}
+	}
+	return args
+}
+
+// cache will show how much of the -db each namespace is using with 'stats' or remove a
+// namespace's messages with 'purge'. Without a namespace, every cached message is used.
+func cache(args []string) {
+	if len(args) == 0 || len(args) > 2 || (args[0] != "stats" && args[0] != "purge") {
+		log.Print("usage: copycat-imap cache [-db=...] stats|purge [namespace]")
+		os.Exit(1)
+	}
+	var namespace string
+	if len(args) == 2 {
+		namespace = args[1]
+	}
+
+	db, err := copycat.NewCache(*dbFile)
+	errCheck(err, "Cache")
+	defer db.Close()
+
+	if args[0] == "purge" {
+		if _, err = db.Purge(namespace); err != nil {
+			log.Printf("Problems purging the cache: %s", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	namespaces := []string{namespace}
+	if len(namespace) == 0 {
+		namespaces, err = db.Namespaces()
+		errCheck(err, "Cache")
+		namespaces = append(namespaces, "")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tMESSAGES\tBYTES")
+	for _, namespace := range namespaces {
+		usage, err := db.Usage(namespace)
+		errCheck(err, "Cache")
+		if len(namespace) == 0 {
+			namespace = "(all)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\n", namespace, usage.Messages, usage.Bytes)
+	}
+	w.Flush()
+}
+
+// setup walks through the source and destination logins, finding and checking their
+// servers, and writes them to the -config-file (copycat.json by default).
+func setup(args []string) {
+	in := bufio.NewReader(os.Stdin)
+	path := *configFile
+	if len(path) == 0 {
+		path = "copycat.json"
+	}
+	if _, err := os.Stat(path); err == nil && !confirm(in, fmt.Sprintf("%s already exists. Overwrite it?", path), false) {
+		return
+	}
+	fmt.Println("Passwords aren't shown as they're typed. They're saved in the config file, which only you can read.")
+
+	fmt.Println("\nThe source account, to copy from:")
+	src := setupInbox(in)
+	var dsts []copycat.InboxInfo
+	for {
+		fmt.Println("\nA destination account, to copy to:")
+		dsts = append(dsts, setupInbox(in))
+		if !confirm(in, "Add another destination?", false) {
+			break
+		}
+	}
+
+	// the same layout as -example-config
+	type account struct {
+		User  string `json:"user"`
+		Pw    string `json:"pw"`
+		Host  string `json:"host"`
+		Admin string `json:"admin,omitempty"`
+		Root  string `json:"root,omitempty"`
+	}
+	var config struct {
+		Source account   `json:"source"`
+		Dest   []account `json:"dest"`
+	}
+	config.Source = account(src)
+	for _, dst := range dsts {
+		config.Dest = append(config.Dest, account(dst))
+	}
+	raw, err := json.MarshalIndent(config, "", "    ")
+	errCheck(err, "Config")
+	// it has passwords in it, and WriteFile keeps the mode of a file that's already there
+	errCheck(ioutil.WriteFile(path, append(raw, '\n'), 0600), "Config File")
+	errCheck(os.Chmod(path, 0600), "Config File")
+
+	command := []string{os.Args[0], "-config-file=" + path, "-folders", "-sync"}
+	for _, info := range append([]copycat.InboxInfo{src}, dsts...) {
+		if profile, known := copycat.SuggestProfile(info.Host); known {
+			command = append(command, profile.Flags...)
+		}
+	}
+	fmt.Printf("\nWrote %s. To copy every folder, run:\n\n  %s\n\n", path, strings.Join(command, " "))
+}
+
+// setupInbox asks for a login until it's one that works or the user keeps it anyway.
+func setupInbox(in *bufio.Reader) copycat.InboxInfo {
+	for {
+		info := copycat.InboxInfo{User: prompt(in, "Login (usually the email address)", "")}
+		info.Pw = promptPassword(in, "Password")
+		if err := info.DiscoverHost(); err != nil {
+			fmt.Printf("Couldn't find the server: %s\n", err.Error())
+		}
+		info.Host = prompt(in, "IMAP server (host:port, over TLS)", info.Host)
+		if err := info.Validate(); err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+
+		if profile, known := copycat.SuggestProfile(info.Host); known {
+			fmt.Printf("This looks like %s. Suggested flags: %s\n", profile.Name, strings.Join(profile.Flags, " "))
+			for _, note := range profile.Notes {
+				fmt.Printf("  * %s\n", note)
+			}
+		}
+
+		fmt.Printf("Checking %s on %s...\n", info.User, info.Host)
+		health, err := copycat.Check(info)
+		if err == nil {
+			fmt.Println(health)
+			return info
+		}
+		fmt.Printf("FAILED: %s\n", err.Error())
+		if confirm(in, "Keep it anyway?", false) {
+			return info
+		}
+	}
+}
+
+// prompt asks the question and returns the answer, or def if it's left blank.
+func prompt(in *bufio.Reader, question string, def string) string {
+	if len(def) > 0 {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, err := in.ReadString('\n')
+	if err != nil && len(answer) == 0 {
+		// nothing more is coming
+		fmt.Println()
+		os.Exit(1)
+	}
+	if answer = strings.TrimSpace(answer); len(answer) == 0 {
+		return def
+	}
+	return answer
+}
+
+// promptPassword asks for a password without echoing it, when stdin is a terminal.
+// Otherwise it's read like any other answer.
+func promptPassword(in *bufio.Reader, question string) string {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return prompt(in, question, "")
+	}
+	fmt.Printf("%s: ", question)
+	pw, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		// nothing more is coming
+		os.Exit(1)
+	}
+	return string(pw)
+}
+
+// confirm asks a yes or no question.
+func confirm(in *bufio.Reader, question string, def bool) bool {
+	choices := "y/N"
+	if def {
+		choices = "Y/n"
+	}
+	switch strings.ToLower(prompt(in, question+" ("+choices+")", "")) {
+	case "y", "yes":
+		return true
+	case "n", "no":
+		return false
+	}
+	return def
+}
+
+func init() {
+	// recover runs main again, so it can't be in the map's initializer
+	commands["recover"] = recoverRun
+}
+
+// recoverRun starts the last run that didn't finish, or the run with the id in the args,
+// again with the same flags. Folders it already synced are skipped and the appends it
+// was in the middle of are checked before anything else. Passwords aren't kept with the
+// run, so they're given to recover like any other command (or in the environment).
+func recoverRun(args []string) {
+	var id string
+	if len(args) > 0 {
+		id = args[0]
+	}
+	run, err := copycat.LastRun(*dbFile, id)
+	if err == copycat.ErrNotFound {
+		log.Print("No unfinished runs found in the -db.")
+		os.Exit(1)
+	}
+	errCheck(err, "Journal")
+	if !run.Finished.IsZero() {
+		log.Printf("Run %s already finished at %s.", run.Id, run.Finished.Format(time.RFC3339))
+		os.Exit(1)
+	}
+
+	log.Printf("recovering run %s started at %s", run.Id, run.Started.Format(time.RFC3339))
+	rerun := append([]string{os.Args[0]}, run.Args...)
+	for _, name := range credentialFlags {
+		if cmdlineFlags[name] {
+			rerun = append(rerun, "-"+name+"="+flag.Lookup(name).Value.String())
+		}
+	}
+	os.Args = append(rerun, "-run-id="+run.Id)
+	main()
+}
+
+// logs prints the lines of the run with the id in the args that -log-sample held back.
+func logs(args []string) {
+	if len(args) != 1 {
+		log.Print("usage: copycat-imap logs [-db=path] <run id>")
+		os.Exit(1)
+	}
+	lines, err := copycat.JournalLog(*dbFile, args[0])
+	errCheck(err, "Journal")
+	for _, line := range lines {
+		fmt.Print(line)
+	}
+}
+
+// checksums will write a manifest of every message in the folders of the source and
+// each destination to stdout, so audit tools can check the copies themselves.
+func checksums(args []string) {
+	srcInfo, dstInfos := inboxes()
+	names := commandFolders(srcInfo, args)
+
+	w, err := copycat.NewChecksumWriter(os.Stdout, *checksumFormat)
+	errCheck(err, "Checksum Format")
+	defer w.Flush()
+
+	for _, folder := range names {
+		writeChecksums(w, srcInfo, folder)
+	}
+	for _, dstInfo := range dstInfos {
+		src, err := copycat.GetConnection(srcInfo, true)
+		errCheck(err, "Source Connection")
+		dst, err := copycat.GetConnection(dstInfo, true)
+		errCheck(err, "Destination Connection")
+		dstNames, err := copycat.DestinationFolders(src, dst, dstInfo, names)
+		errCheck(err, "Destination Folders")
+		src.Logout(20 * time.Second)
+		dst.Logout(20 * time.Second)
+
+		for _, folder := range names {
+			writeChecksums(w, dstInfo, dstNames[folder])
+		}
+	}
+}
+
+func writeChecksums(w *copycat.ChecksumWriter, info copycat.InboxInfo, folder string) {
+	conn, err := copycat.GetFolderConnection(info, folder, true)
+	if err != nil {
+		log.Printf("Unable to open folder %s in %s: %s. skipping!", folder, info.User, err.Error())
+		return
+	}
+	defer conn.Logout(20 * time.Second)
+
+	if err = copycat.WriteChecksums(conn, info.User, w); err != nil {
+		log.Printf("Problems writing checksums of folder %s in %s: %s", folder, info.User, err.Error())
+	}
+}
+
+// diff will list the messages that are only in the source, only in a destination or, with
+// -preserve-flags, have different flags, without copying anything. The folders to compare
+// are the args, or every folder with -folders. The INBOX is compared by default.
+func diff(args []string) {
+	srcInfo, dstInfos := inboxes()
+	names := commandFolders(srcInfo, args)
+
+	var differences int
+	for _, dstInfo := range dstInfos {
+		src, err := copycat.GetConnection(srcInfo, true)
+		errCheck(err, "Source Connection")
+		dst, err := copycat.GetConnection(dstInfo, true)
+		errCheck(err, "Destination Connection")
+		dstNames, err := copycat.DestinationFolders(src, dst, dstInfo, names)
+		errCheck(err, "Destination Folders")
+		src.Logout(20 * time.Second)
+		dst.Logout(20 * time.Second)
+
+		for _, folder := range names {
+			result, err := diffFolder(srcInfo, dstInfo, folder, dstNames[folder])
+			if err != nil {
+				log.Printf("Unable to compare folder %s with %s: %s", folder, dstInfo.User, err.Error())
+				differences++
+				continue
+			}
+			for _, id := range result.SourceOnly {
+				fmt.Printf("source-only\t%s\t%s\t%s\n", dstInfo.User, folder, id)
+			}
+			for _, id := range result.DestOnly {
+				fmt.Printf("destination-only\t%s\t%s\t%s\n", dstInfo.User, folder, id)
+			}
+			for _, flags := range result.FlagsDiffer {
+				fmt.Printf("flags\t%s\t%s\t%s\t%s\t%s\n", dstInfo.User, folder, flags.MessageId, strings.Join(flags.Source, " "), strings.Join(flags.Dest, " "))
+			}
+			differences += len(result.SourceOnly) + len(result.DestOnly) + len(result.FlagsDiffer)
+		}
+	}
+
+	if differences > 0 {
+		os.Exit(1)
+	}
+}
+
+// verify will compare every message in the folders with its copy in each destination and
+// print the ones that are missing or differ. The folders are picked like they are for diff
+// and -parallel-folders of them are verified at once, each over -verify-conns connections
+// to each side.
+func verify(args []string) {
+	srcInfo, dstInfos := inboxes()
+	names := commandFolders(srcInfo, args)
+	opts := copycat.VerifyOptions{Conns: *verifyConns, Transform: transformers(nil, nil)}
+
+	type verifyJob struct {
+		dstInfo   copycat.InboxInfo
+		folder    string
+		dstFolder string
+	}
+	var jobs []verifyJob
+	for _, dstInfo := range dstInfos {
+		src, err := copycat.GetConnection(srcInfo, true)
+		errCheck(err, "Source Connection")
+		dst, err := copycat.GetConnection(dstInfo, true)
+		errCheck(err, "Destination Connection")
+		dstNames, err := copycat.DestinationFolders(src, dst, dstInfo, names)
+		errCheck(err, "Destination Folders")
+		src.Logout(20 * time.Second)
+		dst.Logout(20 * time.Second)
+		for _, folder := range names {
+			jobs = append(jobs, verifyJob{dstInfo, folder, dstNames[folder]})
+		}
+	}
+
+	// the workers send everything back here so only this goroutine prints
+	type verifyResult struct {
+		job   verifyJob
+		count int
+		err   error
+	}
+	queue := make(chan verifyJob)
+	results := make(chan verifyResult)
+	problemsFound := make(chan copycat.VerifyProblem)
+	for i := 0; i < *parallelFolders || i == 0; i++ {
+		go func() {
+			for job := range queue {
+				jobOpts := opts
+				if *verifyRate > 0 {
+					jobOpts.Limiter = copycat.NewRateLimiter(*verifyRate * 1024)
+				}
+				count, err := copycat.VerifyFolder(srcInfo, job.dstInfo, job.folder, job.dstFolder, jobOpts, func(problem copycat.VerifyProblem) {
+					problemsFound <- problem
+				})
+				results <- verifyResult{job, count, err}
+			}
+		}()
+	}
+	go func() {
+		for _, job := range jobs {
+			queue <- job
+		}
+		close(queue)
+	}()
+
+	start := time.Now()
+	var problems, verified int
+	for done := 0; done < len(jobs); {
+		select {
+		case problem := <-problemsFound:
+			problems++
+			fmt.Printf("%s\t%s\t%s\t%s\n", problem.Problem, problem.Destination, problem.Folder, problem.MessageId)
+		case result := <-results:
+			done++
+			if result.err != nil {
+				log.Printf("Unable to verify folder %s with %s: %s", result.job.folder, result.job.dstInfo.User, result.err.Error())
+				problems++
+			}
+			verified += result.count
+			log.Printf("verified %d of %d folder(s), %d message(s) at %.1f msg/s", done, len(jobs), verified, float64(verified)/time.Since(start).Seconds())
+		}
+	}
+
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
+
+func diffFolder(srcInfo copycat.InboxInfo, dstInfo copycat.InboxInfo, folder string, dstFolder string) (copycat.DiffResult, error) {
+	src, err := copycat.GetFolderConnection(srcInfo, folder, true)
+	if err != nil {
+		return copycat.DiffResult{}, err
+	}
+	defer src.Logout(20 * time.Second)
+
+	dst, err := copycat.GetFolderConnection(dstInfo, dstFolder, true)
+	if err != nil {
+		return copycat.DiffResult{}, err
+	}
+	defer dst.Logout(20 * time.Second)
+
+	return copycat.Diff(src, dst, *preserveFlags)
+}
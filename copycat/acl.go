@@ -0,0 +1,117 @@
+package copycat
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// CopyACLs has SyncFolders give each folder it creates in the destinations the same
+// ACL as the source folder, if both servers have the ACL extension. ACLs that can't be
+// copied are listed in the RunReport.
+var CopyACLs bool
+
+// ACL is who has which rights on a folder (RFC 4314), ex. {"fred": "lrswipkxtecda"}.
+type ACL map[string]string
+
+// String lists the identifiers and their rights, ex. "anyone:lr fred:lrswipkxtecda".
+func (a ACL) String() string {
+	var entries []string
+	for id, rights := range a {
+		entries = append(entries, id+":"+rights)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, " ")
+}
+
+// GetACL asks the server for the folder's ACL with GETACL. The user needs the
+// administer right on the folder to read it.
+func GetACL(conn *imap.Client, folder string) (ACL, error) {
+	cmd, err := imap.Wait(conn.Send("GETACL", conn.Quote(folder)))
+	if err != nil {
+		return nil, err
+	}
+	acl := make(ACL)
+	for _, rsp := range cmd.Data {
+		// * ACL folder id rights [id rights]...
+		if rsp.Label != "ACL" || len(rsp.Fields) < 2 {
+			continue
+		}
+		for i := 2; i+1 < len(rsp.Fields); i += 2 {
+			acl[imap.AsString(rsp.Fields[i])] = imap.AsString(rsp.Fields[i+1])
+		}
+	}
+	return acl, nil
+}
+
+// reportSharedACLs adds the ACL of each of the folders in a shared namespace to the
+// RunReport, for when they aren't copied with the folders.
+func reportSharedACLs(conn *imap.Client, user string, folders []string, ns Namespaces) {
+	if !conn.Caps["ACL"] {
+		return
+	}
+	for _, folder := range folders {
+		if kind, _ := ns.shared(folder); len(kind) == 0 {
+			continue
+		}
+		acl, err := GetACL(conn, folder)
+		if err != nil {
+			log.Printf("Unable to read the ACL of shared folder %s in %s: %s", folder, user, err.Error())
+			continue
+		}
+		RunReport.ACL(user, folder, acl)
+	}
+}
+
+// SetACL gives the identifier the rights on the folder with SETACL.
+func SetACL(conn *imap.Client, folder string, id string, rights string) error {
+	_, err := imap.Wait(conn.Send("SETACL", conn.Quote(folder), conn.Quote(id), conn.Quote(rights)))
+	return err
+}
+
+// sourceACLs reads the ACL of each folder that has one for CopyACLs.
+func sourceACLs(conn *imap.Client, user string, folders []string) map[string]ACL {
+	acls := make(map[string]ACL)
+	if !conn.Caps["ACL"] {
+		log.Printf("The source %s doesn't have the ACL extension. folder ACLs won't be copied", user)
+		return acls
+	}
+	for _, folder := range folders {
+		acl, err := GetACL(conn, folder)
+		if err != nil {
+			log.Printf("Unable to read the ACL of folder %s in %s: %s", folder, user, err.Error())
+			continue
+		}
+		acls[folder] = acl
+	}
+	return acls
+}
+
+// copyACLs sets the source ACLs on the destination's folders. names is the destination
+// name of each source folder. The source user's own rights are left out since the
+// destination user owns the copies. Any rights that can't be set are reported.
+func copyACLs(conn *imap.Client, srcUser string, dstUser string, acls map[string]ACL, names map[string]string) {
+	for folder, acl := range acls {
+		delete(acl, srcUser)
+		if len(acl) == 0 {
+			continue
+		}
+		if !conn.Caps["ACL"] {
+			RunReport.ACL(dstUser, names[folder], acl)
+			continue
+		}
+
+		failed := make(ACL)
+		for id, rights := range acl {
+			if err := SetACL(conn, names[folder], id, rights); err != nil {
+				log.Printf("Unable to give %s the rights %s on folder %s in %s: %s", id, rights, names[folder], dstUser, err.Error())
+				failed[id] = rights
+			}
+		}
+		if len(failed) > 0 {
+			RunReport.ACL(dstUser, names[folder], failed)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package copycat
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopyACLs(t *testing.T) {
+	defer func(r *Report) { RunReport = r }(RunReport)
+	RunReport = NewReport()
+
+	src := newFakeServer("ACL")
+	src.acls["shared.Sales"] = ACL{"fred": "lrswipkxtecda", "bob": "lrs", "anyone": "lr"}
+	src.acls["INBOX"] = ACL{"fred": "lrswipkxtecda"}
+	srcConn := dialFake(t, src)
+	defer srcConn.Logout(time.Second)
+
+	acls := sourceACLs(srcConn, "fred", []string{"INBOX", "shared.Sales"})
+	if acls["shared.Sales"].String() != "anyone:lr bob:lrs fred:lrswipkxtecda" || acls["INBOX"].String() != "fred:lrswipkxtecda" {
+		t.Fatalf("unexpected source ACLs %v", acls)
+	}
+
+	// the owner's rights are left out, and any the destination won't set are reported
+	dst := newFakeServer("ACL")
+	dst.refuse["anyone"] = true
+	dstConn := dialFake(t, dst)
+	defer dstConn.Logout(time.Second)
+	names := map[string]string{"shared.Sales": "#shared/Sales", "INBOX": "INBOX"}
+	copyACLs(dstConn, "fred", "fred@example.com", acls, names)
+	if dst.acls["#shared/Sales"].String() != "bob:lrs" || len(dst.acls["INBOX"]) > 0 {
+		t.Errorf("unexpected destination ACLs %v", dst.acls)
+	}
+
+	// without the ACL extension on the destination, everything but the owner is reported
+	plain := dialFake(t, newFakeServer())
+	defer plain.Logout(time.Second)
+	copyACLs(plain, "fred", "other@example.com", sourceACLs(srcConn, "fred", []string{"shared.Sales"}), names)
+
+	out := RunReport.String()
+	if !strings.Contains(out, "2 folder ACL(s)") || !strings.Contains(out, "fred@example.com #shared/Sales: anyone:lr\n") || !strings.Contains(out, "other@example.com #shared/Sales: anyone:lr bob:lrs\n") {
+		t.Errorf("unexpected report:\n%s", out)
+	}
+
+	// and nothing is read from a source without it
+	if acls = sourceACLs(plain, "fred", []string{"INBOX"}); len(acls) > 0 {
+		t.Errorf("expected no ACLs from a source without the extension, got %v", acls)
+	}
+}
@@ -0,0 +1,127 @@
+package copycat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// ErrNotIdling is returned when adding a destination with nothing idling to add it to.
+var ErrNotIdling = errors.New("no continuous sync is running")
+
+// fanOut is where idle sends each new message: a storer for each destination and sink.
+// Destinations can be added to it while idling.
+type fanOut struct {
+	mu       sync.Mutex
+	requests []chan WorkRequest
+}
+
+func (f *fanOut) add(requests chan WorkRequest) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, requests)
+}
+
+// send hands the request to every storer, returning how many there were.
+func (f *fanOut) send(request WorkRequest) int {
+	f.mu.Lock()
+	requests := f.requests
+	f.mu.Unlock()
+	for _, storeRequests := range requests {
+		storeRequests <- request
+	}
+	return len(requests)
+}
+
+// liveIdle is what CopyCat.Idle is running with, for AddDestination.
+type liveIdle struct {
+	fanout      *fanOut
+	storers     *sync.WaitGroup
+	transform   Transformer
+	dbFile      string
+	generateIds bool
+
+	mu    sync.Mutex
+	added []InboxInfo
+}
+
+// AddDestination adds a destination to the running Idle without stopping it. New
+// messages are stored to it from now on, and the rest of the source's INBOX (or every
+// folder, with Folders set) is copied to it in the background with its own
+// connections, using the messages already in the -db where it can. Deletes in the
+// source are only purged from it once Idle is restarted (see Added).
+func (c *CopyCat) AddDestination(dst InboxInfo) error {
+	if c.live == nil {
+		return ErrNotIdling
+	}
+	live := c.live
+	live.mu.Lock()
+	defer live.mu.Unlock()
+	c.mu.Lock()
+	_, exists := c.IdleAppendConns.Dest[dst.User]
+	c.mu.Unlock()
+	if exists {
+		return fmt.Errorf("%s is already a destination", dst.User)
+	}
+
+	rememberRoots([]InboxInfo{dst})
+	var dstConn *imap.Client
+	var err error
+	if len(dst.Root) > 0 {
+		dstConn, err = getRootedConnection(dst, "INBOX")
+	} else {
+		dstConn, err = GetConnection(dst, false)
+	}
+	if err != nil {
+		return err
+	}
+	// taking new messages first, so none are missed while the rest are copied
+	storeRequests := make(chan WorkRequest, SearchPipelineDepth)
+	live.storers.Add(1)
+	go CheckAndAppendMessages(dstConn, dst.User, storeRequests, nil, live.transform, live.storers, nil)
+	live.fanout.add(storeRequests)
+	// so it's logged out with the rest
+	c.mu.Lock()
+	c.IdleAppendConns.Dest[dst.User] = []*imap.Client{dstConn}
+	c.mu.Unlock()
+	live.added = append(live.added, dst)
+	log.Printf("added %s as a destination, copying the rest of the mailbox to it", dst.User)
+
+	go func() {
+		if err := c.backfill(dst); err != nil {
+			log.Printf("Problems copying the mailbox to %s: %s", dst.User, err.Error())
+			return
+		}
+		log.Printf("%s is caught up", dst.User)
+	}()
+	return nil
+}
+
+// backfill copies what's already in the source to an added destination: every folder
+// with Folders set, otherwise the INBOX.
+func (c *CopyCat) backfill(dst InboxInfo) error {
+	live := c.live
+	if c.Folders {
+		return SyncFolders(c.src, []InboxInfo{dst}, nil, c.connsPerInbox, c.ParallelFolders, c.MaxConns, false, live.dbFile, live.transform, live.generateIds)
+	}
+	conns, err := initiateConnections(c.src, []InboxInfo{dst}, "INBOX", nil, c.connsPerInbox)
+	defer conns.Close()
+	if err != nil {
+		return err
+	}
+	return SearchAndStore(conns.Source, conns.Dest, nil, live.dbFile, 0, live.transform, live.generateIds)
+}
+
+// Added returns the destinations added with AddDestination, to be included when Idle
+// is set up again.
+func (c *CopyCat) Added() []InboxInfo {
+	if c.live == nil {
+		return nil
+	}
+	c.live.mu.Lock()
+	defer c.live.mu.Unlock()
+	return append([]InboxInfo(nil), c.live.added...)
+}
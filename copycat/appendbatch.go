@@ -0,0 +1,204 @@
+package copycat
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// The ways messages can be appended to a destination (see AppendMode).
+const (
+	// AppendAuto picks one of the others for each destination by its round trip time.
+	AppendAuto = "auto"
+	// AppendSingle appends a message and waits for it before appending the next.
+	AppendSingle = "single"
+	// AppendPipelined sends the APPENDs for a batch before waiting on any of them.
+	AppendPipelined = "pipelined"
+	// AppendMulti appends a batch with one APPEND, on servers with MULTIAPPEND.
+	AppendMulti = "multiappend"
+)
+
+// AppendMode is how the storers append messages to the destinations.
+var AppendMode = AppendAuto
+
+// AppendBatchBytes is the most bytes of messages appended in one batch, which is kept
+// under the destination's APPENDLIMIT if it has one.
+var AppendBatchBytes = 10 * 1024 * 1024
+
+// AppendBatchDepth is the most messages appended in one batch.
+const AppendBatchDepth = 8
+
+// batchingLatency is the round trip time above which waiting on each append costs more
+// than the append itself, so AppendAuto batches them.
+const batchingLatency = 20 * time.Millisecond
+
+// chooseAppendStrategy is the strategy for the mode on a server with the round trip
+// time, given whether it takes MULTIAPPEND.
+func chooseAppendStrategy(mode string, rtt time.Duration, multiAppend bool) string {
+	switch mode {
+	case AppendSingle, AppendPipelined:
+		return mode
+	case AppendMulti:
+		if multiAppend {
+			return AppendMulti
+		}
+		return AppendPipelined
+	}
+	if rtt < batchingLatency {
+		return AppendSingle
+	}
+	if multiAppend {
+		return AppendMulti
+	}
+	return AppendPipelined
+}
+
+// appendLimit is the APPENDLIMIT the server advertises, or 0 if there isn't one.
+func appendLimit(caps map[string]bool) int {
+	for capability := range caps {
+		if strings.HasPrefix(capability, "APPENDLIMIT=") {
+			limit, _ := strconv.Atoi(strings.TrimPrefix(capability, "APPENDLIMIT="))
+			return limit
+		}
+	}
+	return 0
+}
+
+// appendTuner picks how a storer appends to its destination. The round trip is measured
+// with a NOOP when the storer starts and again each time it keeps the connection alive,
+// and the strategy is picked again if it has changed.
+type appendTuner struct {
+	conn     *imap.Client
+	user     string
+	rtt      time.Duration
+	strategy string
+	maxBytes int
+	// set once a MULTIAPPEND fails, so it isn't picked again
+	noMulti bool
+}
+
+func newAppendTuner(conn *imap.Client, user string) *appendTuner {
+	t := &appendTuner{conn: conn, user: user, maxBytes: AppendBatchBytes}
+	if limit := appendLimit(conn.Caps); limit > 0 && limit < t.maxBytes {
+		t.maxBytes = limit
+	}
+	var best time.Duration
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if _, err := imap.Wait(conn.Noop()); err != nil {
+			break
+		}
+		if took := time.Since(start); best == 0 || took < best {
+			best = took
+		}
+	}
+	t.observe(best)
+	return t
+}
+
+// observe picks the strategy again for a new round trip time.
+func (t *appendTuner) observe(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	t.rtt = rtt
+	strategy := chooseAppendStrategy(AppendMode, rtt, t.conn.Caps["MULTIAPPEND"] && !t.noMulti)
+	if strategy == t.strategy {
+		return
+	}
+	if len(t.strategy) > 0 {
+		log.Printf("switching from %s to %s appends for %s (round trip %s)", t.strategy, strategy, t.user, rtt.Round(time.Millisecond))
+	} else {
+		log.Printf("using %s appends for %s (round trip %s)", strategy, t.user, rtt.Round(time.Millisecond))
+	}
+	t.strategy = strategy
+	RunReport.AppendStrategy(t.user, strategy, rtt)
+}
+
+// noop keeps the connection alive, timing it for observe.
+func (t *appendTuner) noop() {
+	start := time.Now()
+	if _, err := imap.Wait(t.conn.Noop()); err == nil {
+		t.observe(time.Since(start))
+	}
+}
+
+// batching says if appends should be queued for appendBatch.
+func (t *appendTuner) batching() bool {
+	return t.strategy != AppendSingle
+}
+
+// full says if the queued messages should be appended before queueing another, given
+// how many there are and their size along with the next one's.
+func (t *appendTuner) full(queued int, size int) bool {
+	return queued > 0 && (queued >= AppendBatchDepth || size > t.maxBytes)
+}
+
+// appendBatch appends the messages to the folder selected on conn, returning the UID
+// each was given if the server says (UIDPLUS) and any error appending it. A MULTIAPPEND
+// is all or nothing, so if it fails every message has the error and the tuner falls
+// back to pipelining, in case it was the batch the server didn't like.
+func (t *appendTuner) appendBatch(msgs []MessageData) ([]uint32, []error) {
+	uids := make([]uint32, len(msgs))
+	errs := make([]error, len(msgs))
+	if t.strategy == AppendMulti && len(msgs) > 1 {
+		err := Faults.appendFailure()
+		var cmd *imap.Command
+		if err == nil {
+			fields := []imap.Field{t.conn.Quote(imap.UTF7Encode(t.conn.Mailbox.Name))}
+			for _, msg := range msgs {
+				fields = append(fields, appendFlags(t.conn, msg), msg.InternalDate, msg.Literal())
+			}
+			cmd, err = imap.Wait(t.conn.Send("APPEND", fields...))
+		}
+		if err != nil {
+			log.Printf("Unable to append %d messages at once to %s: %s. appending them one at a time", len(msgs), t.user, err.Error())
+			t.strategy, t.noMulti = AppendPipelined, true
+			RunReport.AppendStrategy(t.user, t.strategy, t.rtt)
+			for i := range errs {
+				errs[i] = wrapError("append", "", err)
+			}
+			return uids, errs
+		}
+		for i, uid := range appendUIDs(cmd) {
+			if i < len(uids) {
+				uids[i] = uid
+			}
+		}
+		return uids, errs
+	}
+
+	cmds := make([]*imap.Command, len(msgs))
+	for i, msg := range msgs {
+		if errs[i] = Faults.appendFailure(); errs[i] == nil {
+			cmds[i], errs[i] = t.conn.Append(t.conn.Mailbox.Name, appendFlags(t.conn, msg), &msg.InternalDate, msg.Literal())
+		}
+	}
+	for i := range msgs {
+		cmd, err := imap.Wait(cmds[i], errs[i])
+		if err != nil {
+			errs[i] = wrapError("append", "", err)
+			continue
+		}
+		uids[i] = appendUID(cmd)
+	}
+	return uids, errs
+}
+
+// appendUIDs are the UIDs from a MULTIAPPEND's APPENDUID response code, in the order the
+// messages were appended, or nil if there isn't one.
+func appendUIDs(cmd *imap.Command) []uint32 {
+	rsp, err := cmd.Result(imap.OK)
+	if err != nil || rsp.Label != "APPENDUID" || len(rsp.Fields) == 0 {
+		return nil
+	}
+	last := rsp.Fields[len(rsp.Fields)-1]
+	if uid := imap.AsNumber(last); uid > 0 {
+		return []uint32{uid}
+	}
+	uids, _ := parseUIDSet(imap.AsAtom(last))
+	return uids
+}
@@ -0,0 +1,65 @@
+package copycat
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendStrategy(t *testing.T) {
+	tests := []struct {
+		mode        string
+		rtt         time.Duration
+		multiAppend bool
+		want        string
+	}{
+		{AppendAuto, 2 * time.Millisecond, true, AppendSingle},
+		{AppendAuto, 80 * time.Millisecond, true, AppendMulti},
+		{AppendAuto, 80 * time.Millisecond, false, AppendPipelined},
+		{AppendSingle, 80 * time.Millisecond, true, AppendSingle},
+		{AppendPipelined, 2 * time.Millisecond, true, AppendPipelined},
+		{AppendMulti, 2 * time.Millisecond, true, AppendMulti},
+		{AppendMulti, 2 * time.Millisecond, false, AppendPipelined},
+	}
+	for _, test := range tests {
+		if got := chooseAppendStrategy(test.mode, test.rtt, test.multiAppend); got != test.want {
+			t.Errorf("%s with a %s round trip (multiappend %v): expected %s, got %s", test.mode, test.rtt, test.multiAppend, test.want, got)
+		}
+	}
+
+	if limit := appendLimit(map[string]bool{"IMAP4rev1": true, "APPENDLIMIT=35651584": true}); limit != 35651584 {
+		t.Errorf("expected the APPENDLIMIT, got %d", limit)
+	}
+	if limit := appendLimit(map[string]bool{"IMAP4rev1": true}); limit != 0 {
+		t.Errorf("expected no limit, got %d", limit)
+	}
+
+	tuner := &appendTuner{maxBytes: 1000}
+	if tuner.full(0, 5000) {
+		t.Error("expected a message bigger than the batch to still be queued on its own")
+	}
+	if !tuner.full(2, 1500) {
+		t.Error("expected a batch over its size to be full")
+	}
+	if !tuner.full(AppendBatchDepth, 10) {
+		t.Error("expected a batch of AppendBatchDepth messages to be full")
+	}
+	if tuner.full(2, 500) {
+		t.Error("expected a small batch not to be full")
+	}
+}
+
+func TestReportAppendStrategy(t *testing.T) {
+	r := NewReport()
+	r.AppendStrategy("b@example.com", AppendMulti, 80*time.Millisecond)
+	r.AppendStrategy("a@example.com", AppendSingle, 2*time.Millisecond)
+	r.AppendStrategy("b@example.com", AppendPipelined, 80*time.Millisecond)
+
+	out := r.String()
+	if !strings.Contains(out, "a@example.com: single (round trip 2ms)") || !strings.Contains(out, "b@example.com: pipelined (round trip 80ms)") {
+		t.Errorf("expected the latest strategy of each destination in the report:\n%s", out)
+	}
+	if choices := r.appendChoices(); len(choices) != 2 || choices[0].Destination != "a@example.com" {
+		t.Errorf("expected the destinations in order, got %+v", choices)
+	}
+}
@@ -0,0 +1,339 @@
+package copycat
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ArchiveEML   = "eml"
+	ArchiveJSONL = "jsonl"
+
+	ManifestFile      = "manifest.jsonl"
+	archiveMessageDir = "messages"
+	archiveJSONLFile  = "messages.jsonl"
+)
+
+// ManifestEntry describes a single message in an archive. Size and SHA256 are of the
+// message as it's stored, so for an encrypted message PlainSize and PlainSHA256 are
+// those of the message itself.
+type ManifestEntry struct {
+	MessageId    string    `json:"message_id"`
+	Folder       string    `json:"folder"`
+	Flags        []string  `json:"flags"`
+	InternalDate time.Time `json:"internal_date"`
+	Size         int       `json:"size"`
+	SHA256       string    `json:"sha256"`
+	File         string    `json:"file"`
+	Encrypted    bool      `json:"encrypted,omitempty"`
+	PlainSize    int       `json:"plain_size,omitempty"`
+	PlainSHA256  string    `json:"plain_sha256,omitempty"`
+}
+
+// ArchiveMessage is a single line of an archive's messages.jsonl.
+// The body is base64 encoded.
+type ArchiveMessage struct {
+	SHA256 string `json:"sha256"`
+	Body   []byte `json:"body"`
+}
+
+// ArchiveSink is a Sink that exports messages into a directory as a
+// point-in-time backup. Each message is written as an .eml file under
+// messages/ (or as a line of messages.jsonl) and described by a line in
+// manifest.jsonl. Messages already in the manifest are skipped, so an archive
+// can be brought up to date by running against it again. If Encrypted is set,
+// the messages are expected to have been encrypted by an EncryptedSink and
+// are written as .eml.gpg files.
+type ArchiveSink struct {
+	Dir       string
+	Format    string
+	Encrypted bool
+
+	mu       sync.Mutex
+	seen     map[string]bool
+	manifest *os.File
+	messages *os.File
+}
+
+// NewArchiveSink will open or create an archive in the given directory.
+func NewArchiveSink(dir string, format string) (*ArchiveSink, error) {
+	if format != ArchiveEML && format != ArchiveJSONL {
+		return nil, fmt.Errorf("unknown archive format: %q", format)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, archiveMessageDir), 0755); err != nil {
+		return nil, err
+	}
+
+	entries, err := ReadManifest(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	a := &ArchiveSink{Dir: dir, Format: format, seen: make(map[string]bool)}
+	for _, entry := range entries {
+		a.seen[entry.Folder+"\x00"+entry.MessageId] = true
+	}
+
+	if a.manifest, err = os.OpenFile(filepath.Join(dir, ManifestFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+		return nil, err
+	}
+
+	if format == ArchiveJSONL {
+		if a.messages, err = os.OpenFile(filepath.Join(dir, archiveJSONLFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			a.manifest.Close()
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// ReadManifest will read all of the entries in an archive's manifest.
+func ReadManifest(dir string) ([]ManifestEntry, error) {
+	file, err := os.Open(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []ManifestEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry ManifestEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func (a *ArchiveSink) Has(folder string, messageId string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.seen[folder+"\x00"+messageId], nil
+}
+
+func (a *ArchiveSink) Put(folder string, messageId string, msg MessageData) error {
+	sum := sha256.Sum256(msg.Body)
+	digest := hex.EncodeToString(sum[:])
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry := ManifestEntry{
+		MessageId:    messageId,
+		Folder:       folder,
+		Flags:        msg.Flags,
+		InternalDate: msg.InternalDate,
+		Size:         len(msg.Body),
+		SHA256:       digest,
+		Encrypted:    a.Encrypted,
+	}
+	if a.Encrypted {
+		entry.PlainSize, entry.PlainSHA256 = msg.plainSize, msg.plainSHA256
+	}
+
+	switch a.Format {
+	case ArchiveEML:
+		entry.File = filepath.Join(archiveMessageDir, digest+".eml")
+		if a.Encrypted {
+			entry.File += ".gpg"
+		}
+		if err := writeFileAtomic(filepath.Join(a.Dir, entry.File), msg.Body); err != nil {
+			return err
+		}
+	case ArchiveJSONL:
+		entry.File = archiveJSONLFile
+		if err := writeJSONLine(a.messages, ArchiveMessage{SHA256: digest, Body: msg.Body}); err != nil {
+			return err
+		}
+	}
+
+	if err := writeJSONLine(a.manifest, entry); err != nil {
+		return err
+	}
+	a.seen[folder+"\x00"+messageId] = true
+	return nil
+}
+
+func (a *ArchiveSink) Close() error {
+	if a.messages != nil {
+		a.messages.Close()
+	}
+	return a.manifest.Close()
+}
+
+func writeJSONLine(file *os.File, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// writeFileAtomic writes to a temp file first so a crash never leaves a partial message behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0644); err == nil {
+		_, err = tmp.Write(data)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ArchiveSource is a MessageSource that replays an archive written by an ArchiveSink.
+// Encrypted messages are decrypted with gpg as they are fetched.
+type ArchiveSource struct {
+	Dir string
+
+	entries []ManifestEntry
+
+	mu       sync.Mutex
+	messages *os.File
+	offsets  map[string]int64
+}
+
+// NewArchiveSource will open the archive in the given directory.
+func NewArchiveSource(dir string) (*ArchiveSource, error) {
+	entries, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &ArchiveSource{Dir: dir, entries: entries}, nil
+}
+
+func (a *ArchiveSource) List() ([]SourceMessage, error) {
+	msgs := make([]SourceMessage, len(a.entries))
+	for i, entry := range a.entries {
+		msgs[i] = SourceMessage{Folder: entry.Folder, MessageId: entry.MessageId, Key: strconv.Itoa(i)}
+	}
+	return msgs, nil
+}
+
+func (a *ArchiveSource) Fetch(msg SourceMessage) (MessageData, error) {
+	indx, err := strconv.Atoi(msg.Key)
+	if err != nil || indx < 0 || indx >= len(a.entries) {
+		return MessageData{}, NotFound
+	}
+	entry := a.entries[indx]
+
+	var body []byte
+	if entry.File == archiveJSONLFile {
+		body, err = a.readJSONL(entry.SHA256)
+	} else {
+		body, err = ioutil.ReadFile(filepath.Join(a.Dir, entry.File))
+	}
+	if err != nil {
+		return MessageData{}, err
+	}
+
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != entry.SHA256 {
+		return MessageData{}, fmt.Errorf("digest mismatch for %s", entry.File)
+	}
+
+	if entry.Encrypted {
+		if body, err = GPGDecrypt(body); err != nil {
+			return MessageData{}, err
+		}
+		sum = sha256.Sum256(body)
+		if len(entry.PlainSHA256) > 0 && hex.EncodeToString(sum[:]) != entry.PlainSHA256 {
+			return MessageData{}, fmt.Errorf("digest mismatch for %s once decrypted", entry.File)
+		}
+	}
+
+	return MessageData{InternalDate: entry.InternalDate, Flags: entry.Flags, Body: body}, nil
+}
+
+// readJSONL will find a message in messages.jsonl by its digest. The offset of
+// every line is indexed the first time it is called.
+func (a *ArchiveSource) readJSONL(digest string) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.messages == nil {
+		file, err := os.Open(filepath.Join(a.Dir, archiveJSONLFile))
+		if err != nil {
+			return nil, err
+		}
+		if a.offsets, err = indexJSONL(file); err != nil {
+			file.Close()
+			return nil, err
+		}
+		a.messages = file
+	}
+
+	offset, exists := a.offsets[digest]
+	if !exists {
+		return nil, NotFound
+	}
+	if _, err := a.messages.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	line, err := bufio.NewReader(a.messages).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var message ArchiveMessage
+	if err = json.Unmarshal(line, &message); err != nil {
+		return nil, err
+	}
+	return message.Body, nil
+}
+
+func indexJSONL(file *os.File) (map[string]int64, error) {
+	offsets := make(map[string]int64)
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var message struct {
+				SHA256 string `json:"sha256"`
+			}
+			if jsonErr := json.Unmarshal(line, &message); jsonErr == nil {
+				offsets[message.SHA256] = offset
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			return offsets, nil
+		}
+		if err != nil {
+			return offsets, err
+		}
+	}
+}
+
+func (a *ArchiveSource) Close() error {
+	if a.messages != nil {
+		return a.messages.Close()
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package copycat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	for _, format := range []string{ArchiveEML, ArchiveJSONL} {
+		dir, err := ioutil.TempDir("", "archivetest")
+		if err != nil {
+			t.Errorf("unable to create temp dir - %s", err.Error())
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		sink, err := NewArchiveSink(dir, format)
+		if err != nil {
+			t.Errorf("unable to create %s archive - %s", format, err.Error())
+			return
+		}
+
+		msgs := map[string]MessageData{
+			"<1@example.com>": {InternalDate: time.Now().UTC(), Flags: []string{`\Seen`}, Body: []byte("Message-Id: <1@example.com>\r\n\r\none")},
+			"<2@example.com>": {InternalDate: time.Now().UTC(), Body: []byte("Message-Id: <2@example.com>\r\n\r\ntwo")},
+		}
+		for id, msg := range msgs {
+			if err = sink.Put("INBOX", id, msg); err != nil {
+				t.Errorf("unable to put in %s archive - %s", format, err.Error())
+				return
+			}
+		}
+		sink.Close()
+
+		// reopening should remember what it has
+		if sink, err = NewArchiveSink(dir, format); err != nil {
+			t.Errorf("unable to reopen %s archive - %s", format, err.Error())
+			return
+		}
+		if has, _ := sink.Has("INBOX", "<1@example.com>"); !has {
+			t.Errorf("reopened %s archive is missing a message", format)
+		}
+		sink.Close()
+
+		source, err := NewArchiveSource(dir)
+		if err != nil {
+			t.Errorf("unable to open %s archive source - %s", format, err.Error())
+			return
+		}
+
+		listed, _ := source.List()
+		if len(listed) != len(msgs) {
+			t.Errorf("%s archive listed %d messages - expected %d", format, len(listed), len(msgs))
+		}
+		for _, item := range listed {
+			got, err := source.Fetch(item)
+			if err != nil {
+				t.Errorf("unable to fetch from %s archive - %s", format, err.Error())
+				continue
+			}
+
+			want := msgs[item.MessageId]
+			if string(got.Body) != string(want.Body) || !got.InternalDate.Equal(want.InternalDate) || len(got.Flags) != len(want.Flags) {
+				t.Errorf("%s archive returned %v - expected %v", format, got, want)
+			}
+			if item.Folder != "INBOX" {
+				t.Errorf("%s archive returned folder %s - expected INBOX", format, item.Folder)
+			}
+		}
+		source.Close()
+	}
+}
+
+func TestEncryptedArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archivetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a stand-in for gpg that "encrypts" by adding a line and decrypts by taking it off
+	defer func(command string) { GPGCommand = command }(GPGCommand)
+	GPGCommand = filepath.Join(dir, "gpg")
+	script := "#!/bin/sh\ncase \"$*\" in *--decrypt*) tail -n +2 ;; *--recipient\\ 123456789ABCDEF0123456789ABCDEF012345678*) echo encrypted; cat ;; *) exit 2 ;; esac\n"
+	if err = ioutil.WriteFile(GPGCommand, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := NewArchiveSink(filepath.Join(dir, "archive"), ArchiveEML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive.Encrypted = true
+	sink := &EncryptedSink{Sink: archive, Recipients: []string{"0x1234 5678 9ABC DEF0 1234 5678 9abc def0 1234 5678"}}
+	body := []byte("Message-Id: <1@example.com>\r\n\r\none")
+	if err = sink.Put("INBOX", "<1@example.com>", MessageData{Body: body}); err != nil {
+		t.Fatal(err)
+	}
+	archive.Close()
+
+	entries, err := ReadManifest(filepath.Join(dir, "archive"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one manifest entry, got %v (%v)", entries, err)
+	}
+	entry := entries[0]
+	plain := sha256.Sum256(body)
+	if entry.PlainSHA256 != hex.EncodeToString(plain[:]) || entry.PlainSize != len(body) {
+		t.Errorf("expected the plaintext's digest and size in the manifest, got %s and %d", entry.PlainSHA256, entry.PlainSize)
+	}
+	stored := sha256.Sum256(append([]byte("encrypted\n"), body...))
+	if entry.SHA256 != hex.EncodeToString(stored[:]) || entry.Size != len(body)+len("encrypted\n") {
+		t.Errorf("expected the stored file's digest and size in the manifest, got %s and %d", entry.SHA256, entry.Size)
+	}
+
+	source, err := NewArchiveSource(filepath.Join(dir, "archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	listed, _ := source.List()
+	if msg, err := source.Fetch(listed[0]); err != nil || string(msg.Body) != string(body) {
+		t.Errorf("expected the decrypted message back, got %q (%v)", msg.Body, err)
+	}
+}
+
+func TestGPGFingerprint(t *testing.T) {
+	tests := map[string]string{
+		"123456789ABCDEF0123456789ABCDEF012345678":                   "123456789ABCDEF0123456789ABCDEF012345678",
+		" 1234 5678 9abc def0 1234  5678 9ABC DEF0 1234 5678 ":       "123456789ABCDEF0123456789ABCDEF012345678",
+		"0x123456789ABCDEF0123456789ABCDEF012345678":                 "123456789ABCDEF0123456789ABCDEF012345678",
+		"archive@example.com":                                        "",
+		"Archive Key":                                                "",
+		"9ABCDEF012345678":                                           "",
+		"123456789ABCDEF0123456789ABCDEF01234567G":                   "",
+		"123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789A": "",
+	}
+	for recipient, expected := range tests {
+		got, err := GPGFingerprint(recipient)
+		if got != expected || (err == nil) != (len(expected) > 0) {
+			t.Errorf("GPGFingerprint(%q) = %q, %v - expected %q", recipient, got, err, expected)
+		}
+	}
+}
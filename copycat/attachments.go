@@ -0,0 +1,334 @@
+package copycat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ModifiedHeader is added to messages an AttachmentPolicy changed, saying what it did.
+const ModifiedHeader = "X-Copycat-Modified"
+
+// AttachmentExecutables can be used in an AttachmentPolicy's Strip or Skip for the file
+// types that run code when opened.
+const AttachmentExecutables = "executables"
+
+var executableTypes = []string{
+	".exe", ".com", ".bat", ".cmd", ".scr", ".pif", ".cpl", ".msi", ".msp", ".dll",
+	".vbs", ".vbe", ".js", ".jse", ".wsf", ".wsh", ".hta", ".ps1", ".jar", ".lnk",
+	"application/x-msdownload", "application/x-msdos-program", "application/x-dosexec",
+	"application/x-executable", "application/x-ms-installer", "application/java-archive",
+}
+
+// AttachmentPolicy is a Transformer that walks each message's MIME parts and deals with
+// its attachments: messages with an attachment matching Skip are left out, attachments
+// matching Strip are removed, and attachments larger than DetachOver are saved to
+// DetachDir and removed. Types are either a file extension (ex. ".exe") or a MIME type
+// (ex. "application/zip" or "video/*"), ignoring case. Each attachment taken out is
+// replaced with a short text part saying what it was, the message gets an
+// X-Copycat-Modified header and the change is noted in the Report. Parts that aren't
+// changed are copied byte for byte.
+type AttachmentPolicy struct {
+	Skip       []string
+	Strip      []string
+	DetachOver int
+	DetachDir  string
+	Report     *Report
+}
+
+// NewAttachmentPolicy expands "executables" in the types and checks there's somewhere to
+// detach attachments to.
+func NewAttachmentPolicy(skip []string, strip []string, detachOver int, detachDir string) (*AttachmentPolicy, error) {
+	if detachOver > 0 && len(detachDir) == 0 {
+		return nil, fmt.Errorf("a directory is needed to detach attachments to")
+	}
+	if len(detachDir) > 0 {
+		if err := os.MkdirAll(detachDir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &AttachmentPolicy{Skip: expandTypes(skip), Strip: expandTypes(strip), DetachOver: detachOver, DetachDir: detachDir}, nil
+}
+
+func expandTypes(types []string) []string {
+	var expanded []string
+	for _, t := range types {
+		if strings.EqualFold(t, AttachmentExecutables) {
+			expanded = append(expanded, executableTypes...)
+			continue
+		}
+		if !strings.Contains(t, "/") && !strings.HasPrefix(t, ".") {
+			t = "." + t
+		}
+		expanded = append(expanded, t)
+	}
+	return expanded
+}
+
+func (p *AttachmentPolicy) Transform(msg MessageData) (MessageData, error) {
+	header, content, hasContent := splitMessage(toCRLF(msg.Body))
+	if !hasContent {
+		return msg, nil
+	}
+	fields := headerFields(header)
+	id := messageId(msg.Body)
+
+	var changes []string
+	fields, content, skip, err := p.entity(fields, content, &changes)
+	if err != nil {
+		log.Printf("Couldn't apply the attachment policy to %s: %s", id, err)
+		return msg, err
+	}
+	if len(skip) > 0 {
+		log.Printf("Skipping %s, it has the attachment %s", id, skip)
+		Stats.Add("skipped_attachments", 1)
+		return msg, ErrSkipMessage
+	}
+	if len(changes) == 0 {
+		return msg, nil
+	}
+
+	msg.Body = joinMessage(append(modifiedHeader(changes), bytes.Join(fields, nil)...), content, true)
+	Stats.Add("altered_attachments", 1)
+	p.Report.Altered(id, strings.Join(changes, ", "))
+	return msg, nil
+}
+
+// modifiedHeader is the ModifiedHeader listing the changes, with the ones that aren't
+// ASCII encoded (RFC 2047) and folded to fit in 78 columns.
+func modifiedHeader(changes []string) []byte {
+	encoded := make([]string, len(changes))
+	for i, change := range changes {
+		encoded[i] = mime.QEncoding.Encode("utf-8", change)
+	}
+	var out bytes.Buffer
+	out.WriteString(ModifiedHeader + ":")
+	column := out.Len()
+	for _, word := range strings.Split(strings.Join(encoded, "; "), " ") {
+		if column+1+len(word) > 78 {
+			out.WriteString("\r\n")
+			column = 0
+		}
+		out.WriteString(" " + word)
+		column += 1 + len(word)
+	}
+	out.WriteString("\r\n")
+	return out.Bytes()
+}
+
+// entity applies the policy to a message or one of its parts, and the parts in it if
+// it's multipart. It stops at the first attachment that means the message is skipped.
+func (p *AttachmentPolicy) entity(fields [][]byte, content []byte, changes *[]string) ([][]byte, []byte, string, error) {
+	mediaType, params, _ := mime.ParseMediaType(fieldValue(fields, "Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if len(params["boundary"]) == 0 {
+			return fields, content, "", nil
+		}
+		content, skip, err := p.multipart(content, params["boundary"], changes)
+		return fields, content, skip, err
+	}
+
+	name := attachmentName(fields, params)
+	if len(name) == 0 {
+		return fields, content, "", nil
+	}
+	if matchesType(p.Skip, name, mediaType) {
+		return fields, content, name, nil
+	}
+	if matchesType(p.Strip, name, mediaType) {
+		*changes = append(*changes, "stripped "+name)
+		fields, content = replacePart(fields, fmt.Sprintf("The attachment %s (%s) was removed when this message was copied.", name, mediaType))
+		return fields, content, "", nil
+	}
+	if p.DetachOver > 0 && len(content) > p.DetachOver {
+		data, err := decodeContent(fieldValue(fields, "Content-Transfer-Encoding"), content)
+		if err != nil {
+			// the part is left as it is rather than losing the message over it
+			log.Printf("Couldn't decode the attachment %s to detach it: %s", name, err)
+			return fields, content, "", nil
+		}
+		if len(data) <= p.DetachOver {
+			return fields, content, "", nil
+		}
+		file, err := p.detach(name, data)
+		if err != nil {
+			return fields, content, "", err
+		}
+		*changes = append(*changes, "detached "+name)
+		fields, content = replacePart(fields, fmt.Sprintf("The attachment %s (%s, %d KB) was detached to %s when this message was copied.", name, mediaType, len(data)/1024, file))
+	}
+	return fields, content, "", nil
+}
+
+// multipart applies the policy to each of the parts between the boundary's delimiter
+// lines, leaving the preamble, the delimiters and the epilogue as they were. A last part
+// without a closing delimiter runs to the end of the content.
+func (p *AttachmentPolicy) multipart(content []byte, boundary string, changes *[]string) ([]byte, string, error) {
+	delimiter := []byte("--" + boundary)
+	var out []byte
+	start := -1 // where the current part begins
+	copied := 0
+	part := func(partEnd int) (string, error) {
+		header, body, hasBody := splitMessage(content[start:partEnd])
+		fields, body, skip, err := p.entity(headerFields(header), body, changes)
+		if len(skip) > 0 || err != nil {
+			return skip, err
+		}
+		out = append(out, content[copied:start]...)
+		out = append(out, joinMessage(bytes.Join(fields, nil), body, hasBody)...)
+		copied = partEnd
+		return "", nil
+	}
+	closed := false
+	for offset := 0; offset < len(content); {
+		end := bytes.Index(content[offset:], []byte("\r\n"))
+		next := offset + end + 2
+		if end < 0 {
+			end, next = len(content)-offset, len(content)
+		}
+		line := bytes.TrimRight(content[offset:offset+end], " \t")
+		if bytes.HasPrefix(line, delimiter) && (len(line) == len(delimiter) || bytes.Equal(line[len(delimiter):], []byte("--"))) {
+			if start >= 0 {
+				// the CRLF before a delimiter belongs to the delimiter
+				partEnd := offset - 2
+				if partEnd < start {
+					partEnd = start
+				}
+				if skip, err := part(partEnd); len(skip) > 0 || err != nil {
+					return content, skip, err
+				}
+			}
+			start = next
+			if len(line) > len(delimiter) {
+				closed = true
+				break
+			}
+		}
+		offset = next
+	}
+	if !closed && start >= 0 && start < len(content) {
+		if skip, err := part(len(content)); len(skip) > 0 || err != nil {
+			return content, skip, err
+		}
+	}
+	return append(out, content[copied:]...), "", nil
+}
+
+// detach saves the attachment to the DetachDir under a hash of its content, so the same
+// attachment is only saved once however many messages it's in.
+func (p *AttachmentPolicy) detach(name string, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	file := filepath.Join(p.DetachDir, hex.EncodeToString(sum[:12])+"-"+safeFileName(name))
+	if _, err := os.Stat(file); err == nil {
+		return file, nil
+	}
+	return file, ioutil.WriteFile(file, data, 0600)
+}
+
+// attachmentName is the part's file name, or "" if it isn't an attachment.
+func attachmentName(fields [][]byte, params map[string]string) string {
+	disposition, dispositionParams, _ := mime.ParseMediaType(fieldValue(fields, "Content-Disposition"))
+	name := dispositionParams["filename"]
+	if len(name) == 0 {
+		name = params["name"]
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	// it ends up in a header, where a line break would start a field of its own
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	if len(name) == 0 && disposition == "attachment" {
+		name = "unnamed"
+	}
+	return name
+}
+
+// matchesType is true if the file name's extension or the media type is one of the types.
+func matchesType(types []string, name string, mediaType string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, t := range types {
+		t = strings.ToLower(t)
+		switch {
+		case strings.HasPrefix(t, "."):
+			if t == ext {
+				return true
+			}
+		case strings.HasSuffix(t, "/*"):
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+				return true
+			}
+		case t == mediaType:
+			return true
+		}
+	}
+	return false
+}
+
+// replacePart replaces a part's content with a line of text, dropping the Content-
+// fields that described what was there.
+func replacePart(fields [][]byte, text string) ([][]byte, []byte) {
+	var kept [][]byte
+	for _, field := range fields {
+		if colon := bytes.IndexByte(field, ':'); colon < 0 || !strings.HasPrefix(strings.ToLower(string(bytes.TrimSpace(field[:colon]))), "content-") {
+			kept = append(kept, field)
+		}
+	}
+	kept = append(kept, []byte("Content-Type: text/plain; charset=utf-8\r\n"), []byte("Content-Disposition: inline\r\n"))
+	return kept, []byte(text + "\r\n")
+}
+
+func decodeContent(encoding string, content []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if isSpace(byte(r)) {
+				return -1
+			}
+			return r
+		}, content)
+		return base64.StdEncoding.DecodeString(string(clean))
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(content)))
+	}
+	return content, nil
+}
+
+// fieldValue is the unfolded value of the named field, or "".
+func fieldValue(fields [][]byte, name string) string {
+	for _, field := range fields {
+		colon := bytes.IndexByte(field, ':')
+		if colon >= 0 && strings.EqualFold(strings.TrimSpace(string(field[:colon])), name) {
+			return strings.TrimSpace(unfold(string(field[colon+1:])))
+		}
+	}
+	return ""
+}
+
+// safeFileName keeps an attachment's name from leaving the directory it's saved to.
+func safeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name = strings.TrimLeft(name, "."); len(name) == 0 {
+		return "attachment"
+	}
+	return name
+}
@@ -0,0 +1,121 @@
+package copycat
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	big := strings.Repeat("QUJD", 400)
+	msg := "Message-Id: <1@example.com>\r\nContent-Type: multipart/mixed; boundary=\"b\"\r\n\r\npreamble\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n" +
+		"--b\r\nContent-Type: application/octet-stream; name=\"setup.EXE\"\r\nContent-Disposition: attachment\r\n\r\nMZ\r\n" +
+		"--b\r\nContent-Type: application/pdf\r\nContent-Transfer-Encoding: base64\r\nContent-Disposition: attachment; filename=\"big.pdf\"\r\n\r\n" + big + "\r\n" +
+		"--b--\r\nepilogue\r\n"
+
+	policy, err := NewAttachmentPolicy(nil, []string{"executables"}, 1000, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := policy.Transform(MessageData{Body: []byte(msg)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(got.Body)
+	for _, want := range []string{
+		"X-Copycat-Modified: stripped setup.EXE; detached big.pdf\r\n",
+		"preamble\r\n--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n--b\r\n",
+		"The attachment setup.EXE (application/octet-stream) was removed",
+		"--b--\r\nepilogue\r\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the message:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "MZ") || strings.Contains(body, big) {
+		t.Errorf("expected the attachments to be gone:\n%s", body)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*-big.pdf"))
+	if len(files) != 1 {
+		t.Fatalf("expected big.pdf to be detached, got %v", files)
+	}
+	if data, _ := ioutil.ReadFile(files[0]); len(data) != 1200 {
+		t.Errorf("expected the decoded attachment, got %d bytes", len(data))
+	}
+
+	// nothing to do leaves the message alone
+	policy, _ = NewAttachmentPolicy(nil, []string{"zip"}, 0, "")
+	if got, _ = policy.Transform(MessageData{Body: []byte(msg)}); string(got.Body) != msg {
+		t.Errorf("expected the message to be unchanged:\n%s", got.Body)
+	}
+
+	policy, _ = NewAttachmentPolicy([]string{"application/*"}, nil, 0, "")
+	if _, err = policy.Transform(MessageData{Body: []byte(msg)}); err != ErrSkipMessage {
+		t.Errorf("expected the message to be skipped, got %v", err)
+	}
+	if _, err = NewAttachmentPolicy(nil, nil, 1, ""); err == nil {
+		t.Error("expected an error detaching without a directory")
+	}
+
+	// a last part without its closing delimiter is still looked at
+	unclosed := "Message-Id: <2@example.com>\r\nContent-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n" +
+		"--b\r\nContent-Type: application/octet-stream; name=\"setup.exe\"\r\n\r\nMZ\r\n"
+	policy, _ = NewAttachmentPolicy(nil, []string{"executables"}, 0, "")
+	if got, err = policy.Transform(MessageData{Body: []byte(unclosed)}); err != nil || strings.Contains(string(got.Body), "MZ") {
+		t.Errorf("expected the unclosed part to be stripped, got %v:\n%s", err, got.Body)
+	}
+
+	// an attachment that can't be decoded is left as it is
+	bad := strings.Replace(msg, big, "!!"+big, 1)
+	policy, _ = NewAttachmentPolicy(nil, nil, 1000, dir)
+	if got, err = policy.Transform(MessageData{Body: []byte(bad)}); err != nil || string(got.Body) != bad {
+		t.Errorf("expected the message to be unchanged, got %v:\n%s", err, got.Body)
+	}
+
+	// names are encoded in the header and can't break out of it
+	names := "Message-Id: <3@example.com>\r\nContent-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+		"--b\r\nContent-Type: application/octet-stream; name=\"=?utf-8?q?na=C3=AFve_r=C3=A9sum=C3=A9_for_the_interview_next_week.EXE?=\"\r\n\r\nMZ\r\n" +
+		"--b\r\nContent-Type: application/octet-stream; name=\"=?utf-8?q?evil=0D=0ABcc:_victim@example.com.EXE?=\"\r\n\r\nMZ\r\n" +
+		"--b--\r\n"
+	policy, _ = NewAttachmentPolicy(nil, []string{"executables"}, 0, "")
+	if got, err = policy.Transform(MessageData{Body: []byte(names)}); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(got.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Header["Bcc"]) > 0 {
+		t.Errorf("expected the line break in the name to be stripped:\n%s", got.Body)
+	}
+	modified, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get(ModifiedHeader))
+	if want := "stripped naïve résumé for the interview next week.EXE; stripped evilBcc: victim@example.com.EXE"; err != nil || modified != want {
+		t.Errorf("expected %q, got %q (%v)", want, modified, err)
+	}
+	header := string(got.Body[:bytes.Index(got.Body, []byte("\r\n\r\n"))])
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("expected the header to be folded, got a line of %d: %q", len(line), line)
+		}
+	}
+
+	// but one that can't be detached fails the message
+	policy, _ = NewAttachmentPolicy(nil, nil, 1000, filepath.Join(dir, "gone"))
+	os.Remove(policy.DetachDir)
+	if _, err = policy.Transform(MessageData{Body: []byte(msg)}); err == nil || err == ErrSkipMessage {
+		t.Errorf("expected an error detaching to a missing directory, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package copycat
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AnyTenant is the tenant of the API tokens that can act for every tenant and use the
+// run controls.
+const AnyTenant = "*"
+
+// APITokens are the bearer tokens the serve command's API accepts, each with the tenant
+// its jobs are for. A job submitted with a token is always for the token's tenant, and
+// the token only sees and cancels that tenant's jobs.
+type APITokens map[string]string
+
+// LoadAPITokens reads a line for each token followed by its tenant, or * for one that
+// can act for any tenant, ex:
+//
+//	# token                           tenant
+//	3f9a0c6e5b1d47a2b8c4e6f1a2b3c4d5  acme
+//	9b8a7c6d5e4f30211f2e3d4c5b6a7980  *
+func LoadAPITokens(file string) (APITokens, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(APITokens)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a token followed by its tenant", file, line)
+		}
+		if len(fields[0]) < 16 {
+			return nil, fmt.Errorf("%s:%d: the token is too short, use at least 16 characters", file, line)
+		}
+		tokens[fields[0]] = fields[1]
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", file)
+	}
+	return tokens, nil
+}
+
+// tenant returns the tenant of the request's bearer token, and false if it doesn't
+// have one of the tokens.
+func (t APITokens) tenant(r *http.Request) (string, bool) {
+	return t.bearer(r.Header.Get("Authorization"))
+}
+
+// bearer returns the tenant of the token in an Authorization header, and false if it
+// isn't one of the tokens.
+func (t APITokens) bearer(auth string) (string, bool) {
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	given := []byte(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+	for token, tenant := range t {
+		if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+			return tenant, true
+		}
+	}
+	return "", false
+}
+
+// Admin only lets requests with a token for AnyTenant through to the handler.
+func (t APITokens) Admin(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tenant, ok := t.tenant(r); !ok || tenant != AnyTenant {
+			unauthorized(w)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="copycat-imap"`)
+	writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "a valid API token is required"})
+}
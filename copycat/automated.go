@@ -0,0 +1,135 @@
+package copycat
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+)
+
+// The kinds of automated messages an AutomatedFilter can leave out.
+const (
+	// AutomatedBounces are delivery status notifications: bounces and delay warnings.
+	AutomatedBounces = "bounces"
+	// AutomatedCalendarReplies are the accepted, declined and tentative responses to
+	// meeting invitations. The invitations themselves are kept.
+	AutomatedCalendarReplies = "calendar-replies"
+	// AutomatedAutoReplies are out of office and other automatic replies.
+	AutomatedAutoReplies = "auto-replies"
+)
+
+// AutomatedKinds are all of the kinds, in the order messages are checked for them.
+var AutomatedKinds = []string{AutomatedBounces, AutomatedCalendarReplies, AutomatedAutoReplies}
+
+// ParseAutomatedKinds reads a comma separated list of AutomatedKinds, where "all" is
+// every one of them.
+func ParseAutomatedKinds(list string) ([]string, error) {
+	var kinds []string
+	for _, kind := range ParseFlags(list) {
+		if kind == "all" {
+			return AutomatedKinds, nil
+		}
+		if !listed(AutomatedKinds, kind) {
+			return nil, fmt.Errorf("unknown kind of automated message %q, expected %s or all", kind, strings.Join(AutomatedKinds, ", "))
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
+
+// AutomatedFilter is a Transformer that skips the automated messages of its Kinds,
+// recognized by their headers and content type, to keep the noise out of an archive.
+type AutomatedFilter struct {
+	Kinds []string
+}
+
+func (f AutomatedFilter) Transform(msg MessageData) (MessageData, error) {
+	header, _ := ParseHeader(msg.Body)
+	if header == nil {
+		return msg, nil
+	}
+	if kind := automatedKind(header, msg.Body); len(kind) > 0 && listed(f.Kinds, kind) {
+		log.Printf("Skipping %s, it's one of the %s", header.Get("Message-Id"), kind)
+		Stats.Add("skipped_automated", 1)
+		return msg, ErrSkipMessage
+	}
+	return msg, nil
+}
+
+// the Subject prefixes mail servers give bounces and auto-replies that don't say what
+// they are in their headers
+var (
+	bounceSubjects    = []string{"undeliverable:", "undelivered mail", "delivery status notification", "returned mail:", "mail delivery failed", "delivery failure"}
+	autoReplySubjects = []string{"automatic reply:", "auto-reply:", "autoreply:", "out of office", "out of the office"}
+)
+
+// automatedKind says which of the AutomatedKinds the message is, or "" if it isn't one.
+func automatedKind(header mail.Header, body []byte) string {
+	mediaType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	subject := strings.ToLower(strings.TrimSpace(header.Get("Subject")))
+	from := strings.ToLower(header.Get("From"))
+
+	// RFC 3464, or a sender and subject that can only be a bounce
+	if mediaType == "multipart/report" && strings.EqualFold(params["report-type"], "delivery-status") ||
+		len(header.Get("X-Failed-Recipients")) > 0 ||
+		(strings.Contains(from, "mailer-daemon") || strings.Contains(from, "postmaster")) && hasPrefix(subject, bounceSubjects) {
+		return AutomatedBounces
+	}
+
+	// an iTIP REPLY (RFC 5546), on its own or as one of the message's parts
+	if isCalendarReply(mediaType, params) ||
+		strings.HasPrefix(mediaType, "multipart/") && hasCalendarReplyPart(body, params["boundary"]) {
+		return AutomatedCalendarReplies
+	}
+
+	// RFC 3834 or the headers mail clients and servers used before it. Outlook's subject
+	// only counts when the headers also say the message was sent automatically.
+	autoSubmitted := strings.ToLower(strings.TrimSpace(header.Get("Auto-Submitted")))
+	if strings.HasPrefix(autoSubmitted, "auto-replied") ||
+		len(header.Get("X-Autoreply")) > 0 || len(header.Get("X-Autorespond")) > 0 ||
+		strings.EqualFold(strings.TrimSpace(header.Get("Precedence")), "auto_reply") {
+		return AutomatedAutoReplies
+	}
+	automatic := len(autoSubmitted) > 0 && autoSubmitted != "no" || len(header.Get("X-Auto-Response-Suppress")) > 0
+	if automatic && hasPrefix(subject, autoReplySubjects) {
+		return AutomatedAutoReplies
+	}
+	return ""
+}
+
+func isCalendarReply(mediaType string, params map[string]string) bool {
+	return mediaType == "text/calendar" && strings.EqualFold(strings.TrimSpace(params["method"]), "REPLY")
+}
+
+// hasCalendarReplyPart is true if one of the multipart message's own parts is an iTIP
+// REPLY. Parts of nested messages, such as a forwarded response, don't count.
+func hasCalendarReplyPart(body []byte, boundary string) bool {
+	_, content, hasContent := splitMessage(toCRLF(body))
+	if !hasContent || len(boundary) == 0 {
+		return false
+	}
+	reader := multipart.NewReader(bytes.NewReader(content), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return false
+		}
+		mediaType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if isCalendarReply(mediaType, params) {
+			return true
+		}
+	}
+}
+
+// hasPrefix is true if s starts with any of the prefixes.
+func hasPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package copycat
+
+import "testing"
+
+func TestAutomatedFilter(t *testing.T) {
+	tests := []struct {
+		msg  string
+		kind string
+	}{
+		{"From: Mail Delivery System <MAILER-DAEMON@example.com>\r\nSubject: Undelivered Mail Returned to Sender\r\n\r\nsorry\r\n", AutomatedBounces},
+		{"From: postmaster@example.com\r\nContent-Type: multipart/report; report-type=delivery-status; boundary=x\r\n\r\n--x--\r\n", AutomatedBounces},
+		{"From: jane@example.com\r\nSubject: Accepted: Planning\r\nContent-Type: multipart/alternative; boundary=x\r\n\r\n--x\r\nContent-Type: text/calendar; method=REPLY\r\n\r\nBEGIN:VCALENDAR\r\nMETHOD:REPLY\r\nEND:VCALENDAR\r\n--x--\r\n", AutomatedCalendarReplies},
+		{"From: jane@example.com\r\nContent-Type: text/calendar; method=REQUEST\r\n\r\nBEGIN:VCALENDAR\r\nMETHOD:REQUEST\r\nEND:VCALENDAR\r\n", ""},
+		{"From: bob@example.com\r\nAuto-Submitted: auto-replied\r\nSubject: Re: lunch\r\n\r\naway\r\n", AutomatedAutoReplies},
+		{"From: bob@example.com\r\nX-Auto-Response-Suppress: All\r\nSubject: Automatic reply: lunch\r\n\r\naway\r\n", AutomatedAutoReplies},
+		{"From: bob@example.com\r\nSubject: Out of office until Monday?\r\n\r\nare you?\r\n", ""},
+		{"From: jane@example.com\r\nContent-Type: text/calendar; method=reply\r\n\r\nBEGIN:VCALENDAR\r\nMETHOD:REPLY\r\nEND:VCALENDAR\r\n", AutomatedCalendarReplies},
+		{"From: jane@example.com\r\nSubject: Fwd: Accepted\r\nContent-Type: multipart/mixed; boundary=x\r\n\r\n--x\r\nContent-Type: text/plain\r\n\r\nsee below\r\n--x\r\nContent-Type: message/rfc822\r\n\r\nContent-Type: text/calendar; method=REPLY\r\n\r\nMETHOD:REPLY\r\n--x--\r\n", ""},
+		{"From: jane@example.com\r\nContent-Type: text/plain\r\n\r\nput METHOD:REPLY in a text/calendar part\r\n", ""},
+		{"From: bob@example.com\r\nAuto-Submitted: no\r\nSubject: Returned mail: see transcript\r\n\r\nhi\r\n", ""},
+	}
+	for _, test := range tests {
+		header, _ := ParseHeader([]byte(test.msg))
+		if kind := automatedKind(header, []byte(test.msg)); kind != test.kind {
+			t.Errorf("expected %q to be %q, got %q", test.msg, test.kind, kind)
+		}
+	}
+
+	filter := AutomatedFilter{Kinds: []string{AutomatedAutoReplies}}
+	if _, err := filter.Transform(MessageData{Body: []byte(tests[4].msg)}); err != ErrSkipMessage {
+		t.Errorf("expected the auto-reply to be skipped, got %v", err)
+	}
+	if _, err := filter.Transform(MessageData{Body: []byte(tests[0].msg)}); err != nil {
+		t.Errorf("expected the bounce to be kept, got %v", err)
+	}
+
+	if kinds, err := ParseAutomatedKinds("bounces, all"); err != nil || len(kinds) != len(AutomatedKinds) {
+		t.Errorf("expected every kind, got %v (%v)", kinds, err)
+	}
+	if _, err := ParseAutomatedKinds("spam"); err == nil {
+		t.Error("expected an error for an unknown kind")
+	}
+}
@@ -0,0 +1,144 @@
+package copycat
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// BatchUser is a row of a users CSV, keyed by the column names in its first line.
+type BatchUser struct {
+	// Line is the line of the CSV it was read from.
+	Line    int
+	Columns map[string]string
+}
+
+// ReadBatchUsers reads a CSV of users for ExpandJobs. The first line names the columns,
+// ex. "source,dest,source_pw,dest_pw". Blank lines and lines starting with # are skipped.
+func ReadBatchUsers(r io.Reader) ([]BatchUser, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading the column names: %s", err.Error())
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	var users []BatchUser
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return users, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		user := BatchUser{Line: line, Columns: make(map[string]string)}
+		for i, name := range header {
+			user.Columns[name] = strings.TrimSpace(record[i])
+		}
+		users = append(users, user)
+	}
+}
+
+// ExpandJobs makes a JobSpec for each user from the template, a JobSpec whose strings
+// are text/template templates of the user's columns, ex. {"user": "{{.source}}"}. Once
+// filled in, the passwords are credential references resolved with ResolveCredential.
+// Errors give the CSV line of the user they're for.
+func ExpandJobs(tmpl []byte, users []BatchUser) ([]JobSpec, error) {
+	var spec JobSpec
+	decoder := json.NewDecoder(bytes.NewReader(tmpl))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("job template: %s", err.Error())
+	}
+
+	var specs []JobSpec
+	for _, user := range users {
+		expanded, err := expandJob(spec, user.Columns)
+		if err == nil {
+			err = expanded.Validate()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", user.Line, err.Error())
+		}
+		specs = append(specs, expanded)
+	}
+	return specs, nil
+}
+
+func expandJob(spec JobSpec, columns map[string]string) (JobSpec, error) {
+	var err error
+	fill := func(s string) string {
+		if err != nil || !strings.Contains(s, "{{") {
+			return s
+		}
+		var t *template.Template
+		if t, err = template.New("").Option("missingkey=error").Parse(s); err != nil {
+			return s
+		}
+		var out bytes.Buffer
+		if err = t.Execute(&out, columns); err != nil {
+			return s
+		}
+		return out.String()
+	}
+	inbox := func(info InboxInfo) InboxInfo {
+		info = InboxInfo{User: fill(info.User), Pw: fill(info.Pw), Host: fill(info.Host), Admin: fill(info.Admin), Root: fill(info.Root)}
+		if err == nil {
+			info.Pw, err = ResolveCredential(info.Pw)
+		}
+		return info
+	}
+
+	spec.Source = inbox(spec.Source)
+	dests := make([]InboxInfo, len(spec.Dest))
+	for i, dst := range spec.Dest {
+		dests[i] = inbox(dst)
+	}
+	spec.Dest = dests
+	filters := make([]string, len(spec.Filters))
+	for i, filter := range spec.Filters {
+		filters[i] = fill(filter)
+	}
+	spec.Filters = filters
+	spec.Tenant = fill(spec.Tenant)
+	return spec, err
+}
+
+// isCredentialRef is true if the password is a reference for ResolveCredential.
+func isCredentialRef(pw string) bool {
+	return strings.HasPrefix(pw, "env:") || strings.HasPrefix(pw, "file:")
+}
+
+// ResolveCredential looks up a password given as a reference so it doesn't have to be
+// written in the CSV: "env:NAME" is the environment variable and "file:path" is the
+// contents of the file, without a trailing newline. Anything else is the password itself.
+func ResolveCredential(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		value, set := os.LookupEnv(name)
+		if !set {
+			return "", fmt.Errorf("the environment variable %s isn't set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(ref, "file:"):
+		raw, err := ioutil.ReadFile(strings.TrimPrefix(ref, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(raw), "\r\n"), nil
+	}
+	return ref, nil
+}
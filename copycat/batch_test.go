@@ -0,0 +1,55 @@
+package copycat
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExpandJobs(t *testing.T) {
+	os.Setenv("COPYCAT_TEST_PW", "from the env")
+	defer os.Unsetenv("COPYCAT_TEST_PW")
+
+	users, err := ReadBatchUsers(strings.NewReader(`source, dest, source_pw
+# bob moved teams
+bob@old.example.com, bob@new.example.com, env:COPYCAT_TEST_PW
+"alice@old.example.com", alice@new.example.com, hunter2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := []byte(`{
+	"source": {"user": "{{.source}}", "pw": "{{.source_pw}}", "host": "imap.old.example.com:993"},
+	"dest": [{"user": "{{.dest}}", "pw": "admin", "host": "imap.new.example.com:993"}],
+	"folders": true,
+	"tenant": "{{index (split .dest \"@\") 1}}"
+}`)
+	if _, err = ExpandJobs(tmpl, users); err == nil {
+		t.Error("expected an error for an unknown template function")
+	}
+
+	tmpl = []byte(strings.Replace(string(tmpl), `{{index (split .dest \"@\") 1}}`, "new", 1))
+	specs, err := ExpandJobs(tmpl, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 2 {
+		t.Fatalf("expected 2 jobs, got %d", len(specs))
+	}
+	if specs[0].Source.User != "bob@old.example.com" || specs[0].Source.Pw != "from the env" || specs[0].Dest[0].User != "bob@new.example.com" || !specs[0].Folders || specs[0].Tenant != "new" {
+		t.Errorf("unexpected job: %+v", specs[0])
+	}
+	if specs[1].Source.Pw != "hunter2" || specs[1].Dest[0].Pw != "admin" {
+		t.Errorf("unexpected job: %+v", specs[1])
+	}
+
+	// a column the CSV doesn't have
+	_, err = ExpandJobs([]byte(`{"source": {"user": "{{.src}}", "pw": "x", "host": "h"}, "dest": [{"user": "u", "pw": "x", "host": "h"}]}`), users)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Errorf("expected an error for line 3, got %v", err)
+	}
+	os.Unsetenv("COPYCAT_TEST_PW")
+	if _, err = ExpandJobs(tmpl, users); err == nil {
+		t.Error("expected an error for an unset credential")
+	}
+}
@@ -0,0 +1,131 @@
+package copycat
+
+import (
+	"log"
+	"sync"
+)
+
+// BrokerMemory, if it's more than 0, has each message fetched from the source once and
+// held until every destination and sink has stored or skipped it, instead of going
+// through the Cache. It's the most bytes of bodies to keep in memory while they wait,
+// the rest are spilled to temporary files. Nothing is kept once the run is over.
+var BrokerMemory int64
+
+// broker hands each fetched message to every consumer of a folder without storing it
+// anywhere between runs. Each message is held until all of the consumers have either
+// taken it or said they don't need it with skip.
+type broker struct {
+	consumers int
+	spool     *Spool
+
+	mu sync.Mutex
+	// message id -> entry
+	entries map[string]*brokerEntry
+}
+
+type brokerEntry struct {
+	// consumers that haven't taken or skipped the message yet
+	left int
+	// closed once the message is fetched, nil until someone asks for it
+	ready chan struct{}
+	data  MessageData
+	err   error
+}
+
+// newBroker creates a broker for the number of consumers, holding up to max bytes of
+// bodies in memory.
+func newBroker(consumers int, max int64) *broker {
+	return &broker{consumers: consumers, spool: NewSpool(max, ""), entries: make(map[string]*brokerEntry)}
+}
+
+// entry finds or adds the entry for the message. b.mu must be held.
+func (b *broker) entry(id string) *brokerEntry {
+	entry, exists := b.entries[id]
+	if !exists {
+		entry = &brokerEntry{left: b.consumers}
+		b.entries[id] = entry
+	}
+	return entry
+}
+
+// done counts a consumer as finished with the entry, letting it go after the last one.
+// b.mu must be held.
+func (b *broker) done(id string, entry *brokerEntry) {
+	entry.left--
+	if entry.left > 0 {
+		return
+	}
+	if b.entries[id] == entry {
+		delete(b.entries, id)
+	}
+	b.spool.Release(entry.data)
+}
+
+// take returns the message for one consumer, calling fetch if no one has fetched it yet.
+// If another consumer is already fetching it, take waits for them instead. The message is
+// always returned in memory, for the caller to hold in InFlight.
+func (b *broker) take(id string, fetch func() (MessageData, error)) (MessageData, error) {
+	for {
+		b.mu.Lock()
+		entry := b.entry(id)
+		if entry.ready == nil {
+			entry.ready = make(chan struct{})
+			b.mu.Unlock()
+
+			data, err := fetch()
+			b.mu.Lock()
+			if err != nil && err != NotFound {
+				// let anyone waiting try it on their own connection
+				delete(b.entries, id)
+				close(entry.ready)
+				b.mu.Unlock()
+				return data, err
+			}
+			entry.data, entry.err = b.spool.Hold(data), err
+			close(entry.ready)
+			b.done(id, entry)
+			b.mu.Unlock()
+			return data, err
+		}
+		b.mu.Unlock()
+
+		<-entry.ready
+		b.mu.Lock()
+		if b.entries[id] != entry {
+			// the fetch failed
+			b.mu.Unlock()
+			continue
+		}
+		data, err := entry.data.Load()
+		if err != nil {
+			log.Printf("Unable to read message (%s) back from disk: %s", id, err.Error())
+		}
+		if entry.err != nil {
+			err = entry.err
+		}
+		b.done(id, entry)
+		b.mu.Unlock()
+		return data, err
+	}
+}
+
+// skip says one consumer won't be taking the message. It's safe to call on a nil broker.
+func (b *broker) skip(id string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.done(id, b.entry(id))
+	b.mu.Unlock()
+}
+
+// Close lets go of any messages that weren't taken by every consumer. It must only be
+// called once the consumers are finished.
+func (b *broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, entry := range b.entries {
+		b.spool.Release(entry.data)
+		delete(b.entries, id)
+	}
+}
@@ -0,0 +1,61 @@
+package copycat
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBroker(t *testing.T) {
+	b := newBroker(3, 1024)
+	var fetches int32
+	fetch := func() (MessageData, error) {
+		atomic.AddInt32(&fetches, 1)
+		return MessageData{Body: []byte("hello")}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := b.take("<1@example.com>", fetch)
+			if err != nil || string(data.Body) != "hello" {
+				t.Errorf("expected the message, got %q %v", data.Body, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if fetches != 1 {
+		t.Errorf("expected the message to be fetched once, it was fetched %d times", fetches)
+	}
+	if b.spool.Held() != 5 {
+		t.Errorf("expected the message to be held for the last consumer, %d bytes are held", b.spool.Held())
+	}
+	b.skip("<1@example.com>")
+	if len(b.entries) != 0 || b.spool.Held() != 0 {
+		t.Errorf("expected the message to be let go once every consumer is done, %d left", len(b.entries))
+	}
+
+	// skipped by everyone before it's fetched
+	for i := 0; i < 3; i++ {
+		b.skip("<2@example.com>")
+	}
+	if len(b.entries) != 0 {
+		t.Errorf("expected nothing to be held, %d left", len(b.entries))
+	}
+
+	// a failed fetch is tried again by the next consumer
+	failed := errors.New("connection lost")
+	if _, err := b.take("<3@example.com>", func() (MessageData, error) { return MessageData{}, failed }); err != failed {
+		t.Errorf("expected the fetch error, got %v", err)
+	}
+	if data, err := b.take("<3@example.com>", fetch); err != nil || string(data.Body) != "hello" {
+		t.Errorf("expected the message, got %q %v", data.Body, err)
+	}
+	b.Close()
+	if len(b.entries) != 0 || b.spool.Held() != 0 {
+		t.Errorf("expected Close to let go of everything, %d left", len(b.entries))
+	}
+}
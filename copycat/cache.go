@@ -4,56 +4,99 @@ import (
 	"bytes"
 	"encoding/gob"
 	"errors"
+	"log"
+	"path/filepath"
+	"sync"
 
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type Cache struct {
-	db *leveldb.DB
+	db   *leveldb.DB
+	path string
 }
 
+// a db can only be opened once, so caches for the same path (ex. from syncs running
+// side by side in serve) share it until the last one is closed.
+var openDBs = struct {
+	sync.Mutex
+	dbs  map[string]*leveldb.DB
+	refs map[string]int
+}{dbs: make(map[string]*leveldb.DB), refs: make(map[string]int)}
+
 func NewCache(dbPath string) (*Cache, error) {
-	c := &Cache{}
-	var err error
-	c.db, err = leveldb.OpenFile(dbPath, nil)
-	if err != nil {
-		return nil, err
+	path := filepath.Clean(dbPath)
+	openDBs.Lock()
+	defer openDBs.Unlock()
+
+	db, open := openDBs.dbs[path]
+	if !open {
+		var err error
+		db, err = leveldb.OpenFile(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		openDBs.dbs[path] = db
 	}
+	openDBs.refs[path]++
 
-	return c, nil
+	return &Cache{db: db, path: path}, nil
 }
 
 func (c *Cache) Close() {
-	c.db.Close()
+	openDBs.Lock()
+	defer openDBs.Unlock()
+	if openDBs.refs[c.path]--; openDBs.refs[c.path] <= 0 {
+		c.db.Close()
+		delete(openDBs.dbs, c.path)
+		delete(openDBs.refs, c.path)
+	}
 }
 
 // our own so we dont have to include leveldb elsewhere
 var ErrNotFound = errors.New("not found")
 
+// Get returns the cached message, counting it as a hit or miss in Stats and the RunReport.
+// Entries from before cache records are converted to records as they're read.
 func (c *Cache) Get(id string) (MessageData, error) {
 	var md MessageData
 	rawData, err := c.db.Get([]byte(id), nil)
-	if err != nil {
-		if err == leveldb.ErrNotFound {
-			return md, ErrNotFound
-		}
-		return md, err
+	if err == leveldb.ErrNotFound {
+		Stats.Add("cache_misses", 1)
+		RunReport.CacheLookup(false)
+		return md, ErrNotFound
 	}
-	err = deserialize(rawData, &md)
 	if err != nil {
 		return md, err
 	}
+	Stats.Add("cache_hits", 1)
+	RunReport.CacheLookup(true)
+	if isRecord(rawData) {
+		return decodeMessage(rawData)
+	}
 
+	if err = deserialize(rawData, &md); err != nil {
+		return md, err
+	}
+	if err = c.Put(id, md); err != nil {
+		log.Printf("Unable to convert cached message %s: %s", id, err.Error())
+	}
 	return md, nil
 }
 
+// Put adds the message to the cache, in the CacheNamespace if there is one.
 func (c *Cache) Put(id string, data MessageData) error {
-	rawData, err := serialize(data)
+	rawData, err := encodeMessage(data, Compress)
 	if err != nil {
 		return err
 	}
 
-	return c.db.Put([]byte(id), rawData, nil)
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(id), rawData)
+	if len(CacheNamespace) > 0 {
+		batch.Put(namespaceKey(CacheNamespace, id), nil)
+	}
+	return c.db.Write(batch, nil)
 }
 
 // serialize encodes a value using gob.
@@ -1,10 +1,17 @@
 package copycat
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"reflect"
+	"sort"
 	"testing"
 	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
 )
 
 const cacheTestLoc = "/tmp/cachetest"
@@ -50,3 +57,366 @@ func cleanUp() {
 		log.Print(err.Error())
 	}
 }
+
+func TestFolderState(t *testing.T) {
+	defer cleanUp()
+
+	cache, err := NewCache(cacheTestLoc)
+	if err != nil {
+		t.Fatalf("unable to create cache - %s", err.Error())
+	}
+	defer cache.Close()
+
+	src := InboxInfo{User: "src@example.com", Host: "imap.example.com:993"}
+	key := folderStateKey(src, "Archive")
+	if _, err = cache.getFolderState(key); err == nil {
+		t.Errorf("expected no state for a folder that was never synced")
+	}
+
+	state := folderState{
+		Source: FolderStatus{Messages: 10, UIDNext: 11, UIDValidity: 1, HighestModSeq: "12345678901"},
+		Dest:   map[string]FolderStatus{"dst@example.com": {Messages: 10, UIDNext: 20, UIDValidity: 7}},
+	}
+	if err = cache.putFolderState(key, state); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := cache.getFolderState(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Source != state.Source || !sameStatus(saved.Dest, state.Dest) {
+		t.Errorf("unexpected state: %+v", saved)
+	}
+
+	if sameStatus(saved.Dest, map[string]FolderStatus{"dst@example.com": {Messages: 9, UIDNext: 20, UIDValidity: 7}}) {
+		t.Errorf("expected a destination with a message removed to have changed")
+	}
+}
+
+func TestFolderRenames(t *testing.T) {
+	defer cleanUp()
+
+	cache, err := NewCache(cacheTestLoc)
+	if err != nil {
+		t.Fatalf("unable to create cache - %s", err.Error())
+	}
+	defer cache.Close()
+
+	src := InboxInfo{User: "src@example.com", Host: "imap.example.com:993"}
+	other := InboxInfo{User: "other@example.com", Host: "imap.example.com:993"}
+	state := folderState{Source: FolderStatus{UIDValidity: 1}, Names: map[string]string{"dst@example.com": "Projects"}, Sample: []string{"<a@b>", "<c@d>", "<e@f>"}}
+	for _, key := range []string{folderStateKey(src, "Projects"), folderStateKey(src, "Projects/2019"), folderStateKey(other, "Archive")} {
+		if err = cache.putFolderState(key, state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	states := cache.folderStates(src)
+	if len(states) != 2 || states["Projects"].Names["dst@example.com"] != "Projects" || len(states["Projects/2019"].Sample) != 3 {
+		t.Errorf("expected the states of the source's 2 folders, got %+v", states)
+	}
+
+	if !sameFolder(state.Sample, []string{"<c@d>", "<e@f>", "<g@h>"}) {
+		t.Error("expected a folder missing one of its first messages to be the same folder")
+	}
+	if sameFolder(state.Sample, []string{"<e@f>", "<g@h>", "<i@j>"}) {
+		t.Error("expected a folder with mostly other messages to be another folder")
+	}
+	if sameFolder(nil, nil) {
+		t.Error("expected an empty folder not to be recognized")
+	}
+}
+
+func TestUIDIndex(t *testing.T) {
+	defer cleanUp()
+
+	cache, err := NewCache(cacheTestLoc)
+	if err != nil {
+		t.Fatalf("unable to create cache - %s", err.Error())
+	}
+	defer cache.Close()
+
+	src := InboxInfo{User: "src@example.com", Host: "imap.example.com:993"}
+	key := uidIndexKey(src, "Archive")
+	if _, err = cache.getUIDIndex(key); err == nil {
+		t.Errorf("expected no index for a folder that was never synced")
+	}
+	index := &uidIndex{UIDValidity: 1, UIDNext: 4, HighestModSeq: "12345678901", Purged: true, key: key, added: map[uint32]string{1: "<a@b>", 3: "<c@d>"}}
+	if err = cache.putUIDIndex(index); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := cache.getUIDIndex(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, *index) {
+		t.Errorf("expected %+v, got %+v", *index, saved)
+	}
+	if id, exists := cache.uidIndexMessageId(key, 3); !exists || id != "<c@d>" {
+		t.Errorf("expected <c@d> for UID 3, got %q", id)
+	}
+
+	// only what changed is written
+	index.removed = []uint32{1}
+	index.added = map[uint32]string{4: "<e@f>"}
+	if err = cache.putUIDIndex(index); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := cache.uidIndexMessageId(key, 1); exists {
+		t.Error("expected the vanished UID to be removed")
+	}
+	if _, exists := cache.uidIndexMessageId(key, 3); !exists {
+		t.Error("expected the UID that's still there to be kept")
+	}
+
+	// a new index throws out the old entries
+	if err = cache.putUIDIndex((&uidIndex{UIDValidity: 1, key: key}).restart()); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := cache.uidIndexMessageId(key, 4); exists {
+		t.Error("expected the entries to be thrown out when the index starts over")
+	}
+
+	uids, err := parseUIDSet("41,43:45,50:48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{41, 43, 44, 45, 48, 49, 50}; !reflect.DeepEqual(uids, want) {
+		t.Errorf("expected %v, got %v", want, uids)
+	}
+	if _, err = parseUIDSet("41,*"); err == nil {
+		t.Error("expected an error for a set that isn't just UIDs")
+	}
+
+	// a single UID is a number
+	rsp := &imap.Response{Label: "VANISHED", Fields: []imap.Field{"VANISHED", []imap.Field{"EARLIER"}, uint32(41)}}
+	if uids, err = vanishedUIDs(rsp); err != nil || !reflect.DeepEqual(uids, []uint32{41}) {
+		t.Errorf("expected UID 41, got %v %v", uids, err)
+	}
+	// other responses waiting on the connection are left for whatever they're for
+	exists := &imap.Response{Label: "EXISTS"}
+	conn := &imap.Client{Data: []*imap.Response{rsp, exists}}
+	if vanished := takeVanished(conn); len(vanished) != 1 || len(conn.Data) != 1 || conn.Data[0] != exists {
+		t.Errorf("expected only the VANISHED response to be taken, got %v and left %v", vanished, conn.Data)
+	}
+}
+
+func TestSkipList(t *testing.T) {
+	defer cleanUp()
+
+	cache, err := NewCache(cacheTestLoc)
+	if err != nil {
+		t.Fatalf("unable to create cache - %s", err.Error())
+	}
+	defer cache.Close()
+	defer func(runID string) { RunID = runID }(RunID)
+
+	skips := newSkipList(cache)
+	tooBig := errors.New("NO [TOOBIG] Message too large")
+	for run := 1; run <= SkipAfter; run++ {
+		if skips.skip("dst@example.com", "<a@b>") {
+			t.Fatalf("expected the message to be tried in run %d", run)
+		}
+		RunID = fmt.Sprintf("run-%d", run)
+		// only counted once a run, and only for permanent failures
+		skips.failed("dst@example.com", "<a@b>", tooBig)
+		skips.failed("dst@example.com", "<a@b>", tooBig)
+		skips.failed("dst@example.com", "<a@b>", errors.New("NO [CANNOT] Something else"))
+	}
+	if !skips.skip("dst@example.com", "<a@b>") {
+		t.Errorf("expected the message to be skipped after failing in %d runs", SkipAfter)
+	}
+	if skips.skip("other@example.com", "<a@b>") || skips.skipped["dst@example.com"] != 1 {
+		t.Errorf("expected the message to be skipped in just the one destination, got %v", skips.skipped)
+	}
+
+	skips.copied("dst@example.com", "<a@b>")
+	if skips.skip("dst@example.com", "<a@b>") {
+		t.Error("expected a copied message to be forgotten")
+	}
+	var none *skipList
+	if none.skip("dst@example.com", "<a@b>") {
+		t.Error("expected a nil skip list to skip nothing")
+	}
+}
+
+func TestSharedCache(t *testing.T) {
+	defer cleanUp()
+
+	first, err := NewCache(cacheTestLoc)
+	if err != nil {
+		t.Fatalf("unable to create cache - %s", err.Error())
+	}
+	second, err := NewCache(cacheTestLoc + "/")
+	if err != nil {
+		t.Fatalf("unable to open the cache a second time - %s", err.Error())
+	}
+
+	if err = first.Put("key123", MessageData{Body: []byte("shared")}); err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+	if data, err := second.Get("key123"); err != nil || string(data.Body) != "shared" {
+		t.Errorf("expected the second cache to still be open and see the first's data, got %q (%v)", data.Body, err)
+	}
+	second.Close()
+
+	third, err := NewCache(cacheTestLoc)
+	if err != nil {
+		t.Fatalf("unable to reopen the cache - %s", err.Error())
+	}
+	third.Close()
+}
+
+func TestCacheRecord(t *testing.T) {
+	data := MessageData{
+		InternalDate: time.Date(2014, 3, 1, 10, 0, 0, 0, time.FixedZone("EST", -5*3600)),
+		Flags:        []string{`\Seen`, "Work"},
+		Body:         bytes.Repeat([]byte("Subject: hi\r\n\r\nhello\r\n"), 200),
+	}
+	for _, compress := range []Compression{{}, {"deflate", -1}, {"gzip", 9}, {"zstd", -1}, {"zstd", 1}} {
+		raw, err := encodeMessage(data, compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(compress.Algorithm) > 0 && len(raw) >= len(data.Body) {
+			t.Errorf("expected the record to be compressed, got %d bytes for a %d byte body", len(raw), len(data.Body))
+		}
+		decoded, err := decodeMessage(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decoded.InternalDate.Equal(data.InternalDate) || decoded.InternalDate.Format(time.RFC3339) != data.InternalDate.Format(time.RFC3339) ||
+			!reflect.DeepEqual(decoded.Flags, data.Flags) || !bytes.Equal(decoded.Body, data.Body) {
+			t.Errorf("compress=%v: expected %v, got %v", compress, data, decoded)
+		}
+		if _, err = decodeMessage(raw[:len(raw)-10]); err == nil {
+			t.Errorf("compress=%v: expected an error for a truncated record", compress)
+		}
+	}
+}
+
+func TestCacheLegacyEntries(t *testing.T) {
+	defer cleanUp()
+
+	cache, err := NewCache(cacheTestLoc)
+	if err != nil {
+		t.Fatalf("unable to create cache - %s", err.Error())
+	}
+	defer cache.Close()
+
+	// entries used to be gob encoded
+	data := MessageData{InternalDate: time.Date(2014, 3, 1, 10, 0, 0, 0, time.UTC), Flags: []string{`\Seen`}, Body: []byte("old")}
+	raw, err := serialize(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isRecord(raw) {
+		t.Fatal("a gob entry looks like a cache record")
+	}
+	cache.db.Put([]byte("old"), raw, nil)
+
+	got, err := cache.Get("old")
+	if err != nil || string(got.Body) != "old" || !got.InternalDate.Equal(data.InternalDate) {
+		t.Fatalf("unable to read the old entry: %v %v", got, err)
+	}
+	if raw, _ = cache.db.Get([]byte("old"), nil); !isRecord(raw) {
+		t.Error("expected the old entry to be converted to a record")
+	}
+}
+
+func TestCacheNamespaces(t *testing.T) {
+	defer cleanUp()
+	defer func() { CacheNamespace = "" }()
+	cache, err := NewCache(cacheTestLoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	data := MessageData{InternalDate: time.Now(), Body: []byte("this is some data")}
+	CacheNamespace = "fred@example.com"
+	cache.Put("<1@example.com>", data)
+	cache.Put("<2@example.com>", data)
+	CacheNamespace = "wilma@example.com"
+	cache.Put("<3@example.com>", data)
+	if err = cache.putFolderState("folder-state\x00fred", folderState{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if namespaces, _ := cache.Namespaces(); !reflect.DeepEqual(namespaces, []string{"fred@example.com", "wilma@example.com"}) {
+		t.Errorf("unexpected namespaces: %v", namespaces)
+	}
+	if usage, _ := cache.Usage("fred@example.com"); usage.Messages != 2 || usage.Bytes == 0 {
+		t.Errorf("expected fred to have 2 messages, got %+v", usage)
+	}
+	if usage, _ := cache.Usage(""); usage.Messages != 3 {
+		t.Errorf("expected 3 messages in all, got %+v", usage)
+	}
+
+	if purged, err := cache.Purge("fred@example.com"); err != nil || purged != 2 {
+		t.Errorf("expected 2 messages to be purged, got %d %v", purged, err)
+	}
+	if _, err = cache.Get("<1@example.com>"); err != ErrNotFound {
+		t.Errorf("expected fred's message to be gone, got %v", err)
+	}
+	if _, err = cache.Get("<3@example.com>"); err != nil {
+		t.Errorf("expected wilma's message to be kept, got %v", err)
+	}
+
+	if purged, _ := cache.Purge(""); purged != 1 {
+		t.Errorf("expected the last message to be purged, %d were", purged)
+	}
+	if _, err = cache.getFolderState("folder-state\x00fred"); err != nil {
+		t.Errorf("expected the folder state to be kept, got %v", err)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	defer cleanUp()
+	journal, err := OpenJournal(cacheTestLoc, "run-1", []string{"-folders", "-sync"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.FolderDone("INBOX")
+	done := journal.Appending("Work", "<1@example.com>", "dst@example.com")
+	journal.Appending("Work", "<2@example.com>", "dst@example.com")
+	journal.Appended(done, 7, 42, nil)
+	lost := journal.Appending("Work", "<3@example.com>", "dst@example.com")
+	journal.Appended(lost, 0, 0, &Error{Kind: ErrConnLost, Op: "append", Err: errors.New("broken pipe")})
+	refused := journal.Appending("Work", "<4@example.com>", "dst@example.com")
+	journal.Appended(refused, 0, 0, errors.New("NO [TOOBIG] message too large"))
+	// crash
+	journal.cache.Close()
+
+	run, err := LastRun(cacheTestLoc, "")
+	if err != nil || run.Id != "run-1" || !reflect.DeepEqual(run.Args, []string{"-folders", "-sync"}) {
+		t.Fatalf("expected the unfinished run, got %+v %v", run, err)
+	}
+
+	journal, err = OpenJournal(cacheTestLoc, "run-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !journal.Done("INBOX") || journal.Done("Work") {
+		t.Errorf("expected only the INBOX to be done")
+	}
+	uncertain := journal.Uncertain()
+	sort.Slice(uncertain, func(i, j int) bool { return uncertain[i].MessageId < uncertain[j].MessageId })
+	if !reflect.DeepEqual(uncertain, []UncertainAppend{{"Work", "<2@example.com>", "dst@example.com"}, {"Work", "<3@example.com>", "dst@example.com"}}) {
+		t.Errorf("unexpected uncertain appends: %v", uncertain)
+	}
+	if confirmed, exists := journal.Confirmed("Work", "<1@example.com>", "dst@example.com"); !exists || confirmed.UIDValidity != 7 || confirmed.UID != 42 {
+		t.Errorf("expected the append to be confirmed with its UID, got %+v", confirmed)
+	}
+	if _, exists := journal.Confirmed("Work", "<4@example.com>", "dst@example.com"); exists {
+		t.Errorf("expected the refused append not to be confirmed")
+	}
+	journal.Close(nil)
+
+	if _, err = LastRun(cacheTestLoc, ""); err != ErrNotFound {
+		t.Errorf("expected no unfinished runs, got %v", err)
+	}
+	if run, _ = LastRun(cacheTestLoc, "run-1"); run.Finished.IsZero() {
+		t.Errorf("expected the run to be finished")
+	}
+}
@@ -0,0 +1,141 @@
+package copycat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Cached messages are kept as a record of
+//
+//	"cc" magic, version, codec, then the (possibly compressed) payload of
+//	internal date (time.MarshalBinary), flag count, flags, body
+//
+// with the date, each flag and the body prefixed with their length as a uvarint. The
+// magic can't start a gob stream, so entries from before records are told apart from
+// them and are still read.
+const (
+	cacheMagic         = "cc"
+	cacheRecordVersion = 1
+
+	codecNone    = 0
+	codecDeflate = 1
+	codecGzip    = 2
+	codecZstd    = 3
+)
+
+// messages smaller than this aren't worth compressing
+const minCompressSize = 1024
+
+var errBadRecord = errors.New("invalid cache record")
+
+// encodeMessage builds the cache record for the message, compressed with compress.
+func encodeMessage(data MessageData, compress Compression) ([]byte, error) {
+	var payload bytes.Buffer
+	date, err := data.InternalDate.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	writeBytes(&payload, date)
+	writeUvarint(&payload, uint64(len(data.Flags)))
+	for _, flag := range data.Flags {
+		writeBytes(&payload, []byte(flag))
+	}
+	writeBytes(&payload, data.Body)
+
+	codec := byte(codecNone)
+	body := payload.Bytes()
+	if compress.codec() != codecNone && len(data.Body) >= minCompressSize {
+		var compressed bytes.Buffer
+		w, err := compress.writer(&compressed)
+		if err != nil {
+			return nil, err
+		}
+		w.Write(body)
+		if err = w.Close(); err != nil {
+			return nil, err
+		}
+		// some messages (ex. mostly attachments) don't get any smaller
+		if compressed.Len() < len(body) {
+			codec, body = compress.codec(), compressed.Bytes()
+		}
+	}
+
+	record := make([]byte, 0, len(cacheMagic)+2+len(body))
+	record = append(record, cacheMagic...)
+	record = append(record, cacheRecordVersion, codec)
+	return append(record, body...), nil
+}
+
+// isRecord reports if raw is a cache record rather than an older gob entry.
+func isRecord(raw []byte) bool {
+	return bytes.HasPrefix(raw, []byte(cacheMagic))
+}
+
+// decodeMessage reads a message out of a cache record.
+func decodeMessage(raw []byte) (MessageData, error) {
+	var data MessageData
+	if !isRecord(raw) || len(raw) < len(cacheMagic)+2 {
+		return data, errBadRecord
+	}
+	version, codec := raw[len(cacheMagic)], raw[len(cacheMagic)+1]
+	if version != cacheRecordVersion {
+		return data, fmt.Errorf("unknown cache record version %d", version)
+	}
+	payload := raw[len(cacheMagic)+2:]
+	if codec != codecNone {
+		r, err := codecReader(codec, bytes.NewReader(payload))
+		if err != nil {
+			return data, fmt.Errorf("unable to read cache record: %s", err.Error())
+		}
+		if payload, err = ioutil.ReadAll(r); err != nil {
+			return data, err
+		}
+	}
+
+	r := bytes.NewReader(payload)
+	date, err := readBytes(r)
+	if err != nil {
+		return data, err
+	}
+	if err = data.InternalDate.UnmarshalBinary(date); err != nil {
+		return data, err
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(r.Len()) {
+		return data, errBadRecord
+	}
+	for i := uint64(0); i < count; i++ {
+		flag, err := readBytes(r)
+		if err != nil {
+			return data, err
+		}
+		data.Flags = append(data.Flags, string(flag))
+	}
+	if data.Body, err = readBytes(r); err != nil {
+		return data, err
+	}
+	return data, nil
+}
+
+func writeUvarint(buf *bytes.Buffer, n uint64) {
+	var size [binary.MaxVarintLen64]byte
+	buf.Write(size[:binary.PutUvarint(size[:], n)])
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil || size > uint64(r.Len()) {
+		return nil, errBadRecord
+	}
+	b := make([]byte, size)
+	r.Read(b)
+	return b, nil
+}
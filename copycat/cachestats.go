@@ -0,0 +1,139 @@
+package copycat
+
+import (
+	"bytes"
+	"log"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// CacheNamespace is recorded with every message put in the Cache (ex. the source
+// account), so the messages from one run or account can be looked at or purged alone.
+var CacheNamespace string
+
+// messages are listed in their namespace under this prefix, the namespace and their
+// Message-Id. Message-Ids can't have a NUL in them, unlike every other key.
+const cacheNamespacePrefix = "cache-ns\x00"
+
+func namespaceKey(namespace string, id string) []byte {
+	return []byte(cacheNamespacePrefix + namespace + "\x00" + id)
+}
+
+// isMessageKey is true for the keys of cached messages, rather than folder states, jobs
+// and the like.
+func isMessageKey(key []byte) bool {
+	return bytes.IndexByte(key, 0) < 0
+}
+
+// CacheUsage is how much of the Cache a namespace is using.
+type CacheUsage struct {
+	Namespace string
+	Messages  int
+	Bytes     int64
+}
+
+// Usage adds up the messages in the namespace, or every cached message if it's empty.
+func (c *Cache) Usage(namespace string) (CacheUsage, error) {
+	usage := CacheUsage{Namespace: namespace}
+	if len(namespace) == 0 {
+		iter := c.db.NewIterator(nil, nil)
+		defer iter.Release()
+		for iter.Next() {
+			if isMessageKey(iter.Key()) {
+				usage.Messages++
+				usage.Bytes += int64(len(iter.Value()))
+			}
+		}
+		return usage, iter.Error()
+	}
+
+	err := c.namespaceIds(namespace, func(id []byte) error {
+		raw, err := c.db.Get(id, nil)
+		if err == leveldb.ErrNotFound {
+			return nil
+		}
+		usage.Messages++
+		usage.Bytes += int64(len(raw))
+		return err
+	})
+	return usage, err
+}
+
+// Namespaces lists the namespaces messages have been cached in.
+func (c *Cache) Namespaces() ([]string, error) {
+	seen := make(map[string]bool)
+	iter := c.db.NewIterator(util.BytesPrefix([]byte(cacheNamespacePrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := iter.Key()[len(cacheNamespacePrefix):]
+		if end := bytes.IndexByte(key, 0); end >= 0 {
+			seen[string(key[:end])] = true
+		}
+	}
+	var namespaces []string
+	for namespace := range seen {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces, iter.Error()
+}
+
+// Purge removes the messages in the namespace, or every cached message if it's empty,
+// and returns how many were removed. A message cached by more than one namespace is
+// removed for all of them and will be fetched again if it's needed.
+func (c *Cache) Purge(namespace string) (int, error) {
+	batch := new(leveldb.Batch)
+	var purged int
+	if len(namespace) == 0 {
+		iter := c.db.NewIterator(nil, nil)
+		for iter.Next() {
+			key := iter.Key()
+			if isMessageKey(key) {
+				purged++
+			}
+			if isMessageKey(key) || bytes.HasPrefix(key, []byte(cacheNamespacePrefix)) {
+				batch.Delete(append([]byte(nil), key...))
+			}
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return 0, err
+		}
+	} else {
+		err := c.namespaceIds(namespace, func(id []byte) error {
+			if cached, _ := c.db.Has(id, nil); cached {
+				purged++
+			}
+			batch.Delete(id)
+			batch.Delete(namespaceKey(namespace, string(id)))
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := c.db.Write(batch, nil); err != nil {
+		return 0, err
+	}
+	log.Printf("purged %d message(s) from the cache", purged)
+	Stats.Add("cache_evictions", int64(purged))
+	RunReport.CacheEvicted(purged)
+	return purged, nil
+}
+
+// namespaceIds calls f with the Message-Id of each message in the namespace.
+func (c *Cache) namespaceIds(namespace string, f func(id []byte) error) error {
+	prefix := namespaceKey(namespace, "")
+	iter := c.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		id := append([]byte(nil), iter.Key()[len(prefix):]...)
+		if err := f(id); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
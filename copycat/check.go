@@ -0,0 +1,106 @@
+package copycat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// how many NOOPs are timed to estimate the round trip to a server
+const checkPings = 3
+
+// Health is what Check found out about an account.
+type Health struct {
+	Account      string
+	Host         string
+	Capabilities []string
+	Folders      int
+	Messages     uint32
+	Quota        []imap.Quota
+	// Login is how long it took to connect, log in and select the INBOX.
+	Login time.Duration
+	// RoundTrip is the average time a NOOP took.
+	RoundTrip time.Duration
+}
+
+// Check will log in to the account and collect its capabilities, folder and message
+// counts, quota (if the server has QUOTA) and round-trip time without changing anything.
+func Check(info InboxInfo) (health Health, err error) {
+	health = Health{Account: info.User, Host: info.Host}
+
+	start := time.Now()
+	conn, err := GetConnection(info, true)
+	if err != nil {
+		return health, err
+	}
+	defer conn.Logout(20 * time.Second)
+	health.Login = time.Since(start)
+
+	for capability := range conn.Caps {
+		health.Capabilities = append(health.Capabilities, capability)
+	}
+	sort.Strings(health.Capabilities)
+
+	start = time.Now()
+	for i := 0; i < checkPings; i++ {
+		if _, err = imap.Wait(conn.Noop()); err != nil {
+			return health, wrapError("noop", info.User, err)
+		}
+	}
+	health.RoundTrip = time.Since(start) / checkPings
+
+	folders, err := ListFolders(conn)
+	if err != nil {
+		return health, wrapError("list", info.User, err)
+	}
+	health.Folders = len(folders)
+	for _, folder := range folders {
+		status, err := GetFolderStatus(conn, folder)
+		if err != nil {
+			return health, wrapError("status "+folder, info.User, err)
+		}
+		health.Messages += status.Messages
+	}
+
+	if conn.Caps["QUOTA"] {
+		cmd, err := imap.Wait(conn.GetQuotaRoot("INBOX"))
+		if err != nil {
+			return health, wrapError("getquotaroot", info.User, err)
+		}
+		for _, rsp := range cmd.Data {
+			if rsp.Label != "QUOTA" {
+				continue
+			}
+			_, quotas := rsp.Quota()
+			for _, quota := range quotas {
+				health.Quota = append(health.Quota, *quota)
+			}
+		}
+	}
+	return health, nil
+}
+
+// String describes the account's health over a few lines.
+func (h Health) String() string {
+	lines := []string{
+		fmt.Sprintf("%s on %s: ok", h.Account, h.Host),
+		fmt.Sprintf("  login: %s, round trip: %s", h.Login, h.RoundTrip),
+		fmt.Sprintf("  capabilities: %s", strings.Join(h.Capabilities, " ")),
+		fmt.Sprintf("  folders: %d, messages: %d", h.Folders, h.Messages),
+	}
+	for _, quota := range h.Quota {
+		// STORAGE is in KB, everything else is a count
+		lines = append(lines, fmt.Sprintf("  quota: %s %d of %d (%.1f%%)", quota.Resource, quota.Usage, quota.Limit, percent(quota.Usage, quota.Limit)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func percent(n uint32, of uint32) float64 {
+	if of == 0 {
+		return 0
+	}
+	return float64(n) / float64(of) * 100
+}
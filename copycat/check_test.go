@@ -0,0 +1,29 @@
+package copycat
+
+import (
+	"testing"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+func TestHealthString(t *testing.T) {
+	health := Health{
+		Account:      "bob@example.com",
+		Host:         "imap.example.com:993",
+		Capabilities: []string{"IDLE", "IMAP4rev1", "QUOTA"},
+		Folders:      4,
+		Messages:     1200,
+		Quota:        []imap.Quota{{Resource: "STORAGE", Usage: 512, Limit: 2048}},
+		Login:        250 * time.Millisecond,
+		RoundTrip:    40 * time.Millisecond,
+	}
+	expected := `bob@example.com on imap.example.com:993: ok
+  login: 250ms, round trip: 40ms
+  capabilities: IDLE IMAP4rev1 QUOTA
+  folders: 4, messages: 1200
+  quota: STORAGE 512 of 2048 (25.0%)`
+	if health.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, health.String())
+	}
+}
@@ -0,0 +1,123 @@
+package copycat
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+const (
+	ChecksumsCSV   = "csv"
+	ChecksumsJSONL = "jsonl"
+)
+
+// ChecksumEntry is a line of a checksum manifest describing one message in a folder.
+type ChecksumEntry struct {
+	Account      string    `json:"account"`
+	Folder       string    `json:"folder"`
+	MessageId    string    `json:"message_id"`
+	UID          uint32    `json:"uid"`
+	SHA256       string    `json:"sha256"`
+	Size         int       `json:"size"`
+	InternalDate time.Time `json:"internal_date"`
+}
+
+var checksumColumns = []string{"account", "folder", "message_id", "uid", "sha256", "size", "internal_date"}
+
+// ChecksumWriter writes a checksum manifest as CSV (with a header line) or JSON lines.
+// Dates are in UTC in RFC 3339 format so the output is the same wherever it's run.
+type ChecksumWriter struct {
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+func NewChecksumWriter(w io.Writer, format string) (*ChecksumWriter, error) {
+	switch format {
+	case ChecksumsCSV:
+		c := &ChecksumWriter{csv: csv.NewWriter(w)}
+		return c, c.csv.Write(checksumColumns)
+	case ChecksumsJSONL:
+		encoder := json.NewEncoder(w)
+		// keep Message-Ids readable instead of \u003c escaping them
+		encoder.SetEscapeHTML(false)
+		return &ChecksumWriter{json: encoder}, nil
+	}
+	return nil, fmt.Errorf("unknown checksum format: %q", format)
+}
+
+func (c *ChecksumWriter) Write(entry ChecksumEntry) error {
+	entry.InternalDate = entry.InternalDate.UTC()
+	if c.json != nil {
+		return c.json.Encode(entry)
+	}
+	return c.csv.Write([]string{
+		entry.Account,
+		entry.Folder,
+		entry.MessageId,
+		strconv.FormatUint(uint64(entry.UID), 10),
+		entry.SHA256,
+		strconv.Itoa(entry.Size),
+		entry.InternalDate.Format(time.RFC3339),
+	})
+}
+
+func (c *ChecksumWriter) Flush() error {
+	if c.csv != nil {
+		c.csv.Flush()
+		return c.csv.Error()
+	}
+	return nil
+}
+
+// WriteChecksums adds an entry for every message in the folder selected on conn to
+// the manifest, in UID order. Messages are streamed from the server and hashed as
+// they arrive, so only one is held in memory at a time.
+func WriteChecksums(conn *imap.Client, account string, w *ChecksumWriter) error {
+	if conn.Mailbox.Messages == 0 {
+		return nil
+	}
+
+	seq, _ := imap.NewSeqSet("")
+	seq.AddRange(1, 0)
+	cmd, err := conn.Fetch(seq, "UID", "INTERNALDATE", "BODY.PEEK[]")
+	if err != nil {
+		return err
+	}
+
+	for cmd.InProgress() {
+		if err = conn.Recv(-1); err != nil {
+			return err
+		}
+		for _, rsp := range cmd.Data {
+			info := rsp.MessageInfo()
+			body := imap.AsBytes(info.Attrs["BODY[]"])
+			sum := sha256.Sum256(body)
+			entry := ChecksumEntry{
+				Account:      account,
+				Folder:       conn.Mailbox.Name,
+				UID:          info.UID,
+				SHA256:       hex.EncodeToString(sum[:]),
+				Size:         len(body),
+				InternalDate: imap.AsDateTime(info.Attrs["INTERNALDATE"]),
+			}
+			if header, _ := ParseHeader(body); header != nil {
+				entry.MessageId = header.Get("Message-Id")
+			}
+			if err = w.Write(entry); err != nil {
+				return err
+			}
+		}
+		cmd.Data = nil
+	}
+	conn.Data = nil
+
+	_, err = cmd.Result(imap.OK)
+	return err
+}
@@ -0,0 +1,45 @@
+package copycat
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestChecksumWriter(t *testing.T) {
+	entry := ChecksumEntry{
+		Account:      "user@example.com",
+		Folder:       "INBOX",
+		MessageId:    "<1@example.com>",
+		UID:          7,
+		SHA256:       "abc123",
+		Size:         42,
+		InternalDate: time.Date(2014, 3, 1, 12, 4, 5, 0, time.FixedZone("EST", -5*60*60)),
+	}
+
+	var buf bytes.Buffer
+	w, err := NewChecksumWriter(&buf, ChecksumsCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(entry)
+	if err = w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "account,folder,message_id,uid,sha256,size,internal_date\nuser@example.com,INBOX,<1@example.com>,7,abc123,42,2014-03-01T17:04:05Z\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected csv:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	w, _ = NewChecksumWriter(&buf, ChecksumsJSONL)
+	w.Write(entry)
+	expected = `{"account":"user@example.com","folder":"INBOX","message_id":"<1@example.com>","uid":7,"sha256":"abc123","size":42,"internal_date":"2014-03-01T17:04:05Z"}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected json:\n%s", buf.String())
+	}
+
+	if _, err = NewChecksumWriter(&buf, "xml"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
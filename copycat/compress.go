@@ -0,0 +1,92 @@
+package copycat
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is how message bodies are compressed before they're put in the Cache or
+// spilled to disk. The zero value leaves them alone.
+type Compression struct {
+	// Algorithm is "deflate", "gzip", "zstd" or empty for none.
+	Algorithm string
+	// Level is from 1 (fastest) to 9 (smallest), or -1 for the default.
+	Level int
+}
+
+// Compress is the Compression used for cached and spilled messages.
+var Compress Compression
+
+// NewCompression checks the algorithm and level are ones we can use.
+func NewCompression(algorithm string, level int) (Compression, error) {
+	c := Compression{Algorithm: algorithm, Level: level}
+	switch algorithm {
+	case "", "none":
+		return Compression{}, nil
+	case "deflate", "gzip", "zstd":
+	default:
+		return c, fmt.Errorf("unknown compression %q, use deflate, gzip or zstd", algorithm)
+	}
+	if level != flate.DefaultCompression && (level < flate.BestSpeed || level > flate.BestCompression) {
+		return c, fmt.Errorf("compression level %d isn't between %d and %d", level, flate.BestSpeed, flate.BestCompression)
+	}
+	return c, nil
+}
+
+// codec is the codec recorded with bodies compressed by c.
+func (c Compression) codec() byte {
+	switch c.Algorithm {
+	case "deflate":
+		return codecDeflate
+	case "gzip":
+		return codecGzip
+	case "zstd":
+		return codecZstd
+	}
+	return codecNone
+}
+
+// writer wraps w to compress anything written to it. It must be closed to finish.
+func (c Compression) writer(w io.Writer) (io.WriteCloser, error) {
+	switch c.codec() {
+	case codecDeflate:
+		return flate.NewWriter(w, c.Level)
+	case codecGzip:
+		return gzip.NewWriterLevel(w, c.Level)
+	case codecZstd:
+		level := zstd.SpeedDefault
+		if c.Level != flate.DefaultCompression {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// codecReader wraps r to decompress a body compressed with the codec.
+func codecReader(codec byte, r io.Reader) (io.Reader, error) {
+	switch codec {
+	case codecNone:
+		return r, nil
+	case codecDeflate:
+		return flate.NewReader(r), nil
+	case codecGzip:
+		return gzip.NewReader(r)
+	case codecZstd:
+		// decoding one at a time doesn't start any goroutines, so it needn't be closed
+		return zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("unknown codec %d", codec)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
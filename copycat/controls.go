@@ -0,0 +1,247 @@
+package copycat
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Controls can pause, resume or cancel a running sync or skip the rest of a folder.
+// They're shared by everything running in the process.
+var Controls = newRunControls()
+
+// ErrCanceled is returned by a sync that was stopped with Cancel.
+var ErrCanceled = errors.New("sync canceled")
+
+// RunControls are checked by the storers before each message they store and by the
+// producers before each message they hand out.
+type RunControls struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	paused   bool
+	resumed  chan bool
+	canceled chan bool
+	skipped  map[string]bool
+	// a new window for Schedule
+	schedule  chan TimeWindow
+	reloaders []func()
+	// adds a destination to what's idling, see CopyCat.AddDestination
+	addDestination func(InboxInfo) error
+}
+
+func newRunControls() *RunControls {
+	c := &RunControls{skipped: make(map[string]bool), resumed: make(chan bool), canceled: make(chan bool), schedule: make(chan TimeWindow, 1)}
+	c.cond = sync.NewCond(&c.mu)
+	close(c.resumed)
+	return c
+}
+
+// Pause stops new messages from being handed out and stored. Messages already being
+// appended are finished first.
+func (c *RunControls) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.paused {
+		log.Print("pausing the sync")
+		c.resumed = make(chan bool)
+	}
+	c.paused = true
+}
+
+// Resume lets a paused sync carry on.
+func (c *RunControls) Resume() {
+	c.mu.Lock()
+	if c.paused {
+		log.Print("resuming the sync")
+		close(c.resumed)
+	}
+	c.paused = false
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+func (c *RunControls) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
+
+// Wait blocks while the sync is paused (and not canceled).
+func (c *RunControls) Wait() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.paused && !c.isCanceled() {
+		c.cond.Wait()
+	}
+}
+
+// Resumed is closed once the sync isn't paused, for waiting in a select.
+func (c *RunControls) Resumed() <-chan bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resumed
+}
+
+// Cancel stops the sync cleanly: no more messages are handed out or stored, appends
+// already under way are finished and the folders that were completed are checkpointed
+// (see SkipUnchanged), so the next run carries on from there.
+func (c *RunControls) Cancel() {
+	c.mu.Lock()
+	if !c.isCanceled() {
+		log.Print("canceling the sync")
+		close(c.canceled)
+	}
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+// Canceled is closed once the sync is canceled.
+func (c *RunControls) Canceled() <-chan bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.canceled
+}
+
+// Rearm undoes a Cancel and forgets the skipped folders, for the next run in the same
+// process once the canceled one has stopped (ex. the serve command's next job).
+func (c *RunControls) Rearm() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isCanceled() {
+		c.canceled = make(chan bool)
+	}
+	c.skipped = make(map[string]bool)
+}
+
+func (c *RunControls) isCanceled() bool {
+	select {
+	case <-c.canceled:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stopped is true if the sync was canceled or, given a folder, the folder was skipped.
+func (c *RunControls) Stopped(folder string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.isCanceled() || (len(folder) > 0 && c.skipped[folder])
+}
+
+// SkipFolder will have the rest of the source folder's messages ignored for this run.
+func (c *RunControls) SkipFolder(folder string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.skipped[folder] {
+		log.Printf("skipping the rest of folder %s", folder)
+	}
+	c.skipped[folder] = true
+}
+
+// unskip forgets a skipped folder once its sync is over, so a later sync of it (ex. the
+// INBOX while idling) isn't skipped too.
+func (c *RunControls) unskip(folder string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.skipped, folder)
+}
+
+func (c *RunControls) Skipped(folder string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.skipped[folder]
+}
+
+// OnReload adds f to what's done by Reload.
+func (c *RunControls) OnReload(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reloaders = append(c.reloaders, f)
+}
+
+// Reload has the settings that can change while running read again (ex. on SIGHUP),
+// by calling each func given to OnReload in turn. Syncs under way aren't interrupted.
+func (c *RunControls) Reload() {
+	c.mu.Lock()
+	reloaders := c.reloaders
+	c.mu.Unlock()
+	log.Print("reloading the settings")
+	for _, reload := range reloaders {
+		reload()
+	}
+}
+
+func (c *RunControls) setAddDestination(add func(InboxInfo) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addDestination = add
+}
+
+// AddDestination adds the destination to the sync idling in this process.
+func (c *RunControls) AddDestination(dst InboxInfo) error {
+	c.mu.Lock()
+	add := c.addDestination
+	c.mu.Unlock()
+	if add == nil {
+		return ErrNotIdling
+	}
+	return add(dst)
+}
+
+// ServeHTTP lets the sync be controlled with a POST to /control/pause, /control/resume,
+// /control/cancel or /control/reload. A POST of an InboxInfo (like a config's "dest")
+// to /control/destinations adds it with AddDestination.
+func (c *RunControls) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	switch r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:] {
+	case "destinations":
+		c.serveAddDestination(w, r)
+		return
+	case "pause":
+		c.Pause()
+	case "resume":
+		c.Resume()
+	case "cancel":
+		c.Cancel()
+	case "reload":
+		c.Reload()
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown control"})
+		return
+	}
+	c.mu.Lock()
+	status := map[string]bool{"paused": c.paused, "canceled": c.isCanceled()}
+	c.mu.Unlock()
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (c *RunControls) serveAddDestination(w http.ResponseWriter, r *http.Request) {
+	var dst InboxInfo
+	if err := json.NewDecoder(r.Body).Decode(&dst); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	err := dst.DiscoverHost()
+	if err == nil {
+		err = dst.Validate()
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	switch err = c.AddDestination(dst); {
+	case err == ErrNotIdling:
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"added": dst.User})
+	}
+}
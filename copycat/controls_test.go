@@ -0,0 +1,225 @@
+package copycat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunControls(t *testing.T) {
+	c := newRunControls()
+	c.Pause()
+
+	resumed := make(chan bool)
+	go func() {
+		c.Wait()
+		close(resumed)
+	}()
+	select {
+	case <-resumed:
+		t.Fatal("Wait returned while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// canceling lets anything waiting on a pause go so it can stop
+	c.Cancel()
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("Wait didn't return once canceled")
+	}
+	if !c.Stopped("") || !c.Stopped("INBOX") {
+		t.Error("expected everything to be stopped once canceled")
+	}
+	c.Cancel()
+
+	c = newRunControls()
+	c.SkipFolder("Archive")
+	if !c.Stopped("Archive") || c.Stopped("INBOX") || c.Stopped("") {
+		t.Error("expected only the skipped folder to be stopped")
+	}
+	c.unskip("Archive")
+	if c.Stopped("Archive") {
+		t.Error("expected the skip to be over once the folder's sync is")
+	}
+}
+
+func TestWaitWhilePaused(t *testing.T) {
+	defer func(c *RunControls) { Controls = c }(Controls)
+	Controls = newRunControls()
+	Controls.Pause()
+
+	tick := make(chan time.Time)
+	noops := make(chan bool, 2)
+	resumed := make(chan bool)
+	go func() {
+		waitWhilePaused(tick, func() { noops <- true })
+		close(resumed)
+	}()
+	// the connection is kept alive for as long as the pause lasts
+	for i := 0; i < 2; i++ {
+		tick <- time.Now()
+		select {
+		case <-noops:
+		case <-time.After(time.Second):
+			t.Fatal("expected a NOOP on each tick while paused")
+		}
+	}
+	Controls.Resume()
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("waitWhilePaused didn't return once resumed")
+	}
+	// not paused, so it doesn't wait at all
+	waitWhilePaused(tick, func() { t.Error("expected no NOOP when not paused") })
+}
+
+func TestRunControlsHTTP(t *testing.T) {
+	c := newRunControls()
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	post := func(control string) int {
+		rsp, err := http.Post(server.URL+"/control/"+control, "", strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+	if post("pause") != http.StatusOK || !c.Paused() {
+		t.Error("expected the sync to be paused")
+	}
+	if post("resume") != http.StatusOK || c.Paused() {
+		t.Error("expected the sync to be resumed")
+	}
+	var reloads int
+	c.OnReload(func() { reloads++ })
+	if post("reload") != http.StatusOK || reloads != 1 {
+		t.Errorf("expected the settings to be reloaded once, got %d", reloads)
+	}
+	if post("restart") != http.StatusNotFound {
+		t.Error("expected an unknown control to be not found")
+	}
+	if post("cancel") != http.StatusOK || !c.Stopped("") {
+		t.Error("expected the sync to be canceled")
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	if _, err := ParseTimeWindow("22:00"); err == nil {
+		t.Error("expected a window without an end to be rejected")
+	}
+	w, err := ParseTimeWindow("22:00-06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.String() != "22:00-06:00" {
+		t.Errorf("expected 22:00-06:00, got %s", w)
+	}
+
+	at := func(hour, minute int) time.Time {
+		return time.Date(2014, 3, 1, hour, minute, 0, 0, time.UTC)
+	}
+	for _, check := range []struct {
+		at       time.Time
+		contains bool
+		next     time.Time
+	}{
+		{at(23, 0), true, at(30, 0)},
+		{at(3, 0), true, at(6, 0)},
+		{at(6, 0), false, at(22, 0)},
+		{at(12, 30), false, at(22, 0)},
+	} {
+		if w.Contains(check.at) != check.contains {
+			t.Errorf("expected %s in the window to be %v", check.at.Format("15:04"), check.contains)
+		}
+		if next := w.Next(check.at); !next.Equal(check.next) {
+			t.Errorf("expected the window to change at %s after %s, got %s", check.next, check.at.Format("15:04"), next)
+		}
+	}
+}
+
+func TestRunBudget(t *testing.T) {
+	defer func(c *RunControls) { Controls = c }(Controls)
+	Controls = newRunControls()
+
+	budget := NewRunBudget(RunLimits{Messages: 3}, true)
+	budget.Copied(100)
+	budget.Copied(100)
+	if budget.Reached() || Controls.Paused() {
+		t.Fatal("expected the budget to have room left")
+	}
+	budget.Copied(100)
+	if !budget.Reached() || !Controls.Paused() {
+		t.Fatal("expected reaching the budget to pause the sync")
+	}
+	budget.Reset()
+	if budget.Reached() || Controls.Paused() {
+		t.Fatal("expected a reset to resume the sync")
+	}
+
+	budget = NewRunBudget(RunLimits{Bytes: 150}, false)
+	budget.Copied(100)
+	budget.Copied(100)
+	if !Controls.Stopped("") {
+		t.Error("expected reaching the budget to cancel the sync")
+	}
+
+	// a nil budget never runs out
+	var none *RunBudget
+	none.Copied(1)
+	none.Reset()
+}
+
+func TestAddDestinationHTTP(t *testing.T) {
+	c := newRunControls()
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	post := func(body string) int {
+		rsp, err := http.Post(server.URL+"/control/destinations", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+	dst := `{"user": "bob@backup.example.com", "pw": "pw", "host": "imap.backup.example.com:993"}`
+	if status := post(dst); status != http.StatusConflict {
+		t.Errorf("expected a conflict with nothing idling, got %d", status)
+	}
+
+	var added []InboxInfo
+	c.setAddDestination(func(info InboxInfo) error {
+		added = append(added, info)
+		return nil
+	})
+	if status := post(`{"user": "bob"}`); status != http.StatusBadRequest {
+		t.Errorf("expected a destination without a password to be refused, got %d", status)
+	}
+	if status := post(dst); status != http.StatusOK {
+		t.Errorf("expected the destination to be added, got %d", status)
+	}
+	expected := []InboxInfo{{User: "bob@backup.example.com", Pw: "pw", Host: "imap.backup.example.com:993"}}
+	if !reflect.DeepEqual(added, expected) {
+		t.Errorf("expected %v to be added, got %v", expected, added)
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	first := make(chan WorkRequest, 1)
+	f := &fanOut{requests: []chan WorkRequest{first}}
+	second := make(chan WorkRequest, 1)
+	f.add(second)
+	if sent := f.send(WorkRequest{Value: "<a@b>"}); sent != 2 {
+		t.Errorf("expected 2 requests, got %d", sent)
+	}
+	if (<-first).Value != "<a@b>" || (<-second).Value != "<a@b>" {
+		t.Error("expected both storers to get the request")
+	}
+}
@@ -1,9 +1,12 @@
 package copycat
 
 import (
-	"crypto/tls"
 	"errors"
+	"fmt"
 	"log"
+	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -27,9 +30,9 @@ func NewCopyCat(src InboxInfo, dsts []InboxInfo, connsPerInbox int, sync bool, i
 	}
 	log.Printf("Creating CopyCat to to sync %s's contents to the following mailbox(s):  %s", src.User, dstUsers)
 
-	cat = &CopyCat{}
+	cat = &CopyCat{src: src, connsPerInbox: connsPerInbox}
 	if sync {
-		if cat.SyncConns, err = initiateConnections(src, dsts, connsPerInbox); err != nil {
+		if cat.SyncConns, err = initiateConnections(src, dsts, "INBOX", nil, connsPerInbox); err != nil {
 			log.Printf("unable to initiate sync connections: %s", err.Error())
 			return cat, err
 		}
@@ -37,13 +40,13 @@ func NewCopyCat(src InboxInfo, dsts []InboxInfo, connsPerInbox int, sync bool, i
 	}
 
 	if idle {
-		if cat.IdlePurgeConns, err = initiateConnections(src, dsts, 2); err != nil {
+		if cat.IdlePurgeConns, err = initiateConnections(src, dsts, "INBOX", nil, 2); err != nil {
 			log.Printf("unable to initiate idle connections: %s", err.Error())
 			return cat, err
 		}
 		log.Print("created 2 connection per inbox for idling purging")
 
-		if cat.IdleAppendConns, err = initiateConnections(src, dsts, 1); err != nil {
+		if cat.IdleAppendConns, err = initiateConnections(src, dsts, "INBOX", nil, 1); err != nil {
 			log.Printf("unable to initiate idle connections: %s", err.Error())
 			return cat, err
 		}
@@ -64,16 +67,29 @@ type CopyCat struct {
 	IdleAppendConns conns
 	IdlePurgeConns  conns
 	IdleConn        *imap.Client
+
+	// Folders, if set, has AddDestination copy every folder to a new destination rather
+	// than just the INBOX, with SyncFolders' ParallelFolders and MaxConns.
+	Folders         bool
+	ParallelFolders int
+	MaxConns        int
+
+	src           InboxInfo
+	connsPerInbox int
+	// the destinations added while idling, see AddDestination
+	live *liveIdle
+	// guards IdleAppendConns.Dest, which AddDestination adds to
+	mu sync.Mutex
 }
 
 // Sync will make sure that the dst inbox looks exactly like the src.
-func (c *CopyCat) Sync(runPurge bool, dbFile string, quickSyncCount int) error {
-	return Sync(c.SyncConns.Source, c.SyncConns.Dest, runPurge, dbFile, quickSyncCount)
+func (c *CopyCat) Sync(sinks []Sink, runPurge bool, dbFile string, quickSyncCount int, transform Transformer, generateIds bool) error {
+	return Sync(c.SyncConns.Source, c.SyncConns.Dest, sinks, runPurge, dbFile, quickSyncCount, transform, generateIds)
 }
 
 // Idle will optionally sync the mailboxes, wait for updates
 // from the imap server and update the destinations appropriately.
-func (c *CopyCat) Idle(runSync bool, runPurge bool, dbFile string) (err error) {
+func (c *CopyCat) Idle(sinks []Sink, runSync bool, runPurge bool, dbFile string, transform Transformer, generateIds bool) (err error) {
 
 	purgeRequests := make(chan bool, 100)
 	// kick off sync as a goroutine if we plan on idling.
@@ -82,16 +98,21 @@ func (c *CopyCat) Idle(runSync bool, runPurge bool, dbFile string) (err error) {
 	// pick up those changes.
 	go func() {
 		if runSync {
-			err = Sync(c.SyncConns.Source, c.SyncConns.Dest, runPurge, dbFile, 0)
+			err = Sync(c.SyncConns.Source, c.SyncConns.Dest, sinks, runPurge, dbFile, 0, transform, generateIds)
 			if err != nil {
 				log.Print("SYNC ERROR: ", err.Error())
 			}
+			// the sync's failures don't count against the messages that arrive while idling
+			c.mu.Lock()
+			users := dstUsers(c.IdleAppendConns.Dest)
+			c.mu.Unlock()
+			resetErrorBudgets(users)
 		}
 
 		for _ = range purgeRequests {
 			err = SearchAndPurge(c.IdlePurgeConns.Source, c.IdlePurgeConns.Dest)
 			if err != nil {
-				log.Print("There was an error during the purge: (%s)", err.Error())
+				log.Printf("There was an error during the purge: (%s)", err.Error())
 			}
 		}
 
@@ -99,18 +120,31 @@ func (c *CopyCat) Idle(runSync bool, runPurge bool, dbFile string) (err error) {
 
 	var appendRequests []chan WorkRequest
 	var storers sync.WaitGroup
+	fanout := &fanOut{}
+	c.live = &liveIdle{fanout: fanout, storers: &storers, transform: transform, dbFile: dbFile, generateIds: generateIds}
 	// setup storers for each destination
-	for _, dst := range c.IdleAppendConns.Dest {
-		storeRequests := make(chan WorkRequest)
+	for user, dst := range c.IdleAppendConns.Dest {
+		storeRequests := make(chan WorkRequest, SearchPipelineDepth)
 		for _, dstConn := range dst {
 			storers.Add(1)
-			go CheckAndAppendMessages(dstConn, storeRequests, nil, &storers)
+			go CheckAndAppendMessages(dstConn, user, storeRequests, nil, transform, &storers, nil)
 		}
 		appendRequests = append(appendRequests, storeRequests)
 	}
+	// ...and for each sink
+	for _, sink := range sinks {
+		storeRequests := make(chan WorkRequest)
+		storers.Add(1)
+		go StoreToSink(sink, "INBOX", storeRequests, nil, transform, &storers, nil)
+		appendRequests = append(appendRequests, storeRequests)
+	}
 
 	// idle...
-	err = Idle(c.IdleConn, appendRequests, purgeRequests)
+	fanout.requests = appendRequests
+	// only once the fan out is set up, so an added destination's storer isn't lost
+	Controls.setAddDestination(c.AddDestination)
+	defer Controls.setAddDestination(nil)
+	err = idle(c.IdleConn, fanout, purgeRequests, generateIds)
 	if err != nil {
 		log.Print("IDLE ERROR: ", err.Error())
 	}
@@ -119,22 +153,27 @@ func (c *CopyCat) Idle(runSync bool, runPurge bool, dbFile string) (err error) {
 }
 
 // Sync will make sure that the dst inbox looks exactly like the src.
-func Sync(src []*imap.Client, dsts map[string][]*imap.Client, runPurge bool, dbFile string, quickSyncCount int) (err error) {
+func Sync(src []*imap.Client, dsts map[string][]*imap.Client, sinks []Sink, runPurge bool, dbFile string, quickSyncCount int, transform Transformer, generateIds bool) (err error) {
 	log.Print("beginning sync...")
+	resetErrorBudgets(dstUsers(dsts))
 
 	if runPurge {
 		err = SearchAndPurge(src, dsts)
 		if err != nil {
-			log.Print("There was an error during the purge. (%s) quitting process.", err.Error())
+			log.Printf("There was an error during the purge. (%s) quitting process.", err.Error())
 			return
 		}
 	} else {
 		log.Printf("skipping purge")
 	}
 
-	err = SearchAndStore(src, dsts, dbFile, quickSyncCount)
+	err = SearchAndStore(src, dsts, sinks, dbFile, quickSyncCount, transform, generateIds)
 	if err != nil {
-		log.Print("There was an error during the store. (%s) quitting process.", err.Error())
+		log.Printf("There was an error during the store. (%s) quitting process.", err.Error())
+	} else if ExpungeSource {
+		if err = expungeDeleted(src[0], dsts, sinks, time.Time{}); err != nil {
+			log.Printf("There was an error expunging deleted messages from the source. (%s)", err.Error())
+		}
 	}
 	log.Print("sync complete")
 	return
@@ -142,7 +181,9 @@ func Sync(src []*imap.Client, dsts map[string][]*imap.Client, runPurge bool, dbF
 
 func (c *CopyCat) Close() {
 	c.SyncConns.Close()
+	c.mu.Lock()
 	c.IdleAppendConns.Close()
+	c.mu.Unlock()
 	c.IdlePurgeConns.Close()
 	if c.IdleConn != nil {
 		c.IdleConn.Logout(20 * time.Second)
@@ -158,6 +199,13 @@ type InboxInfo struct {
 	User string
 	Pw   string
 	Host string
+	// Admin, if set, is who logs in (ex. a Dovecot master user or Cyrus admin) to act
+	// as User with SASL PLAIN. Pw is then the Admin's password.
+	Admin string
+	// Root, if set on a destination, is the folder every synced folder is put under,
+	// ex. "Migrated/olduser@example.com", so several accounts can be synced into one
+	// without their folders mixing. Its levels are separated with "/".
+	Root string
 }
 
 func NewInboxInfo(id string, pw string, host string) (info InboxInfo, err error) {
@@ -183,17 +231,32 @@ func (i *InboxInfo) Validate() error {
 
 type MessageData struct {
 	InternalDate time.Time
+	Flags        []string
 	Body         []byte
+
+	// set by a FlagPolicy to append with Flags
+	flagsSet bool
+
+	// set by an EncryptedSink, the Body before it was encrypted
+	plainSHA256 string
+	plainSize   int
+
+	// set by InFlight.Hold
+	held       int
+	spill      string
+	spillSize  int
+	spillCodec byte
 }
 
 func FetchMessage(conn *imap.Client, messageUID uint32) (msg MessageData, err error) {
 	seq, _ := imap.NewSeqSet("")
 	seq.AddNum(messageUID)
 	var cmd *imap.Command
-	cmd, err = imap.Wait(conn.UIDFetch(seq, "INTERNALDATE", "BODY[]", "UID", "RFC822.HEADER"))
+	// PEEK so it isn't marked \Seen, even if the source were somehow selected read-write
+	cmd, err = imap.Wait(conn.UIDFetch(seq, "INTERNALDATE", "FLAGS", "BODY.PEEK[]", "UID"))
 	if err != nil {
 		log.Printf("Unable to fetch message (%d): %s", messageUID, err.Error())
-		return
+		return msg, wrapError("fetch", "", err)
 	}
 
 	if len(cmd.Data) == 0 {
@@ -202,15 +265,52 @@ func FetchMessage(conn *imap.Client, messageUID uint32) (msg MessageData, err er
 	}
 
 	msgFields := cmd.Data[0].MessageInfo().Attrs
-	msg = MessageData{InternalDate: imap.AsDateTime(msgFields["INTERNALDATE"]), Body: imap.AsBytes(msgFields["BODY[]"])}
+	msg = MessageData{InternalDate: imap.AsDateTime(msgFields["INTERNALDATE"]), Flags: flagList(imap.AsFlagSet(msgFields["FLAGS"])), Body: imap.AsBytes(msgFields["BODY[]"])}
 	return msg, nil
 }
 
+// flagList turns a FlagSet into a sorted list of flags.
+func flagList(flags imap.FlagSet) []string {
+	var list []string
+	for flag, set := range flags {
+		if set {
+			list = append(list, flag)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// AppendMessage will append the message to the conn's selected mailbox as unseen, or with
+// the flags given to it by a FlagPolicy. Errors are an *Error.
 func AppendMessage(conn *imap.Client, messageData MessageData) error {
-	_, err := imap.Wait(conn.Append("INBOX", imap.NewFlagSet("UnSeen"), &messageData.InternalDate, imap.NewLiteral(messageData.Body)))
+	_, err := appendMessageUID(conn, messageData)
 	return err
 }
 
+// appendMessageUID is AppendMessage, also returning the UID the message was given if the
+// server says (UIDPLUS), or 0.
+func appendMessageUID(conn *imap.Client, messageData MessageData) (uint32, error) {
+	if err := Faults.appendFailure(); err != nil {
+		return 0, err
+	}
+	cmd, err := imap.Wait(conn.Append(conn.Mailbox.Name, appendFlags(conn, messageData), &messageData.InternalDate, messageData.Literal()))
+	if err != nil && messageData.flagsSet && !abortsRun(err) {
+		log.Printf("Unable to append message with flags (%s): %s. trying without them", strings.Join(messageData.Flags, " "), err.Error())
+		return 0, wrapError("append", "", storeFlagsAfterAppend(conn, messageData))
+	}
+	if err != nil {
+		return 0, wrapError("append", "", err)
+	}
+	return appendUID(cmd), nil
+}
+
+// RestoreMessage will append the message to the conn's selected mailbox with its original flags.
+func RestoreMessage(conn *imap.Client, messageData MessageData) error {
+	messageData.flagsSet = true
+	return AppendMessage(conn, messageData)
+}
+
 func AddDeletedFlag(conn *imap.Client, uid uint32) error {
 	seqSet, _ := imap.NewSeqSet("")
 	seqSet.AddNum(uid)
@@ -218,11 +318,16 @@ func AddDeletedFlag(conn *imap.Client, uid uint32) error {
 	return err
 }
 
+// messageIdFetch pulls just the Message-Id header without setting \Seen.
+const messageIdFetch = "BODY.PEEK[HEADER.FIELDS (MESSAGE-ID)]"
+
+// GetAllMessages will fetch the UID and Message-Id header of every message in the selected
+// folder. Use MessageIdHeader to pull the header out of each response.
 func GetAllMessages(conn *imap.Client) (*imap.Command, error) {
-	// get headers and UID for ALL message in src inbox...
+	// get Message-Id and UID for ALL message in src inbox...
 	allMsgs, _ := imap.NewSeqSet("")
 	allMsgs.Add("1:*")
-	cmd, err := imap.Wait(conn.Fetch(allMsgs, "RFC822.HEADER", "UID"))
+	cmd, err := imap.Wait(conn.Fetch(allMsgs, messageIdFetch, "UID"))
 	if err != nil {
 		return &imap.Command{}, err
 	}
@@ -230,25 +335,95 @@ func GetAllMessages(conn *imap.Client) (*imap.Command, error) {
 	return cmd, nil
 }
 
-func GetConnection(info InboxInfo, readOnly bool) (*imap.Client, error) {
-	conn, err := imap.DialTLS(info.Host, new(tls.Config))
+// MessageIdHeader will return the header fields fetched by GetAllMessages. Servers
+// don't agree on how to echo back the field list, so any HEADER.FIELDS section is used.
+func MessageIdHeader(info *imap.MessageInfo) []byte {
+	for name, value := range info.Attrs {
+		if strings.HasPrefix(name, "BODY[HEADER.FIELDS") {
+			return imap.AsBytes(value)
+		}
+	}
+	return nil
+}
+
+// GetHeaders will fetch the full header of each of the messages.
+func GetHeaders(conn *imap.Client, uids []uint32) (map[uint32][]byte, error) {
+	headers := make(map[uint32][]byte)
+	if len(uids) == 0 {
+		return headers, nil
+	}
+
+	seq, _ := imap.NewSeqSet("")
+	for _, uid := range uids {
+		seq.AddNum(uid)
+	}
+	cmd, err := imap.Wait(conn.UIDFetch(seq, "RFC822.HEADER", "UID"))
 	if err != nil {
-		return nil, err
+		return headers, err
+	}
+	for _, rsp := range cmd.Data {
+		info := rsp.MessageInfo()
+		headers[info.UID] = imap.AsBytes(info.Attrs["RFC822.HEADER"])
 	}
+	return headers, nil
+}
+
+func GetConnection(info InboxInfo, readOnly bool) (*imap.Client, error) {
+	return GetFolderConnection(info, "INBOX", readOnly)
+}
 
-	_, err = conn.Login(info.User, info.Pw)
+// GetFolderConnection will log in and select the given folder. If readOnly is set, as it
+// is for every source connection, the folder is opened with EXAMINE, so the server won't
+// let anything in it change and an account with read-only rights to it can be synced
+// from. Errors are an *Error, and a login the server refuses for any reason it doesn't
+// give is an ErrAuth.
+func GetFolderConnection(info InboxInfo, folder string, readOnly bool) (*imap.Client, error) {
+	conn, err := dialIMAP(info.Host)
 	if err != nil {
-		return nil, err
+		return nil, &Error{Kind: ErrConnLost, Op: "connect to " + info.Host, Account: info.User, Err: err}
 	}
 
-	_, err = imap.Wait(conn.Select("INBOX", readOnly))
+	if err = login(conn, info); err != nil {
+		e := wrapError("login", info.User, err).(*Error)
+		if e.Kind == nil {
+			e.Kind = ErrAuth
+		}
+		return nil, e
+	}
+
+	_, err = imap.Wait(conn.Select(folder, readOnly))
 	if err != nil {
-		return nil, err
+		conn.Logout(20 * time.Second)
+		return nil, wrapError("select "+folder, info.User, err)
 	}
 
 	return conn, nil
 }
 
+// login authenticates as the info's User, or as its Admin on the User's behalf.
+func login(conn *imap.Client, info InboxInfo) error {
+	if len(info.Admin) == 0 {
+		_, err := conn.Login(info.User, info.Pw)
+		return err
+	}
+	if !conn.Caps["AUTH=PLAIN"] {
+		return fmt.Errorf("the server doesn't offer AUTH=PLAIN, needed for %s to log in as %s", info.Admin, info.User)
+	}
+	_, err := conn.Auth(imap.PlainAuth(info.Admin, info.Pw, info.User))
+	return err
+}
+
+// dialIMAP connects to the host over TLS (see AddressPreference), through the Faults
+// if they're set.
+func dialIMAP(host string) (*imap.Client, error) {
+	conn, err := dialTLS(host)
+	if err != nil {
+		return nil, err
+	}
+	name, _, _ := net.SplitHostPort(host)
+	return imap.NewClient(Faults.Conn(conn), name, 60*time.Second)
+}
+
 func ResetConnection(conn *imap.Client, readOnly bool) error {
 	// dont check for error because its possible it's already closed.
 	conn.Close(!readOnly)
@@ -261,39 +436,62 @@ func ResetConnection(conn *imap.Client, readOnly bool) error {
 	return nil
 }
 
-func initiateConnections(srcInfo InboxInfo, dstInfos []InboxInfo, connsPerInbox int) (conns conns, err error) {
-	//initiate connections
-	var srcConns []*imap.Client
+// DestinationConnections will create connsPerInbox connections to each destination.
+func DestinationConnections(dstInfos []InboxInfo, connsPerInbox int) (map[string][]*imap.Client, error) {
+	rememberRoots(dstInfos)
 	dstConns := make(map[string][]*imap.Client)
+	for _, dst := range dstInfos {
+		for i := 0; i < connsPerInbox; i++ {
+			dstConn, err := GetConnection(dst, false)
+			if err != nil {
+				log.Printf("Unable to connect to %s: %s", dst.User, err.Error())
+				return dstConns, err
+			}
+			dstConns[dst.User] = append(dstConns[dst.User], dstConn)
+		}
+	}
+	return dstConns, nil
+}
+
+// initiateConnections will create connsPerInbox connections to the source and each destination
+// with the given folder selected. Destinations in dstNames (by user) select that name instead,
+// and the others select the folder under their Root if they have one. On error, any connections
+// that were made are returned so they can be closed.
+func initiateConnections(srcInfo InboxInfo, dstInfos []InboxInfo, folder string, dstNames map[string]string, connsPerInbox int) (conns conns, err error) {
+	rememberRoots(dstInfos)
+	//initiate connections
+	conns.Dest = make(map[string][]*imap.Client)
 	for i := 0; i < connsPerInbox; i++ {
 		// initiate source connections
 		var sourceConn *imap.Client
-		sourceConn, err = GetConnection(srcInfo, true)
+		sourceConn, err = GetFolderConnection(srcInfo, folder, true)
 		if err != nil {
 			log.Printf("Unable to connect to %s: %s", srcInfo.User, err.Error())
 			return
 		}
-		srcConns = append(srcConns, sourceConn)
+		conns.Source = append(conns.Source, sourceConn)
 
 		// initiate destination connections
 		for _, dst := range dstInfos {
+			dstFolder := folder
+			name, renamed := dstNames[dst.User]
+			if renamed {
+				dstFolder = name
+			}
 			var dstConn *imap.Client
-			if dstConn, err = GetConnection(dst, false); err != nil {
+			if len(dst.Root) > 0 && !renamed {
+				dstConn, err = getRootedConnection(dst, dstFolder)
+			} else {
+				dstConn, err = GetFolderConnection(dst, dstFolder, false)
+			}
+			if err != nil {
 				log.Printf("Unable to connect to %s: %s", dst.User, err.Error())
 				return
 			}
-
-			if _, exists := dstConns[dst.User]; exists {
-				dstConns[dst.User] = append(dstConns[dst.User], dstConn)
-			} else {
-				dstConns[dst.User] = []*imap.Client{dstConn}
-			}
-
+			conns.Dest[dst.User] = append(conns.Dest[dst.User], dstConn)
 		}
 	}
 
-	conns.Source = srcConns
-	conns.Dest = dstConns
 	return conns, nil
 }
 
@@ -302,6 +500,17 @@ type WorkRequest struct {
 	Header string
 	UID    uint32
 	Msg    MessageData
+	// the source folder the message is in
+	Folder string
+	// the RFC822.SIZE of the message, or 0 if it isn't known
+	Size uint32
+
+	// how long the destination search took
+	searched time.Duration
+	// the broker to tell if the message won't be fetched, if there is one
+	broker *broker
+	// set by searchAndStore so the storers can pass over messages that keep failing
+	skips *skipList
 }
 
 type conns struct {
@@ -0,0 +1,102 @@
+package copycat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// drainPollInterval is the longest to wait between checks of the source while draining.
+const drainPollInterval = 10 * time.Second
+
+// Cutover moves a mailbox to a new server with as short a window as possible where
+// new mail only lands on the old one. Sync is run once to copy everything over while
+// the source is still live. Then the FreezeCommand (ex. a script that points MX records
+// at the new server or makes the source read-only) is run, the source INBOX is watched
+// until nothing has arrived for Quiet and Sync is run again to copy what came in
+// along the way. Sync should do a complete pass, it is usually cheap the second time.
+// Messages the bulk copy couldn't store (see FailedMessages) don't stop the cutover,
+// they're reported and tried again in the delta pass.
+type Cutover struct {
+	Source        InboxInfo
+	Sync          func() error
+	FreezeCommand string
+	Quiet         time.Duration
+}
+
+func (c Cutover) Run() error {
+	start := time.Now()
+	log.Print("cutover: starting the bulk copy")
+	var failed FailedMessages
+	if err := c.Sync(); errors.As(err, &failed) {
+		log.Printf("cutover: bulk copy complete in %s, but %d message(s) couldn't be stored. they'll be tried again in the delta pass", time.Since(start), failed)
+	} else if err != nil {
+		return fmt.Errorf("bulk copy failed: %s", err.Error())
+	} else {
+		log.Printf("cutover: bulk copy complete in %s", time.Since(start))
+	}
+
+	frozen := time.Now()
+	if len(c.FreezeCommand) > 0 {
+		log.Printf("cutover: freezing the source with: %s", c.FreezeCommand)
+		if out, err := exec.Command("sh", "-c", c.FreezeCommand).CombinedOutput(); err != nil {
+			return fmt.Errorf("freeze command failed: %s (%s)", err.Error(), strings.TrimSpace(string(out)))
+		}
+	}
+
+	if c.Quiet > 0 {
+		log.Printf("cutover: waiting for the source to be quiet for %s", c.Quiet)
+		if err := c.drain(); err != nil {
+			return fmt.Errorf("unable to watch the source: %s", err.Error())
+		}
+	}
+
+	log.Print("cutover: starting the delta pass")
+	delta := time.Now()
+	err := c.Sync()
+	if err != nil && !errors.As(err, &failed) {
+		return fmt.Errorf("delta pass failed: %s", err.Error())
+	}
+	log.Printf("cutover: delta pass complete in %s. the source was frozen for %s. total time %s", time.Since(delta), time.Since(frozen), time.Since(start))
+	if err != nil {
+		return fmt.Errorf("delta pass: %s", err.Error())
+	}
+	return nil
+}
+
+// drain waits until the STATUS of the source INBOX hasn't changed for Quiet, so mail
+// that was already on its way when the source was frozen makes it into the delta pass.
+func (c Cutover) drain() error {
+	conn, err := GetConnection(c.Source, true)
+	if err != nil {
+		return err
+	}
+	defer conn.Logout(20 * time.Second)
+
+	poll := c.Quiet / 4
+	if poll > drainPollInterval {
+		poll = drainPollInterval
+	}
+
+	last, err := GetFolderStatus(conn, "INBOX")
+	if err != nil {
+		return err
+	}
+	changed := time.Now()
+	for time.Since(changed) < c.Quiet {
+		time.Sleep(poll)
+		status, err := GetFolderStatus(conn, "INBOX")
+		if err != nil {
+			return err
+		}
+		if status != last {
+			log.Printf("cutover: the source INBOX is still changing (%d messages, next UID %d)", status.Messages, status.UIDNext)
+			last = status
+			changed = time.Now()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package copycat
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCutover(t *testing.T) {
+	var passes int
+	cut := Cutover{Sync: func() error { passes++; return nil }, FreezeCommand: "true"}
+	if err := cut.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if passes != 2 {
+		t.Errorf("expected a bulk copy and a delta pass, got %d passes", passes)
+	}
+
+	// the source has to be frozen before the delta pass
+	passes = 0
+	cut.FreezeCommand = "echo no >&2; false"
+	if err := cut.Run(); err == nil {
+		t.Errorf("expected the failed freeze to stop the cutover")
+	}
+	if passes != 1 {
+		t.Errorf("expected only the bulk copy, got %d passes", passes)
+	}
+
+	// messages that couldn't be stored don't stop the cutover, other errors do
+	passes = 0
+	cut.FreezeCommand = "true"
+	cut.Sync = func() error { passes++; return FailedMessages(2) }
+	if err := cut.Run(); err == nil {
+		t.Errorf("expected the messages the delta pass couldn't store to be reported")
+	}
+	if passes != 2 {
+		t.Errorf("expected a bulk copy and a delta pass despite the failed messages, got %d passes", passes)
+	}
+	passes = 0
+	cut.Sync = func() error {
+		passes++
+		return &Error{Kind: ErrAuth, Op: "login", Err: errors.New("NO [AUTHENTICATIONFAILED]")}
+	}
+	if err := cut.Run(); err == nil || passes != 1 {
+		t.Errorf("expected a failed login to stop the cutover after the bulk copy, got %v after %d passes", err, passes)
+	}
+}
@@ -0,0 +1,206 @@
+package copycat
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// The AddressPreference values.
+const (
+	// PreferAuto tries the addresses in the order DNS gave them.
+	PreferAuto = "auto"
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+	// IPv4Only and IPv6Only never try the other family.
+	IPv4Only = "ipv4-only"
+	IPv6Only = "ipv6-only"
+)
+
+// AddressPreference is which IP family servers are connected to over first. The other
+// family is tried alongside it after FallbackDelay (Happy Eyeballs, RFC 8305), or as
+// soon as every address of the preferred family has failed.
+var AddressPreference = PreferAuto
+
+// FallbackDelay is how long the preferred family gets before the other is tried too.
+var FallbackDelay = 300 * time.Millisecond
+
+// DialTimeout is how long each address gets to connect.
+var DialTimeout = 30 * time.Second
+
+// DNSCacheTTL is how long a host's addresses are kept, so a run with hundreds of
+// connections doesn't look them up for each one. 0 to look them up every time.
+var DNSCacheTTL = 5 * time.Minute
+
+var resolved = struct {
+	sync.Mutex
+	hosts map[string]resolvedHost
+}{hosts: make(map[string]resolvedHost)}
+
+type resolvedHost struct {
+	addrs   []net.IP
+	expires time.Time
+}
+
+// ParseAddressPreference checks the preference is one of the AddressPreference values.
+func ParseAddressPreference(s string) (string, error) {
+	switch s {
+	case PreferAuto, PreferIPv4, PreferIPv6, IPv4Only, IPv6Only:
+		return s, nil
+	}
+	return "", fmt.Errorf("expected auto, ipv4, ipv6, ipv4-only or ipv6-only, not %q", s)
+}
+
+// lookupHost returns the host's addresses, from the cache if they're still fresh.
+func lookupHost(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	resolved.Lock()
+	cached, exists := resolved.hosts[host]
+	resolved.Unlock()
+	if exists && time.Now().Before(cached.expires) {
+		return cached.addrs, nil
+	}
+
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		if exists {
+			// a stale answer is better than none while DNS is having trouble
+			return cached.addrs, nil
+		}
+		return nil, err
+	}
+	if DNSCacheTTL > 0 {
+		resolved.Lock()
+		resolved.hosts[host] = resolvedHost{addrs: addrs, expires: time.Now().Add(DNSCacheTTL)}
+		resolved.Unlock()
+	}
+	return addrs, nil
+}
+
+// orderAddrs splits the addresses into the ones to try first and the fallbacks, by the preference.
+func orderAddrs(addrs []net.IP, preference string) (primaries []net.IP, fallbacks []net.IP) {
+	var v4, v6 []net.IP
+	for _, ip := range addrs {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch preference {
+	case PreferIPv4:
+		return v4, v6
+	case PreferIPv6:
+		return v6, v4
+	case IPv4Only:
+		return v4, nil
+	case IPv6Only:
+		return v6, nil
+	}
+	// whichever family DNS listed first
+	if len(addrs) > 0 && addrs[0].To4() == nil {
+		return v6, v4
+	}
+	return v4, v6
+}
+
+// dial connects to the host:port over TCP, racing the preferred and fallback addresses.
+func dial(address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := lookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	primaries, fallbacks := orderAddrs(addrs, AddressPreference)
+	if len(primaries) == 0 {
+		primaries, fallbacks = fallbacks, nil
+	}
+	if len(primaries) == 0 {
+		return nil, fmt.Errorf("%s has no %s addresses", host, AddressPreference)
+	}
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan result)
+	done := make(chan struct{})
+	defer close(done)
+	race := func(addrs []net.IP, primary bool) {
+		conn, err := dialSerial(addrs, port)
+		select {
+		case results <- result{conn, err, primary}:
+		case <-done:
+			// the other family won
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	go race(primaries, true)
+	fallback := time.NewTimer(FallbackDelay)
+	defer fallback.Stop()
+	racing := 1
+	startFallback := func() {
+		if len(fallbacks) > 0 {
+			go race(fallbacks, false)
+			racing++
+			fallbacks = nil
+		}
+	}
+	var firstErr error
+	for racing > 0 {
+		select {
+		case <-fallback.C:
+			startFallback()
+		case r := <-results:
+			racing--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			if firstErr == nil || r.primary {
+				firstErr = r.err
+			}
+			startFallback()
+		}
+	}
+	return nil, firstErr
+}
+
+// dialSerial tries each address in turn until one connects.
+func dialSerial(addrs []net.IP, port string) (net.Conn, error) {
+	var err error
+	for _, ip := range addrs {
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), DialTimeout); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// dialTLS connects to the host:port with dial and starts TLS on the connection.
+func dialTLS(address string) (net.Conn, error) {
+	conn, err := dial(address)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(address)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+	tlsConn.SetDeadline(time.Now().Add(DialTimeout))
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -0,0 +1,80 @@
+package copycat
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOrderAddrs(t *testing.T) {
+	v4, v6 := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	tests := []struct {
+		preference string
+		addrs      []net.IP
+		primaries  []net.IP
+		fallbacks  []net.IP
+	}{
+		{PreferAuto, []net.IP{v6, v4}, []net.IP{v6}, []net.IP{v4}},
+		{PreferAuto, []net.IP{v4, v6}, []net.IP{v4}, []net.IP{v6}},
+		{PreferIPv4, []net.IP{v6, v4}, []net.IP{v4}, []net.IP{v6}},
+		{PreferIPv6, []net.IP{v4, v6}, []net.IP{v6}, []net.IP{v4}},
+		{IPv4Only, []net.IP{v6, v4}, []net.IP{v4}, nil},
+		{IPv6Only, []net.IP{v4}, nil, nil},
+	}
+	for _, test := range tests {
+		primaries, fallbacks := orderAddrs(test.addrs, test.preference)
+		if !sameIPs(primaries, test.primaries) || !sameIPs(fallbacks, test.fallbacks) {
+			t.Errorf("%s %v: expected %v then %v, got %v then %v", test.preference, test.addrs, test.primaries, test.fallbacks, primaries, fallbacks)
+		}
+	}
+
+	if _, err := ParseAddressPreference("ipv5"); err == nil {
+		t.Error("expected an unknown preference to be rejected")
+	}
+}
+
+func sameIPs(a []net.IP, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	defer func(preference string, delay time.Duration) {
+		AddressPreference, FallbackDelay = preference, delay
+	}(AddressPreference, FallbackDelay)
+	FallbackDelay = 10 * time.Millisecond
+
+	AddressPreference = PreferIPv6
+	conn, err := dial(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("expected to fall back to IPv4, got %s", err)
+	}
+	conn.Close()
+
+	AddressPreference = IPv6Only
+	if _, err = dial(listener.Addr().String()); err == nil {
+		t.Error("expected IPv6 only not to dial an IPv4 address")
+	}
+}
@@ -0,0 +1,92 @@
+package copycat
+
+import (
+	"sort"
+	"strings"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// DiffResult lists how the messages of a folder differ between a source and destination.
+type DiffResult struct {
+	SourceOnly  []string
+	DestOnly    []string
+	FlagsDiffer []FlagDiff
+}
+
+// FlagDiff is a message with different flags in the source and destination.
+type FlagDiff struct {
+	MessageId string
+	Source    []string
+	Dest      []string
+}
+
+// Diff compares the messages in the folders selected on src and dst by Message-Id
+// without changing anything. Flags are only compared if compareFlags is set, since
+// copies normally only get an UnSeen flag (see FlagPolicy).
+func Diff(src *imap.Client, dst *imap.Client, compareFlags bool) (DiffResult, error) {
+	srcMsgs, err := messageFlags(src)
+	if err != nil {
+		return DiffResult{}, err
+	}
+	dstMsgs, err := messageFlags(dst)
+	if err != nil {
+		return DiffResult{}, err
+	}
+	return diffMessages(srcMsgs, dstMsgs, compareFlags), nil
+}
+
+// messageFlags returns the flags of every message with a Message-Id in the selected folder.
+func messageFlags(conn *imap.Client) (map[string][]string, error) {
+	msgs := make(map[string][]string)
+	if conn.Mailbox.Messages == 0 {
+		return msgs, nil
+	}
+
+	seq, _ := imap.NewSeqSet("")
+	seq.AddRange(1, 0)
+	cmd, err := imap.Wait(conn.Fetch(seq, messageIdFetch, "FLAGS"))
+	if err != nil {
+		return nil, err
+	}
+	for _, rsp := range cmd.Data {
+		info := rsp.MessageInfo()
+		header := messageHeader(conn, info)
+		if len(header.Get("Message-Id")) == 0 {
+			continue
+		}
+		flags := imap.FlagSet{}
+		for flag := range info.Flags {
+			// \Recent is set by the server and never matches
+			if flag != `\Recent` {
+				flags[flag] = true
+			}
+		}
+		msgs[header.Get("Message-Id")] = flagList(flags)
+	}
+	return msgs, nil
+}
+
+func diffMessages(src map[string][]string, dst map[string][]string, compareFlags bool) DiffResult {
+	var result DiffResult
+	for id, srcFlags := range src {
+		dstFlags, exists := dst[id]
+		if !exists {
+			result.SourceOnly = append(result.SourceOnly, id)
+			continue
+		}
+		if compareFlags && strings.Join(srcFlags, " ") != strings.Join(dstFlags, " ") {
+			result.FlagsDiffer = append(result.FlagsDiffer, FlagDiff{MessageId: id, Source: srcFlags, Dest: dstFlags})
+		}
+	}
+	for id := range dst {
+		if _, exists := src[id]; !exists {
+			result.DestOnly = append(result.DestOnly, id)
+		}
+	}
+
+	sort.Strings(result.SourceOnly)
+	sort.Strings(result.DestOnly)
+	sort.Slice(result.FlagsDiffer, func(i, j int) bool { return result.FlagsDiffer[i].MessageId < result.FlagsDiffer[j].MessageId })
+	return result
+}
@@ -0,0 +1,32 @@
+package copycat
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDiffMessages(t *testing.T) {
+	src := map[string][]string{
+		"<1@example.com>": {`\Seen`},
+		"<2@example.com>": {`\Flagged`, `\Seen`},
+		"<3@example.com>": nil,
+	}
+	dst := map[string][]string{
+		"<1@example.com>": {`\Seen`},
+		"<2@example.com>": {`\Seen`},
+		"<4@example.com>": nil,
+	}
+
+	result := diffMessages(src, dst, false)
+	if fmt.Sprint(result.SourceOnly) != "[<3@example.com>]" || fmt.Sprint(result.DestOnly) != "[<4@example.com>]" {
+		t.Errorf("unexpected differences: %+v", result)
+	}
+	if len(result.FlagsDiffer) != 0 {
+		t.Errorf("flags shouldn't be compared: %+v", result.FlagsDiffer)
+	}
+
+	result = diffMessages(src, dst, true)
+	if len(result.FlagsDiffer) != 1 || result.FlagsDiffer[0].MessageId != "<2@example.com>" {
+		t.Errorf("unexpected flag differences: %+v", result.FlagsDiffer)
+	}
+}
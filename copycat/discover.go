@@ -0,0 +1,228 @@
+package copycat
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// The ways a server can be discovered, in the order they're tried.
+const (
+	DiscoverSRV          = "srv"
+	DiscoverAutoconfig   = "autoconfig"
+	DiscoverAutodiscover = "autodiscover"
+)
+
+// Discovery is the IMAP server found for an email address.
+type Discovery struct {
+	// Host is the host:port to connect to over TLS.
+	Host string
+	// Method is how it was found and Source where from (ex. the SRV record or URL).
+	Method string
+	Source string
+	// Foreign is set if the Host isn't in the email's domain (see AllowDiscoveredHost).
+	Foreign bool
+}
+
+// AllowDiscoveredHost lets DiscoverHost use a Foreign server, ex. the provider's server
+// that autoconfig finds for a domain it hosts. Otherwise they're refused, since the
+// login would go to whoever answered the lookup.
+var AllowDiscoveredHost bool
+
+// Where servers are looked for. Each is formatted with the domain and email address
+// (escaped for a URL) as needed.
+var (
+	autoconfigURLs = []string{
+		"https://autoconfig.%[1]s/mail/config-v1.1.xml?emailaddress=%[2]s",
+		"https://%[1]s/.well-known/autoconfig/mail/config-v1.1.xml?emailaddress=%[2]s",
+		// Thunderbird's database of the big providers
+		"https://autoconfig.thunderbird.net/v1.1/%[1]s",
+	}
+	autodiscoverURLs = []string{
+		"https://autodiscover.%[1]s/autodiscover/autodiscover.xml",
+		"https://%[1]s/autodiscover/autodiscover.xml",
+	}
+	lookupSRV      = net.LookupSRV
+	discoverClient = &http.Client{Timeout: 15 * time.Second}
+)
+
+// Discover finds the IMAP server for the email address with its RFC 6186 SRV record,
+// Thunderbird autoconfig or Exchange autodiscover, in that order. Only servers that
+// take TLS from the start (imaps, usually port 993) are used. The password is only
+// sent to autodiscover, which may need it.
+func Discover(email string, password string) (Discovery, error) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return Discovery{}, fmt.Errorf("%q isn't an email address", email)
+	}
+	domain := strings.ToLower(email[at+1:])
+
+	found, err := discoverIn(domain, email, password)
+	if err != nil {
+		return Discovery{}, err
+	}
+	found.Foreign = !inDomain(found.Host, domain)
+	return found, nil
+}
+
+func discoverIn(domain string, email string, password string) (Discovery, error) {
+	if found, err := discoverSRV(domain); err == nil {
+		return found, nil
+	}
+	for _, pattern := range autoconfigURLs {
+		if found, err := discoverAutoconfig(fmt.Sprintf(pattern, domain, url.QueryEscape(email))); err == nil {
+			return found, nil
+		}
+	}
+	for _, pattern := range autodiscoverURLs {
+		if found, err := discoverAutodiscover(fmt.Sprintf(pattern, domain), email, password); err == nil {
+			return found, nil
+		}
+	}
+	return Discovery{}, fmt.Errorf("no IMAP server found for %s", domain)
+}
+
+// inDomain is true if the host (host:port) is the domain or its registrable parent
+// (ex. example.co.uk for mail.example.co.uk), or under either.
+func inDomain(host string, domain string) bool {
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		name = host
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if parent, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		domain = parent
+	}
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// DiscoverHost fills in the Host with Discover if it's empty and the User is an email address.
+// With an Admin, the Pw is the admin's, so it isn't sent to the user's domain. A Foreign
+// server is an error unless AllowDiscoveredHost is set.
+func (i *InboxInfo) DiscoverHost() error {
+	if len(i.Host) > 0 || !strings.Contains(i.User, "@") {
+		return nil
+	}
+	password := i.Pw
+	if len(i.Admin) > 0 {
+		password = ""
+	}
+	found, err := Discover(i.User, password)
+	if err != nil {
+		return err
+	}
+	log.Printf("found %s for %s with %s (%s)", found.Host, i.User, found.Method, found.Source)
+	if found.Foreign && !AllowDiscoveredHost {
+		return fmt.Errorf("%s, found for %s, isn't in its domain. Give the host to use it, or allow discovered hosts", found.Host, i.User)
+	}
+	i.Host = found.Host
+	return nil
+}
+
+func discoverSRV(domain string) (Discovery, error) {
+	_, records, err := lookupSRV("imaps", "tcp", domain)
+	if err != nil {
+		return Discovery{}, err
+	}
+	for _, record := range records {
+		// a target of "." says the service isn't offered
+		target := strings.TrimSuffix(record.Target, ".")
+		if len(target) == 0 {
+			continue
+		}
+		return Discovery{Host: net.JoinHostPort(target, strconv.Itoa(int(record.Port))), Method: DiscoverSRV, Source: "_imaps._tcp." + domain}, nil
+	}
+	return Discovery{}, ErrNotFound
+}
+
+type autoconfigServer struct {
+	Type       string `xml:"type,attr"`
+	Hostname   string `xml:"hostname"`
+	Port       int    `xml:"port"`
+	SocketType string `xml:"socketType"`
+}
+
+func discoverAutoconfig(configURL string) (Discovery, error) {
+	rsp, err := discoverClient.Get(configURL)
+	if err != nil {
+		return Discovery{}, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return Discovery{}, fmt.Errorf("%s: %s", configURL, rsp.Status)
+	}
+	var config struct {
+		Servers []autoconfigServer `xml:"emailProvider>incomingServer"`
+	}
+	if err = xml.NewDecoder(rsp.Body).Decode(&config); err != nil {
+		return Discovery{}, err
+	}
+	for _, server := range config.Servers {
+		if server.Type == "imap" && server.SocketType == "SSL" && len(server.Hostname) > 0 {
+			if server.Port == 0 {
+				server.Port = 993
+			}
+			return Discovery{Host: net.JoinHostPort(server.Hostname, strconv.Itoa(server.Port)), Method: DiscoverAutoconfig, Source: configURL}, nil
+		}
+	}
+	return Discovery{}, ErrNotFound
+}
+
+const autodiscoverRequest = `<?xml version="1.0" encoding="utf-8"?>
+<Autodiscover xmlns="http://schemas.microsoft.com/exchange/autodiscover/outlook/requestschema/2006">
+<Request><EMailAddress>%s</EMailAddress><AcceptableResponseSchema>http://schemas.microsoft.com/exchange/autodiscover/outlook/responseschema/2006a</AcceptableResponseSchema></Request>
+</Autodiscover>`
+
+type autodiscoverProtocol struct {
+	Type   string `xml:"Type"`
+	Server string `xml:"Server"`
+	Port   int    `xml:"Port"`
+	SSL    string `xml:"SSL"`
+}
+
+func discoverAutodiscover(discoverURL string, email string, password string) (Discovery, error) {
+	var body bytes.Buffer
+	xml.EscapeText(&body, []byte(email))
+	req, err := http.NewRequest("POST", discoverURL, strings.NewReader(fmt.Sprintf(autodiscoverRequest, body.String())))
+	if err != nil {
+		return Discovery{}, err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	if len(password) > 0 {
+		req.SetBasicAuth(email, password)
+	}
+	rsp, err := discoverClient.Do(req)
+	if err != nil {
+		return Discovery{}, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return Discovery{}, fmt.Errorf("%s: %s", discoverURL, rsp.Status)
+	}
+	var result struct {
+		Protocols []autodiscoverProtocol `xml:"Response>Account>Protocol"`
+	}
+	if err = xml.NewDecoder(rsp.Body).Decode(&result); err != nil {
+		return Discovery{}, err
+	}
+	for _, protocol := range result.Protocols {
+		// SSL defaults to on
+		if protocol.Type == "IMAP" && !strings.EqualFold(protocol.SSL, "off") && len(protocol.Server) > 0 {
+			port := protocol.Port
+			if port == 0 {
+				port = 993
+			}
+			return Discovery{Host: net.JoinHostPort(protocol.Server, strconv.Itoa(port)), Method: DiscoverAutodiscover, Source: discoverURL}, nil
+		}
+	}
+	return Discovery{}, ErrNotFound
+}
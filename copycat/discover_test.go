@@ -0,0 +1,154 @@
+package copycat
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+func TestDiscover(t *testing.T) {
+	defer func(srv func(string, string, string) (string, []*net.SRV, error), autoconfig []string, autodiscover []string) {
+		lookupSRV, autoconfigURLs, autodiscoverURLs = srv, autoconfig, autodiscover
+	}(lookupSRV, autoconfigURLs, autodiscoverURLs)
+
+	lookupSRV = func(service string, proto string, name string) (string, []*net.SRV, error) {
+		if name == "srv.example.com" && service == "imaps" {
+			return "", []*net.SRV{{Target: "imap.srv.example.com.", Port: 993}}, nil
+		}
+		return "", nil, errors.New("no such host")
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/autoconfig/config.example.com"):
+			fmt.Fprint(w, `<clientConfig version="1.1"><emailProvider id="config.example.com">
+<incomingServer type="pop3"><hostname>pop.config.example.com</hostname><port>995</port><socketType>SSL</socketType></incomingServer>
+<incomingServer type="imap"><hostname>mail.config.example.com</hostname><port>143</port><socketType>STARTTLS</socketType></incomingServer>
+<incomingServer type="imap"><hostname>mail.config.example.com</hostname><port>993</port><socketType>SSL</socketType></incomingServer>
+</emailProvider></clientConfig>`)
+		case strings.HasPrefix(r.URL.Path, "/autoconfig/hijacked.example.org"):
+			fmt.Fprint(w, `<clientConfig version="1.1"><emailProvider id="hijacked.example.org">
+<incomingServer type="imap"><hostname>imap.attacker.example.net</hostname><port>993</port><socketType>SSL</socketType></incomingServer>
+</emailProvider></clientConfig>`)
+		case r.URL.Path == "/autodiscover/exchange.example.com" && r.Method == "POST":
+			if _, pw, ok := r.BasicAuth(); ok && pw == "admin-secret" {
+				t.Error("the admin's password was sent to autodiscover")
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			if !strings.Contains(string(body), "<EMailAddress>bob@exchange.example.com</EMailAddress>") {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `<Autodiscover><Response><Account><Protocol><Type>EXCH</Type><Server>ex.example.com</Server></Protocol>
+<Protocol><Type>IMAP</Type><Server>outlook.example.com</Server><Port>993</Port><SSL>on</SSL></Protocol></Account></Response></Autodiscover>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	autoconfigURLs = []string{server.URL + "/autoconfig/%[1]s?emailaddress=%[2]s"}
+	autodiscoverURLs = []string{server.URL + "/autodiscover/%[1]s"}
+
+	tests := []struct {
+		email  string
+		host   string
+		method string
+	}{
+		{"bob@srv.example.com", "imap.srv.example.com:993", DiscoverSRV},
+		{"bob@config.example.com", "mail.config.example.com:993", DiscoverAutoconfig},
+		{"bob@exchange.example.com", "outlook.example.com:993", DiscoverAutodiscover},
+	}
+	for _, test := range tests {
+		found, err := Discover(test.email, "")
+		if err != nil {
+			t.Errorf("%s: %s", test.email, err)
+			continue
+		}
+		if found.Host != test.host || found.Method != test.method {
+			t.Errorf("%s: expected %s with %s, got %s with %s", test.email, test.host, test.method, found.Host, found.Method)
+		}
+	}
+	if _, err := Discover("bob@nowhere.example.com", ""); err == nil {
+		t.Error("expected nothing to be found for an unknown domain")
+	}
+
+	info := InboxInfo{User: "bob@srv.example.com", Pw: "secret"}
+	if err := info.DiscoverHost(); err != nil || info.Host != "imap.srv.example.com:993" {
+		t.Errorf("expected the host to be filled in, got %q (%v)", info.Host, err)
+	}
+	info = InboxInfo{User: "bob@exchange.example.com", Pw: "admin-secret", Admin: "admin@exchange.example.com"}
+	if err := info.DiscoverHost(); err != nil || info.Host != "outlook.example.com:993" {
+		t.Errorf("expected the host to be filled in without the admin's password, got %q (%v)", info.Host, err)
+	}
+
+	// a server outside the domain is only used if it's allowed
+	if found, err := Discover("bob@hijacked.example.org", ""); err != nil || !found.Foreign {
+		t.Errorf("expected the server to be found outside the domain, got %+v (%v)", found, err)
+	}
+	info = InboxInfo{User: "bob@hijacked.example.org", Pw: "secret"}
+	if err := info.DiscoverHost(); err == nil || len(info.Host) > 0 {
+		t.Errorf("expected the server outside the domain to be refused, got %q", info.Host)
+	}
+	defer func(allow bool) { AllowDiscoveredHost = allow }(AllowDiscoveredHost)
+	AllowDiscoveredHost = true
+	if err := info.DiscoverHost(); err != nil || info.Host != "imap.attacker.example.net:993" {
+		t.Errorf("expected the allowed server to be used, got %q (%v)", info.Host, err)
+	}
+}
+
+func TestInDomain(t *testing.T) {
+	tests := []struct {
+		host   string
+		domain string
+		in     bool
+	}{
+		{"imap.example.com:993", "example.com", true},
+		{"example.com:993", "example.com", true},
+		{"IMAP.Example.com.:993", "example.com", true},
+		{"imap.example.com:993", "mail.example.com", true},
+		{"imap.example.co.uk:993", "mail.example.co.uk", true},
+		{"imap.other.co.uk:993", "example.co.uk", false},
+		{"imap.gmail.com:993", "example.com", false},
+		{"imap.notexample.com:993", "example.com", false},
+		{"example.com.attacker.net:993", "example.com", false},
+	}
+	for _, test := range tests {
+		if in := inDomain(test.host, test.domain); in != test.in {
+			t.Errorf("inDomain(%q, %q) = %v, expected %v", test.host, test.domain, in, test.in)
+		}
+	}
+}
+
+func TestAdminLogin(t *testing.T) {
+	// an admin can only log in as the user with AUTH=PLAIN's authorization identity
+	conn := &imap.Client{Caps: map[string]bool{"IMAP4REV1": true}}
+	err := login(conn, InboxInfo{User: "bob@example.com", Pw: "admin-secret", Admin: "admin@example.com"})
+	if err == nil || !strings.Contains(err.Error(), "AUTH=PLAIN") {
+		t.Errorf("expected the admin login to need AUTH=PLAIN, got %v", err)
+	}
+}
+
+func TestSuggestProfile(t *testing.T) {
+	tests := []struct {
+		host string
+		name string
+	}{
+		{"imap.gmail.com:993", "Gmail"},
+		{"IMAP.GoogleMail.com", "Gmail"},
+		{"outlook.office365.com:993", "Microsoft 365"},
+		{"imap.example.com:993", ""},
+		{"notimap.gmail.com.example.com", ""},
+	}
+	for _, test := range tests {
+		profile, known := SuggestProfile(test.host)
+		if known != (len(test.name) > 0) || profile.Name != test.name {
+			t.Errorf("SuggestProfile(%q) = %q, %v, expected %q", test.host, profile.Name, known, test.name)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package copycat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// EnumerateWindow is how many UIDs are listed with each FETCH when listing a whole folder,
+// for servers that cap how much a FETCH returns or time out fetching everything at once.
+// 0, the default, lists the folder with a single FETCH.
+var EnumerateWindow uint32
+
+// enumerateRetries is how many times a window that fails is tried again before listing
+// stops. Each try halves the window, down to minEnumerateWindow.
+const (
+	enumerateRetries   = 3
+	minEnumerateWindow = 100
+)
+
+// enumerateMessages will FETCH the Message-Id of each message in seq and push a WorkRequest
+// for it onto the queue as soon as its response arrives. If from isn't 0, the messages are
+// listed from that UID up in windows of EnumerateWindow UIDs instead (see listWindows), and
+// if listing stops partway the UID it stopped at is returned. If generateIds is set, messages
+// without a Message-Id have their full headers pulled once the listing is done so
+// they can be given a SyntheticMessageId. If ThreadOrder is set, nothing is pushed until
+// the whole listing is done so the messages can be put in thread order. The highest UID
+// listed is returned too, counting messages that were left out (ex. as spam).
+func enumerateMessages(conn *imap.Client, seq *imap.SeqSet, from uint32, generateIds bool, queue *workQueue) (highest uint32, stoppedAt uint32, err error) {
+	span := Tracing.StartSpan("enumerate", nil, "folder", conn.Mailbox.Name)
+	var count int
+	defer func() {
+		span.Set("messages", strconv.Itoa(count))
+		span.Fail(err)
+		span.Finish()
+	}()
+
+	fetch := messageIdFetch
+	var threads *threader
+	if ThreadOrder {
+		fetch = threadFetch
+		threads = new(threader)
+	}
+	fetch = withSpamFields(fetch)
+	folder := conn.Mailbox.Name
+	push := func(request WorkRequest, references []string) {
+		request.Folder = folder
+		if tooLarge(request) {
+			return
+		}
+		if threads != nil {
+			threads.Add(request, references)
+		} else {
+			queue.Push(request)
+		}
+		Stats.Add("enumerated", 1)
+		count++
+	}
+
+	var noIds []uint32
+	sizes := make(map[uint32]uint32)
+	// the UIDs listed in the current window, so trying it again doesn't list them twice
+	var windowStart uint32
+	listed := make(map[uint32]bool)
+	list := func(cmd *imap.Command, err error, start uint32) error {
+		if err != nil {
+			return err
+		}
+		if start != windowStart {
+			windowStart = start
+			listed = make(map[uint32]bool)
+		}
+		for cmd.InProgress() {
+			if err = conn.Recv(-1); err != nil {
+				return err
+			}
+			for _, rsp := range cmd.Data {
+				info := rsp.MessageInfo()
+				// n:* is always the last message, even when its UID is below n
+				if info == nil || start > 0 && (info.UID < start || listed[info.UID]) {
+					continue
+				}
+				// even if it's left out below, so catching up doesn't list it again
+				if info.UID > highest {
+					highest = info.UID
+				}
+				header := messageHeader(conn, info)
+				if header == nil {
+					continue
+				}
+				if start > 0 {
+					listed[info.UID] = true
+				}
+				if isSpam(folder, header) {
+					continue
+				}
+
+				value := header.Get("Message-Id")
+				if len(value) == 0 && generateIds {
+					noIds = append(noIds, info.UID)
+					sizes[info.UID] = info.Size
+					continue
+				}
+				push(WorkRequest{Value: value, Header: "Message-Id", UID: info.UID, Size: info.Size}, References(header))
+			}
+			cmd.Data = nil
+		}
+		// we don't care about anything the server told us along the way
+		conn.Data = nil
+
+		_, err = cmd.Result(imap.OK)
+		return err
+	}
+
+	if from == 0 {
+		cmd, fetchErr := conn.Fetch(seq, fetch, "UID", "RFC822.SIZE")
+		err = list(cmd, fetchErr, 0)
+	} else {
+		stoppedAt, err = listWindows(conn, from, func(window *imap.SeqSet, start uint32) error {
+			cmd, err := conn.UIDFetch(window, fetch, "UID", "RFC822.SIZE")
+			return list(cmd, err, start)
+		})
+	}
+	if err != nil && (from == 0 || count == 0) {
+		return highest, stoppedAt, err
+	}
+
+	headers, headerErr := GetHeaders(conn, noIds)
+	for _, uid := range noIds {
+		if header, exists := headers[uid]; exists {
+			push(WorkRequest{Value: SyntheticMessageId(header), Header: "Message-Id", UID: uid, Size: sizes[uid]}, nil)
+		}
+	}
+
+	if threads != nil {
+		for _, request := range threads.Order() {
+			queue.Push(request)
+		}
+	}
+	if err == nil {
+		err = headerErr
+	}
+	return highest, stoppedAt, err
+}
+
+// uidOf is the UID of the message with the sequence number in the selected folder.
+func uidOf(conn *imap.Client, num uint32) (uint32, error) {
+	if num <= 1 {
+		return 1, nil
+	}
+	seq, _ := imap.NewSeqSet("")
+	seq.AddNum(num)
+	cmd, err := imap.Wait(conn.Fetch(seq, "UID"))
+	if err != nil {
+		return 0, err
+	}
+	for _, rsp := range cmd.Data {
+		if info := rsp.MessageInfo(); info != nil && info.UID > 0 {
+			return info.UID, nil
+		}
+	}
+	return 0, fmt.Errorf("no UID for message %d", num)
+}
+
+// listWindows calls list with windows of EnumerateWindow UIDs from the UID from up, the
+// last one open ended so messages that arrive while listing are included. A window that
+// fails is tried again, halved in case it was more than the server would take. If it
+// keeps failing, listing stops and the UID it stopped at is returned with the error.
+func listWindows(conn *imap.Client, from uint32, list func(window *imap.SeqSet, start uint32) error) (uint32, error) {
+	folder := conn.Mailbox.Name
+	size := EnumerateWindow
+	cursor := from
+	var failures int
+	for {
+		next := conn.Mailbox.UIDNext
+		window, _ := imap.NewSeqSet("")
+		last := cursor + size - 1
+		final := next == 0 || last+1 >= next || last < cursor
+		if final {
+			window.Add(fmt.Sprintf("%d:*", cursor))
+		} else {
+			window.AddRange(cursor, last)
+		}
+
+		err := list(window, cursor)
+		if err == nil {
+			if final {
+				return 0, nil
+			}
+			cursor, failures = last+1, 0
+			continue
+		}
+		failures++
+		if failures > enumerateRetries || abortsRun(err) || Controls.Stopped("") {
+			return cursor, fmt.Errorf("listing stopped at UID %d: %s", cursor, err.Error())
+		}
+		if size/2 >= minEnumerateWindow {
+			size /= 2
+		}
+		log.Printf("Unable to list the messages in %s from UID %d: %s. trying again with %d UIDs", folder, cursor, err.Error(), size)
+		time.Sleep(time.Duration(failures) * time.Second)
+		// a failed FETCH can leave the session in any state, so start the folder afresh
+		if _, err = imap.Wait(conn.Select(folder, true)); err != nil {
+			return cursor, fmt.Errorf("listing stopped at UID %d: %s", cursor, err.Error())
+		}
+	}
+}
+
+// QueueMemory is how many listed messages a folder's work queue holds in memory. Any more
+// wait in a temporary file until the storers catch up, so listing a huge folder doesn't
+// hold every Message-Id in memory. 0 for no limit.
+var QueueMemory = 100000
+
+// workQueue is a FIFO of WorkRequests that never blocks Push. Listing messages must never
+// wait on the storers, since they may be waiting on the same connection to fetch from.
+// Past QueueMemory requests, they're spilled to disk.
+type workQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	requests []WorkRequest
+	closed   bool
+	// the number and total RFC822.SIZE of every request pushed
+	pushed int
+	bytes  int64
+	// requests pushed once the queue was full, in order, and how many are yet to be read back
+	spill, spillIn *os.File
+	writer         *bufio.Writer
+	reader         *bufio.Reader
+	spilled        int
+}
+
+// spilledRequest is the part of a WorkRequest that's known when it's listed.
+type spilledRequest struct {
+	Value  string
+	Header string
+	UID    uint32
+	Folder string
+	Size   uint32
+}
+
+func newWorkQueue() *workQueue {
+	q := &workQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *workQueue) Push(request WorkRequest) {
+	q.mu.Lock()
+	// once anything is spilled, everything after it is too so the order is kept
+	if !q.spillRequest(request) {
+		q.requests = append(q.requests, request)
+	}
+	q.pushed++
+	q.bytes += int64(request.Size)
+	q.mu.Unlock()
+	Stats.Add("queued", 1)
+	q.cond.Signal()
+}
+
+// spillRequest writes the request to the spill file if the queue is full, returning
+// false if it should be kept in memory instead. q.mu must be held.
+func (q *workQueue) spillRequest(request WorkRequest) bool {
+	if QueueMemory <= 0 || (q.spill == nil && len(q.requests) < QueueMemory) {
+		return false
+	}
+	if q.spill == nil {
+		file, err := ioutil.TempFile("", "copycat-queue-")
+		if err != nil {
+			log.Printf("Unable to spill listed messages to disk: %s. keeping them in memory", err.Error())
+			return false
+		}
+		// read back through a file of its own, since the writes move the file's offset
+		in, err := os.Open(file.Name())
+		if err != nil {
+			log.Printf("Unable to spill listed messages to disk: %s. keeping them in memory", err.Error())
+			file.Close()
+			os.Remove(file.Name())
+			return false
+		}
+		q.spill, q.spillIn, q.writer, q.reader = file, in, bufio.NewWriter(file), bufio.NewReader(in)
+	}
+	line, _ := json.Marshal(spilledRequest{Value: request.Value, Header: request.Header, UID: request.UID, Folder: request.Folder, Size: request.Size})
+	if _, err := q.writer.Write(append(line, '\n')); err != nil {
+		log.Printf("Unable to spill listed messages to disk: %s. keeping them in memory", err.Error())
+		return false
+	}
+	q.spilled++
+	return true
+}
+
+// unspill reads up to QueueMemory requests back from the spill file, removing it once
+// they've all been read. q.mu must be held.
+func (q *workQueue) unspill() {
+	if err := q.writer.Flush(); err != nil {
+		log.Printf("Unable to read listed messages back from disk: %s. %d message(s) will be synced on the next run", err.Error(), q.spilled)
+		q.removeSpill()
+		return
+	}
+	for len(q.requests) < QueueMemory && q.spilled > 0 {
+		line, err := q.reader.ReadBytes('\n')
+		var request spilledRequest
+		if err == nil {
+			err = json.Unmarshal(line, &request)
+		}
+		if err != nil {
+			log.Printf("Unable to read listed messages back from disk: %s. %d message(s) will be synced on the next run", err.Error(), q.spilled)
+			q.removeSpill()
+			return
+		}
+		q.requests = append(q.requests, WorkRequest{Value: request.Value, Header: request.Header, UID: request.UID, Folder: request.Folder, Size: request.Size})
+		q.spilled--
+	}
+	if q.spilled == 0 {
+		q.removeSpill()
+	}
+}
+
+// removeSpill drops anything left in the spill file and removes it. q.mu must be held.
+func (q *workQueue) removeSpill() {
+	if q.spill == nil {
+		return
+	}
+	Stats.Add("queued", -int64(q.spilled))
+	q.spill.Close()
+	q.spillIn.Close()
+	os.Remove(q.spill.Name())
+	q.spill, q.spillIn, q.writer, q.reader, q.spilled = nil, nil, nil, nil, 0
+}
+
+// Pop will wait for the next request. It returns false once the queue is closed and empty.
+func (q *workQueue) Pop() (WorkRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.requests) == 0 && q.spilled == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.requests) == 0 && q.spilled > 0 {
+		q.unspill()
+	}
+	if len(q.requests) == 0 {
+		return WorkRequest{}, false
+	}
+	request := q.requests[0]
+	q.requests[0] = WorkRequest{}
+	q.requests = q.requests[1:]
+	Stats.Add("queued", -1)
+	return request, true
+}
+
+// Listed returns how many requests were pushed and their total size.
+func (q *workQueue) Listed() (int, int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pushed, q.bytes
+}
+
+func (q *workQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// Discard drops whatever hasn't been popped, for when the storers stop early.
+func (q *workQueue) Discard() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	Stats.Add("queued", -int64(len(q.requests)))
+	q.requests = nil
+	q.removeSpill()
+}
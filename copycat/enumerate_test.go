@@ -0,0 +1,139 @@
+package copycat
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+func TestWorkQueue(t *testing.T) {
+	defer func(memory int) { QueueMemory = memory }(QueueMemory)
+	QueueMemory = 3
+
+	queue := newWorkQueue()
+	for i := 1; i <= 10; i++ {
+		queue.Push(WorkRequest{Value: fmt.Sprintf("<%d@example.com>", i), Header: "Message-Id", UID: uint32(i), Folder: "INBOX", Size: 100})
+	}
+	if len(queue.requests) != 3 || queue.spilled != 7 || queue.spill == nil {
+		t.Fatalf("expected 3 requests in memory and 7 on disk, got %d and %d", len(queue.requests), queue.spilled)
+	}
+	spill := queue.spill.Name()
+
+	// they come back in order, even when more are pushed while some are on disk
+	popped := 0
+	pop := func() {
+		request, ok := queue.Pop()
+		popped++
+		if !ok || request.UID != uint32(popped) || request.Value != fmt.Sprintf("<%d@example.com>", popped) || request.Folder != "INBOX" || request.Size != 100 {
+			t.Fatalf("expected request %d, got %+v (%t)", popped, request, ok)
+		}
+		if len(queue.requests) > QueueMemory {
+			t.Fatalf("expected at most %d requests in memory, got %d", QueueMemory, len(queue.requests))
+		}
+	}
+	for popped < 5 {
+		pop()
+	}
+	queue.Push(WorkRequest{Value: "<11@example.com>", Header: "Message-Id", UID: 11, Folder: "INBOX", Size: 100})
+	done := make(chan bool)
+	go func() {
+		for popped < 11 {
+			pop()
+		}
+		_, ok := queue.Pop()
+		done <- ok
+	}()
+	time.Sleep(10 * time.Millisecond)
+	queue.Close()
+	if <-done {
+		t.Error("expected a closed, empty queue to stop popping")
+	}
+	if listed, size := queue.Listed(); listed != 11 || size != 1100 {
+		t.Errorf("expected 11 requests of 1100 bytes listed, got %d of %d", listed, size)
+	}
+	if _, err := os.Stat(spill); !os.IsNotExist(err) {
+		t.Errorf("expected the spill file to be removed once it was read, got %v", err)
+	}
+
+	// what's left when the storers stop early is dropped, file and all
+	queue = newWorkQueue()
+	for i := 1; i <= 5; i++ {
+		queue.Push(WorkRequest{UID: uint32(i)})
+	}
+	spill = queue.spill.Name()
+	queue.Discard()
+	queue.Close()
+	if _, ok := queue.Pop(); ok {
+		t.Error("expected nothing to pop once the queue was discarded")
+	}
+	if _, err := os.Stat(spill); !os.IsNotExist(err) {
+		t.Errorf("expected the spill file to be removed, got %v", err)
+	}
+
+	// with no limit, everything's kept in memory
+	QueueMemory = 0
+	queue = newWorkQueue()
+	for i := 1; i <= 5; i++ {
+		queue.Push(WorkRequest{UID: uint32(i)})
+	}
+	if len(queue.requests) != 5 || queue.spill != nil {
+		t.Errorf("expected every request in memory, got %d", len(queue.requests))
+	}
+}
+
+func TestEnumerateMessages(t *testing.T) {
+	server := newFakeServer()
+	conn := dialFake(t, server)
+	date := time.Date(2014, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, body := range []string{
+		"Message-Id: <1@example.com>\r\nSubject: one\r\n\r\nhello\r\n",
+		"Subject: no id\r\n\r\nhello\r\n",
+		"Message-Id: <3@example.com>\r\nSubject: three\r\n\r\nhello\r\n",
+	} {
+		if err := AppendMessage(conn, MessageData{InternalDate: date, Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Logout(time.Second)
+	conn, err := server.Dial(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Logout(time.Second)
+
+	for _, c := range []struct {
+		name        string
+		from        uint32
+		generateIds bool
+		want        []uint32
+	}{
+		{"one fetch", 0, false, []uint32{1, 3}},
+		{"windows", 2, false, []uint32{3}},
+		{"synthetic ids", 0, true, []uint32{1, 3, 2}},
+	} {
+		seq, _ := imap.NewSeqSet("1:*")
+		queue := newWorkQueue()
+		highest, stoppedAt, err := enumerateMessages(conn, seq, c.from, c.generateIds, queue)
+		queue.Close()
+		if err != nil || highest != 3 || stoppedAt != 0 {
+			t.Errorf("%s: expected to list up to UID 3, got %d, %d, %v", c.name, highest, stoppedAt, err)
+		}
+		var uids []uint32
+		for {
+			request, ok := queue.Pop()
+			if !ok {
+				break
+			}
+			if request.Folder != "INBOX" || request.Header != "Message-Id" || len(request.Value) == 0 || request.Size == 0 {
+				t.Errorf("%s: unexpected request %+v", c.name, request)
+			}
+			uids = append(uids, request.UID)
+		}
+		if fmt.Sprint(uids) != fmt.Sprint(c.want) {
+			t.Errorf("%s: expected UIDs %v, got %v", c.name, c.want, uids)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package copycat
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the environment variables copycat reads its flags and config from.
+const EnvPrefix = "COPYCAT_"
+
+// envVars returns the COPYCAT_ variables in environ (ex. os.Environ()) by name, without the prefix.
+func envVars(environ []string) map[string]string {
+	vars := make(map[string]string)
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		if eq := strings.IndexByte(kv, '='); eq > 0 {
+			vars[kv[len(EnvPrefix):eq]] = kv[eq+1:]
+		}
+	}
+	return vars
+}
+
+// envInbox splits the name of a config variable, ex. DEST_1_USER, into the inbox (-1
+// for the source) and its field. ok is false if it isn't one.
+func envInbox(name string) (index int, field string, ok bool) {
+	switch {
+	case strings.HasPrefix(name, "SOURCE_"):
+		index, field = -1, strings.TrimPrefix(name, "SOURCE_")
+	case strings.HasPrefix(name, "DEST_"):
+		parts := strings.SplitN(strings.TrimPrefix(name, "DEST_"), "_", 2)
+		if len(parts) != 2 {
+			return 0, "", false
+		}
+		var err error
+		if index, err = strconv.Atoi(parts[0]); err != nil || index < 0 {
+			return 0, "", false
+		}
+		field = parts[1]
+	default:
+		return 0, "", false
+	}
+	switch field {
+	case "USER", "PW", "HOST", "ADMIN", "ROOT":
+		return index, field, true
+	}
+	return 0, "", false
+}
+
+// ConfigInEnv says if environ has any of the variables ApplyEnv reads.
+func ConfigInEnv(environ []string) bool {
+	for name := range envVars(environ) {
+		if _, _, ok := envInbox(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyEnv sets the config's inboxes from COPYCAT_SOURCE_<FIELD> and
+// COPYCAT_DEST_<N>_<FIELD> variables in environ, FIELD being USER, PW, HOST, ADMIN or
+// ROOT and N the index in Dest, from 0. They override what's in the config already, and
+// can add destinations after the last one. Passwords can be references, see
+// ResolveCredential, ex. COPYCAT_SOURCE_PW=file:/run/secrets/source_pw.
+func (c *Config) ApplyEnv(environ []string) error {
+	vars := envVars(environ)
+	var names []string
+	for name := range vars {
+		if _, _, ok := envInbox(name); ok {
+			names = append(names, name)
+		}
+	}
+	// by index, so destinations are added in order
+	sort.Slice(names, func(i, j int) bool {
+		a, _, _ := envInbox(names[i])
+		b, _, _ := envInbox(names[j])
+		return a < b || (a == b && names[i] < names[j])
+	})
+
+	for _, name := range names {
+		index, field, _ := envInbox(name)
+		info := &c.Source
+		if index >= 0 {
+			if index > len(c.Dest) {
+				return fmt.Errorf("%s%s: there's no dest %d before it", EnvPrefix, name, len(c.Dest))
+			}
+			if index == len(c.Dest) {
+				c.Dest = append(c.Dest, InboxInfo{})
+			}
+			info = &c.Dest[index]
+		}
+		value := vars[name]
+		switch field {
+		case "USER":
+			info.User = value
+		case "PW":
+			pw, err := ResolveCredential(value)
+			if err != nil {
+				return fmt.Errorf("%s%s: %s", EnvPrefix, name, err.Error())
+			}
+			info.Pw = pw
+		case "HOST":
+			info.Host = value
+		case "ADMIN":
+			info.Admin = value
+		case "ROOT":
+			info.Root = value
+		}
+	}
+	return nil
+}
+
+// FlagsFromEnv sets each flag in the set that wasn't given on the command line from its
+// COPYCAT_ variable in environ, named like the flag in upper case with - as _, ex.
+// COPYCAT_MAX_CONNS for -max-conns. It returns the variables that are neither a flag
+// nor part of the config (see ApplyEnv), which are likely typos.
+func FlagsFromEnv(fs *flag.FlagSet, environ []string) (unknown []string, err error) {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for name, value := range envVars(environ) {
+		flagName := strings.Replace(strings.ToLower(name), "_", "-", -1)
+		if fs.Lookup(flagName) == nil {
+			if _, _, ok := envInbox(name); !ok {
+				unknown = append(unknown, EnvPrefix+name)
+			}
+			continue
+		}
+		if given[flagName] {
+			continue
+		}
+		if err = fs.Set(flagName, value); err != nil {
+			return nil, fmt.Errorf("%s%s: %s", EnvPrefix, name, err.Error())
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// FlagsFromFile sets flags in the set from a file with one on each line, like on the
+// command line but without quoting, ex. "-window=22:00-06:00" or "-idle". Blank lines
+// and lines starting with # are skipped. Flags in skip, ex. the ones given on the
+// command line, are left alone. Every flag is checked before any are set. It returns
+// the flags it set.
+func FlagsFromFile(fs *flag.FlagSet, file string, skip map[string]bool) (map[string]bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	type setting struct {
+		line        int
+		name, value string
+	}
+	var settings []setting
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimLeft(text, "-")
+		name, value := text, "true"
+		if eq := strings.IndexByte(text, '='); eq >= 0 {
+			name, value = text[:eq], text[eq+1:]
+		}
+		if fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown flag -%s", file, line, name)
+		}
+		settings = append(settings, setting{line, name, value})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	for _, s := range settings {
+		if skip[s.name] {
+			continue
+		}
+		if err = fs.Set(s.name, s.value); err != nil {
+			return set, fmt.Errorf("%s:%d: -%s: %s", file, s.line, s.name, err.Error())
+		}
+		set[s.name] = true
+	}
+	return set, nil
+}
+
+// ResetFlags sets the named flags back to their COPYCAT_ variable in environ if they
+// have one, or else their default, ex. once they're taken out of the -flags-file.
+func ResetFlags(fs *flag.FlagSet, names []string, environ []string) error {
+	vars := envVars(environ)
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil {
+			continue
+		}
+		value, ok := vars[strings.Replace(strings.ToUpper(name), "-", "_", -1)]
+		if !ok {
+			value = f.DefValue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("-%s: %s", name, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package copycat
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+	config := Config{
+		Source: InboxInfo{User: "bob", Pw: "old", Host: "imap.old.example.com"},
+		Dest:   []InboxInfo{{User: "bob", Pw: "pw", Host: "imap.new.example.com"}},
+	}
+	environ := []string{
+		"PATH=/bin",
+		"COPYCAT_SOURCE_PW=new",
+		"COPYCAT_DEST_1_USER=bob@backup.example.com",
+		"COPYCAT_DEST_1_PW=backup",
+		"COPYCAT_DEST_0_HOST=imap.other.example.com",
+		"COPYCAT_MAX_CONNS=20",
+	}
+	if !ConfigInEnv(environ) {
+		t.Error("expected config in the environment")
+	}
+	if err := config.ApplyEnv(environ); err != nil {
+		t.Fatal(err)
+	}
+	expected := Config{
+		Source: InboxInfo{User: "bob", Pw: "new", Host: "imap.old.example.com"},
+		Dest: []InboxInfo{
+			{User: "bob", Pw: "pw", Host: "imap.other.example.com"},
+			{User: "bob@backup.example.com", Pw: "backup"},
+		},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected %+v, got %+v", expected, config)
+	}
+
+	if ConfigInEnv([]string{"COPYCAT_MAX_CONNS=20"}) {
+		t.Error("expected no config in the environment")
+	}
+	var gap Config
+	if err := gap.ApplyEnv([]string{"COPYCAT_DEST_1_USER=bob"}); err == nil {
+		t.Error("expected an error for a dest without the one before it")
+	}
+}
+
+func TestFlagsFromEnv(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	maxConns := fs.Int("max-conns", 10, "")
+	idle := fs.Bool("idle", false, "")
+	dbFile := fs.String("db", "copycat.db", "")
+	if err := fs.Parse([]string{"-db=given.db"}); err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{"COPYCAT_MAX_CONNS=20", "COPYCAT_IDLE=true", "COPYCAT_DB=env.db", "COPYCAT_SOURCE_USER=bob", "COPYCAT_MAX_CONN=5"}
+	unknown, err := FlagsFromEnv(fs, environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *maxConns != 20 || !*idle || *dbFile != "given.db" {
+		t.Errorf("expected the env to set the flags not given, got -max-conns=%d -idle=%t -db=%s", *maxConns, *idle, *dbFile)
+	}
+	if !reflect.DeepEqual(unknown, []string{"COPYCAT_MAX_CONN"}) {
+		t.Errorf("expected COPYCAT_MAX_CONN to be unknown, got %v", unknown)
+	}
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("max-conns", 10, "")
+	if _, err = FlagsFromEnv(fs, []string{"COPYCAT_MAX_CONNS=lots"}); err == nil {
+		t.Error("expected an error for a bad value")
+	}
+}
+
+func TestFlagsFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flagsfiletest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "flags")
+	if err = ioutil.WriteFile(file, []byte("# after hours\n-window=22:00-06:00\n\n-idle\nc=4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	window := fs.String("window", "", "")
+	idle := fs.Bool("idle", false, "")
+	conns := fs.Int("c", 2, "")
+	set, err := FlagsFromFile(fs, file, map[string]bool{"c": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *window != "22:00-06:00" || !*idle || *conns != 2 {
+		t.Errorf("expected the flags not skipped to be set, got -window=%s -idle=%t -c=%d", *window, *idle, *conns)
+	}
+	if len(set) != 2 || !set["window"] || !set["idle"] {
+		t.Errorf("expected -window and -idle to be set from the file, got %v", set)
+	}
+
+	if err = ioutil.WriteFile(file, []byte("-window=09:00-17:00\n-windows=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = FlagsFromFile(fs, file, nil); err == nil || err.Error() != file+":2: unknown flag -windows" {
+		t.Errorf("expected an unknown flag on line 2, got %v", err)
+	}
+	if *window != "22:00-06:00" {
+		t.Errorf("expected no flags to be set from a bad file, got -window=%s", *window)
+	}
+}
+
+func TestResetFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	window := fs.String("window", "", "")
+	conns := fs.Int("max-conns", 10, "")
+	fs.Set("window", "22:00-06:00")
+	fs.Set("max-conns", "4")
+
+	if err := ResetFlags(fs, []string{"window", "max-conns"}, []string{"COPYCAT_MAX_CONNS=6"}); err != nil {
+		t.Fatal(err)
+	}
+	if *window != "" || *conns != 6 {
+		t.Errorf("expected -window back to its default and -max-conns from its variable, got -window=%s -max-conns=%d", *window, *conns)
+	}
+}
@@ -0,0 +1,115 @@
+package copycat
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// MaxAppendFailures is the fraction (0 to 1) of appends to a destination that can fail
+// before the run is aborted. Messages that fail to append are skipped until then. At 0,
+// the first failure aborts the run. Below 1, failures every later append will hit too
+// (ErrAuth, ErrQuotaExceeded and ErrConnLost) abort it right away. At 1, failures are
+// logged and skipped and the run is never aborted.
+var MaxAppendFailures float64 = 1
+
+// errorBudgetMinimum is how many appends a destination needs before its failure rate is
+// judged, so a couple of early failures don't end a run.
+const errorBudgetMinimum = 100
+
+// errorBudget tracks the appends to a destination over a run.
+type errorBudget struct {
+	User string
+
+	mu       sync.Mutex
+	appends  int
+	failures int
+	exceeded bool
+}
+
+var errorBudgets = struct {
+	sync.Mutex
+	byUser map[string]*errorBudget
+}{byUser: make(map[string]*errorBudget)}
+
+// destinationBudget returns the errorBudget of the destination, shared by all of its storers.
+func destinationBudget(user string) *errorBudget {
+	errorBudgets.Lock()
+	defer errorBudgets.Unlock()
+	budget, exists := errorBudgets.byUser[user]
+	if !exists {
+		budget = &errorBudget{User: user}
+		errorBudgets.byUser[user] = budget
+	}
+	return budget
+}
+
+// resetErrorBudgets gives the destinations a fresh budget, for a new run.
+func resetErrorBudgets(users []string) {
+	errorBudgets.Lock()
+	defer errorBudgets.Unlock()
+	for _, user := range users {
+		delete(errorBudgets.byUser, user)
+	}
+}
+
+// budgetExceeded returns an error naming the first of the destinations that has used up
+// its budget, if any. Only the run's own destinations are looked at, so a job can't be
+// stopped by another's.
+func budgetExceeded(users []string) error {
+	errorBudgets.Lock()
+	defer errorBudgets.Unlock()
+	for _, user := range users {
+		if budget, exists := errorBudgets.byUser[user]; exists && budget.Exceeded() {
+			return budget.err()
+		}
+	}
+	return nil
+}
+
+// dstUsers are the users of the destinations.
+func dstUsers(dsts map[string][]*imap.Client) []string {
+	var users []string
+	for user := range dsts {
+		users = append(users, user)
+	}
+	return users
+}
+
+// Record counts the result of an append and returns true if the budget has been used up.
+func (b *errorBudget) Record(err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.appends++
+	if err == nil || b.exceeded {
+		return b.exceeded
+	}
+
+	b.failures++
+	if MaxAppendFailures >= 1 {
+		return false
+	}
+	if MaxAppendFailures <= 0 || abortsRun(err) || (b.appends >= errorBudgetMinimum && float64(b.failures) > MaxAppendFailures*float64(b.appends)) {
+		b.exceeded = true
+		log.Printf("%s. aborting!", b.errLocked())
+	}
+	return b.exceeded
+}
+
+func (b *errorBudget) Exceeded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exceeded
+}
+
+func (b *errorBudget) err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.errLocked()
+}
+
+func (b *errorBudget) errLocked() error {
+	return fmt.Errorf("%d of %d appends to %s failed, more than the %.1f%% allowed", b.failures, b.appends, b.User, MaxAppendFailures*100)
+}
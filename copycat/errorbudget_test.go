@@ -0,0 +1,69 @@
+package copycat
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorBudget(t *testing.T) {
+	defer func(max float64) { MaxAppendFailures = max }(MaxAppendFailures)
+	failed := errors.New("NO [TOOBIG] message too large")
+
+	lenient := &errorBudget{User: "default@example.com"}
+	for i := 0; i < 10; i++ {
+		if lenient.Record(ErrConnLost) {
+			t.Fatal("the default budget should never run out")
+		}
+	}
+
+	MaxAppendFailures = 0
+	strict := &errorBudget{User: "strict@example.com"}
+	if strict.Record(nil) {
+		t.Error("a successful append used up the budget")
+	}
+	if !strict.Record(failed) {
+		t.Error("the first failure should abort with no budget")
+	}
+
+	MaxAppendFailures = 0.05
+	budget := &errorBudget{User: "lenient@example.com"}
+	for i := 0; i < 10; i++ {
+		if budget.Record(failed) {
+			t.Fatalf("budget used up after %d failures, before the minimum number of appends", i+1)
+		}
+	}
+	for budget.appends < 200 {
+		if budget.Record(nil) {
+			t.Fatal("a successful append used up the budget")
+		}
+	}
+	// 10 of 200 is exactly 5%
+	if budget.Exceeded() {
+		t.Error("budget used up at the limit")
+	}
+	if !budget.Record(failed) {
+		t.Errorf("11 of 201 failures is over 5%% and should use up the budget")
+	}
+	if !budget.Record(nil) {
+		t.Error("a used up budget should stay used up")
+	}
+}
+
+func TestErrorBudgetScope(t *testing.T) {
+	defer func(max float64) { MaxAppendFailures = max }(MaxAppendFailures)
+	MaxAppendFailures = 0
+	users := []string{"first@example.com", "second@example.com"}
+	resetErrorBudgets(users)
+	destinationBudget("first@example.com").Record(errors.New("NO [TOOBIG] message too large"))
+
+	if budgetExceeded(users) == nil {
+		t.Error("expected the run's budget to be used up")
+	}
+	if err := budgetExceeded([]string{"second@example.com"}); err != nil {
+		t.Errorf("expected another run's budget to be left alone, got %v", err)
+	}
+	resetErrorBudgets(users)
+	if err := budgetExceeded(users); err != nil {
+		t.Errorf("expected a new run to get a fresh budget, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package copycat
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// The kinds of errors copycat can tell apart. Errors returned by the connection, fetch and
+// append functions are an *Error that matches one of these with errors.Is if the server's
+// response (or the network error) says which it was.
+var (
+	ErrAuth            = errors.New("authentication failed")
+	ErrQuotaExceeded   = errors.New("quota exceeded")
+	ErrMessageTooLarge = errors.New("message too large")
+	ErrThrottled       = errors.New("throttled")
+	ErrConnLost        = errors.New("connection lost")
+	ErrRejected        = errors.New("message rejected")
+)
+
+// Error wraps an error from an IMAP server with what was being done when it happened.
+type Error struct {
+	// Kind is one of the Err* values, or nil if the error couldn't be classified.
+	Kind error
+	// Op is the command that failed, ex. login or append.
+	Op        string
+	MessageId string
+	Account   string
+	Err       error
+}
+
+func (e *Error) Error() string {
+	s := e.Op
+	if len(e.MessageId) > 0 {
+		s += " " + e.MessageId
+	}
+	if len(e.Account) > 0 {
+		s += " for " + e.Account
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+func (e *Error) Is(target error) bool { return e.Kind != nil && e.Kind == target }
+
+// wrapError will classify err and wrap it with the op, unless it's already an *Error.
+func wrapError(op string, account string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Kind: classifyError(err), Op: op, Account: account, Err: err}
+}
+
+// errorKinds are the response codes (RFC 5530) and the text servers use in place of
+// them, in the order they're checked.
+var errorKinds = []struct {
+	kind  error
+	signs []string
+}{
+	{ErrAuth, []string{"[authenticationfailed]", "[authorizationfailed]", "[expired]", "invalid credentials", "authentication failed", "login failed"}},
+	// Gmail sends [OVERQUOTA] for its bandwidth limits too, which aren't a full mailbox
+	{ErrThrottled, []string{"[throttled]", "bandwidth limit", "suggested backoff"}},
+	{ErrQuotaExceeded, []string{"[overquota]", "quota"}},
+	{ErrMessageTooLarge, []string{"[toobig]", "too large", "too big", "exceeds the maximum"}},
+	{ErrThrottled, []string{"[limit]", "[unavailable]", "throttl", "rate limit", "too many", "try again later"}},
+	{ErrConnLost, []string{"connection reset", "broken pipe", "use of closed network connection"}},
+	// the server won't take the message's content
+	{ErrRejected, []string{"[parse]", "rejected", "virus"}},
+}
+
+// classifyError returns the kind of err, or nil if it isn't one copycat knows.
+func classifyError(err error) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == imap.ErrTimeout || err == imap.ErrAborted {
+		return ErrConnLost
+	}
+	if _, ok := err.(net.Error); ok {
+		return ErrConnLost
+	}
+
+	text := err.Error()
+	if rsp, ok := err.(imap.ResponseError); ok && rsp.Response != nil {
+		text = "[" + rsp.Label + "] " + rsp.Info + " " + text
+	}
+	text = strings.ToLower(text)
+	for _, k := range errorKinds {
+		for _, sign := range k.signs {
+			if strings.Contains(text, sign) {
+				return k.kind
+			}
+		}
+	}
+	return nil
+}
+
+// abortsRun is true for errors every later command on the account will hit too.
+func abortsRun(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch classifyError(err) {
+	case ErrAuth, ErrQuotaExceeded, ErrConnLost:
+		return true
+	}
+	return false
+}
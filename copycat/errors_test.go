@@ -0,0 +1,106 @@
+package copycat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind error
+	}{
+		{errors.New("NO [AUTHENTICATIONFAILED] Invalid credentials (Failure)"), ErrAuth},
+		{errors.New("NO [OVERQUOTA] Quota exceeded (Mailbox is full)"), ErrQuotaExceeded},
+		{errors.New("NO [TOOBIG] Message too large"), ErrMessageTooLarge},
+		{errors.New("NO [LIMIT] Too many simultaneous connections"), ErrThrottled},
+		{errors.New("NO Server Unavailable. Try again later."), ErrThrottled},
+		{errors.New("NO [OVERQUOTA] Account exceeded command or bandwidth limits."), ErrThrottled},
+		{errors.New("NO [THROTTLED] Account is being throttled."), ErrThrottled},
+		{errors.New("NO Request is throttled. Suggested Backoff Time: 92000 milliseconds"), ErrThrottled},
+		{io.EOF, ErrConnLost},
+		{imap.ErrTimeout, ErrConnLost},
+		{imap.ResponseError{Response: &imap.Response{Label: "OVERQUOTA"}}, ErrQuotaExceeded},
+		{errors.New("NO [CANNOT] Invalid mailbox name"), nil},
+		{errors.New("NO [PARSE] Message contains invalid header"), ErrRejected},
+		{errors.New("NO Message rejected: virus found"), ErrRejected},
+	}
+	for _, test := range tests {
+		if kind := classifyError(test.err); kind != test.kind {
+			t.Errorf("classifyError(%q) = %v, expected %v", test.err, kind, test.kind)
+		}
+	}
+}
+
+func TestThrottleWait(t *testing.T) {
+	tests := []struct {
+		err  error
+		wait time.Duration
+	}{
+		{errors.New("NO Request is throttled. Suggested Backoff Time: 92000 milliseconds"), 92 * time.Second},
+		{errors.New("NO [UNAVAILABLE] Try again in 30 seconds"), 30 * time.Second},
+		{errors.New("NO Rate limit hit, retry after 2 minutes"), 2 * time.Minute},
+		{errors.New("NO Throttled, retry after 9000 minutes"), maxThrottleWait},
+		{errors.New("NO [OVERQUOTA] Account exceeded command or bandwidth limits."), 10 * ThrottleCooldown},
+		{errors.New("NO [LIMIT] Too many simultaneous connections"), ThrottleCooldown},
+	}
+	for _, test := range tests {
+		if wait := throttleWait(test.err); wait != test.wait {
+			t.Errorf("throttleWait(%q) = %s, expected %s", test.err, wait, test.wait)
+		}
+	}
+
+	if throttled("dst@example.com", errors.New("NO [TOOBIG] Message too large")) {
+		t.Error("expected only throttling to cool the connections down")
+	}
+	ThrottleCooldown = 50 * time.Millisecond
+	defer func() { ThrottleCooldown = time.Minute }()
+	if !throttled("dst@example.com", errors.New("NO [LIMIT] Too many simultaneous connections")) {
+		t.Fatal("expected throttling to cool the connections down")
+	}
+	start := time.Now()
+	coolDown("dst@example.com", nil)
+	if since := time.Since(start); since < 25*time.Millisecond {
+		t.Errorf("expected to wait out the cool-down, waited %s", since)
+	}
+	start = time.Now()
+	coolDown("other@example.com", nil)
+	if since := time.Since(start); since > 10*time.Millisecond {
+		t.Errorf("expected other accounts not to wait, waited %s", since)
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	if wrapError("append", "bob@example.com", nil) != nil {
+		t.Error("a nil error was wrapped")
+	}
+
+	raw := errors.New("NO [OVERQUOTA] Mailbox is full")
+	err := wrapError("append", "bob@example.com", raw)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("%q isn't an ErrQuotaExceeded", err)
+	}
+	if errors.Is(err, ErrAuth) {
+		t.Errorf("%q is an ErrAuth", err)
+	}
+	if !errors.Is(err, raw) {
+		t.Error("the server's error should still be in the chain")
+	}
+	if expected := "append for bob@example.com: NO [OVERQUOTA] Mailbox is full"; err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+
+	// context added further up the stack keeps the kind
+	wrapped := fmt.Errorf("folder INBOX: %w", err)
+	if !errors.Is(wrapped, ErrQuotaExceeded) || !abortsRun(wrapped) {
+		t.Errorf("%q lost its kind", wrapped)
+	}
+	if again := wrapError("store", "", wrapped); again != wrapped {
+		t.Error("an *Error was wrapped twice")
+	}
+}
@@ -0,0 +1,95 @@
+package copycat
+
+import "time"
+
+// The kinds of Event.
+const (
+	// FolderStarted is sent for each destination and sink once the source folder is
+	// selected. Count is the number of messages in the source folder.
+	FolderStarted = "folder-started"
+	// FolderListed is sent for each destination and sink once the source folder's
+	// messages are listed. Count is how many are to be stored and Size their total
+	// RFC822.SIZE, so progress can be followed by bytes.
+	FolderListed = "folder-listed"
+	// MessagesArrived is sent for each destination and sink when Count messages arrived
+	// in the source folder during its sync and are about to be caught up on (see
+	// LateArrivals).
+	MessagesArrived = "arrived"
+	// FolderDone is sent once a folder is finished, with Error set if it failed.
+	FolderDone = "folder-done"
+	// MessagesChecked is sent after Count messages were looked for in a destination.
+	MessagesChecked = "checked"
+	// MessageCopied is sent after a message is stored in a destination.
+	MessageCopied = "copied"
+	// MessageFailed is sent when a message couldn't be stored in a destination.
+	MessageFailed = "error"
+	// CheckpointWritten is sent once the state of a synced folder is saved (see
+	// SkipUnchanged). Count is the number of messages in the source folder.
+	CheckpointWritten = "checkpoint"
+)
+
+// Event is a step in a sync, sent to the Progress func.
+type Event struct {
+	Kind        string    `json:"kind"`
+	Time        time.Time `json:"time"`
+	Folder      string    `json:"folder,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	MessageId   string    `json:"message_id,omitempty"`
+	Count       int       `json:"count,omitempty"`
+	Size        int       `json:"size,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	// ErrorKind is the kind of a failed message's Error, ex. "quota exceeded", if it's known
+	ErrorKind string `json:"error_kind,omitempty"`
+	// the MessageKey of a copied or failed message
+	Key   string `json:"key,omitempty"`
+	RunId string `json:"run_id,omitempty"`
+}
+
+// ProgressFunc is called with each Event. It is called from many goroutines at once.
+type ProgressFunc func(Event)
+
+// Progress follows the sync as it goes (ex. TUI.Handle). It is nil, for no events, unless set.
+var Progress ProgressFunc
+
+// And returns a ProgressFunc that sends each event to f and then next. Either can be nil.
+func (f ProgressFunc) And(next ProgressFunc) ProgressFunc {
+	if f == nil {
+		return next
+	}
+	if next == nil {
+		return f
+	}
+	return func(e Event) {
+		f(e)
+		next(e)
+	}
+}
+
+// emit sends the event to Progress, if it's set.
+func emit(e Event) {
+	if Progress == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if len(e.RunId) == 0 {
+		e.RunId = RunID
+	}
+	Progress(e)
+}
+
+// errorKind names the kind of err (see classifyError), or "" if it isn't known.
+func errorKind(err error) string {
+	if kind := classifyError(err); kind != nil {
+		return kind.Error()
+	}
+	return ""
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
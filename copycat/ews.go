@@ -0,0 +1,315 @@
+package copycat
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how many folders or messages to ask Exchange for at a time
+const ewsPageSize = 500
+
+// EWSSource is a MessageSource that reads an Exchange mailbox over Exchange Web Services,
+// for servers whose IMAP is missing or unreliable. Every mail folder is listed with its
+// path (the Inbox and its subfolders are under INBOX) and messages are pulled as MIME
+// with their read state as \Seen and their categories as keywords. It logs in with
+// basic auth, so the server needs that enabled for EWS.
+type EWSSource struct {
+	// URL is the EWS endpoint, ex. https://mail.example.com/EWS/Exchange.asmx
+	URL      string
+	User     string
+	Password string
+	Client   *http.Client
+}
+
+// NewEWSSource creates an EWSSource for the user at the EWS endpoint.
+func NewEWSSource(url string, user string, password string) *EWSSource {
+	return &EWSSource{URL: url, User: user, Password: password, Client: &http.Client{Timeout: 5 * time.Minute}}
+}
+
+const ewsEnvelope = `<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:t="http://schemas.microsoft.com/exchange/services/2006/types" xmlns:m="http://schemas.microsoft.com/exchange/services/2006/messages">
+<soap:Header><t:RequestServerVersion Version="Exchange2010_SP2"/></soap:Header>
+<soap:Body>%s</soap:Body>
+</soap:Envelope>`
+
+// ewsResponse is the part of every EWS response message that says how it went.
+type ewsResponse struct {
+	Class string `xml:"ResponseClass,attr"`
+	Code  string `xml:"ResponseCode"`
+	Text  string `xml:"MessageText"`
+}
+
+func (r ewsResponse) err() error {
+	if r.Class == "Success" {
+		return nil
+	}
+	return fmt.Errorf("%s: %s", r.Code, r.Text)
+}
+
+type ewsFolder struct {
+	Id       ewsId  `xml:"FolderId"`
+	ParentId ewsId  `xml:"ParentFolderId"`
+	Name     string `xml:"DisplayName"`
+	Class    string `xml:"FolderClass"`
+}
+
+type ewsId struct {
+	Id string `xml:"Id,attr"`
+}
+
+// ewsPage is the paging of a FindFolder or FindItem response.
+type ewsPage struct {
+	Last   bool `xml:"IncludesLastItemInRange,attr"`
+	Offset int  `xml:"IndexedPagingOffset,attr"`
+}
+
+type ewsItems struct {
+	// messages, meeting requests and the like
+	Items []ewsItem `xml:",any"`
+}
+
+type ewsItem struct {
+	Id         ewsId    `xml:"ItemId"`
+	MessageId  string   `xml:"InternetMessageId"`
+	Mime       string   `xml:"MimeContent"`
+	Received   string   `xml:"DateTimeReceived"`
+	IsRead     bool     `xml:"IsRead"`
+	Categories []string `xml:"Categories>String"`
+}
+
+// call posts the operation to the server and decodes the SOAP body of the response into v.
+func (e *EWSSource) call(operation string, v interface{}) error {
+	req, err := http.NewRequest("POST", e.URL, strings.NewReader(fmt.Sprintf(ewsEnvelope, operation)))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(e.User, e.Password)
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+
+	rsp, err := e.Client.Do(req)
+	if err != nil {
+		return &Error{Kind: ErrConnLost, Op: "connect to " + e.URL, Account: e.User, Err: err}
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusUnauthorized {
+		return &Error{Kind: ErrAuth, Op: "ews login", Account: e.User, Err: fmt.Errorf("%s", rsp.Status)}
+	}
+	if rsp.StatusCode != http.StatusOK {
+		// faults come back as a 500 with the reason in the body
+		body, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return fmt.Errorf("ews request failed: %s: %s", rsp.Status, strings.TrimSpace(string(body)))
+	}
+
+	envelope := struct {
+		Body struct {
+			Inner []byte `xml:",innerxml"`
+		} `xml:"Body"`
+	}{}
+	if err = xml.NewDecoder(rsp.Body).Decode(&envelope); err != nil {
+		return err
+	}
+	return xml.Unmarshal(envelope.Body.Inner, v)
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// folders returns the path of every mail folder by its id.
+func (e *EWSSource) folders() (map[string]string, error) {
+	var roots struct {
+		Messages []struct {
+			ewsResponse
+			Folders []ewsFolder `xml:"Folders>Folder"`
+		} `xml:"ResponseMessages>GetFolderResponseMessage"`
+	}
+	err := e.call(`<m:GetFolder><m:FolderShape><t:BaseShape>IdOnly</t:BaseShape></m:FolderShape><m:FolderIds>`+
+		`<t:DistinguishedFolderId Id="msgfolderroot"/><t:DistinguishedFolderId Id="inbox"/></m:FolderIds></m:GetFolder>`, &roots)
+	if err != nil {
+		return nil, err
+	}
+	if len(roots.Messages) != 2 {
+		return nil, fmt.Errorf("expected the root and inbox folders, got %d", len(roots.Messages))
+	}
+	var ids []string
+	for _, msg := range roots.Messages {
+		if err = msg.err(); err != nil {
+			return nil, err
+		}
+		if len(msg.Folders) == 0 {
+			return nil, fmt.Errorf("missing folder in the response")
+		}
+		ids = append(ids, msg.Folders[0].Id.Id)
+	}
+	root, inbox := ids[0], ids[1]
+
+	all := make(map[string]ewsFolder)
+	for offset := 0; ; {
+		var found struct {
+			Messages []struct {
+				ewsResponse
+				Root struct {
+					ewsPage
+					Folders []ewsFolder `xml:"Folders>Folder"`
+				} `xml:"RootFolder"`
+			} `xml:"ResponseMessages>FindFolderResponseMessage"`
+		}
+		err = e.call(fmt.Sprintf(`<m:FindFolder Traversal="Deep"><m:FolderShape><t:BaseShape>IdOnly</t:BaseShape><t:AdditionalProperties>`+
+			`<t:FieldURI FieldURI="folder:DisplayName"/><t:FieldURI FieldURI="folder:ParentFolderId"/><t:FieldURI FieldURI="folder:FolderClass"/>`+
+			`</t:AdditionalProperties></m:FolderShape><m:IndexedPageFolderView MaxEntriesReturned="%d" Offset="%d" BasePoint="Beginning"/>`+
+			`<m:ParentFolderIds><t:DistinguishedFolderId Id="msgfolderroot"/></m:ParentFolderIds></m:FindFolder>`, ewsPageSize, offset), &found)
+		if err != nil {
+			return nil, err
+		}
+		if len(found.Messages) == 0 {
+			return nil, fmt.Errorf("empty FindFolder response")
+		}
+		msg := found.Messages[0]
+		if err = msg.err(); err != nil {
+			return nil, err
+		}
+		for _, folder := range msg.Root.Folders {
+			all[folder.Id.Id] = folder
+		}
+		if msg.Root.Last || len(msg.Root.Folders) == 0 {
+			break
+		}
+		offset = msg.Root.Offset
+	}
+
+	paths := make(map[string]string)
+	for id, folder := range all {
+		// calendars, contacts, tasks and notes don't hold mail
+		if len(folder.Class) > 0 && !strings.HasPrefix(folder.Class, "IPF.Note") {
+			continue
+		}
+		path := ewsFolderPath(id, all, root, inbox)
+		if len(path) > 0 {
+			paths[id] = path
+		}
+	}
+	// in case the inbox wasn't listed with the rest
+	paths[inbox] = "INBOX"
+	return paths, nil
+}
+
+// ewsFolderPath joins the names of the folder and its parents up to the root.
+func ewsFolderPath(id string, all map[string]ewsFolder, root string, inbox string) string {
+	var names []string
+	// the depth limit guards against a loop of parents
+	for depth := 0; id != root && depth < 64; depth++ {
+		if id == inbox {
+			names = append([]string{"INBOX"}, names...)
+			break
+		}
+		folder, exists := all[id]
+		if !exists {
+			return ""
+		}
+		names = append([]string{strings.Replace(folder.Name, "/", "_", -1)}, names...)
+		id = folder.ParentId.Id
+	}
+	return strings.Join(names, "/")
+}
+
+func (e *EWSSource) List() ([]SourceMessage, error) {
+	paths, err := e.folders()
+	if err != nil {
+		return nil, err
+	}
+
+	// import the folders in order, parents first
+	var ids []string
+	for id := range paths {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return paths[ids[i]] < paths[ids[j]] })
+
+	var msgs []SourceMessage
+	for _, id := range ids {
+		path := paths[id]
+		for offset := 0; ; {
+			var found struct {
+				Messages []struct {
+					ewsResponse
+					Root struct {
+						ewsPage
+						Items ewsItems `xml:"Items"`
+					} `xml:"RootFolder"`
+				} `xml:"ResponseMessages>FindItemResponseMessage"`
+			}
+			err = e.call(fmt.Sprintf(`<m:FindItem Traversal="Shallow"><m:ItemShape><t:BaseShape>IdOnly</t:BaseShape><t:AdditionalProperties>`+
+				`<t:FieldURI FieldURI="message:InternetMessageId"/></t:AdditionalProperties></m:ItemShape>`+
+				`<m:IndexedPageItemView MaxEntriesReturned="%d" Offset="%d" BasePoint="Beginning"/>`+
+				`<m:ParentFolderIds><t:FolderId Id="%s"/></m:ParentFolderIds></m:FindItem>`, ewsPageSize, offset, xmlEscape(id)), &found)
+			if err != nil {
+				return nil, err
+			}
+			if len(found.Messages) == 0 {
+				return nil, fmt.Errorf("empty FindItem response for %s", path)
+			}
+			msg := found.Messages[0]
+			if err = msg.err(); err != nil {
+				return nil, fmt.Errorf("listing %s: %s", path, err.Error())
+			}
+			for _, item := range msg.Root.Items.Items {
+				msgs = append(msgs, SourceMessage{Folder: path, MessageId: item.MessageId, Key: item.Id.Id})
+			}
+			if msg.Root.Last || len(msg.Root.Items.Items) == 0 {
+				break
+			}
+			offset = msg.Root.Offset
+		}
+	}
+	return msgs, nil
+}
+
+func (e *EWSSource) Fetch(msg SourceMessage) (MessageData, error) {
+	var got struct {
+		Messages []struct {
+			ewsResponse
+			Items ewsItems `xml:"Items"`
+		} `xml:"ResponseMessages>GetItemResponseMessage"`
+	}
+	err := e.call(fmt.Sprintf(`<m:GetItem><m:ItemShape><t:BaseShape>IdOnly</t:BaseShape><t:IncludeMimeContent>true</t:IncludeMimeContent>`+
+		`<t:AdditionalProperties><t:FieldURI FieldURI="item:DateTimeReceived"/><t:FieldURI FieldURI="message:IsRead"/><t:FieldURI FieldURI="item:Categories"/>`+
+		`</t:AdditionalProperties></m:ItemShape><m:ItemIds><t:ItemId Id="%s"/></m:ItemIds></m:GetItem>`, xmlEscape(msg.Key)), &got)
+	if err != nil {
+		return MessageData{}, err
+	}
+	if len(got.Messages) == 0 || len(got.Messages[0].Items.Items) == 0 {
+		if len(got.Messages) > 0 && got.Messages[0].err() != nil {
+			return MessageData{}, got.Messages[0].err()
+		}
+		return MessageData{}, NotFound
+	}
+
+	item := got.Messages[0].Items.Items[0]
+	body, err := base64.StdEncoding.DecodeString(strings.TrimSpace(item.Mime))
+	if err != nil {
+		return MessageData{}, fmt.Errorf("invalid MIME content: %s", err.Error())
+	}
+	data := MessageData{Body: body}
+	data.InternalDate, _ = time.Parse(time.RFC3339, item.Received)
+	if item.IsRead {
+		data.Flags = append(data.Flags, `\Seen`)
+	}
+	for _, category := range item.Categories {
+		data.Flags = append(data.Flags, categoryKeyword(category))
+	}
+	return data, nil
+}
+
+func (e *EWSSource) Close() error {
+	return nil
+}
@@ -0,0 +1,93 @@
+package copycat
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// a mailbox with an Inbox, a subfolder of it, a top level folder and a calendar
+const (
+	ewsGetFolder = `<m:GetFolderResponse><m:ResponseMessages>
+<m:GetFolderResponseMessage ResponseClass="Success"><m:ResponseCode>NoError</m:ResponseCode><m:Folders><t:Folder><t:FolderId Id="root"/></t:Folder></m:Folders></m:GetFolderResponseMessage>
+<m:GetFolderResponseMessage ResponseClass="Success"><m:ResponseCode>NoError</m:ResponseCode><m:Folders><t:Folder><t:FolderId Id="inbox"/></t:Folder></m:Folders></m:GetFolderResponseMessage>
+</m:ResponseMessages></m:GetFolderResponse>`
+	ewsFindFolder = `<m:FindFolderResponse><m:ResponseMessages><m:FindFolderResponseMessage ResponseClass="Success"><m:ResponseCode>NoError</m:ResponseCode>
+<m:RootFolder IncludesLastItemInRange="true" IndexedPagingOffset="4"><t:Folders>
+<t:Folder><t:FolderId Id="inbox"/><t:ParentFolderId Id="root"/><t:DisplayName>Inbox</t:DisplayName><t:FolderClass>IPF.Note</t:FolderClass></t:Folder>
+<t:Folder><t:FolderId Id="clients"/><t:ParentFolderId Id="inbox"/><t:DisplayName>Clients</t:DisplayName><t:FolderClass>IPF.Note</t:FolderClass></t:Folder>
+<t:Folder><t:FolderId Id="projects"/><t:ParentFolderId Id="root"/><t:DisplayName>Projects 1/2</t:DisplayName></t:Folder>
+<t:CalendarFolder><t:FolderId Id="calendar"/><t:ParentFolderId Id="root"/><t:DisplayName>Calendar</t:DisplayName></t:CalendarFolder>
+<t:Folder><t:FolderId Id="contacts"/><t:ParentFolderId Id="root"/><t:DisplayName>Contacts</t:DisplayName><t:FolderClass>IPF.Contact</t:FolderClass></t:Folder>
+</t:Folders></m:RootFolder></m:FindFolderResponseMessage></m:ResponseMessages></m:FindFolderResponse>`
+	ewsFindItem = `<m:FindItemResponse><m:ResponseMessages><m:FindItemResponseMessage ResponseClass="Success"><m:ResponseCode>NoError</m:ResponseCode>
+<m:RootFolder IncludesLastItemInRange="true"><t:Items>%s</t:Items></m:RootFolder></m:FindItemResponseMessage></m:ResponseMessages></m:FindItemResponse>`
+	ewsGetItem = `<m:GetItemResponse><m:ResponseMessages><m:GetItemResponseMessage ResponseClass="Success"><m:ResponseCode>NoError</m:ResponseCode><m:Items>
+<t:Message><t:MimeContent CharacterSet="UTF-8">%s</t:MimeContent><t:ItemId Id="item1"/><t:DateTimeReceived>2014-03-01T10:00:00Z</t:DateTimeReceived>
+<t:Categories><t:String>Red category</t:String></t:Categories><t:IsRead>true</t:IsRead></t:Message>
+</m:Items></m:GetItemResponseMessage></m:ResponseMessages></m:GetItemResponse>`
+)
+
+func TestEWSSource(t *testing.T) {
+	raw := "Message-Id: <1@example.com>\r\nSubject: hi\r\n\r\nhello\r\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pw, _ := r.BasicAuth(); user != "fred" || pw != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		req, _ := ioutil.ReadAll(r.Body)
+		var body string
+		switch {
+		case strings.Contains(string(req), "<m:GetFolder>"):
+			body = ewsGetFolder
+		case strings.Contains(string(req), "<m:FindFolder"):
+			body = ewsFindFolder
+		case strings.Contains(string(req), `<t:FolderId Id="clients"/>`):
+			body = fmt.Sprintf(ewsFindItem, `<t:Message><t:ItemId Id="item1"/><t:InternetMessageId>&lt;1@example.com&gt;</t:InternetMessageId></t:Message>`+
+				`<t:MeetingRequest><t:ItemId Id="item2"/><t:InternetMessageId>&lt;2@example.com&gt;</t:InternetMessageId></t:MeetingRequest>`)
+		case strings.Contains(string(req), "<m:FindItem"):
+			body = fmt.Sprintf(ewsFindItem, "")
+		case strings.Contains(string(req), "<m:GetItem>"):
+			body = fmt.Sprintf(ewsGetItem, base64.StdEncoding.EncodeToString([]byte(raw)))
+		}
+		fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body xmlns:m="m" xmlns:t="t">%s</s:Body></s:Envelope>`, body)
+	}))
+	defer server.Close()
+
+	source := NewEWSSource(server.URL, "fred", "secret")
+	msgs, err := source.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Folder != "INBOX/Clients" || msgs[0].MessageId != "<1@example.com>" || msgs[1].Key != "item2" {
+		t.Errorf("unexpected messages: %+v", msgs)
+	}
+	paths, _ := source.folders()
+	var names []string
+	for _, path := range paths {
+		names = append(names, path)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "INBOX,INBOX/Clients,Projects 1_2" {
+		t.Errorf("unexpected folders: %v", names)
+	}
+
+	msg, err := source.Fetch(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Body) != raw || msg.InternalDate.Year() != 2014 || fmt.Sprint(msg.Flags) != `[\Seen Red_category]` {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+
+	source.Password = "wrong"
+	if _, err = source.List(); !errors.Is(err, ErrAuth) {
+		t.Errorf("expected an auth error, got %v", err)
+	}
+}
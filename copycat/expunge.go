@@ -0,0 +1,140 @@
+package copycat
+
+import (
+	"log"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// ExpungeSource will have messages already flagged \Deleted in the source expunged
+// once a folder has been synced, so the migration also tidies the old mailbox.
+var ExpungeSource bool
+
+// expungeDeleted expunges the messages flagged \Deleted in the folder selected on src,
+// but only the ones found in every destination and sink or that were intentionally not
+// copied because they were received before since. Anything else is left alone. src is
+// selected read-write for the expunge and then read-only again; this is the only time
+// the source is. If the source account can't change the folder, or there's nothing to
+// check the messages against, nothing is expunged.
+func expungeDeleted(src *imap.Client, dsts map[string][]*imap.Client, sinks []Sink, since time.Time) error {
+	folder := src.Mailbox.Name
+	if len(dsts) == 0 && len(sinks) == 0 {
+		log.Printf("There are no destinations to confirm the deleted messages in %s are copied, so they can't be expunged. skipping!", folder)
+		return nil
+	}
+	defer imap.Wait(src.Select(folder, true))
+	if _, err := imap.Wait(src.Select(folder, false)); err != nil {
+		return err
+	}
+	if src.Mailbox.ReadOnly {
+		log.Printf("The source %s is read-only, so its deleted messages can't be expunged. skipping!", folder)
+		return nil
+	}
+
+	cmd, err := imap.Wait(src.UIDSearch("DELETED"))
+	if err != nil {
+		return err
+	}
+	deleted, _ := imap.NewSeqSet("")
+	var count int
+	for _, rsp := range cmd.Data {
+		for _, uid := range rsp.SearchResults() {
+			deleted.AddNum(uid)
+			count++
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+
+	cmd, err = imap.Wait(src.UIDFetch(deleted, messageIdFetch, "INTERNALDATE", "UID"))
+	if err != nil {
+		return err
+	}
+	var requests []WorkRequest
+	confirmed, _ := imap.NewSeqSet("")
+	var confirmedCount int
+	for _, rsp := range cmd.Data {
+		info := rsp.MessageInfo()
+		if !since.IsZero() && info.InternalDate.Before(since) {
+			confirmed.AddNum(info.UID)
+			confirmedCount++
+			continue
+		}
+		header := messageHeader(src, info)
+		if len(header.Get("Message-Id")) == 0 {
+			// there's nothing to look for in the destinations
+			continue
+		}
+		requests = append(requests, WorkRequest{Value: header.Get("Message-Id"), Header: "Message-Id", UID: info.UID})
+	}
+
+	// keep only the messages every destination has
+	missing := make(map[uint32]bool)
+	for user, conns := range dsts {
+		for start := 0; start < len(requests); start += SearchPipelineDepth {
+			end := start + SearchPipelineDepth
+			if end > len(requests) {
+				end = len(requests)
+			}
+			absent, failed := searchPipelined(conns[0], requests[start:end])
+			for _, request := range absent {
+				log.Printf("%s is flagged \\Deleted in the source %s but isn't in %s. not expunging it.", request.Value, folder, user)
+				missing[request.UID] = true
+			}
+			// a search that failed confirms nothing
+			for _, request := range failed {
+				missing[request.UID] = true
+			}
+		}
+	}
+	for uid := range unconfirmedInSinks(sinks, folder, requests) {
+		missing[uid] = true
+	}
+	for _, request := range requests {
+		if !missing[request.UID] {
+			confirmed.AddNum(request.UID)
+			confirmedCount++
+		}
+	}
+
+	if confirmedCount == 0 {
+		return nil
+	}
+	if src.Caps["UIDPLUS"] {
+		_, err = imap.Wait(src.Expunge(confirmed))
+	} else if confirmedCount == count {
+		_, err = imap.Wait(src.Expunge(nil))
+	} else {
+		log.Printf("The source doesn't support UIDPLUS, so %s can't be expunged without also expunging %d unconfirmed messages. skipping!", folder, count-confirmedCount)
+		return nil
+	}
+	if err == nil {
+		log.Printf("expunged %d deleted messages from the source %s", confirmedCount, folder)
+		Stats.Add("expunged", int64(confirmedCount))
+	}
+	return err
+}
+
+// unconfirmedInSinks returns the UIDs of the requests' messages that one of the sinks
+// doesn't have, or couldn't be asked about.
+func unconfirmedInSinks(sinks []Sink, folder string, requests []WorkRequest) map[uint32]bool {
+	missing := make(map[uint32]bool)
+	for _, sink := range sinks {
+		for _, request := range requests {
+			if missing[request.UID] {
+				continue
+			}
+			has, err := sink.Has(folder, request.Value)
+			if err != nil {
+				log.Printf("Unable to check %s for %s: %s. not expunging it.", sinkName(sink), request.Value, err.Error())
+				missing[request.UID] = true
+			} else if !has {
+				log.Printf("%s is flagged \\Deleted in the source %s but isn't in %s. not expunging it.", request.Value, folder, sinkName(sink))
+				missing[request.UID] = true
+			}
+		}
+	}
+	return missing
+}
@@ -0,0 +1,74 @@
+package copycat
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// a Sink holding the Message-Ids in has
+type fakeSink struct {
+	has map[string]bool
+	err error
+}
+
+func (s fakeSink) Has(folder string, messageId string) (bool, error) {
+	return s.has[folder+" "+messageId], s.err
+}
+func (s fakeSink) Put(folder string, messageId string, msg MessageData) error { return nil }
+func (s fakeSink) Close() error                                               { return nil }
+
+func TestExpungeConfirmation(t *testing.T) {
+	requests := []WorkRequest{{Value: "<1@example.com>", UID: 1}, {Value: "<2@example.com>", UID: 2}, {Value: "<3@example.com>", UID: 3}}
+	first := fakeSink{has: map[string]bool{"INBOX <1@example.com>": true, "INBOX <2@example.com>": true}}
+	second := fakeSink{has: map[string]bool{"INBOX <1@example.com>": true, "INBOX <3@example.com>": true}}
+
+	missing := unconfirmedInSinks([]Sink{first, second}, "INBOX", requests)
+	if len(missing) != 2 || !missing[2] || !missing[3] {
+		t.Errorf("expected only the message in both sinks to be confirmed, got %v", missing)
+	}
+	missing = unconfirmedInSinks([]Sink{first, fakeSink{err: errors.New("unreachable")}}, "INBOX", requests)
+	if len(missing) != 3 {
+		t.Errorf("expected nothing to be confirmed by a sink that can't be checked, got %v", missing)
+	}
+	if missing = unconfirmedInSinks(nil, "INBOX", requests); len(missing) != 0 {
+		t.Errorf("expected no sinks to leave it to the destinations, got %v", missing)
+	}
+
+	// with nothing to check against, the source isn't touched at all
+	src := &imap.Client{Mailbox: &imap.MailboxStatus{Name: "INBOX"}}
+	if err := expungeDeleted(src, nil, nil, time.Time{}); err != nil {
+		t.Errorf("expected the expunge to be skipped, got %v", err)
+	}
+}
+
+func TestExpungeFailedSearch(t *testing.T) {
+	source := newFakeServer()
+	dest := newFakeServer()
+	src, dst := dialFake(t, source), dialFake(t, dest)
+	defer src.Logout(time.Second)
+	defer dst.Logout(time.Second)
+	for _, body := range []string{
+		"Message-Id: <copied@example.com>\r\nSubject: hi\r\n\r\nhello\r\n",
+		"Message-Id: <unsearched@example.com>\r\nSubject: hi\r\n\r\nhello\r\n",
+	} {
+		for _, conn := range []*imap.Client{src, dst} {
+			if err := AppendMessage(conn, MessageData{InternalDate: time.Now(), Body: []byte(body)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, msg := range source.messages {
+		msg.flags = []string{`\Deleted`}
+	}
+	dest.refuse["<unsearched@example.com>"] = true
+
+	if err := expungeDeleted(src, map[string][]*imap.Client{"dst@example.com": {dst}}, nil, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if source.Len() != 1 || source.messages[0].header.Get("Message-Id") != "<unsearched@example.com>" {
+		t.Errorf("expected only the message found in the destination to be expunged, %d left", source.Len())
+	}
+}
@@ -0,0 +1,611 @@
+package copycat
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// fakeServer is an IMAP server with a single INBOX held in memory. It speaks just enough
+// of the protocol for a sync to run against it, so the pipeline can be benchmarked without
+// a real account.
+type fakeServer struct {
+	mu       sync.Mutex
+	messages []*fakeMessage
+	nextUID  uint32
+	// extensions it has besides UIDPLUS, ex. ACL
+	caps []string
+	// the ACL and annotations of each folder, the identifiers and entries it won't set and
+	// the values it fails searches for
+	acls     map[string]ACL
+	metadata map[string]Metadata
+	refuse   map[string]bool
+}
+
+type fakeMessage struct {
+	uid    uint32
+	date   time.Time
+	flags  []string
+	body   []byte
+	header mail.Header
+}
+
+const fakeDateTime = "02-Jan-2006 15:04:05 -0700"
+
+func newFakeServer(caps ...string) *fakeServer {
+	return &fakeServer{nextUID: 1, caps: caps, acls: make(map[string]ACL), metadata: make(map[string]Metadata), refuse: make(map[string]bool)}
+}
+
+// dialFake connects to the server like Dial, failing the test if it can't.
+func dialFake(t *testing.T, s *fakeServer) *imap.Client {
+	conn, err := s.Dial(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// Dial will connect a client to the server, log in and select the INBOX.
+func (s *fakeServer) Dial(readOnly bool) (*imap.Client, error) {
+	client, server := net.Pipe()
+	go s.serve(server)
+	conn, err := imap.NewClient(client, "fake", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Login("user", "pw"); err != nil {
+		return nil, err
+	}
+	if _, err = imap.Wait(conn.Select("INBOX", readOnly)); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Len is the number of messages in the INBOX.
+func (s *fakeServer) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages)
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "* OK [CAPABILITY %s] fake server ready\r\n", s.capability())
+	w.Flush()
+	for {
+		args, err := readFakeCommand(r, w)
+		if err != nil {
+			return
+		}
+		if len(args) < 2 {
+			fmt.Fprint(w, "* BAD missing command\r\n")
+			w.Flush()
+			continue
+		}
+		tag, name, args := args[0], strings.ToUpper(args[1]), args[2:]
+		uid := false
+		if name == "UID" && len(args) > 0 {
+			uid, name, args = true, strings.ToUpper(args[0]), args[1:]
+		}
+		s.mu.Lock()
+		status := s.handle(w, name, args, uid)
+		s.mu.Unlock()
+		fmt.Fprintf(w, "%s %s\r\n", tag, status)
+		if w.Flush() != nil || name == "LOGOUT" {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) handle(w io.Writer, name string, args []string, uid bool) string {
+	switch name {
+	case "CAPABILITY":
+		fmt.Fprintf(w, "* CAPABILITY %s\r\n", s.capability())
+	case "LOGIN", "NOOP", "CHECK", "CLOSE":
+	case "LOGOUT":
+		fmt.Fprint(w, "* BYE fake server logging out\r\n")
+	case "SELECT", "EXAMINE":
+		if len(args) != 1 || !strings.EqualFold(args[0], "INBOX") {
+			return "NO no such mailbox"
+		}
+		fmt.Fprint(w, "* FLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft)\r\n")
+		fmt.Fprint(w, "* OK [PERMANENTFLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft \\*)] flags\r\n")
+		fmt.Fprintf(w, "* %d EXISTS\r\n* 0 RECENT\r\n", len(s.messages))
+		fmt.Fprintf(w, "* OK [UIDVALIDITY 1] uids\r\n* OK [UIDNEXT %d] next\r\n", s.nextUID)
+		if name == "EXAMINE" {
+			return "OK [READ-ONLY] EXAMINE completed"
+		}
+		return "OK [READ-WRITE] SELECT completed"
+	case "LIST":
+		fmt.Fprint(w, "* LIST () \"/\" INBOX\r\n")
+	case "APPEND":
+		return s.append(args)
+	case "SEARCH":
+		for _, arg := range args {
+			if s.refuse[arg] {
+				return "NO search failed"
+			}
+		}
+		var found []string
+		for i, msg := range s.messages {
+			// the keys are all ANDed, like a parenthesized list of them
+			if _, ok := s.matches(i, msg, append(append([]string{"("}, args...), ")")); ok {
+				found = append(found, strconv.FormatUint(uint64(s.number(i, msg, uid)), 10))
+			}
+		}
+		fmt.Fprintf(w, "* SEARCH %s\r\n", strings.Join(found, " "))
+	case "FETCH":
+		if len(args) < 2 {
+			return "BAD missing arguments"
+		}
+		return s.fetch(w, args[0], fakeList(args[1:]), uid)
+	case "STORE":
+		if len(args) < 3 {
+			return "BAD missing arguments"
+		}
+		flags := fakeList(args[2:])
+		for i, msg := range s.messages {
+			if !s.inSet(args[0], i, msg, uid) {
+				continue
+			}
+			switch strings.ToUpper(strings.TrimSuffix(args[1], ".SILENT")) {
+			case "+FLAGS":
+				msg.flags = append(msg.flags, flags...)
+			case "-FLAGS":
+				msg.flags = fakeWithout(msg.flags, flags)
+			case "FLAGS":
+				msg.flags = append([]string(nil), flags...)
+			}
+		}
+	case "GETACL", "SETACL", "GETMETADATA", "SETMETADATA":
+		return s.folderCommand(w, name, args)
+	case "EXPUNGE":
+		var kept []*fakeMessage
+		for i, msg := range s.messages {
+			// UID EXPUNGE only expunges the messages in its set
+			if len(fakeWithout(msg.flags, []string{`\Deleted`})) == len(msg.flags) || uid && len(args) > 0 && !s.inSet(args[0], i, msg, true) {
+				kept = append(kept, msg)
+			}
+		}
+		s.messages = kept
+	default:
+		return "BAD unknown command"
+	}
+	return "OK " + name + " completed"
+}
+
+func (s *fakeServer) capability() string {
+	return strings.Join(append([]string{"IMAP4rev1", "UIDPLUS"}, s.caps...), " ")
+}
+
+// folderCommand handles the ACL and METADATA commands, if the server has the extension.
+func (s *fakeServer) folderCommand(w io.Writer, name string, args []string) string {
+	extension := "ACL"
+	if strings.HasSuffix(name, "METADATA") {
+		extension = "METADATA"
+		// GETMETADATA's options come before the folder
+		if len(args) > 0 && args[0] == "(" {
+			for len(args) > 0 && args[0] != ")" {
+				args = args[1:]
+			}
+			args = args[1:]
+		}
+	}
+	if !strings.Contains(" "+s.capability()+" ", " "+extension+" ") {
+		return "BAD unknown command"
+	}
+	if len(args) == 0 {
+		return "BAD missing arguments"
+	}
+	folder := args[0]
+	switch name {
+	case "GETACL":
+		fields := []string{fakeQuote(folder)}
+		for id, rights := range s.acls[folder] {
+			fields = append(fields, fakeQuote(id), fakeQuote(rights))
+		}
+		fmt.Fprintf(w, "* ACL %s\r\n", strings.Join(fields, " "))
+	case "SETACL":
+		if len(args) != 3 || s.refuse[args[1]] {
+			return "NO can't set the rights"
+		}
+		if s.acls[folder] == nil {
+			s.acls[folder] = make(ACL)
+		}
+		s.acls[folder][args[1]] = args[2]
+	case "GETMETADATA":
+		var entries []string
+		for entry, value := range s.metadata[folder] {
+			entries = append(entries, fakeQuote(entry), fakeQuote(value))
+		}
+		if len(entries) > 0 {
+			fmt.Fprintf(w, "* METADATA %s (%s)\r\n", fakeQuote(folder), strings.Join(entries, " "))
+		}
+	case "SETMETADATA":
+		entries := fakeList(args[1:])
+		if len(entries) != 2 || s.refuse[entries[0]] {
+			return "NO [METADATA TOOMANY] can't set the annotation"
+		}
+		if s.metadata[folder] == nil {
+			s.metadata[folder] = make(Metadata)
+		}
+		s.metadata[folder][entries[0]] = entries[1]
+	}
+	return "OK " + name + " completed"
+}
+
+func (s *fakeServer) append(args []string) string {
+	if len(args) < 2 || !strings.EqualFold(args[0], "INBOX") {
+		return "NO no such mailbox"
+	}
+	msg := &fakeMessage{uid: s.nextUID, date: time.Now(), body: []byte(args[len(args)-1])}
+	args = args[1 : len(args)-1]
+	if len(args) > 0 && args[0] == "(" {
+		msg.flags = fakeList(args)
+		for len(args) > 0 && args[0] != ")" {
+			args = args[1:]
+		}
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		// the day can be padded with a space
+		date, err := time.Parse("2-Jan-2006 15:04:05 -0700", strings.TrimSpace(args[0]))
+		if err != nil {
+			return "BAD invalid date"
+		}
+		msg.date = date
+	}
+	if parsed, err := mail.ReadMessage(bytes.NewReader(msg.body)); err == nil {
+		msg.header = parsed.Header
+	}
+	s.messages = append(s.messages, msg)
+	s.nextUID++
+	return fmt.Sprintf("OK [APPENDUID 1 %d] APPEND completed", msg.uid)
+}
+
+func (s *fakeServer) fetch(w io.Writer, set string, items []string, uid bool) string {
+	if uid {
+		items = append(items, "UID")
+	}
+	for i, msg := range s.messages {
+		if !s.inSet(set, i, msg, uid) {
+			continue
+		}
+		header := msg.body
+		if end := bytes.Index(msg.body, []byte("\r\n\r\n")); end >= 0 {
+			header = msg.body[:end+4]
+		}
+		var attrs []string
+		seen := make(map[string]bool)
+		for _, item := range items {
+			item = strings.ToUpper(item)
+			if seen[item] {
+				continue
+			}
+			seen[item] = true
+			switch {
+			case item == "UID":
+				attrs = append(attrs, fmt.Sprintf("UID %d", msg.uid))
+			case item == "RFC822.SIZE":
+				attrs = append(attrs, fmt.Sprintf("RFC822.SIZE %d", len(msg.body)))
+			case item == "INTERNALDATE":
+				attrs = append(attrs, fmt.Sprintf("INTERNALDATE %q", msg.date.Format(fakeDateTime)))
+			case item == "FLAGS":
+				attrs = append(attrs, "FLAGS ("+strings.Join(msg.flags, " ")+")")
+			case item == "BODY[]" || item == "BODY.PEEK[]" || item == "RFC822":
+				attrs = append(attrs, fakeLiteral(strings.Replace(item, ".PEEK", "", 1), msg.body))
+			case item == "RFC822.HEADER" || item == "BODY[HEADER]" || item == "BODY.PEEK[HEADER]":
+				attrs = append(attrs, fakeLiteral(strings.Replace(item, ".PEEK", "", 1), header))
+			case strings.Contains(item, "[HEADER.FIELDS ("):
+				names := item[strings.Index(item, "(")+1 : strings.Index(item, ")")]
+				attrs = append(attrs, fakeLiteral(strings.Replace(item, ".PEEK", "", 1), fakeHeaderFields(header, strings.Fields(names))))
+			default:
+				return "BAD unknown fetch item " + item
+			}
+		}
+		fmt.Fprintf(w, "* %d FETCH (%s)\r\n", i+1, strings.Join(attrs, " "))
+	}
+	return "OK FETCH completed"
+}
+
+// matches evaluates the first search key in args against the message, returning what's
+// left of args after it.
+func (s *fakeServer) matches(i int, msg *fakeMessage, args []string) ([]string, bool) {
+	if len(args) == 0 {
+		return nil, true
+	}
+	key, args := strings.ToUpper(args[0]), args[1:]
+	switch {
+	case key == "(":
+		match := true
+		for len(args) > 0 && args[0] != ")" {
+			var ok bool
+			args, ok = s.matches(i, msg, args)
+			match = match && ok
+		}
+		if len(args) > 0 {
+			args = args[1:]
+		}
+		return args, match
+	case key == "ALL":
+		return args, true
+	case key == "NOT":
+		args, ok := s.matches(i, msg, args)
+		return args, !ok
+	case key == "OR":
+		args, a := s.matches(i, msg, args)
+		args, b := s.matches(i, msg, args)
+		return args, a || b
+	case key == "HEADER" && len(args) >= 2:
+		value := msg.header.Get(args[0])
+		return args[2:], len(value) > 0 && strings.Contains(strings.ToLower(value), strings.ToLower(args[1]))
+	case key == "UID" && len(args) >= 1:
+		return args[1:], s.inSet(args[0], i, msg, true)
+	case key == "SINCE" && len(args) >= 1:
+		since, err := time.Parse("2-Jan-2006", args[0])
+		return args[1:], err == nil && !msg.date.Before(since)
+	case key == "DELETED" || key == "UNDELETED":
+		deleted := len(fakeWithout(msg.flags, []string{`\Deleted`})) != len(msg.flags)
+		return args, deleted == (key == "DELETED")
+	case strings.IndexFunc(key, func(r rune) bool { return !strings.ContainsRune("0123456789:,*", r) }) < 0:
+		return args, s.inSet(key, i, msg, false)
+	}
+	// anything else matches everything, which is as close as dedup searches need
+	return args, true
+}
+
+// number is the message's UID, or its sequence number if uid isn't set.
+func (s *fakeServer) number(i int, msg *fakeMessage, uid bool) uint32 {
+	if uid {
+		return msg.uid
+	}
+	return uint32(i + 1)
+}
+
+// inSet will check if the message is in the sequence set, of UIDs if uid is set.
+func (s *fakeServer) inSet(set string, i int, msg *fakeMessage, uid bool) bool {
+	var largest uint32
+	if len(s.messages) > 0 {
+		largest = s.number(len(s.messages)-1, s.messages[len(s.messages)-1], uid)
+	}
+	n := s.number(i, msg, uid)
+	for _, part := range strings.Split(set, ",") {
+		bounds := strings.SplitN(part, ":", 2)
+		lo, hi := fakeSeqNumber(bounds[0], largest), fakeSeqNumber(bounds[len(bounds)-1], largest)
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if lo <= n && n <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+func fakeSeqNumber(s string, largest uint32) uint32 {
+	if s == "*" {
+		return largest
+	}
+	n, _ := strconv.ParseUint(s, 10, 32)
+	return uint32(n)
+}
+
+// fakeHeaderFields is the fields of the header with any of the names, ended by a blank line.
+func fakeHeaderFields(header []byte, names []string) []byte {
+	var fields bytes.Buffer
+	keep := false
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			keep = false
+			for _, name := range names {
+				if colon := strings.Index(line, ":"); colon > 0 && strings.EqualFold(strings.TrimSpace(line[:colon]), name) {
+					keep = true
+				}
+			}
+		}
+		if keep {
+			fields.WriteString(line)
+		}
+	}
+	fields.WriteString("\r\n")
+	return fields.Bytes()
+}
+
+func fakeQuote(s string) string {
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+func fakeLiteral(name string, value []byte) string {
+	return fmt.Sprintf("%s {%d}\r\n%s", name, len(value), value)
+}
+
+// fakeList is the items of a parenthesized list at the start of args, or its first
+// argument if it isn't a list.
+func fakeList(args []string) []string {
+	if len(args) == 0 || args[0] != "(" {
+		return args[:1]
+	}
+	var items []string
+	for _, arg := range args[1:] {
+		if arg == ")" {
+			break
+		}
+		items = append(items, arg)
+	}
+	return items
+}
+
+func fakeWithout(flags []string, remove []string) []string {
+	var kept []string
+	for _, flag := range flags {
+		removed := false
+		for _, r := range remove {
+			removed = removed || strings.EqualFold(flag, r)
+		}
+		if !removed {
+			kept = append(kept, flag)
+		}
+	}
+	return kept
+}
+
+// readFakeCommand reads a command's arguments, and any literals in it, asking the client
+// to go ahead with each literal.
+func readFakeCommand(r *bufio.Reader, w *bufio.Writer) ([]string, error) {
+	var args []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		open := strings.LastIndex(line, "{")
+		if open < 0 || !strings.HasSuffix(line, "}") {
+			return append(args, splitFakeArgs(line)...), nil
+		}
+		size := line[open+1 : len(line)-1]
+		synchronizing := !strings.HasSuffix(size, "+")
+		n, err := strconv.Atoi(strings.TrimSuffix(size, "+"))
+		if err != nil {
+			return append(args, splitFakeArgs(line)...), nil
+		}
+		args = append(args, splitFakeArgs(line[:open])...)
+		if synchronizing {
+			fmt.Fprint(w, "+ go ahead\r\n")
+			if err = w.Flush(); err != nil {
+				return nil, err
+			}
+		}
+		literal := make([]byte, n)
+		if _, err = io.ReadFull(r, literal); err != nil {
+			return nil, err
+		}
+		args = append(args, string(literal))
+	}
+}
+
+// splitFakeArgs splits a line into atoms, quoted strings and parentheses. Anything in
+// brackets, like a fetch's BODY[HEADER.FIELDS (MESSAGE-ID)], is part of its atom.
+func splitFakeArgs(line string) []string {
+	var args []string
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ':
+			i++
+		case c == '(' || c == ')':
+			args = append(args, string(c))
+			i++
+		case c == '"':
+			var arg strings.Builder
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				arg.WriteByte(line[i])
+			}
+			args = append(args, arg.String())
+			i++
+		default:
+			start := i
+			for depth := 0; i < len(line); i++ {
+				if line[i] == '[' {
+					depth++
+				} else if line[i] == ']' {
+					depth--
+				} else if depth == 0 && strings.IndexByte(" ()", line[i]) >= 0 {
+					break
+				}
+			}
+			args = append(args, line[start:i])
+		}
+	}
+	return args
+}
+
+func TestFakeServer(t *testing.T) {
+	server := newFakeServer()
+	client, conn := net.Pipe()
+	go server.serve(conn)
+	defer client.Close()
+	r := bufio.NewReader(client)
+
+	// exchange sends the command, and the literal if there is one, and returns everything
+	// the server answers up to and including the tagged response
+	n := 0
+	exchange := func(command string, literal string) string {
+		n++
+		tag := fmt.Sprintf("a%d", n)
+		fmt.Fprintf(client, "%s %s\r\n", tag, command)
+		if len(literal) > 0 {
+			if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "+ ") {
+				t.Fatalf("expected a continuation for %q, got %q (%v)", command, line, err)
+			}
+			fmt.Fprintf(client, "%s\r\n", literal)
+		}
+		var answer strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("lost the server after %q: %v", command, err)
+			}
+			answer.WriteString(line)
+			if strings.HasPrefix(line, tag+" ") {
+				return answer.String()
+			}
+		}
+	}
+
+	if greeting, _ := r.ReadString('\n'); !strings.HasPrefix(greeting, "* OK") {
+		t.Fatalf("unexpected greeting %q", greeting)
+	}
+	exchange("LOGIN user pw", "")
+	one := "Message-Id: <one@example.com>\r\nSubject: one\r\n\r\nhello\r\n"
+	if answer := exchange(fmt.Sprintf(`APPEND INBOX (\Seen) " 1-Mar-2014 12:00:00 +0000" {%d}`, len(one)), one); !strings.Contains(answer, "OK [APPENDUID 1 1]") {
+		t.Errorf("expected the first message to get UID 1, got %q", answer)
+	}
+	two := "Subject: two\r\nMessage-Id: <two@example.com>\r\n\r\nhello\r\n"
+	exchange(fmt.Sprintf("APPEND INBOX {%d}", len(two)), two)
+
+	if answer := exchange("SELECT INBOX", ""); !strings.Contains(answer, "* 2 EXISTS") || !strings.Contains(answer, "[UIDNEXT 3]") {
+		t.Errorf("unexpected SELECT %q", answer)
+	}
+	if answer := exchange(`UID SEARCH OR HEADER Message-Id "<two@example.com>" HEADER Resent-Message-Id "<two@example.com>"`, ""); !strings.HasPrefix(answer, "* SEARCH 2\r\n") {
+		t.Errorf("expected the dedup search to find UID 2, got %q", answer)
+	}
+	// n:* always takes in the last message, however large n is
+	if answer := exchange("UID SEARCH UID 5:*", ""); !strings.HasPrefix(answer, "* SEARCH 2\r\n") {
+		t.Errorf("expected the last message, got %q", answer)
+	}
+	answer := exchange("FETCH 1:* (UID BODY.PEEK[HEADER.FIELDS (MESSAGE-ID)] FLAGS)", "")
+	if want := "* 1 FETCH (UID 1 BODY[HEADER.FIELDS (MESSAGE-ID)] {33}\r\nMessage-Id: <one@example.com>\r\n\r\n FLAGS (\\Seen))\r\n"; !strings.HasPrefix(answer, want) {
+		t.Errorf("expected %q, got %q", want, answer)
+	}
+
+	exchange(`UID STORE 1 +FLAGS (\Deleted)`, "")
+	exchange("EXPUNGE", "")
+	if answer := exchange("SEARCH ALL", ""); !strings.HasPrefix(answer, "* SEARCH 1\r\n") || server.Len() != 1 {
+		t.Errorf("expected a single message after the expunge, got %q", answer)
+	}
+	if answer := exchange("UID FETCH 2 (INTERNALDATE BODY.PEEK[])", ""); !strings.Contains(answer, "UID 2") || !strings.Contains(answer, two) {
+		t.Errorf("expected the second message, got %q", answer)
+	}
+	if answer := exchange("EXAMINE Archive", ""); !strings.Contains(answer, " NO ") {
+		t.Errorf("expected only the INBOX to exist, got %q", answer)
+	}
+}
@@ -0,0 +1,125 @@
+package copycat
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults makes IMAP connections and appends fail on purpose, to check a run copes with
+// them (ex. in staging or tests). It is nil, for no faults, unless set.
+var Faults *FaultInjection
+
+// FaultInjection is how often things should go wrong.
+type FaultInjection struct {
+	// DropRate is the chance each read or write on a connection drops it.
+	DropRate float64
+	// Delay is the most each read is held up for. How long is picked at random.
+	Delay time.Duration
+	// AppendFailRate is the chance each append is refused.
+	AppendFailRate float64
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// errInjected is what injected failures look like, so they're handled like the real thing.
+var errInjected = errors.New("injected fault")
+
+// NewFaultInjection parses comma separated name=value pairs of drop (rate), delay
+// (duration), append (rate) and seed (for repeatable faults), ex. "drop=0.001,append=0.01".
+func NewFaultInjection(spec string) (*FaultInjection, error) {
+	f := &FaultInjection{}
+	seed := time.Now().UnixNano()
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected name=value, not %q", pair)
+		}
+		var err error
+		switch parts[0] {
+		case "drop":
+			f.DropRate, err = strconv.ParseFloat(parts[1], 64)
+		case "delay":
+			f.Delay, err = time.ParseDuration(parts[1])
+		case "append":
+			f.AppendFailRate, err = strconv.ParseFloat(parts[1], 64)
+		case "seed":
+			seed, err = strconv.ParseInt(parts[1], 10, 64)
+		default:
+			return nil, fmt.Errorf("unknown fault %q", parts[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", parts[0], err.Error())
+		}
+	}
+	f.rand = rand.New(rand.NewSource(seed))
+	return f, nil
+}
+
+// chance returns true with the probability rate.
+func (f *FaultInjection) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand.Float64() < rate
+}
+
+func (f *FaultInjection) delay() time.Duration {
+	if f == nil || f.Delay <= 0 {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Duration(f.rand.Int63n(int64(f.Delay)))
+}
+
+// appendFailure returns an error if this append should be refused.
+func (f *FaultInjection) appendFailure() error {
+	if f == nil || !f.chance(f.AppendFailRate) {
+		return nil
+	}
+	Stats.Add("faults_injected", 1)
+	return &Error{Op: "append", Err: errInjected}
+}
+
+// Conn wraps the connection so it's slowed down and dropped as often as f says.
+func (f *FaultInjection) Conn(conn net.Conn) net.Conn {
+	if f == nil {
+		return conn
+	}
+	return &faultConn{Conn: conn, faults: f}
+}
+
+type faultConn struct {
+	net.Conn
+	faults *FaultInjection
+}
+
+func (c *faultConn) drop() error {
+	Stats.Add("faults_injected", 1)
+	c.Conn.Close()
+	return &Error{Kind: ErrConnLost, Op: "injected drop", Err: errInjected}
+}
+
+func (c *faultConn) Read(p []byte) (int, error) {
+	time.Sleep(c.faults.delay())
+	if c.faults.chance(c.faults.DropRate) {
+		return 0, c.drop()
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	if c.faults.chance(c.faults.DropRate) {
+		return 0, c.drop()
+	}
+	return c.Conn.Write(p)
+}
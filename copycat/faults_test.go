@@ -0,0 +1,54 @@
+package copycat
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFaultInjection(t *testing.T) {
+	if _, err := NewFaultInjection("drop=often"); err == nil {
+		t.Error("expected an error for an invalid rate")
+	}
+	if _, err := NewFaultInjection("explode=1"); err == nil {
+		t.Error("expected an error for an unknown fault")
+	}
+
+	faults, err := NewFaultInjection("append=0.25,delay=1ms,seed=7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if faults.AppendFailRate != 0.25 || faults.Delay != time.Millisecond {
+		t.Errorf("unexpected faults: %+v", faults)
+	}
+	var failed int
+	for i := 0; i < 1000; i++ {
+		if faults.appendFailure() != nil {
+			failed++
+		}
+	}
+	if failed < 200 || failed > 300 {
+		t.Errorf("expected about a quarter of the appends to fail, %d did", failed)
+	}
+	var none *FaultInjection
+	if none.appendFailure() != nil || none.Conn(nil) != nil {
+		t.Error("expected no faults from a nil FaultInjection")
+	}
+}
+
+func TestFaultConnDrop(t *testing.T) {
+	faults, _ := NewFaultInjection("drop=1,seed=1")
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := faults.Conn(client)
+
+	_, err := conn.Write([]byte("a1 NOOP\r\n"))
+	if !errors.Is(err, ErrConnLost) {
+		t.Errorf("expected a lost connection, got %v", err)
+	}
+	// the underlying connection is really gone, like it would be after a drop
+	if _, err = client.Write([]byte("x")); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
@@ -0,0 +1,109 @@
+package copycat
+
+import (
+	"log"
+	"strings"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// FlagPolicy is a Transformer that decides which flags a copied message gets.
+// Normally messages are appended as unseen and their source flags are dropped.
+// With a FlagPolicy, the source flags are kept if Preserve is set, then each
+// flag in Add is set and each flag in Remove is cleared (ex. mark everything
+// \Seen and add an "Imported" keyword).
+type FlagPolicy struct {
+	Preserve bool
+	Add      []string
+	Remove   []string
+}
+
+// ParseFlags splits a comma separated list of flags.
+func ParseFlags(list string) []string {
+	var flags []string
+	for _, flag := range strings.Split(list, ",") {
+		if flag = strings.TrimSpace(flag); len(flag) > 0 {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+func (p FlagPolicy) Transform(msg MessageData) (MessageData, error) {
+	flags := make(map[string]bool)
+	if p.Preserve {
+		for _, flag := range msg.Flags {
+			flags[flag] = true
+		}
+	}
+	for _, flag := range p.Add {
+		flags[flag] = true
+	}
+	for _, flag := range p.Remove {
+		for set := range flags {
+			// system flags are case-insensitive, as are keywords on most servers
+			if strings.EqualFold(set, flag) {
+				delete(flags, set)
+			}
+		}
+	}
+	// \Recent is set by the server and can't be appended
+	delete(flags, `\Recent`)
+
+	msg.Flags = flagList(flags)
+	msg.flagsSet = true
+	return msg, nil
+}
+
+// appendFlags are the flags a message should be appended with.
+func appendFlags(conn *imap.Client, msg MessageData) imap.FlagSet {
+	if !msg.flagsSet {
+		// our default is a keyword too, so leave it off if the server won't keep it
+		if !keywordAllowed(conn, "UnSeen") {
+			return imap.NewFlagSet()
+		}
+		return imap.NewFlagSet("UnSeen")
+	}
+
+	flags := imap.NewFlagSet()
+	for _, flag := range msg.Flags {
+		// \Recent is set by the server and can't be appended
+		if flag != `\Recent` {
+			flags[flag] = true
+		}
+	}
+	return flags
+}
+
+// appendUID is the UID from an APPEND's APPENDUID response code, or 0 if there isn't one.
+func appendUID(cmd *imap.Command) uint32 {
+	rsp, err := cmd.Result(imap.OK)
+	if err != nil || rsp.Label != "APPENDUID" || len(rsp.Fields) == 0 {
+		return 0
+	}
+	return imap.AsNumber(rsp.Fields[len(rsp.Fields)-1])
+}
+
+// storeFlagsAfterAppend is for servers that refuse some flags on APPEND. The message is
+// appended without any flags and, if the server tells us its UID (UIDPLUS), they are
+// set with a STORE afterwards.
+func storeFlagsAfterAppend(conn *imap.Client, msg MessageData) error {
+	cmd, err := imap.Wait(conn.Append(conn.Mailbox.Name, nil, &msg.InternalDate, msg.Literal()))
+	if err != nil {
+		return err
+	}
+	if len(msg.Flags) == 0 {
+		return nil
+	}
+
+	uid := appendUID(cmd)
+	if uid == 0 {
+		log.Printf("Unable to find the UID of an appended message to set its flags (%s)", strings.Join(msg.Flags, " "))
+		return nil
+	}
+
+	seq, _ := imap.NewSeqSet("")
+	seq.AddNum(uid)
+	_, err = imap.Wait(conn.UIDStore(seq, "+FLAGS.SILENT", imap.NewFlagSet(msg.Flags...)))
+	return err
+}
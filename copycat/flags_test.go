@@ -0,0 +1,29 @@
+package copycat
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFlagPolicy(t *testing.T) {
+	msg := MessageData{Flags: []string{`\Answered`, `\Recent`, `\Seen`, "Work"}}
+
+	tests := []struct {
+		policy FlagPolicy
+		want   string
+	}{
+		{FlagPolicy{}, "[]"},
+		{FlagPolicy{Preserve: true}, `[Work \Answered \Seen]`},
+		{FlagPolicy{Add: ParseFlags(`\Seen, Imported`)}, `[Imported \Seen]`},
+		{FlagPolicy{Preserve: true, Add: []string{"Imported"}, Remove: []string{`\seen`, "work"}}, `[Imported \Answered]`},
+	}
+	for _, test := range tests {
+		got, err := test.policy.Transform(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got.Flags) != test.want || !got.flagsSet {
+			t.Errorf("%+v: got flags %v, want %s", test.policy, got.Flags, test.want)
+		}
+	}
+}
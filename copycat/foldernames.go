@@ -0,0 +1,229 @@
+package copycat
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// FolderRules are the limits a server puts on folder names, and the Root of the account
+// they're created in. Zero values mean no limit.
+type FolderRules struct {
+	// MaxDepth is the most levels of folders, including the top one. Deeper folders
+	// are flattened into a folder at the deepest level allowed.
+	MaxDepth int
+	// MaxLength is the most characters in each level of a folder name.
+	MaxLength int
+	// Invalid characters are replaced with an underscore.
+	Invalid string
+	// Root is the folder every folder goes under (see InboxInfo.Root). Its levels count
+	// toward MaxDepth.
+	Root string
+}
+
+// ProviderFolderRules are the FolderRules of servers known to refuse some folder
+// names, keyed by host (without a port).
+var ProviderFolderRules = map[string]FolderRules{
+	// Yahoo and AOL only allow a single level of subfolders
+	"imap.mail.yahoo.com": {MaxDepth: 2, MaxLength: 40, Invalid: `"\%*`},
+	"imap.aol.com":        {MaxDepth: 2, MaxLength: 40, Invalid: `"\%*`},
+	"imap.mail.me.com":    {MaxLength: 64, Invalid: `"\%*`},
+}
+
+// FolderLimits are applied to every destination on top of its provider's rules.
+var FolderLimits FolderRules
+
+// FolderRulesFor returns the rules for folders created on the host.
+func FolderRulesFor(host string) FolderRules {
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	rules := ProviderFolderRules[strings.ToLower(host)]
+	if FolderLimits.MaxDepth > 0 {
+		rules.MaxDepth = FolderLimits.MaxDepth
+	}
+	if FolderLimits.MaxLength > 0 {
+		rules.MaxLength = FolderLimits.MaxLength
+	}
+	rules.Invalid += FolderLimits.Invalid
+	return rules
+}
+
+// folderRules are the FolderRulesFor the destination's host, under its Root.
+func (i InboxInfo) folderRules() FolderRules {
+	rules := FolderRulesFor(i.Host)
+	rules.Root = i.Root
+	return rules
+}
+
+// rootLevels splits a Root into its levels.
+func rootLevels(root string) []string {
+	var levels []string
+	for _, level := range strings.Split(root, "/") {
+		if level = strings.TrimSpace(level); len(level) > 0 {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
+// underRoot puts the folder, named with the destination's delimiter, under the root. A
+// destination without folder levels gets it flattened, as SyncFolders would.
+func underRoot(root string, folder string, delim string) string {
+	if len(rootLevels(root)) == 0 {
+		return folder
+	}
+	return FolderRules{Root: root}.Sanitize(folder, delim, delim)
+}
+
+var destinationRoots = struct {
+	sync.Mutex
+	byUser map[string]string
+}{byUser: make(map[string]string)}
+
+// rememberRoots keeps the Root of each destination, so the messages stored to it
+// outside of SyncFolders' folder names (ex. routed ones) go under it too.
+func rememberRoots(dsts []InboxInfo) {
+	destinationRoots.Lock()
+	defer destinationRoots.Unlock()
+	for _, dst := range dsts {
+		destinationRoots.byUser[dst.User] = dst.Root
+	}
+}
+
+func destinationRoot(user string) string {
+	destinationRoots.Lock()
+	defer destinationRoots.Unlock()
+	return destinationRoots.byUser[user]
+}
+
+// getRootedConnection logs in to the destination and selects the folder under its
+// Root, creating it if needed.
+func getRootedConnection(info InboxInfo, folder string) (*imap.Client, error) {
+	conn, err := GetConnection(info, false)
+	if err != nil {
+		return nil, err
+	}
+	delim, err := HierarchyDelimiter(conn)
+	if err != nil {
+		conn.Logout(20 * time.Second)
+		return nil, wrapError("list", info.User, err)
+	}
+	name := underRoot(info.Root, folder, delim)
+	// this will fail if the folder already exists, which is fine
+	imap.Wait(conn.Create(name))
+	if _, err = imap.Wait(conn.Select(name, false)); err != nil {
+		conn.Logout(20 * time.Second)
+		return nil, wrapError("select "+name, info.User, err)
+	}
+	return conn, nil
+}
+
+// Sanitize returns a name for the folder that follows the rules. srcDelim is the
+// hierarchy delimiter of the name and dstDelim is the one the returned name uses.
+// A dstDelim of "" is for servers without folder levels, so every level is flattened.
+func (r FolderRules) Sanitize(name string, srcDelim string, dstDelim string) string {
+	return strings.Join(r.sanitize(name, srcDelim, dstDelim), dstDelim)
+}
+
+func (r FolderRules) sanitize(name string, srcDelim string, dstDelim string) []string {
+	if strings.EqualFold(name, "INBOX") && len(r.Root) == 0 {
+		return []string{name}
+	}
+
+	parts := []string{name}
+	if len(srcDelim) > 0 {
+		parts = strings.Split(name, srcDelim)
+	}
+	parts = append(rootLevels(r.Root), parts...)
+	depth := r.MaxDepth
+	if len(dstDelim) == 0 {
+		depth = 1
+	}
+	if depth > 0 && len(parts) > depth {
+		flattened := strings.Join(parts[depth-1:], " - ")
+		parts = append(parts[:depth-1], flattened)
+	}
+
+	for i, part := range parts {
+		part = strings.Map(func(c rune) rune {
+			// the destination's delimiter would add a level that isn't in the source
+			if strings.ContainsRune(r.Invalid, c) || (len(dstDelim) > 0 && strings.ContainsRune(dstDelim, c)) {
+				return '_'
+			}
+			return c
+		}, part)
+		if part = strings.TrimSpace(r.truncate(part, 0)); len(part) == 0 {
+			part = "_"
+		}
+		parts[i] = part
+	}
+	return parts
+}
+
+// truncate shortens a level of a folder name to leave room for extra characters.
+func (r FolderRules) truncate(part string, extra int) string {
+	if runes := []rune(part); r.MaxLength > 0 && len(runes)+extra > r.MaxLength {
+		return string(runes[:r.MaxLength-extra])
+	}
+	return part
+}
+
+// MapFolders returns the destination name of each folder under the rules, translated
+// from the source's hierarchy delimiter to the destination's. Folders that would end
+// up with the same name are numbered.
+func (r FolderRules) MapFolders(folders []string, srcDelim string, dstDelim string) map[string]string {
+	names := make(map[string]string)
+	taken := make(map[string]bool)
+	for _, folder := range folders {
+		parts := r.sanitize(folder, srcDelim, dstDelim)
+		name := strings.Join(parts, dstDelim)
+		for n := 2; taken[strings.ToLower(name)]; n++ {
+			suffix := " " + strconv.Itoa(n)
+			last := parts[len(parts)-1]
+			name = strings.Join(append(parts[:len(parts)-1:len(parts)-1], strings.TrimSpace(r.truncate(last, len(suffix)))+suffix), dstDelim)
+		}
+		taken[strings.ToLower(name)] = true
+		names[folder] = name
+	}
+	return names
+}
+
+// HierarchyDelimiter asks the server which delimiter separates levels of folders.
+// It returns "" for a server without folder levels.
+func HierarchyDelimiter(conn *imap.Client) (string, error) {
+	cmd, err := imap.Wait(conn.List("", ""))
+	if err != nil {
+		return "", err
+	}
+	for _, rsp := range cmd.Data {
+		if info := rsp.MailboxInfo(); info != nil {
+			return info.Delim, nil
+		}
+	}
+	return "", nil
+}
+
+// DestinationFolders returns the name SyncFolders gives each of the folders from src on dst.
+func DestinationFolders(src *imap.Client, dst *imap.Client, dstInfo InboxInfo, folders []string) (map[string]string, error) {
+	delim, err := HierarchyDelimiter(src)
+	if err != nil {
+		return nil, err
+	}
+	dstDelim, err := HierarchyDelimiter(dst)
+	if err != nil {
+		return nil, err
+	}
+	srcNamespaces, err := GetNamespaces(src)
+	if err != nil {
+		return nil, err
+	}
+	dstNamespaces, err := GetNamespaces(dst)
+	if err != nil {
+		return nil, err
+	}
+	return dstInfo.folderRules().MapNamespaces(folders, delim, dstDelim, srcNamespaces, dstNamespaces), nil
+}
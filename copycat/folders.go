@@ -0,0 +1,444 @@
+package copycat
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// ListFolders will return the name of every selectable folder on the connection.
+func ListFolders(conn *imap.Client) ([]string, error) {
+	return listFolders(conn, "*")
+}
+
+// listFolders returns the selectable folders matching the LIST pattern.
+func listFolders(conn *imap.Client, pattern string) ([]string, error) {
+	cmd, err := imap.Wait(conn.List("", pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	var folders []string
+	for _, rsp := range cmd.Data {
+		info := rsp.MailboxInfo()
+		if info == nil || info.Attrs[`\Noselect`] || info.Attrs[`\NonExistent`] {
+			continue
+		}
+		folders = append(folders, info.Name)
+	}
+	return folders, nil
+}
+
+// ConnBudget keeps the number of open connections to each server under Max.
+// Connections are acquired all at once so a folder is never left holding
+// half of what it needs while waiting on the rest. When connections are freed,
+// they go to the waiter with the least weight that they're enough for (see AcquireFair).
+type ConnBudget struct {
+	Max int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	open    map[string]int
+	waiting []*budgetWaiter
+	seq     int
+}
+
+type budgetWaiter struct {
+	need   map[string]int
+	weight int
+	seq    int
+}
+
+func NewConnBudget(max int) *ConnBudget {
+	b := &ConnBudget{Max: max, open: make(map[string]int)}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Acquire will block until the number of connections needed for each host are available.
+// If more are needed than Max allows, they will be given out once nothing else is open to the host.
+// It goes ahead of anything waiting in AcquireFair.
+func (b *ConnBudget) Acquire(need map[string]int) {
+	b.AcquireFair(need, 0)
+}
+
+// AcquireFair is Acquire for work of the given weight, ex. the messages left in a folder.
+// While it waits, lighter work that the free connections are enough for goes first, so
+// small folders aren't held up behind a huge one. Work of the same weight goes in turn.
+func (b *ConnBudget) AcquireFair(need map[string]int, weight int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	w := &budgetWaiter{need: need, weight: weight, seq: b.seq}
+	b.waiting = append(b.waiting, w)
+	for !b.available(need) || b.ahead(w) {
+		b.cond.Wait()
+	}
+	for i, waiter := range b.waiting {
+		if waiter == w {
+			b.waiting = append(b.waiting[:i], b.waiting[i+1:]...)
+			break
+		}
+	}
+	for host, count := range need {
+		b.open[host] += count
+	}
+	// whoever was waiting behind this may fit in what's left
+	b.cond.Broadcast()
+}
+
+// ahead says if another waiter should get connections before w.
+func (b *ConnBudget) ahead(w *budgetWaiter) bool {
+	for _, other := range b.waiting {
+		if other == w || !b.available(other.need) {
+			continue
+		}
+		if other.weight < w.weight || (other.weight == w.weight && other.seq < w.seq) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *ConnBudget) available(need map[string]int) bool {
+	for host, count := range need {
+		if b.open[host] > 0 && b.open[host]+count > b.Max {
+			return false
+		}
+	}
+	return true
+}
+
+// Release gives back connections taken with Acquire.
+func (b *ConnBudget) Release(need map[string]int) {
+	b.mu.Lock()
+	for host, count := range need {
+		b.open[host] -= count
+	}
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// FairFolders will have SyncFolders start the smallest folders first, give each folder
+// connections in proportion to the messages in it (see folderConns) and hand out freed
+// connections to the smallest waiting folder, so small folders finish early instead of
+// waiting on the biggest ones.
+var FairFolders = true
+
+// messagesPerConn is how many messages in a folder are worth another connection to it.
+const messagesPerConn = 500
+
+// folderConns is how many connections a folder of the size gets, up to connsPerFolder.
+func folderConns(messages uint32, connsPerFolder int) int {
+	conns := int((messages + messagesPerConn - 1) / messagesPerConn)
+	if conns < 1 {
+		conns = 1
+	}
+	if conns > connsPerFolder {
+		conns = connsPerFolder
+	}
+	return conns
+}
+
+// folderSizes is the number of messages in each folder in the source, from the STATUS
+// already known or else asked for on conn. Folders whose size can't be found are left out.
+func folderSizes(conn *imap.Client, folders []string, known map[string]FolderStatus) map[string]uint32 {
+	sizes := make(map[string]uint32)
+	for _, folder := range folders {
+		if status, exists := known[folder]; exists {
+			sizes[folder] = status.Messages
+			continue
+		}
+		status, err := GetFolderStatus(conn, folder)
+		if err != nil {
+			log.Printf("Unable to get the status of folder %s: %s", folder, err.Error())
+			continue
+		}
+		sizes[folder] = status.Messages
+	}
+	return sizes
+}
+
+// smallestFirst orders the folders by size, keeping the listing order among folders of
+// the same size. Folders without a size go last.
+func smallestFirst(folders []string, sizes map[string]uint32) {
+	sort.SliceStable(folders, func(i, j int) bool {
+		a, aKnown := sizes[folders[i]]
+		b, bKnown := sizes[folders[j]]
+		if aKnown != bKnown {
+			return aKnown
+		}
+		return a < b
+	})
+}
+
+// connsNeeded is how many connections initiateConnections will make to each host.
+func connsNeeded(src InboxInfo, dsts []InboxInfo, connsPerInbox int) map[string]int {
+	need := map[string]int{src.Host: connsPerInbox}
+	for _, dst := range dsts {
+		need[dst.Host] += connsPerInbox
+	}
+	return need
+}
+
+// SubscribeFolders will have SyncFolders subscribe to each folder in the destinations
+// so clients that only show subscribed folders list them.
+var SubscribeFolders = true
+
+// SyncFolders will sync every folder in the source, not just the INBOX, creating any
+// that are missing in the destinations. Up to parallelFolders folders are synced at once,
+// each with connsPerFolder connections per inbox, while keeping the connections open
+// to any one server under maxConns. The message cache is shared by all of the folders.
+// Folders are renamed in destinations that can't take their names (see FolderRules) and
+// synced according to the FolderPolicies.
+func SyncFolders(src InboxInfo, dsts []InboxInfo, sinks []Sink, connsPerFolder, parallelFolders, maxConns int, runPurge bool, dbFile string, transform Transformer, generateIds bool) error {
+	budget := NewConnBudget(maxConns)
+	var users []string
+	for _, dst := range dsts {
+		users = append(users, dst.User)
+	}
+	resetErrorBudgets(users)
+
+	cache, err := NewCache(dbFile)
+	if err != nil {
+		log.Printf("problems initiating cache - %s", err.Error())
+		return err
+	}
+	defer cache.Close()
+
+	// find the folders and make sure the destinations have them
+	control := connsNeeded(src, dsts, 1)
+	budget.Acquire(control)
+	controlConns, err := initiateConnections(src, dsts, "INBOX", nil, 1)
+	if err != nil {
+		controlConns.Close()
+		budget.Release(control)
+		return err
+	}
+	folders, err := ListFolders(controlConns.Source[0])
+	if err != nil {
+		controlConns.Close()
+		budget.Release(control)
+		return err
+	}
+	srcNamespaces, err := GetNamespaces(controlConns.Source[0])
+	if err != nil {
+		log.Printf("Unable to find the namespaces of %s: %s. assuming there aren't any", src.User, err.Error())
+	}
+	shared, err := sharedFolders(controlConns.Source[0], srcNamespaces)
+	if err != nil {
+		controlConns.Close()
+		budget.Release(control)
+		return err
+	}
+	listed := make(map[string]bool)
+	var synced []string
+	for _, folder := range append(folders, shared...) {
+		if listed[folder] {
+			continue
+		}
+		listed[folder] = true
+		if kind, prefix := srcNamespaces.shared(folder); len(kind) > 0 && !sharedIncluded(kind, prefix) {
+			log.Printf("skipping shared folder %s", folder)
+			continue
+		}
+		if folderPolicy(folder).Skip {
+			log.Printf("skipping folder %s", folder)
+			continue
+		}
+		if GroupwareFolders != GroupwareSync && skipGroupware(controlConns.Source[0], src.User, folder) {
+			continue
+		}
+		synced = append(synced, folder)
+	}
+	folders = synced
+	var renamed map[string]folderState
+	if SkipUnchanged {
+		renamed = detectRenames(controlConns.Source[0], src, listed, folders, cache)
+	}
+	var metadata map[string]Metadata
+	if CopyMetadata {
+		metadata = sourceMetadata(controlConns.Source[0], src.User, folders)
+	}
+	var acls map[string]ACL
+	if CopyACLs {
+		acls = sourceACLs(controlConns.Source[0], src.User, folders)
+	} else {
+		reportSharedACLs(controlConns.Source[0], src.User, folders, srcNamespaces)
+	}
+
+	delim, err := HierarchyDelimiter(controlConns.Source[0])
+	if err != nil {
+		controlConns.Close()
+		budget.Release(control)
+		return err
+	}
+
+	// destination user -> source folder -> destination folder
+	dstFolders := make(map[string]map[string]string)
+	for _, dst := range dsts {
+		dstConn := controlConns.Dest[dst.User][0]
+		dstDelim, err := HierarchyDelimiter(dstConn)
+		if err != nil {
+			log.Printf("Unable to find the folder delimiter of %s: %s. using %q", dst.User, err.Error(), delim)
+			dstDelim = delim
+		}
+		dstNamespaces, err := GetNamespaces(dstConn)
+		if err != nil {
+			log.Printf("Unable to find the namespaces of %s: %s. assuming there aren't any", dst.User, err.Error())
+		}
+		names := dst.folderRules().MapNamespaces(folders, delim, dstDelim, srcNamespaces, dstNamespaces)
+		for _, folder := range folders {
+			// just changing the delimiter or namespace, or putting it under the root, isn't worth reporting
+			if names[folder] != translateFolder(folder, dst.Root, delim, dstDelim, srcNamespaces, dstNamespaces) {
+				log.Printf("folder %s will be %s in %s", folder, names[folder], dst.User)
+				RunReport.Renamed(dst.User, folder, names[folder])
+			}
+			if state, exists := renamed[folder]; !exists || !renameDestFolder(dstConn, dst.User, state, names[folder]) {
+				// this will fail if the folder already exists, which is fine
+				imap.Wait(dstConn.Create(names[folder]))
+			}
+			if SubscribeFolders {
+				if _, err := imap.Wait(dstConn.Subscribe(names[folder])); err != nil {
+					log.Printf("Unable to subscribe to folder %s in %s: %s", names[folder], dst.User, err.Error())
+				}
+			}
+		}
+		if CopyACLs {
+			copyACLs(dstConn, src.User, dst.User, acls, names)
+		}
+		if CopyMetadata {
+			copyMetadata(dstConn, dst.User, metadata, names)
+		}
+		dstFolders[dst.User] = names
+	}
+	var srcStatus map[string]FolderStatus
+	if SkipUnchanged {
+		folders, srcStatus = changedFolders(controlConns, src, folders, dstFolders, cache)
+	}
+	var sizes map[string]uint32
+	if FairFolders {
+		sizes = folderSizes(controlConns.Source[0], folders, srcStatus)
+		smallestFirst(folders, sizes)
+	}
+	controlConns.Close()
+	budget.Release(control)
+	log.Printf("found %d folders to sync", len(folders))
+
+	if parallelFolders <= 0 {
+		parallelFolders = 1
+	}
+	folderRequests := make(chan string)
+	var mu sync.Mutex
+	stored := make(map[string]FolderStatus)
+	var workers sync.WaitGroup
+	for i := 0; i < parallelFolders; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for folder := range folderRequests {
+				if budgetExceeded(users) != nil || Controls.Stopped("") {
+					log.Printf("skipping folder %s after the run was stopped", folder)
+					continue
+				}
+				if Journal.Done(folder) {
+					log.Printf("skipping folder %s, it was synced before the run stopped", folder)
+					continue
+				}
+				dstNames := make(map[string]string)
+				for user, names := range dstFolders {
+					dstNames[user] = names[folder]
+				}
+				conns, weight := connsPerFolder, 0
+				if size, known := sizes[folder]; known {
+					conns, weight = folderConns(size, connsPerFolder), int(size)
+				}
+				if !syncFolder(src, dsts, sinks, folder, dstNames, conns, weight, budget, runPurge, cache, transform, generateIds) {
+					continue
+				}
+				Journal.FolderDone(folder)
+				if status, exists := srcStatus[folder]; exists {
+					mu.Lock()
+					stored[folder] = status
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, folder := range folders {
+		folderRequests <- folder
+	}
+	close(folderRequests)
+	workers.Wait()
+
+	// remember what the synced folders looked like so they can be skipped next time
+	if len(stored) > 0 {
+		budget.Acquire(control)
+		if controlConns, err = initiateConnections(src, dsts, "INBOX", nil, 1); err == nil {
+			saveFolderStates(controlConns, src, stored, dstFolders, cache)
+		} else {
+			log.Printf("Unable to save the state of the synced folders: %s", err.Error())
+		}
+		controlConns.Close()
+		budget.Release(control)
+	}
+
+	if err = budgetExceeded(users); err != nil {
+		return err
+	}
+	if Controls.Stopped("") {
+		return ErrCanceled
+	}
+	log.Print("folder sync complete")
+	return nil
+}
+
+// syncFolder opens connections to the folder within the budget and runs a purge and store on it.
+// dstNames has the name of the folder in each destination and weight is its share of the
+// budget (see AcquireFair). It returns false if the folder couldn't be synced.
+func syncFolder(src InboxInfo, dsts []InboxInfo, sinks []Sink, folder string, dstNames map[string]string, connsPerFolder int, weight int, budget *ConnBudget, runPurge bool, cache *Cache, transform Transformer, generateIds bool) bool {
+	need := connsNeeded(src, dsts, connsPerFolder)
+	budget.AcquireFair(need, weight)
+	defer budget.Release(need)
+
+	conns, err := initiateConnections(src, dsts, folder, dstNames, connsPerFolder)
+	defer conns.Close()
+	if err != nil {
+		log.Printf("Unable to open folder %s: %s. skipping!", folder, err.Error())
+		return false
+	}
+
+	log.Printf("beginning sync of folder %s", folder)
+	// kept up to date on every sync, so the next -purge only needs what's vanished since
+	index := loadUIDIndex(conns.Source[0], src, folder, cache)
+	if runPurge && !purgeVanished(conns, index, folder, cache) {
+		if err = SearchAndPurge(conns.Source, conns.Dest); err != nil {
+			log.Printf("There was an error during the purge of folder %s: %s. skipping!", folder, err.Error())
+			return false
+		}
+		index = index.restart()
+	}
+
+	// an emptied folder still needs the purge above, but there's nothing to store
+	if conns.Source[0].Mailbox.Messages == 0 {
+		log.Printf("folder %s is empty", folder)
+		return true
+	}
+
+	policy := folderPolicy(folder)
+	if err = searchAndStore(conns.Source, conns.Dest, sinks, cache, 0, policy.Since(), policy.Transformer(transform), generateIds); err != nil {
+		log.Printf("There was an error during the store of folder %s: %s", folder, err.Error())
+		return false
+	}
+	updateUIDIndex(conns.Source[0], folder, index, cache)
+
+	if ExpungeSource {
+		if err = expungeDeleted(conns.Source[0], conns.Dest, sinks, policy.Since()); err != nil {
+			log.Printf("There was an error expunging deleted messages from folder %s: %s", folder, err.Error())
+		}
+	}
+	return true
+}
@@ -0,0 +1,184 @@
+package copycat
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConnBudget(t *testing.T) {
+	budget := NewConnBudget(4)
+
+	first := map[string]int{"imap.src.com": 2, "imap.dst.com": 2}
+	budget.Acquire(first)
+	budget.Acquire(first)
+
+	acquired := make(chan bool)
+	go func() {
+		budget.Acquire(map[string]int{"imap.src.com": 1})
+		acquired <- true
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Acquire should block while the budget is used up")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	budget.Release(first)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Acquire should not block once connections are released")
+	}
+
+	// more than the max is allowed when nothing else is open to the host
+	done := make(chan bool)
+	go func() {
+		budget.Acquire(map[string]int{"imap.other.com": 6})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Acquire should allow oversubscribing an idle host")
+	}
+}
+
+func TestConnBudgetFairness(t *testing.T) {
+	budget := NewConnBudget(2)
+	one := map[string]int{"imap.src.com": 1}
+	budget.Acquire(one)
+	budget.Acquire(one)
+
+	order := make(chan string, 2)
+	go func() {
+		budget.AcquireFair(one, 5000)
+		order <- "huge"
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		budget.AcquireFair(one, 10)
+		order <- "small"
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	budget.Release(one)
+	select {
+	case first := <-order:
+		if first != "small" {
+			t.Errorf("expected the smaller folder to get the connection first, got %s", first)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("AcquireFair should not block once a connection is released")
+	}
+	budget.Release(one)
+	select {
+	case <-order:
+	case <-time.After(time.Second):
+		t.Fatal("the bigger folder should get the next connection")
+	}
+
+	if conns := folderConns(20, 4); conns != 1 {
+		t.Errorf("expected a small folder to get 1 connection, got %d", conns)
+	}
+	if conns := folderConns(1200, 4); conns != 3 {
+		t.Errorf("expected 3 connections, got %d", conns)
+	}
+	if conns := folderConns(100000, 4); conns != 4 {
+		t.Errorf("expected the most connections a folder can have, got %d", conns)
+	}
+
+	folders := []string{"INBOX", "Archive", "Sent", "Drafts", "Unknown"}
+	smallestFirst(folders, map[string]uint32{"INBOX": 300, "Archive": 90000, "Sent": 300, "Drafts": 2})
+	if want := []string{"Drafts", "INBOX", "Sent", "Archive", "Unknown"}; !reflect.DeepEqual(folders, want) {
+		t.Errorf("expected %v, got %v", want, folders)
+	}
+}
+
+func TestIsSentFolder(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"Sent":              true,
+		"INBOX.Sent Items":  true,
+		"[Gmail]/Sent Mail": true,
+		"Sent Messages":     true,
+		"INBOX":             false,
+		"Sent/Archive":      false,
+	} {
+		if isSentFolder(name) != expected {
+			t.Errorf("isSentFolder(%q) should be %v", name, expected)
+		}
+	}
+}
+
+func TestFolderRules(t *testing.T) {
+	rules := FolderRules{MaxDepth: 2, MaxLength: 12, Invalid: `"*`}
+	for name, expected := range map[string]string{
+		"INBOX":                     "INBOX",
+		"Projects/2014/Q1/Invoices": "Projects/2014 - Q1 -",
+		`Say "hi"*`:                 "Say _hi__",
+		"A very long folder name":   "A very long",
+		"Work/ ":                    "Work/_",
+	} {
+		if sanitized := rules.Sanitize(name, "/", "/"); sanitized != expected {
+			t.Errorf("Sanitize(%q) should be %q, got %q", name, expected, sanitized)
+		}
+	}
+
+	names := rules.MapFolders([]string{"Archive/Old stuff from 2010", "Archive/Old stuff from 2011", "archive/old stuff from 2012"}, "/", "/")
+	if names["Archive/Old stuff from 2010"] != "Archive/Old stuff fr" || names["Archive/Old stuff from 2011"] != "Archive/Old stuff 2" || names["archive/old stuff from 2012"] != "archive/old stuff 3" {
+		t.Errorf("unexpected folder names: %v", names)
+	}
+}
+
+func TestFolderDelimiters(t *testing.T) {
+	var rules FolderRules
+	if name := rules.Sanitize("INBOX.Work.v1/v2", ".", "/"); name != "INBOX/Work/v1_v2" {
+		t.Errorf("unexpected translated name: %s", name)
+	}
+	if name := rules.Sanitize("Work/Clients", "/", ""); name != "Work - Clients" {
+		t.Errorf("expected a flat name, got: %s", name)
+	}
+}
+
+func TestFolderRoot(t *testing.T) {
+	rules := FolderRules{Root: "Migrated/old@example.com/"}
+	courier := Namespaces{Personal: []string{"INBOX."}}
+	names := rules.MapNamespaces([]string{"INBOX", "Work/Clients"}, "/", ".", Namespaces{}, courier)
+	for folder, expected := range map[string]string{"INBOX": "INBOX.Migrated.old@example_com.INBOX", "Work/Clients": "INBOX.Migrated.old@example_com.Work.Clients"} {
+		if names[folder] != expected {
+			t.Errorf("expected %s to be %s, got %s", folder, expected, names[folder])
+		}
+	}
+	if name := translateFolder("Work/Clients", rules.Root, "/", "/", Namespaces{}, Namespaces{}); name != "Migrated/old@example.com/Work/Clients" {
+		t.Errorf("unexpected translated name: %s", name)
+	}
+
+	// routed messages and INBOX-only syncs go under it too
+	for folder, expected := range map[string]string{"INBOX": "Migrated.old@example_com.INBOX", "Finance.Invoices": "Migrated.old@example_com.Finance.Invoices"} {
+		if name := underRoot(rules.Root, folder, "."); name != expected {
+			t.Errorf("expected %s to be %s, got %s", folder, expected, name)
+		}
+	}
+	if name := underRoot("", "Finance.Invoices", "."); name != "Finance.Invoices" {
+		t.Errorf("expected no root to leave the folder alone, got %s", name)
+	}
+
+	// the root's levels count toward the depth
+	rules.MaxDepth = 3
+	if name := rules.Sanitize("Work/Clients", "/", "/"); name != "Migrated/old@example.com/Work - Clients" {
+		t.Errorf("unexpected flattened name: %s", name)
+	}
+}
+
+func TestFolderRulesFor(t *testing.T) {
+	if rules := FolderRulesFor("imap.mail.yahoo.com:993"); rules.MaxDepth != 2 {
+		t.Errorf("expected Yahoo's rules, got %+v", rules)
+	}
+
+	FolderLimits = FolderRules{MaxLength: 20}
+	defer func() { FolderLimits = FolderRules{} }()
+	if rules := FolderRulesFor("imap.example.com:993"); rules.MaxDepth != 0 || rules.MaxLength != 20 {
+		t.Errorf("expected only the folder limits, got %+v", rules)
+	}
+}
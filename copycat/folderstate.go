@@ -0,0 +1,163 @@
+package copycat
+
+import (
+	"fmt"
+	"log"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// SkipUnchanged will have SyncFolders skip folders whose STATUS in the source and
+// every destination is the same as when they were last synced.
+var SkipUnchanged bool
+
+// FolderStatus is what STATUS says about a folder. It changes whenever a message
+// is added or removed (or, with CONDSTORE, its flags change).
+type FolderStatus struct {
+	Messages      uint32
+	UIDNext       uint32
+	UIDValidity   uint32
+	HighestModSeq string
+}
+
+// GetFolderStatus asks the server for the STATUS of a folder that isn't selected.
+func GetFolderStatus(conn *imap.Client, folder string) (FolderStatus, error) {
+	items := []string{"MESSAGES", "UIDNEXT", "UIDVALIDITY"}
+	if conn.Caps["CONDSTORE"] {
+		items = append(items, "HIGHESTMODSEQ")
+	}
+	cmd, err := imap.Wait(conn.Status(folder, items...))
+	if err != nil {
+		return FolderStatus{}, err
+	}
+
+	var status FolderStatus
+	for _, rsp := range cmd.Data {
+		mailbox := rsp.MailboxStatus()
+		if mailbox == nil {
+			continue
+		}
+		status.Messages, status.UIDNext, status.UIDValidity = mailbox.Messages, mailbox.UIDNext, mailbox.UIDValidity
+		// HIGHESTMODSEQ is 64 bits, so it's kept as it was sent
+		if len(rsp.Fields) == 3 {
+			fields := imap.AsList(rsp.Fields[2])
+			for i := 0; i+1 < len(fields); i += 2 {
+				if imap.AsAtom(fields[i]) == "HIGHESTMODSEQ" {
+					status.HighestModSeq = fmt.Sprint(fields[i+1])
+				}
+			}
+		}
+	}
+	return status, nil
+}
+
+// folderState is the STATUS of a folder in the source and each destination (by user) after it was last synced.
+type folderState struct {
+	Source FolderStatus
+	Dest   map[string]FolderStatus
+	// Names is the folder's name in each destination and Sample the Message-Ids of its
+	// first messages, for detectRenames.
+	Names  map[string]string
+	Sample []string
+}
+
+func folderStateKey(src InboxInfo, folder string) string {
+	// Message-Ids are the only other keys and never look like this
+	return "folder-state\x00" + src.User + "\x00" + src.Host + "\x00" + folder
+}
+
+func (c *Cache) getFolderState(key string) (folderState, error) {
+	var state folderState
+	raw, err := c.db.Get([]byte(key), nil)
+	if err != nil {
+		return state, err
+	}
+	return state, deserialize(raw, &state)
+}
+
+func (c *Cache) putFolderState(key string, state folderState) error {
+	raw, err := serialize(state)
+	if err != nil {
+		return err
+	}
+	return c.db.Put([]byte(key), raw, nil)
+}
+
+// destStatus gets the STATUS of the folder in each destination using the control connections.
+func destStatus(controlConns conns, folder string, dstFolders map[string]map[string]string) (map[string]FolderStatus, error) {
+	statuses := make(map[string]FolderStatus)
+	for user, dst := range controlConns.Dest {
+		status, err := GetFolderStatus(dst[0], dstFolders[user][folder])
+		if err != nil {
+			return nil, err
+		}
+		statuses[user] = status
+	}
+	return statuses, nil
+}
+
+// changedFolders returns the folders that have changed in the source or a destination
+// since they were last synced, along with the source STATUS of each.
+func changedFolders(controlConns conns, src InboxInfo, folders []string, dstFolders map[string]map[string]string, cache *Cache) ([]string, map[string]FolderStatus) {
+	var changed []string
+	srcStatus := make(map[string]FolderStatus)
+	for _, folder := range folders {
+		status, err := GetFolderStatus(controlConns.Source[0], folder)
+		if err != nil {
+			log.Printf("Unable to get the status of folder %s: %s", folder, err.Error())
+			changed = append(changed, folder)
+			continue
+		}
+		srcStatus[folder] = status
+
+		last, err := cache.getFolderState(folderStateKey(src, folder))
+		if err == nil && last.Source == status {
+			dst, err := destStatus(controlConns, folder, dstFolders)
+			if err == nil && sameStatus(last.Dest, dst) {
+				log.Printf("folder %s is unchanged since it was last synced. skipping", folder)
+				Stats.Add("folders_unchanged", 1)
+				continue
+			}
+		}
+		changed = append(changed, folder)
+	}
+	return changed, srcStatus
+}
+
+// saveFolderStates records the source STATUS from before each folder was synced along with
+// the destinations' STATUS now. Anything that arrived in the source during the sync will
+// change its STATUS, so the folder won't be skipped next time.
+func saveFolderStates(controlConns conns, src InboxInfo, srcStatus map[string]FolderStatus, dstFolders map[string]map[string]string, cache *Cache) {
+	for folder, status := range srcStatus {
+		dst, err := destStatus(controlConns, folder, dstFolders)
+		if err != nil {
+			log.Printf("Unable to get the status of folder %s in the destinations: %s", folder, err.Error())
+			continue
+		}
+		names := make(map[string]string)
+		for user := range dst {
+			names[user] = dstFolders[user][folder]
+		}
+		sample, err := folderSample(controlConns.Source[0], folder)
+		if err != nil {
+			log.Printf("Unable to sample folder %s, so a rename of it won't be noticed: %s", folder, err.Error())
+		}
+		if err = cache.putFolderState(folderStateKey(src, folder), folderState{Source: status, Dest: dst, Names: names, Sample: sample}); err != nil {
+			log.Printf("Unable to save the state of folder %s: %s", folder, err.Error())
+			continue
+		}
+		emit(Event{Kind: CheckpointWritten, Folder: folder, Count: int(status.Messages)})
+	}
+}
+
+func sameStatus(a map[string]FolderStatus, b map[string]FolderStatus) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for user, status := range a {
+		if other, exists := b[user]; !exists || other != status {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package copycat
+
+import (
+	"log"
+	"path"
+	"strings"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// sentFolders are the usual names of a sent folder, without any parent folders.
+var sentFolders = map[string]bool{
+	"sent":          true,
+	"sent items":    true,
+	"sent mail":     true,
+	"sent messages": true,
+}
+
+// isGmail reports if the server is Gmail, which keeps every message in All Mail
+// and treats folders as labels on them.
+func isGmail(conn *imap.Client) bool {
+	return conn.Caps["X-GM-EXT-1"]
+}
+
+// isSentFolder guesses if a folder holds sent messages from its name.
+func isSentFolder(name string) bool {
+	name = strings.Replace(name, ".", "/", -1)
+	return sentFolders[strings.ToLower(path.Base(name))]
+}
+
+// gmailAllMail returns the name of the All Mail folder if the conn is a Gmail
+// destination with a sent folder selected. Gmail files a copy of everything sent
+// through it in All Mail, so a sent message copied from another server may
+// already be there without being in the folder.
+func gmailAllMail(conn *imap.Client) string {
+	if !isGmail(conn) || conn.Mailbox == nil || !isSentFolder(conn.Mailbox.Name) {
+		return ""
+	}
+
+	cmd, err := imap.Wait(conn.List("", "*"))
+	if err != nil {
+		log.Printf("Unable to find the Gmail All Mail folder: %s", err.Error())
+		return ""
+	}
+	for _, rsp := range cmd.Data {
+		if info := rsp.MailboxInfo(); info != nil && info.Attrs[`\All`] {
+			return info.Name
+		}
+	}
+	return ""
+}
+
+// gmailSentDedup looks for the missing messages in All Mail by Message-Id. Any that
+// are found get the selected folder added as a label with a COPY instead of being
+// appended again. It returns the messages that are still missing. The folder is
+// selected again before returning; if that fails, the conn can't be appended to.
+func gmailSentDedup(conn *imap.Client, allMail string, missing []WorkRequest) ([]WorkRequest, error) {
+	folder := conn.Mailbox.Name
+	if _, err := imap.Wait(conn.Select(allMail, true)); err != nil {
+		log.Printf("Unable to select %s to look for sent messages: %s", allMail, err.Error())
+		_, err = imap.Wait(conn.Select(folder, false))
+		return missing, err
+	}
+
+	// X-GM-RAW uses Gmail's own index, which is much faster than a HEADER search of All Mail
+	cmds := make([]*imap.Command, len(missing))
+	errs := make([]error, len(missing))
+	for i, request := range missing {
+		cmds[i], errs[i] = conn.UIDSearch("X-GM-RAW", conn.Quote("rfc822msgid:"+strings.Trim(request.Value, "<> ")))
+	}
+
+	found, _ := imap.NewSeqSet("")
+	var stillMissing []WorkRequest
+	var labeled int
+	for i, request := range missing {
+		cmd, err := imap.Wait(cmds[i], errs[i])
+		if err != nil || len(cmd.Data) == 0 || len(cmd.Data[0].SearchResults()) == 0 {
+			stillMissing = append(stillMissing, request)
+			continue
+		}
+		found.AddNum(cmd.Data[0].SearchResults()[0])
+		labeled++
+	}
+
+	if labeled > 0 {
+		if _, err := imap.Wait(conn.UIDCopy(found, folder)); err != nil {
+			log.Printf("Unable to label %d sent messages already in %s: %s", labeled, allMail, err.Error())
+			stillMissing = missing
+		} else {
+			Stats.Add("gmail_labeled", int64(labeled))
+		}
+	}
+
+	_, err := imap.Wait(conn.Select(folder, false))
+	return stillMissing, err
+}
@@ -0,0 +1,83 @@
+package copycat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// GPGCommand is the gpg program that's run to encrypt and decrypt messages.
+var GPGCommand = "gpg"
+
+// EncryptedSink encrypts each message to one or more OpenPGP recipients
+// before handing it to the wrapped Sink. Encryption is done by gpg, so the
+// recipients' public keys need to be in the user's keyring. The digest and size
+// of the message before it was encrypted are handed on too, for an ArchiveSink's
+// manifest.
+type EncryptedSink struct {
+	Sink
+	Recipients []string
+}
+
+func (e *EncryptedSink) Put(folder string, messageId string, msg MessageData) error {
+	encrypted, err := GPGEncrypt(e.Recipients, msg.Body)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(msg.Body)
+	msg.plainSHA256, msg.plainSize = hex.EncodeToString(sum[:]), len(msg.Body)
+	msg.Body = encrypted
+	return e.Sink.Put(folder, messageId, msg)
+}
+
+// GPGEncrypt will encrypt the data to each of the recipients. Keys aren't checked against
+// the web of trust (archives are encrypted unattended, to keys nobody has signed), so a
+// recipient has to be a key's full fingerprint: a name or email address could pick up
+// any key with a matching user id that made it into the keyring.
+func GPGEncrypt(recipients []string, data []byte) ([]byte, error) {
+	args := []string{"--batch", "--quiet", "--yes", "--trust-model", "always", "--encrypt"}
+	for _, recipient := range recipients {
+		fingerprint, err := GPGFingerprint(recipient)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--recipient", fingerprint)
+	}
+	return runGPG(args, data)
+}
+
+// GPGFingerprint returns the recipient as a full key fingerprint (40 hex digits, or 64
+// for v5 keys), without spaces or a 0x in front, or an error if it isn't one.
+func GPGFingerprint(recipient string) (string, error) {
+	fingerprint := strings.ToUpper(strings.Replace(strings.TrimSpace(recipient), " ", "", -1))
+	fingerprint = strings.TrimPrefix(fingerprint, "0X")
+	if len(fingerprint) != 40 && len(fingerprint) != 64 {
+		return "", fmt.Errorf("gpg recipient %q isn't a full key fingerprint", recipient)
+	}
+	for _, c := range fingerprint {
+		if !strings.ContainsRune("0123456789ABCDEF", c) {
+			return "", fmt.Errorf("gpg recipient %q isn't a full key fingerprint", recipient)
+		}
+	}
+	return fingerprint, nil
+}
+
+// GPGDecrypt will decrypt the data with whatever secret key gpg has available.
+func GPGDecrypt(data []byte) ([]byte, error) {
+	return runGPG([]string{"--batch", "--quiet", "--decrypt"}, data)
+}
+
+func runGPG(args []string, data []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(GPGCommand, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("gpg failed: %s (%s)", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,630 @@
+package copycat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how many folders or messages to ask Graph for at a time
+	graphPageSize = 500
+	// how many times a throttled request is retried before giving up
+	graphRetries = 5
+)
+
+// GraphClient calls the Microsoft Graph API for a Microsoft 365 tenant with an app's
+// client credentials. The app needs the Mail.ReadWrite application permission. Graph
+// has its own throttling, separate from (and much more generous than) IMAP's, and
+// throttled requests are retried after the wait Graph asks for.
+type GraphClient struct {
+	Tenant   string
+	ClientID string
+	Secret   string
+	// BaseURL and TokenURL are only changed for testing.
+	BaseURL  string
+	TokenURL string
+	Client   *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewGraphClient creates a GraphClient for the tenant (ex. contoso.onmicrosoft.com or its id).
+func NewGraphClient(tenant string, clientID string, secret string) (*GraphClient, error) {
+	if len(tenant) == 0 || len(clientID) == 0 || len(secret) == 0 {
+		return nil, fmt.Errorf("tenant, client id and secret are required")
+	}
+	return &GraphClient{
+		Tenant:   tenant,
+		ClientID: clientID,
+		Secret:   secret,
+		BaseURL:  "https://graph.microsoft.com/v1.0",
+		TokenURL: "https://login.microsoftonline.com/" + url.PathEscape(tenant) + "/oauth2/v2.0/token",
+		Client:   &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// accessToken returns the app's token, getting a new one when it's about to expire.
+func (g *GraphClient) accessToken() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.token) > 0 && time.Now().Before(g.expires) {
+		return g.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {g.ClientID},
+		"client_secret": {g.Secret},
+		"scope":         {"https://graph.microsoft.com/.default"},
+	}
+	rsp, err := g.Client.PostForm(g.TokenURL, form)
+	if err != nil {
+		return "", &Error{Kind: ErrConnLost, Op: "graph login", Account: g.ClientID, Err: err}
+	}
+	defer rsp.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Description string `json:"error_description"`
+	}
+	if err = json.NewDecoder(rsp.Body).Decode(&token); err != nil || rsp.StatusCode != http.StatusOK {
+		if err == nil {
+			err = fmt.Errorf("%s: %s", rsp.Status, token.Description)
+		}
+		return "", &Error{Kind: ErrAuth, Op: "graph login", Account: g.ClientID, Err: err}
+	}
+	g.token = token.AccessToken
+	// renew a minute early so a token doesn't expire mid request
+	g.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return g.token, nil
+}
+
+// do sends the request to the path under BaseURL (or to a full URL, like a next page
+// link) and returns the response body. Throttled requests are retried.
+func (g *GraphClient) do(method string, path string, contentType string, body []byte) ([]byte, error) {
+	target := path
+	if !strings.HasPrefix(path, "http") {
+		target = g.BaseURL + path
+	}
+	for attempt := 0; ; attempt++ {
+		token, err := g.accessToken()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if len(contentType) > 0 {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		rsp, err := g.Client.Do(req)
+		if err != nil {
+			return nil, &Error{Kind: ErrConnLost, Op: method + " " + path, Err: err}
+		}
+		data, err := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if err != nil {
+			return nil, &Error{Kind: ErrConnLost, Op: method + " " + path, Err: err}
+		}
+
+		switch {
+		case rsp.StatusCode >= 200 && rsp.StatusCode < 300:
+			return data, nil
+		case (rsp.StatusCode == http.StatusTooManyRequests || rsp.StatusCode == http.StatusServiceUnavailable) && attempt < graphRetries:
+			wait, _ := strconv.Atoi(rsp.Header.Get("Retry-After"))
+			if wait <= 0 {
+				wait = 1 << uint(attempt)
+			}
+			log.Printf("graph is throttling requests, retrying in %ds", wait)
+			time.Sleep(time.Duration(wait) * time.Second)
+			continue
+		}
+
+		var failed struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(data, &failed)
+		err = fmt.Errorf("%s: %s %s", rsp.Status, failed.Error.Code, failed.Error.Message)
+		switch rsp.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return nil, &Error{Kind: ErrAuth, Op: method + " " + path, Err: err}
+		case http.StatusNotFound:
+			return nil, NotFound
+		case http.StatusTooManyRequests:
+			return nil, &Error{Kind: ErrThrottled, Op: method + " " + path, Err: err}
+		}
+		return nil, &Error{Op: method + " " + path, Err: err}
+	}
+}
+
+// getJSON decodes the response to a GET into v.
+func (g *GraphClient) getJSON(path string, v interface{}) error {
+	data, err := g.do("GET", path, "", nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+type graphFolder struct {
+	Id               string `json:"id"`
+	DisplayName      string `json:"displayName"`
+	ChildFolderCount int    `json:"childFolderCount"`
+}
+
+// folderPages gets every folder listed at path, following the next page links.
+func (g *GraphClient) folderPages(path string) ([]graphFolder, error) {
+	var folders []graphFolder
+	for len(path) > 0 {
+		var page struct {
+			Value []graphFolder `json:"value"`
+			Next  string        `json:"@odata.nextLink"`
+		}
+		if err := g.getJSON(path, &page); err != nil {
+			return nil, err
+		}
+		folders = append(folders, page.Value...)
+		path = page.Next
+	}
+	return folders, nil
+}
+
+func graphUser(user string) string {
+	return "/users/" + url.PathEscape(user)
+}
+
+// GraphSource is a MessageSource that reads a Microsoft 365 mailbox with Graph. Every
+// mail folder is listed with its path (the Inbox and its subfolders are under INBOX) and
+// messages are downloaded as MIME with their read state as \Seen, follow up flag as
+// \Flagged and categories as keywords.
+type GraphSource struct {
+	Graph *GraphClient
+	User  string
+}
+
+// NewGraphSource creates a GraphSource for the user's mailbox.
+func NewGraphSource(graph *GraphClient, user string) *GraphSource {
+	return &GraphSource{Graph: graph, User: user}
+}
+
+// folders returns the path of every mail folder by its id.
+func (s *GraphSource) folders() (map[string]string, error) {
+	var inbox graphFolder
+	if err := s.Graph.getJSON(graphUser(s.User)+"/mailFolders/inbox", &inbox); err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]string)
+	var walk func(path string, parent string) error
+	walk = func(path string, parent string) error {
+		folders, err := s.Graph.folderPages(fmt.Sprintf("%s?$top=%d", path, graphPageSize))
+		if err != nil {
+			return err
+		}
+		for _, folder := range folders {
+			name := strings.Replace(folder.DisplayName, "/", "_", -1)
+			if folder.Id == inbox.Id {
+				name = "INBOX"
+			}
+			if len(parent) > 0 {
+				name = parent + "/" + name
+			}
+			paths[folder.Id] = name
+			if folder.ChildFolderCount > 0 {
+				if err = walk(graphUser(s.User)+"/mailFolders/"+url.PathEscape(folder.Id)+"/childFolders", name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(graphUser(s.User)+"/mailFolders", ""); err != nil {
+		return nil, err
+	}
+	// in case the inbox wasn't listed with the rest
+	paths[inbox.Id] = "INBOX"
+	return paths, nil
+}
+
+func (s *GraphSource) List() ([]SourceMessage, error) {
+	paths, err := s.folders()
+	if err != nil {
+		return nil, err
+	}
+
+	// import the folders in order, parents first
+	var ids []string
+	for id := range paths {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return paths[ids[i]] < paths[ids[j]] })
+
+	var msgs []SourceMessage
+	for _, id := range ids {
+		next := fmt.Sprintf("%s/mailFolders/%s/messages?$select=internetMessageId&$top=%d", graphUser(s.User), url.PathEscape(id), graphPageSize)
+		for len(next) > 0 {
+			var page struct {
+				Value []struct {
+					Id        string `json:"id"`
+					MessageId string `json:"internetMessageId"`
+				} `json:"value"`
+				Next string `json:"@odata.nextLink"`
+			}
+			if err = s.Graph.getJSON(next, &page); err != nil {
+				return nil, fmt.Errorf("listing %s: %s", paths[id], err.Error())
+			}
+			for _, msg := range page.Value {
+				msgs = append(msgs, SourceMessage{Folder: paths[id], MessageId: msg.MessageId, Key: msg.Id})
+			}
+			next = page.Next
+		}
+	}
+	return msgs, nil
+}
+
+// graphMessage is the state of a message that's kept as its flags.
+type graphMessage struct {
+	IsRead     bool     `json:"isRead"`
+	Received   string   `json:"receivedDateTime,omitempty"`
+	Categories []string `json:"categories"`
+	Flag       struct {
+		Status string `json:"flagStatus"`
+	} `json:"flag"`
+}
+
+func (s *GraphSource) Fetch(msg SourceMessage) (MessageData, error) {
+	path := graphUser(s.User) + "/messages/" + url.PathEscape(msg.Key)
+	var state graphMessage
+	if err := s.Graph.getJSON(path+"?$select=isRead,receivedDateTime,categories,flag", &state); err != nil {
+		return MessageData{}, err
+	}
+	body, err := s.Graph.do("GET", path+"/$value", "", nil)
+	if err != nil {
+		return MessageData{}, err
+	}
+
+	data := MessageData{Body: body}
+	data.InternalDate, _ = time.Parse(time.RFC3339, state.Received)
+	if state.IsRead {
+		data.Flags = append(data.Flags, `\Seen`)
+	}
+	if state.Flag.Status == "flagged" {
+		data.Flags = append(data.Flags, `\Flagged`)
+	}
+	for _, category := range state.Categories {
+		data.Flags = append(data.Flags, categoryKeyword(category))
+	}
+	return data, nil
+}
+
+func (s *GraphSource) Close() error {
+	return nil
+}
+
+// categoryKeyword turns an Exchange category into an IMAP keyword, which is an atom
+// so it can't have spaces.
+func categoryKeyword(category string) string {
+	return strings.Map(func(c rune) rune {
+		if strings.ContainsRune(` (){%*"\]`, c) {
+			return '_'
+		}
+		return c
+	}, category)
+}
+
+// GraphSink is a Sink that uploads messages into a Microsoft 365 mailbox with Graph.
+// Folders are created as needed, with INBOX going to the Inbox. Messages are created
+// from their MIME parts with their read state, follow up flag and keywords (as
+// categories), and marked as sent so Exchange doesn't keep them as drafts.
+type GraphSink struct {
+	Graph *GraphClient
+	User  string
+
+	mu sync.Mutex
+	// folder path -> id
+	folders map[string]string
+}
+
+// NewGraphSink creates a GraphSink for the user's mailbox.
+func NewGraphSink(graph *GraphClient, user string) *GraphSink {
+	return &GraphSink{Graph: graph, User: user, folders: make(map[string]string)}
+}
+
+// folderId returns the id of the folder at the path, creating it and its parents if needed.
+func (s *GraphSink) folderId(folder string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var id, path string
+	for _, name := range strings.Split(strings.Trim(folder, "/"), "/") {
+		if len(path) > 0 {
+			path += "/"
+		}
+		path += name
+		if known, exists := s.folders[path]; exists {
+			id = known
+			continue
+		}
+
+		parent := graphUser(s.User) + "/mailFolders"
+		if len(id) > 0 {
+			parent += "/" + url.PathEscape(id) + "/childFolders"
+		}
+		if len(id) == 0 && strings.EqualFold(name, "INBOX") {
+			var inbox graphFolder
+			if err := s.Graph.getJSON(parent+"/inbox", &inbox); err != nil {
+				return "", err
+			}
+			id = inbox.Id
+		} else {
+			var err error
+			if id, err = s.childFolder(parent, name); err != nil {
+				return "", err
+			}
+		}
+		s.folders[path] = id
+	}
+	return id, nil
+}
+
+// childFolder finds the folder with the name under parent or creates it.
+func (s *GraphSink) childFolder(parent string, name string) (string, error) {
+	filter := url.QueryEscape("displayName eq '" + strings.Replace(name, "'", "''", -1) + "'")
+	var found struct {
+		Value []graphFolder `json:"value"`
+	}
+	if err := s.Graph.getJSON(parent+"?$filter="+filter, &found); err != nil {
+		return "", err
+	}
+	if len(found.Value) > 0 {
+		return found.Value[0].Id, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"displayName": name})
+	data, err := s.Graph.do("POST", parent, "application/json", body)
+	if err != nil {
+		return "", err
+	}
+	var created graphFolder
+	if err = json.Unmarshal(data, &created); err != nil {
+		return "", err
+	}
+	return created.Id, nil
+}
+
+func (s *GraphSink) Has(folder string, messageId string) (bool, error) {
+	id, err := s.folderId(folder)
+	if err != nil {
+		return false, err
+	}
+	filter := url.QueryEscape("internetMessageId eq '" + strings.Replace(messageId, "'", "''", -1) + "'")
+	var found struct {
+		Value []struct {
+			Id string `json:"id"`
+		} `json:"value"`
+	}
+	err = s.Graph.getJSON(fmt.Sprintf("%s/mailFolders/%s/messages?$select=id&$top=1&$filter=%s", graphUser(s.User), url.PathEscape(id), filter), &found)
+	return len(found.Value) > 0, err
+}
+
+func (s *GraphSink) Put(folder string, messageId string, msg MessageData) error {
+	id, err := s.folderId(folder)
+	if err != nil {
+		return err
+	}
+	created, err := newGraphMessage(msg)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(created)
+	if err != nil {
+		return err
+	}
+	_, err = s.Graph.do("POST", graphUser(s.User)+"/mailFolders/"+url.PathEscape(id)+"/messages", "application/json", body)
+	return err
+}
+
+// the MAPI properties set on the messages a GraphSink creates
+const (
+	graphMessageFlags  = "Integer 0x0E07"    // PR_MESSAGE_FLAGS
+	graphDeliveryTime  = "SystemTime 0x0E06" // PR_MESSAGE_DELIVERY_TIME
+	graphSubmitTime    = "SystemTime 0x0039" // PR_CLIENT_SUBMIT_TIME
+	graphMessageIsRead = "1"                 // MSGFLAG_READ, and not MSGFLAG_UNSENT
+)
+
+// graphNewMessage is a message as Graph creates it from JSON. Unlike a MIME upload this
+// can set PR_MESSAGE_FLAGS, which is the only way to keep Exchange from treating a
+// created message as a draft.
+type graphNewMessage struct {
+	Subject           string              `json:"subject"`
+	Body              graphBody           `json:"body"`
+	From              *graphRecipient     `json:"from,omitempty"`
+	To                []graphRecipient    `json:"toRecipients,omitempty"`
+	Cc                []graphRecipient    `json:"ccRecipients,omitempty"`
+	Bcc               []graphRecipient    `json:"bccRecipients,omitempty"`
+	ReplyTo           []graphRecipient    `json:"replyTo,omitempty"`
+	InternetMessageId string              `json:"internetMessageId,omitempty"`
+	IsRead            bool                `json:"isRead"`
+	Categories        []string            `json:"categories"`
+	Flag              graphFlag           `json:"flag"`
+	Attachments       []graphAttachment   `json:"attachments,omitempty"`
+	Properties        []graphMAPIProperty `json:"singleValueExtendedProperties"`
+}
+
+type graphBody struct {
+	ContentType string `json:"contentType"`
+	Content     string `json:"content"`
+}
+
+type graphRecipient struct {
+	EmailAddress struct {
+		Name    string `json:"name,omitempty"`
+		Address string `json:"address"`
+	} `json:"emailAddress"`
+}
+
+type graphFlag struct {
+	Status string `json:"flagStatus"`
+}
+
+type graphAttachment struct {
+	Type         string `json:"@odata.type"`
+	Name         string `json:"name"`
+	ContentType  string `json:"contentType,omitempty"`
+	ContentId    string `json:"contentId,omitempty"`
+	IsInline     bool   `json:"isInline"`
+	ContentBytes []byte `json:"contentBytes"`
+}
+
+type graphMAPIProperty struct {
+	Id    string `json:"id"`
+	Value string `json:"value"`
+}
+
+// newGraphMessage turns a MIME message into one Graph can create, with its read state,
+// follow up flag and keywords (as categories), and its dates kept in the MAPI properties
+// Graph won't set otherwise.
+func newGraphMessage(msg MessageData) (*graphNewMessage, error) {
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg.Body))
+	if err != nil {
+		return nil, err
+	}
+	header := textproto.MIMEHeader(parsed.Header)
+	decoder := new(mime.WordDecoder)
+	m := &graphNewMessage{Categories: []string{}, Flag: graphFlag{Status: "notFlagged"}}
+	if m.Subject, err = decoder.DecodeHeader(header.Get("Subject")); err != nil {
+		m.Subject = header.Get("Subject")
+	}
+	if from := graphRecipients(parsed.Header, "From"); len(from) > 0 {
+		m.From = &from[0]
+	}
+	m.To = graphRecipients(parsed.Header, "To")
+	m.Cc = graphRecipients(parsed.Header, "Cc")
+	m.Bcc = graphRecipients(parsed.Header, "Bcc")
+	m.ReplyTo = graphRecipients(parsed.Header, "Reply-To")
+	m.InternetMessageId = strings.TrimSpace(header.Get("Message-Id"))
+	m.addPart(header, parsed.Body)
+	if len(m.Body.ContentType) == 0 {
+		m.Body.ContentType = "text"
+	}
+
+	flags := "0"
+	for _, flag := range msg.Flags {
+		switch {
+		case strings.EqualFold(flag, `\Seen`):
+			m.IsRead = true
+			flags = graphMessageIsRead
+		case strings.EqualFold(flag, `\Flagged`):
+			m.Flag.Status = "flagged"
+		case !strings.HasPrefix(flag, `\`):
+			m.Categories = append(m.Categories, flag)
+		}
+	}
+	m.Properties = append(m.Properties, graphMAPIProperty{graphMessageFlags, flags})
+	if !msg.InternalDate.IsZero() {
+		m.Properties = append(m.Properties, graphMAPIProperty{graphDeliveryTime, msg.InternalDate.UTC().Format(time.RFC3339)})
+	}
+	if sent, err := parsed.Header.Date(); err == nil {
+		m.Properties = append(m.Properties, graphMAPIProperty{graphSubmitTime, sent.UTC().Format(time.RFC3339)})
+	}
+	return m, nil
+}
+
+func graphRecipients(header mail.Header, name string) []graphRecipient {
+	addresses, err := header.AddressList(name)
+	if err != nil {
+		return nil
+	}
+	recipients := make([]graphRecipient, len(addresses))
+	for i, address := range addresses {
+		recipients[i].EmailAddress.Name = address.Name
+		recipients[i].EmailAddress.Address = address.Address
+	}
+	return recipients
+}
+
+// addPart walks the MIME parts, using the first HTML part (or else the first plain text
+// part) that isn't an attachment as the body and attaching everything else.
+func (m *graphNewMessage) addPart(header textproto.MIMEHeader, body io.Reader) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			m.addPart(part.Header, part)
+		}
+		return
+	}
+
+	content, _ := ioutil.ReadAll(body)
+	// multipart.Part has already decoded quoted-printable and removed the header
+	if data, err := decodeContent(header.Get("Content-Transfer-Encoding"), content); err == nil {
+		content = data
+	}
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	name := dispositionParams["filename"]
+	if len(name) == 0 {
+		name = params["name"]
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+
+	if len(name) == 0 && disposition != "attachment" {
+		switch {
+		case mediaType == "text/html" && m.Body.ContentType != "html":
+			m.Body = graphBody{ContentType: "html", Content: toUTF8(content)}
+			return
+		case mediaType == "text/plain" && len(m.Body.ContentType) == 0:
+			m.Body = graphBody{ContentType: "text", Content: toUTF8(content)}
+			return
+		}
+	}
+	if len(name) == 0 {
+		name = "attachment"
+		if mediaType == "message/rfc822" {
+			name = "message.eml"
+		}
+	}
+	m.Attachments = append(m.Attachments, graphAttachment{
+		Type:         "#microsoft.graph.fileAttachment",
+		Name:         name,
+		ContentType:  mediaType,
+		ContentId:    strings.Trim(header.Get("Content-Id"), "<>"),
+		IsInline:     disposition == "inline",
+		ContentBytes: content,
+	})
+}
+
+func (s *GraphSink) Close() error {
+	return nil
+}
@@ -0,0 +1,167 @@
+package copycat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestGraph(t *testing.T, handler http.HandlerFunc) (*GraphClient, *httptest.Server) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			r.ParseForm()
+			if r.Form.Get("client_secret") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, `{"error_description":"bad secret"}`)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"abc","expires_in":3600}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}))
+
+	graph, err := NewGraphClient("contoso.onmicrosoft.com", "app", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.BaseURL = server.URL
+	graph.TokenURL = server.URL + "/token"
+	return graph, server
+}
+
+func TestGraphSource(t *testing.T) {
+	raw := "Message-Id: <1@example.com>\r\nSubject: hi\r\n\r\nhello\r\n"
+	throttled := false
+	graph, server := newTestGraph(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/fred@example.com/mailFolders/inbox":
+			fmt.Fprint(w, `{"id":"inbox-id"}`)
+		case "/users/fred@example.com/mailFolders":
+			fmt.Fprint(w, `{"value":[{"id":"inbox-id","displayName":"Inbox","childFolderCount":1},{"id":"projects","displayName":"Projects 1/2"}]}`)
+		case "/users/fred@example.com/mailFolders/inbox-id/childFolders":
+			fmt.Fprint(w, `{"value":[{"id":"clients","displayName":"Clients"}]}`)
+		case "/users/fred@example.com/mailFolders/clients/messages":
+			fmt.Fprint(w, `{"value":[{"id":"m1","internetMessageId":"<1@example.com>"}]}`)
+		case "/users/fred@example.com/mailFolders/inbox-id/messages", "/users/fred@example.com/mailFolders/projects/messages":
+			fmt.Fprint(w, `{"value":[]}`)
+		case "/users/fred@example.com/messages/m1":
+			fmt.Fprint(w, `{"isRead":true,"receivedDateTime":"2014-03-01T10:00:00Z","categories":["Red category"],"flag":{"flagStatus":"flagged"}}`)
+		case "/users/fred@example.com/messages/m1/$value":
+			// make sure throttled requests are retried
+			if !throttled {
+				throttled = true
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			fmt.Fprint(w, raw)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer server.Close()
+
+	source := NewGraphSource(graph, "fred@example.com")
+	msgs, err := source.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SourceMessage{{Folder: "INBOX/Clients", MessageId: "<1@example.com>", Key: "m1"}}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Fatalf("expected %v, got %v", want, msgs)
+	}
+
+	data, err := source.Fetch(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data.Body) != raw {
+		t.Errorf("unexpected body %q", data.Body)
+	}
+	if flags := []string{`\Seen`, `\Flagged`, "Red_category"}; !reflect.DeepEqual(data.Flags, flags) {
+		t.Errorf("expected flags %v, got %v", flags, data.Flags)
+	}
+	if data.InternalDate.Year() != 2014 {
+		t.Errorf("unexpected internal date %s", data.InternalDate)
+	}
+
+	graph.Secret, graph.token = "wrong", ""
+	if _, err = source.List(); !strings.Contains(err.Error(), "bad secret") {
+		t.Errorf("expected a login error, got %v", err)
+	}
+}
+
+func TestGraphSink(t *testing.T) {
+	raw := "Message-Id: <1@example.com>\r\nFrom: Wilma <wilma@example.com>\r\nTo: fred@example.com\r\nSubject: =?utf-8?q?h=C3=AF?=\r\n" +
+		"Date: Sat, 1 Mar 2014 10:00:00 +0000\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nhello\r\n" +
+		"--b\r\nContent-Type: application/pdf; name=notes.pdf\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERg==\r\n--b--\r\n"
+	var created []string
+	var uploaded graphNewMessage
+	graph, server := newTestGraph(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case r.URL.Path == "/users/fred@example.com/mailFolders/inbox":
+			fmt.Fprint(w, `{"id":"inbox-id"}`)
+		case r.URL.Path == "/users/fred@example.com/mailFolders/inbox-id/childFolders" && r.Method == "GET":
+			if r.URL.Query().Get("$filter") != "displayName eq 'Fred''s'" {
+				t.Errorf("unexpected filter %q", r.URL.Query().Get("$filter"))
+			}
+			fmt.Fprint(w, `{"value":[]}`)
+		case r.URL.Path == "/users/fred@example.com/mailFolders/inbox-id/childFolders" && r.Method == "POST":
+			created = append(created, string(body))
+			fmt.Fprint(w, `{"id":"freds"}`)
+		case r.URL.Path == "/users/fred@example.com/mailFolders/freds/messages" && r.Method == "GET":
+			fmt.Fprint(w, `{"value":[]}`)
+		case r.URL.Path == "/users/fred@example.com/mailFolders/freds/messages" && r.Method == "POST":
+			if err := json.Unmarshal(body, &uploaded); err != nil {
+				t.Errorf("expected a JSON message, got %s", body)
+			}
+			fmt.Fprint(w, `{"id":"m1"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer server.Close()
+
+	sink := NewGraphSink(graph, "fred@example.com")
+	has, err := sink.Has("INBOX/Fred's", "<1@example.com>")
+	if err != nil || has {
+		t.Fatalf("expected the message to be missing, got %v %v", has, err)
+	}
+	received := time.Date(2014, 3, 1, 10, 5, 0, 0, time.UTC)
+	if err = sink.Put("INBOX/Fred's", "<1@example.com>", MessageData{Body: []byte(raw), InternalDate: received, Flags: []string{`\Seen`, `\Answered`, "Work"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 || created[0] != `{"displayName":"Fred's"}` {
+		t.Errorf("expected the folder to be created once, got %v", created)
+	}
+	if uploaded.Subject != "hï" || uploaded.From.EmailAddress.Address != "wilma@example.com" || len(uploaded.To) != 1 || uploaded.InternetMessageId != "<1@example.com>" {
+		t.Errorf("unexpected headers %+v", uploaded)
+	}
+	if uploaded.Body.ContentType != "text" || uploaded.Body.Content != "hello" {
+		t.Errorf("unexpected body %+v", uploaded.Body)
+	}
+	if len(uploaded.Attachments) != 1 || uploaded.Attachments[0].Name != "notes.pdf" || string(uploaded.Attachments[0].ContentBytes) != "%PDF" {
+		t.Errorf("unexpected attachments %+v", uploaded.Attachments)
+	}
+	if !uploaded.IsRead || uploaded.Flag.Status != "notFlagged" || !reflect.DeepEqual(uploaded.Categories, []string{"Work"}) {
+		t.Errorf("unexpected message state %+v", uploaded)
+	}
+	// not a draft, and with its dates
+	want := []graphMAPIProperty{{graphMessageFlags, "1"}, {graphDeliveryTime, "2014-03-01T10:05:00Z"}, {graphSubmitTime, "2014-03-01T10:00:00Z"}}
+	if !reflect.DeepEqual(uploaded.Properties, want) {
+		t.Errorf("expected the properties %v, got %v", want, uploaded.Properties)
+	}
+}
@@ -0,0 +1,228 @@
+package copycat
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// What SyncFolders does with GroupwareFolders.
+const (
+	// GroupwareSync copies them like any other folder.
+	GroupwareSync = ""
+	// GroupwareSkip leaves them out and lists them in the run report.
+	GroupwareSkip = "skip"
+	// GroupwareExport leaves them out and writes their items to .ics and .vcf files in GroupwareDir.
+	GroupwareExport = "export"
+)
+
+// The kinds of groupware folders.
+const (
+	CalendarFolder = "calendar"
+	ContactsFolder = "contacts"
+	TasksFolder    = "tasks"
+)
+
+// GroupwareFolders is what SyncFolders does with the calendar, contacts and tasks folders
+// Exchange style servers show over IMAP, whose items look broken in mail clients.
+var GroupwareFolders = GroupwareSync
+
+// GroupwareDir is where GroupwareExport writes items, in a directory for each folder.
+var GroupwareDir = "groupware"
+
+// how many messages are looked at to decide if a folder is a groupware folder
+const groupwareSample = 10
+
+// itemKind classifies a message by its Content-Class, which Exchange sets on every
+// item, or by its Content-Type. Meeting invites (urn:content-classes:calendarmessage)
+// are mail, so they aren't groupware items.
+func itemKind(header mail.Header) string {
+	class := strings.ToLower(header.Get("Content-Class"))
+	switch {
+	case strings.HasPrefix(class, "urn:content-classes:appointment"):
+		return CalendarFolder
+	case strings.HasPrefix(class, "urn:content-classes:person"):
+		return ContactsFolder
+	case strings.HasPrefix(class, "urn:content-classes:task"):
+		return TasksFolder
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch mediaType {
+	case "text/calendar":
+		return CalendarFolder
+	case "text/vcard", "text/x-vcard", "text/directory":
+		return ContactsFolder
+	}
+	return ""
+}
+
+// groupwareKind looks at the first few messages of the folder and returns the kind of
+// groupware folder it is, if most of them are groupware items. The folder is left
+// selected.
+func groupwareKind(conn *imap.Client, folder string) (string, error) {
+	if _, err := imap.Wait(conn.Select(folder, true)); err != nil {
+		return "", err
+	}
+	if conn.Mailbox.Messages == 0 {
+		return "", nil
+	}
+
+	last := conn.Mailbox.Messages
+	if last > groupwareSample {
+		last = groupwareSample
+	}
+	seq, _ := imap.NewSeqSet("")
+	seq.AddRange(1, last)
+	cmd, err := imap.Wait(conn.Fetch(seq, "BODY.PEEK[HEADER.FIELDS (CONTENT-CLASS CONTENT-TYPE)]"))
+	if err != nil {
+		return "", err
+	}
+	kinds := make(map[string]int)
+	var sampled int
+	for _, rsp := range cmd.Data {
+		info := rsp.MessageInfo()
+		if info == nil {
+			continue
+		}
+		sampled++
+		if msg, err := mail.ReadMessage(bytes.NewReader(imap.AsBytes(info.Attrs["BODY[HEADER.FIELDS (CONTENT-CLASS CONTENT-TYPE)]"]))); err == nil {
+			kinds[itemKind(msg.Header)]++
+		}
+	}
+	for kind, count := range kinds {
+		if len(kind) > 0 && count*2 > sampled {
+			return kind, nil
+		}
+	}
+	return "", nil
+}
+
+// skipGroupware decides if the folder is a groupware folder that shouldn't be synced
+// and, with GroupwareExport, exports its items. The INBOX is selected again afterwards.
+func skipGroupware(conn *imap.Client, user string, folder string) bool {
+	defer imap.Wait(conn.Select("INBOX", true))
+
+	kind, err := groupwareKind(conn, folder)
+	if err != nil {
+		log.Printf("Unable to check if folder %s holds mail: %s. syncing it anyway", folder, err.Error())
+		return false
+	}
+	if len(kind) == 0 {
+		return false
+	}
+
+	action := "skipped"
+	if GroupwareFolders == GroupwareExport {
+		exported, err := exportGroupware(conn, filepath.Join(GroupwareDir, dirName(folder)))
+		action = fmt.Sprintf("%d item(s) exported", exported)
+		if err != nil {
+			log.Printf("Unable to export the items in %s: %s", folder, err.Error())
+			action += ", " + err.Error()
+		}
+	}
+	log.Printf("skipping %s folder %s: %s", kind, folder, action)
+	RunReport.Groupware(user, folder, kind, action)
+	return true
+}
+
+// dirName makes a folder name safe to use as the name of a directory.
+func dirName(folder string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, folder)
+}
+
+// exportGroupware writes the calendar or contact in each message in the folder selected
+// on conn to a file named for its UID in dir. Messages without one are left out.
+func exportGroupware(conn *imap.Client, dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	seq, _ := imap.NewSeqSet("")
+	seq.AddRange(1, 0)
+	cmd, err := conn.Fetch(seq, "UID", "BODY.PEEK[]")
+	if err != nil {
+		return 0, err
+	}
+
+	var exported int
+	for cmd.InProgress() {
+		if err = conn.Recv(-1); err != nil {
+			return exported, err
+		}
+		for _, rsp := range cmd.Data {
+			info := rsp.MessageInfo()
+			if info == nil {
+				continue
+			}
+			msg, err := mail.ReadMessage(bytes.NewReader(imap.AsBytes(info.Attrs["BODY[]"])))
+			if err != nil {
+				continue
+			}
+			ext, item := groupwareItem(textproto.MIMEHeader(msg.Header), msg.Body)
+			if len(item) == 0 {
+				continue
+			}
+			if err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d%s", info.UID, ext)), item, 0600); err != nil {
+				return exported, err
+			}
+			exported++
+		}
+		cmd.Data = nil
+	}
+	return exported, nil
+}
+
+// groupwareItem finds the first text/calendar or vCard part of a message and returns
+// the extension for it and its decoded contents.
+func groupwareItem(header textproto.MIMEHeader, body io.Reader) (string, []byte) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return "", nil
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				return "", nil
+			}
+			if ext, item := groupwareItem(part.Header, part); len(item) > 0 {
+				return ext, item
+			}
+		}
+	}
+
+	ext := ".vcf"
+	switch mediaType {
+	case "text/calendar":
+		ext = ".ics"
+	case "text/vcard", "text/x-vcard", "text/directory":
+	default:
+		return "", nil
+	}
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	item, _ := ioutil.ReadAll(body)
+	return ext, item
+}
@@ -0,0 +1,64 @@
+package copycat
+
+import (
+	"bytes"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestItemKind(t *testing.T) {
+	tests := []struct {
+		header string
+		kind   string
+	}{
+		{"Content-Class: urn:content-classes:appointment\r\nContent-Type: multipart/mixed; boundary=x\r\n", CalendarFolder},
+		{"Content-Class: urn:content-classes:person\r\n", ContactsFolder},
+		{"Content-Class: urn:content-classes:task\r\n", TasksFolder},
+		{"Content-Type: text/x-vcard; charset=utf-8\r\n", ContactsFolder},
+		{"Content-Type: text/calendar; method=PUBLISH\r\n", CalendarFolder},
+		// invites are mail
+		{"Content-Class: urn:content-classes:calendarmessage\r\nContent-Type: multipart/alternative; boundary=x\r\n", ""},
+		{"Content-Type: text/plain\r\n", ""},
+	}
+	for _, test := range tests {
+		msg, err := mail.ReadMessage(strings.NewReader(test.header + "\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind := itemKind(msg.Header); kind != test.kind {
+			t.Errorf("expected %q for %q, got %q", test.kind, test.header, kind)
+		}
+	}
+}
+
+func TestGroupwareItem(t *testing.T) {
+	raw := "Content-Class: urn:content-classes:appointment\r\n" +
+		"Content-Type: multipart/alternative; boundary=x\r\n\r\n" +
+		"--x\r\nContent-Type: text/plain\r\n\r\nLunch\r\n" +
+		"--x\r\nContent-Type: text/calendar; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		"QkVHSU46VkNBTEVOREFSDQpFTkQ6VkNB\r\nTEVOREFSDQo=\r\n" +
+		"--x--\r\n"
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ext, item := groupwareItem(textproto.MIMEHeader(msg.Header), msg.Body)
+	if ext != ".ics" || !bytes.Equal(item, []byte("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n")) {
+		t.Errorf("expected the calendar, got %q %q", ext, item)
+	}
+
+	msg, _ = mail.ReadMessage(strings.NewReader("Content-Type: text/plain\r\n\r\nhi\r\n"))
+	if _, item = groupwareItem(textproto.MIMEHeader(msg.Header), msg.Body); len(item) > 0 {
+		t.Errorf("expected no item in a plain message, got %q", item)
+	}
+}
+
+func TestReportGroupware(t *testing.T) {
+	report := NewReport()
+	report.Groupware("fred", "Calendar", CalendarFolder, "12 item(s) exported")
+	if out := report.String(); !strings.Contains(out, "1 groupware folder(s) not synced\n    fred Calendar (calendar): 12 item(s) exported") {
+		t.Errorf("report is missing the groupware folder:\n%s", out)
+	}
+}
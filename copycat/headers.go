@@ -0,0 +1,89 @@
+package copycat
+
+import (
+	"bytes"
+	"log"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// HeaderParsing is how headers net/mail can't parse are handled. With HeaderLenient (the
+// default) they're scanned for whatever fields can be made out, so the message is still
+// copied. With HeaderStrict the message is skipped. Either way, it's listed in the report.
+var HeaderParsing = HeaderLenient
+
+const (
+	HeaderStrict  = "strict"
+	HeaderLenient = "lenient"
+)
+
+// a field name is any printable ASCII but the colon, though some mailers leave space
+// before the colon
+var headerField = regexp.MustCompile(`^([!-9;-~]+)[ \t]*:[ \t]*(.*)$`)
+
+// ParseHeader parses a message header, or the fields of one fetched with
+// BODY[HEADER.FIELDS]. If net/mail can't parse it and HeaderParsing is lenient, it's
+// scanned line by line instead, keeping every line that looks like a field and skipping
+// the rest, and lenient is true. The header is nil if it couldn't be parsed.
+func ParseHeader(raw []byte) (header mail.Header, lenient bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err == nil {
+		return msg.Header, false
+	}
+	if HeaderParsing == HeaderStrict || len(bytes.TrimSpace(raw)) == 0 {
+		return nil, false
+	}
+	return scanHeader(raw), true
+}
+
+// scanHeader pulls what fields it can out of a malformed header.
+func scanHeader(raw []byte) mail.Header {
+	header := make(mail.Header)
+	var lines []string
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(bytes.TrimSpace(line)) == 0 {
+			// the end of the header
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			// folded onto the line before
+			lines[len(lines)-1] += " " + string(bytes.TrimSpace(line))
+			continue
+		}
+		lines = append(lines, string(line))
+	}
+	for _, line := range lines {
+		if match := headerField.FindStringSubmatch(line); match != nil {
+			name := textproto.CanonicalMIMEHeaderKey(match[1])
+			header[name] = append(header[name], match[2])
+		}
+	}
+	if ids := header["Message-Id"]; len(ids) > 0 {
+		// the first thing that looks like a msg-id, ignoring any comments or junk around it
+		if id := msgIdPattern.FindString(ids[0]); len(id) > 0 {
+			header["Message-Id"] = []string{id}
+		}
+	}
+	return header
+}
+
+// messageHeader parses the header fetched for the message in the folder selected on conn,
+// recording it in the RunReport if it was malformed.
+func messageHeader(conn *imap.Client, info *imap.MessageInfo) mail.Header {
+	raw := MessageIdHeader(info)
+	header, lenient := ParseHeader(raw)
+	switch {
+	case lenient:
+		Stats.Add("lenient_headers", 1)
+		RunReport.Malformed(conn.Mailbox.Name, info.UID, header.Get("Message-Id"), "parsed leniently")
+	case header == nil && len(bytes.TrimSpace(raw)) > 0:
+		Stats.Add("malformed_headers", 1)
+		log.Printf("Skipping UID %d in %s, its header can't be parsed", info.UID, conn.Mailbox.Name)
+		RunReport.Malformed(conn.Mailbox.Name, info.UID, "", "skipped")
+	}
+	return header
+}
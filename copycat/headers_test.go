@@ -0,0 +1,43 @@
+package copycat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseHeader(t *testing.T) {
+	header, lenient := ParseHeader([]byte("Message-Id: <a@example.com>\r\nSubject: hi\r\n\r\n"))
+	if lenient || header.Get("Message-Id") != "<a@example.com>" {
+		t.Errorf("expected a well formed header to parse strictly, got %v (lenient %v)", header, lenient)
+	}
+
+	// a junk line, a space before the colon, a folded id with a comment after it
+	malformed := []byte("this line is junk\r\nSubject : hi\r\nMessage-ID:\r\n <b@example.com> (junk)\r\n\r\n")
+	header, lenient = ParseHeader(malformed)
+	if !lenient {
+		t.Fatal("expected the malformed header to need the lenient scanner")
+	}
+	if id := header.Get("Message-Id"); id != "<b@example.com>" {
+		t.Errorf("expected <b@example.com>, got %q", id)
+	}
+	if subject := header.Get("Subject"); subject != "hi" {
+		t.Errorf("expected the subject hi, got %q", subject)
+	}
+
+	HeaderParsing = HeaderStrict
+	defer func() { HeaderParsing = HeaderLenient }()
+	if header, _ = ParseHeader(malformed); header != nil {
+		t.Errorf("expected strict parsing to give up, got %v", header)
+	}
+}
+
+func TestReportMalformed(t *testing.T) {
+	report := NewReport()
+	report.Malformed("INBOX", 7, "<b@example.com>", "parsed leniently")
+	report.Malformed("INBOX", 7, "<b@example.com>", "parsed leniently")
+	report.Malformed("Archive", 2, "", "skipped")
+	out := report.String()
+	if !strings.Contains(out, "2 message(s) with malformed headers") || !strings.Contains(out, "Archive UID 2 : skipped") {
+		t.Errorf("report is missing the malformed headers:\n%s", out)
+	}
+}
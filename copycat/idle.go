@@ -1,10 +1,8 @@
 package copycat
 
 import (
-	"bytes"
 	"errors"
 	"log"
-	"net/mail"
 	"os"
 	"os/signal"
 	"time"
@@ -19,7 +17,11 @@ const idleTimeoutMinutes = 20
 // taken to update the destinations. If the process decides the inboxes are out of sync,
 // it will pass a bool to the requestPurge channel. It is expected that the requestPurge
 // channel is setup to initiate a purge process when it receives the notificaiton.
-func Idle(src *imap.Client, appendRequests []chan WorkRequest, requestPurge chan bool) (err error) {
+func Idle(src *imap.Client, appendRequests []chan WorkRequest, requestPurge chan bool, generateIds bool) (err error) {
+	return idle(src, &fanOut{requests: appendRequests}, requestPurge, generateIds)
+}
+
+func idle(src *imap.Client, fanout *fanOut, requestPurge chan bool, generateIds bool) (err error) {
 	var nextUID uint32
 	if nextUID, err = getNextUID(src); err != nil {
 		log.Printf("Unable to get UIDNext: %s", err.Error())
@@ -97,16 +99,17 @@ func Idle(src *imap.Client, appendRequests []chan WorkRequest, requestPurge chan
 							log.Printf("attempting to find/append %d new messages", newMessages)
 							for i := uint32(0); i < newMessages; i++ {
 								var request WorkRequest
-								if request, err = getMessageInfo(src, nextUID); err == nil {
+								switch request, err = getMessageInfo(src, nextUID, generateIds); err {
+								case nil:
+									request.Folder = src.Mailbox.Name
 
-									log.Printf("creating %d append requests for %d", len(appendRequests), nextUID)
-									for _, requests := range appendRequests {
-										requests <- request
-									}
-									log.Printf("done creating append requests for %d", nextUID)
+									log.Printf("created %d append requests for %d", fanout.send(request), nextUID)
 									nextUID++
 									startSize++
-								} else {
+								case ErrSkipMessage:
+									nextUID++
+									startSize++
+								default:
 									log.Printf("Unable to find message for UID (%d): %s", nextUID, err.Error())
 								}
 							}
@@ -124,6 +127,12 @@ func Idle(src *imap.Client, appendRequests []chan WorkRequest, requestPurge chan
 
 			go sleep(poll)
 
+		case <-Controls.Canceled():
+			log.Printf("Sync canceled. Terminating idle...")
+			if _, err = src.IdleTerm(); err != nil {
+				log.Printf("error while terminating idle: %s", err.Error())
+			}
+			return ErrCanceled
 		case <-interrupt:
 			log.Printf("Received interrupt. Terminating idle...")
 			_, err = src.IdleTerm()
@@ -149,11 +158,9 @@ func Idle(src *imap.Client, appendRequests []chan WorkRequest, requestPurge chan
 			log.Printf("idle restarted.")
 		}
 	}
-
-	return
 }
 
-func getMessageInfo(conn *imap.Client, uid uint32) (WorkRequest, error) {
+func getMessageInfo(conn *imap.Client, uid uint32, generateIds bool) (WorkRequest, error) {
 	log.Printf("fetching data for (%d) from src for idle", uid)
 
 	// get headers and UID for ALL message in src inbox...
@@ -163,9 +170,16 @@ func getMessageInfo(conn *imap.Client, uid uint32) (WorkRequest, error) {
 	}
 
 	var request WorkRequest
-	if mesg, _ := mail.ReadMessage(bytes.NewReader(msg.Body)); mesg != nil {
+	if parsed, _ := ParseHeader(msg.Body); parsed != nil {
+		if isSpam(conn.Mailbox.Name, parsed) {
+			return WorkRequest{}, ErrSkipMessage
+		}
 		header := "Message-Id"
-		value := mesg.Header.Get(header)
+		value := parsed.Get(header)
+		if len(value) == 0 && generateIds {
+			rawHeader, _, _ := splitMessage(toCRLF(msg.Body))
+			value = SyntheticMessageId(rawHeader)
+		}
 		request = WorkRequest{Value: value, Header: header, UID: uid, Msg: msg}
 	} else {
 		return request, errors.New("message was empty")
@@ -0,0 +1,284 @@
+package copycat
+
+import (
+	"crypto/sha256"
+	"log"
+	"sync"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// ImportArchive will connect to each destination and Import the archive in the given directory.
+func ImportArchive(dir string, dstInfos []InboxInfo, sinks []Sink, connsPerInbox int, transform Transformer) error {
+	source, err := NewArchiveSource(dir)
+	if err != nil {
+		log.Printf("Unable to open archive: %s", err.Error())
+		return err
+	}
+	defer source.Close()
+
+	return ImportSource(source, dstInfos, sinks, connsPerInbox, transform)
+}
+
+// ImportSource will connect to each destination and Import the source's messages.
+func ImportSource(source MessageSource, dstInfos []InboxInfo, sinks []Sink, connsPerInbox int, transform Transformer) error {
+	var c conns
+	defer c.Close()
+	var err error
+	if c.Dest, err = DestinationConnections(dstInfos, connsPerInbox); err != nil {
+		return err
+	}
+
+	return Import(source, c.Dest, sinks, transform)
+}
+
+// Import will copy every message in the source into each destination and sink, restoring
+// the message's folder, flags and internal date. Folders are created as needed and
+// messages that already exist in the destination folder or sink are skipped. Messages
+// without a Message-Id are found in a destination folder by their content instead.
+func Import(source MessageSource, dsts map[string][]*imap.Client, sinks []Sink, transform Transformer) error {
+	msgs, err := source.List()
+	if err != nil {
+		log.Printf("Unable to list source messages: %s", err.Error())
+		return err
+	}
+
+	// group the messages by folder, keeping their order
+	var folders []string
+	byFolder := make(map[string][]SourceMessage)
+	unidentified := make(map[string]bool)
+	for _, msg := range msgs {
+		if _, exists := byFolder[msg.Folder]; !exists {
+			folders = append(folders, msg.Folder)
+		}
+		byFolder[msg.Folder] = append(byFolder[msg.Folder], msg)
+		if len(msg.MessageId) == 0 {
+			unidentified[msg.Folder] = true
+		}
+	}
+
+	copies := &importCopies{source: source, want: len(dsts) + len(sinks), counts: make(map[string]int)}
+	for _, folder := range folders {
+		log.Printf("importing %d messages into %s", len(byFolder[folder]), folder)
+
+		var importRequests []chan SourceMessage
+		var importers sync.WaitGroup
+		for user, dst := range dsts {
+			name := folder
+			if root := destinationRoot(user); len(root) > 0 {
+				delim, _ := HierarchyDelimiter(dst[0])
+				name = underRoot(root, folder, delim)
+			}
+			if err = openFolder(dst, name); err != nil {
+				log.Printf("Unable to open %s for %s: %s. skipping folder!", name, user, err.Error())
+				continue
+			}
+			var known contentHashes
+			if unidentified[folder] {
+				if known, err = unidentifiedHashes(dst[0]); err != nil {
+					log.Printf("Unable to hash the messages without a Message-Id in %s for %s: %s. not importing any!", name, user, err.Error())
+				}
+			}
+
+			requests := make(chan SourceMessage)
+			for _, dstConn := range dst {
+				importers.Add(1)
+				go importMessages(dstConn, source, requests, transform, known, copies, &importers)
+			}
+			importRequests = append(importRequests, requests)
+		}
+		for _, sink := range sinks {
+			requests := make(chan SourceMessage)
+			importers.Add(1)
+			go importToSink(sink, folder, source, requests, transform, copies, &importers)
+			importRequests = append(importRequests, requests)
+		}
+
+		for _, msg := range byFolder[folder] {
+			for _, requests := range importRequests {
+				requests <- msg
+			}
+		}
+		for _, requests := range importRequests {
+			close(requests)
+		}
+		importers.Wait()
+	}
+
+	// leave the connections the way we found them
+	for _, dst := range dsts {
+		openFolder(dst, "INBOX")
+	}
+
+	log.Printf("import complete")
+	return nil
+}
+
+// openFolder will create the folder if needed and select it on each connection.
+func openFolder(conns []*imap.Client, folder string) error {
+	// this will fail if the folder already exists, which is fine
+	imap.Wait(conns[0].Create(folder))
+
+	for _, conn := range conns {
+		if _, err := imap.Wait(conn.Select(folder, false)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contentHashes are the SHA-256 sums of messages' content.
+type contentHashes map[[sha256.Size]byte]bool
+
+// unidentifiedHashes hashes the content of each message without a Message-Id in the
+// folder selected on conn, like the checksums command does.
+func unidentifiedHashes(conn *imap.Client) (contentHashes, error) {
+	cmd, err := imap.Wait(conn.UIDSearch("NOT", "HEADER", "Message-Id", ""))
+	if err != nil {
+		return nil, err
+	}
+	uids, _ := imap.NewSeqSet("")
+	for _, rsp := range cmd.Data {
+		for _, uid := range rsp.SearchResults() {
+			uids.AddNum(uid)
+		}
+	}
+	known := make(contentHashes)
+	if uids.Empty() {
+		return known, nil
+	}
+	cmd, err = imap.Wait(conn.UIDFetch(uids, "BODY.PEEK[]"))
+	if err != nil {
+		return nil, err
+	}
+	for _, rsp := range cmd.Data {
+		known[sha256.Sum256(imap.AsBytes(rsp.MessageInfo().Attrs["BODY[]"]))] = true
+	}
+	return known, nil
+}
+
+// importMessages will append each message it receives that is not already in the conn's
+// selected folder. Messages without a Message-Id are looked for in known, and skipped if
+// it's nil since they can't be checked.
+func importMessages(conn *imap.Client, source MessageSource, requests chan SourceMessage, transform Transformer, known contentHashes, copies *importCopies, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for request := range requests {
+		if len(request.MessageId) > 0 {
+			cmd, err := imap.Wait(conn.UIDSearch(dedupSearch("Message-Id", request.MessageId)))
+			if err != nil {
+				log.Printf("Unable to search for message (%s): %s. skipping!", request.MessageId, err.Error())
+				continue
+			}
+			if len(cmd.Data[0].SearchResults()) > 0 {
+				copies.copied(request)
+				continue
+			}
+		} else if known == nil {
+			continue
+		}
+
+		msg, err := source.Fetch(request)
+		if err != nil {
+			log.Printf("Unable to fetch message (%s) from source: %s. skipping!", request.MessageId, err.Error())
+			continue
+		}
+		// restored with its flags, so transforms treat them as carried over
+		msg.flagsSet = true
+
+		if transform != nil {
+			if msg, err = transform.Transform(msg); err != nil {
+				if err != ErrSkipMessage {
+					log.Printf("Unable to transform message (%s): %s. skipping!", request.MessageId, err.Error())
+				}
+				continue
+			}
+		}
+
+		// the content is what the copy would have, so it's only checked once transformed
+		if len(request.MessageId) == 0 && known[sha256.Sum256(msg.Body)] {
+			copies.copied(request)
+			continue
+		}
+
+		msg.Flags = supportedKeywords(conn, request.MessageId, msg.Flags)
+		if err = RestoreMessage(conn, msg); err != nil {
+			log.Printf("Problems restoring message (%s) to dst: %s", request.MessageId, err.Error())
+			continue
+		}
+		copies.copied(request)
+	}
+}
+
+// importToSink will put each message it receives that the sink doesn't already have in
+// the sink under the folder.
+func importToSink(sink Sink, folder string, source MessageSource, requests chan SourceMessage, transform Transformer, copies *importCopies, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for request := range requests {
+		if len(request.MessageId) > 0 {
+			has, err := sink.Has(folder, request.MessageId)
+			if err != nil {
+				log.Printf("Unable to check sink for message (%s): %s. skipping!", request.MessageId, err.Error())
+				continue
+			}
+			if has {
+				copies.copied(request)
+				continue
+			}
+		}
+
+		msg, err := source.Fetch(request)
+		if err != nil {
+			log.Printf("Unable to fetch message (%s) from source: %s. skipping!", request.MessageId, err.Error())
+			continue
+		}
+		// restored with its flags, so transforms treat them as carried over
+		msg.flagsSet = true
+		if transform != nil {
+			if msg, err = transform.Transform(msg); err != nil {
+				if err != ErrSkipMessage {
+					log.Printf("Unable to transform message (%s): %s. skipping!", request.MessageId, err.Error())
+				}
+				continue
+			}
+		}
+		if err = sink.Put(folder, request.MessageId, msg); err != nil {
+			log.Printf("Problems putting message (%s) in sink: %s", request.MessageId, err.Error())
+			continue
+		}
+		copies.copied(request)
+	}
+}
+
+// importCopies counts the destinations each message is in, so the source is only told
+// it was copied (see copiedFrom) once it's in all of them.
+type importCopies struct {
+	mu     sync.Mutex
+	source MessageSource
+	want   int
+	counts map[string]int
+}
+
+func (c *importCopies) copied(msg SourceMessage) {
+	c.mu.Lock()
+	c.counts[msg.Key]++
+	done := c.counts[msg.Key] >= c.want
+	if done {
+		delete(c.counts, msg.Key)
+	}
+	c.mu.Unlock()
+	if done {
+		copiedFrom(c.source, msg)
+	}
+}
+
+// copiedFrom tells sources that keep track of what's been copied, like POP3Source, that
+// the message is in a destination.
+func copiedFrom(source MessageSource, msg SourceMessage) {
+	if tracker, ok := source.(interface {
+		Copied(SourceMessage)
+	}); ok {
+		tracker.Copied(msg)
+	}
+}
@@ -0,0 +1,106 @@
+package copycat
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+type memorySource struct {
+	msgs   []SourceMessage
+	copied []string
+}
+
+func (s *memorySource) List() ([]SourceMessage, error) { return s.msgs, nil }
+func (s *memorySource) Fetch(msg SourceMessage) (MessageData, error) {
+	return MessageData{Body: []byte("Message-Id: " + msg.MessageId + "\r\n\r\nhi\r\n")}, nil
+}
+func (s *memorySource) Close() error { return nil }
+func (s *memorySource) Copied(msg SourceMessage) {
+	s.copied = append(s.copied, msg.Key)
+}
+
+type memorySink struct {
+	mu  sync.Mutex
+	put []string
+}
+
+func (s *memorySink) Has(folder string, messageId string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, put := range s.put {
+		if put == folder+" "+messageId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (s *memorySink) Put(folder string, messageId string, msg MessageData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put = append(s.put, folder+" "+messageId)
+	return nil
+}
+func (s *memorySink) Close() error { return nil }
+
+func TestImportToSinks(t *testing.T) {
+	source := &memorySource{msgs: []SourceMessage{
+		{Folder: "INBOX", MessageId: "<1@example.com>", Key: "1"},
+		{Folder: "Archive", MessageId: "<2@example.com>", Key: "2"},
+	}}
+	sink := &memorySink{}
+	if err := Import(source, nil, []Sink{sink}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"INBOX <1@example.com>", "Archive <2@example.com>"}; !reflect.DeepEqual(sink.put, want) {
+		t.Errorf("expected %v in the sink, got %v", want, sink.put)
+	}
+	if want := []string{"1", "2"}; !reflect.DeepEqual(source.copied, want) {
+		t.Errorf("expected %v to be recorded as copied, got %v", want, source.copied)
+	}
+
+	// messages the sink has already aren't put again
+	source.copied = nil
+	Import(source, nil, []Sink{sink}, nil)
+	if len(sink.put) != 2 || len(source.copied) != 2 {
+		t.Errorf("expected nothing new in the sink, got %v", sink.put)
+	}
+}
+
+// a source of the messages in bodies, by Key
+type bodySource struct {
+	msgs   []SourceMessage
+	bodies map[string]string
+}
+
+func (s bodySource) List() ([]SourceMessage, error) { return s.msgs, nil }
+func (s bodySource) Fetch(msg SourceMessage) (MessageData, error) {
+	return MessageData{InternalDate: time.Now(), Body: []byte(s.bodies[msg.Key])}, nil
+}
+func (s bodySource) Close() error { return nil }
+
+func TestImportUnidentified(t *testing.T) {
+	dst := newFakeServer()
+	conn := dialFake(t, dst)
+	defer conn.Logout(time.Second)
+	source := bodySource{
+		msgs: []SourceMessage{{Folder: "INBOX", Key: "1"}, {Folder: "INBOX", MessageId: "<2@example.com>", Key: "2"}},
+		bodies: map[string]string{
+			"1": "Subject: no id\r\n\r\nhello\r\n",
+			"2": "Message-Id: <2@example.com>\r\nSubject: hi\r\n\r\nhello\r\n",
+		},
+	}
+
+	// a message without a Message-Id is found by its content the second time
+	for run := 0; run < 2; run++ {
+		if err := Import(source, map[string][]*imap.Client{"dst@example.com": {conn}}, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dst.Len() != 2 {
+		t.Errorf("expected each message to be imported once, got %d", dst.Len())
+	}
+}
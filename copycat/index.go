@@ -0,0 +1,238 @@
+package copycat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// max amount of text to index for a single message
+const maxIndexText = 1024 * 1024
+
+// IndexedMessage is the document stored in the search index for each message.
+type IndexedMessage struct {
+	MessageId    string    `json:"message_id"`
+	Folder       string    `json:"folder"`
+	Flags        []string  `json:"flags"`
+	InternalDate time.Time `json:"internal_date"`
+	From         string    `json:"from"`
+	To           string    `json:"to"`
+	Cc           string    `json:"cc"`
+	Subject      string    `json:"subject"`
+	Date         string    `json:"date"`
+	Text         string    `json:"text"`
+}
+
+// IndexSink is a Sink that feeds messages into an Elasticsearch index so they
+// can be searched without a mail client. Documents are keyed by folder and
+// Message-Id, like the other sinks, so a message found in several folders is
+// indexed (and found) in each of them.
+type IndexSink struct {
+	// URL of the index, ex. http://localhost:9200/mail
+	URL string
+
+	Client *http.Client
+}
+
+func NewIndexSink(indexURL string) (*IndexSink, error) {
+	if _, err := url.Parse(indexURL); err != nil {
+		return nil, err
+	}
+	return &IndexSink{URL: strings.TrimRight(indexURL, "/"), Client: &http.Client{Timeout: time.Minute}}, nil
+}
+
+// docURL is where the message's document is. The id is a hash of the folder and
+// Message-Id, since together they can be longer than the 512 bytes an id can be.
+func (s *IndexSink) docURL(folder string, messageId string) string {
+	return fmt.Sprintf("%s/_doc/%x", s.URL, sha256.Sum256([]byte(folder+"\x00"+messageId)))
+}
+
+func (s *IndexSink) Has(folder string, messageId string) (bool, error) {
+	rsp, err := s.Client.Head(s.docURL(folder, messageId))
+	if err != nil {
+		return false, err
+	}
+	rsp.Body.Close()
+
+	switch rsp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status checking index: %s", rsp.Status)
+}
+
+func (s *IndexSink) Put(folder string, messageId string, msg MessageData) error {
+	doc := NewIndexedMessage(messageId, msg)
+	doc.Folder = folder
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", s.docURL(folder, messageId), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	return checkIndexResponse(rsp, nil)
+}
+
+func (s *IndexSink) Close() error {
+	return nil
+}
+
+// Search runs a simple query string search against the index, returning up to size messages.
+func (s *IndexSink) Search(query string, size int) ([]IndexedMessage, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"size": size,
+		"query": map[string]interface{}{
+			"simple_query_string": map[string]interface{}{
+				"query":  query,
+				"fields": []string{"subject^2", "from", "to", "cc", "text"},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := s.Client.Post(s.URL+"/_search", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source IndexedMessage `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err = checkIndexResponse(rsp, &result); err != nil {
+		return nil, err
+	}
+
+	var msgs []IndexedMessage
+	for _, hit := range result.Hits.Hits {
+		msgs = append(msgs, hit.Source)
+	}
+	return msgs, nil
+}
+
+func checkIndexResponse(rsp *http.Response, result interface{}) error {
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return fmt.Errorf("index returned %s: %s", rsp.Status, strings.TrimSpace(string(msg)))
+	}
+	if result != nil {
+		return json.NewDecoder(rsp.Body).Decode(result)
+	}
+	return nil
+}
+
+// NewIndexedMessage pulls the headers and readable text out of a message.
+func NewIndexedMessage(messageId string, msg MessageData) IndexedMessage {
+	doc := IndexedMessage{MessageId: messageId, Flags: msg.Flags, InternalDate: msg.InternalDate}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg.Body))
+	if err != nil {
+		return doc
+	}
+
+	decoder := new(mime.WordDecoder)
+	decode := func(name string) string {
+		value := parsed.Header.Get(name)
+		if decoded, err := decoder.DecodeHeader(value); err == nil {
+			return decoded
+		}
+		return value
+	}
+	doc.From = decode("From")
+	doc.To = decode("To")
+	doc.Cc = decode("Cc")
+	doc.Subject = decode("Subject")
+	doc.Date = parsed.Header.Get("Date")
+
+	var text bytes.Buffer
+	extractText(textproto.MIMEHeader(parsed.Header), parsed.Body, &text)
+	doc.Text = text.String()
+	if len(doc.Text) > maxIndexText {
+		doc.Text = doc.Text[:maxIndexText]
+	}
+	return doc
+}
+
+var htmlTags = regexp.MustCompile(`(?s)<(script|style)[^>]*>.*?</(script|style)>|<[^>]*>`)
+
+// extractText walks the MIME parts of a message, writing out the text of any
+// text/plain parts. HTML parts are used, stripped of tags, if there's no plain text.
+func extractText(header textproto.MIMEHeader, body io.Reader, text *bytes.Buffer) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		var htmlText bytes.Buffer
+		start := text.Len()
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			if partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); partType == "text/html" {
+				extractText(part.Header, part, &htmlText)
+			} else {
+				extractText(part.Header, part, text)
+			}
+		}
+		if text.Len() == start {
+			text.Write(htmlText.Bytes())
+		}
+		return
+	}
+
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	content, _ := ioutil.ReadAll(io.LimitReader(body, maxIndexText))
+	decoded := toUTF8(content)
+	if mediaType == "text/html" {
+		decoded = html.UnescapeString(htmlTags.ReplaceAllString(decoded, " "))
+	}
+	text.WriteString(decoded)
+	text.WriteString("\n")
+}
@@ -0,0 +1,132 @@
+package copycat
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewIndexedMessage(t *testing.T) {
+	date := time.Date(2014, 3, 1, 12, 0, 0, 0, time.UTC)
+	body := "From: =?utf-8?q?Ren=C3=A9e?= <renee@example.com>\r\n" +
+		"To: bob@example.com\r\n" +
+		"Cc: carol@example.com\r\n" +
+		"Subject: =?utf-8?q?caf=C3=A9?= plans\r\n" +
+		"Date: Sat, 1 Mar 2014 12:00:00 +0000\r\n" +
+		"\r\n" +
+		"see you there\r\n"
+	doc := NewIndexedMessage("<a@example.com>", MessageData{InternalDate: date, Flags: []string{`\Seen`}, Body: []byte(body)})
+
+	if doc.MessageId != "<a@example.com>" || !doc.InternalDate.Equal(date) || len(doc.Flags) != 1 {
+		t.Errorf("expected the message's id, date and flags, got %+v", doc)
+	}
+	if doc.From != "Renée <renee@example.com>" || doc.To != "bob@example.com" || doc.Cc != "carol@example.com" {
+		t.Errorf("unexpected addresses %q, %q, %q", doc.From, doc.To, doc.Cc)
+	}
+	if doc.Subject != "café plans" || doc.Date != "Sat, 1 Mar 2014 12:00:00 +0000" {
+		t.Errorf("unexpected subject %q or date %q", doc.Subject, doc.Date)
+	}
+	if doc.Text != "see you there\r\n\n" {
+		t.Errorf("unexpected text %q", doc.Text)
+	}
+
+	// a message that can't be parsed is still indexed by its id
+	if doc = NewIndexedMessage("<b@example.com>", MessageData{Body: []byte("no header here")}); doc.MessageId != "<b@example.com>" || len(doc.Text) > 0 {
+		t.Errorf("expected just the id of an unparsable message, got %+v", doc)
+	}
+
+	// and only so much text is kept
+	huge := "Subject: huge\r\n\r\n" + strings.Repeat("a", maxIndexText+100)
+	if doc = NewIndexedMessage("<c@example.com>", MessageData{Body: []byte(huge)}); len(doc.Text) != maxIndexText {
+		t.Errorf("expected the text to be cut to %d bytes, got %d", maxIndexText, len(doc.Text))
+	}
+}
+
+func TestExtractText(t *testing.T) {
+	for _, c := range []struct {
+		name, contentType, body, want string
+	}{
+		{"no content type", "", "plain", "plain\n"},
+		{"attachment", "application/pdf", "%PDF-1.4", ""},
+		{"html", "text/html", "<p>fish &amp; chips</p><script>alert(1)</script>", " fish & chips  \n"},
+		{
+			"plain over html", `multipart/alternative; boundary="b"`,
+			"--b\r\nContent-Type: text/plain\r\n\r\nplain\r\n--b\r\nContent-Type: text/html\r\n\r\n<b>html</b>\r\n--b--\r\n",
+			"plain\n",
+		},
+		{
+			"html when there's no plain text", `multipart/alternative; boundary="b"`,
+			"--b\r\nContent-Type: text/html\r\n\r\n<style>p {}</style><b>html</b>\r\n--b--\r\n",
+			"  html \n",
+		},
+		{
+			"nested and encoded", `multipart/mixed; boundary="outer"`,
+			"--outer\r\nContent-Type: multipart/alternative; boundary=\"inner\"\r\n\r\n" +
+				"--inner\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\naGVsbG8=\r\n--inner--\r\n" +
+				"--outer\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nsoft=\r\nbreak=3D\r\n" +
+				"--outer\r\nContent-Type: image/png\r\nContent-Transfer-Encoding: base64\r\n\r\niVBORw0K\r\n--outer--\r\n",
+			"hello\nsoftbreak=\n",
+		},
+	} {
+		header := textproto.MIMEHeader{}
+		if len(c.contentType) > 0 {
+			header.Set("Content-Type", c.contentType)
+		}
+		var text bytes.Buffer
+		extractText(header, strings.NewReader(c.body), &text)
+		if text.String() != c.want {
+			t.Errorf("%s: expected %q, got %q", c.name, c.want, text.String())
+		}
+	}
+}
+
+func TestIndexSinkHas(t *testing.T) {
+	// just enough of Elasticsearch to keep documents by id
+	var mu sync.Mutex
+	docs := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "PUT":
+			docs[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+			w.Write([]byte(`{"result":"created"}`))
+		case "HEAD":
+			if _, found := docs[r.URL.Path]; !found {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}
+	}))
+	defer server.Close()
+
+	sink, err := NewIndexSink(server.URL + "/mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte("Message-Id: <1@example.com>\r\nSubject: hi\r\n\r\nhello\r\n")
+	if err = sink.Put("INBOX", "<1@example.com>", MessageData{Body: body}); err != nil {
+		t.Fatal(err)
+	}
+	for folder, expected := range map[string]bool{"INBOX": true, "Archive": false} {
+		if has, err := sink.Has(folder, "<1@example.com>"); err != nil || has != expected {
+			t.Errorf("Has(%q) = %v (%v) - expected %v", folder, has, err, expected)
+		}
+	}
+
+	// the same message in another folder is a document of its own
+	if err = sink.Put("Archive", "<1@example.com>", MessageData{Body: body}); err != nil {
+		t.Fatal(err)
+	}
+	has, _ := sink.Has("Archive", "<1@example.com>")
+	mu.Lock()
+	defer mu.Unlock()
+	if !has || len(docs) != 2 {
+		t.Errorf("expected a document for each folder, got %d", len(docs))
+	}
+}
@@ -0,0 +1,702 @@
+package copycat
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The states of a Job.
+const (
+	JobQueued   = "queued"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+	maxJobBytes = 1 << 20
+)
+
+// JobSpec is a sync submitted to a JobQueue.
+type JobSpec struct {
+	Source InboxInfo   `json:"source"`
+	Dest   []InboxInfo `json:"dest"`
+	// Folders syncs every folder instead of just the INBOX.
+	Folders bool `json:"folders,omitempty"`
+	Purge   bool `json:"purge,omitempty"`
+	// Filters are programs to pass each message through (see ExecTransformer).
+	Filters []string `json:"filters,omitempty"`
+	// Tenant is who the job is for, to share out the service (see TenantLimits).
+	Tenant string `json:"tenant,omitempty"`
+	// Local is set for jobs from a batch or the command line, whose passwords can be
+	// references (see ResolveCredential). Jobs submitted over HTTP can't use them.
+	Local bool `json:"local,omitempty"`
+}
+
+// Validate checks the spec has everything a sync needs.
+func (s JobSpec) Validate() error {
+	if err := s.Source.Validate(); err != nil {
+		return fmt.Errorf("source: %s", err.Error())
+	}
+	if len(s.Dest) == 0 {
+		return errors.New("at least one destination is required")
+	}
+	for _, dst := range s.Dest {
+		if err := dst.Validate(); err != nil {
+			return fmt.Errorf("destination: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// resolveCredentials looks up the passwords given as references (see ResolveCredential).
+func (s *JobSpec) resolveCredentials() (err error) {
+	if s.Source.Pw, err = ResolveCredential(s.Source.Pw); err != nil {
+		return err
+	}
+	dests := make([]InboxInfo, len(s.Dest))
+	for i, dst := range s.Dest {
+		if dst.Pw, err = ResolveCredential(dst.Pw); err != nil {
+			return err
+		}
+		dests[i] = dst
+	}
+	s.Dest = dests
+	return nil
+}
+
+// hasCredentialRef is true if any of the spec's passwords is a reference.
+func hasCredentialRef(s JobSpec) bool {
+	if isCredentialRef(s.Source.Pw) {
+		return true
+	}
+	for _, dst := range s.Dest {
+		if isCredentialRef(dst.Pw) {
+			return true
+		}
+	}
+	return false
+}
+
+// Job is a JobSpec and how it's going.
+type Job struct {
+	Id       string    `json:"id"`
+	Spec     JobSpec   `json:"spec"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+// public is a copy of the job that's safe to hand out, without any passwords.
+func (j Job) public() Job {
+	j.Spec.Source.Pw = ""
+	dests := make([]InboxInfo, len(j.Spec.Dest))
+	for i, dst := range j.Spec.Dest {
+		dst.Pw = ""
+		dests[i] = dst
+	}
+	j.Spec.Dest = dests
+	return j
+}
+
+// JobQueue runs submitted syncs in order, at most Concurrency at a time, and keeps
+// the status of every job it has been given. Jobs can be tagged with a tenant to have
+// the tenant's TenantLimits applied to them. It serves a REST API for them, and the same
+// one over gRPC with GRPCServer:
+//
+//	POST   /jobs       submit a JobSpec as JSON, returns the Job
+//	GET    /jobs       list every Job
+//	GET    /jobs/<id>  get one Job
+//	DELETE /jobs/<id>  cancel a Job that hasn't started
+type JobQueue struct {
+	// Tenants are the limits of each tenant, by tenant ID. See LoadTenantLimits.
+	Tenants map[string]TenantLimits
+	// Tokens, if set, are required to use the API, and decide the tenant of each job.
+	Tokens APITokens
+	// Filters are the programs jobs submitted over the API may ask for. The API refuses
+	// any others, since they're run on this host.
+	Filters []string
+	// Rearm, if set, has a Cancel of the run Controls only stop the jobs running at the
+	// time: the next job waits for them to stop and then re-arms the Controls. Otherwise
+	// every job from then on is stopped too.
+	Rearm bool
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	jobs     map[string]*Job
+	order    []string
+	pending  []*Job
+	running  map[string]int
+	limiters map[string]*RateLimiter
+	run      JobRunner
+	// if set, every change to a job is saved in it
+	store *Cache
+	// seals the passwords of the saved jobs, if set
+	key []byte
+	// closed and replaced each time a job changes
+	changed chan struct{}
+	// the events of the jobs being watched (see Handle)
+	watchers map[chan Event]*Job
+}
+
+// JobRunner runs the sync for a job within its tenant's limits.
+type JobRunner func(spec JobSpec, limits TenantLimits) error
+
+// the most jobs that can be waiting to run
+const maxQueuedJobs = 1024
+
+// NewJobQueue starts concurrency workers that pass each submitted job's spec to run.
+func NewJobQueue(concurrency int, tenants map[string]TenantLimits, run JobRunner) *JobQueue {
+	q := newJobQueue(tenants, run)
+	q.start(concurrency)
+	return q
+}
+
+func newJobQueue(tenants map[string]TenantLimits, run JobRunner) *JobQueue {
+	q := &JobQueue{Tenants: tenants, jobs: make(map[string]*Job), running: make(map[string]int), limiters: make(map[string]*RateLimiter), run: run,
+		changed: make(chan struct{}), watchers: make(map[chan Event]*Job)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// NewPersistentJobQueue is a JobQueue that keeps its jobs in the state db so they survive
+// a restart. Jobs that were queued or running when the process stopped are queued again,
+// in the order they were submitted. Syncs only copy what's missing, so a job that was cut
+// off picks up where it left off (and with SkipUnchanged, folders it finished are skipped).
+//
+// Passwords are never saved as they are. Credential references (see ResolveCredential)
+// are saved, and with a key the passwords are sealed with it (AES-GCM). Any others are
+// left out, so a job that needs them fails instead of resuming.
+func NewPersistentJobQueue(concurrency int, tenants map[string]TenantLimits, store *Cache, key []byte, run JobRunner) (*JobQueue, error) {
+	saved, err := store.jobs()
+	if err != nil {
+		return nil, err
+	}
+
+	q := newJobQueue(tenants, run)
+	q.store = store
+	if len(key) > 0 {
+		sum := sha256.Sum256(key)
+		q.key = sum[:]
+	}
+	for i := range saved {
+		job := &saved[i]
+		q.jobs[job.Id] = job
+		q.order = append(q.order, job.Id)
+		if job.State != JobQueued && job.State != JobRunning {
+			continue
+		}
+		if err = q.unseal(&job.Spec); err != nil {
+			log.Printf("Unable to resume job %s for %s: %s", job.Id, job.Spec.Source.User, err.Error())
+			job.State = JobFailed
+			job.Error = err.Error()
+			job.Finished = time.Now()
+			q.save(job)
+			continue
+		}
+		log.Printf("resuming %s job %s for %s", job.State, job.Id, job.Spec.Source.User)
+		job.State = JobQueued
+		q.save(job)
+		q.pending = append(q.pending, job)
+	}
+	q.start(concurrency)
+	return q, nil
+}
+
+func (q *JobQueue) start(concurrency int) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		go q.work()
+	}
+}
+
+// save writes the job to the store, if there is one, with its passwords sealed, and
+// wakes anything watching the jobs. A job that's over doesn't need them at all. q.mu must
+// be held.
+func (q *JobQueue) save(job *Job) {
+	close(q.changed)
+	q.changed = make(chan struct{})
+	if q.store == nil {
+		return
+	}
+	saved := *job
+	over := job.State != JobQueued && job.State != JobRunning
+	seal := func(info InboxInfo) InboxInfo {
+		switch {
+		case over || len(info.Pw) == 0:
+			info.Pw = ""
+		case isCredentialRef(info.Pw):
+		case q.key != nil:
+			info.Pw = q.sealPassword(info.Pw)
+		default:
+			info.Pw = ""
+		}
+		return info
+	}
+	saved.Spec.Source = seal(saved.Spec.Source)
+	saved.Spec.Dest = make([]InboxInfo, len(job.Spec.Dest))
+	for i, dst := range job.Spec.Dest {
+		saved.Spec.Dest[i] = seal(dst)
+	}
+	if err := q.store.putJob(saved); err != nil {
+		log.Printf("Unable to save job %s: %s", job.Id, err.Error())
+	}
+}
+
+// sealedPrefix marks a password sealed with the queue's key.
+const sealedPrefix = "sealed:"
+
+func (q *JobQueue) sealPassword(pw string) string {
+	gcm, err := q.cipher()
+	if err != nil {
+		return ""
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return ""
+	}
+	return sealedPrefix + base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(pw), nil))
+}
+
+// unseal restores the passwords of a saved job, or says why it can't.
+func (q *JobQueue) unseal(spec *JobSpec) error {
+	open := func(info *InboxInfo) error {
+		switch {
+		case len(info.Pw) == 0:
+			return fmt.Errorf("the password for %s wasn't kept, submit the job again (or give passwords as env: or file: references, or set a job key)", info.User)
+		case !strings.HasPrefix(info.Pw, sealedPrefix):
+			return nil
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(info.Pw, sealedPrefix))
+		gcm, cipherErr := q.cipher()
+		if err != nil || cipherErr != nil || len(raw) < gcm.NonceSize() {
+			return fmt.Errorf("the password for %s can't be unsealed without the job key", info.User)
+		}
+		pw, err := gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], nil)
+		if err != nil {
+			return fmt.Errorf("the password for %s can't be unsealed with this job key", info.User)
+		}
+		info.Pw = string(pw)
+		return nil
+	}
+	if err := open(&spec.Source); err != nil {
+		return err
+	}
+	for i := range spec.Dest {
+		if err := open(&spec.Dest[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *JobQueue) cipher() (cipher.AEAD, error) {
+	if q.key == nil {
+		return nil, errors.New("no job key")
+	}
+	block, err := aes.NewCipher(q.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// next waits for the first pending job whose tenant isn't already running as many
+// jobs as it's allowed, so one tenant's jobs can't hold up everyone else's.
+func (q *JobQueue) next() *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.Rearm && Controls.Stopped("") {
+			if q.busy() {
+				q.cond.Wait()
+				continue
+			}
+			Controls.Rearm()
+		}
+		for i, job := range q.pending {
+			limits := q.limits(job.Spec.Tenant)
+			if limits.MaxJobs > 0 && q.running[job.Spec.Tenant] >= limits.MaxJobs {
+				continue
+			}
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			q.running[job.Spec.Tenant]++
+			job.State = JobRunning
+			job.Started = time.Now()
+			q.save(job)
+			return job
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *JobQueue) work() {
+	for {
+		job := q.next()
+		q.mu.Lock()
+		spec := job.Spec
+		limits := q.limits(spec.Tenant)
+		if limits.Bandwidth > 0 {
+			if q.limiters[spec.Tenant] == nil {
+				q.limiters[spec.Tenant] = NewRateLimiter(limits.Bandwidth)
+			}
+			limits.Limiter = q.limiters[spec.Tenant]
+		}
+		q.mu.Unlock()
+
+		log.Printf("starting job %s for %s", job.Id, spec.Source.User)
+		var err error
+		if spec.Local {
+			err = spec.resolveCredentials()
+		}
+		if err == nil {
+			err = q.run(spec, limits)
+		}
+
+		q.mu.Lock()
+		q.running[spec.Tenant]--
+		job.Finished = time.Now()
+		job.State = JobDone
+		if err != nil {
+			job.State = JobFailed
+			job.Error = err.Error()
+		}
+		q.save(job)
+		q.mu.Unlock()
+		q.cond.Broadcast()
+		log.Printf("job %s is %s", job.Id, job.State)
+	}
+}
+
+// busy is true while any job is running.
+func (q *JobQueue) busy() bool {
+	for _, running := range q.running {
+		if running > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Submit queues the spec. It returns an error if the spec is invalid or too many
+// jobs are already waiting.
+func (q *JobQueue) Submit(spec JobSpec) (Job, error) {
+	if err := spec.Validate(); err != nil {
+		return Job{}, err
+	}
+
+	job := &Job{Id: randomHex(8), Spec: spec, State: JobQueued, Created: time.Now()}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) >= maxQueuedJobs {
+		return Job{}, errors.New("too many jobs are waiting")
+	}
+	q.pending = append(q.pending, job)
+	q.jobs[job.Id] = job
+	q.order = append(q.order, job.Id)
+	q.save(job)
+	// not Signal, which could wake a Wait instead of a worker
+	q.cond.Broadcast()
+	return job.public(), nil
+}
+
+// Wait blocks until every job submitted has finished or been canceled.
+func (q *JobQueue) Wait() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) > 0 || q.busy() {
+		q.cond.Wait()
+	}
+}
+
+// SetTenants replaces the tenants' limits. The most jobs a tenant can run and its
+// bandwidth change right away, connections for the jobs started from now on.
+func (q *JobQueue) SetTenants(tenants map[string]TenantLimits) {
+	q.mu.Lock()
+	q.Tenants = tenants
+	for tenant, limiter := range q.limiters {
+		limiter.SetRate(q.limits(tenant).Bandwidth)
+	}
+	q.mu.Unlock()
+	// a tenant may be allowed more jobs now
+	q.cond.Broadcast()
+}
+
+// Get returns the job with the id.
+func (q *JobQueue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, exists := q.jobs[id]
+	if !exists {
+		return Job{}, false
+	}
+	return job.public(), true
+}
+
+var (
+	// ErrJobNotFound is returned for an id the queue was never given.
+	ErrJobNotFound = errors.New("no such job")
+	// ErrJobStarted is returned when canceling a job that is already running or finished.
+	ErrJobStarted = errors.New("job has already started")
+)
+
+// Cancel keeps a queued job from running.
+func (q *JobQueue) Cancel(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, exists := q.jobs[id]
+	if !exists {
+		return Job{}, ErrJobNotFound
+	}
+	if job.State != JobQueued {
+		return job.public(), ErrJobStarted
+	}
+	for i, pending := range q.pending {
+		if pending == job {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+	job.State = JobCanceled
+	job.Finished = time.Now()
+	q.save(job)
+	log.Printf("job %s is %s", job.Id, job.State)
+	return job.public(), nil
+}
+
+// List returns every job in the order they were submitted.
+func (q *JobQueue) List() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := []Job{}
+	for _, id := range q.order {
+		jobs = append(jobs, q.jobs[id].public())
+	}
+	return jobs
+}
+
+// Handle passes the event on to whatever is watching the running jobs with its
+// destination. Add it to the Progress func to have the jobs' events streamed over gRPC.
+// A destination in more than one running job gets the events of each.
+func (q *JobQueue) Handle(e Event) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for events, job := range q.watchers {
+		if job.State != JobRunning {
+			continue
+		}
+		for _, dst := range job.Spec.Dest {
+			if dst.User == e.Destination {
+				// a slow watcher misses events rather than holding up the sync
+				select {
+				case events <- e:
+				default:
+				}
+				break
+			}
+		}
+	}
+}
+
+// watch calls send with the job each time its state changes and with its events (see
+// Handle) while it runs, until the job is over, ctx is done or send fails.
+func (q *JobQueue) watch(ctx context.Context, id string, send func(Job, *Event) error) error {
+	events := make(chan Event, 64)
+	q.mu.Lock()
+	job, exists := q.jobs[id]
+	if !exists {
+		q.mu.Unlock()
+		return ErrJobNotFound
+	}
+	q.watchers[events] = job
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.watchers, events)
+		q.mu.Unlock()
+	}()
+
+	var state string
+	for {
+		q.mu.Lock()
+		current, changed := job.public(), q.changed
+		q.mu.Unlock()
+		if current.State != state {
+			if err := send(current, nil); err != nil {
+				return err
+			}
+			state = current.State
+		}
+		if state != JobQueued && state != JobRunning {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case e := <-events:
+			if err := send(current, &e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (q *JobQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tenant := AnyTenant
+	if q.Tokens != nil {
+		var ok bool
+		if tenant, ok = q.Tokens.tenant(r); !ok {
+			unauthorized(w)
+			return
+		}
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	switch {
+	case len(id) == 0 && r.Method == "POST":
+		var spec JobSpec
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxJobBytes)).Decode(&spec); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid job: " + err.Error()})
+			return
+		}
+		job, err := q.submitFor(tenant, spec)
+		switch {
+		case errors.Is(err, errOtherTenant):
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		default:
+			writeJSON(w, http.StatusCreated, job)
+		}
+	case len(id) == 0 && r.Method == "GET":
+		jobs := []Job{}
+		for _, job := range q.List() {
+			if visibleTo(tenant, job) {
+				jobs = append(jobs, job)
+			}
+		}
+		writeJSON(w, http.StatusOK, jobs)
+	case r.Method == "GET":
+		job, exists := q.Get(id)
+		if !exists || !visibleTo(tenant, job) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": ErrJobNotFound.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	case r.Method == "DELETE":
+		if job, exists := q.Get(id); !exists || !visibleTo(tenant, job) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": ErrJobNotFound.Error()})
+			return
+		}
+		job, err := q.Cancel(id)
+		switch err {
+		case nil:
+			writeJSON(w, http.StatusOK, job)
+		case ErrJobNotFound:
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		default:
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// errOtherTenant is returned when a token submits a job for a tenant other than its own.
+var errOtherTenant = errors.New("the token can't submit jobs for tenant")
+
+// submitFor checks a spec submitted over the API with a token for the tenant and queues
+// it. The spec can't be for another tenant, give its passwords as references or name
+// filters that aren't in Filters.
+func (q *JobQueue) submitFor(tenant string, spec JobSpec) (Job, error) {
+	if tenant != AnyTenant {
+		if len(spec.Tenant) > 0 && spec.Tenant != tenant {
+			return Job{}, fmt.Errorf("%w %s", errOtherTenant, spec.Tenant)
+		}
+		spec.Tenant = tenant
+	}
+	// references would read the service's own environment and files
+	spec.Local = false
+	if hasCredentialRef(spec) {
+		return Job{}, errors.New("passwords can't be env: or file: references")
+	}
+	for _, filter := range spec.Filters {
+		if !q.allowedFilter(filter) {
+			return Job{}, fmt.Errorf("the filter %q isn't allowed", filter)
+		}
+	}
+	return q.Submit(spec)
+}
+
+// visibleTo is true if a token for the tenant can see the job. A job it can't is
+// reported as not found.
+func visibleTo(tenant string, job Job) bool {
+	return tenant == AnyTenant || job.Spec.Tenant == tenant
+}
+
+// allowedFilter is true if the filter is exactly one of the Filters.
+func (q *JobQueue) allowedFilter(filter string) bool {
+	for _, allowed := range q.Filters {
+		if filter == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Unable to write response: %s", err.Error())
+	}
+}
+
+// jobs are kept in the state db under this prefix and their id
+const jobKeyPrefix = "job\x00"
+
+func (c *Cache) putJob(job Job) error {
+	raw, err := serialize(job)
+	if err != nil {
+		return err
+	}
+	return c.db.Put([]byte(jobKeyPrefix+job.Id), raw, nil)
+}
+
+// jobs returns every saved job in the order they were submitted.
+func (c *Cache) jobs() ([]Job, error) {
+	var jobs []Job
+	iter := c.db.NewIterator(util.BytesPrefix([]byte(jobKeyPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var job Job
+		if err := deserialize(iter.Value(), &job); err != nil {
+			log.Printf("Unable to read saved job %q: %s. skipping!", string(iter.Key()[len(jobKeyPrefix):]), err.Error())
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+	return jobs, iter.Error()
+}
@@ -0,0 +1,689 @@
+// The job API of 'copycat-imap serve' as a gRPC service, served with -grpc. It mirrors
+// the REST API of copycat.JobQueue call for call, with the same tokens and rules, for
+// platforms that would rather drive migrations with typed RPCs.
+//
+// A token goes in the "authorization" metadata as "Bearer <token>". The Go code in
+// this directory is generated from this file with protoc-gen-go and protoc-gen-go-grpc:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//	    --go-grpc_out=. --go-grpc_opt=paths=source_relative copycat/jobspb/jobs.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: copycat/jobspb/jobs.proto
+
+package jobspb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Inbox struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	User  string                 `protobuf:"bytes,1,opt,name=user,proto3" json:"user,omitempty"`
+	// only ever sent to the service, never returned
+	Pw            string `protobuf:"bytes,2,opt,name=pw,proto3" json:"pw,omitempty"`
+	Host          string `protobuf:"bytes,3,opt,name=host,proto3" json:"host,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Inbox) Reset() {
+	*x = Inbox{}
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Inbox) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Inbox) ProtoMessage() {}
+
+func (x *Inbox) ProtoReflect() protoreflect.Message {
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Inbox.ProtoReflect.Descriptor instead.
+func (*Inbox) Descriptor() ([]byte, []int) {
+	return file_copycat_jobspb_jobs_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Inbox) GetUser() string {
+	if x != nil {
+		return x.User
+	}
+	return ""
+}
+
+func (x *Inbox) GetPw() string {
+	if x != nil {
+		return x.Pw
+	}
+	return ""
+}
+
+func (x *Inbox) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+type JobSpec struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Source *Inbox                 `protobuf:"bytes,1,opt,name=source,proto3" json:"source,omitempty"`
+	Dest   []*Inbox               `protobuf:"bytes,2,rep,name=dest,proto3" json:"dest,omitempty"`
+	// sync every folder instead of just the INBOX
+	Folders bool `protobuf:"varint,3,opt,name=folders,proto3" json:"folders,omitempty"`
+	Purge   bool `protobuf:"varint,4,opt,name=purge,proto3" json:"purge,omitempty"`
+	// programs to pass each message through, from the service's -job-filters
+	Filters       []string `protobuf:"bytes,5,rep,name=filters,proto3" json:"filters,omitempty"`
+	Tenant        string   `protobuf:"bytes,6,opt,name=tenant,proto3" json:"tenant,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *JobSpec) Reset() {
+	*x = JobSpec{}
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *JobSpec) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*JobSpec) ProtoMessage() {}
+
+func (x *JobSpec) ProtoReflect() protoreflect.Message {
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use JobSpec.ProtoReflect.Descriptor instead.
+func (*JobSpec) Descriptor() ([]byte, []int) {
+	return file_copycat_jobspb_jobs_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *JobSpec) GetSource() *Inbox {
+	if x != nil {
+		return x.Source
+	}
+	return nil
+}
+
+func (x *JobSpec) GetDest() []*Inbox {
+	if x != nil {
+		return x.Dest
+	}
+	return nil
+}
+
+func (x *JobSpec) GetFolders() bool {
+	if x != nil {
+		return x.Folders
+	}
+	return false
+}
+
+func (x *JobSpec) GetPurge() bool {
+	if x != nil {
+		return x.Purge
+	}
+	return false
+}
+
+func (x *JobSpec) GetFilters() []string {
+	if x != nil {
+		return x.Filters
+	}
+	return nil
+}
+
+func (x *JobSpec) GetTenant() string {
+	if x != nil {
+		return x.Tenant
+	}
+	return ""
+}
+
+type Job struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Id    string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Spec  *JobSpec               `protobuf:"bytes,2,opt,name=spec,proto3" json:"spec,omitempty"`
+	// queued, running, done, failed or canceled
+	State         string                 `protobuf:"bytes,3,opt,name=state,proto3" json:"state,omitempty"`
+	Error         string                 `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
+	Created       *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=created,proto3" json:"created,omitempty"`
+	Started       *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=started,proto3" json:"started,omitempty"`
+	Finished      *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=finished,proto3" json:"finished,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Job) Reset() {
+	*x = Job{}
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Job) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Job) ProtoMessage() {}
+
+func (x *Job) ProtoReflect() protoreflect.Message {
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Job.ProtoReflect.Descriptor instead.
+func (*Job) Descriptor() ([]byte, []int) {
+	return file_copycat_jobspb_jobs_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Job) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Job) GetSpec() *JobSpec {
+	if x != nil {
+		return x.Spec
+	}
+	return nil
+}
+
+func (x *Job) GetState() string {
+	if x != nil {
+		return x.State
+	}
+	return ""
+}
+
+func (x *Job) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *Job) GetCreated() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Created
+	}
+	return nil
+}
+
+func (x *Job) GetStarted() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Started
+	}
+	return nil
+}
+
+func (x *Job) GetFinished() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Finished
+	}
+	return nil
+}
+
+type JobRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *JobRequest) Reset() {
+	*x = JobRequest{}
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *JobRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*JobRequest) ProtoMessage() {}
+
+func (x *JobRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use JobRequest.ProtoReflect.Descriptor instead.
+func (*JobRequest) Descriptor() ([]byte, []int) {
+	return file_copycat_jobspb_jobs_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *JobRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type ListJobsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListJobsRequest) Reset() {
+	*x = ListJobsRequest{}
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListJobsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListJobsRequest) ProtoMessage() {}
+
+func (x *ListJobsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListJobsRequest.ProtoReflect.Descriptor instead.
+func (*ListJobsRequest) Descriptor() ([]byte, []int) {
+	return file_copycat_jobspb_jobs_proto_rawDescGZIP(), []int{4}
+}
+
+type JobList struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Jobs          []*Job                 `protobuf:"bytes,1,rep,name=jobs,proto3" json:"jobs,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *JobList) Reset() {
+	*x = JobList{}
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *JobList) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*JobList) ProtoMessage() {}
+
+func (x *JobList) ProtoReflect() protoreflect.Message {
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use JobList.ProtoReflect.Descriptor instead.
+func (*JobList) Descriptor() ([]byte, []int) {
+	return file_copycat_jobspb_jobs_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *JobList) GetJobs() []*Job {
+	if x != nil {
+		return x.Jobs
+	}
+	return nil
+}
+
+// Progress has either the job, when its state changed, or an event of its sync.
+type Progress struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Job           *Job                   `protobuf:"bytes,1,opt,name=job,proto3" json:"job,omitempty"`
+	Event         *Event                 `protobuf:"bytes,2,opt,name=event,proto3" json:"event,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Progress) Reset() {
+	*x = Progress{}
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Progress) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Progress) ProtoMessage() {}
+
+func (x *Progress) ProtoReflect() protoreflect.Message {
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Progress.ProtoReflect.Descriptor instead.
+func (*Progress) Descriptor() ([]byte, []int) {
+	return file_copycat_jobspb_jobs_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Progress) GetJob() *Job {
+	if x != nil {
+		return x.Job
+	}
+	return nil
+}
+
+func (x *Progress) GetEvent() *Event {
+	if x != nil {
+		return x.Event
+	}
+	return nil
+}
+
+// Event is a copycat.Event.
+type Event struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// folder-started, folder-listed, arrived, checked, copied, error, folder-done or
+	// checkpoint
+	Kind          string                 `protobuf:"bytes,1,opt,name=kind,proto3" json:"kind,omitempty"`
+	Time          *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=time,proto3" json:"time,omitempty"`
+	Folder        string                 `protobuf:"bytes,3,opt,name=folder,proto3" json:"folder,omitempty"`
+	Destination   string                 `protobuf:"bytes,4,opt,name=destination,proto3" json:"destination,omitempty"`
+	MessageId     string                 `protobuf:"bytes,5,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	Count         int64                  `protobuf:"varint,6,opt,name=count,proto3" json:"count,omitempty"`
+	Size          int64                  `protobuf:"varint,7,opt,name=size,proto3" json:"size,omitempty"`
+	Error         string                 `protobuf:"bytes,8,opt,name=error,proto3" json:"error,omitempty"`
+	ErrorKind     string                 `protobuf:"bytes,9,opt,name=error_kind,json=errorKind,proto3" json:"error_kind,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Event) Reset() {
+	*x = Event{}
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Event) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event) ProtoMessage() {}
+
+func (x *Event) ProtoReflect() protoreflect.Message {
+	mi := &file_copycat_jobspb_jobs_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event.ProtoReflect.Descriptor instead.
+func (*Event) Descriptor() ([]byte, []int) {
+	return file_copycat_jobspb_jobs_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *Event) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+func (x *Event) GetTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+func (x *Event) GetFolder() string {
+	if x != nil {
+		return x.Folder
+	}
+	return ""
+}
+
+func (x *Event) GetDestination() string {
+	if x != nil {
+		return x.Destination
+	}
+	return ""
+}
+
+func (x *Event) GetMessageId() string {
+	if x != nil {
+		return x.MessageId
+	}
+	return ""
+}
+
+func (x *Event) GetCount() int64 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *Event) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *Event) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *Event) GetErrorKind() string {
+	if x != nil {
+		return x.ErrorKind
+	}
+	return ""
+}
+
+var File_copycat_jobspb_jobs_proto protoreflect.FileDescriptor
+
+const file_copycat_jobspb_jobs_proto_rawDesc = "" +
+	"\n" +
+	"\x19copycat/jobspb/jobs.proto\x12\fcopycat.jobs\x1a\x1fgoogle/protobuf/timestamp.proto\"?\n" +
+	"\x05Inbox\x12\x12\n" +
+	"\x04user\x18\x01 \x01(\tR\x04user\x12\x0e\n" +
+	"\x02pw\x18\x02 \x01(\tR\x02pw\x12\x12\n" +
+	"\x04host\x18\x03 \x01(\tR\x04host\"\xc1\x01\n" +
+	"\aJobSpec\x12+\n" +
+	"\x06source\x18\x01 \x01(\v2\x13.copycat.jobs.InboxR\x06source\x12'\n" +
+	"\x04dest\x18\x02 \x03(\v2\x13.copycat.jobs.InboxR\x04dest\x12\x18\n" +
+	"\afolders\x18\x03 \x01(\bR\afolders\x12\x14\n" +
+	"\x05purge\x18\x04 \x01(\bR\x05purge\x12\x18\n" +
+	"\afilters\x18\x05 \x03(\tR\afilters\x12\x16\n" +
+	"\x06tenant\x18\x06 \x01(\tR\x06tenant\"\x90\x02\n" +
+	"\x03Job\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12)\n" +
+	"\x04spec\x18\x02 \x01(\v2\x15.copycat.jobs.JobSpecR\x04spec\x12\x14\n" +
+	"\x05state\x18\x03 \x01(\tR\x05state\x12\x14\n" +
+	"\x05error\x18\x04 \x01(\tR\x05error\x124\n" +
+	"\acreated\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\acreated\x124\n" +
+	"\astarted\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\astarted\x126\n" +
+	"\bfinished\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\bfinished\"\x1c\n" +
+	"\n" +
+	"JobRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\"\x11\n" +
+	"\x0fListJobsRequest\"0\n" +
+	"\aJobList\x12%\n" +
+	"\x04jobs\x18\x01 \x03(\v2\x11.copycat.jobs.JobR\x04jobs\"Z\n" +
+	"\bProgress\x12#\n" +
+	"\x03job\x18\x01 \x01(\v2\x11.copycat.jobs.JobR\x03job\x12)\n" +
+	"\x05event\x18\x02 \x01(\v2\x13.copycat.jobs.EventR\x05event\"\x83\x02\n" +
+	"\x05Event\x12\x12\n" +
+	"\x04kind\x18\x01 \x01(\tR\x04kind\x12.\n" +
+	"\x04time\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\x12\x16\n" +
+	"\x06folder\x18\x03 \x01(\tR\x06folder\x12 \n" +
+	"\vdestination\x18\x04 \x01(\tR\vdestination\x12\x1d\n" +
+	"\n" +
+	"message_id\x18\x05 \x01(\tR\tmessageId\x12\x14\n" +
+	"\x05count\x18\x06 \x01(\x03R\x05count\x12\x12\n" +
+	"\x04size\x18\a \x01(\x03R\x04size\x12\x14\n" +
+	"\x05error\x18\b \x01(\tR\x05error\x12\x1d\n" +
+	"\n" +
+	"error_kind\x18\t \x01(\tR\terrorKind2\xb9\x02\n" +
+	"\x04Jobs\x125\n" +
+	"\tSubmitJob\x12\x15.copycat.jobs.JobSpec\x1a\x11.copycat.jobs.Job\x128\n" +
+	"\tGetStatus\x12\x18.copycat.jobs.JobRequest\x1a\x11.copycat.jobs.Job\x12@\n" +
+	"\bListJobs\x12\x1d.copycat.jobs.ListJobsRequest\x1a\x15.copycat.jobs.JobList\x12D\n" +
+	"\x0eStreamProgress\x12\x18.copycat.jobs.JobRequest\x1a\x16.copycat.jobs.Progress0\x01\x128\n" +
+	"\tCancelJob\x12\x18.copycat.jobs.JobRequest\x1a\x11.copycat.jobs.JobB\x1dZ\x1bcopycat-imap/copycat/jobspbb\x06proto3"
+
+var (
+	file_copycat_jobspb_jobs_proto_rawDescOnce sync.Once
+	file_copycat_jobspb_jobs_proto_rawDescData []byte
+)
+
+func file_copycat_jobspb_jobs_proto_rawDescGZIP() []byte {
+	file_copycat_jobspb_jobs_proto_rawDescOnce.Do(func() {
+		file_copycat_jobspb_jobs_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_copycat_jobspb_jobs_proto_rawDesc), len(file_copycat_jobspb_jobs_proto_rawDesc)))
+	})
+	return file_copycat_jobspb_jobs_proto_rawDescData
+}
+
+var file_copycat_jobspb_jobs_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_copycat_jobspb_jobs_proto_goTypes = []any{
+	(*Inbox)(nil),                 // 0: copycat.jobs.Inbox
+	(*JobSpec)(nil),               // 1: copycat.jobs.JobSpec
+	(*Job)(nil),                   // 2: copycat.jobs.Job
+	(*JobRequest)(nil),            // 3: copycat.jobs.JobRequest
+	(*ListJobsRequest)(nil),       // 4: copycat.jobs.ListJobsRequest
+	(*JobList)(nil),               // 5: copycat.jobs.JobList
+	(*Progress)(nil),              // 6: copycat.jobs.Progress
+	(*Event)(nil),                 // 7: copycat.jobs.Event
+	(*timestamppb.Timestamp)(nil), // 8: google.protobuf.Timestamp
+}
+var file_copycat_jobspb_jobs_proto_depIdxs = []int32{
+	0,  // 0: copycat.jobs.JobSpec.source:type_name -> copycat.jobs.Inbox
+	0,  // 1: copycat.jobs.JobSpec.dest:type_name -> copycat.jobs.Inbox
+	1,  // 2: copycat.jobs.Job.spec:type_name -> copycat.jobs.JobSpec
+	8,  // 3: copycat.jobs.Job.created:type_name -> google.protobuf.Timestamp
+	8,  // 4: copycat.jobs.Job.started:type_name -> google.protobuf.Timestamp
+	8,  // 5: copycat.jobs.Job.finished:type_name -> google.protobuf.Timestamp
+	2,  // 6: copycat.jobs.JobList.jobs:type_name -> copycat.jobs.Job
+	2,  // 7: copycat.jobs.Progress.job:type_name -> copycat.jobs.Job
+	7,  // 8: copycat.jobs.Progress.event:type_name -> copycat.jobs.Event
+	8,  // 9: copycat.jobs.Event.time:type_name -> google.protobuf.Timestamp
+	1,  // 10: copycat.jobs.Jobs.SubmitJob:input_type -> copycat.jobs.JobSpec
+	3,  // 11: copycat.jobs.Jobs.GetStatus:input_type -> copycat.jobs.JobRequest
+	4,  // 12: copycat.jobs.Jobs.ListJobs:input_type -> copycat.jobs.ListJobsRequest
+	3,  // 13: copycat.jobs.Jobs.StreamProgress:input_type -> copycat.jobs.JobRequest
+	3,  // 14: copycat.jobs.Jobs.CancelJob:input_type -> copycat.jobs.JobRequest
+	2,  // 15: copycat.jobs.Jobs.SubmitJob:output_type -> copycat.jobs.Job
+	2,  // 16: copycat.jobs.Jobs.GetStatus:output_type -> copycat.jobs.Job
+	5,  // 17: copycat.jobs.Jobs.ListJobs:output_type -> copycat.jobs.JobList
+	6,  // 18: copycat.jobs.Jobs.StreamProgress:output_type -> copycat.jobs.Progress
+	2,  // 19: copycat.jobs.Jobs.CancelJob:output_type -> copycat.jobs.Job
+	15, // [15:20] is the sub-list for method output_type
+	10, // [10:15] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
+}
+
+func init() { file_copycat_jobspb_jobs_proto_init() }
+func file_copycat_jobspb_jobs_proto_init() {
+	if File_copycat_jobspb_jobs_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_copycat_jobspb_jobs_proto_rawDesc), len(file_copycat_jobspb_jobs_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_copycat_jobspb_jobs_proto_goTypes,
+		DependencyIndexes: file_copycat_jobspb_jobs_proto_depIdxs,
+		MessageInfos:      file_copycat_jobspb_jobs_proto_msgTypes,
+	}.Build()
+	File_copycat_jobspb_jobs_proto = out.File
+	file_copycat_jobspb_jobs_proto_goTypes = nil
+	file_copycat_jobspb_jobs_proto_depIdxs = nil
+}
@@ -0,0 +1,165 @@
+package copycat
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"copycat-imap/copycat/jobspb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GRPCServer returns a server for the queue's API as the Jobs service of
+// jobspb/jobs.proto. It has the same rules as the REST API: with Tokens, every call
+// needs one as "Bearer <token>" in its "authorization" metadata and only sees the jobs
+// of the token's tenant.
+func (q *JobQueue) GRPCServer() *grpc.Server {
+	server := grpc.NewServer()
+	jobspb.RegisterJobsServer(server, jobServer{queue: q})
+	return server
+}
+
+type jobServer struct {
+	jobspb.UnimplementedJobsServer
+	queue *JobQueue
+}
+
+// tenant returns the tenant of the call's token.
+func (s jobServer) tenant(ctx context.Context) (string, error) {
+	if s.queue.Tokens == nil {
+		return AnyTenant, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if tenant, ok := s.queue.Tokens.bearer(auth); ok {
+			return tenant, nil
+		}
+	}
+	return "", status.Error(codes.Unauthenticated, "a valid API token is required")
+}
+
+// get returns the job with the id if the call's token can see it.
+func (s jobServer) get(ctx context.Context, id string) (Job, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return Job{}, err
+	}
+	job, exists := s.queue.Get(id)
+	if !exists || !visibleTo(tenant, job) {
+		return Job{}, status.Error(codes.NotFound, ErrJobNotFound.Error())
+	}
+	return job, nil
+}
+
+func (s jobServer) SubmitJob(ctx context.Context, spec *jobspb.JobSpec) (*jobspb.Job, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	job, err := s.queue.submitFor(tenant, jobSpecFromPB(spec))
+	switch {
+	case errors.Is(err, errOtherTenant):
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return jobToPB(job), nil
+}
+
+func (s jobServer) GetStatus(ctx context.Context, req *jobspb.JobRequest) (*jobspb.Job, error) {
+	job, err := s.get(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return jobToPB(job), nil
+}
+
+func (s jobServer) ListJobs(ctx context.Context, req *jobspb.ListJobsRequest) (*jobspb.JobList, error) {
+	tenant, err := s.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := &jobspb.JobList{}
+	for _, job := range s.queue.List() {
+		if visibleTo(tenant, job) {
+			list.Jobs = append(list.Jobs, jobToPB(job))
+		}
+	}
+	return list, nil
+}
+
+func (s jobServer) StreamProgress(req *jobspb.JobRequest, stream grpc.ServerStreamingServer[jobspb.Progress]) error {
+	if _, err := s.get(stream.Context(), req.GetId()); err != nil {
+		return err
+	}
+	err := s.queue.watch(stream.Context(), req.GetId(), func(job Job, e *Event) error {
+		if e != nil {
+			return stream.Send(&jobspb.Progress{Event: eventToPB(*e)})
+		}
+		return stream.Send(&jobspb.Progress{Job: jobToPB(job)})
+	})
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return status.FromContextError(err).Err()
+	}
+	return err
+}
+
+func (s jobServer) CancelJob(ctx context.Context, req *jobspb.JobRequest) (*jobspb.Job, error) {
+	if _, err := s.get(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	job, err := s.queue.Cancel(req.GetId())
+	switch err {
+	case nil:
+		return jobToPB(job), nil
+	case ErrJobNotFound:
+		return nil, status.Error(codes.NotFound, err.Error())
+	default:
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+}
+
+func jobSpecFromPB(spec *jobspb.JobSpec) JobSpec {
+	inbox := func(info *jobspb.Inbox) InboxInfo {
+		return InboxInfo{User: info.GetUser(), Pw: info.GetPw(), Host: info.GetHost()}
+	}
+	s := JobSpec{Source: inbox(spec.GetSource()), Folders: spec.GetFolders(), Purge: spec.GetPurge(), Filters: spec.GetFilters(), Tenant: spec.GetTenant()}
+	for _, dst := range spec.GetDest() {
+		s.Dest = append(s.Dest, inbox(dst))
+	}
+	return s
+}
+
+// jobToPB converts a job from the queue, which never has its passwords.
+func jobToPB(job Job) *jobspb.Job {
+	spec := &jobspb.JobSpec{
+		Source:  &jobspb.Inbox{User: job.Spec.Source.User, Host: job.Spec.Source.Host},
+		Folders: job.Spec.Folders,
+		Purge:   job.Spec.Purge,
+		Filters: job.Spec.Filters,
+		Tenant:  job.Spec.Tenant,
+	}
+	for _, dst := range job.Spec.Dest {
+		spec.Dest = append(spec.Dest, &jobspb.Inbox{User: dst.User, Host: dst.Host})
+	}
+	return &jobspb.Job{Id: job.Id, Spec: spec, State: job.State, Error: job.Error,
+		Created: timeToPB(job.Created), Started: timeToPB(job.Started), Finished: timeToPB(job.Finished)}
+}
+
+func eventToPB(e Event) *jobspb.Event {
+	return &jobspb.Event{Kind: e.Kind, Time: timeToPB(e.Time), Folder: e.Folder, Destination: e.Destination, MessageId: e.MessageId,
+		Count: int64(e.Count), Size: int64(e.Size), Error: e.Error, ErrorKind: e.ErrorKind}
+}
+
+// timeToPB leaves out a zero time, ex. a job that hasn't started.
+func timeToPB(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
@@ -0,0 +1,109 @@
+package copycat
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"copycat-imap/copycat/jobspb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestJobGRPC(t *testing.T) {
+	started := make(chan bool, 1)
+	block := make(chan bool)
+	queue := NewJobQueue(1, nil, func(spec JobSpec, limits TenantLimits) error {
+		started <- true
+		<-block
+		return nil
+	})
+	queue.Tokens = APITokens{"acme-0123456789abcdef": "acme", "admin-0123456789abcdef": AnyTenant}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := queue.GRPCServer()
+	go server.Serve(listener)
+	defer server.Stop()
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := jobspb.NewJobsClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	as := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+	spec := func(pw string) *jobspb.JobSpec {
+		return &jobspb.JobSpec{
+			Source: &jobspb.Inbox{User: "src@example.com", Pw: pw, Host: "imap.example.com:993"},
+			Dest:   []*jobspb.Inbox{{User: "dst@example.com", Pw: "secret", Host: "imap.other.com:993"}},
+		}
+	}
+	code := func(err error) codes.Code { return status.Code(err) }
+
+	if _, err = client.SubmitJob(as("wrong-0123456789abcdef"), spec("secret")); code(err) != codes.Unauthenticated {
+		t.Errorf("expected a job with an unknown token to be refused, got %v", err)
+	}
+	other := spec("secret")
+	other.Tenant = "other"
+	if _, err = client.SubmitJob(as("acme-0123456789abcdef"), other); code(err) != codes.PermissionDenied {
+		t.Errorf("expected a job for another tenant to be refused, got %v", err)
+	}
+	if _, err = client.SubmitJob(as("admin-0123456789abcdef"), spec("file:/etc/shadow")); code(err) != codes.InvalidArgument {
+		t.Errorf("expected a credential reference to be refused, got %v", err)
+	}
+
+	running, err := client.SubmitJob(as("acme-0123456789abcdef"), spec("secret"))
+	if err != nil || running.Spec.Tenant != "acme" || running.Spec.Source.Pw != "" {
+		t.Fatalf("expected the job to be created for acme without its password, got %v (%v)", running, err)
+	}
+	<-started
+	queued, err := client.SubmitJob(as("admin-0123456789abcdef"), other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.GetStatus(as("acme-0123456789abcdef"), &jobspb.JobRequest{Id: queued.Id}); code(err) != codes.NotFound {
+		t.Errorf("expected another tenant's job to be hidden, got %v", err)
+	}
+	if list, err := client.ListJobs(as("acme-0123456789abcdef"), &jobspb.ListJobsRequest{}); err != nil || len(list.Jobs) != 1 {
+		t.Errorf("expected acme to see only its job, got %v (%v)", list, err)
+	}
+	if _, err = client.CancelJob(as("admin-0123456789abcdef"), &jobspb.JobRequest{Id: running.Id}); code(err) != codes.FailedPrecondition {
+		t.Errorf("expected a running job not to be canceled, got %v", err)
+	}
+	if job, err := client.CancelJob(as("admin-0123456789abcdef"), &jobspb.JobRequest{Id: queued.Id}); err != nil || job.State != JobCanceled {
+		t.Errorf("expected the queued job to be canceled, got %v (%v)", job, err)
+	}
+
+	stream, err := client.StreamProgress(as("acme-0123456789abcdef"), &jobspb.JobRequest{Id: running.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress, err := stream.Recv(); err != nil || progress.Job.GetState() != JobRunning {
+		t.Fatalf("expected the running job first, got %v (%v)", progress, err)
+	}
+	queue.Handle(Event{Kind: MessageCopied, Destination: "someone@example.com", MessageId: "<other@example.com>"})
+	queue.Handle(Event{Kind: MessageCopied, Destination: "dst@example.com", MessageId: "<copied@example.com>"})
+	if progress, err := stream.Recv(); err != nil || progress.Event.GetMessageId() != "<copied@example.com>" {
+		t.Errorf("expected only the event of the job's destination, got %v (%v)", progress, err)
+	}
+	close(block)
+	if progress, err := stream.Recv(); err != nil || progress.Job.GetState() != JobDone {
+		t.Errorf("expected the job to be done, got %v (%v)", progress, err)
+	}
+	if _, err = stream.Recv(); err != io.EOF {
+		t.Errorf("expected the stream to end with the job, got %v", err)
+	}
+}
@@ -0,0 +1,460 @@
+package copycat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Journal records how far a run got in the state db, so the recover command can pick it
+// up where it stopped if it crashes. It is nil, for no journal, unless set with OpenJournal.
+var Journal *RunJournal
+
+// runs are kept in the state db under this prefix and their id, with their uncertain
+// appends under the run's key, "\x00append\x00" and the appends' MessageKey.
+const journalKeyPrefix = "journal\x00"
+
+// confirmed appends are kept, for every run, under this prefix and their MessageKey
+const confirmedKeyPrefix = "appended\x00"
+
+// ConfirmedAppend is where a message ended up in a destination. The UID is 0 if the
+// server didn't say (see UIDPLUS).
+type ConfirmedAppend struct {
+	UIDValidity uint32
+	UID         uint32
+	Time        time.Time
+}
+
+// JournalRun is what's recorded about a run.
+type JournalRun struct {
+	Id      string
+	Args    []string
+	Started time.Time
+	// zero until the run finished without being stopped
+	Finished time.Time
+	// the folders that were synced
+	Folders map[string]bool
+	// where listing the folders that couldn't be listed in full got to (see EnumerateWindow)
+	Cursors map[string]ListCursor
+}
+
+// ListCursor is the UID listing a folder stopped at. Everything before it was synced.
+type ListCursor struct {
+	UIDValidity uint32
+	UID         uint32
+}
+
+// UncertainAppend is a message that was being appended when the run stopped, so it might
+// or might not be in the destination.
+type UncertainAppend struct {
+	// the folder in the destination
+	Folder      string
+	MessageId   string
+	Destination string
+}
+
+// RunJournal keeps a JournalRun up to date. A nil *RunJournal quietly ignores everything.
+type RunJournal struct {
+	cache *Cache
+	// how many lines have been logged with Log
+	logged int64
+
+	mu  sync.Mutex
+	run JournalRun
+}
+
+// JournalRetention is how long finished runs are kept in the journal, for the logs command.
+var JournalRetention = 7 * 24 * time.Hour
+
+// ConfirmedRetention is how long confirmed appends are kept once a run finishes. They're
+// only needed until the destinations' search has caught up with the appends.
+var ConfirmedRetention = 24 * time.Hour
+
+// OpenJournal starts recording the run with the id in the db, or picks it up again if
+// it was recorded before. args are what the run needs to be started again, which
+// shouldn't have any passwords in them (see StripFlags). Runs that finished more than
+// JournalRetention ago are pruned.
+func OpenJournal(dbFile string, id string, args []string) (*RunJournal, error) {
+	cache, err := NewCache(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	if err = cache.pruneJournal(time.Now().Add(-JournalRetention)); err != nil {
+		log.Printf("Unable to prune the journal: %s", err.Error())
+	}
+	j := &RunJournal{cache: cache}
+	j.run, err = cache.journalRun(id)
+	if err == leveldb.ErrNotFound {
+		j.run = JournalRun{Id: id, Args: args, Started: time.Now(), Folders: make(map[string]bool)}
+		err = j.save()
+	} else if err == nil {
+		log.Printf("resuming run %s from %s with %d folder(s) already synced", id, j.run.Started.Format(time.RFC3339), len(j.run.Folders))
+	}
+	if err != nil {
+		cache.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// LastRun returns the run with the id, or the most recent one that didn't finish if it's empty.
+func LastRun(dbFile string, id string) (JournalRun, error) {
+	cache, err := NewCache(dbFile)
+	if err != nil {
+		return JournalRun{}, err
+	}
+	defer cache.Close()
+	if len(id) > 0 {
+		run, err := cache.journalRun(id)
+		if err == leveldb.ErrNotFound {
+			err = ErrNotFound
+		}
+		return run, err
+	}
+
+	var runs []JournalRun
+	iter := cache.db.NewIterator(util.BytesPrefix([]byte(journalKeyPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var run JournalRun
+		if isAppendKey(iter.Key()) || deserialize(iter.Value(), &run) != nil || !run.Finished.IsZero() {
+			continue
+		}
+		runs = append(runs, run)
+	}
+	if len(runs) == 0 {
+		return JournalRun{}, ErrNotFound
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Started.After(runs[j].Started) })
+	return runs[0], iter.Error()
+}
+
+// pruneJournal deletes the runs that finished before the time, with everything kept with them.
+func (c *Cache) pruneJournal(before time.Time) error {
+	var finished []string
+	iter := c.db.NewIterator(util.BytesPrefix([]byte(journalKeyPrefix)), nil)
+	for iter.Next() {
+		var run JournalRun
+		if isAppendKey(iter.Key()) || deserialize(iter.Value(), &run) != nil {
+			continue
+		}
+		if !run.Finished.IsZero() && run.Finished.Before(before) {
+			finished = append(finished, run.Id)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	for _, id := range finished {
+		batch := new(leveldb.Batch)
+		batch.Delete([]byte(journalKeyPrefix + id))
+		iter := c.db.NewIterator(util.BytesPrefix([]byte(journalKeyPrefix+id+"\x00")), nil)
+		for iter.Next() {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+		iter.Release()
+		if err := c.db.Write(batch, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StripFlags returns the args without the named flags (and their values), ex. to keep
+// passwords out of the journal.
+func StripFlags(args []string, names []string) []string {
+	var stripped []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(stripped, args[i:]...)
+		}
+		if !strings.HasPrefix(arg, "-") {
+			stripped = append(stripped, arg)
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		hasValue := strings.Contains(name, "=")
+		name = strings.SplitN(name, "=", 2)[0]
+		if !listed(names, name) {
+			stripped = append(stripped, arg)
+			continue
+		}
+		if !hasValue {
+			// the value is the next argument
+			i++
+		}
+	}
+	return stripped
+}
+
+func isAppendKey(key []byte) bool {
+	for _, b := range key[len(journalKeyPrefix):] {
+		if b == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cache) journalRun(id string) (JournalRun, error) {
+	var run JournalRun
+	raw, err := c.db.Get([]byte(journalKeyPrefix+id), nil)
+	if err != nil {
+		return run, err
+	}
+	return run, deserialize(raw, &run)
+}
+
+// save writes the run to the db. j.mu must be held or the journal not shared yet.
+func (j *RunJournal) save() error {
+	raw, err := serialize(j.run)
+	if err != nil {
+		return err
+	}
+	return j.cache.db.Put([]byte(journalKeyPrefix+j.run.Id), raw, nil)
+}
+
+// Done is true if the folder was synced before the run stopped.
+func (j *RunJournal) Done(folder string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.run.Folders[folder]
+}
+
+// FolderDone records the folder as synced.
+func (j *RunJournal) FolderDone(folder string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.run.Folders[folder] = true
+	if err := j.save(); err != nil {
+		log.Printf("Unable to record folder %s in the journal: %s", folder, err.Error())
+	}
+}
+
+// Cursor is the UID to carry on listing the folder from, if listing it stopped partway
+// before the run did, or 0.
+func (j *RunJournal) Cursor(folder string, uidValidity uint32) uint32 {
+	if j == nil {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if cursor, exists := j.run.Cursors[folder]; exists && cursor.UIDValidity == uidValidity {
+		return cursor.UID
+	}
+	return 0
+}
+
+// Listed records that listing the folder stopped at the UID, once everything listed
+// before it has been synced, so a resumed run doesn't list those messages again.
+func (j *RunJournal) Listed(folder string, uidValidity uint32, uid uint32) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.run.Cursors == nil {
+		j.run.Cursors = make(map[string]ListCursor)
+	}
+	j.run.Cursors[folder] = ListCursor{UIDValidity: uidValidity, UID: uid}
+	if err := j.save(); err != nil {
+		log.Printf("Unable to record where listing folder %s stopped in the journal: %s", folder, err.Error())
+	}
+}
+
+// Log keeps a line of the log with the run, ex. one a LogSampler held back. It doesn't
+// take j.mu since it's called from the log, and errors are ignored since they can't be logged.
+func (j *RunJournal) Log(line string) {
+	if j == nil {
+		return
+	}
+	n := atomic.AddInt64(&j.logged, 1)
+	j.cache.db.Put([]byte(fmt.Sprintf("%s%s\x00log\x00%012d", journalKeyPrefix, j.run.Id, n)), []byte(line), nil)
+}
+
+// JournalLog returns the lines kept with the run with the id by Log, in order.
+func JournalLog(dbFile string, id string) ([]string, error) {
+	cache, err := NewCache(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	defer cache.Close()
+	var lines []string
+	iter := cache.db.NewIterator(util.BytesPrefix([]byte(journalKeyPrefix+id+"\x00log\x00")), nil)
+	defer iter.Release()
+	for iter.Next() {
+		lines = append(lines, string(iter.Value()))
+	}
+	return lines, iter.Error()
+}
+
+func (j *RunJournal) appendKey(key string) []byte {
+	return []byte(journalKeyPrefix + j.run.Id + "\x00append\x00" + key)
+}
+
+// Appending records the message as about to be appended and returns the key to give
+// Appended once it's known whether it was. Until then, the append is in doubt.
+func (j *RunJournal) Appending(folder string, messageId string, destination string) string {
+	if j == nil {
+		return ""
+	}
+	key := MessageKey(folder, messageId, destination)
+	raw, err := serialize(UncertainAppend{Folder: folder, MessageId: messageId, Destination: destination})
+	if err == nil {
+		err = j.cache.db.Put(j.appendKey(key), raw, nil)
+	}
+	if err != nil {
+		log.Printf("Unable to record the append of %s in the journal: %s", messageId, err.Error())
+	}
+	return key
+}
+
+// Appended records how the append with the key went. If err is nil, it's confirmed with
+// the UID the message was given. If the connection was lost, the message might have been
+// appended anyway, so it's left in doubt.
+func (j *RunJournal) Appended(key string, uidValidity uint32, uid uint32, err error) {
+	if j == nil || errors.Is(err, ErrConnLost) {
+		return
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(j.appendKey(key))
+	if err == nil {
+		raw, err := serialize(ConfirmedAppend{UIDValidity: uidValidity, UID: uid, Time: time.Now()})
+		if err != nil {
+			log.Printf("Unable to record an append in the journal: %s", err.Error())
+			return
+		}
+		batch.Put([]byte(confirmedKeyPrefix+key), raw)
+	}
+	if err := j.cache.db.Write(batch, nil); err != nil {
+		log.Printf("Unable to record an append in the journal: %s", err.Error())
+	}
+}
+
+// Confirmed returns where the message was appended to the destination folder, by any run.
+func (j *RunJournal) Confirmed(folder string, messageId string, destination string) (ConfirmedAppend, bool) {
+	var confirmed ConfirmedAppend
+	if j == nil {
+		return confirmed, false
+	}
+	raw, err := j.cache.db.Get([]byte(confirmedKeyPrefix+MessageKey(folder, messageId, destination)), nil)
+	if err != nil || deserialize(raw, &confirmed) != nil {
+		return confirmed, false
+	}
+	return confirmed, true
+}
+
+// Uncertain lists the appends that were under way when the run stopped.
+func (j *RunJournal) Uncertain() []UncertainAppend {
+	if j == nil {
+		return nil
+	}
+	var appends []UncertainAppend
+	iter := j.cache.db.NewIterator(util.BytesPrefix(j.appendKey("")), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var pending UncertainAppend
+		if err := deserialize(iter.Value(), &pending); err == nil {
+			appends = append(appends, pending)
+		}
+	}
+	return appends
+}
+
+// VerifyUncertain looks for each of the Uncertain appends in their destination. The ones
+// that are found are confirmed and the rest are cleared from the journal, to be copied
+// again by the sync. Appends that can't be checked are left in doubt for the sync, which
+// will search for them too.
+func (j *RunJournal) VerifyUncertain(dsts []InboxInfo) {
+	for _, pending := range j.Uncertain() {
+		key := MessageKey(pending.Folder, pending.MessageId, pending.Destination)
+		uidValidity, uid, err := verifyAppend(dsts, pending)
+		switch {
+		case err != nil:
+			log.Printf("Unable to check if %s was appended to %s: %s. the sync will check it", pending.MessageId, pending.Destination, err.Error())
+		case uid > 0:
+			log.Printf("%s was appended to %s %s before the run stopped", pending.MessageId, pending.Destination, pending.Folder)
+			j.Appended(key, uidValidity, uid, nil)
+		default:
+			log.Printf("%s wasn't appended to %s %s before the run stopped. it will be copied again", pending.MessageId, pending.Destination, pending.Folder)
+			j.Appended(key, 0, 0, NotFound)
+		}
+	}
+}
+
+// verifyAppend searches the destination for the message and returns its UID, or 0 if it's not there.
+func verifyAppend(dsts []InboxInfo, pending UncertainAppend) (uidValidity uint32, uid uint32, err error) {
+	for _, dst := range dsts {
+		if dst.User != pending.Destination {
+			continue
+		}
+		conn, err := GetFolderConnection(dst, pending.Folder, true)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer conn.Logout(20 * time.Second)
+		cmd, err := imap.Wait(conn.UIDSearch([]imap.Field{"HEADER", "Message-Id", pending.MessageId}))
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(cmd.Data) > 0 && len(cmd.Data[0].SearchResults()) > 0 {
+			uid = cmd.Data[0].SearchResults()[0]
+		}
+		return conn.Mailbox.UIDValidity, uid, nil
+	}
+	return 0, 0, ErrNotFound
+}
+
+// Close records the run as finished, unless it was stopped by err.
+func (j *RunJournal) Close(err error) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	if err == nil {
+		j.run.Finished = time.Now()
+		if err := j.save(); err != nil {
+			log.Printf("Unable to record the run as finished: %s", err.Error())
+		}
+		if err := j.cache.pruneConfirmed(time.Now().Add(-ConfirmedRetention)); err != nil {
+			log.Printf("Unable to prune the confirmed appends: %s", err.Error())
+		}
+	}
+	j.mu.Unlock()
+	j.cache.Close()
+}
+
+// pruneConfirmed removes the appends confirmed before the time, by any run.
+func (c *Cache) pruneConfirmed(before time.Time) error {
+	batch := new(leveldb.Batch)
+	iter := c.db.NewIterator(util.BytesPrefix([]byte(confirmedKeyPrefix)), nil)
+	for iter.Next() {
+		var confirmed ConfirmedAppend
+		if deserialize(iter.Value(), &confirmed) != nil || confirmed.Time.Before(before) {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return c.db.Write(batch, nil)
+}
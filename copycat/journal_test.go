@@ -0,0 +1,75 @@
+package copycat
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStripFlags(t *testing.T) {
+	args := []string{"-sync", "-src-pw=secret", "-src-id", "bob", "--dst-pw", "other", "-folders", "-redaction-key=k"}
+	stripped := StripFlags(args, []string{"src-pw", "dst-pw", "redaction-key"})
+	if expected := []string{"-sync", "-src-id", "bob", "-folders"}; !reflect.DeepEqual(stripped, expected) {
+		t.Errorf("expected %v, got %v", expected, stripped)
+	}
+}
+
+func TestPruneJournal(t *testing.T) {
+	defer cleanUp()
+	journal, err := OpenJournal(cacheTestLoc, "old", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Log("a line")
+	journal.Close(nil)
+	journal, err = OpenJournal(cacheTestLoc, "crashed", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.cache.Close()
+
+	cache, err := NewCache(cacheTestLoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.pruneJournal(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cache.journalRun("old"); err == nil {
+		t.Error("expected the finished run to be pruned")
+	}
+	if _, err = cache.journalRun("crashed"); err != nil {
+		t.Errorf("expected the run that didn't finish to be kept, got %v", err)
+	}
+	cache.Close()
+	if lines, _ := JournalLog(cacheTestLoc, "old"); len(lines) != 0 {
+		t.Errorf("expected the finished run's log to be pruned, got %v", lines)
+	}
+}
+
+func TestPruneConfirmed(t *testing.T) {
+	defer cleanUp()
+	journal, err := OpenJournal(cacheTestLoc, "run", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Appended(journal.Appending("INBOX", "<1@example.com>", "dst@example.com"), 7, 42, nil)
+	if err = journal.cache.pruneConfirmed(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := journal.Confirmed("INBOX", "<1@example.com>", "dst@example.com"); !exists {
+		t.Error("expected a recent append to be kept")
+	}
+
+	// finishing the run prunes the appends confirmed before the retention
+	defer func(retention time.Duration) { ConfirmedRetention = retention }(ConfirmedRetention)
+	ConfirmedRetention = -time.Hour
+	journal.Close(nil)
+	if journal, err = OpenJournal(cacheTestLoc, "next", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer journal.cache.Close()
+	if _, exists := journal.Confirmed("INBOX", "<1@example.com>", "dst@example.com"); exists {
+		t.Error("expected the confirmed append to be pruned once the run finished")
+	}
+}
@@ -0,0 +1,103 @@
+package copycat
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// KeywordMap is a Transformer that renames keywords (custom flags) before messages are
+// appended, for destinations that use different names or don't allow some of them.
+// A keyword mapped to "" is dropped. Anything it changes is recorded in the Report, if
+// a FlagPolicy is carrying the flags over; otherwise they aren't appended at all.
+type KeywordMap struct {
+	Map    map[string]string
+	Report *Report
+}
+
+// LoadKeywordMap reads a translation table with a line for each keyword, ex:
+//
+//	# keyword=new keyword (or nothing to drop it)
+//	$Label1=Important
+//	NonJunk=
+func LoadKeywordMap(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keywords := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			return nil, fmt.Errorf("%s:%d: expected keyword=new keyword", path, line)
+		}
+		keywords[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return keywords, scanner.Err()
+}
+
+func (k KeywordMap) Transform(msg MessageData) (MessageData, error) {
+	var flags, changes []string
+	for _, flag := range msg.Flags {
+		to, mapped := k.Map[flag]
+		switch {
+		case !mapped:
+			flags = append(flags, flag)
+		case len(to) == 0:
+			changes = append(changes, "dropped keyword "+flag)
+		default:
+			flags = append(flags, to)
+			changes = append(changes, "translated keyword "+flag+" to "+to)
+		}
+	}
+	if len(changes) == 0 {
+		return msg, nil
+	}
+
+	if msg.flagsSet {
+		k.Report.Altered(messageId(msg.Body), strings.Join(changes, ", "))
+	}
+	msg.Flags = flags
+	return msg, nil
+}
+
+// keywordAllowed checks the PERMANENTFLAGS of the conn's selected mailbox to see if
+// the flag can be stored. System flags and servers that don't say are given the benefit of the doubt.
+func keywordAllowed(conn *imap.Client, flag string) bool {
+	if strings.HasPrefix(flag, `\`) || conn.Mailbox == nil || len(conn.Mailbox.PermFlags) == 0 || conn.Mailbox.PermFlags[`\*`] {
+		return true
+	}
+	for permanent := range conn.Mailbox.PermFlags {
+		if strings.EqualFold(permanent, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedKeywords drops any keyword the conn's selected mailbox won't store
+// so the APPEND isn't rejected, recording them in the RunReport.
+func supportedKeywords(conn *imap.Client, messageId string, flags []string) []string {
+	var kept, dropped []string
+	for _, flag := range flags {
+		if keywordAllowed(conn, flag) {
+			kept = append(kept, flag)
+		} else {
+			dropped = append(dropped, flag)
+		}
+	}
+	if len(dropped) > 0 {
+		RunReport.Altered(messageId, "dropped keyword(s) not allowed by the destination: "+strings.Join(dropped, " "))
+	}
+	return kept
+}
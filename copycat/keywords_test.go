@@ -0,0 +1,62 @@
+package copycat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+func TestKeywordMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keywordtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keywords")
+	ioutil.WriteFile(path, []byte("# comment\n$Label1 = Important\nNonJunk=\n"), 0600)
+	keywords, err := LoadKeywordMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := NewReport()
+	msg, err := KeywordMap{Map: keywords, Report: report}.Transform(MessageData{Flags: []string{`\Seen`, "$Label1", "NonJunk"}, flagsSet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(msg.Flags) != `[\Seen Important]` {
+		t.Errorf("unexpected flags: %v", msg.Flags)
+	}
+	if len(report.altered) != 1 {
+		t.Errorf("expected the change to be reported")
+	}
+
+	// without a FlagPolicy the flags aren't appended, so there's nothing to report
+	report = NewReport()
+	if _, err = (KeywordMap{Map: keywords, Report: report}).Transform(MessageData{Flags: []string{"$Label1"}}); err != nil || len(report.altered) != 0 {
+		t.Errorf("expected no change reported without a FlagPolicy, got %v (%v)", report.altered, err)
+	}
+
+	ioutil.WriteFile(path, []byte("no equals\n"), 0600)
+	if _, err = LoadKeywordMap(path); err == nil {
+		t.Errorf("expected an error for a bad line")
+	}
+}
+
+func TestSupportedKeywords(t *testing.T) {
+	conn := &imap.Client{Mailbox: &imap.MailboxStatus{PermFlags: imap.FlagSet{`\Seen`: true, "Important": true}}}
+	kept := supportedKeywords(conn, "<1@example.com>", []string{`\Seen`, `\Flagged`, "important", "Other"})
+	if fmt.Sprint(kept) != `[\Seen \Flagged important]` {
+		t.Errorf("unexpected kept flags: %v", kept)
+	}
+
+	conn.Mailbox.PermFlags[`\*`] = true
+	if !keywordAllowed(conn, "Other") {
+		t.Errorf(`expected any keyword to be allowed with \*`)
+	}
+}
@@ -0,0 +1,251 @@
+package copycat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ConfigProblem is a mistake found in a config file or the flags used with it.
+type ConfigProblem struct {
+	// File is where the problem is, with its Line and Column (from 1) if they're known.
+	// It's empty for problems with the flags.
+	File   string
+	Line   int
+	Column int
+	// Warning is set for problems that don't stop a run, but probably aren't meant.
+	Warning bool
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	kind := "error"
+	if p.Warning {
+		kind = "warning"
+	}
+	switch {
+	case len(p.File) == 0:
+		return fmt.Sprintf("%s: %s", kind, p.Message)
+	case p.Line == 0:
+		return fmt.Sprintf("%s: %s: %s", p.File, kind, p.Message)
+	case p.Column == 0:
+		return fmt.Sprintf("%s:%d: %s: %s", p.File, p.Line, kind, p.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", p.File, p.Line, p.Column, kind, p.Message)
+}
+
+// placeholder matches credentials that were never filled in, like the ones from
+// -example-config, "<password>" or an unexpanded "${PASSWORD}".
+var placeholder = regexp.MustCompile(`(?i)^(<.*>|\$\{.*\}|\$[A-Z_]+|x{3,}|\*{3,}|\?+|changeme|change[_-]me|password|secret|todo|tbd|placeholder|your[_ -].+|.+_user_name|.+_pa\$\$w0rd|imap\.(source|dest\d*)\.com)$`)
+
+// LintConfig checks the JSON of a -config-file (see Config) for syntax errors, unknown
+// keys, missing logins and credentials that are still placeholders. The source can
+// only be left out if needSource is false, ex. when importing an archive.
+func LintConfig(file string, raw []byte, needSource bool) []ConfigProblem {
+	l := &configLinter{file: file, raw: raw}
+	var parsed interface{}
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		offset := int64(len(raw))
+		if syntax, ok := err.(*json.SyntaxError); ok {
+			offset = syntax.Offset
+		}
+		l.problem(offset, false, "%s", err.Error())
+		return l.problems
+	}
+
+	var source, dest bool
+	l.object(raw, 0, "the config", func(key string, keyAt int64, value json.RawMessage, at int64) {
+		switch strings.ToLower(key) {
+		case "source":
+			source = true
+			l.inbox(value, at, "source")
+		case "dest":
+			dest = true
+			l.array(value, at, "dest", func(i int, value json.RawMessage, at int64) {
+				l.inbox(value, at, fmt.Sprintf("dest[%d]", i))
+			})
+		default:
+			l.problem(keyAt, false, "unknown key %q, expected \"source\" or \"dest\"", key)
+		}
+	})
+	if !source && needSource {
+		l.problem(0, false, "missing the \"source\" account")
+	}
+	if !dest {
+		l.problem(0, true, "no \"dest\" accounts, so nothing will be copied to an inbox")
+	}
+	return l.problems
+}
+
+type configLinter struct {
+	file     string
+	raw      []byte
+	problems []ConfigProblem
+}
+
+// problem records a problem at the offset into the file.
+func (l *configLinter) problem(offset int64, warning bool, format string, args ...interface{}) {
+	offset = skipSpace(l.raw, offset)
+	before := l.raw[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len([]rune(string(before[bytes.LastIndexByte(before, '\n')+1:]))) + 1
+	l.problems = append(l.problems, ConfigProblem{File: l.file, Line: line, Column: column, Warning: warning, Message: fmt.Sprintf(format, args...)})
+}
+
+// skipSpace moves the offset past any whitespace and separators to the next token.
+func skipSpace(raw []byte, offset int64) int64 {
+	for offset < int64(len(raw)) && strings.IndexByte(" \t\r\n,:", raw[offset]) >= 0 {
+		offset++
+	}
+	if offset > int64(len(raw)) {
+		return int64(len(raw))
+	}
+	return offset
+}
+
+// object calls field with each key of the JSON object at offset, and its value.
+func (l *configLinter) object(value []byte, offset int64, what string, field func(key string, keyAt int64, value json.RawMessage, at int64)) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	if token, _ := dec.Token(); token != json.Delim('{') {
+		l.problem(offset, false, "%s should be an object", what)
+		return
+	}
+	for dec.More() {
+		keyAt := offset + dec.InputOffset()
+		token, err := dec.Token()
+		if err != nil {
+			return
+		}
+		var v json.RawMessage
+		if err = dec.Decode(&v); err != nil {
+			return
+		}
+		field(token.(string), keyAt, v, offset+dec.InputOffset()-int64(len(v)))
+	}
+}
+
+// array calls item with each value of the JSON array at offset.
+func (l *configLinter) array(value []byte, offset int64, what string, item func(i int, value json.RawMessage, at int64)) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	if token, _ := dec.Token(); token != json.Delim('[') {
+		l.problem(offset, false, "%q should be a list", what)
+		return
+	}
+	for i := 0; dec.More(); i++ {
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return
+		}
+		item(i, v, offset+dec.InputOffset()-int64(len(v)))
+	}
+}
+
+// inbox checks an InboxInfo.
+func (l *configLinter) inbox(value []byte, offset int64, what string) {
+	var info InboxInfo
+	l.object(value, offset, fmt.Sprintf("%q", what), func(key string, keyAt int64, value json.RawMessage, at int64) {
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			l.problem(at, false, "%s.%s should be a string", what, key)
+			return
+		}
+		switch strings.ToLower(key) {
+		case "user":
+			info.User = s
+		case "pw":
+			info.Pw = s
+		case "host":
+			info.Host = s
+		case "admin":
+			info.Admin = s
+		case "root":
+			info.Root = s
+		default:
+			l.problem(keyAt, false, "unknown key %q in %s, expected \"user\", \"pw\", \"host\", \"admin\" or \"root\"", key, what)
+			return
+		}
+		if len(s) > 0 && placeholder.MatchString(s) {
+			l.problem(at, false, "%s.%s is a placeholder: %q", what, key, s)
+		}
+	})
+	if !bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+		return
+	}
+	switch {
+	case len(info.User) == 0:
+		l.problem(offset, false, "%s is missing its \"user\"", what)
+	case len(info.Pw) == 0:
+		l.problem(offset, false, "%s is missing its \"pw\"", what)
+	case len(info.Host) == 0 && !strings.Contains(info.User, "@"):
+		l.problem(offset, false, "%s is missing its \"host\", which can only be discovered for an email address", what)
+	case len(info.Host) == 0:
+		l.problem(offset, true, "%s has no \"host\", so it will be discovered", what)
+	}
+}
+
+// LintRoutes checks the routes can send messages where they say, given the folder
+// policies and the rules of the destination hosts. The problems are in file.
+func LintRoutes(file string, routes []Route, policies []FolderPolicy, dstHosts []string) []ConfigProblem {
+	var problems []ConfigProblem
+	add := func(route Route, warning bool, format string, args ...interface{}) {
+		problems = append(problems, ConfigProblem{File: file, Line: route.Line, Warning: warning, Message: fmt.Sprintf(format, args...)})
+	}
+	for i, route := range routes {
+		if _, err := path.Match(strings.ToLower(route.Folder), ""); err != nil {
+			add(route, false, "bad folder pattern %q", route.Folder)
+			continue
+		}
+		for _, policy := range policies {
+			if strings.EqualFold(policy.Pattern, route.Folder) || policy.Pattern == "*" {
+				if policy.Skip {
+					add(route, true, "%s is skipped by the folder policy for %s, so it's never routed", route.Folder, policy.Pattern)
+				}
+				break
+			}
+		}
+		for _, earlier := range routes[:i] {
+			if len(earlier.Conditions) == 0 && (earlier.Folder == "*" || strings.EqualFold(earlier.Folder, route.Folder)) {
+				add(route, true, "never used, every message of %s is sent to %s by line %d first", route.Folder, earlier.Dest, earlier.Line)
+				break
+			}
+		}
+		if strings.EqualFold(route.Dest, route.Folder) {
+			add(route, true, "routes %s to itself", route.Folder)
+		}
+		// the destination's delimiter isn't known without connecting, so guess from the name
+		delim := ""
+		for _, d := range []string{"/", "."} {
+			if strings.Contains(route.Dest, d) {
+				delim = d
+				break
+			}
+		}
+		for _, host := range dstHosts {
+			if sanitized := FolderRulesFor(host).Sanitize(route.Dest, delim, delim); sanitized != route.Dest {
+				add(route, false, "%s can't be created on %s, it would be %s", route.Dest, host, sanitized)
+			}
+		}
+	}
+	return problems
+}
+
+// LintFolderPolicies checks the policies' patterns and warns of any that can never match.
+func LintFolderPolicies(file string, policies []FolderPolicy) []ConfigProblem {
+	var problems []ConfigProblem
+	for i, policy := range policies {
+		if _, err := path.Match(strings.ToLower(policy.Pattern), ""); err != nil {
+			problems = append(problems, ConfigProblem{File: file, Line: policy.Line, Message: fmt.Sprintf("bad folder pattern %q", policy.Pattern)})
+			continue
+		}
+		for _, earlier := range policies[:i] {
+			if earlier.Pattern == "*" || strings.EqualFold(earlier.Pattern, policy.Pattern) {
+				problems = append(problems, ConfigProblem{File: file, Line: policy.Line, Warning: true, Message: fmt.Sprintf("never used, %s already matches on line %d", earlier.Pattern, earlier.Line)})
+				break
+			}
+		}
+	}
+	return problems
+}
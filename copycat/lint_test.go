@@ -0,0 +1,57 @@
+package copycat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLintConfig(t *testing.T) {
+	raw := `{
+    "source": {
+        "user": "bob@example.com",
+        "pw": "source_pa$$w0rd"
+    },
+    "dest": [
+        {"user": "bob", "pw": "hunter2", "host": "imap.example.org:993"},
+        {"user": "alice", "pw": "hunter2", "hots": "imap.example.org:993"}
+    ],
+    "purge": true
+}`
+	var got []string
+	for _, problem := range LintConfig("copycat.json", []byte(raw), true) {
+		got = append(got, problem.String())
+	}
+	expected := []string{
+		`copycat.json:4:15: error: source.pw is a placeholder: "source_pa$$w0rd"`,
+		`copycat.json:2:15: warning: source has no "host", so it will be discovered`,
+		`copycat.json:8:44: error: unknown key "hots" in dest[1], expected "user", "pw", "host", "admin" or "root"`,
+		`copycat.json:8:9: error: dest[1] is missing its "host", which can only be discovered for an email address`,
+		`copycat.json:10:5: error: unknown key "purge", expected "source" or "dest"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+
+	problems := LintConfig("copycat.json", []byte("{\n  \"source\": {\"user\": \"bob\",}\n}"), true)
+	if len(problems) != 1 || problems[0].Line != 3 || problems[0].Warning {
+		t.Errorf("expected a syntax error on line 3, got %v", problems)
+	}
+}
+
+func TestLintRoutes(t *testing.T) {
+	policies := []FolderPolicy{{Pattern: "Junk", Skip: true, Line: 1}}
+	routes := []Route{
+		{Folder: "Junk", Conditions: []Condition{{Field: "from", Pattern: "*"}}, Dest: "Spam", Line: 2},
+		{Folder: "INBOX", Dest: "Old/Corp/Mail", Line: 3},
+		{Folder: "INBOX", Conditions: []Condition{{Field: "from", Pattern: "*"}}, Dest: "Other", Line: 4},
+		{Folder: "[", Dest: "Other", Line: 5},
+	}
+	var lines []int
+	for _, problem := range LintRoutes("routes.txt", routes, policies, []string{"imap.mail.yahoo.com:993"}) {
+		lines = append(lines, problem.Line)
+	}
+	// skipped, too deep for Yahoo, shadowed and a bad pattern
+	if len(lines) != 4 || lines[0] != 2 || lines[1] != 3 || lines[2] != 4 || lines[3] != 5 {
+		t.Errorf("unexpected problems on lines %v", lines)
+	}
+}
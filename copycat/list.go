@@ -0,0 +1,169 @@
+package copycat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// FolderSummary is a folder in the tree printed by the list command.
+type FolderSummary struct {
+	Name string
+	// Depth is how many parents the folder has.
+	Depth int
+	// Parent is set for folders that only exist to hold others, so they have no counts.
+	Parent   bool
+	Messages uint32
+	// Size is the total RFC822.SIZE of the messages in bytes, or -1 if it isn't known.
+	Size int64
+}
+
+// Leaf is the last part of the folder's name.
+func (f FolderSummary) Leaf(delim string) string {
+	if len(delim) == 0 {
+		return f.Name
+	}
+	parts := strings.Split(f.Name, delim)
+	return parts[len(parts)-1]
+}
+
+// SummarizeFolders will count the messages in each folder on the conn and, if sizes
+// is set, add up their sizes with STATUS (SIZE) or, without STATUS=SIZE, by fetching
+// the RFC822.SIZE of every message. The folders are returned in tree order, parents first.
+func SummarizeFolders(conn *imap.Client, sizes bool) ([]FolderSummary, string, error) {
+	folders, err := ListFolders(conn)
+	if err != nil {
+		return nil, "", err
+	}
+	delim, err := HierarchyDelimiter(conn)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var summaries []FolderSummary
+	for _, folder := range folders {
+		summary := FolderSummary{Name: folder, Size: -1}
+		status, err := GetFolderStatus(conn, folder)
+		if err != nil {
+			return nil, "", wrapError("status "+folder, "", err)
+		}
+		summary.Messages = status.Messages
+		if sizes {
+			if summary.Size, err = folderSize(conn, folder, status.Messages); err != nil {
+				return nil, "", wrapError("size "+folder, "", err)
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	return folderTree(summaries, delim), delim, nil
+}
+
+// folderTree sorts the folders so each comes right after its parent, adding any
+// parents the server didn't list (ex. \Noselect ones), and sets their depth.
+func folderTree(summaries []FolderSummary, delim string) []FolderSummary {
+	listed := make(map[string]bool)
+	for _, summary := range summaries {
+		listed[summary.Name] = true
+	}
+	if len(delim) > 0 {
+		for _, summary := range summaries {
+			parts := strings.Split(summary.Name, delim)
+			for i := 1; i < len(parts); i++ {
+				parent := strings.Join(parts[:i], delim)
+				if !listed[parent] {
+					listed[parent] = true
+					summaries = append(summaries, FolderSummary{Name: parent, Parent: true, Size: -1})
+				}
+			}
+		}
+	}
+
+	for i := range summaries {
+		if len(delim) > 0 {
+			summaries[i].Depth = strings.Count(summaries[i].Name, delim)
+		}
+	}
+	// sorting by path keeps children under their parent
+	path := func(name string) string {
+		if len(delim) == 0 {
+			return name
+		}
+		return strings.Replace(name, delim, "\x00", -1)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return path(summaries[i].Name) < path(summaries[j].Name)
+	})
+	return summaries
+}
+
+// folderSize adds up the size of every message in the folder.
+func folderSize(conn *imap.Client, folder string, messages uint32) (int64, error) {
+	if messages == 0 {
+		return 0, nil
+	}
+
+	if conn.Caps["STATUS=SIZE"] {
+		cmd, err := imap.Wait(conn.Status(folder, "SIZE"))
+		if err != nil {
+			return 0, err
+		}
+		for _, rsp := range cmd.Data {
+			if rsp.MailboxStatus() == nil || len(rsp.Fields) != 3 {
+				continue
+			}
+			fields := imap.AsList(rsp.Fields[2])
+			for i := 0; i+1 < len(fields); i += 2 {
+				if imap.AsAtom(fields[i]) == "SIZE" {
+					var size int64
+					fmt.Sscan(fmt.Sprint(fields[i+1]), &size)
+					return size, nil
+				}
+			}
+		}
+		return -1, nil
+	}
+
+	if _, err := imap.Wait(conn.Select(folder, true)); err != nil {
+		return 0, err
+	}
+	all, _ := imap.NewSeqSet("1:*")
+	cmd, err := conn.Fetch(all, "RFC822.SIZE")
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for cmd.InProgress() {
+		if err = conn.Recv(-1); err != nil {
+			return 0, err
+		}
+		for _, rsp := range cmd.Data {
+			size += int64(rsp.MessageInfo().Size)
+		}
+		cmd.Data = nil
+	}
+	conn.Data = nil
+	if _, err = cmd.Result(imap.OK); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// FormatSize makes a size in bytes easier to read, ex. 1.5 MB.
+func FormatSize(size int64) string {
+	if size < 0 {
+		return "?"
+	}
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
@@ -0,0 +1,48 @@
+package copycat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFolderTree(t *testing.T) {
+	summaries := []FolderSummary{
+		{Name: "Work/2014", Messages: 3, Size: 300},
+		{Name: "INBOX", Messages: 10, Size: 1000},
+		{Name: "Work Stuff", Messages: 1, Size: 100},
+		{Name: "Archive/Old/Receipts", Messages: 2, Size: -1},
+		{Name: "Work", Messages: 4, Size: 400},
+	}
+	var names []string
+	var depths []int
+	for _, summary := range folderTree(summaries, "/") {
+		names = append(names, summary.Name)
+		depths = append(depths, summary.Depth)
+		if summary.Parent != (summary.Name == "Archive" || summary.Name == "Archive/Old") {
+			t.Errorf("folder %s has Parent %v", summary.Name, summary.Parent)
+		}
+	}
+
+	expected := []string{"Archive", "Archive/Old", "Archive/Old/Receipts", "INBOX", "Work", "Work/2014", "Work Stuff"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+	if expectedDepths := []int{0, 1, 2, 0, 0, 1, 0}; !reflect.DeepEqual(depths, expectedDepths) {
+		t.Errorf("expected depths %v, got %v", expectedDepths, depths)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := map[int64]string{
+		-1:              "?",
+		512:             "512 B",
+		1536:            "1.5 KB",
+		5 * 1024 * 1024: "5.0 MB",
+		3 << 40:         "3.0 TB",
+	}
+	for size, expected := range tests {
+		if formatted := FormatSize(size); formatted != expected {
+			t.Errorf("FormatSize(%d) = %q, expected %q", size, formatted, expected)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package copycat
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// DefaultSizeDistribution is mostly small messages with a few large attachments.
+const DefaultSizeDistribution = "4k:70,64k:25,2m:5"
+
+// SizeDistribution is a weighted list of message sizes to generate.
+type SizeDistribution struct {
+	Sizes   []int
+	Weights []int
+	total   int
+}
+
+// ParseSizeDistribution reads a comma separated list of size:weight pairs, ex. "4k:70,64k:25,2m:5".
+// Sizes can end in k or m.
+func ParseSizeDistribution(spec string) (SizeDistribution, error) {
+	var dist SizeDistribution
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 {
+			return dist, fmt.Errorf("invalid size:weight pair: %q", pair)
+		}
+
+		size, err := parseSize(parts[0])
+		if err != nil {
+			return dist, err
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil || weight <= 0 {
+			return dist, fmt.Errorf("invalid weight: %q", parts[1])
+		}
+
+		dist.Sizes = append(dist.Sizes, size)
+		dist.Weights = append(dist.Weights, weight)
+		dist.total += weight
+	}
+	return dist, nil
+}
+
+func parseSize(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier = 1024
+		s = strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		multiplier = 1024 * 1024
+		s = strings.TrimSuffix(s, "m")
+	}
+	size, err := strconv.Atoi(s)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return size * multiplier, nil
+}
+
+// Pick returns a random size from the distribution.
+func (d SizeDistribution) Pick(r *rand.Rand) int {
+	n := r.Intn(d.total)
+	for i, weight := range d.Weights {
+		if n < weight {
+			return d.Sizes[i]
+		}
+		n -= weight
+	}
+	return d.Sizes[len(d.Sizes)-1]
+}
+
+var loadgenWords = strings.Fields("lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor incididunt ut labore et dolore magna aliqua")
+
+// SyntheticMessage builds a message of roughly size bytes. Anything over 8k gets
+// its bulk from a random base64 attachment, like the messages that slow down real syncs.
+func SyntheticMessage(r *rand.Rand, n int, size int, date time.Time) []byte {
+	var msg bytes.Buffer
+	boundary := fmt.Sprintf("loadgen-%x", r.Int63())
+	fmt.Fprintf(&msg, "Message-Id: <loadgen-%d-%x@loadgen.copycat-imap.invalid>\r\n", n, r.Int63())
+	fmt.Fprintf(&msg, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "From: Load Generator <loadgen@example.com>\r\n")
+	fmt.Fprintf(&msg, "To: Copycat <copycat@example.com>\r\n")
+	fmt.Fprintf(&msg, "Subject: Synthetic message %d\r\n", n)
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+
+	text := size
+	attachment := 0
+	if size > 8*1024 {
+		text = 4 * 1024
+		attachment = size - text
+	}
+
+	if attachment > 0 {
+		fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", boundary)
+		fmt.Fprintf(&msg, "--%s\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\n", boundary)
+	} else {
+		fmt.Fprintf(&msg, "Content-Type: text/plain; charset=us-ascii\r\n\r\n")
+	}
+
+	line := 0
+	for written := 0; written < text; {
+		word := loadgenWords[r.Intn(len(loadgenWords))]
+		msg.WriteString(word)
+		written += len(word) + 1
+		if line += len(word) + 1; line > 72 {
+			msg.WriteString("\r\n")
+			line = 0
+		} else {
+			msg.WriteString(" ")
+		}
+	}
+	msg.WriteString("\r\n")
+
+	if attachment > 0 {
+		fmt.Fprintf(&msg, "--%s\r\nContent-Type: application/octet-stream\r\nContent-Transfer-Encoding: base64\r\nContent-Disposition: attachment; filename=\"data-%d.bin\"\r\n\r\n", boundary, n)
+		raw := make([]byte, attachment*3/4)
+		r.Read(raw)
+		encoded := base64.StdEncoding.EncodeToString(raw)
+		for len(encoded) > 76 {
+			msg.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		msg.WriteString(encoded + "\r\n")
+		fmt.Fprintf(&msg, "--%s--\r\n", boundary)
+	}
+	return msg.Bytes()
+}
+
+// LoadGen will append count synthetic messages with sizes from dist to the conn's selected mailbox.
+func LoadGen(conn *imap.Client, count int, dist SizeDistribution, seed int64) error {
+	r := rand.New(rand.NewSource(seed))
+	start := time.Now().Add(-time.Duration(count) * time.Minute)
+	startTime := time.Now()
+	var total int
+	for i := 0; i < count; i++ {
+		date := start.Add(time.Duration(i) * time.Minute)
+		body := SyntheticMessage(r, i, dist.Pick(r), date)
+		if err := AppendMessage(conn, MessageData{InternalDate: date, Body: body}); err != nil {
+			return err
+		}
+		total += len(body)
+
+		if ((i % 100) == 0) && (i > 0) {
+			log.Printf("appended %d synthetic messages (%d bytes). Rate: %f msg/s", i, total, float64(i)/time.Since(startTime).Seconds())
+		}
+	}
+	log.Printf("appended %d synthetic messages (%d bytes) in %s", count, total, time.Since(startTime))
+	return nil
+}
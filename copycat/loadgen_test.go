@@ -0,0 +1,188 @@
+package copycat
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/mail"
+	"os"
+	"testing"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+func TestParseSizeDistribution(t *testing.T) {
+	dist, err := ParseSizeDistribution("4k:70, 64K:25,2m:5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(dist.Sizes) != "[4096 65536 2097152]" || fmt.Sprint(dist.Weights) != "[70 25 5]" {
+		t.Errorf("unexpected distribution: %v %v", dist.Sizes, dist.Weights)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		if size := dist.Pick(r); size != 4096 && size != 65536 && size != 2097152 {
+			t.Fatalf("picked a size not in the distribution: %d", size)
+		}
+	}
+
+	for _, bad := range []string{"", "4k", "4x:1", "4k:0", "4k:a", "4km:1"} {
+		if _, err = ParseSizeDistribution(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestSyntheticMessage(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, size := range []int{1024, 64 * 1024} {
+		body := SyntheticMessage(r, 1, size, time.Now())
+		msg, err := mail.ReadMessage(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.Header.Get("Message-Id")) == 0 {
+			t.Errorf("synthetic message is missing a Message-Id")
+		}
+		if len(body) < size || len(body) > size+size/4+1024 {
+			t.Errorf("expected a message of about %d bytes, got %d", size, len(body))
+		}
+		if hasBareLineEnding(body) {
+			t.Errorf("synthetic message has bare line endings")
+		}
+	}
+}
+
+func benchmarkMessages(b *testing.B, size int) [][]byte {
+	r := rand.New(rand.NewSource(1))
+	msgs := make([][]byte, 16)
+	for i := range msgs {
+		msgs[i] = SyntheticMessage(r, i, size, time.Now())
+	}
+	return msgs
+}
+
+func benchmarkTransform(b *testing.B, transform Transformer, size int) {
+	msgs := benchmarkMessages(b, size)
+	b.SetBytes(int64(len(msgs[0])))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := transform.Transform(MessageData{Body: msgs[i%len(msgs)]}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNormalizerSmall(b *testing.B) { benchmarkTransform(b, Normalizer{}, 4*1024) }
+func BenchmarkNormalizerLarge(b *testing.B) { benchmarkTransform(b, Normalizer{}, 2*1024*1024) }
+func BenchmarkMIMERepairSmall(b *testing.B) { benchmarkTransform(b, MIMERepairer{}, 4*1024) }
+func BenchmarkMIMERepairLarge(b *testing.B) { benchmarkTransform(b, MIMERepairer{}, 2*1024*1024) }
+
+func BenchmarkIndexedMessage(b *testing.B) {
+	msgs := benchmarkMessages(b, 64*1024)
+	b.SetBytes(int64(len(msgs[0])))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewIndexedMessage("<bench@example.com>", MessageData{Body: msgs[i%len(msgs)]})
+	}
+}
+
+func BenchmarkCache(b *testing.B) {
+	dir, err := ioutil.TempDir("", "cachebench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cache.Close()
+
+	msgs := benchmarkMessages(b, 64*1024)
+	b.SetBytes(int64(len(msgs[0])))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id := fmt.Sprintf("<%d@example.com>", i)
+		if err = cache.Put(id, MessageData{Body: msgs[i%len(msgs)]}); err != nil {
+			b.Fatal(err)
+		}
+		if _, err = cache.Get(id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWorkQueue(b *testing.B) {
+	queue := newWorkQueue()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			queue.Push(WorkRequest{UID: uint32(i)})
+		}
+		queue.Close()
+	}()
+	for {
+		if _, ok := queue.Pop(); !ok {
+			break
+		}
+	}
+}
+
+// BenchmarkSync times a whole sync of a source filled by LoadGen into an empty destination,
+// both on fake servers.
+func BenchmarkSync(b *testing.B) {
+	src := newFakeServer()
+	conn, err := src.Dial(false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dist, _ := ParseSizeDistribution("4k:70,64k:25,512k:5")
+	if err = LoadGen(conn, 200, dist, 1); err != nil {
+		b.Fatal(err)
+	}
+	conn.Logout(time.Second)
+
+	var total int64
+	for _, msg := range src.messages {
+		total += int64(len(msg.body))
+	}
+	b.SetBytes(total)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dir, err := ioutil.TempDir("", "syncbench")
+		if err != nil {
+			b.Fatal(err)
+		}
+		dst := newFakeServer()
+		var srcConns, dstConns []*imap.Client
+		for j := 0; j < 4; j++ {
+			srcConn, err := src.Dial(true)
+			if err != nil {
+				b.Fatal(err)
+			}
+			dstConn, err := dst.Dial(false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			srcConns, dstConns = append(srcConns, srcConn), append(dstConns, dstConn)
+		}
+		b.StartTimer()
+
+		err = SearchAndStore(srcConns, map[string][]*imap.Client{"dst": dstConns}, nil, dir, 0, nil, false)
+
+		b.StopTimer()
+		if err != nil || dst.Len() != src.Len() {
+			b.Fatalf("expected %d messages in the destination, got %d (%v)", src.Len(), dst.Len(), err)
+		}
+		for _, conn := range append(srcConns, dstConns...) {
+			conn.Logout(time.Second)
+		}
+		os.RemoveAll(dir)
+		b.StartTimer()
+	}
+}
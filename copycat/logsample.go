@@ -0,0 +1,105 @@
+package copycat
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogSampler is an output for the log that keeps a line repeated over and over (ex.
+// every append failing while a destination is down) from drowning out the rest. Lines
+// are told apart ignoring their ids, numbers and quoted values. Once a kind of line
+// has been logged Burst times in an Interval, the rest are only counted, and a summary
+// of them is logged when the Interval is up. The lines held back are still kept in the
+// Journal, if there is one.
+type LogSampler struct {
+	Burst    int
+	Interval time.Duration
+
+	mu    sync.Mutex
+	out   io.Writer
+	lines map[string]*sampledLine
+}
+
+type sampledLine struct {
+	logged     int
+	suppressed int
+	// the last one held back, for the summary
+	example string
+}
+
+var (
+	logTimestamp = regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d(\.\d+)? `)
+	// what changes between lines that are otherwise the same
+	logVariable = regexp.MustCompile(`<[^>]*>|"[^"]*"|\([^)]*\)|[0-9]+`)
+)
+
+// NewLogSampler starts summarizing the lines it held back every interval. Call Wrap to
+// start sampling the log.
+func NewLogSampler(burst int, interval time.Duration) *LogSampler {
+	s := &LogSampler{Burst: burst, Interval: interval, lines: make(map[string]*sampledLine)}
+	go func() {
+		for range time.Tick(interval) {
+			s.Flush()
+		}
+	}()
+	return s
+}
+
+// Wrap makes the sampler the log's output, in front of whatever it's writing to now.
+// It's called again whenever the log's output is replaced, ex. as the log is rotated.
+func (s *LogSampler) Wrap() {
+	current := log.Writer()
+	if current == io.Writer(s) {
+		return
+	}
+	s.mu.Lock()
+	s.out = current
+	s.mu.Unlock()
+	log.SetOutput(s)
+}
+
+func (s *LogSampler) Write(p []byte) (int, error) {
+	line := string(p)
+	key := logVariable.ReplaceAllString(logTimestamp.ReplaceAllString(line, ""), "#")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sampled := s.lines[key]
+	if sampled == nil {
+		sampled = &sampledLine{}
+		s.lines[key] = sampled
+	}
+	if sampled.logged < s.Burst {
+		sampled.logged++
+		return s.out.Write(p)
+	}
+	sampled.suppressed++
+	sampled.example = logTimestamp.ReplaceAllString(line, "")
+	Journal.Log(line)
+	return len(p), nil
+}
+
+// Flush logs a summary of each kind of line held back since the last Flush and starts
+// counting them over.
+func (s *LogSampler) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var summaries []string
+	for key, sampled := range s.lines {
+		if sampled.suppressed > 0 {
+			summaries = append(summaries, fmt.Sprintf("%s [%d more like this in the last %s]\n", strings.TrimSuffix(sampled.example, "\n"), sampled.suppressed, s.Interval))
+		}
+		delete(s.lines, key)
+	}
+	sort.Strings(summaries)
+	prefix := time.Now().Format("2006/01/02 15:04:05 ")
+	for _, summary := range summaries {
+		s.out.Write([]byte(prefix + summary))
+	}
+}
@@ -0,0 +1,37 @@
+package copycat
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogSampler(t *testing.T) {
+	var out bytes.Buffer
+	s := &LogSampler{Burst: 2, Interval: time.Minute, out: &out, lines: make(map[string]*sampledLine)}
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(s, "2026/01/02 03:04:05 append <%d@example.com> for bob: NO [OVERQUOTA] (%d bytes)\n", i, i*100)
+	}
+	fmt.Fprintf(s, "2026/01/02 03:04:06 folder done\n")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], "<1@example.com>") || lines[2] != "2026/01/02 03:04:06 folder done" {
+		t.Fatalf("expected the first 2 appends and the folder, got:\n%s", out.String())
+	}
+
+	out.Reset()
+	s.Flush()
+	if !strings.HasSuffix(out.String(), " append <4@example.com> for bob: NO [OVERQUOTA] (400 bytes) [3 more like this in the last 1m0s]\n") {
+		t.Errorf("unexpected summary %q", out.String())
+	}
+
+	// the count starts over
+	out.Reset()
+	fmt.Fprintf(s, "2026/01/02 03:05:05 append <5@example.com> for bob: NO [OVERQUOTA] (500 bytes)\n")
+	s.Flush()
+	if strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("expected the line to be logged again, got %q", out.String())
+	}
+}
@@ -0,0 +1,110 @@
+package copycat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// The targets NewLogTarget takes, besides "syslog://host:port".
+const (
+	LogSyslog   = "syslog"
+	LogJournald = "journald"
+	LogEventlog = "eventlog"
+)
+
+// The priorities log lines are given, as syslog numbers them.
+const (
+	priorityErr     = 3
+	priorityWarning = 4
+	priorityInfo    = 6
+)
+
+// journaldSocket is where the systemd journal takes entries in its native protocol.
+var journaldSocket = "/run/systemd/journal/socket"
+
+// NewLogTarget returns an output for the log that sends each line to the local syslog
+// ("syslog"), a remote one over UDP ("syslog://host:514"), the systemd journal
+// ("journald") or the Windows event log ("eventlog"), tagged with the tag. Lines are
+// given a priority going by what they say (see logPriority). The journal also gets the
+// run's id and the kind of any error in the line as fields, COPYCAT_RUN_ID and
+// COPYCAT_ERROR_KIND.
+func NewLogTarget(target string, tag string) (io.Writer, error) {
+	switch {
+	case target == LogJournald:
+		conn, err := net.Dial("unixgram", journaldSocket)
+		if err != nil {
+			return nil, err
+		}
+		return &journaldWriter{conn: conn, tag: tag}, nil
+	case target == LogEventlog:
+		return newEventLogWriter(tag)
+	case target == LogSyslog:
+		return newSyslogWriter("", "", tag)
+	case strings.HasPrefix(target, "syslog://"):
+		return newSyslogWriter("udp", strings.TrimPrefix(target, "syslog://"), tag)
+	}
+	return nil, fmt.Errorf("expected syslog, syslog://host:port, journald or eventlog, not %q", target)
+}
+
+// logPriority guesses how serious a log line is from the words copycat's lines use.
+func logPriority(line string) int {
+	lower := strings.ToLower(line)
+	for _, word := range []string{"quitting", "invalid ", "error", "failed"} {
+		if strings.Contains(lower, word) {
+			return priorityErr
+		}
+	}
+	for _, word := range []string{"unable", "problems", "skippin", "throttled", "giving up", "retrying"} {
+		if strings.Contains(lower, word) {
+			return priorityWarning
+		}
+	}
+	return priorityInfo
+}
+
+// logMessage is the line without the log's timestamp, which the host's logging adds itself.
+func logMessage(p []byte) string {
+	return strings.TrimSuffix(logTimestamp.ReplaceAllString(string(p), ""), "\n")
+}
+
+type journaldWriter struct {
+	conn net.Conn
+	tag  string
+}
+
+func (w *journaldWriter) Write(p []byte) (int, error) {
+	message := logMessage(p)
+	var entry bytes.Buffer
+	journaldField(&entry, "MESSAGE", message)
+	journaldField(&entry, "PRIORITY", fmt.Sprint(logPriority(message)))
+	journaldField(&entry, "SYSLOG_IDENTIFIER", w.tag)
+	journaldField(&entry, "SYSLOG_PID", fmt.Sprint(os.Getpid()))
+	if len(RunID) > 0 {
+		journaldField(&entry, "COPYCAT_RUN_ID", RunID)
+	}
+	if kind := errorKind(errors.New(message)); len(kind) > 0 {
+		journaldField(&entry, "COPYCAT_ERROR_KIND", kind)
+	}
+	if _, err := w.conn.Write(entry.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// journaldField writes the field in the journal's native format. Values with a newline
+// are written with their length instead of ending at the newline.
+func journaldField(buf *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+	buf.WriteString(name + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
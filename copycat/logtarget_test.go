@@ -0,0 +1,70 @@
+package copycat
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogPriority(t *testing.T) {
+	tests := []struct {
+		line     string
+		priority int
+	}{
+		{"There was an error during the store. (EOF) quitting process.", priorityErr},
+		{"Unable to search for message (<a@b>): EOF. skippin!", priorityWarning},
+		{"bob is being throttled (NO [THROTTLED]). cooling down for 1m0s", priorityWarning},
+		{"sync complete", priorityInfo},
+	}
+	for _, test := range tests {
+		if priority := logPriority(test.line); priority != test.priority {
+			t.Errorf("logPriority(%q) = %d, expected %d", test.line, priority, test.priority)
+		}
+	}
+}
+
+func TestJournald(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journaldtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(socket string, id string) { journaldSocket, RunID = socket, id }(journaldSocket, RunID)
+	journaldSocket = filepath.Join(dir, "socket")
+	RunID = "run-1"
+
+	server, err := net.ListenPacket("unixgram", journaldSocket)
+	if err != nil {
+		t.Skipf("no unix sockets: %s", err.Error())
+	}
+	defer server.Close()
+	w, err := NewLogTarget(LogJournald, "copycat-imap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New(w, "", log.LstdFlags)
+	logger.Print("append <a@b> for bob: NO [OVERQUOTA] mailbox is full. skipping!")
+
+	buf := make([]byte, 4096)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := string(buf[:n])
+	for _, field := range []string{"MESSAGE=append <a@b> for bob: NO [OVERQUOTA] mailbox is full. skipping!\n", "PRIORITY=4\n", "SYSLOG_IDENTIFIER=copycat-imap\n", "COPYCAT_RUN_ID=run-1\n", "COPYCAT_ERROR_KIND=quota exceeded\n"} {
+		if !strings.Contains(entry, field) {
+			t.Errorf("expected %q in the entry:\n%s", field, entry)
+		}
+	}
+
+	var field bytes.Buffer
+	journaldField(&field, "MESSAGE", "two\nlines")
+	if field.String() != "MESSAGE\n\x09\x00\x00\x00\x00\x00\x00\x00two\nlines\n" {
+		t.Errorf("unexpected multi-line field %q", field.String())
+	}
+}
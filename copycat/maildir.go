@@ -0,0 +1,318 @@
+package copycat
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MaildirIndexNotmuch = "notmuch"
+	MaildirIndexMu      = "mu"
+
+	// how long to wait after a delivery before running the indexer
+	maildirIndexDelay = 30 * time.Second
+
+	// where mu keeps its database for the maildir, like notmuch keeps its in .notmuch
+	maildirMuHome = ".mu"
+)
+
+// maildirIndexerDirs are the indexers' own directories in a maildir, which aren't folders.
+var maildirIndexerDirs = map[string]bool{".notmuch": true, maildirMuHome: true}
+
+// maildir info flags for the IMAP system flags
+var maildirFlags = map[string]string{
+	`\Draft`:    "D",
+	`\Flagged`:  "F",
+	`\Answered`: "R",
+	`\Seen`:     "S",
+	`\Deleted`:  "T",
+}
+
+// MaildirSink is a Sink that delivers messages into a local Maildir. Messages
+// are written to tmp/ and moved into new/ (or cur/ if they have any flags) with
+// LF line endings. INBOX is delivered to the top of the Maildir and any other
+// folder to a Maildir++ subfolder (ex. Work/Reports goes to .Work.Reports).
+// If Indexer is set to "notmuch" or "mu", it will be run shortly after messages
+// are delivered so local mail tools pick them up. Either one indexes Dir into a
+// database of its own there (.notmuch or .mu), not the one in the user's config.
+//
+// If Dovecot is set, the Maildir is written the way Dovecot keeps one so it can be
+// brought in with doveadm import without losing anything: keywords are kept as
+// letters listed in each folder's dovecot-keywords file, file names carry the
+// message's size and size with CRLF line endings (S= and W=) and folders are listed
+// in the subscriptions file.
+type MaildirSink struct {
+	Dir     string
+	Indexer string
+	Dovecot bool
+
+	mu       sync.Mutex
+	seen     map[string]bool
+	folders  map[string]bool
+	keywords map[string]map[string]int
+	count    int
+	hostname string
+	indexing *time.Timer
+}
+
+// NewMaildirSink will create the Maildir if needed and learn the Message-Ids it already holds.
+func NewMaildirSink(dir string, indexer string) (*MaildirSink, error) {
+	if indexer != "" && indexer != MaildirIndexNotmuch && indexer != MaildirIndexMu {
+		return nil, fmt.Errorf("unknown maildir indexer: %q", indexer)
+	}
+
+	m := &MaildirSink{Dir: dir, Indexer: indexer, seen: make(map[string]bool), folders: make(map[string]bool), keywords: make(map[string]map[string]int)}
+	if err := m.createFolder(""); err != nil {
+		return nil, err
+	}
+	m.hostname, _ = os.Hostname()
+	m.hostname = strings.NewReplacer("/", "_", ":", "_").Replace(m.hostname)
+
+	// the top level and every Maildir++ subfolder
+	subfolders := []string{""}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), ".") && !maildirIndexerDirs[entry.Name()] {
+			subfolders = append(subfolders, entry.Name())
+			m.folders[entry.Name()] = true
+		}
+	}
+
+	for _, subfolder := range subfolders {
+		for _, sub := range []string{"new", "cur"} {
+			files, err := ioutil.ReadDir(filepath.Join(dir, subfolder, sub))
+			if err != nil {
+				continue
+			}
+			for _, file := range files {
+				if id := maildirMessageId(filepath.Join(dir, subfolder, sub, file.Name())); len(id) > 0 {
+					m.seen[subfolder+"\x00"+id] = true
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// maildirSubfolder returns the Maildir++ directory for an IMAP folder.
+func maildirSubfolder(folder string) string {
+	if strings.EqualFold(folder, "INBOX") {
+		return ""
+	}
+	return "." + strings.NewReplacer("/", ".", ".", "_").Replace(strings.Trim(folder, "/"))
+}
+
+// createFolder makes the tmp, new and cur directories for the subfolder if needed.
+func (m *MaildirSink) createFolder(subfolder string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(m.Dir, subfolder, sub), 0700); err != nil {
+			return err
+		}
+	}
+	m.folders[subfolder] = true
+	if m.Dovecot && len(subfolder) > 0 {
+		return appendLine(filepath.Join(m.Dir, "subscriptions"), strings.TrimPrefix(subfolder, "."))
+	}
+	return nil
+}
+
+// keywordLetter returns the letter Dovecot keeps the keyword as in the subfolder's file
+// names, adding it to the subfolder's dovecot-keywords file if it's new. There are only
+// 26 letters, so false is returned for any keywords after that. m.mu must be held.
+func (m *MaildirSink) keywordLetter(subfolder string, keyword string) (string, bool, error) {
+	path := filepath.Join(m.Dir, subfolder, "dovecot-keywords")
+	keywords, loaded := m.keywords[subfolder]
+	if !loaded {
+		// lines of "index keyword"
+		keywords = make(map[string]int)
+		if raw, err := ioutil.ReadFile(path); err == nil {
+			for _, line := range strings.Split(string(raw), "\n") {
+				var index int
+				var name string
+				if n, _ := fmt.Sscanf(line, "%d %s", &index, &name); n == 2 {
+					keywords[name] = index
+				}
+			}
+		}
+		m.keywords[subfolder] = keywords
+	}
+
+	index, exists := keywords[keyword]
+	if !exists {
+		if len(keywords) >= 26 {
+			return "", false, nil
+		}
+		index = len(keywords)
+		if err := appendLine(path, fmt.Sprintf("%d %s", index, keyword)); err != nil {
+			return "", false, err
+		}
+		keywords[keyword] = index
+	}
+	return string(rune('a' + index)), true, nil
+}
+
+func appendLine(path string, line string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(line + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// maildirMessageId reads just enough of a file to find its Message-Id.
+func maildirMessageId(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	msg, err := mail.ReadMessage(bufio.NewReader(io.LimitReader(file, 256*1024)))
+	if err != nil {
+		return ""
+	}
+	return msg.Header.Get("Message-Id")
+}
+
+func (m *MaildirSink) Has(folder string, messageId string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.seen[maildirSubfolder(folder)+"\x00"+messageId], nil
+}
+
+func (m *MaildirSink) Put(folder string, messageId string, msg MessageData) error {
+	subfolder := maildirSubfolder(folder)
+	m.mu.Lock()
+	if !m.folders[subfolder] {
+		if err := m.createFolder(subfolder); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+	}
+	m.count++
+	name := fmt.Sprintf("%d.P%d_%d.%s", time.Now().Unix(), os.Getpid(), m.count, m.hostname)
+
+	var info []string
+	for _, flag := range msg.Flags {
+		if letter, exists := maildirFlags[flag]; exists {
+			info = append(info, letter)
+		} else if m.Dovecot && !strings.HasPrefix(flag, `\`) {
+			letter, ok, err := m.keywordLetter(subfolder, flag)
+			if err != nil {
+				m.mu.Unlock()
+				return err
+			}
+			if !ok {
+				log.Printf("Too many keywords in maildir folder %s to keep %s on message (%s)", folder, flag, messageId)
+				continue
+			}
+			info = append(info, letter)
+		}
+	}
+	m.mu.Unlock()
+
+	dir := filepath.Join(m.Dir, subfolder)
+	body := bytes.Replace(msg.Body, []byte("\r\n"), []byte("\n"), -1)
+	if m.Dovecot {
+		name += fmt.Sprintf(",S=%d,W=%d", len(body), len(body)+bytes.Count(body, []byte("\n")))
+	}
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, body, 0600); err != nil {
+		return err
+	}
+
+	dst := filepath.Join(dir, "new", name)
+	if len(info) > 0 {
+		sort.Strings(info)
+		dst = filepath.Join(dir, "cur", name+":2,"+strings.Join(info, ""))
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if !msg.InternalDate.IsZero() {
+		os.Chtimes(dst, msg.InternalDate, msg.InternalDate)
+	}
+
+	m.mu.Lock()
+	m.seen[subfolder+"\x00"+messageId] = true
+	m.scheduleIndex()
+	m.mu.Unlock()
+	return nil
+}
+
+// scheduleIndex will run the indexer once deliveries have quieted down. m.mu must be held.
+func (m *MaildirSink) scheduleIndex() {
+	if len(m.Indexer) == 0 {
+		return
+	}
+	if m.indexing != nil {
+		m.indexing.Reset(maildirIndexDelay)
+		return
+	}
+	m.indexing = time.AfterFunc(maildirIndexDelay, m.runIndexer)
+}
+
+func (m *MaildirSink) runIndexer() {
+	var cmds []*exec.Cmd
+	switch m.Indexer {
+	case MaildirIndexNotmuch:
+		// the database (and mail root) is the maildir, whatever the config says
+		cmd := exec.Command("notmuch", "new")
+		cmd.Env = append(os.Environ(), "NOTMUCH_DATABASE="+m.Dir)
+		cmds = append(cmds, cmd)
+	case MaildirIndexMu:
+		// mu init would wipe a database that's already there
+		home := filepath.Join(m.Dir, maildirMuHome)
+		if _, err := os.Stat(home); os.IsNotExist(err) {
+			cmds = append(cmds, exec.Command("mu", "init", "--muhome="+home, "--maildir="+m.Dir))
+		}
+		cmds = append(cmds, exec.Command("mu", "index", "--muhome="+home))
+	default:
+		return
+	}
+
+	log.Printf("running %s to index %s", m.Indexer, m.Dir)
+	for _, cmd := range cmds {
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("Problems running %s: %s (%s)", m.Indexer, err.Error(), strings.TrimSpace(string(out)))
+			return
+		}
+	}
+}
+
+// Close will run the indexer right away if any deliveries are waiting on it.
+func (m *MaildirSink) Close() error {
+	if m.Dovecot {
+		log.Printf("import the maildir into dovecot with: doveadm import -u <user> maildir:%s \"\" all", m.Dir)
+	}
+	m.mu.Lock()
+	pending := m.indexing != nil && m.indexing.Stop()
+	m.indexing = nil
+	m.mu.Unlock()
+
+	if pending {
+		m.runIndexer()
+	}
+	return nil
+}
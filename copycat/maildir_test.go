@@ -0,0 +1,120 @@
+package copycat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaildirSinkDovecot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildirtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	box, err := NewMaildirSink(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	box.Dovecot = true
+	body := []byte("Message-Id: <1@example.com>\r\nSubject: hi\r\n\r\nhello\r\n")
+	if err = box.Put("Work/Reports", "<1@example.com>", MessageData{Body: body, Flags: []string{`\Seen`, "$Forwarded", "Urgent", `\Recent`}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = box.Put("Work/Reports", "<2@example.com>", MessageData{Body: body, Flags: []string{"Urgent"}}); err != nil {
+		t.Fatal(err)
+	}
+	box.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, ".Work.Reports", "cur", "*"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 messages, got %v", files)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, filepath.Base(file))
+	}
+	all := strings.Join(names, " ")
+	if !strings.Contains(all, ",S=47,W=51:2,Sab") || !strings.Contains(all, ",S=47,W=51:2,b") {
+		t.Errorf("unexpected file names: %s", all)
+	}
+
+	keywords, _ := ioutil.ReadFile(filepath.Join(dir, ".Work.Reports", "dovecot-keywords"))
+	if string(keywords) != "0 $Forwarded\n1 Urgent\n" {
+		t.Errorf("unexpected keywords: %q", keywords)
+	}
+	subscriptions, _ := ioutil.ReadFile(filepath.Join(dir, "subscriptions"))
+	if string(subscriptions) != "Work.Reports\n" {
+		t.Errorf("unexpected subscriptions: %q", subscriptions)
+	}
+}
+
+func TestMaildirSubfolder(t *testing.T) {
+	tests := map[string]string{
+		"INBOX":        "",
+		"inbox":        "",
+		"Sent":         ".Sent",
+		"Work/Reports": ".Work.Reports",
+		"v1.2":         ".v1_2",
+	}
+	for folder, want := range tests {
+		if got := maildirSubfolder(folder); got != want {
+			t.Errorf("maildirSubfolder(%q) = %q, want %q", folder, got, want)
+		}
+	}
+}
+
+func TestMaildirIndexer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildirtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// stand-ins for notmuch and mu that log how they were run
+	bin := filepath.Join(dir, "bin")
+	log := filepath.Join(dir, "log")
+	if err = os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"notmuch", "mu"} {
+		script := "#!/bin/sh\necho \"" + name + " $* $NOTMUCH_DATABASE\" >> " + log + "\n"
+		if err = ioutil.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	box := filepath.Join(dir, "mail")
+	for _, indexer := range []string{MaildirIndexNotmuch, MaildirIndexMu} {
+		sink, err := NewMaildirSink(box, indexer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink.runIndexer()
+	}
+	// mu's database is only set up the first time
+	os.Mkdir(filepath.Join(box, maildirMuHome), 0755)
+	sink, _ := NewMaildirSink(box, MaildirIndexMu)
+	sink.runIndexer()
+
+	raw, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := filepath.Join(box, maildirMuHome)
+	expected := "notmuch new " + box + "\n" +
+		"mu init --muhome=" + home + " --maildir=" + box + " \n" +
+		"mu index --muhome=" + home + " \n" +
+		"mu index --muhome=" + home + " \n"
+	if string(raw) != expected {
+		t.Errorf("expected the indexers to be pointed at the maildir:\n%s\ngot:\n%s", expected, raw)
+	}
+	if sink.folders[maildirMuHome] {
+		t.Errorf("expected mu's database not to be taken for a folder")
+	}
+}
@@ -0,0 +1,125 @@
+package copycat
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// MemcacheConfig is how to connect to the memcached servers the purge uses.
+type MemcacheConfig struct {
+	// Servers are host:port addresses or paths to unix sockets.
+	Servers []string
+	// DialTimeout is how long to wait on a connection, or Timeout if it's 0.
+	DialTimeout time.Duration
+	// Timeout is how long to wait on a read or write. memcache's default is used if it's 0.
+	Timeout time.Duration
+	// MaxIdleConns is how many idle connections are kept to each server.
+	MaxIdleConns int
+	// Consistent spreads keys over the servers with a hash ring, so adding or removing
+	// a server only moves the keys near it instead of nearly all of them.
+	Consistent bool
+}
+
+// Memcache is the MemcacheConfig used to connect to memcached.
+var Memcache = MemcacheConfig{Servers: []string{MemcacheServer}}
+
+// NewClient creates a memcache client for the servers.
+func (c MemcacheConfig) NewClient() (*memcache.Client, error) {
+	if len(c.Servers) == 0 {
+		return nil, fmt.Errorf("no memcached servers")
+	}
+	var selector memcache.ServerSelector
+	if c.Consistent {
+		ring, err := newHashRing(c.Servers)
+		if err != nil {
+			return nil, err
+		}
+		selector = ring
+	} else {
+		list := new(memcache.ServerList)
+		if err := list.SetServers(c.Servers...); err != nil {
+			return nil, err
+		}
+		selector = list
+	}
+
+	client := memcache.NewFromSelector(selector)
+	client.Timeout = c.Timeout
+	client.MaxIdleConns = c.MaxIdleConns
+	if c.DialTimeout > 0 {
+		dialer := &net.Dialer{Timeout: c.DialTimeout}
+		client.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, address)
+		}
+	}
+	return client, nil
+}
+
+// how many points each server gets on the hash ring, to spread keys evenly
+const ringPoints = 160
+
+// hashRing is a memcache.ServerSelector that uses consistent hashing.
+type hashRing struct {
+	addrs  []net.Addr
+	points []uint32
+	// point -> addr
+	owners map[uint32]net.Addr
+}
+
+func newHashRing(servers []string) (*hashRing, error) {
+	ring := &hashRing{owners: make(map[uint32]net.Addr)}
+	for _, server := range servers {
+		var addr net.Addr
+		var err error
+		if strings.Contains(server, "/") {
+			addr, err = net.ResolveUnixAddr("unix", server)
+		} else {
+			addr, err = net.ResolveTCPAddr("tcp", server)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ring.addrs = append(ring.addrs, addr)
+		for i := 0; i < ringPoints; i++ {
+			// the server's name is hashed instead of its address so the ring doesn't
+			// change when it resolves differently
+			point := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s-%d", server, i)))
+			if _, taken := ring.owners[point]; taken {
+				continue
+			}
+			ring.owners[point] = addr
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring, nil
+}
+
+// PickServer returns the server owning the first point on the ring after the key's hash.
+func (r *hashRing) PickServer(key string) (net.Addr, error) {
+	if len(r.points) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]], nil
+}
+
+func (r *hashRing) Each(f func(net.Addr) error) error {
+	for _, addr := range r.addrs {
+		if err := f(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package copycat
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHashRing(t *testing.T) {
+	three, err := newHashRing([]string{"127.0.0.1:11211", "127.0.0.2:11211", "127.0.0.3:11211"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	four, err := newHashRing([]string{"127.0.0.1:11211", "127.0.0.2:11211", "127.0.0.3:11211", "127.0.0.4:11211"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const keys = 10000
+	counts := make(map[string]int)
+	var moved int
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("<%d@example.com>", i)
+		before, _ := three.PickServer(key)
+		after, _ := four.PickServer(key)
+		counts[before.String()]++
+		if before.String() != after.String() {
+			moved++
+			if after.String() != "127.0.0.4:11211" {
+				t.Fatalf("%s moved from %s to %s instead of the new server", key, before, after)
+			}
+		}
+	}
+
+	// every server gets a fair share and only about a quarter of the keys move
+	for server, count := range counts {
+		if count < keys/5 {
+			t.Errorf("expected %s to get about a third of the keys, got %d", server, count)
+		}
+	}
+	if moved < keys/8 || moved > keys*3/8 {
+		t.Errorf("expected about a quarter of the keys to move, %d did", moved)
+	}
+}
+
+func TestMemcacheConfig(t *testing.T) {
+	if _, err := (MemcacheConfig{}).NewClient(); err == nil {
+		t.Error("expected an error without servers")
+	}
+	if _, err := (MemcacheConfig{Servers: []string{"nohost"}, Consistent: true}).NewClient(); err == nil {
+		t.Error("expected an error for an invalid server")
+	}
+	client, err := MemcacheConfig{Servers: []string{"127.0.0.1:11211", "127.0.0.2:11211"}, DialTimeout: time.Second, Timeout: 50 * time.Millisecond, MaxIdleConns: 8}.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Timeout != 50*time.Millisecond || client.MaxIdleConns != 8 || client.DialContext == nil {
+		t.Errorf("options weren't set on the client: %+v", client)
+	}
+}
@@ -0,0 +1,70 @@
+package copycat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+const syntheticIdDomain = "copycat-imap.invalid"
+
+// DedupHeaders are headers a message is also looked for by in the destinations, for
+// copies made by other migration tools that moved the original Message-Id into one,
+// ex. X-MS-Exchange-Organization-OriginalMessageId.
+var DedupHeaders []string
+
+// dedupSearch is a search for messages with the id in the header or any DedupHeaders.
+func dedupSearch(header string, id string) []imap.Field {
+	var search []imap.Field
+	for range DedupHeaders {
+		search = append(search, "OR")
+	}
+	search = append(search, "HEADER", header, id)
+	for _, alternate := range DedupHeaders {
+		search = append(search, "HEADER", alternate, id)
+	}
+	return search
+}
+
+// SyntheticMessageId derives a stable Message-Id from the header of a message
+// that does not have one. Line endings and NUL bytes are normalized first so
+// the id does not change if the message is normalized on its way over.
+func SyntheticMessageId(header []byte) string {
+	header = bytes.Replace(header, []byte{0}, nil, -1)
+	header = bytes.TrimRight(toCRLF(header), "\r\n")
+	sum := sha256.Sum256(header)
+	return fmt.Sprintf("<%x@%s>", sum[:16], syntheticIdDomain)
+}
+
+// IsSyntheticMessageId will check if the id was created by SyntheticMessageId.
+func IsSyntheticMessageId(id string) bool {
+	return strings.HasSuffix(id, "@"+syntheticIdDomain+">")
+}
+
+// MessageIdGenerator is a Transformer that injects a SyntheticMessageId into
+// any message without a Message-Id. It needs to run before anything that
+// rewrites headers so the id matches the one used to search the destinations.
+type MessageIdGenerator struct {
+	Report *Report
+}
+
+func (g MessageIdGenerator) Transform(msg MessageData) (MessageData, error) {
+	if len(messageId(msg.Body)) > 0 {
+		return msg, nil
+	}
+
+	header, _, _ := splitMessage(toCRLF(msg.Body))
+	id := SyntheticMessageId(header)
+
+	newline := "\n"
+	if bytes.Contains(msg.Body, []byte("\r\n")) {
+		newline = "\r\n"
+	}
+	msg.Body = append([]byte("Message-Id: "+id+newline), msg.Body...)
+
+	g.Report.Altered(id, "added synthetic Message-Id")
+	return msg, nil
+}
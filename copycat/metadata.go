@@ -0,0 +1,88 @@
+package copycat
+
+import (
+	"log"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// CopyMetadata has SyncFolders copy the annotations on each folder (ex. its color or
+// comment, or settings clients keep there) to the destinations with the METADATA
+// extension (RFC 5464). Annotations a destination won't take are listed in the RunReport.
+var CopyMetadata bool
+
+// Metadata is a folder's annotations by entry, ex. {"/private/comment": "invoices"}.
+type Metadata map[string]string
+
+// GetMetadata asks the server for every annotation on the folder with GETMETADATA.
+func GetMetadata(conn *imap.Client, folder string) (Metadata, error) {
+	cmd, err := imap.Wait(conn.Send("GETMETADATA", []imap.Field{"DEPTH", "infinity"}, conn.Quote(folder), []imap.Field{conn.Quote("/private"), conn.Quote("/shared")}))
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(Metadata)
+	for _, rsp := range cmd.Data {
+		// * METADATA folder (entry value [entry value]...)
+		if rsp.Label != "METADATA" || len(rsp.Fields) < 3 {
+			continue
+		}
+		entries := imap.AsList(rsp.Fields[2])
+		for i := 0; i+1 < len(entries); i += 2 {
+			value := imap.AsString(entries[i+1])
+			if len(value) == 0 {
+				// larger values come back as literals
+				value = string(imap.AsBytes(entries[i+1]))
+			}
+			// NIL is an entry that isn't set
+			if len(value) > 0 {
+				metadata[imap.AsString(entries[i])] = value
+			}
+		}
+	}
+	return metadata, nil
+}
+
+// SetMetadata sets an annotation on the folder with SETMETADATA.
+func SetMetadata(conn *imap.Client, folder string, entry string, value string) error {
+	_, err := imap.Wait(conn.Send("SETMETADATA", conn.Quote(folder), []imap.Field{conn.Quote(entry), conn.Quote(value)}))
+	return err
+}
+
+// sourceMetadata reads the annotations of each folder that has any for CopyMetadata.
+func sourceMetadata(conn *imap.Client, user string, folders []string) map[string]Metadata {
+	metadata := make(map[string]Metadata)
+	if !conn.Caps["METADATA"] {
+		log.Printf("The source %s doesn't have the METADATA extension. folder annotations won't be copied", user)
+		return metadata
+	}
+	for _, folder := range folders {
+		entries, err := GetMetadata(conn, folder)
+		if err != nil {
+			log.Printf("Unable to read the annotations of folder %s in %s: %s", folder, user, err.Error())
+			continue
+		}
+		if len(entries) > 0 {
+			metadata[folder] = entries
+		}
+	}
+	return metadata
+}
+
+// copyMetadata sets the source annotations on the destination's folders. names is the
+// destination name of each source folder. Each entry is set on its own, since servers
+// refuse a whole SETMETADATA over one entry they don't take, and any that are refused
+// are reported.
+func copyMetadata(conn *imap.Client, dstUser string, metadata map[string]Metadata, names map[string]string) {
+	for folder, entries := range metadata {
+		for entry, value := range entries {
+			if !conn.Caps["METADATA"] {
+				RunReport.Unsupported(dstUser, names[folder], entry)
+				continue
+			}
+			if err := SetMetadata(conn, names[folder], entry, value); err != nil {
+				log.Printf("Unable to set the annotation %s on folder %s in %s: %s", entry, names[folder], dstUser, err.Error())
+				RunReport.Unsupported(dstUser, names[folder], entry)
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package copycat
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopyMetadata(t *testing.T) {
+	defer func(r *Report) { RunReport = r }(RunReport)
+	RunReport = NewReport()
+
+	src := newFakeServer("METADATA")
+	src.metadata["Work"] = Metadata{"/private/color": "#ff0000", "/shared/comment": `the "work" folder`}
+	srcConn := dialFake(t, src)
+	defer srcConn.Logout(time.Second)
+
+	metadata := sourceMetadata(srcConn, "fred", []string{"INBOX", "Work"})
+	if len(metadata) != 1 || metadata["Work"]["/private/color"] != "#ff0000" || metadata["Work"]["/shared/comment"] != `the "work" folder` {
+		t.Fatalf("unexpected source annotations %v", metadata)
+	}
+
+	// each entry is set on its own, so one the destination won't take is all that's reported
+	dst := newFakeServer("METADATA")
+	dst.refuse["/private/color"] = true
+	dstConn := dialFake(t, dst)
+	defer dstConn.Logout(time.Second)
+	names := map[string]string{"Work": "INBOX.Work"}
+	copyMetadata(dstConn, "fred@example.com", metadata, names)
+	if len(dst.metadata["INBOX.Work"]) != 1 || dst.metadata["INBOX.Work"]["/shared/comment"] != `the "work" folder` {
+		t.Errorf("unexpected destination annotations %v", dst.metadata)
+	}
+
+	// without the METADATA extension on the destination, every entry is reported
+	plain := dialFake(t, newFakeServer())
+	defer plain.Logout(time.Second)
+	copyMetadata(plain, "other@example.com", metadata, names)
+
+	out := RunReport.String()
+	for _, want := range []string{"3 folder annotation(s) not copied", "fred@example.com INBOX.Work: /private/color\n", "other@example.com INBOX.Work: /private/color\n", "other@example.com INBOX.Work: /shared/comment\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report is missing %q:\n%s", want, out)
+		}
+	}
+
+	// and nothing is read from a source without it
+	if metadata = sourceMetadata(plain, "fred", []string{"Work"}); len(metadata) > 0 {
+		t.Errorf("expected no annotations from a source without the extension, got %v", metadata)
+	}
+}
@@ -0,0 +1,218 @@
+package copycat
+
+import (
+	"strings"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// The kinds of shared namespaces, for SharedNamespaces.
+const (
+	OtherUsersNamespace = "other"
+	SharedNamespace     = "shared"
+)
+
+// SharedNamespaces opts folders in the source's shared namespaces in to SyncFolders.
+// Each is the prefix of a namespace (ex. "#public/") or OtherUsersNamespace or
+// SharedNamespace for every namespace of that kind. Folders in shared namespaces
+// that aren't listed are left out.
+var SharedNamespaces []string
+
+// Namespaces are the folder prefixes of each kind of namespace on a server (RFC 2342).
+type Namespaces struct {
+	Personal []string
+	// Other is where other users' folders are, ex. "Other Users/" or "user.".
+	Other []string
+	// Shared is where shared and public folders are, ex. "#shared/" or "#public/".
+	Shared []string
+}
+
+// GetNamespaces asks the server for its namespaces with NAMESPACE. Servers without
+// NAMESPACE have no namespaces, so folders can go anywhere.
+func GetNamespaces(conn *imap.Client) (Namespaces, error) {
+	var ns Namespaces
+	if !conn.Caps["NAMESPACE"] {
+		return ns, nil
+	}
+	cmd, err := imap.Wait(conn.Send("NAMESPACE"))
+	if err != nil {
+		return ns, err
+	}
+	for _, rsp := range cmd.Data {
+		// * NAMESPACE (("INBOX." ".")) (("user." ".")) (("shared." "."))
+		if rsp.Label != "NAMESPACE" || len(rsp.Fields) < 4 {
+			continue
+		}
+		ns.Personal = namespacePrefixes(rsp.Fields[1])
+		ns.Other = namespacePrefixes(rsp.Fields[2])
+		ns.Shared = namespacePrefixes(rsp.Fields[3])
+	}
+	return ns, nil
+}
+
+// namespacePrefixes reads the prefixes out of a list of namespaces, or NIL for none.
+func namespacePrefixes(field imap.Field) []string {
+	var prefixes []string
+	for _, namespace := range imap.AsList(field) {
+		if parts := imap.AsList(namespace); len(parts) > 0 {
+			prefixes = append(prefixes, imap.AsString(parts[0]))
+		}
+	}
+	return prefixes
+}
+
+// PersonalNamespace asks the server which prefix the user's own folders are created
+// under, ex. "INBOX." on Courier and Cyrus. It returns "" for servers without
+// NAMESPACE or a personal namespace.
+func PersonalNamespace(conn *imap.Client) (string, error) {
+	ns, err := GetNamespaces(conn)
+	return ns.personal(), err
+}
+
+func (ns Namespaces) personal() string {
+	if len(ns.Personal) == 0 {
+		return ""
+	}
+	return ns.Personal[0]
+}
+
+// shared returns the kind and prefix of the shared namespace the folder is in, if any.
+func (ns Namespaces) shared(folder string) (kind string, prefix string) {
+	for _, prefix := range ns.Other {
+		if stripNamespace(folder, prefix) != folder {
+			return OtherUsersNamespace, prefix
+		}
+	}
+	for _, prefix := range ns.Shared {
+		if stripNamespace(folder, prefix) != folder {
+			return SharedNamespace, prefix
+		}
+	}
+	return "", ""
+}
+
+// first returns the first prefix of the kind of shared namespace, or "" if there isn't one.
+func (ns Namespaces) first(kind string) string {
+	prefixes := ns.Shared
+	if kind == OtherUsersNamespace {
+		prefixes = ns.Other
+	}
+	if len(prefixes) == 0 {
+		return ""
+	}
+	return prefixes[0]
+}
+
+// sharedIncluded reports if a shared namespace is opted in by SharedNamespaces.
+func sharedIncluded(kind string, prefix string) bool {
+	for _, included := range SharedNamespaces {
+		if included == kind || strings.EqualFold(included, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedFolders lists the folders in the source's opted in shared namespaces. Servers
+// often leave these out of a plain LIST.
+func sharedFolders(conn *imap.Client, ns Namespaces) ([]string, error) {
+	var folders []string
+	for _, group := range []struct {
+		kind     string
+		prefixes []string
+	}{{OtherUsersNamespace, ns.Other}, {SharedNamespace, ns.Shared}} {
+		for _, prefix := range group.prefixes {
+			if !sharedIncluded(group.kind, prefix) {
+				continue
+			}
+			names, err := listFolders(conn, prefix+"*")
+			if err != nil {
+				return nil, err
+			}
+			folders = append(folders, names...)
+		}
+	}
+	return folders, nil
+}
+
+// stripNamespace takes the namespace prefix off of a folder name.
+func stripNamespace(name string, prefix string) string {
+	if len(prefix) > 0 && len(name) > len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+		return name[len(prefix):]
+	}
+	return name
+}
+
+// addNamespace puts a folder name under the namespace prefix. The INBOX is always
+// at the top and names already under the prefix are left alone.
+func addNamespace(name string, prefix string) string {
+	if len(prefix) == 0 || strings.EqualFold(name, "INBOX") || stripNamespace(name, prefix) != name {
+		return name
+	}
+	return prefix + name
+}
+
+// placeFolder returns the destination namespace prefix a source folder goes in and its
+// name within it. Shared folders go in the destination's first namespace of the same
+// kind or, if it doesn't have one, in the personal namespace.
+func placeFolder(folder string, src Namespaces, dst Namespaces) (prefix string, name string) {
+	kind, srcPrefix := src.shared(folder)
+	if len(kind) == 0 {
+		return dst.personal(), stripNamespace(folder, src.personal())
+	}
+	if dstPrefix := dst.first(kind); len(dstPrefix) > 0 {
+		return dstPrefix, stripNamespace(folder, srcPrefix)
+	}
+	// ex. '#shared/Sales' becomes 'shared/Sales'
+	return dst.personal(), strings.TrimPrefix(folder, "#")
+}
+
+// translateFolder is the name of the folder on the destination with only its namespace
+// and hierarchy delimiter changed and, if there is one, the root put in front of it.
+func translateFolder(folder string, root string, srcDelim string, dstDelim string, src Namespaces, dst Namespaces) string {
+	prefix, name := placeFolder(folder, src, dst)
+	if len(srcDelim) > 0 && len(dstDelim) > 0 {
+		name = strings.Replace(name, srcDelim, dstDelim, -1)
+	}
+	if levels := rootLevels(root); len(levels) > 0 && len(dstDelim) > 0 {
+		name = strings.Join(append(levels, name), dstDelim)
+	}
+	return addNamespace(name, prefix)
+}
+
+// MapNamespaces is MapFolders for servers with namespaces: each folder is mapped within
+// the destination namespace it goes in (see placeFolder), with the source's prefix
+// taken off before and the destination's put on after, so 'INBOX.Work' on Courier
+// becomes 'Work' on Gmail and the other way around.
+func (r FolderRules) MapNamespaces(folders []string, srcDelim string, dstDelim string, src Namespaces, dst Namespaces) map[string]string {
+	existing := make(map[string]bool)
+	for _, folder := range folders {
+		existing[strings.ToLower(folder)] = true
+	}
+
+	// destination prefix -> the source folders going in it and their names there
+	groups := make(map[string][]string)
+	placed := make(map[string]string)
+	for _, folder := range folders {
+		prefix, name := placeFolder(folder, src, dst)
+		// a folder outside the personal namespace could already have the name
+		if kind, _ := src.shared(folder); len(kind) == 0 && name != folder && existing[strings.ToLower(name)] {
+			name = folder
+		}
+		groups[prefix] = append(groups[prefix], folder)
+		placed[folder] = name
+	}
+
+	names := make(map[string]string)
+	for prefix, group := range groups {
+		var inGroup []string
+		for _, folder := range group {
+			inGroup = append(inGroup, placed[folder])
+		}
+		mapped := r.MapFolders(inGroup, srcDelim, dstDelim)
+		for _, folder := range group {
+			names[folder] = addNamespace(mapped[placed[folder]], prefix)
+		}
+	}
+	return names
+}
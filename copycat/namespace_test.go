@@ -0,0 +1,52 @@
+package copycat
+
+import "testing"
+
+func TestMapNamespaces(t *testing.T) {
+	courier := Namespaces{Personal: []string{"INBOX."}}
+	folders := []string{"INBOX", "INBOX.Sent", "INBOX.Work.Clients", "Shared"}
+
+	// Courier to a server without a namespace
+	names := FolderRules{}.MapNamespaces(folders, ".", "/", courier, Namespaces{})
+	for folder, expected := range map[string]string{"INBOX": "INBOX", "INBOX.Sent": "Sent", "INBOX.Work.Clients": "Work/Clients", "Shared": "Shared"} {
+		if names[folder] != expected {
+			t.Errorf("expected %s to be %s, got %s", folder, expected, names[folder])
+		}
+	}
+
+	// and back again
+	names = FolderRules{}.MapNamespaces([]string{"INBOX", "Sent", "Work/Clients", "INBOX/Receipts"}, "/", ".", Namespaces{}, courier)
+	for folder, expected := range map[string]string{"INBOX": "INBOX", "Sent": "INBOX.Sent", "Work/Clients": "INBOX.Work.Clients", "INBOX/Receipts": "INBOX.Receipts"} {
+		if names[folder] != expected {
+			t.Errorf("expected %s to be %s, got %s", folder, expected, names[folder])
+		}
+	}
+
+	// a folder outside the namespace keeps its name
+	names = FolderRules{}.MapNamespaces([]string{"INBOX.Sent", "Sent"}, ".", "/", courier, Namespaces{})
+	if names["INBOX.Sent"] == names["Sent"] {
+		t.Errorf("expected different names, got %v", names)
+	}
+
+	// shared folders go in the same kind of namespace, or the personal one
+	cyrus := Namespaces{Personal: []string{"INBOX."}, Other: []string{"user."}, Shared: []string{"shared."}}
+	dovecot := Namespaces{Personal: []string{""}, Shared: []string{"#shared/"}}
+	names = FolderRules{}.MapNamespaces([]string{"INBOX.Sales", "shared.Sales", "shared.Sales.2014", "user.bob.Sent"}, ".", "/", cyrus, dovecot)
+	for folder, expected := range map[string]string{"INBOX.Sales": "Sales", "shared.Sales": "#shared/Sales", "shared.Sales.2014": "#shared/Sales/2014", "user.bob.Sent": "user/bob/Sent"} {
+		if names[folder] != expected {
+			t.Errorf("expected %s to be %s, got %s", folder, expected, names[folder])
+		}
+	}
+	if kind, prefix := cyrus.shared("user.bob.Sent"); kind != OtherUsersNamespace || prefix != "user." {
+		t.Errorf("expected user.bob.Sent to be in the other users namespace, got %s %s", kind, prefix)
+	}
+}
+
+func TestSharedIncluded(t *testing.T) {
+	SharedNamespaces = []string{SharedNamespace, "user."}
+	defer func() { SharedNamespaces = nil }()
+
+	if !sharedIncluded(SharedNamespace, "#public/") || !sharedIncluded(OtherUsersNamespace, "User.") || sharedIncluded(OtherUsersNamespace, "Other Users/") {
+		t.Error("unexpected shared namespaces included")
+	}
+}
@@ -0,0 +1,177 @@
+package copycat
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// NNTPSource is a MessageSource that reads newsgroups, for archiving them into IMAP.
+// Each group is copied to a folder of the same name (ex. comp.lang.go) and its articles
+// are checked for in the destinations by Message-Id like any other message.
+type NNTPSource struct {
+	// Host is host:port. Port 563 uses TLS.
+	Host string
+	// User and Password are sent with AUTHINFO if User is set.
+	User     string
+	Password string
+	Groups   []string
+
+	// everything goes through one conn, with the group of the last article read selected
+	mu       sync.Mutex
+	conn     *textproto.Conn
+	selected string
+}
+
+// NewNNTPSource connects to the news server and logs in if a user is given.
+func NewNNTPSource(host string, user string, password string, groups []string) (*NNTPSource, error) {
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("at least one newsgroup is required")
+	}
+	n := &NNTPSource{Host: host, User: user, Password: password, Groups: groups}
+	var conn net.Conn
+	var err error
+	if _, port, _ := net.SplitHostPort(host); port == "563" {
+		conn, err = dialTLS(host)
+	} else {
+		conn, err = dial(host)
+	}
+	if err != nil {
+		return nil, &Error{Kind: ErrConnLost, Op: "connect to " + host, Account: user, Err: err}
+	}
+	if err = n.login(conn); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// login reads the greeting and sends AUTHINFO if there's a user.
+func (n *NNTPSource) login(conn net.Conn) error {
+	n.conn = textproto.NewConn(conn)
+	// 200 is posting allowed and 201 is read only, either is fine
+	if _, _, err := n.conn.ReadCodeLine(20); err != nil {
+		n.conn.Close()
+		return wrapError("nntp greeting", n.User, err)
+	}
+	if len(n.User) == 0 {
+		return nil
+	}
+
+	// 281 is logged in without a password and 381 is send the password
+	code, line, err := n.cmd(0, "AUTHINFO USER %s", n.User)
+	switch {
+	case err != nil || code == 281:
+	case code == 381:
+		_, _, err = n.cmd(281, "AUTHINFO PASS %s", n.Password)
+	default:
+		err = fmt.Errorf("%d %s", code, line)
+	}
+	if err != nil {
+		n.conn.Close()
+		return &Error{Kind: ErrAuth, Op: "nntp login", Account: n.User, Err: err}
+	}
+	return nil
+}
+
+// cmd sends a command and reads its response, which should have the expected code.
+func (n *NNTPSource) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	id, err := n.conn.Cmd(format, args...)
+	if err != nil {
+		return 0, "", &Error{Kind: ErrConnLost, Op: "nntp", Account: n.User, Err: err}
+	}
+	n.conn.StartResponse(id)
+	defer n.conn.EndResponse(id)
+	return n.conn.ReadCodeLine(expect)
+}
+
+// group selects the newsgroup and returns its first and last article numbers.
+func (n *NNTPSource) group(name string) (first int, last int, err error) {
+	// 211 1234 3000234 3002322 misc.test
+	_, line, err := n.cmd(211, "GROUP %s", name)
+	if err != nil {
+		return 0, 0, err
+	}
+	n.selected = name
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return 0, 0, fmt.Errorf("unexpected GROUP response %q", line)
+	}
+	first, _ = strconv.Atoi(fields[1])
+	last, _ = strconv.Atoi(fields[2])
+	return first, last, nil
+}
+
+func (n *NNTPSource) List() ([]SourceMessage, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var msgs []SourceMessage
+	for _, group := range n.Groups {
+		first, last, err := n.group(group)
+		if err != nil {
+			return nil, fmt.Errorf("selecting %s: %s", group, err.Error())
+		}
+		if last < first || last == 0 {
+			continue
+		}
+
+		// number, subject, from, date, message-id, references, bytes and lines, tab separated
+		if _, _, err = n.cmd(224, "OVER %d-%d", first, last); err != nil {
+			return nil, fmt.Errorf("listing %s: %s", group, err.Error())
+		}
+		overview, err := n.conn.ReadDotLines()
+		if err != nil {
+			return nil, wrapError("nntp over", n.User, err)
+		}
+		for _, line := range overview {
+			fields := strings.Split(line, "\t")
+			if len(fields) < 5 {
+				continue
+			}
+			msgs = append(msgs, SourceMessage{Folder: group, MessageId: strings.TrimSpace(fields[4]), Key: group + " " + fields[0]})
+		}
+	}
+	return msgs, nil
+}
+
+func (n *NNTPSource) Fetch(msg SourceMessage) (MessageData, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	parts := strings.SplitN(msg.Key, " ", 2)
+	if len(parts) != 2 {
+		return MessageData{}, NotFound
+	}
+	if n.selected != parts[0] {
+		if _, _, err := n.group(parts[0]); err != nil {
+			return MessageData{}, err
+		}
+	}
+	if _, _, err := n.cmd(220, "ARTICLE %s", parts[1]); err != nil {
+		// 423 is no article with that number, which happens when it expires
+		if protoErr, ok := err.(*textproto.Error); ok && protoErr.Code == 423 {
+			return MessageData{}, NotFound
+		}
+		return MessageData{}, err
+	}
+	body, err := n.conn.ReadDotBytes()
+	if err != nil {
+		return MessageData{}, wrapError("nntp article", n.User, err)
+	}
+	// ReadDotBytes turns CRLF into LF
+	body = bytes.Replace(body, []byte("\n"), []byte("\r\n"), -1)
+
+	// articles have no flags, and the Date header is the closest thing to an internal date
+	return MessageData{Body: body, InternalDate: headerDate(body)}, nil
+}
+
+func (n *NNTPSource) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cmd(205, "QUIT")
+	return n.conn.Close()
+}
@@ -0,0 +1,108 @@
+package copycat
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeNNTP serves misc.test with two articles, the first of which has expired.
+func fakeNNTP(conn net.Conn) {
+	defer conn.Close()
+	article := "Message-Id: <2@example.com>\r\nDate: Sat, 1 Mar 2014 10:00:00 +0000\r\nNewsgroups: misc.test\r\nSubject: hi\r\n\r\nhello\r\n"
+	fmt.Fprint(conn, "201 news.example.com ready, no posting\r\n")
+	r := bufio.NewReader(conn)
+	group := ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch {
+		case line == "AUTHINFO USER fred\r\n":
+			fmt.Fprint(conn, "381 password required\r\n")
+		case fields[0] == "AUTHINFO":
+			if fields[2] != "secret" {
+				fmt.Fprint(conn, "481 authentication failed\r\n")
+				continue
+			}
+			fmt.Fprint(conn, "281 authentication accepted\r\n")
+		case fields[0] == "GROUP" && fields[1] == "misc.test":
+			group = fields[1]
+			fmt.Fprint(conn, "211 2 1 2 misc.test\r\n")
+		case fields[0] == "GROUP":
+			fmt.Fprint(conn, "411 no such group\r\n")
+		case fields[0] == "OVER" && group == "misc.test":
+			fmt.Fprint(conn, "224 overview follows\r\n"+
+				"1\texpired\tfred@example.com\tFri, 28 Feb 2014 10:00:00 +0000\t<1@example.com>\t\t100\t3\r\n"+
+				"2\thi\tfred@example.com\tSat, 1 Mar 2014 10:00:00 +0000\t<2@example.com>\t\t120\t1\r\n.\r\n")
+		case fields[0] == "ARTICLE" && group == "misc.test" && fields[1] == "2":
+			fmt.Fprintf(conn, "220 2 <2@example.com>\r\n%s.\r\n", article)
+		case fields[0] == "ARTICLE":
+			fmt.Fprint(conn, "423 no article with that number\r\n")
+		case fields[0] == "QUIT":
+			fmt.Fprint(conn, "205 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "500 unknown command\r\n")
+		}
+	}
+}
+
+func newTestNNTP(password string, groups []string) (*NNTPSource, error) {
+	client, server := net.Pipe()
+	go fakeNNTP(server)
+	n := &NNTPSource{Host: "news.example.com:119", User: "fred", Password: password, Groups: groups}
+	return n, n.login(client)
+}
+
+func TestNNTPSource(t *testing.T) {
+	if _, err := newTestNNTP("wrong", []string{"misc.test"}); !errors.Is(err, ErrAuth) {
+		t.Errorf("expected an auth error, got %v", err)
+	}
+
+	source, err := newTestNNTP("secret", []string{"misc.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	msgs, err := source.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SourceMessage{
+		{Folder: "misc.test", MessageId: "<1@example.com>", Key: "misc.test 1"},
+		{Folder: "misc.test", MessageId: "<2@example.com>", Key: "misc.test 2"},
+	}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Fatalf("expected %v, got %v", want, msgs)
+	}
+
+	if _, err = source.Fetch(msgs[0]); err != NotFound {
+		t.Errorf("expected the expired article to be missing, got %v", err)
+	}
+	data, err := source.Fetch(msgs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data.Body), "Message-Id: <2@example.com>\r\n") || !strings.HasSuffix(string(data.Body), "\r\n\r\nhello\r\n") {
+		t.Errorf("unexpected article %q", data.Body)
+	}
+	if data.InternalDate.Day() != 1 {
+		t.Errorf("expected the internal date from the Date header, got %s", data.InternalDate)
+	}
+
+	missing, err := newTestNNTP("secret", []string{"alt.missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer missing.Close()
+	if _, err = missing.List(); err == nil {
+		t.Error("expected an error for a missing group")
+	}
+}
@@ -0,0 +1,64 @@
+package copycat
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+)
+
+// Normalizer is a Transformer that makes a message's literal safe to APPEND
+// to servers that reject bare line endings: any LF or CR that is not part of
+// a CRLF is turned into one and NUL bytes are stripped. IMAP literals are
+// never dot-stuffed so leading dots are left alone. Any message that has to be
+// altered is recorded in the Report.
+type Normalizer struct {
+	Report *Report
+}
+
+func (n Normalizer) Transform(msg MessageData) (MessageData, error) {
+	var reasons []string
+	body := msg.Body
+
+	if bytes.IndexByte(body, 0) >= 0 {
+		body = bytes.Replace(body, []byte{0}, nil, -1)
+		reasons = append(reasons, "stripped NUL bytes")
+	}
+
+	if hasBareLineEnding(body) {
+		body = toCRLF(body)
+		reasons = append(reasons, "converted bare line endings to CRLF")
+	}
+
+	if len(reasons) == 0 {
+		return msg, nil
+	}
+
+	n.Report.Altered(messageId(body), strings.Join(reasons, ", "))
+	msg.Body = body
+	return msg, nil
+}
+
+func hasBareLineEnding(b []byte) bool {
+	for i, c := range b {
+		switch c {
+		case '\r':
+			if i+1 == len(b) || b[i+1] != '\n' {
+				return true
+			}
+		case '\n':
+			if i == 0 || b[i-1] != '\r' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// messageId pulls the Message-Id out of a raw message.
+func messageId(body []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	return msg.Header.Get("Message-Id")
+}
@@ -0,0 +1,48 @@
+package copycat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizer(t *testing.T) {
+	report := NewReport()
+	normalize := Normalizer{Report: report}
+
+	for _, c := range []struct {
+		body, want, reason string
+	}{
+		{"Message-Id: <lf@example.com>\nSubject: hi\n\nhello\n", "Message-Id: <lf@example.com>\r\nSubject: hi\r\n\r\nhello\r\n", "converted bare line endings to CRLF"},
+		{"Message-Id: <cr@example.com>\r\n\r\nhello\rthere\r\n", "Message-Id: <cr@example.com>\r\n\r\nhello\r\nthere\r\n", "converted bare line endings to CRLF"},
+		{"Message-Id: <nul@example.com>\r\n\r\nhel\x00lo\r\n", "Message-Id: <nul@example.com>\r\n\r\nhello\r\n", "stripped NUL bytes"},
+		{"Message-Id: <both@example.com>\n\n\x00hello\n", "Message-Id: <both@example.com>\r\n\r\nhello\r\n", "stripped NUL bytes, converted bare line endings to CRLF"},
+	} {
+		msg, err := normalize.Transform(MessageData{Body: []byte(c.body)})
+		if err != nil || string(msg.Body) != c.want {
+			t.Errorf("expected %q, got %q (%v)", c.want, msg.Body, err)
+		}
+		if entry := report.altered[len(report.altered)-1]; entry.Reason != c.reason {
+			t.Errorf("expected %q to be reported as %q, got %q", c.body, c.reason, entry.Reason)
+		}
+	}
+	if report.altered[0].MessageId != "<lf@example.com>" {
+		t.Errorf("expected the altered message's id in the report, got %q", report.altered[0].MessageId)
+	}
+
+	// a message that's fine is left alone, leading dots and all, and isn't reported
+	fine := "Message-Id: <fine@example.com>\r\n\r\n.hello\r\n..\r\n"
+	if msg, err := normalize.Transform(MessageData{Body: []byte(fine)}); err != nil || string(msg.Body) != fine {
+		t.Errorf("expected the message to be left alone, got %q (%v)", msg.Body, err)
+	}
+	if len(report.altered) != 4 {
+		t.Errorf("expected 4 altered messages in the report, got %d", len(report.altered))
+	}
+	if out := report.String(); !strings.Contains(out, "4 message(s) altered") || !strings.Contains(out, "<nul@example.com>: stripped NUL bytes") {
+		t.Errorf("report is missing the altered messages:\n%s", out)
+	}
+
+	// and there doesn't have to be a report
+	if _, err := (Normalizer{}).Transform(MessageData{Body: []byte("a\nb")}); err != nil {
+		t.Error(err)
+	}
+}
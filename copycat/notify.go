@@ -0,0 +1,42 @@
+package copycat
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Notifications sends alerts about problems found while copycat runs unattended. It
+// is nil, for alerts only in the log, unless set with NewNotifier.
+var Notifications *Notifier
+
+// Notifier POSTs alerts as JSON to a webhook, ex. {"subject": "...", "details": "..."}.
+type Notifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewNotifier(url string) *Notifier {
+	return &Notifier{URL: url, Client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Alert logs the alert and sends it to the webhook, if there is one.
+func (n *Notifier) Alert(subject string, details string) {
+	log.Printf("ALERT: %s: %s", subject, details)
+	if n == nil {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]string{"subject": subject, "details": details})
+	rsp, err := n.Client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Unable to send alert: %s", err.Error())
+		return
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		log.Printf("Unable to send alert: webhook returned %s", rsp.Status)
+	}
+}
@@ -0,0 +1,29 @@
+package copycat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotifier(t *testing.T) {
+	alerts := make(chan map[string]string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Error(err)
+		}
+		alerts <- alert
+	}))
+	defer server.Close()
+
+	NewNotifier(server.URL).Alert("verification failed", "<1@example.com>: missing")
+	if alert := <-alerts; alert["subject"] != "verification failed" || alert["details"] != "<1@example.com>: missing" {
+		t.Errorf("unexpected alert: %v", alert)
+	}
+
+	// alerts are only logged with a nil notifier
+	var notifier *Notifier
+	notifier.Alert("verification failed", "<1@example.com>: missing")
+}
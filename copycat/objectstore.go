@@ -0,0 +1,307 @@
+package copycat
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// messages larger than this are sent with a multipart upload
+	MultipartThreshold = 16 * 1024 * 1024
+	multipartPartSize  = 8 * 1024 * 1024
+)
+
+// ObjectSink is a Sink that writes raw messages to an S3 compatible object store.
+// Google Cloud Storage can be used through its XML API with HMAC keys. Each
+// message is stored under Prefix and its folder with a key built from its
+// Message-Id, and its folder, flags and internal date are kept as object metadata.
+type ObjectSink struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Encrypted bool
+
+	Client *http.Client
+}
+
+// NewObjectSink creates an ObjectSink for the bucket at endpoint (ex. https://s3.amazonaws.com).
+func NewObjectSink(endpoint, region, bucket, prefix, accessKey, secretKey string) (*ObjectSink, error) {
+	if len(bucket) == 0 {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	if len(accessKey) == 0 || len(secretKey) == 0 {
+		return nil, fmt.Errorf("access and secret keys are required")
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, err
+	}
+	return &ObjectSink{
+		Endpoint:  strings.TrimRight(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		Prefix:    strings.Trim(prefix, "/"),
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// ObjectKey builds a key for the message that is safe to use with any object store.
+// A bit of the Message-Id's hash is added so ids that clean up the same don't collide.
+func (o *ObjectSink) ObjectKey(folder string, messageId string) string {
+	sum := sha256.Sum256([]byte(messageId))
+	key := fmt.Sprintf("%s/%s-%x.eml", objectKeySafe(folder, true), objectKeySafe(strings.Trim(messageId, "<>"), false), sum[:4])
+	if o.Encrypted {
+		key += ".gpg"
+	}
+	if len(o.Prefix) > 0 {
+		key = o.Prefix + "/" + key
+	}
+	return key
+}
+
+// objectKeySafe replaces anything that might need escaping in a key with an underscore.
+func objectKeySafe(s string, keepSlash bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_', r == '/' && keepSlash:
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func (o *ObjectSink) Has(folder string, messageId string) (bool, error) {
+	rsp, err := o.do("HEAD", o.ObjectKey(folder, messageId), nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	rsp.Body.Close()
+
+	switch rsp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status checking for object: %s", rsp.Status)
+}
+
+func (o *ObjectSink) Put(folder string, messageId string, msg MessageData) error {
+	key := o.ObjectKey(folder, messageId)
+	header := http.Header{}
+	header.Set("Content-Type", "message/rfc822")
+	header.Set("X-Amz-Meta-Message-Id", messageId)
+	header.Set("X-Amz-Meta-Folder", mime.QEncoding.Encode("utf-8", folder))
+	header.Set("X-Amz-Meta-Flags", strings.Join(msg.Flags, " "))
+	header.Set("X-Amz-Meta-Internal-Date", msg.InternalDate.Format(time.RFC3339))
+	if o.Encrypted && len(msg.plainSHA256) > 0 {
+		header.Set("X-Amz-Meta-Plain-Sha256", msg.plainSHA256)
+		header.Set("X-Amz-Meta-Plain-Size", strconv.Itoa(msg.plainSize))
+	}
+
+	if len(msg.Body) > MultipartThreshold {
+		return o.putMultipart(key, header, msg.Body)
+	}
+
+	rsp, err := o.do("PUT", key, nil, header, msg.Body)
+	if err != nil {
+		return err
+	}
+	return checkObjectResponse(rsp, nil)
+}
+
+func (o *ObjectSink) Close() error {
+	return nil
+}
+
+type initiateMultipartResult struct {
+	UploadId string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []multipartPart `xml:"Part"`
+}
+
+type multipartPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// putMultipart will upload the body in parts, aborting the upload if any of them fail.
+func (o *ObjectSink) putMultipart(key string, header http.Header, body []byte) (err error) {
+	rsp, err := o.do("POST", key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return err
+	}
+	var initiated initiateMultipartResult
+	if err = checkObjectResponse(rsp, &initiated); err != nil {
+		return err
+	}
+
+	uploadId := url.Values{"uploadId": {initiated.UploadId}}
+	defer func() {
+		if err != nil {
+			if rsp, abortErr := o.do("DELETE", key, uploadId, nil, nil); abortErr == nil {
+				rsp.Body.Close()
+			}
+		}
+	}()
+
+	var complete completeMultipartUpload
+	for start, part := 0, 1; start < len(body); start, part = start+multipartPartSize, part+1 {
+		end := start + multipartPartSize
+		if end > len(body) {
+			end = len(body)
+		}
+
+		query := url.Values{"uploadId": {initiated.UploadId}, "partNumber": {fmt.Sprint(part)}}
+		if rsp, err = o.do("PUT", key, query, nil, body[start:end]); err != nil {
+			return err
+		}
+		if err = checkObjectResponse(rsp, nil); err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, multipartPart{PartNumber: part, ETag: rsp.Header.Get("ETag")})
+	}
+
+	completeBody, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	if rsp, err = o.do("POST", key, uploadId, nil, completeBody); err != nil {
+		return err
+	}
+	return checkObjectResponse(rsp, nil)
+}
+
+// do will send a signed request for the key in the sink's bucket.
+func (o *ObjectSink) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := url.Parse(o.Endpoint + "/" + uriEncode(o.Bucket, false) + "/" + uriEncode(key, true))
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	sum := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(sum[:]), o.AccessKey, o.SecretKey, o.Region, time.Now())
+	return o.Client.Do(req)
+}
+
+// checkObjectResponse closes the response, returning an error for anything but a 2xx.
+// If result is given, the response body will be decoded into it.
+func checkObjectResponse(rsp *http.Response, result interface{}) error {
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return fmt.Errorf("object store returned %s: %s", rsp.Status, strings.TrimSpace(string(msg)))
+	}
+	if result != nil {
+		return xml.NewDecoder(rsp.Body).Decode(result)
+	}
+	return nil
+}
+
+// signV4 adds AWS Signature Version 4 headers to the request. Every header already on the request is signed.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery sorts and encodes the query the way SigV4 expects.
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, false)+"="+uriEncode(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode escapes everything but RFC 3986 unreserved characters (and optionally '/').
+func uriEncode(s string, keepSlash bool) string {
+	var buf bytes.Buffer
+	for _, c := range []byte(s) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
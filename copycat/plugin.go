@@ -0,0 +1,106 @@
+package copycat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const PluginTimeoutSeconds = 30
+
+// PluginRequest is written to a plugin's stdin as a single line of JSON.
+// The raw message follows it.
+type PluginRequest struct {
+	InternalDate time.Time `json:"internal_date"`
+	Size         int       `json:"size"`
+}
+
+// PluginResponse is read from a plugin's stdout as a single line of JSON.
+// Action must be one of "accept", "reject" or "replace". For "replace", the
+// rest of stdout is used as the new raw message.
+type PluginResponse struct {
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// ExecTransformer is a Transformer that hands each message to an external
+// program so things like virus scanning or DLP can be hooked into the sync.
+// The program is started once per message.
+type ExecTransformer struct {
+	Path    string
+	Args    []string
+	Timeout time.Duration
+}
+
+// NewExecTransformers will create an ExecTransformer for each of the given
+// program paths.
+func NewExecTransformers(paths []string) Transformers {
+	var transformers Transformers
+	for _, path := range paths {
+		if path = strings.TrimSpace(path); len(path) == 0 {
+			continue
+		}
+		transformers = append(transformers, &ExecTransformer{Path: path, Timeout: PluginTimeoutSeconds * time.Second})
+	}
+	return transformers
+}
+
+func (e *ExecTransformer) Transform(msg MessageData) (MessageData, error) {
+	header, err := json.Marshal(PluginRequest{InternalDate: msg.InternalDate, Size: len(msg.Body)})
+	if err != nil {
+		return msg, err
+	}
+
+	var stdin, stdout, stderr bytes.Buffer
+	stdin.Write(header)
+	stdin.WriteByte('\n')
+	stdin.Write(msg.Body)
+
+	cmd := exec.Command(e.Path, e.Args...)
+	cmd.Stdin = &stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Start(); err != nil {
+		return msg, err
+	}
+
+	// kill it if it hangs
+	timer := time.AfterFunc(e.Timeout, func() {
+		cmd.Process.Kill()
+	})
+	err = cmd.Wait()
+	timer.Stop()
+	if err != nil {
+		return msg, fmt.Errorf("plugin %s failed: %s (%s)", e.Path, err.Error(), strings.TrimSpace(stderr.String()))
+	}
+
+	line, err := stdout.ReadBytes('\n')
+	if len(line) == 0 {
+		return msg, fmt.Errorf("plugin %s returned no response", e.Path)
+	}
+
+	var response PluginResponse
+	if err = json.Unmarshal(line, &response); err != nil {
+		return msg, fmt.Errorf("plugin %s returned an invalid response: %s", e.Path, err.Error())
+	}
+
+	switch response.Action {
+	case "accept":
+		return msg, nil
+	case "reject":
+		log.Printf("plugin %s rejected message: %s", e.Path, response.Reason)
+		return msg, ErrSkipMessage
+	case "replace":
+		if stdout.Len() == 0 {
+			return msg, fmt.Errorf("plugin %s replaced message with nothing", e.Path)
+		}
+		msg.Body = stdout.Bytes()
+		return msg, nil
+	}
+
+	return msg, fmt.Errorf("plugin %s returned an unknown action: %q", e.Path, response.Action)
+}
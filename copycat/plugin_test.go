@@ -0,0 +1,54 @@
+package copycat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExecTransformer(t *testing.T) {
+	msg := MessageData{InternalDate: time.Date(2014, 3, 1, 12, 0, 0, 0, time.UTC), Body: []byte("Subject: hi\r\n\r\nhello\r\n")}
+	plugin := func(script string) *ExecTransformer {
+		return &ExecTransformer{Path: "sh", Args: []string{"-c", script}, Timeout: 5 * time.Second}
+	}
+
+	got, err := plugin(`cat >/dev/null; echo '{"action": "accept"}'`).Transform(msg)
+	if err != nil || string(got.Body) != string(msg.Body) {
+		t.Errorf("expected the message to be accepted as it was, got %q (%v)", got.Body, err)
+	}
+
+	if _, err = plugin(`cat >/dev/null; echo '{"action": "reject", "reason": "virus"}'`).Transform(msg); err != ErrSkipMessage {
+		t.Errorf("expected the rejected message to be skipped, got %v", err)
+	}
+
+	// the request comes first, then the message, which is replaced by what follows the response
+	replace := `read request
+case "$request" in *'"size":22'*) ;; *) echo "bad request $request" >&2; exit 1 ;; esac
+echo '{"action": "replace"}'
+sed 's/hello/goodbye/'`
+	if got, err = plugin(replace).Transform(msg); err != nil || string(got.Body) != "Subject: hi\r\n\r\ngoodbye\r\n" {
+		t.Errorf("expected the message to be replaced, got %q (%v)", got.Body, err)
+	}
+
+	for _, script := range []string{
+		`echo '{"action": "replace"}'`,
+		`echo '{"action": "shrug"}'`,
+		`echo 'not json'`,
+		`true`,
+		`echo oops >&2; exit 3`,
+	} {
+		if _, err = plugin(script).Transform(msg); err == nil || err == ErrSkipMessage {
+			t.Errorf("expected %q to fail, got %v", script, err)
+		}
+	}
+
+	slow := plugin(`exec sleep 5`)
+	slow.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err = slow.Transform(msg); err == nil || time.Since(start) > 4*time.Second {
+		t.Errorf("expected the plugin to be killed after its timeout, got %v after %s", err, time.Since(start))
+	}
+
+	if transformers := NewExecTransformers([]string{" /bin/scan ", "", "/bin/dlp"}); len(transformers) != 2 {
+		t.Errorf("expected a transformer for each program, got %d", len(transformers))
+	}
+}
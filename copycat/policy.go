@@ -0,0 +1,141 @@
+package copycat
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FolderPolicy changes how the folders matching Pattern are synced when using SyncFolders.
+type FolderPolicy struct {
+	// Pattern is matched against the source folder name, ignoring case. It can have
+	// the wildcards of path.Match, ex. "*/Junk".
+	Pattern string
+	// Skip leaves the folder out of the sync entirely.
+	Skip bool
+	// MaxAge only copies messages received within it, if set.
+	MaxAge time.Duration
+	// Keywords are added to every message copied from the folder.
+	Keywords []string
+	// Line is the line of the file it was loaded from.
+	Line int
+}
+
+// FolderPolicies are checked in order and the first to match a folder is used.
+var FolderPolicies []FolderPolicy
+
+// LoadFolderPolicies reads a line for each folder pattern followed by its policies, ex:
+//
+//	# folder  policies
+//	Junk      skip
+//	Trash     newer=30d
+//	Spam      keyword=Junk
+//	*/Old     newer=365d keyword=Old,Imported
+func LoadFolderPolicies(file string) ([]FolderPolicy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var policies []FolderPolicy
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a folder followed by its policies", file, line)
+		}
+
+		policy := FolderPolicy{Pattern: fields[0], Line: line}
+		for _, field := range fields[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			switch {
+			case parts[0] == "skip" && len(parts) == 1:
+				policy.Skip = true
+			case parts[0] == "newer" && len(parts) == 2:
+				if policy.MaxAge, err = parseAge(parts[1]); err != nil {
+					return nil, fmt.Errorf("%s:%d: %s", file, line, err.Error())
+				}
+			case parts[0] == "keyword" && len(parts) == 2:
+				policy.Keywords = append(policy.Keywords, ParseFlags(parts[1])...)
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown policy %q", file, line, field)
+			}
+		}
+		policies = append(policies, policy)
+	}
+	return policies, scanner.Err()
+}
+
+// parseAge reads a duration that can also be in days, ex. "30d".
+func parseAge(age string) (time.Duration, error) {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid age: %q", age)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	duration, err := time.ParseDuration(age)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid age: %q", age)
+	}
+	return duration, nil
+}
+
+// folderPolicy returns the first of FolderPolicies matching the folder, or an empty policy.
+func folderPolicy(folder string) FolderPolicy {
+	for _, policy := range FolderPolicies {
+		if matched, _ := path.Match(strings.ToLower(policy.Pattern), strings.ToLower(folder)); matched {
+			return policy
+		}
+	}
+	return FolderPolicy{}
+}
+
+// Since is the oldest date a message can have to be copied, or the zero time for no limit.
+func (p FolderPolicy) Since() time.Time {
+	if p.MaxAge == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-p.MaxAge)
+}
+
+// Transformer adds the policy's keywords after transform.
+func (p FolderPolicy) Transformer(transform Transformer) Transformer {
+	if len(p.Keywords) == 0 {
+		return transform
+	}
+	if transform == nil {
+		return addKeywords(p.Keywords)
+	}
+	return Transformers{transform, addKeywords(p.Keywords)}
+}
+
+// addKeywords is a Transformer that adds keywords on top of the flags a message would otherwise get.
+type addKeywords []string
+
+func (k addKeywords) Transform(msg MessageData) (MessageData, error) {
+	flags := make(map[string]bool)
+	if msg.flagsSet {
+		for _, flag := range msg.Flags {
+			flags[flag] = true
+		}
+	} else {
+		// what appendFlags would have given it
+		flags["UnSeen"] = true
+	}
+	for _, keyword := range k {
+		flags[keyword] = true
+	}
+	msg.Flags = flagList(flags)
+	msg.flagsSet = true
+	return msg, nil
+}
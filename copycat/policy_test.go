@@ -0,0 +1,52 @@
+package copycat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFolderPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policies")
+	ioutil.WriteFile(path, []byte("# folder policies\nJunk skip\nTrash newer=30d\n*/spam keyword=Junk,Imported\n"), 0600)
+	policies, err := LoadFolderPolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	FolderPolicies = policies
+	defer func() { FolderPolicies = nil }()
+
+	if !folderPolicy("junk").Skip {
+		t.Errorf("expected Junk to be skipped")
+	}
+	if policy := folderPolicy("Trash"); policy.MaxAge != 30*24*time.Hour || policy.Since().IsZero() {
+		t.Errorf("unexpected Trash policy: %+v", policy)
+	}
+	if policy := folderPolicy("INBOX"); policy.Skip || !policy.Since().IsZero() || policy.Transformer(nil) != nil {
+		t.Errorf("expected no policy for the INBOX, got %+v", policy)
+	}
+
+	msg, err := folderPolicy("Archive/Spam").Transformer(nil).Transform(MessageData{Flags: []string{`\Seen`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(msg.Flags) != "[Imported Junk UnSeen]" || !msg.flagsSet {
+		t.Errorf("unexpected flags: %v", msg.Flags)
+	}
+
+	for _, bad := range []string{"Junk\n", "Junk delete\n", "Trash newer=soon\n"} {
+		ioutil.WriteFile(path, []byte(bad), 0600)
+		if _, err = LoadFolderPolicies(path); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package copycat
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// POP3Source is a MessageSource for legacy providers that only have POP3. Everything in
+// the maildrop is listed in the INBOX with UIDL, pulled with RETR and left on the server.
+// With a Cache, messages that were copied on an earlier run are remembered by their
+// UIDL and not listed again.
+type POP3Source struct {
+	// Host is host:port. Port 995 uses TLS and any other port upgrades with STLS.
+	Host     string
+	User     string
+	Password string
+	Cache    *Cache
+
+	// POP3 servers only allow one session per maildrop, so everything goes through one conn.
+	mu   sync.Mutex
+	conn *textproto.Conn
+	msgs map[string]int
+}
+
+// NewPOP3Source logs in to the POP3 server. cache can be nil to copy everything every time.
+func NewPOP3Source(host string, user string, password string, cache *Cache) (*POP3Source, error) {
+	p := &POP3Source{Host: host, User: user, Password: password, Cache: cache, msgs: make(map[string]int)}
+	var conn net.Conn
+	var err error
+	_, port, _ := net.SplitHostPort(host)
+	if port == "995" {
+		conn, err = dialTLS(host)
+	} else {
+		conn, err = dial(host)
+	}
+	if err != nil {
+		return nil, &Error{Kind: ErrConnLost, Op: "connect to " + host, Account: user, Err: err}
+	}
+	if err = p.login(conn, port != "995"); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// login reads the greeting, upgrades the conn with STLS if starttls is set and logs in.
+func (p *POP3Source) login(conn net.Conn, starttls bool) error {
+	p.conn = textproto.NewConn(conn)
+	if _, err := p.response(); err != nil {
+		p.conn.Close()
+		return wrapError("pop3 greeting", p.User, err)
+	}
+
+	if starttls {
+		if _, err := p.cmd("STLS"); err != nil {
+			p.conn.Close()
+			return &Error{Op: "pop3 stls", Account: p.User, Err: err}
+		}
+		host, _, _ := net.SplitHostPort(p.Host)
+		p.conn = textproto.NewConn(tls.Client(conn, &tls.Config{ServerName: host}))
+	}
+
+	var err error
+	if _, err = p.cmd("USER %s", p.User); err == nil {
+		_, err = p.cmd("PASS %s", p.Password)
+	}
+	if err != nil {
+		p.conn.Close()
+		return &Error{Kind: ErrAuth, Op: "pop3 login", Account: p.User, Err: err}
+	}
+	return nil
+}
+
+// cmd sends a command and returns the rest of the +OK line.
+func (p *POP3Source) cmd(format string, args ...interface{}) (string, error) {
+	if err := p.conn.PrintfLine(format, args...); err != nil {
+		return "", &Error{Kind: ErrConnLost, Op: "pop3", Account: p.User, Err: err}
+	}
+	return p.response()
+}
+
+func (p *POP3Source) response() (string, error) {
+	line, err := p.conn.ReadLine()
+	if err != nil {
+		return "", &Error{Kind: ErrConnLost, Op: "pop3", Account: p.User, Err: err}
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return "", fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+}
+
+// multiline sends a command with a multi-line response and returns its lines.
+func (p *POP3Source) multiline(format string, args ...interface{}) ([]byte, error) {
+	if _, err := p.cmd(format, args...); err != nil {
+		return nil, err
+	}
+	return p.conn.ReadDotBytes()
+}
+
+// uidlKey is where a copied message's UIDL is kept in the cache.
+func (p *POP3Source) uidlKey(uidl string) string {
+	// Message-Ids are the only other keys and never look like this
+	return "pop3-uidl\x00" + p.User + "\x00" + p.Host + "\x00" + uidl
+}
+
+func (p *POP3Source) List() ([]SourceMessage, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	raw, err := p.multiline("UIDL")
+	if err != nil {
+		return nil, wrapError("pop3 uidl", p.User, err)
+	}
+	var msgs []SourceMessage
+	var copied int
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		// 1 whqtswO00WBw418f9t5JxYwZ
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		num, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		uidl := fields[1]
+		if p.Cache != nil {
+			if _, err := p.Cache.db.Get([]byte(p.uidlKey(uidl)), nil); err == nil {
+				copied++
+				continue
+			}
+		}
+		p.msgs[uidl] = num
+		msgs = append(msgs, SourceMessage{Folder: "INBOX", MessageId: p.messageId(num), Key: uidl})
+	}
+	if copied > 0 {
+		log.Printf("skipping %d messages copied from %s on earlier runs", copied, p.User)
+	}
+	return msgs, nil
+}
+
+// messageId reads the Message-Id of the message with TOP, which servers don't have to
+// support. Without it the message can't be checked for in the destinations.
+func (p *POP3Source) messageId(num int) string {
+	header, err := p.multiline("TOP %d 0", num)
+	if err != nil {
+		return ""
+	}
+	parsed, _ := ParseHeader(header)
+	if parsed == nil {
+		return ""
+	}
+	return parsed.Get("Message-Id")
+}
+
+func (p *POP3Source) Fetch(msg SourceMessage) (MessageData, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	num, exists := p.msgs[msg.Key]
+	if !exists {
+		return MessageData{}, NotFound
+	}
+	body, err := p.multiline("RETR %d", num)
+	if err != nil {
+		return MessageData{}, wrapError("pop3 retr", p.User, err)
+	}
+	// ReadDotBytes turns CRLF into LF
+	body = bytes.Replace(body, []byte("\n"), []byte("\r\n"), -1)
+
+	// POP3 has no flags or internal date, so the Date header will have to do
+	return MessageData{Body: body, InternalDate: headerDate(body)}, nil
+}
+
+// headerDate is the message's Date header, or now if it doesn't have a valid one.
+func headerDate(body []byte) time.Time {
+	if parsed, err := mail.ReadMessage(bytes.NewReader(body)); err == nil {
+		if date, err := parsed.Header.Date(); err == nil {
+			return date
+		}
+	}
+	return time.Now()
+}
+
+// Copied remembers that the message is in the destinations so later runs skip it.
+func (p *POP3Source) Copied(msg SourceMessage) {
+	if p.Cache == nil {
+		return
+	}
+	if err := p.Cache.db.Put([]byte(p.uidlKey(msg.Key)), []byte{1}, nil); err != nil {
+		log.Printf("Unable to remember message %s was copied: %s", msg.Key, err.Error())
+	}
+}
+
+func (p *POP3Source) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cmd("QUIT")
+	return p.conn.Close()
+}
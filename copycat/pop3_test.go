@@ -0,0 +1,141 @@
+package copycat
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakePOP3 serves a maildrop of two messages, the second without a Message-Id.
+func fakePOP3(conn net.Conn) {
+	defer conn.Close()
+	msgs := []string{
+		"Message-Id: <1@example.com>\r\nDate: Sat, 1 Mar 2014 10:00:00 +0000\r\nSubject: hi\r\n\r\nhello\r\n..dot\r\n",
+		"Subject: no id\r\n\r\nhello again\r\n",
+	}
+	fmt.Fprint(conn, "+OK ready\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "USER":
+			fmt.Fprint(conn, "+OK\r\n")
+		case "PASS":
+			if fields[1] != "secret" {
+				fmt.Fprint(conn, "-ERR [AUTH] invalid password\r\n")
+				continue
+			}
+			fmt.Fprint(conn, "+OK logged in\r\n")
+		case "UIDL":
+			fmt.Fprint(conn, "+OK\r\n1 aaa\r\n2 bbb\r\n.\r\n")
+		case "TOP", "RETR":
+			var num int
+			fmt.Sscan(fields[1], &num)
+			msg := msgs[num-1]
+			if fields[0] == "TOP" {
+				msg = msg[:strings.Index(msg, "\r\n\r\n")+4]
+			}
+			fmt.Fprintf(conn, "+OK\r\n%s.\r\n", msg)
+		case "QUIT":
+			fmt.Fprint(conn, "+OK bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+func newTestPOP3(password string, cache *Cache) (*POP3Source, error) {
+	client, server := net.Pipe()
+	go fakePOP3(server)
+	p := &POP3Source{Host: "pop.example.com:110", User: "fred", Password: password, Cache: cache, msgs: make(map[string]int)}
+	return p, p.login(client, false)
+}
+
+func TestPOP3Source(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pop3test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := NewCache(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	if _, err = newTestPOP3("wrong", cache); !errors.Is(err, ErrAuth) {
+		t.Errorf("expected an auth error, got %v", err)
+	}
+
+	source, err := newTestPOP3("secret", cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := source.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SourceMessage{{Folder: "INBOX", MessageId: "<1@example.com>", Key: "aaa"}, {Folder: "INBOX", Key: "bbb"}}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Fatalf("expected %v, got %v", want, msgs)
+	}
+
+	data, err := source.Fetch(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := "Message-Id: <1@example.com>\r\nDate: Sat, 1 Mar 2014 10:00:00 +0000\r\nSubject: hi\r\n\r\nhello\r\n.dot\r\n"; string(data.Body) != body {
+		t.Errorf("unexpected body %q", data.Body)
+	}
+	if data.InternalDate.Year() != 2014 {
+		t.Errorf("expected the internal date from the Date header, got %s", data.InternalDate)
+	}
+	source.Copied(msgs[0])
+	source.Close()
+
+	// the copied message isn't listed again
+	source, err = newTestPOP3("secret", cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	if msgs, err = source.List(); err != nil || len(msgs) != 1 || msgs[0].Key != "bbb" {
+		t.Errorf("expected only the uncopied message, got %v %v", msgs, err)
+	}
+}
+
+type trackedSource struct {
+	MessageSource
+	copied []string
+}
+
+func (s *trackedSource) Copied(msg SourceMessage) {
+	s.copied = append(s.copied, msg.Key)
+}
+
+func TestImportCopies(t *testing.T) {
+	source := &trackedSource{}
+	copies := &importCopies{source: source, want: 2, counts: make(map[string]int)}
+	msg := SourceMessage{Folder: "INBOX", Key: "aaa"}
+
+	copies.copied(msg)
+	if len(source.copied) != 0 {
+		t.Fatalf("expected the message to not be recorded while a destination doesn't have it, got %v", source.copied)
+	}
+	copies.copied(msg)
+	if !reflect.DeepEqual(source.copied, []string{"aaa"}) {
+		t.Errorf("expected the message to be recorded once every destination has it, got %v", source.copied)
+	}
+}
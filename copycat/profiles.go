@@ -0,0 +1,68 @@
+package copycat
+
+import (
+	"net"
+	"strings"
+)
+
+// ProviderProfile is what we know about running a sync against a big provider.
+type ProviderProfile struct {
+	Name string
+	// Hosts are the IMAP hosts the provider uses. Any host ending in one matches.
+	Hosts []string
+	// Flags are the flags suggested for a sync with the provider.
+	Flags []string
+	// Notes are anything else worth knowing before starting.
+	Notes []string
+}
+
+// ProviderProfiles are the providers SuggestProfile knows.
+var ProviderProfiles = []ProviderProfile{
+	{
+		Name:  "Gmail",
+		Hosts: []string{"imap.gmail.com", "imap.googlemail.com"},
+		Flags: []string{"-c=8", "-throttle-cooldown=120"},
+		Notes: []string{
+			"Log in with an app password if 2-step verification is on.",
+			"Gmail limits IMAP to about 2500 MB downloaded and 500 MB uploaded a day. Use -max-bytes with -window to keep under it.",
+			"Sent folders are deduplicated against All Mail automatically.",
+		},
+	},
+	{
+		Name:  "Microsoft 365",
+		Hosts: []string{"outlook.office365.com"},
+		Flags: []string{"-c=8", "-throttle-cooldown=60"},
+		Notes: []string{
+			"Basic auth may be turned off for IMAP. Consider -src-graph or -dst-graph instead.",
+			"Exchange Online throttles busy mailboxes and says how long to back off, which is waited out automatically.",
+		},
+	},
+	{
+		Name:  "iCloud",
+		Hosts: []string{"imap.mail.me.com"},
+		Flags: []string{"-c=4"},
+		Notes: []string{"Log in with an app-specific password."},
+	},
+	{
+		Name:  "Yahoo",
+		Hosts: []string{"imap.mail.yahoo.com"},
+		Flags: []string{"-c=4"},
+		Notes: []string{"Log in with an app password."},
+	},
+}
+
+// SuggestProfile returns the profile of the provider behind the host (host or host:port), if it's one we know.
+func SuggestProfile(host string) (ProviderProfile, bool) {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.ToLower(host)
+	for _, profile := range ProviderProfiles {
+		for _, known := range profile.Hosts {
+			if host == known || strings.HasSuffix(host, "."+known) {
+				return profile, true
+			}
+		}
+	}
+	return ProviderProfile{}, false
+}
@@ -0,0 +1,69 @@
+package copycat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ProgressStream writes each Event as a line of JSON so programs running many syncs
+// can follow them without reading the logs.
+type ProgressStream struct {
+	mu     sync.Mutex
+	w      io.Writer
+	enc    *json.Encoder
+	closer io.Closer
+	failed bool
+}
+
+// NewProgressStream writes events to target: "-" for stdout, or unix:/path/to.sock or
+// tcp:host:port to connect to something listening for them.
+func NewProgressStream(target string) (*ProgressStream, error) {
+	if target == "-" {
+		return newProgressStream(os.Stdout, nil), nil
+	}
+
+	parts := strings.SplitN(target, ":", 2)
+	if len(parts) != 2 || (parts[0] != "unix" && parts[0] != "tcp") {
+		return nil, fmt.Errorf("invalid progress target %q: expected '-', unix:/path or tcp:host:port", target)
+	}
+	conn, err := net.Dial(parts[0], parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return newProgressStream(conn, conn), nil
+}
+
+func newProgressStream(w io.Writer, closer io.Closer) *ProgressStream {
+	enc := json.NewEncoder(w)
+	// Message-Ids are full of <>
+	enc.SetEscapeHTML(false)
+	return &ProgressStream{w: w, enc: enc, closer: closer}
+}
+
+// Handle is a ProgressFunc that writes the event. If the stream can't be written to,
+// it's logged once and the rest of the events are dropped so the sync isn't held up.
+func (s *ProgressStream) Handle(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed {
+		return
+	}
+	e.Time = e.Time.UTC()
+	if err := s.enc.Encode(e); err != nil {
+		log.Printf("Unable to write progress events: %s. dropping the rest!", err.Error())
+		s.failed = true
+	}
+}
+
+func (s *ProgressStream) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
@@ -0,0 +1,73 @@
+package copycat
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProgressStream(t *testing.T) {
+	var out bytes.Buffer
+	stream := newProgressStream(&out, nil)
+	date := time.Date(2014, 3, 1, 12, 4, 5, 0, time.FixedZone("EST", -5*60*60))
+
+	var tui []string
+	progress := ProgressFunc(nil).And(stream.Handle).And(func(e Event) { tui = append(tui, e.Kind) })
+	progress(Event{Kind: FolderStarted, Time: date, Folder: "INBOX", Destination: "dst@example.com", Count: 10})
+	progress(Event{Kind: MessageCopied, Time: date, Folder: "INBOX", Destination: "dst@example.com", MessageId: "<1234@example.com>", Size: 2048})
+	progress(Event{Kind: CheckpointWritten, Time: date, Folder: "INBOX", Count: 10})
+
+	expected := `{"kind":"folder-started","time":"2014-03-01T17:04:05Z","folder":"INBOX","destination":"dst@example.com","count":10}
+{"kind":"copied","time":"2014-03-01T17:04:05Z","folder":"INBOX","destination":"dst@example.com","message_id":"<1234@example.com>","size":2048}
+{"kind":"checkpoint","time":"2014-03-01T17:04:05Z","folder":"INBOX","count":10}
+`
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+	if len(tui) != 3 {
+		t.Errorf("expected every event to reach both funcs, got %v", tui)
+	}
+}
+
+type failingWriter struct{ writes int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, errors.New("broken pipe")
+}
+
+func TestProgressStreamFailure(t *testing.T) {
+	w := new(failingWriter)
+	stream := newProgressStream(w, nil)
+	stream.Handle(Event{Kind: FolderStarted})
+	stream.Handle(Event{Kind: FolderDone})
+	if w.writes != 1 {
+		t.Errorf("expected events to be dropped after a failed write, got %d writes", w.writes)
+	}
+}
+
+func TestNewProgressStream(t *testing.T) {
+	if _, err := NewProgressStream("http://localhost:9000"); err == nil {
+		t.Error("expected an error for an unknown target")
+	}
+}
+
+func TestMessageKeys(t *testing.T) {
+	defer func() { RunID = "" }()
+	key := MessageKey("INBOX", "<1234@example.com>", "dst@example.com")
+	if key != MessageKey("INBOX", "<1234@example.com>", "dst@example.com") || len(key) != 32 {
+		t.Errorf("expected the same 32 character key every time, got %q", key)
+	}
+	if key == MessageKey("INBOX", "<1234@example.com>", "other@example.com") {
+		t.Error("expected a different key for another destination")
+	}
+
+	RunID = NewRunID()
+	if len(RunID) != 36 || RunID[14] != '4' || RunID == NewRunID() {
+		t.Errorf("expected a random version 4 UUID, got %q", RunID)
+	}
+	if MessageKey("INBOX", "<1234@example.com>", "dst@example.com") != key {
+		t.Error("expected the key to be the same in every run")
+	}
+}
@@ -1,14 +1,11 @@
 package copycat
 
 import (
-	"bytes"
 	"log"
-	"net/mail"
 	"sync"
 	"time"
 
 	"code.google.com/p/go-imap/go1/imap"
-	"github.com/bradfitz/gomemcache/memcache"
 )
 
 // SearchAndPurge will go through the destination inboxes and check if
@@ -67,10 +64,9 @@ func purgeDestination(user string, dsts []*imap.Client, checkRequests chan check
 	startTime := time.Now()
 	log.Printf("Beginning check/purge for %s with %d messages", user, len(cmd.Data))
 	for indx, rsp = range cmd.Data {
-		header := imap.AsBytes(rsp.MessageInfo().Attrs["RFC822.HEADER"])
-		if msg, _ := mail.ReadMessage(bytes.NewReader(header)); msg != nil {
+		if msg := messageHeader(dsts[0], rsp.MessageInfo()); msg != nil {
 			header := "Message-Id"
-			value := msg.Header.Get(header)
+			value := msg.Get(header)
 
 			// create the store request and pass it to each dst's storers
 			workRequests <- WorkRequest{Value: value, Header: header, UID: rsp.MessageInfo().UID}
@@ -113,6 +109,8 @@ func checkAndPurgeMessages(conn *imap.Client, requests chan WorkRequest, checkRe
 				err := AddDeletedFlag(conn, request.UID)
 				if err != nil {
 					log.Printf("Problems removing message from dst: %s", err.Error())
+				} else {
+					Stats.Add("purged", 1)
 				}
 			}
 		case <- timeout.C:
@@ -141,7 +139,10 @@ type checkExistsRequest struct {
 func checkMessagesExist(srcConn *imap.Client, checkRequests chan checkExistsRequest, wg *sync.WaitGroup) {
 	defer wg.Done()
 	// get memcache client
-	cache := memcache.New(MemcacheServer)
+	cache, err := Memcache.NewClient()
+	if err != nil {
+		log.Printf("Unable to connect to memcached: %s. deleted messages will stay cached", err.Error())
+	}
 	
 	timeout := time.NewTicker(NoopMinutes * time.Minute)
 	done := false
@@ -152,6 +153,12 @@ func checkMessagesExist(srcConn *imap.Client, checkRequests chan checkExistsRequ
 				done = true
 				break
 			}
+			// synthetic ids only exist in the destinations so there is nothing to search the src for
+			if IsSyntheticMessageId(request.MessageId) {
+				request.Response <- true
+				continue
+			}
+
 			// check if it exists in src
 			// search for in src
 			cmd, err := imap.Wait(srcConn.UIDSearch([]imap.Field{"HEADER", "Message-Id", request.MessageId}))
@@ -169,7 +176,7 @@ func checkMessagesExist(srcConn *imap.Client, checkRequests chan checkExistsRequ
 			request.Response <- found
 
 			// if it doesnt exist, attempt to remove it from memcached
-			if !found {
+			if !found && cache != nil {
 				cache.Delete(request.MessageId)
 			}			
 		case <- timeout.C:
@@ -0,0 +1,178 @@
+package copycat
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+)
+
+const redactedDomain = "redacted.invalid"
+
+// Redactor is a Transformer for privacy-sensitive copies, ex. an archive kept for
+// analysis: the Redact headers' values are replaced with "[redacted]" and the Hash
+// headers' with a hash of the value, so messages from the same person can still be told
+// apart without saying who they are. Addresses are hashed one at a time into addresses
+// at redacted.invalid. With StripReceived, the Received chain, which traces the
+// message's path through everyone's servers, is dropped. The Message-Id can't be
+// changed, since that's how copies are found in the destinations.
+type Redactor struct {
+	Redact        []string
+	Hash          []string
+	StripReceived bool
+	// Key is mixed into the hashes (HMAC-SHA256), so they can't be reversed by hashing
+	// likely values. Without it they're plain SHA-256.
+	Key []byte
+	// Mapping, if set, records what each hash stands for.
+	Mapping *RedactionMap
+	Report  *Report
+}
+
+// NewRedactor checks the headers can be redacted.
+func NewRedactor(redact []string, hash []string, stripReceived bool, key []byte) (*Redactor, error) {
+	for _, header := range append(append([]string(nil), redact...), hash...) {
+		if strings.EqualFold(header, "Message-Id") {
+			return nil, fmt.Errorf("the Message-Id can't be redacted, it's how messages are found in the destinations")
+		}
+	}
+	return &Redactor{Redact: redact, Hash: hash, StripReceived: stripReceived, Key: key}, nil
+}
+
+func (r *Redactor) Transform(msg MessageData) (MessageData, error) {
+	header, content, hasContent := splitMessage(toCRLF(msg.Body))
+	var changed []string
+	change := func(name string) {
+		if !listed(changed, name) {
+			changed = append(changed, name)
+		}
+	}
+	var fields [][]byte
+	for _, field := range headerFields(header) {
+		colon := bytes.IndexByte(field, ':')
+		if colon < 0 {
+			fields = append(fields, field)
+			continue
+		}
+		name := string(bytes.TrimSpace(field[:colon]))
+		switch {
+		case r.StripReceived && strings.EqualFold(name, "Received"):
+			change(name)
+			continue
+		case listed(r.Redact, name):
+			field = []byte(name + ": [redacted]\r\n")
+			change(name)
+		case listed(r.Hash, name):
+			value := strings.TrimSpace(unfold(string(field[colon+1:])))
+			field = []byte(name + ": " + r.hashValue(name, value) + "\r\n")
+			change(name)
+		}
+		fields = append(fields, field)
+	}
+	if len(changed) == 0 {
+		return msg, nil
+	}
+
+	msg.Body = joinMessage(bytes.Join(fields, nil), content, hasContent)
+	r.Report.Altered(messageId(msg.Body), "redacted "+strings.Join(changed, ", "))
+	return msg, nil
+}
+
+// hashValue hashes each address in an address header, or else the whole value.
+func (r *Redactor) hashValue(name string, value string) string {
+	if addresses, err := mail.ParseAddressList(value); err == nil && len(addresses) > 0 {
+		var hashed []string
+		for _, address := range addresses {
+			hash := r.hash(strings.ToLower(address.Address))
+			r.Mapping.Record(hash, name, address.String())
+			hashed = append(hashed, "<"+hash+"@"+redactedDomain+">")
+		}
+		return strings.Join(hashed, ", ")
+	}
+	hash := r.hash(value)
+	r.Mapping.Record(hash, name, value)
+	return hash
+}
+
+func (r *Redactor) hash(value string) string {
+	var sum []byte
+	if len(r.Key) > 0 {
+		mac := hmac.New(sha256.New, r.Key)
+		mac.Write([]byte(value))
+		sum = mac.Sum(nil)
+	} else {
+		digest := sha256.Sum256([]byte(value))
+		sum = digest[:]
+	}
+	return hex.EncodeToString(sum[:12])
+}
+
+// listed is true if the header is one of the names, ignoring case.
+func listed(names []string, header string) bool {
+	for _, name := range names {
+		if strings.EqualFold(name, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactionMap is a file of what each of a Redactor's hashes stands for, a line of
+// hash, header and value separated by tabs each, so the copies can be re-identified by
+// whoever holds the file. It's only written to, and each hash is written once, also
+// across runs. A nil RedactionMap records nothing.
+type RedactionMap struct {
+	mu   sync.Mutex
+	file *os.File
+	seen map[string]bool
+}
+
+// OpenRedactionMap opens the file to add to, creating it if it doesn't exist.
+func OpenRedactionMap(path string) (*RedactionMap, error) {
+	// it says who everyone is
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	m := &RedactionMap{file: file, seen: make(map[string]bool)}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if fields := strings.SplitN(scanner.Text(), "\t", 3); len(fields) == 3 {
+			m.seen[fields[0]+"\t"+fields[1]] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// Record adds the hash of the header's value, unless it's already there.
+func (m *RedactionMap) Record(hash string, header string, value string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := hash + "\t" + strings.ToLower(header)
+	if m.seen[key] {
+		return
+	}
+	m.seen[key] = true
+	value = strings.NewReplacer("\t", " ", "\r", "", "\n", " ").Replace(value)
+	fmt.Fprintf(m.file, "%s\t%s\t%s\n", hash, strings.ToLower(header), value)
+}
+
+func (m *RedactionMap) Close() error {
+	if m == nil {
+		return nil
+	}
+	return m.file.Close()
+}
@@ -0,0 +1,64 @@
+package copycat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "map.tsv")
+
+	redactor, err := NewRedactor([]string{"subject"}, []string{"From", "To"}, true, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redactor.Mapping, err = OpenRedactionMap(path); err != nil {
+		t.Fatal(err)
+	}
+	msg := "Received: from mx.example.com\r\n\tby mx.other.com\r\nMessage-Id: <1@example.com>\r\nFrom: Jane <jane@example.com>\r\nTo: Bob <BOB@example.com>,\r\n joe@example.com\r\nSubject: salaries\r\n\r\nhi\r\n"
+	got, err := redactor.Transform(MessageData{Body: []byte(msg)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(got.Body)
+	jane := redactor.hash("jane@example.com")
+	for _, want := range []string{"Message-Id: <1@example.com>\r\n", "From: <" + jane + "@redacted.invalid>\r\n", "Subject: [redacted]\r\n", "\r\n\r\nhi\r\n"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the redacted message:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "Received") || strings.Contains(body, "example.com>,") {
+		t.Errorf("expected the Received chain and addresses to be gone:\n%s", body)
+	}
+	if redactor.hash("bob@example.com") == redactor.hash("jane@example.com") || len(jane) != 24 {
+		t.Errorf("unexpected hash %q", jane)
+	}
+	redactor.Mapping.Close()
+
+	// each hash is added once, even in a later run
+	if redactor.Mapping, err = OpenRedactionMap(path); err != nil {
+		t.Fatal(err)
+	}
+	redactor.Transform(MessageData{Body: []byte(msg)})
+	redactor.Mapping.Close()
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) != 3 || lines[0] != jane+"\tfrom\t\"Jane\" <jane@example.com>" {
+		t.Errorf("unexpected mapping:\n%s", raw)
+	}
+
+	if _, err = NewRedactor(nil, []string{"message-id"}, false, nil); err == nil {
+		t.Error("expected the Message-Id not to be redacted")
+	}
+}
@@ -0,0 +1,146 @@
+package copycat
+
+import (
+	"log"
+	"strings"
+
+	"code.google.com/p/go-imap/go1/imap"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// renameSample is how many of a folder's first messages are kept to recognize it by.
+const renameSample = 20
+
+// folderSample returns the Message-Ids of the first messages in the folder, which keep
+// their UIDs when the folder is renamed. The folder is left selected.
+func folderSample(conn *imap.Client, folder string) ([]string, error) {
+	if _, err := imap.Wait(conn.Select(folder, true)); err != nil {
+		return nil, err
+	}
+	if conn.Mailbox.Messages == 0 {
+		return nil, nil
+	}
+	last := conn.Mailbox.Messages
+	if last > renameSample {
+		last = renameSample
+	}
+	seq, _ := imap.NewSeqSet("")
+	seq.AddRange(1, last)
+	cmd, err := imap.Wait(conn.Fetch(seq, messageIdFetch))
+	if err != nil {
+		return nil, err
+	}
+	var sample []string
+	for _, rsp := range cmd.Data {
+		info := rsp.MessageInfo()
+		if info == nil {
+			continue
+		}
+		if header, _ := ParseHeader(MessageIdHeader(info)); header != nil {
+			if id := header.Get("Message-Id"); len(id) > 0 {
+				sample = append(sample, id)
+			}
+		}
+	}
+	return sample, nil
+}
+
+// sameFolder says if the sample of a folder is mostly the sample it had before, allowing
+// for some of its first messages to have been deleted since.
+func sameFolder(before []string, now []string) bool {
+	if len(before) == 0 {
+		return false
+	}
+	found := make(map[string]bool)
+	for _, id := range now {
+		found[id] = true
+	}
+	var kept int
+	for _, id := range before {
+		if found[id] {
+			kept++
+		}
+	}
+	return kept*2 >= len(before)
+}
+
+// folderStates returns the saved state of each of the source's folders, by folder.
+func (c *Cache) folderStates(src InboxInfo) map[string]folderState {
+	states := make(map[string]folderState)
+	prefix := folderStateKey(src, "")
+	iter := c.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var state folderState
+		if deserialize(iter.Value(), &state) == nil {
+			states[strings.TrimPrefix(string(iter.Key()), prefix)] = state
+		}
+	}
+	return states
+}
+
+// detectRenames finds the folders that were renamed in the source since the last run
+// (see SkipUnchanged): a folder without a saved state is the one that was renamed if a
+// folder that's no longer listed had the same UIDVALIDITY and most of the same first
+// messages. Its saved state is moved to the new name, and the old state is returned
+// by the new name so the destinations' folders can be renamed to match.
+func detectRenames(conn *imap.Client, src InboxInfo, listed map[string]bool, folders []string, cache *Cache) map[string]folderState {
+	states := cache.folderStates(src)
+	gone := make(map[string]folderState)
+	for folder, state := range states {
+		if !listed[folder] {
+			gone[folder] = state
+		}
+	}
+	renamed := make(map[string]folderState)
+	if len(gone) == 0 {
+		return renamed
+	}
+	defer imap.Wait(conn.Select("INBOX", true))
+
+	for _, folder := range folders {
+		if _, synced := states[folder]; synced || len(gone) == 0 {
+			continue
+		}
+		status, err := GetFolderStatus(conn, folder)
+		if err != nil {
+			continue
+		}
+		for old, state := range gone {
+			if state.Source.UIDValidity != status.UIDValidity || len(state.Sample) == 0 {
+				continue
+			}
+			sample, err := folderSample(conn, folder)
+			if err != nil || !sameFolder(state.Sample, sample) {
+				continue
+			}
+			log.Printf("folder %s was renamed to %s since the last run", old, folder)
+			if err = cache.putFolderState(folderStateKey(src, folder), state); err != nil {
+				log.Printf("Unable to move the state of folder %s to %s: %s", old, folder, err.Error())
+				break
+			}
+			cache.db.Delete([]byte(folderStateKey(src, old)), nil)
+			Stats.Add("folders_renamed", 1)
+			renamed[folder] = state
+			delete(gone, old)
+			break
+		}
+	}
+	return renamed
+}
+
+// renameDestFolder renames the folder the source folder was synced to last time in the
+// destination, so its messages don't have to be copied again under the new name. It
+// returns false if there's nothing to rename or the rename failed.
+func renameDestFolder(conn *imap.Client, user string, state folderState, name string) bool {
+	old, exists := state.Names[user]
+	if !exists || old == name {
+		return false
+	}
+	if _, err := imap.Wait(conn.Rename(old, name)); err != nil {
+		log.Printf("Unable to rename folder %s to %s in %s: %s. copying it again", old, name, user, err.Error())
+		return false
+	}
+	log.Printf("renamed folder %s to %s in %s", old, name, user)
+	return true
+}
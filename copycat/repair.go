@@ -0,0 +1,270 @@
+package copycat
+
+import (
+	"bytes"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// MIMERepairer is a Transformer that fixes up the problems most often found in
+// old messages that strict servers reject on APPEND: line endings that are not
+// CRLF, raw 8-bit header values and multipart messages with a missing or
+// unterminated boundary.
+type MIMERepairer struct{}
+
+func (r MIMERepairer) Transform(msg MessageData) (MessageData, error) {
+	header, content, hasContent := splitMessage(toCRLF(msg.Body))
+
+	fields := headerFields(header)
+	for i, field := range fields {
+		fields[i] = encodeHeaderField(field)
+	}
+	content = repairBoundary(fields, content)
+
+	msg.Body = joinMessage(bytes.Join(fields, nil), content, hasContent)
+	return msg, nil
+}
+
+// toCRLF will turn any bare LF or CR into a CRLF.
+func toCRLF(b []byte) []byte {
+	out := make([]byte, 0, len(b)+len(b)/50)
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\r':
+			out = append(out, '\r', '\n')
+			if i+1 < len(b) && b[i+1] == '\n' {
+				i++
+			}
+		case '\n':
+			out = append(out, '\r', '\n')
+		default:
+			out = append(out, b[i])
+		}
+	}
+	return out
+}
+
+// splitMessage breaks a CRLF message into its header (including the last
+// header's CRLF) and its content.
+func splitMessage(b []byte) (header []byte, content []byte, hasContent bool) {
+	indx := bytes.Index(b, []byte("\r\n\r\n"))
+	if indx < 0 {
+		return b, nil, false
+	}
+	return b[:indx+2], b[indx+4:], true
+}
+
+func joinMessage(header []byte, content []byte, hasContent bool) []byte {
+	if !hasContent {
+		return header
+	}
+	msg := make([]byte, 0, len(header)+len(content)+2)
+	msg = append(msg, header...)
+	msg = append(msg, '\r', '\n')
+	return append(msg, content...)
+}
+
+// headerFields splits a header into its fields, keeping any folded lines
+// and the trailing CRLF with the field they belong to.
+func headerFields(header []byte) [][]byte {
+	var fields [][]byte
+	start := 0
+	for i := 0; i < len(header)-1; i++ {
+		if header[i] != '\r' || header[i+1] != '\n' {
+			continue
+		}
+		end := i + 2
+		if end < len(header) && (header[end] == ' ' || header[end] == '\t') {
+			continue
+		}
+		fields = append(fields, header[start:end])
+		start = end
+	}
+	if start < len(header) {
+		fields = append(fields, header[start:])
+	}
+	return fields
+}
+
+// encodeHeaderField will RFC 2047 encode any words in the field's value that
+// contain 8-bit data. Runs of neighbouring 8-bit words are encoded together so
+// the whitespace between them survives decoding.
+func encodeHeaderField(field []byte) []byte {
+	colon := bytes.IndexByte(field, ':')
+	if colon < 0 || !has8Bit(field[colon+1:]) {
+		return field
+	}
+
+	var out bytes.Buffer
+	out.Write(field[:colon+1])
+
+	tokens := tokenize(field[colon+1:])
+	for i := 0; i < len(tokens); i++ {
+		if !has8Bit(tokens[i]) {
+			out.Write(tokens[i])
+			continue
+		}
+
+		// grab every 8-bit word that follows with only whitespace between
+		run := tokens[i]
+		for j := i + 2; j < len(tokens) && has8Bit(tokens[j]) && !bytes.ContainsAny(tokens[j-1], "\r\n"); j += 2 {
+			run = append(append(append([]byte{}, run...), tokens[j-1]...), tokens[j]...)
+			i = j
+		}
+		out.WriteString(mime.QEncoding.Encode("utf-8", toUTF8(run)))
+	}
+	return out.Bytes()
+}
+
+// tokenize splits b into alternating runs of whitespace and non-whitespace.
+func tokenize(b []byte) [][]byte {
+	var tokens [][]byte
+	start := 0
+	for i := 1; i <= len(b); i++ {
+		if i == len(b) || isSpace(b[i]) != isSpace(b[start]) {
+			tokens = append(tokens, b[start:i])
+			start = i
+		}
+	}
+	return tokens
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func has8Bit(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// toUTF8 assumes anything that isn't already valid UTF-8 is Latin-1.
+func toUTF8(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+var boundaryParam = regexp.MustCompile(`(?i)boundary\s*=\s*"?([^";\r\n]+)"?`)
+
+// repairBoundary makes sure a multipart message declares its boundary and
+// that the closing delimiter exists, and does the same for any multipart in it.
+// The Content-Type field is rewritten in place if it needs to be.
+func repairBoundary(fields [][]byte, content []byte) []byte {
+	for i, field := range fields {
+		colon := bytes.IndexByte(field, ':')
+		if colon < 0 || !strings.EqualFold(strings.TrimSpace(string(field[:colon])), "Content-Type") {
+			continue
+		}
+
+		value := strings.TrimSpace(unfold(string(field[colon+1:])))
+		mediaType, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			// salvage what we can from broken parameters
+			mediaType = strings.ToLower(strings.TrimSpace(strings.SplitN(value, ";", 2)[0]))
+			params = map[string]string{}
+			if match := boundaryParam.FindStringSubmatch(value); match != nil {
+				params["boundary"] = strings.TrimSpace(match[1])
+			}
+		}
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			return content
+		}
+
+		boundary := params["boundary"]
+		if len(boundary) == 0 {
+			if boundary = findBoundary(content); len(boundary) == 0 {
+				return content
+			}
+		}
+
+		if err != nil || params["boundary"] != boundary {
+			params["boundary"] = boundary
+			if formatted := mime.FormatMediaType(mediaType, params); len(formatted) > 0 {
+				fields[i] = []byte(string(field[:colon+1]) + " " + formatted + "\r\n")
+			}
+		}
+
+		content = repairParts(content, boundary)
+		if !bytes.Contains(content, []byte("--"+boundary+"--")) {
+			if len(content) > 0 && !bytes.HasSuffix(content, []byte("\r\n")) {
+				content = append(content, '\r', '\n')
+			}
+			content = append(content, []byte("--"+boundary+"--\r\n")...)
+		}
+		return content
+	}
+	return content
+}
+
+// repairParts runs repairBoundary on each of the parts between the boundary's delimiter
+// lines, so a nested multipart that isn't closed is closed before the next part starts.
+// A last part without a closing delimiter runs to the end of the content.
+func repairParts(content []byte, boundary string) []byte {
+	delimiter := []byte("--" + boundary)
+	var out []byte
+	start := -1 // where the current part begins
+	copied := 0
+	part := func(partEnd int) {
+		header, body, hasBody := splitMessage(content[start:partEnd])
+		fields := headerFields(header)
+		body = repairBoundary(fields, body)
+		out = append(out, content[copied:start]...)
+		out = append(out, joinMessage(bytes.Join(fields, nil), body, hasBody)...)
+		copied = partEnd
+	}
+	closed := false
+	for offset := 0; offset < len(content); {
+		end := bytes.Index(content[offset:], []byte("\r\n"))
+		next := offset + end + 2
+		if end < 0 {
+			end, next = len(content)-offset, len(content)
+		}
+		line := bytes.TrimRight(content[offset:offset+end], " \t")
+		if bytes.HasPrefix(line, delimiter) && (len(line) == len(delimiter) || bytes.Equal(line[len(delimiter):], []byte("--"))) {
+			if start >= 0 {
+				// the CRLF before a delimiter belongs to the delimiter
+				partEnd := offset - 2
+				if partEnd < start {
+					partEnd = start
+				}
+				part(partEnd)
+			}
+			start = next
+			if len(line) > len(delimiter) {
+				closed = true
+				break
+			}
+		}
+		offset = next
+	}
+	if !closed && start >= 0 && start < len(content) {
+		part(len(content))
+	}
+	return append(out, content[copied:]...)
+}
+
+// findBoundary guesses a multipart boundary from the first delimiter line in the content.
+func findBoundary(content []byte) string {
+	for _, line := range bytes.Split(content, []byte("\r\n")) {
+		if bytes.HasPrefix(line, []byte("--")) && len(bytes.TrimSpace(line)) > 2 {
+			return strings.TrimSuffix(string(bytes.TrimSpace(line[2:])), "--")
+		}
+	}
+	return ""
+}
+
+func unfold(value string) string {
+	return strings.NewReplacer("\r\n ", " ", "\r\n\t", " ", "\r\n", "").Replace(value)
+}
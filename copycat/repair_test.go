@@ -0,0 +1,55 @@
+package copycat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMIMERepairer(t *testing.T) {
+	tests := []struct {
+		given string
+		want  string
+	}{
+		{
+			"Subject: Gr\xfc\xdfe aus K\xf6ln\nFrom: J\xc3\xb6rg M\xc3\xbcller <jm@example.com>\n\nhi\n",
+			"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?= aus =?utf-8?q?K=C3=B6ln?=\r\nFrom: =?utf-8?q?J=C3=B6rg_M=C3=BCller?= <jm@example.com>\r\n\r\nhi\r\n",
+		},
+		{
+			"Content-Type: multipart/mixed\r\n\r\n--abc\r\nContent-Type: text/plain\r\n\r\nhi\r\n",
+			"Content-Type: multipart/mixed; boundary=abc\r\n\r\n--abc\r\nContent-Type: text/plain\r\n\r\nhi\r\n--abc--\r\n",
+		},
+		{
+			"Content-Type: multipart/mixed; boundary=\"abc\"\r\n\r\n--abc\r\n\r\nhi\r\n--abc--\r\n",
+			"Content-Type: multipart/mixed; boundary=\"abc\"\r\n\r\n--abc\r\n\r\nhi\r\n--abc--\r\n",
+		},
+		{
+			// a nested multipart without its boundary or closing delimiter, in one that's closed
+			"Content-Type: multipart/mixed; boundary=abc\r\n\r\n--abc\r\nContent-Type: multipart/alternative\r\n\r\n--def\r\n\r\nhi\r\n--abc\r\n\r\nbye\r\n--abc--\r\n",
+			"Content-Type: multipart/mixed; boundary=abc\r\n\r\n--abc\r\nContent-Type: multipart/alternative; boundary=def\r\n\r\n--def\r\n\r\nhi\r\n--def--\r\n\r\n--abc\r\n\r\nbye\r\n--abc--\r\n",
+		},
+		{
+			// neither of them closed
+			"Content-Type: multipart/mixed; boundary=abc\r\n\r\n--abc\r\nContent-Type: multipart/alternative; boundary=def\r\n\r\n--def\r\n\r\nhi",
+			"Content-Type: multipart/mixed; boundary=abc\r\n\r\n--abc\r\nContent-Type: multipart/alternative; boundary=def\r\n\r\n--def\r\n\r\nhi\r\n--def--\r\n--abc--\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		got, err := MIMERepairer{}.Transform(MessageData{Body: []byte(test.given)})
+		if err != nil {
+			t.Errorf("unable to repair message - %s", err.Error())
+			continue
+		}
+
+		if string(got.Body) != test.want {
+			t.Errorf("repair returned %q - expected %q", got.Body, test.want)
+		}
+	}
+}
+
+func TestToCRLF(t *testing.T) {
+	got := string(toCRLF([]byte("a\nb\r\nc\rd")))
+	if want := strings.Join([]string{"a", "b", "c", "d"}, "\r\n"); got != want {
+		t.Errorf("toCRLF returned %q - expected %q", got, want)
+	}
+}
@@ -0,0 +1,572 @@
+package copycat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// SlowMessageCount is how many of the slowest messages are listed in the report.
+const SlowMessageCount = 10
+
+// ReportEntryLimit is how many altered, skipped or malformed messages the report lists.
+// Any more are only counted, so idling for weeks doesn't grow the report without end.
+var ReportEntryLimit = 1000
+
+// RunReport is the Report that storers record how long each message took and
+// anything they had to change about it in. It is nil, for no report, unless set.
+var RunReport *Report
+
+// Report collects anything worth telling the user about once a run is
+// complete. It is safe to use from multiple goroutines and a nil *Report
+// will quietly ignore everything it is given.
+type Report struct {
+	mu      sync.Mutex
+	altered []reportEntry
+	timed   int
+	slowest []MessageTiming
+	renamed []folderRename
+	acls    []folderACL
+	// annotations a destination wouldn't take
+	unsupported []folderAnnotation
+	groupware   []groupwareFolder
+	// message cache lookups and evictions
+	cacheHits, cacheMisses, cacheEvicted int
+	// messages with headers net/mail couldn't parse, by folder and UID, and the ones
+	// past ReportEntryLimit that are only counted
+	malformed         map[malformedKey]malformedHeader
+	malformedUnlisted map[malformedKey]bool
+	// messages that weren't stored at all
+	skipped []skippedMessage
+	// how each folder went in each destination, from the sync's events (see Handle)
+	folders map[folderKey]*FolderResult
+	// how messages are being appended to each destination
+	appends map[string]appendChoice
+	// messages that arrived in the source during the sync and were left for the next run
+	late []lateArrival
+	// everything altered or skipped, listed or not
+	alteredTotal, skippedTotal int
+}
+
+// MessageTiming is how long each step of storing a message in a destination took.
+type MessageTiming struct {
+	MessageId   string        `json:"message_id"`
+	Destination string        `json:"destination"`
+	Size        int           `json:"size"`
+	Search      time.Duration `json:"search"`
+	Fetch       time.Duration `json:"fetch"`
+	Store       time.Duration `json:"store"`
+}
+
+func (t MessageTiming) Total() time.Duration {
+	return t.Search + t.Fetch + t.Store
+}
+
+type reportEntry struct {
+	MessageId string `json:"message_id"`
+	Reason    string `json:"reason"`
+}
+
+type folderRename struct {
+	Destination string `json:"destination"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+}
+
+func NewReport() *Report {
+	return &Report{}
+}
+
+// Altered records that a message was changed on its way to the destinations.
+func (r *Report) Altered(messageId string, reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.alteredTotal++
+	if len(r.altered) < ReportEntryLimit {
+		r.altered = append(r.altered, reportEntry{MessageId: messageId, Reason: reason})
+	}
+	r.mu.Unlock()
+}
+
+// Renamed records that a folder was given a different name in a destination.
+func (r *Report) Renamed(destination string, from string, to string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.renamed = append(r.renamed, folderRename{Destination: destination, From: from, To: to})
+	r.mu.Unlock()
+}
+
+type appendChoice struct {
+	Destination string        `json:"destination"`
+	Strategy    string        `json:"strategy"`
+	RoundTrip   time.Duration `json:"round_trip"`
+}
+
+// AppendStrategy records how messages are being appended to a destination (see AppendMode)
+// and the round trip time it was picked for. Only the latest is kept.
+func (r *Report) AppendStrategy(destination string, strategy string, rtt time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.appends == nil {
+		r.appends = make(map[string]appendChoice)
+	}
+	r.appends[destination] = appendChoice{Destination: destination, Strategy: strategy, RoundTrip: rtt}
+}
+
+// appendChoices are the AppendStrategy of each destination, sorted by destination.
+func (r *Report) appendChoices() []appendChoice {
+	choices := []appendChoice{}
+	for _, choice := range r.appends {
+		choices = append(choices, choice)
+	}
+	sort.Slice(choices, func(i, j int) bool { return choices[i].Destination < choices[j].Destination })
+	return choices
+}
+
+type lateArrival struct {
+	Folder   string `json:"folder"`
+	Messages int    `json:"messages"`
+}
+
+// Late records that messages arrived in the source folder during its sync and were left
+// for the next run (see LateArrivals).
+func (r *Report) Late(folder string, messages int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.late = append(r.late, lateArrival{Folder: folder, Messages: messages})
+	r.mu.Unlock()
+}
+
+type folderACL struct {
+	Account string `json:"account"`
+	Folder  string `json:"folder"`
+	ACL     ACL    `json:"acl"`
+}
+
+type folderAnnotation struct {
+	Account string `json:"account"`
+	Folder  string `json:"folder"`
+	Entry   string `json:"entry"`
+}
+
+type groupwareFolder struct {
+	Account string `json:"account"`
+	Folder  string `json:"folder"`
+	Kind    string `json:"kind"`
+	Action  string `json:"action"`
+}
+
+type skippedMessage struct {
+	Folder    string `json:"folder"`
+	MessageId string `json:"message_id"`
+	Reason    string `json:"reason"`
+}
+
+// Skipped records a message that was left out of the sync before it was fetched.
+func (r *Report) Skipped(folder string, messageId string, reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.skippedTotal++
+	if len(r.skipped) < ReportEntryLimit {
+		r.skipped = append(r.skipped, skippedMessage{Folder: folder, MessageId: messageId, Reason: reason})
+	}
+	r.mu.Unlock()
+}
+
+type malformedKey struct {
+	Folder string
+	UID    uint32
+}
+
+type malformedHeader struct {
+	MessageId string `json:"message_id"`
+	Action    string `json:"action"`
+}
+
+// Malformed records a message whose header couldn't be parsed (see ParseHeader) and what
+// was done about it. Each message is only listed, or counted past ReportEntryLimit, once
+// however often it was read.
+func (r *Report) Malformed(folder string, uid uint32, messageId string, action string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.malformed == nil {
+		r.malformed = make(map[malformedKey]malformedHeader)
+		r.malformedUnlisted = make(map[malformedKey]bool)
+	}
+	key := malformedKey{Folder: folder, UID: uid}
+	if _, listed := r.malformed[key]; !listed && len(r.malformed) >= ReportEntryLimit {
+		r.malformedUnlisted[key] = true
+		return
+	}
+	r.malformed[key] = malformedHeader{MessageId: messageId, Action: action}
+}
+
+// ACL records the ACL of a folder that admins may need to set up again.
+func (r *Report) ACL(account string, folder string, acl ACL) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.acls = append(r.acls, folderACL{Account: account, Folder: folder, ACL: acl})
+	r.mu.Unlock()
+}
+
+// Unsupported records a folder annotation (see CopyMetadata) a destination wouldn't take.
+func (r *Report) Unsupported(account string, folder string, entry string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.unsupported = append(r.unsupported, folderAnnotation{Account: account, Folder: folder, Entry: entry})
+	r.mu.Unlock()
+}
+
+// Groupware records a calendar, contacts or tasks folder that wasn't synced (see
+// GroupwareFolders) and what was done with it instead.
+func (r *Report) Groupware(account string, folder string, kind string, action string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.groupware = append(r.groupware, groupwareFolder{Account: account, Folder: folder, Kind: kind, Action: action})
+	r.mu.Unlock()
+}
+
+// CacheLookup counts a message looked for in the Cache.
+func (r *Report) CacheLookup(hit bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if hit {
+		r.cacheHits++
+	} else {
+		r.cacheMisses++
+	}
+}
+
+// CacheEvicted counts messages removed from the Cache.
+func (r *Report) CacheEvicted(count int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cacheEvicted += count
+}
+
+type folderKey struct {
+	Folder      string
+	Destination string
+}
+
+// FolderResult is how the sync of a source folder to a destination or sink went.
+type FolderResult struct {
+	Folder      string `json:"folder"`
+	Destination string `json:"destination"`
+	Copied      int    `json:"copied"`
+	// Skipped were already there (or routed there by an earlier run).
+	Skipped int   `json:"skipped"`
+	Failed  int   `json:"failed"`
+	Bytes   int64 `json:"bytes"`
+	// Duration is from when the folder was started to when it was done.
+	Duration time.Duration `json:"duration"`
+	// Errors counts the failures by their kind (ex. "quota exceeded"), or "other".
+	Errors map[string]int `json:"errors,omitempty"`
+
+	started, finished time.Time
+	checked           int
+}
+
+// Handle is a ProgressFunc that counts how each folder went in each destination for
+// the report.
+func (r *Report) Handle(e Event) {
+	if r == nil || len(e.Folder) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.folders == nil {
+		r.folders = make(map[folderKey]*FolderResult)
+	}
+	if e.Kind == FolderDone {
+		// it's sent once for every destination
+		for key, summary := range r.folders {
+			if key.Folder == e.Folder {
+				summary.finished = e.Time
+			}
+		}
+		return
+	}
+	key := folderKey{Folder: e.Folder, Destination: e.Destination}
+	summary := r.folders[key]
+	if summary == nil {
+		summary = &FolderResult{Folder: e.Folder, Destination: e.Destination, started: e.Time}
+		r.folders[key] = summary
+	}
+	switch e.Kind {
+	case FolderStarted:
+		summary.started = e.Time
+	case MessagesChecked:
+		summary.checked += e.Count
+	case MessageCopied:
+		summary.Copied++
+		summary.Bytes += int64(e.Size)
+	case MessageFailed:
+		summary.Failed++
+		if summary.Errors == nil {
+			summary.Errors = make(map[string]int)
+		}
+		kind := e.ErrorKind
+		if len(kind) == 0 {
+			kind = "other"
+		}
+		summary.Errors[kind]++
+	}
+	summary.finished = e.Time
+}
+
+// Folders returns how each folder went in each destination, by folder and destination.
+func (r *Report) Folders() []FolderResult {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.folderSummaries()
+}
+
+// folderSummaries does the work of Folders. r.mu must be held.
+func (r *Report) folderSummaries() []FolderResult {
+	summaries := make([]FolderResult, 0, len(r.folders))
+	for _, summary := range r.folders {
+		s := *summary
+		// appends are counted as checked too, whether they worked or not
+		if s.Skipped = s.checked - s.Copied - s.Failed; s.Skipped < 0 {
+			s.Skipped = 0
+		}
+		s.Duration = s.finished.Sub(s.started)
+		summaries = append(summaries, s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Folder != summaries[j].Folder {
+			return summaries[i].Folder < summaries[j].Folder
+		}
+		return summaries[i].Destination < summaries[j].Destination
+	})
+	return summaries
+}
+
+// Timed records how long a message took, keeping it if it's one of the slowest.
+func (r *Report) Timed(timing MessageTiming) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.timed++
+	if len(r.slowest) == SlowMessageCount && timing.Total() <= r.slowest[len(r.slowest)-1].Total() {
+		return
+	}
+	r.slowest = append(r.slowest, timing)
+	sort.SliceStable(r.slowest, func(i, j int) bool { return r.slowest[i].Total() > r.slowest[j].Total() })
+	if len(r.slowest) > SlowMessageCount {
+		r.slowest = r.slowest[:SlowMessageCount]
+	}
+}
+
+func (r *Report) String() string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var buf bytes.Buffer
+	if len(RunID) > 0 {
+		fmt.Fprintf(&buf, "run report (run %s):\n", RunID)
+	} else {
+		fmt.Fprintf(&buf, "run report:\n")
+	}
+	fmt.Fprintf(&buf, "  %d message(s) altered\n", r.alteredTotal)
+	for _, entry := range r.altered {
+		fmt.Fprintf(&buf, "    %s: %s\n", entry.MessageId, entry.Reason)
+	}
+	writeUnlisted(&buf, r.alteredTotal-len(r.altered))
+	if r.skippedTotal > 0 {
+		fmt.Fprintf(&buf, "  %d message(s) skipped\n", r.skippedTotal)
+		for _, entry := range r.skipped {
+			fmt.Fprintf(&buf, "    %s %s: %s\n", entry.Folder, entry.MessageId, entry.Reason)
+		}
+		writeUnlisted(&buf, r.skippedTotal-len(r.skipped))
+	}
+	if len(r.late) > 0 {
+		fmt.Fprintf(&buf, "  %d folder(s) with messages left for the next run\n", len(r.late))
+		for _, late := range r.late {
+			fmt.Fprintf(&buf, "    %s: %d message(s) arrived during the sync\n", late.Folder, late.Messages)
+		}
+	}
+	if len(r.renamed) > 0 {
+		fmt.Fprintf(&buf, "  %d folder(s) renamed\n", len(r.renamed))
+		for _, rename := range r.renamed {
+			fmt.Fprintf(&buf, "    %s: %s -> %s\n", rename.Destination, rename.From, rename.To)
+		}
+	}
+	if len(r.acls) > 0 {
+		fmt.Fprintf(&buf, "  %d folder ACL(s)\n", len(r.acls))
+		for _, acl := range r.acls {
+			fmt.Fprintf(&buf, "    %s %s: %s\n", acl.Account, acl.Folder, acl.ACL)
+		}
+	}
+	if len(r.unsupported) > 0 {
+		fmt.Fprintf(&buf, "  %d folder annotation(s) not copied\n", len(r.unsupported))
+		for _, annotation := range r.unsupported {
+			fmt.Fprintf(&buf, "    %s %s: %s\n", annotation.Account, annotation.Folder, annotation.Entry)
+		}
+	}
+	if len(r.groupware) > 0 {
+		fmt.Fprintf(&buf, "  %d groupware folder(s) not synced\n", len(r.groupware))
+		for _, folder := range r.groupware {
+			fmt.Fprintf(&buf, "    %s %s (%s): %s\n", folder.Account, folder.Folder, folder.Kind, folder.Action)
+		}
+	}
+	if len(r.malformed) > 0 {
+		keys := make([]malformedKey, 0, len(r.malformed))
+		for key := range r.malformed {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].Folder != keys[j].Folder {
+				return keys[i].Folder < keys[j].Folder
+			}
+			return keys[i].UID < keys[j].UID
+		})
+		fmt.Fprintf(&buf, "  %d message(s) with malformed headers\n", len(keys)+len(r.malformedUnlisted))
+		for _, key := range keys {
+			header := r.malformed[key]
+			fmt.Fprintf(&buf, "    %s UID %d %s: %s\n", key.Folder, key.UID, header.MessageId, header.Action)
+		}
+		writeUnlisted(&buf, len(r.malformedUnlisted))
+	}
+	if summaries := r.folderSummaries(); len(summaries) > 0 {
+		fmt.Fprintf(&buf, "  %d folder(s) synced\n", len(summaries))
+		w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "    folder\tdestination\tcopied\tskipped\tfailed\tsize\ttook\terrors")
+		for _, s := range summaries {
+			var errors []string
+			for kind, count := range s.Errors {
+				errors = append(errors, fmt.Sprintf("%s=%d", kind, count))
+			}
+			sort.Strings(errors)
+			fmt.Fprintf(w, "    %s\t%s\t%d\t%d\t%d\t%s\t%s\t%s\n", s.Folder, s.Destination, s.Copied, s.Skipped, s.Failed, FormatSize(s.Bytes), s.Duration.Truncate(time.Second), strings.Join(errors, ", "))
+		}
+		w.Flush()
+	}
+	if lookups := r.cacheHits + r.cacheMisses; lookups > 0 || r.cacheEvicted > 0 {
+		var rate float64
+		if lookups > 0 {
+			rate = 100 * float64(r.cacheHits) / float64(lookups)
+		}
+		fmt.Fprintf(&buf, "  cache: %d hit(s), %d miss(es) (%.0f%% hit rate), %d evicted\n", r.cacheHits, r.cacheMisses, rate, r.cacheEvicted)
+	}
+	if len(r.appends) > 0 {
+		fmt.Fprintf(&buf, "  appends\n")
+		for _, choice := range r.appendChoices() {
+			fmt.Fprintf(&buf, "    %s: %s (round trip %s)\n", choice.Destination, choice.Strategy, choice.RoundTrip.Round(time.Millisecond))
+		}
+	}
+	if r.timed > 0 {
+		fmt.Fprintf(&buf, "  slowest %d of %d message(s) stored\n", len(r.slowest), r.timed)
+		for _, timing := range r.slowest {
+			fmt.Fprintf(&buf, "    %s to %s (%d bytes): %s total, %s search, %s fetch, %s store\n",
+				timing.MessageId, timing.Destination, timing.Size, timing.Total(), timing.Search, timing.Fetch, timing.Store)
+		}
+	}
+	return buf.String()
+}
+
+// writeUnlisted notes how many entries past ReportEntryLimit were left out of a list.
+func writeUnlisted(buf *bytes.Buffer, count int) {
+	if count > 0 {
+		fmt.Fprintf(buf, "    ...and %d more\n", count)
+	}
+}
+
+// MarshalJSON writes everything the report has, for tools to read.
+func (r *Report) MarshalJSON() ([]byte, error) {
+	if r == nil {
+		return []byte("null"), nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	type malformedMessage struct {
+		Folder string `json:"folder"`
+		UID    uint32 `json:"uid"`
+		malformedHeader
+	}
+	malformed := []malformedMessage{}
+	for key, header := range r.malformed {
+		malformed = append(malformed, malformedMessage{Folder: key.Folder, UID: key.UID, malformedHeader: header})
+	}
+	sort.Slice(malformed, func(i, j int) bool {
+		if malformed[i].Folder != malformed[j].Folder {
+			return malformed[i].Folder < malformed[j].Folder
+		}
+		return malformed[i].UID < malformed[j].UID
+	})
+	return json.Marshal(struct {
+		RunId       string             `json:"run_id,omitempty"`
+		Folders     []FolderResult     `json:"folders"`
+		Altered     []reportEntry      `json:"altered"`
+		Skipped     []skippedMessage   `json:"skipped"`
+		Late        []lateArrival      `json:"late_arrivals"`
+		Renamed     []folderRename     `json:"renamed"`
+		ACLs        []folderACL        `json:"acls"`
+		Unsupported []folderAnnotation `json:"unsupported_annotations"`
+		Groupware   []groupwareFolder  `json:"groupware"`
+		Malformed   []malformedMessage `json:"malformed"`
+		Unlisted    map[string]int     `json:"unlisted"`
+		Cache       map[string]int     `json:"cache"`
+		Appends     []appendChoice     `json:"appends"`
+		Stored      int                `json:"stored"`
+		Slowest     []MessageTiming    `json:"slowest"`
+	}{
+		RunId:       RunID,
+		Folders:     r.folderSummaries(),
+		Altered:     r.altered,
+		Skipped:     r.skipped,
+		Late:        r.late,
+		Renamed:     r.renamed,
+		ACLs:        r.acls,
+		Unsupported: r.unsupported,
+		Groupware:   r.groupware,
+		Malformed:   malformed,
+		Unlisted:    map[string]int{"altered": r.alteredTotal - len(r.altered), "skipped": r.skippedTotal - len(r.skipped), "malformed": len(r.malformedUnlisted)},
+		Cache:       map[string]int{"hits": r.cacheHits, "misses": r.cacheMisses, "evicted": r.cacheEvicted},
+		Appends:     r.appendChoices(),
+		Stored:      r.timed,
+		Slowest:     r.slowest,
+	})
+}
@@ -0,0 +1,162 @@
+package copycat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportSlowest(t *testing.T) {
+	report := NewReport()
+	for i := 1; i <= SlowMessageCount+5; i++ {
+		report.Timed(MessageTiming{MessageId: fmt.Sprintf("<%d@example.com>", i), Destination: "dst", Fetch: time.Duration(i) * time.Second})
+	}
+
+	if len(report.slowest) != SlowMessageCount {
+		t.Fatalf("expected %d slow messages, got %d", SlowMessageCount, len(report.slowest))
+	}
+	if report.slowest[0].MessageId != fmt.Sprintf("<%d@example.com>", SlowMessageCount+5) {
+		t.Errorf("expected the slowest message first, got %s", report.slowest[0].MessageId)
+	}
+	if last := report.slowest[SlowMessageCount-1]; last.Total() != 6*time.Second {
+		t.Errorf("expected the fastest kept message to take 6s, got %s", last.Total())
+	}
+
+	out := report.String()
+	if !strings.Contains(out, fmt.Sprintf("slowest %d of %d message(s) stored", SlowMessageCount, SlowMessageCount+5)) {
+		t.Errorf("report is missing the slowest messages:\n%s", out)
+	}
+
+	// a nil report ignores timings
+	var off *Report
+	off.Timed(MessageTiming{})
+}
+
+func TestTooLarge(t *testing.T) {
+	defer func(r *Report) { RunReport = r }(RunReport)
+	RunReport = NewReport()
+	MaxMessageSize = 1024
+	defer func() { MaxMessageSize = 0 }()
+
+	if tooLarge(WorkRequest{Value: "<small@example.com>", Folder: "INBOX", Size: 1024}) {
+		t.Error("expected a message at the limit to be stored")
+	}
+	if tooLarge(WorkRequest{Value: "<unknown@example.com>", Folder: "INBOX"}) {
+		t.Error("expected a message of unknown size to be stored")
+	}
+	if !tooLarge(WorkRequest{Value: "<big@example.com>", Folder: "INBOX", Size: 1025}) {
+		t.Error("expected a message over the limit to be skipped")
+	}
+	if out := RunReport.String(); !strings.Contains(out, "1 message(s) skipped") || !strings.Contains(out, "INBOX <big@example.com>: larger than 1.0 KB") {
+		t.Errorf("report is missing the skipped message:\n%s", out)
+	}
+}
+
+func TestReportCache(t *testing.T) {
+	report := NewReport()
+	report.CacheLookup(true)
+	report.CacheLookup(true)
+	report.CacheLookup(true)
+	report.CacheLookup(false)
+	report.CacheEvicted(5)
+	if out := report.String(); !strings.Contains(out, "cache: 3 hit(s), 1 miss(es) (75% hit rate), 5 evicted") {
+		t.Errorf("report is missing the cache stats:\n%s", out)
+	}
+}
+
+func TestReportLate(t *testing.T) {
+	report := NewReport()
+	report.Late("INBOX", 4)
+	if out := report.String(); !strings.Contains(out, "INBOX: 4 message(s) arrived during the sync") {
+		t.Errorf("report is missing the late arrivals:\n%s", out)
+	}
+	raw, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), `"late_arrivals":[{"folder":"INBOX","messages":4}]`) {
+		t.Errorf("expected the late arrivals in the JSON report, got %s", raw)
+	}
+}
+
+func TestReportFolders(t *testing.T) {
+	r := NewReport()
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	events := []Event{
+		{Kind: FolderStarted, Folder: "INBOX", Destination: "bob", Count: 4},
+		{Kind: MessagesChecked, Folder: "INBOX", Destination: "bob", Count: 1},
+		{Kind: MessagesChecked, Folder: "INBOX", Destination: "bob", Count: 1},
+		{Kind: MessageCopied, Folder: "INBOX", Destination: "bob", Size: 1000},
+		{Kind: MessagesChecked, Folder: "INBOX", Destination: "bob", Count: 1},
+		{Kind: MessageFailed, Folder: "INBOX", Destination: "bob", Error: "append: [OVERQUOTA]", ErrorKind: "quota exceeded"},
+		{Kind: MessagesChecked, Folder: "INBOX", Destination: "bob", Count: 1},
+		{Kind: MessageFailed, Folder: "INBOX", Destination: "bob", Error: "append: NO"},
+		{Kind: FolderStarted, Folder: "INBOX", Destination: "archive"},
+		{Kind: FolderDone, Folder: "INBOX"},
+	}
+	for i, e := range events {
+		e.Time = start.Add(time.Duration(i) * time.Second)
+		r.Handle(e)
+	}
+
+	folders := r.Folders()
+	if len(folders) != 2 || folders[0].Destination != "archive" || folders[1].Destination != "bob" {
+		t.Fatalf("unexpected folders %+v", folders)
+	}
+	bob := folders[1]
+	if bob.Copied != 1 || bob.Skipped != 1 || bob.Failed != 2 || bob.Bytes != 1000 || bob.Duration != 9*time.Second {
+		t.Errorf("unexpected summary %+v", bob)
+	}
+	if bob.Errors["quota exceeded"] != 1 || bob.Errors["other"] != 1 {
+		t.Errorf("unexpected errors %v", bob.Errors)
+	}
+	if !strings.Contains(r.String(), "2 folder(s) synced") {
+		t.Errorf("expected the folders in the report:\n%s", r.String())
+	}
+
+	raw, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		Folders []FolderResult `json:"folders"`
+	}
+	if err = json.Unmarshal(raw, &parsed); err != nil || len(parsed.Folders) != 2 || parsed.Folders[1].Copied != 1 {
+		t.Errorf("unexpected JSON %s", raw)
+	}
+}
+
+func TestReportLimit(t *testing.T) {
+	defer func(limit int) { ReportEntryLimit = limit }(ReportEntryLimit)
+	ReportEntryLimit = 2
+
+	report := NewReport()
+	for i := 1; i <= 5; i++ {
+		id := fmt.Sprintf("<%d@example.com>", i)
+		report.Altered(id, "converted bare line endings to CRLF")
+		report.Skipped("INBOX", id, "spam")
+		report.Malformed("INBOX", uint32(i), id, "scanned")
+	}
+	// a message already listed is updated, and one that wasn't isn't counted again
+	report.Malformed("INBOX", 1, "<1@example.com>", "skipped")
+	report.Malformed("INBOX", 5, "<5@example.com>", "skipped")
+
+	if len(report.altered) != 2 || len(report.skipped) != 2 || len(report.malformed) != 2 {
+		t.Fatalf("expected 2 of each listed, got %d, %d and %d", len(report.altered), len(report.skipped), len(report.malformed))
+	}
+	out := report.String()
+	for _, want := range []string{"5 message(s) altered", "5 message(s) skipped", "5 message(s) with malformed headers", "...and 3 more", "INBOX UID 1 <1@example.com>: skipped"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report is missing %q:\n%s", want, out)
+		}
+	}
+	raw, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), `"unlisted":{"altered":3,"malformed":3,"skipped":3}`) {
+		t.Errorf("expected the unlisted counts in the JSON report, got %s", raw)
+	}
+}
@@ -0,0 +1,193 @@
+package copycat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// ResyncTarget is a message for Resync, by its UID or Message-Id in the source folder.
+type ResyncTarget struct {
+	Folder    string
+	UID       uint32
+	MessageId string
+}
+
+// ParseResyncList reads the messages to resync, one a line, as a UID or a <Message-Id>
+// in the INBOX, or a folder, a tab and either. Lines of JSON are progress events (see
+// -progress), of which the failed messages are taken, so the events of a run can be
+// passed in as they are. Blank lines and lines starting with # are skipped.
+func ParseResyncList(r io.Reader) ([]ResyncTarget, error) {
+	var targets []ResyncTarget
+	listed := make(map[ResyncTarget]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var target ResyncTarget
+		if strings.HasPrefix(text, "{") {
+			var e Event
+			if err := json.Unmarshal([]byte(text), &e); err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err.Error())
+			}
+			if e.Kind != MessageFailed || len(e.MessageId) == 0 {
+				continue
+			}
+			target = ResyncTarget{Folder: e.Folder, MessageId: e.MessageId}
+		} else {
+			item := text
+			if tab := strings.LastIndexByte(text, '\t'); tab >= 0 {
+				target.Folder, item = strings.TrimSpace(text[:tab]), strings.TrimSpace(text[tab+1:])
+			}
+			if strings.HasPrefix(item, "<") {
+				target.MessageId = item
+			} else if uid, err := strconv.ParseUint(item, 10, 32); err == nil && uid > 0 {
+				target.UID = uint32(uid)
+			} else {
+				return nil, fmt.Errorf("line %d: expected a UID or a <Message-Id>, not %q", line, item)
+			}
+		}
+		if len(target.Folder) == 0 {
+			target.Folder = "INBOX"
+		}
+		// a message that failed in every destination is only copied again once
+		if !listed[target] {
+			listed[target] = true
+			targets = append(targets, target)
+		}
+	}
+	return targets, scanner.Err()
+}
+
+// Resync puts just the targets through the sync again: each is fetched from the source
+// and stored in every destination it isn't in yet, without listing the folders. The
+// destination folders are named like a sync with -folders would name them.
+func Resync(src InboxInfo, dsts []InboxInfo, targets []ResyncTarget, transform Transformer, generateIds bool) error {
+	var folders []string
+	byFolder := make(map[string][]ResyncTarget)
+	for _, target := range targets {
+		if _, exists := byFolder[target.Folder]; !exists {
+			folders = append(folders, target.Folder)
+		}
+		byFolder[target.Folder] = append(byFolder[target.Folder], target)
+	}
+
+	dstFolders, err := resyncFolderNames(src, dsts, folders)
+	if err != nil {
+		return err
+	}
+
+	var failed int32
+	var missing int
+	for _, folder := range folders {
+		if Controls.Stopped("") {
+			return ErrCanceled
+		}
+		dstNames := make(map[string]string)
+		for user, names := range dstFolders {
+			dstNames[user] = names[folder]
+		}
+		conns, err := initiateConnections(src, dsts, folder, dstNames, 1)
+		if err != nil {
+			conns.Close()
+			log.Printf("Unable to open folder %s to resync: %s. skipping!", folder, err.Error())
+			atomic.AddInt32(&failed, int32(len(byFolder[folder])))
+			continue
+		}
+		missing += resyncFolder(conns, folder, byFolder[folder], transform, generateIds, &failed)
+		conns.Close()
+	}
+	if missing > 0 {
+		log.Printf("%d of the messages weren't found in the source", missing)
+	}
+	if n := atomic.LoadInt32(&failed); n > 0 {
+		return fmt.Errorf("%d of the messages couldn't be copied", n)
+	}
+	return nil
+}
+
+// resyncFolderNames maps each source folder to its name in each destination.
+func resyncFolderNames(src InboxInfo, dsts []InboxInfo, folders []string) (map[string]map[string]string, error) {
+	srcConn, err := GetConnection(src, true)
+	if err != nil {
+		return nil, err
+	}
+	defer srcConn.Logout(20 * time.Second)
+	delim, err := HierarchyDelimiter(srcConn)
+	if err != nil {
+		return nil, err
+	}
+	srcNamespaces, _ := GetNamespaces(srcConn)
+
+	dstFolders := make(map[string]map[string]string)
+	for _, dst := range dsts {
+		dstConn, err := GetConnection(dst, false)
+		if err != nil {
+			return nil, err
+		}
+		dstDelim, err := HierarchyDelimiter(dstConn)
+		if err != nil {
+			dstDelim = delim
+		}
+		dstNamespaces, _ := GetNamespaces(dstConn)
+		dstFolders[dst.User] = dst.folderRules().MapNamespaces(folders, delim, dstDelim, srcNamespaces, dstNamespaces)
+		dstConn.Logout(20 * time.Second)
+	}
+	return dstFolders, nil
+}
+
+// resyncFolder stores the targets in one folder, returning how many weren't found.
+func resyncFolder(conns conns, folder string, targets []ResyncTarget, transform Transformer, generateIds bool, failed *int32) (missing int) {
+	srcConn := conns.Source[0]
+	var storers sync.WaitGroup
+	var requests []chan WorkRequest
+	for user, dstConns := range conns.Dest {
+		storeRequests := make(chan WorkRequest, SearchPipelineDepth)
+		storers.Add(1)
+		go CheckAndAppendMessages(dstConns[0], user, storeRequests, nil, transform, &storers, failed)
+		requests = append(requests, storeRequests)
+	}
+
+	for _, target := range targets {
+		uids := []uint32{target.UID}
+		if len(target.MessageId) > 0 {
+			cmd, err := imap.Wait(srcConn.UIDSearch("HEADER", "Message-Id", target.MessageId))
+			if err != nil || len(cmd.Data) == 0 || len(cmd.Data[0].SearchResults()) == 0 {
+				log.Printf("Unable to find %s in %s. skipping!", target.MessageId, folder)
+				missing++
+				continue
+			}
+			uids = cmd.Data[0].SearchResults()
+		}
+		for _, uid := range uids {
+			request, err := getMessageInfo(srcConn, uid, generateIds)
+			if err != nil {
+				log.Printf("Unable to fetch message %d in %s: %s. skipping!", uid, folder, err.Error())
+				missing++
+				continue
+			}
+			request.Folder = folder
+			for _, storeRequests := range requests {
+				storeRequests <- request
+			}
+		}
+	}
+	for _, storeRequests := range requests {
+		close(storeRequests)
+	}
+	storers.Wait()
+	return missing
+}
@@ -0,0 +1,37 @@
+package copycat
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseResyncList(t *testing.T) {
+	list := `# from the report
+42
+<a@example.com>
+Archive/2019	7
+Sent	<b@example.com>
+{"kind":"error","folder":"Sent","destination":"dst1","message_id":"<c@example.com>","error":"NO quota"}
+{"kind":"error","folder":"Sent","destination":"dst2","message_id":"<c@example.com>","error":"NO quota"}
+{"kind":"copied","folder":"Sent","destination":"dst1","message_id":"<d@example.com>"}
+`
+	targets, err := ParseResyncList(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ResyncTarget{
+		{Folder: "INBOX", UID: 42},
+		{Folder: "INBOX", MessageId: "<a@example.com>"},
+		{Folder: "Archive/2019", UID: 7},
+		{Folder: "Sent", MessageId: "<b@example.com>"},
+		{Folder: "Sent", MessageId: "<c@example.com>"},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected %v, got %v", expected, targets)
+	}
+
+	if _, err = ParseResyncList(strings.NewReader("42\nabc\n")); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("expected an error on line 2, got %v", err)
+	}
+}
@@ -0,0 +1,342 @@
+package copycat
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// Route sends the messages of the source folders matching Folder that meet every one
+// of its Conditions to the Dest folder in the destinations, instead of the folder they'd
+// otherwise be copied to (see FolderRules).
+type Route struct {
+	// Folder is matched against the source folder name, ignoring case. It can have
+	// the wildcards of path.Match, ex. "*/Archive".
+	Folder     string
+	Conditions []Condition
+	// Dest is the destination folder, with the destination's hierarchy delimiter.
+	Dest string
+	// Line is the line of the file it was loaded from.
+	Line int
+}
+
+// Condition is a test of a message for a Route.
+type Condition struct {
+	// Field is from, to, cc, subject, header, larger, smaller, older or newer.
+	Field string
+	// Header is the header tested by a header condition.
+	Header string
+	// Pattern is what from, to, cc, subject and header conditions match, ignoring
+	// case. * matches any characters and ? matches one.
+	Pattern string
+	Size    int
+	Age     time.Duration
+}
+
+// Routes are checked in order and the first to match a message decides where it goes.
+var Routes []Route
+
+// RouteMessage is what routes are tested against.
+type RouteMessage struct {
+	Header       mail.Header
+	Size         int
+	InternalDate time.Time
+}
+
+// LoadRoutes reads a line for each source folder pattern, the conditions a message
+// has to meet and, after an arrow, the folder it goes to, ex:
+//
+//	# folder  conditions                   -> destination
+//	INBOX     from:*@oldcorp.com           -> OldCorp
+//	*         subject:*invoice* larger:1m  -> Finance/Invoices
+//	Sent      to:*@oldcorp.com older:365d  -> OldCorp/Sent
+//
+// Patterns with spaces can be quoted, ex. subject:"*weekly report*".
+func LoadRoutes(file string) ([]Route, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var routes []Route
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		route, err := parseRoute(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, line, err.Error())
+		}
+		route.Line = line
+		routes = append(routes, route)
+	}
+	return routes, scanner.Err()
+}
+
+func parseRoute(text string) (Route, error) {
+	var route Route
+	arrow := strings.LastIndex(text, "->")
+	if arrow < 0 {
+		return route, fmt.Errorf("expected '-> destination' at the end of %q", text)
+	}
+	if route.Dest = strings.TrimSpace(text[arrow+2:]); len(route.Dest) == 0 {
+		return route, fmt.Errorf("missing the destination folder of %q", text)
+	}
+
+	fields, err := splitQuoted(text[:arrow])
+	if err != nil {
+		return route, err
+	}
+	if len(fields) == 0 {
+		return route, fmt.Errorf("missing the source folder of %q", text)
+	}
+	route.Folder = fields[0]
+	for _, field := range fields[1:] {
+		condition, err := parseCondition(field)
+		if err != nil {
+			return route, err
+		}
+		route.Conditions = append(route.Conditions, condition)
+	}
+	return route, nil
+}
+
+// splitQuoted splits on spaces that aren't in double quotes, dropping the quotes.
+func splitQuoted(text string) ([]string, error) {
+	var fields []string
+	var field bytes.Buffer
+	var quoted, started bool
+	for _, c := range text {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			started = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if started {
+				fields = append(fields, field.String())
+				field.Reset()
+				started = false
+			}
+		default:
+			field.WriteRune(c)
+			started = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in %q", text)
+	}
+	if started {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+func parseCondition(field string) (Condition, error) {
+	parts := strings.SplitN(field, ":", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return Condition{}, fmt.Errorf("invalid condition %q", field)
+	}
+	condition := Condition{Field: strings.ToLower(parts[0]), Pattern: parts[1]}
+	var err error
+	switch condition.Field {
+	case "from", "to", "cc", "subject":
+	case "header":
+		// header:List-Id=*announce*
+		header := strings.SplitN(parts[1], "=", 2)
+		if len(header) != 2 || len(header[0]) == 0 {
+			return Condition{}, fmt.Errorf("expected header:Name=pattern, not %q", field)
+		}
+		condition.Header, condition.Pattern = header[0], header[1]
+	case "larger", "smaller":
+		if condition.Size, err = parseSize(parts[1]); err != nil || condition.Size <= 0 {
+			return Condition{}, fmt.Errorf("invalid size in %q", field)
+		}
+	case "older", "newer":
+		if condition.Age, err = parseAge(parts[1]); err != nil {
+			return Condition{}, err
+		}
+	default:
+		return Condition{}, fmt.Errorf("unknown condition %q", field)
+	}
+	return condition, nil
+}
+
+// Matches reports if a message in the source folder meets all of the route's conditions.
+func (r Route) Matches(folder string, msg RouteMessage) bool {
+	if matched, _ := path.Match(strings.ToLower(r.Folder), strings.ToLower(folder)); !matched {
+		return false
+	}
+	for _, condition := range r.Conditions {
+		if !condition.Matches(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches reports if the message meets the condition.
+func (c Condition) Matches(msg RouteMessage) bool {
+	switch c.Field {
+	case "from", "to", "cc":
+		// match the bare addresses, falling back to the raw header if it won't parse
+		addresses, err := msg.Header.AddressList(c.Field)
+		if err != nil {
+			return wildcardMatch(c.Pattern, msg.Header.Get(c.Field))
+		}
+		for _, address := range addresses {
+			if wildcardMatch(c.Pattern, address.Address) {
+				return true
+			}
+		}
+		return false
+	case "subject":
+		return wildcardMatch(c.Pattern, msg.Header.Get("Subject"))
+	case "header":
+		return wildcardMatch(c.Pattern, msg.Header.Get(c.Header))
+	case "larger":
+		return msg.Size > c.Size
+	case "smaller":
+		return msg.Size < c.Size
+	case "older":
+		return msg.InternalDate.Before(time.Now().Add(-c.Age))
+	case "newer":
+		return !msg.InternalDate.Before(time.Now().Add(-c.Age))
+	}
+	return false
+}
+
+// wildcardMatch matches s against a pattern where * is any characters and ? is one,
+// ignoring case. Unlike path.Match, * also matches slashes.
+func wildcardMatch(pattern string, s string) bool {
+	p, str := []rune(strings.ToLower(pattern)), []rune(strings.ToLower(s))
+	// the last * seen and where in str it's matching up to
+	star, mark := -1, 0
+	i, j := 0, 0
+	for j < len(str) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == str[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			star, mark = i, j
+			i++
+		case star >= 0:
+			// let the last * take one more character
+			mark++
+			i, j = star+1, mark
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
+
+// routeFor returns the Dest of the first of Routes to match the message, if any do.
+func routeFor(folder string, msg RouteMessage) (string, bool) {
+	for _, route := range Routes {
+		if route.Matches(folder, msg) {
+			return route.Dest, true
+		}
+	}
+	return "", false
+}
+
+// routeMessageData returns the folder the message should go to if it's routed.
+func routeMessageData(folder string, data MessageData) (string, bool) {
+	if len(Routes) == 0 {
+		return "", false
+	}
+	loaded, err := data.Load()
+	if err != nil {
+		log.Printf("Unable to read message to route it: %s", err.Error())
+		return "", false
+	}
+	msg := RouteMessage{Size: loaded.Size(), InternalDate: data.InternalDate, Header: mail.Header{}}
+	if parsed, err := mail.ReadMessage(bytes.NewReader(loaded.Body)); err == nil {
+		msg.Header = parsed.Header
+	}
+	return routeFor(folder, msg)
+}
+
+// appendRouted appends a routed message to the folder unless it's already there. The
+// conn's selected folder is selected again before returning; if that fails, the conn
+// can't be appended to. created has the folders this conn has already made sure exist.
+func appendRouted(conn *imap.Client, folder string, request WorkRequest, created map[string]bool) (copied bool, err error) {
+	if !created[folder] {
+		// this will fail if the folder already exists, which is fine
+		imap.Wait(conn.Create(folder))
+		created[folder] = true
+	}
+
+	selected := conn.Mailbox.Name
+	if _, err = imap.Wait(conn.Select(folder, true)); err != nil {
+		imap.Wait(conn.Select(selected, false))
+		return false, wrapError("select folder", "", err)
+	}
+	missing, _ := searchPipelined(conn, []WorkRequest{request})
+	if _, err = imap.Wait(conn.Select(selected, false)); err != nil {
+		return false, wrapError("select folder", "", err)
+	}
+	if len(missing) == 0 {
+		return false, nil
+	}
+
+	_, err = imap.Wait(conn.Append(folder, appendFlags(conn, request.Msg), &request.Msg.InternalDate, request.Msg.Literal()))
+	return err == nil, wrapError("append", "", err)
+}
+
+// RouteDecision is where a message would be copied to.
+type RouteDecision struct {
+	UID       uint32
+	MessageId string
+	From      string
+	Subject   string
+	// Dest is the folder it would go to and Routed is set if that's from one of Routes.
+	Dest   string
+	Routed bool
+}
+
+// PlanRoutes decides where each message in the folder selected on the conn would be
+// copied to, without copying anything. Messages that aren't routed go to dstFolder.
+func PlanRoutes(conn *imap.Client, dstFolder string) ([]RouteDecision, error) {
+	var decisions []RouteDecision
+	if conn.Mailbox.Messages == 0 {
+		return decisions, nil
+	}
+
+	all, _ := imap.NewSeqSet("1:*")
+	cmd, err := imap.Wait(conn.Fetch(all, "UID", "RFC822.SIZE", "INTERNALDATE", "BODY.PEEK[HEADER]"))
+	if err != nil {
+		return nil, err
+	}
+	for _, rsp := range cmd.Data {
+		info := rsp.MessageInfo()
+		if info == nil {
+			continue
+		}
+		msg := RouteMessage{Size: int(info.Size), InternalDate: info.InternalDate, Header: mail.Header{}}
+		if parsed, err := mail.ReadMessage(bytes.NewReader(imap.AsBytes(info.Attrs["BODY[HEADER]"]))); err == nil {
+			msg.Header = parsed.Header
+		}
+		decision := RouteDecision{UID: info.UID, MessageId: msg.Header.Get("Message-Id"), From: msg.Header.Get("From"), Subject: msg.Header.Get("Subject"), Dest: dstFolder}
+		if dest, routed := routeFor(conn.Mailbox.Name, msg); routed {
+			decision.Dest, decision.Routed = dest, true
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions, nil
+}
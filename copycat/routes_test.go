@@ -0,0 +1,75 @@
+package copycat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "routes")
+	ioutil.WriteFile(path, []byte(`# folder conditions -> destination
+INBOX from:*@oldcorp.com -> OldCorp
+*     subject:"*weekly report*" larger:1k -> Reports/Weekly
+Sent  header:List-Id=*announce* older:30d -> Lists
+`), 0600)
+	routes, err := LoadRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Routes = routes
+	defer func() { Routes = nil }()
+
+	raw := "From: Bob <bob@OldCorp.com>\r\nSubject: Re: the weekly report/summary\r\nList-Id: <announce.example.com>\r\nMessage-Id: <1@example.com>\r\n\r\nbody\r\n"
+	data := MessageData{Body: []byte(raw), InternalDate: time.Now().Add(-60 * 24 * time.Hour)}
+
+	if dest, routed := routeMessageData("INBOX", data); !routed || dest != "OldCorp" {
+		t.Errorf("expected the INBOX message to go to OldCorp, got %q", dest)
+	}
+	// too small for the weekly reports
+	if dest, routed := routeMessageData("Archive", data); routed {
+		t.Errorf("expected the Archive message to not be routed, got %q", dest)
+	}
+	if dest, routed := routeMessageData("sent", data); !routed || dest != "Lists" {
+		t.Errorf("expected the Sent message to go to Lists, got %q", dest)
+	}
+	data.InternalDate = time.Now()
+	if dest, routed := routeMessageData("Sent", data); routed {
+		t.Errorf("expected a new Sent message to not be routed, got %q", dest)
+	}
+
+	for _, bad := range []string{"INBOX from:*@oldcorp.com\n", "INBOX from:x ->\n", "INBOX colour:red -> Red\n", "INBOX larger:huge -> Big\n", "INBOX subject:\"open -> X\n"} {
+		ioutil.WriteFile(path, []byte(bad), 0600)
+		if _, err = LoadRoutes(path); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*@oldcorp.com", "bob@OLDCORP.com", true},
+		{"*@oldcorp.com", "bob@oldcorp.com.evil", false},
+		{"*report*", "a/b report c", true},
+		{"b?b@*", "bob@x", true},
+		{"b?b@*", "bb@x", false},
+		{"*", "", true},
+		{"a*b*c", "aXbYbZc", true},
+	} {
+		if wildcardMatch(test.pattern, test.s) != test.match {
+			t.Errorf("expected %q matching %q to be %t", test.pattern, test.s, test.match)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package copycat
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Budget caps how much a run copies, for providers with daily quotas. It is nil, for
+// no caps, unless set with NewRunBudget.
+var Budget *RunBudget
+
+// RunLimits are the caps on a run. A zero cap is no cap.
+type RunLimits struct {
+	// Messages and Bytes count every copy to every destination and sink.
+	Messages int
+	Bytes    int64
+	Duration time.Duration
+}
+
+// RunBudget stops the sync cleanly, the same as Controls.Cancel, once any of its limits
+// is reached. If Resets is set, the sync is paused instead until Reset is called, ex.
+// by Controls.Schedule as the next day's window opens.
+type RunBudget struct {
+	Limits RunLimits
+	Resets bool
+
+	mu       sync.Mutex
+	started  time.Time
+	messages int
+	bytes    int64
+	reached  bool
+	timer    *time.Timer
+}
+
+func NewRunBudget(limits RunLimits, resets bool) *RunBudget {
+	b := &RunBudget{Limits: limits, Resets: resets}
+	b.Reset()
+	return b
+}
+
+// Copied counts a message of the size copied to a destination or sink.
+func (b *RunBudget) Copied(size int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.messages++
+	b.bytes += int64(size)
+	switch {
+	case b.Limits.Messages > 0 && b.messages >= b.Limits.Messages:
+		b.reach("message")
+	case b.Limits.Bytes > 0 && b.bytes >= b.Limits.Bytes:
+		b.reach("byte")
+	}
+}
+
+// reach stops the sync, if it hasn't already been. b.mu must be held.
+func (b *RunBudget) reach(limit string) {
+	if b.reached {
+		return
+	}
+	b.reached = true
+	Stats.Add("budget_reached", 1)
+	log.Printf("reached the run's %s limit after copying %d message(s) (%s) in %s", limit, b.messages, FormatSize(b.bytes), time.Since(b.started).Truncate(time.Second))
+	if b.Resets {
+		Controls.Pause()
+	} else {
+		Controls.Cancel()
+	}
+}
+
+// Reached is true once a limit was reached, until the next Reset.
+func (b *RunBudget) Reached() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reached
+}
+
+// Reset starts the budget over, resuming the sync if it was paused by reaching it.
+func (b *RunBudget) Reset() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.reached {
+		Controls.Resume()
+	}
+	b.started, b.messages, b.bytes, b.reached = time.Now(), 0, 0, false
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	if b.Limits.Duration > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(b.Limits.Duration, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			// unless it was reset as it went off
+			if b.timer == timer {
+				b.reach("time")
+			}
+		})
+		b.timer = timer
+	}
+}
@@ -0,0 +1,39 @@
+package copycat
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RunID identifies this run in the log, report, progress events and traces. Retries
+// and shards of the same sync can share one so their keys match.
+var RunID string
+
+// NewRunID returns a random (version 4) UUID.
+func NewRunID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// should never happen, but a less random id is better than none
+		copy(b, fmt.Sprintf("%016x", time.Now().UnixNano()))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// MessageKey is the idempotency key for copying a message from a source folder to a
+// destination. It's the same in every run, so anything recorded against it is found
+// again by retries and other processes.
+func MessageKey(folder string, messageId string, destination string) string {
+	return idempotencyKey(folder, messageId, destination)
+}
+
+func idempotencyKey(parts ...string) string {
+	// parts can't have a NUL in them, so they can't run together
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,188 @@
+package copycat
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Systemd tells systemd how the run is going when copycat is started by a Type=notify
+// service (see sd_notify(3)). It is nil, and does nothing, unless set with NewSystemdNotifier.
+var Systemd *SystemdNotifier
+
+// SystemdNotifier sends READY, STATUS, WATCHDOG and STOPPING notifications to systemd.
+// Its Handle keeps the STATUS shown by systemctl up to date with the folder being synced.
+type SystemdNotifier struct {
+	conn net.Conn
+
+	mu     sync.Mutex
+	status string
+	sent   string
+	// the folder being synced, its size and how far along each destination is
+	folder  string
+	total   int
+	checked map[string]int
+	copied  int
+	failed  int
+}
+
+// statusEvery is how often STATUS is updated when there's no watchdog to ping.
+const statusEvery = 5 * time.Second
+
+// NewSystemdNotifier connects to $NOTIFY_SOCKET, returning nil if it isn't set (copycat
+// wasn't started by systemd). If the service has a WatchdogSec, the watchdog is pinged
+// every half of it for as long as no worker is stuck (see StuckWorkers), so a hung
+// run is restarted.
+func NewSystemdNotifier() (*SystemdNotifier, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if len(socket) == 0 {
+		return nil, nil
+	}
+	// a leading @ is an abstract socket
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return nil, err
+	}
+	n := &SystemdNotifier{conn: conn, checked: make(map[string]int)}
+
+	watchdog := watchdogInterval()
+	every := statusEvery
+	if watchdog > 0 && watchdog/2 < every {
+		every = watchdog / 2
+	}
+	go func() {
+		for range time.Tick(every) {
+			n.update(watchdog)
+		}
+	}()
+	return n, nil
+}
+
+// watchdogInterval is the service's WatchdogSec, or 0 if it has none or it's for another process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+func (n *SystemdNotifier) notify(state string) {
+	if _, err := n.conn.Write([]byte(state)); err != nil {
+		log.Printf("unable to notify systemd: %s", err.Error())
+	}
+}
+
+// Ready tells systemd copycat has started.
+func (n *SystemdNotifier) Ready() {
+	if n == nil {
+		return
+	}
+	n.notify("READY=1")
+}
+
+// Stopping tells systemd copycat is finishing up.
+func (n *SystemdNotifier) Stopping() {
+	if n == nil {
+		return
+	}
+	n.notify("STOPPING=1")
+}
+
+// Status sets what copycat is doing for systemctl status, ex. the job being run. It's
+// shown in front of the progress through the current folder.
+func (n *SystemdNotifier) Status(format string, args ...interface{}) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	n.status = fmt.Sprintf(format, args...)
+	n.mu.Unlock()
+	n.update(0)
+}
+
+// Handle follows the sync for the STATUS. Add it to Progress.
+func (n *SystemdNotifier) Handle(e Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch e.Kind {
+	case FolderStarted:
+		if e.Folder != n.folder {
+			n.folder, n.total = e.Folder, e.Count
+			n.checked = make(map[string]int)
+		}
+	case MessagesArrived:
+		if e.Folder == n.folder {
+			n.total += e.Count
+		}
+	case MessagesChecked:
+		if e.Folder == n.folder {
+			n.checked[e.Destination] += e.Count
+		}
+	case MessageCopied:
+		n.copied++
+	case MessageFailed:
+		n.failed++
+	}
+}
+
+// statusLine is the STATUS for where the sync is at.
+func (n *SystemdNotifier) statusLine() string {
+	var parts []string
+	if len(n.status) > 0 {
+		parts = append(parts, n.status)
+	}
+	if len(n.folder) > 0 {
+		// as far as the slowest destination has got
+		checked := -1
+		for _, count := range n.checked {
+			if checked < 0 || count < checked {
+				checked = count
+			}
+		}
+		if checked < 0 {
+			checked = 0
+		}
+		parts = append(parts, fmt.Sprintf("syncing %s (%d of %d checked)", n.folder, checked, n.total))
+	}
+	if n.copied > 0 || n.failed > 0 {
+		parts = append(parts, fmt.Sprintf("%d copied, %d failed", n.copied, n.failed))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// update sends the STATUS if it changed and pings the watchdog, if there is one,
+// unless a worker is stuck.
+func (n *SystemdNotifier) update(watchdog time.Duration) {
+	n.mu.Lock()
+	status := n.statusLine()
+	changed := status != n.sent
+	n.sent = status
+	n.mu.Unlock()
+
+	var state []string
+	if changed {
+		state = append(state, "STATUS="+status)
+	}
+	if watchdog > 0 {
+		if stuck := StuckWorkers(watchdog); len(stuck) > 0 {
+			log.Printf("not pinging the systemd watchdog, workers are stuck: %s", strings.Join(stuck, ", "))
+		} else {
+			state = append(state, "WATCHDOG=1")
+		}
+	}
+	if len(state) > 0 {
+		n.notify(strings.Join(state, "\n"))
+	}
+}
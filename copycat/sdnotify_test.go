@@ -0,0 +1,77 @@
+package copycat
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSystemdNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdnotifytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify")
+	server, err := net.ListenPacket("unixgram", socket)
+	if err != nil {
+		t.Skipf("no unix sockets: %s", err.Error())
+	}
+	defer server.Close()
+	defer os.Setenv("NOTIFY_SOCKET", os.Getenv("NOTIFY_SOCKET"))
+	os.Setenv("NOTIFY_SOCKET", socket)
+
+	n, err := NewSystemdNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func() string {
+		buf := make([]byte, 4096)
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		size, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:size])
+	}
+
+	n.Ready()
+	if got := read(); got != "READY=1" {
+		t.Errorf("expected READY=1, got %q", got)
+	}
+	n.Handle(Event{Kind: FolderStarted, Folder: "INBOX", Destination: "a", Count: 10})
+	n.Handle(Event{Kind: MessagesChecked, Folder: "INBOX", Destination: "a", Count: 5})
+	n.Handle(Event{Kind: MessagesChecked, Folder: "INBOX", Destination: "b", Count: 3})
+	n.Handle(Event{Kind: MessageCopied, Folder: "INBOX", Destination: "a"})
+	n.Status("running the job for bob")
+	expected := "STATUS=running the job for bob, syncing INBOX (3 of 10 checked), 1 copied, 0 failed"
+	if got := read(); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestStuckWorkers(t *testing.T) {
+	w := workerState("stucktest")
+	defer w.Done()
+	w.Set("appending <a@b>")
+	if stuck := StuckWorkers(time.Minute); len(stuck) != 0 {
+		t.Errorf("expected no stuck workers, got %v", stuck)
+	}
+	w.since = time.Now().Add(-2 * time.Minute)
+	if stuck := StuckWorkers(time.Minute); len(stuck) != 1 || stuck[0] != w.name+": appending <a@b> for 2m0s" {
+		t.Errorf("expected %s to be stuck, got %v", w.name, stuck)
+	}
+	w.Set("waiting")
+	w.since = time.Now().Add(-2 * time.Minute)
+	if stuck := StuckWorkers(time.Minute); len(stuck) != 0 {
+		t.Errorf("expected a waiting worker not to be stuck, got %v", stuck)
+	}
+	w.Set("cooling down")
+	w.since = time.Now().Add(-2 * time.Minute)
+	if stuck := StuckWorkers(time.Minute); len(stuck) != 0 {
+		t.Errorf("expected a throttled worker not to be stuck, got %v", stuck)
+	}
+}
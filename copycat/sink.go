@@ -0,0 +1,97 @@
+package copycat
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink is a destination for messages that isn't an IMAP inbox.
+type Sink interface {
+	// Has will check if the sink already holds a message with the given Message-Id in the folder.
+	Has(folder string, messageId string) (bool, error)
+	// Put will store the message in the sink under the folder.
+	Put(folder string, messageId string, msg MessageData) error
+	Close() error
+}
+
+// StoreToSink will wait for WorkRequests from the source folder to come across the pipe.
+// Any message the sink does not already have will be pulled from fetchRequests, passed
+// through the optional transform and put into the sink. If failed isn't nil, it's incremented
+// when a put fails.
+func StoreToSink(sink Sink, folder string, storeRequests chan WorkRequest, fetchRequests chan fetchRequest, transform Transformer, wg *sync.WaitGroup, failed *int32) {
+	defer wg.Done()
+	state := workerState("sink")
+	defer state.Done()
+
+	for request := range storeRequests {
+		Controls.Wait()
+		if Controls.Stopped(request.Folder) {
+			request.broker.skip(request.Value)
+			continue
+		}
+		state.Set("checking " + request.Value)
+		timing := MessageTiming{MessageId: request.Value, Destination: sinkName(sink)}
+		start := time.Now()
+		has, err := sink.Has(folder, request.Value)
+		timing.Search = time.Since(start)
+		if err != nil {
+			log.Printf("Unable to check sink for message (%s): %s. skipping!", request.Value, err.Error())
+			request.broker.skip(request.Value)
+			continue
+		}
+		emit(Event{Kind: MessagesChecked, Folder: folder, Destination: sinkName(sink), Count: 1})
+		if has {
+			request.broker.skip(request.Value)
+			continue
+		}
+
+		span := Tracing.StartSpan("store", nil, "message_id", request.Value, "destination", sinkName(sink), "folder", folder)
+		start = time.Now()
+		var ok bool
+		if request.Msg, ok = prepareMessage(request, fetchRequests, transform, span, failed); !ok {
+			span.Finish()
+			continue
+		}
+		timing.Fetch = time.Since(start)
+
+		state.Set("storing " + request.Value)
+		putSpan := span.Child("put", "size", strconv.Itoa(request.Msg.Size()))
+		start = time.Now()
+		msg, err := request.Msg.Load()
+		if err == nil {
+			err = sink.Put(folder, request.Value, msg)
+		}
+		timing.Store = time.Since(start)
+		timing.Size = request.Msg.Size()
+		InFlight.Release(request.Msg)
+		putSpan.Fail(err)
+		putSpan.Finish()
+		span.Fail(err)
+		span.Finish()
+		if err != nil {
+			log.Printf("Problems putting message (%s) in sink: %s", request.Value, err.Error())
+			emit(Event{Kind: MessageFailed, Folder: folder, Destination: sinkName(sink), MessageId: request.Value, Error: err.Error(), ErrorKind: errorKind(err), Key: MessageKey(folder, request.Value, sinkName(sink))})
+			countFailure(failed)
+		} else {
+			emit(Event{Kind: MessageCopied, Folder: folder, Destination: sinkName(sink), MessageId: request.Value, Size: timing.Size, Key: MessageKey(folder, request.Value, sinkName(sink))})
+			Stats.Add("sink_puts", 1)
+			Budget.Copied(timing.Size)
+			RunReport.Timed(timing)
+		}
+		state.Set("waiting")
+	}
+
+	log.Print("sink storer complete!")
+}
+
+// sinkName labels the sink in traces and reports, ex. "ArchiveSink".
+func sinkName(sink Sink) string {
+	if encrypted, ok := sink.(*EncryptedSink); ok {
+		return "Encrypted" + sinkName(encrypted.Sink)
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", sink), "*copycat.")
+}
@@ -0,0 +1,28 @@
+package copycat
+
+import "log"
+
+// MaxMessageSize skips messages larger than this many bytes, by the RFC822.SIZE the source
+// lists them with, so they're never downloaded. 0 for no limit.
+var MaxMessageSize int
+
+// CacheMaxSize keeps messages larger than this many bytes out of the Cache, so a few
+// huge attachments don't push everything else out of it. 0 for no limit.
+var CacheMaxSize int
+
+// tooLarge checks the request against MaxMessageSize, recording it in the RunReport if
+// it's skipped. Messages of unknown size are never too large.
+func tooLarge(request WorkRequest) bool {
+	if MaxMessageSize <= 0 || int(request.Size) <= MaxMessageSize {
+		return false
+	}
+	Stats.Add("skipped_size", 1)
+	log.Printf("Skipping %s in %s, it's %s", request.Value, request.Folder, FormatSize(int64(request.Size)))
+	RunReport.Skipped(request.Folder, request.Value, "larger than "+FormatSize(int64(MaxMessageSize)))
+	return true
+}
+
+// cacheable is true if a message of the size should be looked for in and added to the Cache.
+func cacheable(size uint32) bool {
+	return CacheMaxSize <= 0 || int(size) <= CacheMaxSize
+}
@@ -0,0 +1,128 @@
+package copycat
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// SkipAfter is how many runs a message has to fail in a destination for a permanent
+// reason (see permanentFailure) before later runs stop trying it. They're counted in the
+// -db, and a message that's copied after all is forgotten. 0 tries every message every run.
+var SkipAfter = 3
+
+// skipEntry is how often a message has failed permanently in a destination.
+type skipEntry struct {
+	Failures int
+	Reason   string
+	// the run it last failed in, so it's only counted once a run
+	RunID string
+}
+
+func skipKey(user string, messageId string) string {
+	// like folderStateKey, these never look like a Message-Id
+	return "skip\x00" + user + "\x00" + messageId
+}
+
+func (c *Cache) getSkipEntry(key string) (skipEntry, error) {
+	var entry skipEntry
+	raw, err := c.db.Get([]byte(key), nil)
+	if err != nil {
+		return entry, err
+	}
+	return entry, deserialize(raw, &entry)
+}
+
+func (c *Cache) putSkipEntry(key string, entry skipEntry) error {
+	raw, err := serialize(entry)
+	if err != nil {
+		return err
+	}
+	return c.db.Put([]byte(key), raw, nil)
+}
+
+// permanentFailure is true for errors a message will get from the destination every
+// time it's appended.
+func permanentFailure(err error) bool {
+	switch classifyError(err) {
+	case ErrMessageTooLarge, ErrRejected:
+		return true
+	}
+	return false
+}
+
+// skipList keeps track of the messages that keep failing permanently in each destination,
+// so a folder's storers can pass over them. A nil skipList never skips anything.
+type skipList struct {
+	cache *Cache
+
+	mu sync.Mutex
+	// how many were passed over in each destination, for the summary
+	skipped map[string]int
+}
+
+func newSkipList(cache *Cache) *skipList {
+	return &skipList{cache: cache, skipped: make(map[string]int)}
+}
+
+// skip says if the message should be passed over in the destination.
+func (s *skipList) skip(user string, messageId string) bool {
+	if s == nil || SkipAfter <= 0 {
+		return false
+	}
+	entry, err := s.cache.getSkipEntry(skipKey(user, messageId))
+	if err != nil || entry.Failures < SkipAfter {
+		return false
+	}
+	s.mu.Lock()
+	s.skipped[user]++
+	s.mu.Unlock()
+	Stats.Add("skipped_failing", 1)
+	return true
+}
+
+// failed counts a failure to append the message to the destination if it was permanent.
+func (s *skipList) failed(user string, messageId string, err error) {
+	if s == nil || !permanentFailure(err) {
+		return
+	}
+	key := skipKey(user, messageId)
+	entry, _ := s.cache.getSkipEntry(key)
+	if entry.RunID == RunID && entry.Failures > 0 {
+		return
+	}
+	entry.Failures++
+	entry.Reason = err.Error()
+	entry.RunID = RunID
+	if err := s.cache.putSkipEntry(key, entry); err != nil {
+		log.Printf("Unable to remember that %s failed in %s: %s", messageId, user, err.Error())
+	}
+}
+
+// copied forgets any failures of the message in the destination.
+func (s *skipList) copied(user string, messageId string) {
+	if s == nil {
+		return
+	}
+	key := []byte(skipKey(user, messageId))
+	if exists, _ := s.cache.db.Has(key, nil); exists {
+		s.cache.db.Delete(key, nil)
+	}
+}
+
+// summarize logs how many messages were passed over in each destination.
+func (s *skipList) summarize(folder string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var users []string
+	for user := range s.skipped {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		log.Printf("skipped %d message(s) in %s for %s that failed permanently in %d or more earlier runs. -skip-after=0 to try them again", s.skipped[user], folder, user, SkipAfter)
+	}
+}
@@ -0,0 +1,18 @@
+package copycat
+
+// MessageSource is somewhere messages can be copied from other than an IMAP inbox.
+type MessageSource interface {
+	// List returns every message in the source. It should be cheap and not pull message bodies.
+	List() ([]SourceMessage, error)
+	// Fetch pulls the full message. It must be safe to call from multiple goroutines.
+	Fetch(msg SourceMessage) (MessageData, error)
+	Close() error
+}
+
+// SourceMessage describes a message listed by a MessageSource. Key is
+// whatever the source needs to find the message again.
+type SourceMessage struct {
+	Folder    string
+	MessageId string
+	Key       string
+}
@@ -0,0 +1,63 @@
+package copycat
+
+import (
+	"log"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MaxSpamScore skips messages the source's spam filter scored above it, going by the
+// X-Spam-Score header or the score in X-Spam-Status, and messages with an X-Spam-Flag of
+// YES. The headers are fetched when the folder is listed, so the messages are never
+// downloaded. 0 copies everything.
+var MaxSpamScore float64
+
+// spamFields are fetched along with the Message-Id when MaxSpamScore is set.
+const spamFields = "X-SPAM-SCORE X-SPAM-FLAG X-SPAM-STATUS"
+
+// SpamAssassin's X-Spam-Status, ex. "Yes, score=7.3 required=5.0 tests=..."
+var spamStatusScore = regexp.MustCompile(`(?i)\bscore=(-?[0-9.]+)`)
+
+// withSpamFields adds the spamFields to a HEADER.FIELDS fetch if they're needed.
+func withSpamFields(fetch string) string {
+	if MaxSpamScore <= 0 {
+		return fetch
+	}
+	return strings.Replace(fetch, ")]", " "+spamFields+")]", 1)
+}
+
+// spamScore is the score the source gave the message, and whether it's known.
+func spamScore(header mail.Header) (float64, bool) {
+	if score, err := strconv.ParseFloat(strings.TrimSpace(header.Get("X-Spam-Score")), 64); err == nil {
+		return score, true
+	}
+	if match := spamStatusScore.FindStringSubmatch(header.Get("X-Spam-Status")); match != nil {
+		if score, err := strconv.ParseFloat(match[1], 64); err == nil {
+			return score, true
+		}
+	}
+	return 0, false
+}
+
+// isSpam checks the message's header against MaxSpamScore, recording it in the RunReport
+// if it's skipped.
+func isSpam(folder string, header mail.Header) bool {
+	if MaxSpamScore <= 0 {
+		return false
+	}
+	var reason string
+	if score, known := spamScore(header); known && score > MaxSpamScore {
+		reason = "spam score " + strconv.FormatFloat(score, 'f', -1, 64)
+	} else if strings.EqualFold(strings.TrimSpace(header.Get("X-Spam-Flag")), "YES") {
+		reason = "flagged as spam"
+	} else {
+		return false
+	}
+	id := header.Get("Message-Id")
+	Stats.Add("skipped_spam", 1)
+	log.Printf("Skipping %s in %s, %s", id, folder, reason)
+	RunReport.Skipped(folder, id, reason)
+	return true
+}
@@ -0,0 +1,66 @@
+package copycat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpam(t *testing.T) {
+	defer func(max float64) { MaxSpamScore = max }(MaxSpamScore)
+	tests := []struct {
+		header string
+		spam   bool
+	}{
+		{"Message-Id: <1@example.com>\r\nX-Spam-Score: 7.5\r\n\r\n", true},
+		{"Message-Id: <2@example.com>\r\nX-Spam-Score: 2.1\r\n\r\n", false},
+		{"Message-Id: <3@example.com>\r\nX-Spam-Status: Yes, score=12.0 required=5.0 tests=BAYES_99\r\n\r\n", true},
+		{"Message-Id: <4@example.com>\r\nX-Spam-Flag: YES\r\n\r\n", true},
+		{"Message-Id: <5@example.com>\r\nX-Spam-Flag: NO\r\nX-Spam-Score: -1.2\r\n\r\n", false},
+		{"Message-Id: <6@example.com>\r\n\r\n", false},
+	}
+
+	MaxSpamScore = 0
+	for _, test := range tests {
+		header, _ := ParseHeader([]byte(test.header))
+		if isSpam("INBOX", header) {
+			t.Errorf("expected nothing to be spam without a MaxSpamScore, got %q", test.header)
+		}
+	}
+	if fetch := withSpamFields(messageIdFetch); fetch != messageIdFetch {
+		t.Errorf("expected the fetch to be left alone, got %s", fetch)
+	}
+
+	MaxSpamScore = 5
+	for _, test := range tests {
+		header, _ := ParseHeader([]byte(test.header))
+		if spam := isSpam("INBOX", header); spam != test.spam {
+			t.Errorf("expected %q to be spam: %v", test.header, test.spam)
+		}
+	}
+	if fetch := withSpamFields(threadFetch); fetch != "BODY.PEEK[HEADER.FIELDS (MESSAGE-ID IN-REPLY-TO REFERENCES X-SPAM-SCORE X-SPAM-FLAG X-SPAM-STATUS)]" {
+		t.Errorf("unexpected fetch %s", fetch)
+	}
+}
+
+func TestIdleSpam(t *testing.T) {
+	defer func(max float64) { MaxSpamScore = max }(MaxSpamScore)
+	MaxSpamScore = 5
+	src := dialFake(t, newFakeServer())
+	defer src.Logout(time.Second)
+	for _, body := range []string{
+		"Message-Id: <spam@example.com>\r\nX-Spam-Score: 9.1\r\n\r\nbuy now\r\n",
+		"Message-Id: <ham@example.com>\r\nX-Spam-Score: 0.3\r\n\r\nhello\r\n",
+	} {
+		if err := AppendMessage(src, MessageData{InternalDate: time.Now(), Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// messages that arrive while idling are held to the same score
+	if _, err := getMessageInfo(src, 1, false); err != ErrSkipMessage {
+		t.Errorf("expected the spam to be skipped, got %v", err)
+	}
+	if request, err := getMessageInfo(src, 2, false); err != nil || request.Value != "<ham@example.com>" {
+		t.Errorf("expected the message to be copied, got %q (%v)", request.Value, err)
+	}
+}
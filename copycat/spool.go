@@ -0,0 +1,175 @@
+package copycat
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// InFlight limits the message bodies held in memory between the fetchers and storers.
+// It is nil, for no limit, unless set with NewSpool.
+var InFlight *Spool
+
+// Spool keeps track of how many bytes of message bodies are in flight. Once Max is
+// reached, bodies are written to temporary files in Dir until some are released.
+type Spool struct {
+	Max int64
+	Dir string
+
+	mu   sync.Mutex
+	held int64
+}
+
+// NewSpool creates a Spool that holds up to max bytes in memory. An empty dir
+// will spill to the default temp directory.
+func NewSpool(max int64, dir string) *Spool {
+	return &Spool{Max: max, Dir: dir}
+}
+
+// Hold will count the message against the budget or, if there's no room left for
+// it, spill its body to disk. Every held message must be given back with Release.
+func (s *Spool) Hold(msg MessageData) MessageData {
+	if s == nil || len(msg.Body) == 0 {
+		return msg
+	}
+
+	s.mu.Lock()
+	fits := s.held+int64(len(msg.Body)) <= s.Max
+	if fits {
+		s.held += int64(len(msg.Body))
+	}
+	s.mu.Unlock()
+	if fits {
+		msg.held = len(msg.Body)
+		return msg
+	}
+
+	file, err := ioutil.TempFile(s.Dir, "copycat-")
+	if err != nil {
+		log.Printf("Unable to spill message to disk: %s. keeping it in memory", err.Error())
+		return msg
+	}
+	defer file.Close()
+	if err = writeSpill(file, msg.Body); err != nil {
+		log.Printf("Unable to spill message to disk: %s. keeping it in memory", err.Error())
+		os.Remove(file.Name())
+		return msg
+	}
+
+	msg.spill = file.Name()
+	msg.spillSize = len(msg.Body)
+	msg.spillCodec = Compress.codec()
+	msg.Body = nil
+	return msg
+}
+
+// writeSpill writes the body to the file, compressed with Compress.
+func writeSpill(file *os.File, body []byte) error {
+	w, err := Compress.writer(file)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(body); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// openSpill opens a spilled body for reading.
+func openSpill(path string, codec byte) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := codecReader(codec, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, file}, nil
+}
+
+// Release gives back the memory or removes the file a held message was using.
+func (s *Spool) Release(msg MessageData) {
+	if len(msg.spill) > 0 {
+		os.Remove(msg.spill)
+	}
+	if s == nil || msg.held == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.held -= int64(msg.held)
+	s.mu.Unlock()
+}
+
+// Held is the number of bytes currently held in memory.
+func (s *Spool) Held() int64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.held
+}
+
+// Size is the size of the body, whether it's in memory or on disk.
+func (msg MessageData) Size() int {
+	if len(msg.Body) == 0 && len(msg.spill) > 0 {
+		return msg.spillSize
+	}
+	return len(msg.Body)
+}
+
+// empty is true if the message has no body in memory or on disk.
+func (msg MessageData) empty() bool {
+	return len(msg.Body) == 0 && len(msg.spill) == 0
+}
+
+// Load will read a spilled body back into memory for anything that needs to look at it.
+func (msg MessageData) Load() (MessageData, error) {
+	if len(msg.spill) == 0 || len(msg.Body) > 0 {
+		return msg, nil
+	}
+	r, err := openSpill(msg.spill, msg.spillCodec)
+	if err != nil {
+		return msg, err
+	}
+	defer r.Close()
+	msg.Body, err = ioutil.ReadAll(r)
+	return msg, err
+}
+
+// Literal returns the body to APPEND, streaming it from disk if it was spilled.
+func (msg MessageData) Literal() imap.Literal {
+	if len(msg.spill) > 0 && len(msg.Body) == 0 {
+		return spillLiteral{path: msg.spill, size: msg.spillSize, codec: msg.spillCodec}
+	}
+	return imap.NewLiteral(msg.Body)
+}
+
+// spillLiteral is an imap.Literal read from a spilled message file.
+type spillLiteral struct {
+	path  string
+	size  int
+	codec byte
+}
+
+func (l spillLiteral) WriteTo(w io.Writer) (int64, error) {
+	r, err := openSpill(l.path, l.codec)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(w, r)
+}
+
+func (l spillLiteral) Info() imap.LiteralInfo {
+	return imap.LiteralInfo{Len: uint32(l.size)}
+}
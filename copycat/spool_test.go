@@ -0,0 +1,96 @@
+package copycat
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spooltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool := NewSpool(10, dir)
+	first := spool.Hold(MessageData{Body: []byte("12345678")})
+	if len(first.spill) > 0 || first.held != 8 {
+		t.Fatalf("expected the first message to be held in memory")
+	}
+
+	second := spool.Hold(MessageData{Body: []byte("abcdefgh")})
+	if len(second.spill) == 0 || len(second.Body) != 0 {
+		t.Fatalf("expected the second message to be spilled")
+	}
+
+	var buf bytes.Buffer
+	if _, err = second.Literal().WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "abcdefgh" || second.Literal().Info().Len != 8 {
+		t.Errorf("spilled literal = %q (%d)", buf.String(), second.Literal().Info().Len)
+	}
+
+	loaded, err := second.Load()
+	if err != nil || string(loaded.Body) != "abcdefgh" {
+		t.Fatalf("unable to load spilled message: %v", err)
+	}
+
+	spool.Release(loaded)
+	if _, err = os.Stat(second.spill); !os.IsNotExist(err) {
+		t.Errorf("expected the spill file to be removed")
+	}
+
+	spool.Release(first)
+	third := spool.Hold(MessageData{Body: []byte("abcdefgh")})
+	if len(third.spill) > 0 {
+		t.Errorf("expected room in memory after release")
+	}
+}
+
+func TestSpoolCompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spooltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { Compress = Compression{} }()
+	Compress = Compression{Algorithm: "gzip", Level: -1}
+
+	body := bytes.Repeat([]byte("Subject: hi\r\n\r\nhello\r\n"), 100)
+	msg := NewSpool(0, dir).Hold(MessageData{Body: body})
+	if len(msg.spill) == 0 {
+		t.Fatal("expected the message to be spilled")
+	}
+	if info, _ := os.Stat(msg.spill); info == nil || info.Size() >= int64(len(body)) {
+		t.Errorf("expected the spilled message to be compressed")
+	}
+
+	var buf bytes.Buffer
+	if _, err = msg.Literal().WriteTo(&buf); err != nil || !bytes.Equal(buf.Bytes(), body) {
+		t.Errorf("spilled literal wasn't the body: %v", err)
+	}
+	if msg.Literal().Info().Len != uint32(len(body)) {
+		t.Errorf("expected the literal to be %d bytes, got %d", len(body), msg.Literal().Info().Len)
+	}
+	loaded, err := msg.Load()
+	if err != nil || !bytes.Equal(loaded.Body, body) {
+		t.Errorf("unable to load spilled message: %v", err)
+	}
+}
+
+func TestNewCompression(t *testing.T) {
+	for _, algorithm := range []string{"", "none", "deflate", "gzip"} {
+		if _, err := NewCompression(algorithm, 6); err != nil {
+			t.Errorf("expected %q to be supported: %v", algorithm, err)
+		}
+	}
+	if _, err := NewCompression("lz4", -1); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+	if _, err := NewCompression("gzip", 12); err == nil {
+		t.Error("expected an error for an invalid level")
+	}
+}
@@ -0,0 +1,102 @@
+package copycat
+
+import (
+	"expvar"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stats are counters for the sync pipeline published with expvar at /debug/vars.
+var Stats = expvar.NewMap("copycat")
+
+// Workers holds the current state of each storer and fetcher, published at /debug/vars.
+var Workers = expvar.NewMap("copycat_workers")
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("in_flight_bytes", expvar.Func(func() interface{} {
+		return InFlight.Held()
+	}))
+}
+
+var (
+	workerIdsMu sync.Mutex
+	workerIds   = make(map[string]int)
+	// the running workers, for StuckWorkers
+	running = make(map[string]*worker)
+)
+
+// worker is the state of a storer or fetcher as shown in Workers.
+type worker struct {
+	name  string
+	state *expvar.String
+
+	mu      sync.Mutex
+	current string
+	since   time.Time
+}
+
+// workerState registers a new worker of the given kind (ex. "storer") to keep
+// its current state in. Done must be called once the worker quits.
+func workerState(kind string) *worker {
+	workerIdsMu.Lock()
+	workerIds[kind]++
+	w := &worker{name: fmt.Sprintf("%s-%d", kind, workerIds[kind]), state: new(expvar.String)}
+	workerIdsMu.Unlock()
+
+	w.Set("starting")
+	Workers.Set(w.name, w.state)
+	workerIdsMu.Lock()
+	running[w.name] = w
+	workerIdsMu.Unlock()
+	return w
+}
+
+func (w *worker) Set(state string) {
+	w.state.Set(state)
+	w.mu.Lock()
+	w.current, w.since = state, time.Now()
+	w.mu.Unlock()
+}
+
+// Current is the state the worker was last Set to.
+func (w *worker) Current() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+func (w *worker) Done() {
+	Workers.Delete(w.name)
+	workerIdsMu.Lock()
+	delete(running, w.name)
+	workerIdsMu.Unlock()
+}
+
+// StuckWorkers lists the workers that have been busy with the same thing (anything but
+// waiting for work or cooling down after being throttled) for longer than limit, ex.
+// "storer-2: appending <id> for 5m0s". Nothing is stuck while the run is paused.
+func StuckWorkers(limit time.Duration) []string {
+	if Controls.Paused() {
+		return nil
+	}
+	var stuck []string
+	workerIdsMu.Lock()
+	defer workerIdsMu.Unlock()
+	for name, w := range running {
+		w.mu.Lock()
+		state, busy := w.current, time.Since(w.since)
+		w.mu.Unlock()
+		if busy > limit && state != "waiting" && !strings.HasPrefix(state, "waiting ") && state != "cooling down" {
+			stuck = append(stuck, fmt.Sprintf("%s: %s for %s", name, state, busy.Round(time.Second)))
+		}
+	}
+	sort.Strings(stuck)
+	return stuck
+}
@@ -1,26 +1,21 @@
 package copycat
 
 import (
-	"bytes"
+	"fmt"
 	"log"
-	"net/mail"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"code.google.com/p/go-imap/go1/imap"
 )
 
 // SearchAndStore will check check if each message in the source inbox
-// exists in the destinations. If it doesn't exist in a destination, the message info will
-// be pulled and stored into the destination.
-func SearchAndStore(src []*imap.Client, dsts map[string][]*imap.Client, dbFile string, quickSyncCount int) (err error) {
-	var cmd *imap.Command
-	cmd, err = GetAllMessages(src[0])
-	if err != nil {
-		log.Printf("Unable to get all messages!")
-		return
-	}
-
+// exists in the destinations and sinks. If it doesn't exist in a destination, the message info will
+// be pulled and stored into the destination. If generateIds is set, messages without a
+// Message-Id will be searched for by their SyntheticMessageId.
+func SearchAndStore(src []*imap.Client, dsts map[string][]*imap.Client, sinks []Sink, dbFile string, quickSyncCount int, transform Transformer, generateIds bool) (err error) {
 	// connect to cache
 	cache, err := NewCache(dbFile)
 	if err != nil {
@@ -29,55 +24,282 @@ func SearchAndStore(src []*imap.Client, dsts map[string][]*imap.Client, dbFile s
 	}
 	defer cache.Close()
 
-	// setup message fetchers to pull from the source/memcache
+	return searchAndStore(src, dsts, sinks, cache, quickSyncCount, time.Time{}, transform, generateIds)
+}
+
+// searchAndStore does the work of SearchAndStore for the folder selected on the connections
+// using an already open cache, so several folders can share it. Messages are handed to the
+// storers as the source lists them, so work starts before the whole folder is enumerated.
+// If since isn't zero, only messages received on or after its date are stored.
+func searchAndStore(src []*imap.Client, dsts map[string][]*imap.Client, sinks []Sink, cache *Cache, quickSyncCount int, since time.Time, transform Transformer, generateIds bool) (err error) {
+	folder := src[0].Mailbox.Name
+	// skipping the folder only lasts until this sync of it is over
+	defer Controls.unskip(folder)
+	total := src[0].Mailbox.Messages
+	if total == 0 {
+		log.Printf("no messages in the source %s", folder)
+		return nil
+	}
+
+	// consider quick sync
+	seq, _ := imap.NewSeqSet("")
+	syncStart := uint32(1)
+	if quickSyncCount != 0 && uint32(quickSyncCount) < total {
+		syncStart = total - uint32(quickSyncCount) + 1
+		log.Printf("found quick sync count. will only sync messages %d through %d", syncStart, total)
+	}
+	count := total - syncStart + 1
+	if since.IsZero() {
+		seq.AddRange(syncStart, 0)
+	} else {
+		cmd, err := imap.Wait(src[0].Search("SINCE", since.Format("2-Jan-2006")))
+		if err != nil {
+			return err
+		}
+		count = 0
+		for _, rsp := range cmd.Data {
+			for _, num := range rsp.SearchResults() {
+				if num >= syncStart {
+					seq.AddNum(num)
+					count++
+				}
+			}
+		}
+		if count == 0 {
+			log.Printf("no messages in the source %s since %s", folder, since.Format("2006-01-02"))
+			return nil
+		}
+	}
+
+	// a whole folder is listed in windows of UIDs, carrying on from where a run that was
+	// resumed got to
+	var from uint32
+	if since.IsZero() && EnumerateWindow > 0 {
+		if from, err = uidOf(src[0], syncStart); err != nil {
+			return err
+		}
+		if cursor := Journal.Cursor(folder, src[0].Mailbox.UIDValidity); cursor > from {
+			log.Printf("carrying on listing %s from UID %d, where the run stopped", folder, cursor)
+			from = cursor
+		}
+	}
+
+	if WarmCache {
+		if err = warmCache(src, dsts, sinks, seq, cache); err != nil {
+			log.Printf("Unable to warm the cache with the source %s: %s. messages will be fetched as they're stored", folder, err.Error())
+		}
+	}
+
+	// hand each message straight from the source to every consumer, if asked to
+	var messages *broker
+	if BrokerMemory > 0 {
+		messages = newBroker(len(dsts)+len(sinks), BrokerMemory)
+		defer messages.Close()
+	}
+
+	for user := range dsts {
+		emit(Event{Kind: FolderStarted, Folder: folder, Destination: user, Count: int(count)})
+	}
+	for _, sink := range sinks {
+		emit(Event{Kind: FolderStarted, Folder: folder, Destination: sinkName(sink), Count: int(count)})
+	}
+	log.Printf("store processing for %d messages from the source %s", count, folder)
+	skips := newSkipList(cache)
+	defer skips.summarize(folder)
+	pass := storePass(src, dsts, sinks, cache, messages, skips, seq, from, transform, generateIds)
+	err = pass.err
+	// everything listed before where listing stopped is synced, so a resumed run can start there
+	if pass.stoppedAt > 0 && pass.dispatched && pass.failed == 0 && !Controls.Stopped("") {
+		Journal.Listed(folder, src[0].Mailbox.UIDValidity, pass.stoppedAt)
+	}
+	failed := pass.failed
+
+	// mail that arrived in the source while it was being synced
+	for catchUps := 0; err == nil && pass.dispatched && pass.stoppedAt == 0 && pass.highest > 0; catchUps++ {
+		late, lateErr := lateArrivals(src[0], pass.highest)
+		if lateErr != nil {
+			log.Printf("Unable to look for messages that arrived in the source %s during the sync: %s", folder, lateErr.Error())
+			break
+		}
+		if late == 0 {
+			break
+		}
+		Stats.Add("late_arrivals", int64(late))
+		if LateArrivals != LateCatchUp || catchUps == maxCatchUps {
+			log.Printf("%d message(s) arrived in the source %s during the sync. they'll be copied on the next run", late, folder)
+			RunReport.Late(folder, late)
+			break
+		}
+		log.Printf("%d message(s) arrived in the source %s during the sync. catching up", late, folder)
+		for user := range dsts {
+			emit(Event{Kind: MessagesArrived, Folder: folder, Destination: user, Count: late})
+		}
+		for _, sink := range sinks {
+			emit(Event{Kind: MessagesArrived, Folder: folder, Destination: sinkName(sink), Count: late})
+		}
+		pass = storePass(src, dsts, sinks, cache, messages, skips, nil, pass.highest+1, transform, generateIds)
+		err = pass.err
+		failed += pass.failed
+	}
+
+	if failed > 0 && err == nil {
+		err = FailedMessages(failed)
+	}
+	if Controls.Stopped("") && err == nil {
+		err = ErrCanceled
+	}
+
+	emit(Event{Kind: FolderDone, Folder: folder, Error: errorString(err)})
+	log.Printf("search and store processes complete")
+	return err
+}
+
+// FailedMessages is the error of a sync that ran to the end but couldn't store some
+// of the messages. They're tried again on the next run.
+type FailedMessages int32
+
+func (n FailedMessages) Error() string {
+	return fmt.Sprintf("%d message(s) couldn't be stored", int32(n))
+}
+
+// The ways to handle messages that arrive in the source during a sync (see LateArrivals).
+const (
+	// LateCatchUp lists and stores them once the rest of the folder is synced.
+	LateCatchUp = "catch-up"
+	// LateNextRun leaves them, and the folder's state, for the next run to copy.
+	LateNextRun = "next-run"
+)
+
+// LateArrivals is what searchAndStore does about messages that arrived in the source
+// folder after it was listed. They're caught up on at most maxCatchUps times, in case
+// mail keeps arriving, and after that are left for the next run.
+var LateArrivals = LateCatchUp
+
+const maxCatchUps = 3
+
+// lateArrivals is how many messages in the folder selected on conn have a UID above highest.
+func lateArrivals(conn *imap.Client, highest uint32) (int, error) {
+	cmd, err := imap.Wait(conn.UIDSearch("UID", fmt.Sprintf("%d:*", highest+1)))
+	if err != nil {
+		return 0, err
+	}
+	var late int
+	for _, rsp := range cmd.Data {
+		for _, uid := range rsp.SearchResults() {
+			// n:* is always the last message, even when its UID is below n
+			if uid > highest {
+				late++
+			}
+		}
+	}
+	return late, nil
+}
+
+// passResult is how a storePass went.
+type passResult struct {
+	err    error
+	failed int32
+	// the UID listing stopped at, if it did partway (see enumerateMessages)
+	stoppedAt uint32
+	// whether every message listed was handed to the storers
+	dispatched bool
+	// the highest UID listed
+	highest uint32
+}
+
+// storePass lists the messages in seq, or from the UID from up, and stores each in the
+// destinations and sinks that don't have it yet.
+func storePass(src []*imap.Client, dsts map[string][]*imap.Client, sinks []Sink, cache *Cache, messages *broker, skips *skipList, seq *imap.SeqSet, from uint32, transform Transformer, generateIds bool) (pass passResult) {
+	folder := src[0].Mailbox.Name
+
+	// setup message fetchers to pull from the source/memcache. the first
+	// source connection joins them once it's done listing messages.
 	fetchRequests := make(chan fetchRequest)
-	for _, srcConn := range src {
-		go fetchEmails(srcConn, fetchRequests, cache)
+	for _, srcConn := range src[1:] {
+		go fetchEmails(srcConn, fetchRequests, cache, messages)
 	}
 
 	var appendRequests []chan WorkRequest
 	var storers sync.WaitGroup
 	// setup storers for each destination
-	for _, dst := range dsts {
-		storeRequests := make(chan WorkRequest)
+	for user, dst := range dsts {
+		// buffered so a storer can take a batch of requests to search for together
+		storeRequests := make(chan WorkRequest, SearchPipelineDepth)
 		for _, dstConn := range dst {
 			storers.Add(1)
-			go CheckAndAppendMessages(dstConn, storeRequests, fetchRequests, &storers)
+			go CheckAndAppendMessages(dstConn, user, storeRequests, fetchRequests, transform, &storers, &pass.failed)
 		}
 		appendRequests = append(appendRequests, storeRequests)
 	}
+	// ...and for each sink
+	for _, sink := range sinks {
+		storeRequests := make(chan WorkRequest)
+		storers.Add(1)
+		go StoreToSink(sink, folder, storeRequests, fetchRequests, transform, &storers, &pass.failed)
+		appendRequests = append(appendRequests, storeRequests)
+	}
 
-	// build the requests and send them
-	log.Printf("store processing for %d messages from the source inbox", len(cmd.Data))
-	var rsp *imap.Response
+	// list the messages in the background...
+	queue := newWorkQueue()
+	enumerated := make(chan error, 1)
+	go func() {
+		defer queue.Close()
+		var listErr error
+		pass.highest, pass.stoppedAt, listErr = enumerateMessages(src[0], seq, from, generateIds, queue)
+		listed, size := queue.Listed()
+		log.Printf("listed %d message(s) (%s) in the source %s", listed, FormatSize(size), folder)
+		for user := range dsts {
+			emit(Event{Kind: FolderListed, Folder: folder, Destination: user, Count: listed, Size: int(size)})
+		}
+		for _, sink := range sinks {
+			emit(Event{Kind: FolderListed, Folder: folder, Destination: sinkName(sink), Count: listed, Size: int(size)})
+		}
+		enumerated <- listErr
+		go fetchEmails(src[0], fetchRequests, cache, messages)
+	}()
+
+	// ...and send them out as they arrive
 	var indx int
 	startTime := time.Now()
-	syncStart := 0
-	// consider quick sync
-	if quickSyncCount != 0 {
-		syncStart = len(cmd.Data) - quickSyncCount
-		log.Printf("found quick sync count. will only sync messages %d through %d", syncStart, len(cmd.Data))
-	}
-	for indx, rsp = range cmd.Data[syncStart:] {
-		header := imap.AsBytes(rsp.MessageInfo().Attrs["RFC822.HEADER"])
-		if msg, _ := mail.ReadMessage(bytes.NewReader(header)); msg != nil {
-			header := "Message-Id"
-			value := msg.Header.Get(header)
-
-			// create the store request and pass it to each dst's storers
-			storeRequest := WorkRequest{Value: value, Header: header, UID: rsp.MessageInfo().UID}
-			for _, storeRequests := range appendRequests {
-				storeRequests <- storeRequest
-			}
+	pass.dispatched = true
+	for {
+		storeRequest, ok := queue.Pop()
+		if !ok {
+			break
+		}
+		if pass.err = budgetExceeded(dstUsers(dsts)); pass.err != nil {
+			pass.dispatched = false
+			break
+		}
+		Controls.Wait()
+		if Controls.Stopped(folder) {
+			pass.dispatched = false
+			break
+		}
+		// pass the store request to each dst's storers
+		storeRequest.Folder = folder
+		storeRequest.broker = messages
+		storeRequest.skips = skips
+		for _, storeRequests := range appendRequests {
+			storeRequests <- storeRequest
+		}
 
-			if ((indx % 100) == 0) && (indx > 0) {
-				since := time.Since(startTime)
-				rate := 100 / since.Seconds()
-				startTime = time.Now()
-				log.Printf("Completed store processing for %d messages from the source inbox. Rate: %f msg/s", indx, rate)
-			}
+		indx++
+		if (indx % 100) == 0 {
+			since := time.Since(startTime)
+			rate := 100 / since.Seconds()
+			startTime = time.Now()
+			log.Printf("Completed store processing for %d messages from the source inbox. Rate: %f msg/s", indx, rate)
+		}
+	}
+	if listErr := <-enumerated; listErr != nil {
+		log.Printf("Unable to list all messages: %s", listErr.Error())
+		if pass.err == nil {
+			pass.err = listErr
 		}
 	}
+	// anything left if the storers stopped early
+	queue.Discard()
 
 	// after everything is on the channel, close them...
 	for _, storeRequests := range appendRequests {
@@ -88,62 +310,252 @@ func SearchAndStore(src []*imap.Client, dsts map[string][]*imap.Client, dbFile s
 
 	// once the storers are complete we can close the fetch channel
 	close(fetchRequests)
+	return pass
+}
 
-	log.Printf("search and store processes complete")
-	return nil
+// countFailure increments failed, if it isn't nil.
+func countFailure(failed *int32) {
+	if failed != nil {
+		atomic.AddInt32(failed, 1)
+	}
 }
 
+// SearchPipelineDepth is the most UID SEARCH commands that will be sent on a destination
+// connection before waiting on their responses.
+const SearchPipelineDepth = 8
+
 // checkAndStoreMessages will wait for WorkRequests to come acorss the pipe. When it receives a request, it will search
 // the given destination inbox for the message. If it is not found, this method will attempt to pull the messages data
-// from fetchRequests and then append it to the destination.
-func CheckAndAppendMessages(dstConn *imap.Client, storeRequests chan WorkRequest, fetchRequests chan fetchRequest, wg *sync.WaitGroup) {
+// from fetchRequests, pass it through the optional transform and then append it to the destination. Any requests
+// that are already waiting are searched for together, with the searches pipelined on the connection.
+// Messages that fail to append are skipped until the destination (by dstUser) uses up its
+// error budget (see MaxAppendFailures), then the rest of the requests are ignored. If failed
+// isn't nil, it's incremented when an append fails.
+func CheckAndAppendMessages(dstConn *imap.Client, dstUser string, storeRequests chan WorkRequest, fetchRequests chan fetchRequest, transform Transformer, wg *sync.WaitGroup, failed *int32) {
 	defer wg.Done()
+	state := workerState("storer")
+	defer state.Done()
+
+	allMail := gmailAllMail(dstConn)
+	budget := destinationBudget(dstUser)
+	folder := dstConn.Mailbox.Name
+	// the folders messages have been routed to (see Routes), which go in the personal namespace
+	// under the destination's root
+	created := make(map[string]bool)
+	var namespace, delim string
+	root := destinationRoot(dstUser)
+	if len(Routes) > 0 {
+		namespace, _ = PersonalNamespace(dstConn)
+		if len(root) > 0 {
+			delim, _ = HierarchyDelimiter(dstConn)
+		}
+	}
+
+	tuner := newAppendTuner(dstConn, dstUser)
+	var queued []*pendingAppend
+	var queuedBytes int
+
+	// appendOne appends a message on its own, trying again while the destination is throttling.
+	appendOne := func(p *pendingAppend) (uid uint32, uidValidity uint32, copied bool, err error) {
+		copied = true
+		for attempt := 1; ; attempt++ {
+			coolDown(dstUser, state)
+			if p.dest != folder {
+				p.appendSpan.Set("folder", p.dest)
+				copied, err = appendRouted(dstConn, p.dest, p.request, created)
+			} else {
+				uid, err = appendMessageUID(dstConn, p.request.Msg)
+				uidValidity = dstConn.Mailbox.UIDValidity
+			}
+			// being throttled says nothing about the message, so it's tried again
+			if attempt > throttleRetries || !throttled(dstUser, err) || Controls.Stopped("") {
+				return
+			}
+		}
+	}
+
+	// finish records how the append went. It returns false if the storer can't carry on.
+	finish := func(p *pendingAppend, uid uint32, uidValidity uint32, copied bool, err error) bool {
+		request := p.request
+		Journal.Appended(p.journal, uidValidity, uid, err)
+		p.timing.Store = time.Since(p.start)
+		p.timing.Size = request.Msg.Size()
+		InFlight.Release(request.Msg)
+		p.appendSpan.Fail(err)
+		p.appendSpan.Finish()
+		p.span.Fail(err)
+		p.span.Finish()
+		if dstConn.Mailbox == nil || dstConn.Mailbox.Name != folder {
+			log.Printf("Problems selecting %s again after routing a message: %s. quitting.", folder, errorString(err))
+			return false
+		}
+		if err == nil && !copied {
+			// already routed there by an earlier run
+			emit(Event{Kind: MessagesChecked, Folder: request.Folder, Destination: dstUser, Count: 1})
+			return true
+		}
+		if e, ok := err.(*Error); ok {
+			e.MessageId = request.Value
+			e.Account = dstUser
+		}
+		budget.Record(err)
+		emit(Event{Kind: MessagesChecked, Folder: request.Folder, Destination: dstUser, Count: 1})
+		if err != nil {
+			log.Printf("%s. skipping!", err.Error())
+			emit(Event{Kind: MessageFailed, Folder: request.Folder, Destination: dstUser, MessageId: request.Value, Error: err.Error(), ErrorKind: errorKind(err), Key: MessageKey(request.Folder, request.Value, dstUser)})
+			countFailure(failed)
+			request.skips.failed(dstUser, request.Value, err)
+			return true
+		}
+		request.skips.copied(dstUser, request.Value)
+		emit(Event{Kind: MessageCopied, Folder: request.Folder, Destination: dstUser, MessageId: request.Value, Size: p.timing.Size, Key: MessageKey(request.Folder, request.Value, dstUser)})
+		Stats.Add("appended", 1)
+		Budget.Copied(p.timing.Size)
+		RunReport.Timed(p.timing)
+		return true
+	}
+
+	// flush appends the queued messages together (see AppendMode). Any that fail are
+	// tried again on their own, which also gives them appendMessageUID's handling of
+	// flags the server won't take.
+	flush := func() bool {
+		if len(queued) == 0 {
+			return true
+		}
+		batch := queued
+		queued, queuedBytes = nil, 0
+		msgs := make([]MessageData, len(batch))
+		for i, p := range batch {
+			msgs[i] = p.request.Msg
+		}
+		state.Set(fmt.Sprintf("appending %d messages", len(batch)))
+		coolDown(dstUser, state)
+		start := time.Now()
+		uids, errs := tuner.appendBatch(msgs)
+		uidValidity := dstConn.Mailbox.UIDValidity
+		ok := true
+		for i, p := range batch {
+			p.start = start
+			uid, err := uids[i], errs[i]
+			if err != nil && ok && !abortsRun(err) {
+				state.Set("appending " + p.request.Value)
+				uid, uidValidity, _, err = appendOne(p)
+			}
+			if !finish(p, uid, uidValidity, true, err) {
+				ok = false
+			}
+		}
+		return ok
+	}
 
 	// noop it every few to keep things alive
 	timeout := time.NewTicker(NoopMinutes * time.Minute)
 	done := false
 	for {
+		state.Set("waiting")
 		select {
 		case request, ok := <-storeRequests:
 			if !ok {
 				done = true
 				break
 			}
-			// search for in dst
-			cmd, err := imap.Wait(dstConn.UIDSearch([]imap.Field{"HEADER", request.Header, request.Value}))
-			if err != nil {
-				log.Printf("Unable to search for message (%s): %s. skippin!", request.Value, err.Error())
+			if budget.Exceeded() {
+				log.Printf("NOT STORING %s in %s: %s", request.Value, dstUser, budget.err())
+				request.broker.skip(request.Value)
 				continue
 			}
+			waitWhilePaused(timeout.C, tuner.noop)
+			coolDown(dstUser, state)
+
+			state.Set("searching")
+			var batch []WorkRequest
+			batch, ok = receiveBatch(request, storeRequests, SearchPipelineDepth)
+			done = !ok
+
+			search := Tracing.StartSpan("search", nil, "destination", dstUser, "folder", dstConn.Mailbox.Name, "messages", strconv.Itoa(len(batch)))
+			missing, _ := searchPipelined(dstConn, batch)
+			if len(allMail) > 0 && len(missing) > 0 {
+				var err error
+				if missing, err = gmailSentDedup(dstConn, allMail, missing); err != nil {
+					search.Fail(err)
+					search.Finish()
+					log.Printf("Problems selecting the sent folder again after looking in %s: %s. quitting.", allMail, err.Error())
+					return
+				}
+			}
+			search.Finish()
+			emit(Event{Kind: MessagesChecked, Folder: request.Folder, Destination: dstUser, Count: len(batch) - len(missing)})
+			skipFound(batch, missing)
 
-			results := cmd.Data[0].SearchResults()
 			// if not found, PULL from SRC and STORE in DST
-			if len(results) == 0 {
-				// only fetch if we dont have data already
-				if len(request.Msg.Body) == 0 {
-					// build and send fetch request
-					response := make(chan MessageData)
-					fr := fetchRequest{MessageId: request.Value, UID: request.UID, Response: response}
-					fetchRequests <- fr
-
-					// grab response from fetchers
-					request.Msg = <-response
+			for _, request := range missing {
+				waitWhilePaused(timeout.C, tuner.noop)
+				if budget.Exceeded() {
+					log.Printf("NOT STORING %s in %s: %s", request.Value, dstUser, budget.err())
+				}
+				if budget.Exceeded() || Controls.Stopped(request.Folder) {
+					request.broker.skip(request.Value)
+					continue
+				}
+				if request.skips.skip(dstUser, request.Value) {
+					request.broker.skip(request.Value)
+					emit(Event{Kind: MessagesChecked, Folder: request.Folder, Destination: dstUser, Count: 1})
+					continue
 				}
-				if len(request.Msg.Body) == 0 {
-					log.Printf("No data found for from fetch request (%s). giving up", request.Value)
+				if appendConfirmed(dstConn, dstUser, request.Value) {
+					// the destination's search hasn't caught up with an earlier append
+					request.broker.skip(request.Value)
+					emit(Event{Kind: MessagesChecked, Folder: request.Folder, Destination: dstUser, Count: 1})
 					continue
 				}
+				span := Tracing.StartSpan("store", nil, "message_id", request.Value, "destination", dstUser, "folder", dstConn.Mailbox.Name)
+				state.Set("fetching " + request.Value)
+				timing := MessageTiming{MessageId: request.Value, Destination: dstUser, Search: request.searched}
+				start := time.Now()
+				var ok bool
+				if request.Msg, ok = prepareMessage(request, fetchRequests, transform, span, failed); !ok {
+					span.Finish()
+					continue
+				}
+				timing.Fetch = time.Since(start)
 
-				err = AppendMessage(dstConn, request.Msg)
-				if err != nil {
-					log.Printf("Problems appending message to dst: %s. quitting.", err.Error())
-					return
+				if request.Msg.flagsSet {
+					request.Msg.Flags = supportedKeywords(dstConn, request.Value, request.Msg.Flags)
 				}
 
+				p := &pendingAppend{request: request, span: span, timing: timing}
+				p.appendSpan = span.Child("append", "size", strconv.Itoa(request.Msg.Size()))
+				dest, routed := routeMessageData(request.Folder, request.Msg)
+				if p.dest = addNamespace(underRoot(root, dest, delim), namespace); !routed {
+					p.dest = folder
+				}
+				p.journal = Journal.Appending(p.dest, request.Value, dstUser)
+
+				// messages for the folder are appended together when batching
+				if p.dest == folder && tuner.batching() {
+					if tuner.full(len(queued), queuedBytes+request.Msg.Size()) && !flush() {
+						return
+					}
+					queued = append(queued, p)
+					queuedBytes += request.Msg.Size()
+					continue
+				}
+				if !flush() {
+					return
+				}
+				state.Set("appending " + request.Value)
+				p.start = time.Now()
+				uid, uidValidity, copied, err := appendOne(p)
+				if !finish(p, uid, uidValidity, copied, err) {
+					return
+				}
+			}
+			if !flush() {
+				return
 			}
 
 		case <-timeout.C:
-			imap.Wait(dstConn.Noop())
+			tuner.noop()
 		}
 
 		if done {
@@ -155,43 +567,221 @@ func CheckAndAppendMessages(dstConn *imap.Client, storeRequests chan WorkRequest
 	return
 }
 
+// waitWhilePaused blocks like Controls.Wait, calling noop on each tick so a connection
+// isn't dropped by the server for being idle while the sync is paused.
+func waitWhilePaused(tick <-chan time.Time, noop func()) {
+	for {
+		select {
+		case <-Controls.Resumed():
+			return
+		case <-Controls.Canceled():
+			return
+		case <-tick:
+			noop()
+		}
+	}
+}
+
+// pendingAppend is a message a storer has fetched and is appending to its destination.
+type pendingAppend struct {
+	request    WorkRequest
+	dest       string
+	journal    string
+	span       *Span
+	appendSpan *Span
+	timing     MessageTiming
+	start      time.Time
+}
+
+// appendConfirmed is true if the Journal has the message as appended to the folder selected
+// on the destination and it's still there under the UID it was given.
+func appendConfirmed(conn *imap.Client, user string, messageId string) bool {
+	confirmed, exists := Journal.Confirmed(conn.Mailbox.Name, messageId, user)
+	if !exists || confirmed.UID == 0 || confirmed.UIDValidity != conn.Mailbox.UIDValidity {
+		return false
+	}
+	cmd, err := imap.Wait(conn.UIDSearch([]imap.Field{"UID", strconv.FormatUint(uint64(confirmed.UID), 10)}))
+	if err != nil || len(cmd.Data) == 0 || len(cmd.Data[0].SearchResults()) == 0 {
+		return false
+	}
+	log.Printf("%s was already appended to %s as UID %d. skipping!", messageId, user, confirmed.UID)
+	return true
+}
+
+// skipFound tells the broker the requests in the batch that aren't missing won't be fetched.
+func skipFound(batch, missing []WorkRequest) {
+	fetching := make(map[string]int)
+	for _, request := range missing {
+		fetching[request.Value]++
+	}
+	for _, request := range batch {
+		if fetching[request.Value] > 0 {
+			fetching[request.Value]--
+			continue
+		}
+		request.broker.skip(request.Value)
+	}
+}
+
+// receiveBatch will add any requests that are ready to the first one, up to max, without blocking.
+// If the channel is found to be closed, open will be false.
+func receiveBatch(first WorkRequest, requests chan WorkRequest, max int) (batch []WorkRequest, open bool) {
+	batch = []WorkRequest{first}
+	for len(batch) < max {
+		select {
+		case request, ok := <-requests:
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, request)
+		default:
+			return batch, true
+		}
+	}
+	return batch, true
+}
+
+// searchPipelined sends a UID SEARCH for each request before waiting on any of them and
+// returns the requests that were not found and the ones that could not be searched.
+func searchPipelined(conn *imap.Client, batch []WorkRequest) (missing, failed []WorkRequest) {
+	start := time.Now()
+	cmds := make([]*imap.Command, len(batch))
+	errs := make([]error, len(batch))
+	for i, request := range batch {
+		cmds[i], errs[i] = conn.UIDSearch(dedupSearch(request.Header, request.Value))
+	}
+
+	Stats.Add("searched", int64(len(batch)))
+	for i, request := range batch {
+		cmd, err := imap.Wait(cmds[i], errs[i])
+		if err != nil {
+			log.Printf("Unable to search for message (%s): %s. skippin!", request.Value, err.Error())
+			failed = append(failed, request)
+			continue
+		}
+		if len(cmd.Data) == 0 || len(cmd.Data[0].SearchResults()) == 0 {
+			request.searched = time.Since(start)
+			missing = append(missing, request)
+		}
+	}
+	return missing, failed
+}
+
+// prepareMessage will pull the request's message data from the fetchers if we don't
+// have it already and pass it through the optional transform. If the message should
+// not be stored, false will be returned. A message that is returned must be given back
+// to InFlight with Release once it's stored. Each step is traced under the span. A
+// transform that fails, rather than skipping the message, is counted in failed.
+func prepareMessage(request WorkRequest, fetchRequests chan fetchRequest, transform Transformer, span *Span, failed *int32) (MessageData, bool) {
+	// only fetch if we dont have data already
+	if len(request.Msg.Body) > 0 {
+		request.broker.skip(request.Value)
+	} else {
+		// build and send fetch request
+		fetchSpan := span.Child("fetch")
+		response := make(chan MessageData)
+		fr := fetchRequest{MessageId: request.Value, UID: request.UID, Size: request.Size, Response: response, Span: fetchSpan}
+		fetchRequests <- fr
+
+		// grab response from fetchers
+		request.Msg = <-response
+		fetchSpan.Finish()
+	}
+	if request.Msg.empty() {
+		log.Printf("No data found for from fetch request (%s). giving up", request.Value)
+		span.Fail(NotFound)
+		return request.Msg, false
+	}
+
+	if transform != nil {
+		transformSpan := span.Child("transform")
+		msg, err := request.Msg.Load()
+		if err == nil {
+			msg, err = transform.Transform(msg)
+		}
+		if err == ErrSkipMessage {
+			transformSpan.Set("skipped", "true")
+		} else {
+			transformSpan.Fail(err)
+		}
+		transformSpan.Finish()
+		if err != nil {
+			if err != ErrSkipMessage {
+				log.Printf("Unable to transform message (%s): %s. skippin!", request.Value, err.Error())
+				countFailure(failed)
+			}
+			InFlight.Release(request.Msg)
+			return request.Msg, false
+		}
+		request.Msg = msg
+	}
+
+	return request.Msg, true
+}
+
 type fetchRequest struct {
 	MessageId string
 	UID       uint32
+	Size      uint32
 	Response  chan MessageData
+	Span      *Span
 }
 
-// FetchEmails will sit and wait for fetchRequests from the destination workers.
-func fetchEmails(conn *imap.Client, requests chan fetchRequest, cache *Cache) {
+// FetchEmails will sit and wait for fetchRequests from the destination workers. If messages
+// isn't nil, they're passed through it instead of being put in the cache.
+func fetchEmails(conn *imap.Client, requests chan fetchRequest, cache *Cache, messages *broker) {
+	state := workerState("fetcher")
+	defer state.Done()
 
 	// noop every few to keep things alive
 	timeout := time.NewTicker(NoopMinutes * time.Minute)
 	done := false
 	for {
+		state.Set("waiting")
 		select {
 		case request, ok := <-requests:
 			if !ok {
 				done = true
 				break
 			}
-			found := true
-			// check if the message body is in cache
-			data, err := cache.Get(request.MessageId)
-			if err != nil {
-				found = false
-				if err != ErrNotFound {
+			state.Set("fetching " + request.MessageId)
+			if messages != nil {
+				msgData, err := messages.take(request.MessageId, func() (MessageData, error) {
+					return brokerFetch(conn, request, cache, state)
+				})
+				if err != nil && err != NotFound {
+					log.Printf("Problems fetching message (%s) data: %s. Passing request and quitting.", request.MessageId, err.Error())
+					requests <- request
+					return
+				}
+				request.Response <- InFlight.Hold(msgData)
+				continue
+			}
+			found := false
+			var data MessageData
+			// check if the message body is in cache, unless it's too large to be kept there
+			if cacheable(request.Size) {
+				cacheSpan := request.Span.Child("cache")
+				cached, err := cache.Get(request.MessageId)
+				cacheSpan.Set("hit", strconv.FormatBool(err == nil))
+				cacheSpan.Finish()
+				if err == nil {
+					data, found = cached, true
+				} else if err != ErrNotFound {
 					log.Printf("problems pulling message data from cache: %s. Pulling message from src...", err.Error())
 				}
-				data = MessageData{}
 			}
 
 			if found {
 				log.Print("cache success!")
-				request.Response <- data
+				request.Response <- InFlight.Hold(data)
 				continue
 			}
 
-			msgData, err := FetchMessage(conn, request.UID)
+			srcSpan := request.Span.Child("source", "uid", strconv.FormatUint(uint64(request.UID), 10))
+			msgData, err := fetchThrottled(conn, request.UID, state)
+			srcSpan.Fail(err)
+			srcSpan.Finish()
 			if err != nil {
 				if err == NotFound {
 					log.Printf("No data found for UID: %d", request.UID)
@@ -201,10 +791,13 @@ func fetchEmails(conn *imap.Client, requests chan fetchRequest, cache *Cache) {
 					return
 				}
 			}
-			request.Response <- msgData
+			Stats.Add("fetched", 1)
+			request.Response <- InFlight.Hold(msgData)
 
-			err = cache.Put(request.MessageId, msgData)
-			if err != nil {
+			if !cacheable(request.Size) {
+				continue
+			}
+			if err = cache.Put(request.MessageId, msgData); err != nil {
 				log.Printf("Unable to add message (%s) to cache: %s", request.MessageId, err.Error())
 			}
 
@@ -218,3 +811,24 @@ func fetchEmails(conn *imap.Client, requests chan fetchRequest, cache *Cache) {
 	}
 
 }
+
+// brokerFetch pulls the request's message from the cache, if it was warmed, or the source
+// without adding it to the cache.
+func brokerFetch(conn *imap.Client, request fetchRequest, cache *Cache, state *worker) (MessageData, error) {
+	if cacheable(request.Size) {
+		if data, err := cache.Get(request.MessageId); err == nil {
+			return data, nil
+		}
+	}
+	srcSpan := request.Span.Child("source", "uid", strconv.FormatUint(uint64(request.UID), 10))
+	data, err := fetchThrottled(conn, request.UID, state)
+	srcSpan.Fail(err)
+	srcSpan.Finish()
+	if err == NotFound {
+		log.Printf("No data found for UID: %d", request.UID)
+	}
+	if err == nil || err == NotFound {
+		Stats.Add("fetched", 1)
+	}
+	return data, err
+}
@@ -0,0 +1,82 @@
+package copycat
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+func TestReceiveBatch(t *testing.T) {
+	requests := make(chan WorkRequest, 10)
+	for i := 0; i < 5; i++ {
+		requests <- WorkRequest{UID: uint32(i + 2)}
+	}
+
+	batch, open := receiveBatch(WorkRequest{UID: 1}, requests, 4)
+	if !open || len(batch) != 4 {
+		t.Fatalf("expected an open batch of 4, got %d (open: %t)", len(batch), open)
+	}
+	for i, request := range batch {
+		if request.UID != uint32(i+1) {
+			t.Errorf("batch[%d].UID = %d, want %d", i, request.UID, i+1)
+		}
+	}
+
+	// only what's ready is taken
+	batch, open = receiveBatch(WorkRequest{UID: 5}, requests, 4)
+	if !open || len(batch) != 3 {
+		t.Fatalf("expected an open batch of 3, got %d (open: %t)", len(batch), open)
+	}
+
+	close(requests)
+	batch, open = receiveBatch(WorkRequest{UID: 8}, requests, 4)
+	if open || len(batch) != 1 {
+		t.Fatalf("expected a closed batch of 1, got %d (open: %t)", len(batch), open)
+	}
+}
+
+func TestDedupSearch(t *testing.T) {
+	defer func(headers []string) { DedupHeaders = headers }(DedupHeaders)
+
+	DedupHeaders = nil
+	if search := fmt.Sprint(dedupSearch("Message-Id", "<a@b>")); search != "[HEADER Message-Id <a@b>]" {
+		t.Errorf("unexpected search %s", search)
+	}
+	DedupHeaders = []string{"X-MS-Exchange-Organization-OriginalMessageId", "Resent-Message-ID"}
+	expected := "[OR OR HEADER Message-Id <a@b> HEADER X-MS-Exchange-Organization-OriginalMessageId <a@b> HEADER Resent-Message-ID <a@b>]"
+	if search := fmt.Sprint(dedupSearch("Message-Id", "<a@b>")); search != expected {
+		t.Errorf("expected %s, got %s", expected, search)
+	}
+}
+
+func TestListWindows(t *testing.T) {
+	defer func(window uint32) { EnumerateWindow = window }(EnumerateWindow)
+	EnumerateWindow = 10000
+	conn := &imap.Client{Mailbox: &imap.MailboxStatus{Name: "Archive", UIDNext: 25001}}
+
+	var starts []uint32
+	stoppedAt, err := listWindows(conn, 1, func(window *imap.SeqSet, start uint32) error {
+		starts = append(starts, start)
+		return nil
+	})
+	if err != nil || stoppedAt != 0 {
+		t.Fatalf("expected the listing to finish, got %d, %v", stoppedAt, err)
+	}
+	if want := []uint32{1, 10001, 20001}; !reflect.DeepEqual(starts, want) {
+		t.Errorf("expected windows starting at %v, got %v", want, starts)
+	}
+
+	// a lost connection isn't worth trying again, and listing can carry on from where it stopped
+	stoppedAt, err = listWindows(conn, 5, func(window *imap.SeqSet, start uint32) error {
+		if start > 5 {
+			return &Error{Kind: ErrConnLost, Op: "fetch", Err: errors.New("connection reset")}
+		}
+		return nil
+	})
+	if err == nil || stoppedAt != 10005 {
+		t.Errorf("expected the listing to stop at UID 10005, got %d, %v", stoppedAt, err)
+	}
+}
@@ -0,0 +1,44 @@
+//go:build !windows
+// +build !windows
+
+package copycat
+
+import (
+	"errors"
+	"io"
+	"log/syslog"
+)
+
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func newSyslogWriter(network string, address string, tag string) (io.Writer, error) {
+	w, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+func (s *syslogWriter) Write(p []byte) (int, error) {
+	message := logMessage(p)
+	var err error
+	switch logPriority(message) {
+	case priorityErr:
+		err = s.w.Err(message)
+	case priorityWarning:
+		err = s.w.Warning(message)
+	default:
+		err = s.w.Info(message)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// newEventLogWriter fails since only Windows has the event log.
+func newEventLogWriter(source string) (io.Writer, error) {
+	return nil, errors.New("the event log is only available on Windows")
+}
@@ -0,0 +1,54 @@
+package copycat
+
+import (
+	"errors"
+	"io"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// newSyslogWriter fails since Windows has no syslog.
+func newSyslogWriter(network string, address string, tag string) (io.Writer, error) {
+	return nil, errors.New("syslog isn't available on Windows")
+}
+
+type eventLogWriter struct {
+	log *eventlog.Log
+}
+
+// newEventLogWriter writes to the Windows event log as the source, which has to have
+// been registered (see InstallEventSource).
+func newEventLogWriter(source string) (io.Writer, error) {
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLogWriter{log: l}, nil
+}
+
+// InstallEventSource registers the source so it can write to the event log.
+func InstallEventSource(source string) error {
+	return eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info)
+}
+
+// RemoveEventSource unregisters a source added with InstallEventSource.
+func RemoveEventSource(source string) error {
+	return eventlog.Remove(source)
+}
+
+func (e *eventLogWriter) Write(p []byte) (int, error) {
+	message := logMessage(p)
+	var err error
+	switch logPriority(message) {
+	case priorityErr:
+		err = e.log.Error(1, message)
+	case priorityWarning:
+		err = e.log.Warning(1, message)
+	default:
+		err = e.log.Info(1, message)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,142 @@
+package copycat
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTenant holds the limits of tenants that aren't listed on their own.
+const DefaultTenant = "*"
+
+// TenantLimits share a JobQueue out between tenants so one tenant's huge migration
+// can't starve the rest. Zero means no limit.
+type TenantLimits struct {
+	// MaxJobs is the most of the tenant's jobs that can run at once.
+	MaxJobs int
+	// MaxConns is the most connections each of the tenant's jobs can have open to
+	// any one server.
+	MaxConns int
+	// Bandwidth is the most bytes per second all of the tenant's jobs can append.
+	Bandwidth int
+
+	// Limiter is the tenant's share of Bandwidth, set by the JobQueue.
+	Limiter *RateLimiter
+}
+
+// limits returns the limits of the tenant, the DefaultTenant's limits, or no limits.
+func (q *JobQueue) limits(tenant string) TenantLimits {
+	if limits, exists := q.Tenants[tenant]; exists {
+		return limits
+	}
+	return q.Tenants[DefaultTenant]
+}
+
+// Conns returns the number of connections to use for a job that asked for conns.
+func (l TenantLimits) Conns(conns int) int {
+	if l.MaxConns > 0 && conns > l.MaxConns {
+		return l.MaxConns
+	}
+	return conns
+}
+
+// LoadTenantLimits reads a line for each tenant ID (or * for the rest) followed by its limits, ex:
+//
+//	# tenant  limits
+//	acme      jobs=4 conns=8 bandwidth=20m
+//	*         jobs=1 conns=2 bandwidth=2m
+//
+// Bandwidth is in bytes per second and can end in k or m.
+func LoadTenantLimits(file string) (map[string]TenantLimits, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tenants := make(map[string]TenantLimits)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a tenant followed by its limits", file, line)
+		}
+
+		var limits TenantLimits
+		for _, field := range fields[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("%s:%d: unknown limit %q", file, line, field)
+			}
+			var err error
+			switch parts[0] {
+			case "jobs":
+				limits.MaxJobs, err = strconv.Atoi(parts[1])
+			case "conns":
+				limits.MaxConns, err = strconv.Atoi(parts[1])
+			case "bandwidth":
+				limits.Bandwidth, err = parseSize(parts[1])
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown limit %q", file, line, field)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid limit %q", file, line, field)
+			}
+		}
+		tenants[fields[0]] = limits
+	}
+	return tenants, scanner.Err()
+}
+
+// RateLimiter holds messages back so no more than Rate bytes a second get through it.
+// It is a Transformer so it can go at the end of a job's transform chain.
+type RateLimiter struct {
+	Rate int
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func NewRateLimiter(rate int) *RateLimiter {
+	return &RateLimiter{Rate: rate}
+}
+
+// SetRate changes the Rate, for the bytes from now on.
+func (l *RateLimiter) SetRate(rate int) {
+	l.mu.Lock()
+	l.Rate = rate
+	l.mu.Unlock()
+}
+
+// Wait blocks until n more bytes can go through.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if l.Rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	start := l.next
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.Rate) * float64(time.Second)))
+	l.mu.Unlock()
+
+	time.Sleep(start.Sub(now))
+}
+
+func (l *RateLimiter) Transform(msg MessageData) (MessageData, error) {
+	l.Wait(msg.Size())
+	return msg, nil
+}
@@ -0,0 +1,84 @@
+package copycat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadTenantLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenanttest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tenants")
+	ioutil.WriteFile(path, []byte("# tenant limits\nacme jobs=4 conns=8 bandwidth=20m\n* jobs=1 conns=2\n"), 0600)
+	tenants, err := LoadTenantLimits(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := &JobQueue{Tenants: tenants}
+	if limits := q.limits("acme"); limits.MaxJobs != 4 || limits.MaxConns != 8 || limits.Bandwidth != 20*1024*1024 {
+		t.Errorf("unexpected limits for acme: %+v", limits)
+	}
+	if limits := q.limits("other"); limits.MaxJobs != 1 || limits.Conns(10) != 2 || limits.Conns(1) != 1 {
+		t.Errorf("expected the default limits for other tenants, got %+v", limits)
+	}
+
+	ioutil.WriteFile(path, []byte("acme jobs=many\n"), 0600)
+	if _, err = LoadTenantLimits(path); err == nil {
+		t.Error("expected an error for an invalid limit")
+	}
+}
+
+func TestTenantFairness(t *testing.T) {
+	started := make(chan string, 3)
+	release := make(chan bool)
+	queue := NewJobQueue(2, map[string]TenantLimits{"big": {MaxJobs: 1}}, func(spec JobSpec, limits TenantLimits) error {
+		started <- spec.Source.User
+		<-release
+		return nil
+	})
+
+	spec := JobSpec{
+		Source: InboxInfo{Pw: "secret", Host: "imap.example.com:993"},
+		Dest:   []InboxInfo{{User: "dst@example.com", Pw: "secret", Host: "imap.other.com:993"}},
+	}
+	for _, job := range []struct{ tenant, user string }{{"big", "big1@example.com"}, {"big", "big2@example.com"}, {"small", "small@example.com"}} {
+		spec.Tenant, spec.Source.User = job.tenant, job.user
+		if _, err := queue.Submit(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the small tenant's job goes ahead of the big tenant's second one
+	running := map[string]bool{<-started: true, <-started: true}
+	if !running["big1@example.com"] || !running["small@example.com"] {
+		t.Errorf("expected one job from each tenant to run, got %v", running)
+	}
+	release <- true
+	release <- true
+	if user := <-started; user != "big2@example.com" {
+		t.Errorf("expected the big tenant's second job to run next, got %s", user)
+	}
+	release <- true
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(100 * 1024)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		limiter.Transform(MessageData{Body: make([]byte, 10*1024)})
+	}
+	// the first message goes right away and each after it waits 100ms
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected 3 10k messages at 100k/s to take about 200ms, took %s", elapsed)
+	}
+	var none *RateLimiter
+	none.Wait(1 << 30)
+}
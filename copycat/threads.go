@@ -0,0 +1,135 @@
+package copycat
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// ThreadOrder will have messages copied a thread at a time, with each message
+// after the ones it replies to, instead of in the order they are in the source.
+// Clients that build threads as messages arrive will then show whole
+// conversations during a live migration. It delays copying until the
+// source folder has been listed.
+var ThreadOrder bool
+
+// threadFetch pulls the headers needed to thread messages without setting \Seen.
+const threadFetch = "BODY.PEEK[HEADER.FIELDS (MESSAGE-ID IN-REPLY-TO REFERENCES)]"
+
+var msgIdPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+// References returns the Message-Ids a message replies to, oldest first. Real
+// References headers are often broken, so anything that doesn't look like an id
+// is skipped, duplicates are dropped and In-Reply-To is added if it's missing.
+func References(header mail.Header) []string {
+	self := header.Get("Message-Id")
+	seen := map[string]bool{self: true}
+
+	var refs []string
+	add := func(value string) {
+		for _, id := range msgIdPattern.FindAllString(value, -1) {
+			if !seen[id] {
+				seen[id] = true
+				refs = append(refs, id)
+			}
+		}
+	}
+	add(header.Get("References"))
+	// In-Reply-To is the direct parent, so it goes last
+	add(header.Get("In-Reply-To"))
+	return refs
+}
+
+// threader collects WorkRequests and puts them in thread order.
+type threader struct {
+	requests   []WorkRequest
+	references [][]string
+}
+
+func (t *threader) Add(request WorkRequest, references []string) {
+	t.requests = append(t.requests, request)
+	t.references = append(t.references, references)
+}
+
+// Order returns the requests grouped into threads, with the threads in the order
+// their first message was added. Within a thread, each message comes after any
+// message it references.
+func (t *threader) Order() []WorkRequest {
+	// index the requests by Message-Id
+	byId := make(map[string]int)
+	for i, request := range t.requests {
+		if id := strings.TrimSpace(request.Value); len(id) > 0 {
+			if _, exists := byId[id]; !exists {
+				byId[id] = i
+			}
+		}
+	}
+
+	// messages that reference each other (or a common missing message) are in the same thread
+	parent := make([]int, len(t.requests))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	union := func(a, b int) {
+		a, b = find(a), find(b)
+		// the earliest message is the root so threads keep their first position
+		if a < b {
+			parent[b] = a
+		} else if b < a {
+			parent[a] = b
+		}
+	}
+	missing := make(map[string]int)
+	for i, refs := range t.references {
+		for _, ref := range refs {
+			if j, exists := byId[ref]; exists {
+				union(i, j)
+			} else if j, exists := missing[ref]; exists {
+				union(i, j)
+			} else {
+				missing[ref] = i
+			}
+		}
+	}
+
+	threads := make(map[int][]int)
+	var roots []int
+	for i := range t.requests {
+		root := find(i)
+		if _, exists := threads[root]; !exists {
+			roots = append(roots, root)
+		}
+		threads[root] = append(threads[root], i)
+	}
+
+	// walk each thread, putting whatever a message references ahead of it
+	ordered := make([]WorkRequest, 0, len(t.requests))
+	visited := make([]bool, len(t.requests))
+	var visit func(i int)
+	visit = func(i int) {
+		if visited[i] {
+			return
+		}
+		visited[i] = true
+		for _, ref := range t.references[i] {
+			if j, exists := byId[ref]; exists {
+				visit(j)
+			}
+		}
+		ordered = append(ordered, t.requests[i])
+	}
+	for _, root := range roots {
+		for _, i := range threads[root] {
+			visit(i)
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,52 @@
+package copycat
+
+import (
+	"fmt"
+	"net/mail"
+	"testing"
+)
+
+func TestReferences(t *testing.T) {
+	header := mail.Header{
+		"Message-Id":  {"<3@example.com>"},
+		"References":  {"junk <1@example.com> <1@example.com>\r\n\t<3@example.com> <2@example.com>"},
+		"In-Reply-To": {"<2@example.com> (sent by someone)"},
+	}
+	refs := References(header)
+	if fmt.Sprint(refs) != "[<1@example.com> <2@example.com>]" {
+		t.Errorf("unexpected references: %v", refs)
+	}
+
+	header = mail.Header{"Message-Id": {"<4@example.com>"}, "In-Reply-To": {"<1@example.com>"}}
+	if refs = References(header); fmt.Sprint(refs) != "[<1@example.com>]" {
+		t.Errorf("expected In-Reply-To to be used without References, got: %v", refs)
+	}
+}
+
+func TestThreadOrder(t *testing.T) {
+	var threads threader
+	add := func(id string, refs ...string) {
+		threads.Add(WorkRequest{Value: id, Header: "Message-Id"}, refs)
+	}
+	// replies arrive before their parents and threads are interleaved
+	add("<b2>", "<b1>")
+	add("<a3>", "<a1>", "<a2>")
+	add("<a1>")
+	add("<b1>")
+	add("<c1>")
+	add("<a2>", "<a1>")
+	// replies to a message we don't have are still kept together
+	add("<d2>", "<missing>")
+	add("<d3>", "<missing>", "<d2>")
+	// a loop shouldn't keep us from finishing
+	add("<e1>", "<e2>")
+	add("<e2>", "<e1>")
+
+	var ids []string
+	for _, request := range threads.Order() {
+		ids = append(ids, request.Value)
+	}
+	if fmt.Sprint(ids) != "[<b1> <b2> <a1> <a2> <a3> <c1> <d2> <d3> <e2> <e1>]" {
+		t.Errorf("unexpected order: %v", ids)
+	}
+}
@@ -0,0 +1,111 @@
+package copycat
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// ThrottleCooldown is how long an account's connections wait after being throttled
+// (see ErrThrottled) when the server doesn't say how long to back off for.
+var ThrottleCooldown = time.Minute
+
+const (
+	// how many times a throttled append is tried again before it counts as a failure
+	throttleRetries = 5
+	// the longest wait a server can ask for
+	maxThrottleWait = time.Hour
+	// the cool-down pool of the source's connections, which aren't told the account
+	sourcePool = "source"
+)
+
+// advisedWait finds how long servers ask to be left alone for in their responses, ex.
+// Exchange's "Suggested Backoff Time: 92000 milliseconds" or "try again in 30 seconds".
+var advisedWait = regexp.MustCompile(`(?i)(?:backoff time|try again in|retry after|retry in)\s*:?\s*(\d+)\s*(milliseconds|ms|seconds|secs|s|minutes|mins|m)\b`)
+
+// Gmail gives no time, but its bandwidth limits take a while to recover
+var gmailBandwidth = regexp.MustCompile(`(?i)bandwidth limit`)
+
+var cooldowns = struct {
+	sync.Mutex
+	until map[string]time.Time
+}{until: make(map[string]time.Time)}
+
+// throttleWait returns how long the server that sent err asked us to wait.
+func throttleWait(err error) time.Duration {
+	text := err.Error()
+	wait := ThrottleCooldown
+	if match := advisedWait.FindStringSubmatch(text); match != nil {
+		n, _ := strconv.Atoi(match[1])
+		switch unit := strings.ToLower(match[2]); {
+		case strings.HasPrefix(unit, "ms") || strings.HasPrefix(unit, "milli"):
+			wait = time.Duration(n) * time.Millisecond
+		case strings.HasPrefix(unit, "m"):
+			wait = time.Duration(n) * time.Minute
+		default:
+			wait = time.Duration(n) * time.Second
+		}
+	} else if gmailBandwidth.MatchString(text) {
+		wait = 10 * ThrottleCooldown
+	}
+	if wait > maxThrottleWait {
+		wait = maxThrottleWait
+	}
+	return wait
+}
+
+// throttled checks if err is the server throttling the pool's connections and, if it
+// is, starts them cooling down for as long as the server asked.
+func throttled(pool string, err error) bool {
+	if err == nil || classifyError(err) != ErrThrottled {
+		return false
+	}
+	wait := throttleWait(err)
+	until := time.Now().Add(wait)
+	cooldowns.Lock()
+	if until.After(cooldowns.until[pool]) {
+		cooldowns.until[pool] = until
+		log.Printf("%s is being throttled (%s). cooling down for %s", pool, err.Error(), wait)
+	}
+	cooldowns.Unlock()
+	Stats.Add("throttled", 1)
+	return true
+}
+
+// fetchThrottled fetches the message from the source, waiting out any throttling.
+func fetchThrottled(conn *imap.Client, uid uint32, state *worker) (MessageData, error) {
+	for attempt := 1; ; attempt++ {
+		coolDown(sourcePool, state)
+		data, err := FetchMessage(conn, uid)
+		if attempt > throttleRetries || !throttled(sourcePool, err) || Controls.Stopped("") {
+			return data, err
+		}
+	}
+}
+
+// coolDown waits until the pool's connections are done cooling down, or the sync is canceled.
+// The worker, if there is one, is "cooling down" meanwhile, so it isn't taken for stuck.
+func coolDown(pool string, state *worker) {
+	cooldowns.Lock()
+	wait := time.Until(cooldowns.until[pool])
+	cooldowns.Unlock()
+	if wait <= 0 {
+		return
+	}
+	if state != nil {
+		previous := state.Current()
+		state.Set("cooling down")
+		defer state.Set(previous)
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-Controls.Canceled():
+	}
+}
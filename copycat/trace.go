@@ -0,0 +1,268 @@
+package copycat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how often buffered spans are sent to the collector
+	traceFlushInterval = 5 * time.Second
+	// spans are dropped once this many are waiting to be sent
+	maxBufferedSpans = 8192
+)
+
+// Tracing exports spans for each stage of the sync pipeline. It is nil, for no
+// tracing, unless set with NewTracer.
+var Tracing *Tracer
+
+// Tracer buffers finished spans and sends them to an OpenTelemetry collector
+// with OTLP over HTTP using its JSON encoding.
+type Tracer struct {
+	// Endpoint of the collector, ex. http://localhost:4318
+	Endpoint string
+	Service  string
+	Client   *http.Client
+
+	mu      sync.Mutex
+	spans   []*Span
+	dropped int
+	done    chan bool
+	flushed chan bool
+}
+
+// NewTracer creates a Tracer and starts sending its spans to the endpoint in the background.
+func NewTracer(endpoint string, service string) *Tracer {
+	t := &Tracer{
+		Endpoint: strings.TrimRight(endpoint, "/"),
+		Service:  service,
+		Client:   &http.Client{Timeout: 30 * time.Second},
+		done:     make(chan bool),
+		flushed:  make(chan bool),
+	}
+	go t.run()
+	return t
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.Flush()
+		case <-t.done:
+			t.Flush()
+			close(t.flushed)
+			return
+		}
+	}
+}
+
+// Close sends any spans that are still buffered.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	close(t.done)
+	<-t.flushed
+}
+
+// Span is a single timed operation. Spans without a parent start a new trace.
+type Span struct {
+	Name     string
+	TraceId  string
+	SpanId   string
+	ParentId string
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]string
+	Error    string
+
+	tracer *Tracer
+}
+
+// StartSpan will begin a span under the parent (if any) with the given attribute
+// key/value pairs. It returns nil if tracing is off, which all Span methods accept.
+func (t *Tracer) StartSpan(name string, parent *Span, attrs ...string) *Span {
+	if t == nil {
+		return nil
+	}
+
+	s := &Span{Name: name, SpanId: randomHex(8), Start: time.Now(), Attrs: make(map[string]string), tracer: t}
+	if parent != nil {
+		s.TraceId = parent.TraceId
+		s.ParentId = parent.SpanId
+	} else {
+		s.TraceId = randomHex(16)
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.Attrs[attrs[i]] = attrs[i+1]
+	}
+	return s
+}
+
+// Child will start a span under this one.
+func (s *Span) Child(name string, attrs ...string) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.StartSpan(name, s, attrs...)
+}
+
+// Set adds an attribute to the span.
+func (s *Span) Set(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.Attrs[key] = value
+}
+
+// Fail marks the span as failed.
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Error = err.Error()
+}
+
+// Finish ends the span and hands it to the tracer to be sent.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+
+	t := s.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.spans) >= maxBufferedSpans {
+		t.dropped++
+		return
+	}
+	t.spans = append(t.spans, s)
+}
+
+// Flush sends the buffered spans to the collector.
+func (t *Tracer) Flush() {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	dropped := t.dropped
+	t.dropped = 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		log.Printf("dropped %d spans the collector couldn't keep up with", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(otlpRequest(t.Service, spans))
+	if err != nil {
+		log.Printf("Unable to encode spans: %s", err.Error())
+		return
+	}
+	rsp, err := t.Client.Post(t.Endpoint+"/v1/traces", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Unable to send %d spans: %s", len(spans), err.Error())
+		return
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		log.Printf("Unable to send %d spans: collector returned %s: %s", len(spans), rsp.Status, strings.TrimSpace(string(msg)))
+	}
+}
+
+// the parts of the OTLP JSON encoding we use
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	var list []otlpAttribute
+	for key, value := range attrs {
+		attr := otlpAttribute{Key: key}
+		attr.Value.StringValue = value
+		list = append(list, attr)
+	}
+	return list
+}
+
+// otlpRequest builds an ExportTraceServiceRequest for the spans.
+func otlpRequest(service string, spans []*Span) map[string]interface{} {
+	var encoded []otlpSpan
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceId:           s.TraceId,
+			SpanId:            s.SpanId,
+			ParentSpanId:      s.ParentId,
+			Name:              s.Name,
+			Kind:              1, // internal
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attrs),
+		}
+		if len(s.Error) > 0 {
+			span.Status.Code = 2 // error
+			span.Status.Message = s.Error
+		}
+		encoded = append(encoded, span)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": service, "copycat.run_id": RunID}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "copycat-imap"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// should never happen, but a bad id is better than no span
+		return fmt.Sprintf("%0*x", n*2, time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
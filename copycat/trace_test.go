@@ -0,0 +1,63 @@
+package copycat
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	requests := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- body
+	}))
+	defer server.Close()
+
+	tracer := NewTracer(server.URL, "test")
+	parent := tracer.StartSpan("store", nil, "message_id", "<1@example.com>")
+	child := parent.Child("append")
+	child.Fail(errors.New("NO"))
+	child.Finish()
+	parent.Finish()
+	tracer.Close()
+
+	var sent struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan
+			}
+		}
+	}
+	if err := json.Unmarshal(<-requests, &sent); err != nil {
+		t.Fatal(err)
+	}
+	spans := sent.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+
+	appendSpan, storeSpan := spans[0], spans[1]
+	if appendSpan.TraceId != storeSpan.TraceId || appendSpan.ParentSpanId != storeSpan.SpanId {
+		t.Errorf("append span is not a child of the store span")
+	}
+	if len(storeSpan.TraceId) != 32 || len(storeSpan.SpanId) != 16 {
+		t.Errorf("unexpected id lengths: %q %q", storeSpan.TraceId, storeSpan.SpanId)
+	}
+	if appendSpan.Status.Code != 2 || appendSpan.Status.Message != "NO" {
+		t.Errorf("expected the append span to be failed, got %+v", appendSpan.Status)
+	}
+	if len(storeSpan.Attributes) != 1 || storeSpan.Attributes[0].Value.StringValue != "<1@example.com>" {
+		t.Errorf("unexpected attributes: %+v", storeSpan.Attributes)
+	}
+
+	// tracing is off with a nil tracer
+	var off *Tracer
+	off.StartSpan("store", nil).Child("append").Finish()
+}
@@ -0,0 +1,31 @@
+package copycat
+
+import (
+	"errors"
+)
+
+// ErrSkipMessage can be returned by a Transformer to keep a message
+// from being appended to the destination.
+var ErrSkipMessage = errors.New("message skipped by transformer")
+
+// Transformer gets a look at every message right before it is appended to a
+// destination. It may return the message as is, return a modified copy of it or
+// return ErrSkipMessage to drop it. Messages can be shared between destinations
+// so a Transformer should never modify the Body it was given in place.
+type Transformer interface {
+	Transform(msg MessageData) (MessageData, error)
+}
+
+// Transformers will run a message through each Transformer in order, handing
+// each one the output of the last.
+type Transformers []Transformer
+
+func (t Transformers) Transform(msg MessageData) (MessageData, error) {
+	var err error
+	for _, transformer := range t {
+		if msg, err = transformer.Transform(msg); err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
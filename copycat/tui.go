@@ -0,0 +1,259 @@
+package copycat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how many errors and log lines the TUI shows
+	tuiRecent = 5
+	// how wide the progress bars are
+	tuiBarWidth = 30
+)
+
+// TUI draws the progress of a sync on a terminal from the Events sent to its Handle:
+// a progress bar for each folder, the current throughput and the latest errors. It
+// also takes keys to pause the sync or skip a folder (see Key).
+type TUI struct {
+	out io.Writer
+
+	mu       sync.Mutex
+	folders  map[string]*folderProgress
+	order    []string
+	selected int
+	copied   int
+	bytes    int64
+	errors   []string
+	logs     [][]byte
+
+	// the total size of the messages listed to be stored
+	listedBytes int64
+
+	// for the throughput since the last draw
+	lastDraw   time.Time
+	lastCopied int
+	lastBytes  int64
+	rate       float64
+	byteRate   float64
+}
+
+type folderProgress struct {
+	total   int
+	checked int
+	copied  int
+	failed  int
+	done    bool
+	// the folder was skipped before it was done, see RunControls.SkipFolder
+	skipped bool
+}
+
+// NewTUI creates a TUI that draws to out, usually os.Stdout.
+func NewTUI(out io.Writer) *TUI {
+	return &TUI{out: out, folders: make(map[string]*folderProgress), lastDraw: time.Now()}
+}
+
+// Handle is a ProgressFunc that updates the TUI.
+func (t *TUI) Handle(e Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	folder, exists := t.folders[e.Folder]
+	if !exists {
+		folder = new(folderProgress)
+		t.folders[e.Folder] = folder
+		t.order = append(t.order, e.Folder)
+	}
+
+	switch e.Kind {
+	case FolderStarted:
+		folder.total += e.Count
+	case MessagesArrived:
+		folder.total += e.Count
+	case FolderListed:
+		t.listedBytes += int64(e.Size)
+	case FolderDone:
+		folder.done = true
+		folder.skipped = Controls.Skipped(e.Folder)
+	case MessagesChecked:
+		folder.checked += e.Count
+	case MessageCopied:
+		folder.copied++
+		t.copied++
+		t.bytes += int64(e.Size)
+	case MessageFailed:
+		folder.failed++
+		t.errors = append(t.errors, fmt.Sprintf("%s %s %s: %s", e.Time.Format("15:04:05"), e.Destination, e.Folder, e.Error))
+		if len(t.errors) > tuiRecent {
+			t.errors = t.errors[1:]
+		}
+	}
+}
+
+// Write keeps the latest log lines to show under the folders, so the log can be
+// pointed at the TUI while it's running.
+func (t *TUI) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.logs = append(t.logs, append([]byte(nil), p...))
+	if len(t.logs) > tuiRecent {
+		t.logs = t.logs[1:]
+	}
+	return len(p), nil
+}
+
+// Key handles a key press: j and k move between folders, s skips the rest of the
+// selected folder and p pauses or resumes the sync.
+func (t *TUI) Key(key byte) {
+	// Controls log what they do, which is written back to the TUI, so they're
+	// called without holding its lock
+	switch key {
+	case 's':
+		t.mu.Lock()
+		var folder string
+		if t.selected < len(t.order) {
+			folder = t.order[t.selected]
+		}
+		t.mu.Unlock()
+		if len(folder) > 0 {
+			Controls.SkipFolder(folder)
+		}
+	case 'p':
+		if Controls.Paused() {
+			Controls.Resume()
+		} else {
+			Controls.Pause()
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch key {
+	case 'j':
+		if t.selected < len(t.order)-1 {
+			t.selected++
+		}
+	case 'k':
+		if t.selected > 0 {
+			t.selected--
+		}
+	}
+}
+
+// Run redraws the TUI every interval until stop is closed.
+func (t *TUI) Run(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.Draw()
+		case <-stop:
+			t.Draw()
+			return
+		}
+	}
+}
+
+// Draw clears the terminal and draws the TUI.
+func (t *TUI) Draw() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if since := time.Since(t.lastDraw).Seconds(); since > 0 {
+		t.rate = float64(t.copied-t.lastCopied) / since
+		t.byteRate = float64(t.bytes-t.lastBytes) / since
+	}
+	t.lastDraw, t.lastCopied, t.lastBytes = time.Now(), t.copied, t.bytes
+
+	// move home and clear the screen
+	io.WriteString(t.out, "\x1b[H\x1b[2J"+t.render())
+}
+
+// Close writes out the last log lines in full so the run's final messages (ex. the
+// report) aren't lost once the TUI stops drawing.
+func (t *TUI) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	io.WriteString(t.out, "\n")
+	for _, line := range t.logs {
+		t.out.Write(line)
+	}
+	t.logs = nil
+}
+
+func (t *TUI) render() string {
+	var out bytes.Buffer
+	state := "running"
+	if Controls.Paused() {
+		state = "PAUSED"
+	}
+	copied := FormatSize(t.bytes)
+	if t.listedBytes > 0 {
+		// messages already in a destination aren't copied, so this is the most there is to do
+		copied += " of up to " + FormatSize(t.listedBytes)
+	}
+	fmt.Fprintf(&out, "copycat-imap: %s, %d messages (%s) copied, %.1f msg/s (%s/s)\n\n", state, t.copied, copied, t.rate, FormatSize(int64(t.byteRate)))
+
+	width := 0
+	for _, name := range t.order {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	for i, name := range t.order {
+		folder := t.folders[name]
+		cursor := " "
+		if i == t.selected {
+			cursor = ">"
+		}
+		status := ""
+		switch {
+		case folder.skipped || Controls.Skipped(name):
+			status = " skipped"
+		case folder.done:
+			status = " done"
+		}
+		if folder.failed > 0 {
+			status += fmt.Sprintf(" (%d failed)", folder.failed)
+		}
+		fmt.Fprintf(&out, "%s %-*s %s %d/%d%s\n", cursor, width, name, progressBar(folder.checked, folder.total, folder.done), folder.checked, folder.total, status)
+	}
+
+	if len(t.errors) > 0 {
+		fmt.Fprintf(&out, "\nrecent errors:\n")
+		for _, err := range t.errors {
+			fmt.Fprintf(&out, "  %s\n", err)
+		}
+	}
+	if len(t.logs) > 0 {
+		fmt.Fprintf(&out, "\nlog:\n")
+		for _, line := range t.logs {
+			// multi-line entries only get their first line
+			first := strings.SplitN(strings.TrimRight(string(line), "\n"), "\n", 2)[0]
+			fmt.Fprintf(&out, "  %s\n", first)
+		}
+	}
+	fmt.Fprintf(&out, "\nj/k: select folder  s: skip folder  p: pause/resume\n")
+	return out.String()
+}
+
+// progressBar draws a bar like [#####.....]  50%.
+func progressBar(n int, total int, done bool) string {
+	fraction := 1.0
+	if !done {
+		fraction = 0
+		if total > 0 {
+			fraction = float64(n) / float64(total)
+		}
+		if fraction > 1 {
+			fraction = 1
+		}
+	}
+	filled := int(fraction * tuiBarWidth)
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("#", filled), strings.Repeat(".", tuiBarWidth-filled), int(fraction*100))
+}
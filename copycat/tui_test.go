@@ -0,0 +1,59 @@
+package copycat
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTUI(t *testing.T) {
+	defer func(c *RunControls) { Controls = c }(Controls)
+	Controls = newRunControls()
+
+	var out bytes.Buffer
+	ui := NewTUI(&out)
+	ui.Handle(Event{Kind: FolderStarted, Folder: "INBOX", Destination: "dst@example.com", Count: 10})
+	ui.Handle(Event{Kind: FolderStarted, Folder: "Archive", Destination: "dst@example.com", Count: 4})
+	ui.Handle(Event{Kind: FolderListed, Folder: "INBOX", Destination: "dst@example.com", Count: 10, Size: 10240})
+	ui.Handle(Event{Kind: MessagesChecked, Folder: "INBOX", Destination: "dst@example.com", Count: 4})
+	ui.Handle(Event{Kind: MessagesChecked, Folder: "INBOX", Destination: "dst@example.com", Count: 1})
+	ui.Handle(Event{Kind: MessageCopied, Folder: "INBOX", Destination: "dst@example.com", Size: 2048})
+	ui.Handle(Event{Kind: MessageFailed, Folder: "INBOX", Destination: "dst@example.com", Error: "NO [TOOBIG] message too large", Time: time.Date(2014, 3, 1, 17, 4, 5, 0, time.UTC)})
+	ui.Handle(Event{Kind: FolderDone, Folder: "Archive"})
+
+	screen := ui.render()
+	for _, expected := range []string{
+		"copycat-imap: running, 1 messages (2.0 KB of up to 10.0 KB) copied",
+		"> INBOX   [###############...............]  50% 5/10 (1 failed)",
+		"  Archive [##############################] 100% 0/4 done",
+		"17:04:05 dst@example.com INBOX: NO [TOOBIG] message too large",
+	} {
+		if !strings.Contains(screen, expected) {
+			t.Errorf("expected %q in:\n%s", expected, screen)
+		}
+	}
+
+	// the controls log, which may be pointed at the TUI
+	log.SetOutput(ui)
+	defer log.SetOutput(os.Stderr)
+
+	ui.Key('j')
+	ui.Key('s')
+	if !Controls.Skipped("Archive") || Controls.Skipped("INBOX") {
+		t.Error("expected the selected folder to be skipped")
+	}
+	ui.Key('p')
+	if !Controls.Paused() || !strings.Contains(ui.render(), "PAUSED") {
+		t.Error("expected p to pause the sync")
+	}
+	if !strings.Contains(ui.render(), "pausing the sync") {
+		t.Error("expected the log in the TUI")
+	}
+	ui.Key('p')
+	if Controls.Paused() {
+		t.Error("expected p to resume the sync")
+	}
+}
@@ -0,0 +1,314 @@
+package copycat
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/go-imap/go1/imap"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// uidIndex is where the Message-Id of each message in a source folder is kept by UID,
+// as of HighestModSeq, so a -purge can look up the messages a QRESYNC server says have
+// vanished since then instead of checking every message in the destinations. Each
+// Message-Id is its own entry in the cache, so a sync only writes what changed.
+type uidIndex struct {
+	UIDValidity   uint32
+	UIDNext       uint32
+	HighestModSeq string
+	// Purged is set once a full purge has been run since the index was started, so the
+	// destinations have nothing the index doesn't know about.
+	Purged bool
+
+	key string
+	// the folder's HIGHESTMODSEQ as of this sync
+	modSeq string
+	// entries to save, and whether the saved ones are thrown out first
+	added   map[uint32]string
+	removed []uint32
+	reset   bool
+}
+
+func uidIndexKey(src InboxInfo, folder string) string {
+	// like folderStateKey, these never look like a Message-Id
+	return "uid-index\x00" + src.User + "\x00" + src.Host + "\x00" + folder
+}
+
+func uidIndexEntryKey(key string, uid uint32) []byte {
+	return []byte(key + "\x00" + strconv.FormatUint(uint64(uid), 10))
+}
+
+func (c *Cache) getUIDIndex(key string) (uidIndex, error) {
+	var index uidIndex
+	raw, err := c.db.Get([]byte(key), nil)
+	if err != nil {
+		return index, err
+	}
+	index.key = key
+	return index, deserialize(raw, &index)
+}
+
+// uidIndexMessageId is the Message-Id the index has for the UID.
+func (c *Cache) uidIndexMessageId(key string, uid uint32) (string, bool) {
+	id, err := c.db.Get(uidIndexEntryKey(key, uid), nil)
+	return string(id), err == nil
+}
+
+// putUIDIndex saves the index and its added and removed entries.
+func (c *Cache) putUIDIndex(index *uidIndex) error {
+	raw, err := serialize(index)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	if index.reset {
+		iter := c.db.NewIterator(util.BytesPrefix([]byte(index.key+"\x00")), nil)
+		for iter.Next() {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+		iter.Release()
+	}
+	for _, uid := range index.removed {
+		batch.Delete(uidIndexEntryKey(index.key, uid))
+	}
+	for uid, id := range index.added {
+		batch.Put(uidIndexEntryKey(index.key, uid), []byte(id))
+	}
+	batch.Put([]byte(index.key), raw)
+	if err = c.db.Write(batch, nil); err != nil {
+		return err
+	}
+	index.added, index.removed, index.reset = nil, nil, false
+	return nil
+}
+
+// parseUIDSet lists the UIDs in a sequence set like the one in a VANISHED response.
+func parseUIDSet(set string) ([]uint32, error) {
+	var uids []uint32
+	for _, part := range strings.Split(set, ",") {
+		bounds := strings.SplitN(part, ":", 2)
+		first, err := strconv.ParseUint(bounds[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad UID set %q", set)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.ParseUint(bounds[1], 10, 32); err != nil {
+				return nil, fmt.Errorf("bad UID set %q", set)
+			}
+		}
+		if first > last {
+			first, last = last, first
+		}
+		for uid := first; uid <= last; uid++ {
+			uids = append(uids, uint32(uid))
+		}
+	}
+	return uids, nil
+}
+
+// enableQResync turns on QRESYNC for the connection, which has to be done outside of a
+// folder, and selects its folder again.
+func enableQResync(conn *imap.Client) error {
+	folder := conn.Mailbox.Name
+	if _, err := imap.Wait(conn.Close(false)); err != nil {
+		return err
+	}
+	_, err := imap.Wait(conn.Send("ENABLE", "QRESYNC"))
+	if _, selectErr := imap.Wait(conn.Select(folder, true)); selectErr != nil {
+		return selectErr
+	}
+	return err
+}
+
+// vanishedSince asks the server for the UIDs expunged from the selected folder since modSeq.
+func vanishedSince(conn *imap.Client, modSeq string) ([]uint32, error) {
+	all, _ := imap.NewSeqSet("1:*")
+	cmd, err := imap.Wait(conn.Send("UID FETCH", all, []imap.Field{"UID"}, []imap.Field{"CHANGEDSINCE", modSeq, "VANISHED"}))
+	if err != nil {
+		return nil, err
+	}
+	// VANISHED (EARLIER) isn't a FETCH, so it may not have been handed to the command
+	responses := append(cmd.Data, takeVanished(conn)...)
+
+	var uids []uint32
+	for _, rsp := range responses {
+		if rsp.Label != "VANISHED" || len(rsp.Fields) < 2 {
+			continue
+		}
+		vanished, err := vanishedUIDs(rsp)
+		if err != nil {
+			return nil, err
+		}
+		uids = append(uids, vanished...)
+	}
+	return uids, nil
+}
+
+// takeVanished removes the VANISHED responses from the ones the connection hasn't
+// handed out yet, leaving the rest.
+func takeVanished(conn *imap.Client) []*imap.Response {
+	var vanished, rest []*imap.Response
+	for _, rsp := range conn.Data {
+		if rsp.Label == "VANISHED" {
+			vanished = append(vanished, rsp)
+		} else {
+			rest = append(rest, rsp)
+		}
+	}
+	conn.Data = rest
+	return vanished
+}
+
+// vanishedUIDs are the UIDs in a VANISHED response. Like APPENDUID's (see appendUIDs), a
+// single UID is a number rather than a set.
+func vanishedUIDs(rsp *imap.Response) ([]uint32, error) {
+	last := rsp.Fields[len(rsp.Fields)-1]
+	if uid := imap.AsNumber(last); uid > 0 {
+		return []uint32{uid}, nil
+	}
+	return parseUIDSet(imap.AsAtom(last))
+}
+
+// loadUIDIndex is the source folder's uidIndex, or nil if the source doesn't support
+// QRESYNC. It's a new one if there isn't a usable one saved.
+func loadUIDIndex(conn *imap.Client, src InboxInfo, folder string, cache *Cache) *uidIndex {
+	if !conn.Caps["QRESYNC"] {
+		return nil
+	}
+	status, err := GetFolderStatus(conn, folder)
+	if err != nil || len(status.HighestModSeq) == 0 {
+		return nil
+	}
+	key := uidIndexKey(src, folder)
+	index, err := cache.getUIDIndex(key)
+	if err != nil || index.UIDValidity != conn.Mailbox.UIDValidity || len(index.HighestModSeq) == 0 {
+		// anything changed after this is picked up next time
+		index = uidIndex{UIDValidity: conn.Mailbox.UIDValidity, HighestModSeq: status.HighestModSeq, key: key, reset: true}
+	}
+	index.modSeq = status.HighestModSeq
+	return &index
+}
+
+// restart starts the index over, once a full purge has left the destinations matching
+// the source.
+func (i *uidIndex) restart() *uidIndex {
+	if i == nil {
+		return nil
+	}
+	return &uidIndex{UIDValidity: i.UIDValidity, HighestModSeq: i.modSeq, Purged: true, key: i.key, modSeq: i.modSeq, reset: true}
+}
+
+// purgeVanished is -purge for a source that supports QRESYNC: the messages expunged from
+// the source folder since it was last synced are looked up in its uidIndex and deleted
+// from the destinations, without going through every destination message. It returns
+// false if the index can't be used, so the full purge is needed.
+func purgeVanished(conns conns, index *uidIndex, folder string, cache *Cache) bool {
+	if index == nil || index.reset || !index.Purged {
+		return false
+	}
+	conn := conns.Source[0]
+	if err := enableQResync(conn); err != nil {
+		log.Printf("Unable to enable QRESYNC for folder %s: %s. checking every message", folder, err.Error())
+		return false
+	}
+	uids, err := vanishedSince(conn, index.HighestModSeq)
+	if err != nil {
+		log.Printf("Unable to find the messages expunged from folder %s: %s. checking every message", folder, err.Error())
+		return false
+	}
+
+	var ids []string
+	for _, uid := range uids {
+		if id, exists := cache.uidIndexMessageId(index.key, uid); exists {
+			index.removed = append(index.removed, uid)
+			ids = append(ids, id)
+		}
+	}
+	log.Printf("%d messages were expunged from the source %s since it was last synced", len(ids), folder)
+
+	mc, err := Memcache.NewClient()
+	if err != nil {
+		log.Printf("Unable to connect to memcached: %s. deleted messages will stay cached", err.Error())
+	}
+	for _, id := range ids {
+		// a copy of the message that's still in the source keeps it in the destinations
+		if cmd, err := imap.Wait(conn.UIDSearch([]imap.Field{"HEADER", "Message-Id", id})); err != nil || len(cmd.Data) == 0 || len(cmd.Data[0].SearchResults()) > 0 {
+			continue
+		}
+		for user, dsts := range conns.Dest {
+			purgeMessageId(dsts[0], user, id)
+		}
+		if mc != nil {
+			mc.Delete(id)
+		}
+	}
+	for _, dsts := range conns.Dest {
+		imap.Wait(dsts[0].Expunge(nil))
+	}
+
+	index.HighestModSeq = index.modSeq
+	return true
+}
+
+// purgeMessageId flags every copy of the message in the destination folder \Deleted.
+func purgeMessageId(conn *imap.Client, user string, id string) {
+	cmd, err := imap.Wait(conn.UIDSearch([]imap.Field{"HEADER", "Message-Id", id}))
+	if err != nil || len(cmd.Data) == 0 {
+		if err != nil {
+			log.Printf("Unable to search %s for %s: %s", user, id, err.Error())
+		}
+		return
+	}
+	for _, uid := range cmd.Data[0].SearchResults() {
+		log.Printf("expunged from src. marking for deletion: %s", id)
+		if err = AddDeletedFlag(conn, uid); err != nil {
+			log.Printf("Problems removing message from dst: %s", err.Error())
+		} else {
+			Stats.Add("purged", 1)
+		}
+	}
+}
+
+// updateUIDIndex adds the messages that arrived in the source folder since the index was
+// last saved and saves it for the next purgeVanished.
+func updateUIDIndex(conn *imap.Client, folder string, index *uidIndex, cache *Cache) {
+	if index == nil {
+		return
+	}
+	if index.added == nil {
+		index.added = make(map[uint32]string)
+	}
+	first := index.UIDNext
+	if first == 0 {
+		first = 1
+	}
+	seq, _ := imap.NewSeqSet("")
+	seq.Add(fmt.Sprintf("%d:*", first))
+	cmd, err := imap.Wait(conn.UIDFetch(seq, messageIdFetch))
+	if err != nil {
+		log.Printf("Unable to index folder %s for the next purge: %s", folder, err.Error())
+		return
+	}
+	for _, rsp := range cmd.Data {
+		info := rsp.MessageInfo()
+		// n:* is always the last message, even when it's older than n
+		if info == nil || info.UID < first {
+			continue
+		}
+		if header, _ := ParseHeader(MessageIdHeader(info)); header != nil {
+			if id := header.Get("Message-Id"); len(id) > 0 {
+				index.added[info.UID] = id
+			}
+		}
+		if info.UID >= index.UIDNext {
+			index.UIDNext = info.UID + 1
+		}
+	}
+	if err = cache.putUIDIndex(index); err != nil {
+		log.Printf("Unable to save the index of folder %s: %s", folder, err.Error())
+	}
+}
@@ -0,0 +1,127 @@
+package copycat
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// Verify will check a random sample of sampleSize messages from the source INBOX
+// against each destination every interval until stop is closed (see VerifySample).
+func Verify(srcInfo InboxInfo, dstInfos []InboxInfo, interval time.Duration, sampleSize int, transform Transformer, stop chan bool) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := VerifySample(srcInfo, dstInfos, sampleSize, transform, r); err != nil {
+				log.Printf("Unable to verify messages: %s", err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// VerifyOnce will check a single random sample, like Verify does every interval, for
+// a sync that's run once instead of idling.
+func VerifyOnce(srcInfo InboxInfo, dstInfos []InboxInfo, sampleSize int, transform Transformer) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	if err := VerifySample(srcInfo, dstInfos, sampleSize, transform, r); err != nil {
+		log.Printf("Unable to verify messages: %s", err.Error())
+	}
+}
+
+// VerifySample picks sampleSize messages at random from the source INBOX and makes
+// sure each destination still has an identical copy. The copy should match the source
+// message after it has been through the transform, so a transform that isn't
+// repeatable (or a destination that changes messages on append) will show up as corruption.
+// Missing and corrupt messages are sent to Notifications.
+func VerifySample(srcInfo InboxInfo, dstInfos []InboxInfo, sampleSize int, transform Transformer, r *rand.Rand) error {
+	src, err := GetConnection(srcInfo, true)
+	if err != nil {
+		return err
+	}
+	defer src.Logout(20 * time.Second)
+
+	cmd, err := GetAllMessages(src)
+	if err != nil {
+		return err
+	}
+	var sample []WorkRequest
+	for _, i := range r.Perm(len(cmd.Data)) {
+		if len(sample) == sampleSize {
+			break
+		}
+		info := cmd.Data[i].MessageInfo()
+		if id := messageHeader(src, info).Get("Message-Id"); len(id) > 0 {
+			sample = append(sample, WorkRequest{Value: id, Header: "Message-Id", UID: info.UID})
+		}
+	}
+
+	// what each destination should have
+	digests := make(map[string][sha256.Size]byte)
+	for _, request := range sample {
+		msg, err := FetchMessage(src, request.UID)
+		if err != nil {
+			// it may have been deleted since we listed it
+			continue
+		}
+		if transform != nil {
+			if msg, err = transform.Transform(msg); err != nil {
+				continue
+			}
+		}
+		digests[request.Value] = sha256.Sum256(msg.Body)
+	}
+
+	for _, dstInfo := range dstInfos {
+		dst, err := GetConnection(dstInfo, true)
+		if err != nil {
+			log.Printf("Unable to connect to %s to verify messages: %s", dstInfo.User, err.Error())
+			continue
+		}
+		for _, request := range sample {
+			expected, exists := digests[request.Value]
+			if !exists {
+				continue
+			}
+			if problem := verifyMessage(dst, request, expected); len(problem) > 0 {
+				Stats.Add("verify_failures", 1)
+				Notifications.Alert("copycat verification failed", fmt.Sprintf("%s in %s: %s", request.Value, dstInfo.User, problem))
+			}
+			Stats.Add("verified", 1)
+		}
+		dst.Logout(20 * time.Second)
+	}
+	return nil
+}
+
+// verifyMessage returns what's wrong with the message in the selected folder on dst, if anything.
+func verifyMessage(dst *imap.Client, request WorkRequest, expected [sha256.Size]byte) string {
+	cmd, err := imap.Wait(dst.UIDSearch([]imap.Field{"HEADER", request.Header, request.Value}))
+	if err != nil {
+		log.Printf("Unable to search for message (%s) to verify it: %s", request.Value, err.Error())
+		return ""
+	}
+	if len(cmd.Data) == 0 || len(cmd.Data[0].SearchResults()) == 0 {
+		return "missing"
+	}
+
+	// any copy matching is good enough
+	for _, uid := range cmd.Data[0].SearchResults() {
+		msg, err := FetchMessage(dst, uid)
+		if err != nil {
+			return ""
+		}
+		if sha256.Sum256(msg.Body) == expected {
+			return ""
+		}
+	}
+	return "contents differ from the source"
+}
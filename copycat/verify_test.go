@@ -0,0 +1,33 @@
+package copycat
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+func TestVerifyMessage(t *testing.T) {
+	dst := dialFake(t, newFakeServer())
+	defer dst.Logout(time.Second)
+
+	copied := "Message-Id: <copied@example.com>\r\nSubject: hi\r\n\r\nhello\r\n"
+	changed := "Message-Id: <changed@example.com>\r\nSubject: hi\r\n\r\nhello?\r\n"
+	for _, body := range []string{copied, changed, copied} {
+		if err := AppendMessage(dst, MessageData{InternalDate: time.Now(), Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		id, source, want string
+	}{
+		{"<copied@example.com>", copied, ""},
+		{"<changed@example.com>", "Message-Id: <changed@example.com>\r\nSubject: hi\r\n\r\nhello\r\n", "contents differ from the source"},
+		{"<gone@example.com>", "Message-Id: <gone@example.com>\r\n\r\nhello\r\n", "missing"},
+	} {
+		request := WorkRequest{Value: c.id, Header: "Message-Id"}
+		if problem := verifyMessage(dst, request, sha256.Sum256([]byte(c.source))); problem != c.want {
+			t.Errorf("%s: expected %q, got %q", c.id, c.want, problem)
+		}
+	}
+}
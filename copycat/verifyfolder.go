@@ -0,0 +1,245 @@
+package copycat
+
+import (
+	"crypto/sha256"
+	"log"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// how many messages each verify connection fetches at a time
+const verifyBatch = 50
+
+// VerifyOptions are how VerifyFolder goes about it.
+type VerifyOptions struct {
+	// Conns is how many connections are opened to each side of the folder.
+	Conns int
+	// Limiter caps how fast messages are fetched from either side, if it's set.
+	Limiter *RateLimiter
+	// Transform is what the source messages went through when they were copied.
+	Transform Transformer
+}
+
+// VerifyProblem is a message that isn't in a destination the way it is in the source.
+type VerifyProblem struct {
+	Destination string
+	Folder      string
+	MessageId   string
+	// Problem is "missing" or "differs".
+	Problem string
+}
+
+// VerifyFolder compares every message in the source folder with its copy in the folder
+// of the destination. Both sides are fetched at once on opts.Conns connections each and
+// hashed as they arrive, so only the hashes are kept. Problems are sent to found as they
+// turn up, and the number of messages compared is returned.
+func VerifyFolder(srcInfo InboxInfo, dstInfo InboxInfo, folder string, dstFolder string, opts VerifyOptions, found func(VerifyProblem)) (int, error) {
+	if opts.Conns <= 0 {
+		opts.Conns = 1
+	}
+	srcIds, err := folderMessageIds(srcInfo, folder)
+	if err != nil {
+		return 0, err
+	}
+	dstIds, err := folderMessageIds(dstInfo, dstFolder)
+	if err != nil {
+		return 0, err
+	}
+
+	// message id by UID on each side, only for messages on both
+	srcUIDs := make(map[uint32]string)
+	dstUIDs := make(map[uint32]string)
+	for id, uids := range srcIds {
+		if _, exists := dstIds[id]; !exists {
+			found(VerifyProblem{Destination: dstInfo.User, Folder: folder, MessageId: id, Problem: "missing"})
+			Stats.Add("verify_failures", 1)
+			continue
+		}
+		// any copy of a duplicate will do
+		srcUIDs[uids[0]] = id
+		for _, uid := range dstIds[id] {
+			dstUIDs[uid] = id
+		}
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	var srcErr, dstErr error
+	srcDigests := make(map[string][sha256.Size]byte)
+	dstDigests := make(map[string][][sha256.Size]byte)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		var mu sync.Mutex
+		srcErr = hashMessages(srcInfo, folder, srcUIDs, opts, opts.Transform, func(id string, sum [sha256.Size]byte) {
+			mu.Lock()
+			srcDigests[id] = sum
+			mu.Unlock()
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		var mu sync.Mutex
+		dstErr = hashMessages(dstInfo, dstFolder, dstUIDs, opts, nil, func(id string, sum [sha256.Size]byte) {
+			mu.Lock()
+			dstDigests[id] = append(dstDigests[id], sum)
+			mu.Unlock()
+		})
+	}()
+	wg.Wait()
+	if srcErr != nil {
+		return 0, srcErr
+	}
+	if dstErr != nil {
+		return 0, dstErr
+	}
+
+	var compared int
+	for id, expected := range srcDigests {
+		compared++
+		Stats.Add("verified", 1)
+		if !containsDigest(dstDigests[id], expected) {
+			found(VerifyProblem{Destination: dstInfo.User, Folder: folder, MessageId: id, Problem: "differs"})
+			Stats.Add("verify_failures", 1)
+		}
+	}
+	emit(Event{Kind: MessagesChecked, Folder: folder, Destination: dstInfo.User, Count: compared})
+	log.Printf("verified %d message(s) in %s for %s in %s", compared, folder, dstInfo.User, time.Since(start))
+	return compared, nil
+}
+
+func containsDigest(digests [][sha256.Size]byte, digest [sha256.Size]byte) bool {
+	for _, d := range digests {
+		if d == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// folderMessageIds lists the UIDs of each message in the folder by Message-Id.
+func folderMessageIds(info InboxInfo, folder string) (map[string][]uint32, error) {
+	conn, err := GetFolderConnection(info, folder, true)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Logout(20 * time.Second)
+
+	ids := make(map[string][]uint32)
+	if conn.Mailbox.Messages == 0 {
+		return ids, nil
+	}
+	cmd, err := GetAllMessages(conn)
+	if err != nil {
+		return nil, err
+	}
+	for _, rsp := range cmd.Data {
+		info := rsp.MessageInfo()
+		if id := messageHeader(conn, info).Get("Message-Id"); len(id) > 0 {
+			ids[id] = append(ids[id], info.UID)
+		}
+	}
+	return ids, nil
+}
+
+// hashMessages fetches the messages in uids in batches spread over opts.Conns connections
+// to the folder and calls record with the hash of each, after the transform if there is one.
+func hashMessages(info InboxInfo, folder string, uids map[uint32]string, opts VerifyOptions, transform Transformer, record func(id string, sum [sha256.Size]byte)) error {
+	batches := make(chan []uint32)
+	errs := make(chan error, opts.Conns)
+	var fetchers sync.WaitGroup
+	for i := 0; i < opts.Conns; i++ {
+		fetchers.Add(1)
+		go func() {
+			defer fetchers.Done()
+			conn, err := GetFolderConnection(info, folder, true)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Logout(20 * time.Second)
+			for batch := range batches {
+				if err := hashBatch(conn, batch, uids, opts.Limiter, transform, record); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	batch := make([]uint32, 0, verifyBatch)
+	stopped := false
+	for uid := range uids {
+		batch = append(batch, uid)
+		if len(batch) < verifyBatch {
+			continue
+		}
+		if stopped = !sendBatch(batches, batch, errs); stopped {
+			break
+		}
+		batch = make([]uint32, 0, verifyBatch)
+	}
+	if !stopped && len(batch) > 0 {
+		sendBatch(batches, batch, errs)
+	}
+	close(batches)
+	fetchers.Wait()
+
+	// a batch that failed would look like messages that differ
+	if len(errs) > 0 {
+		return <-errs
+	}
+	return nil
+}
+
+// sendBatch hands the batch to a fetcher, returning false once any of them has failed.
+func sendBatch(batches chan []uint32, batch []uint32, errs chan error) bool {
+	for len(errs) == 0 {
+		select {
+		case batches <- batch:
+			return true
+		case <-time.After(time.Second):
+		}
+	}
+	return false
+}
+
+func hashBatch(conn *imap.Client, batch []uint32, uids map[uint32]string, limiter *RateLimiter, transform Transformer, record func(id string, sum [sha256.Size]byte)) error {
+	seq, _ := imap.NewSeqSet("")
+	for _, uid := range batch {
+		seq.AddNum(uid)
+	}
+	cmd, err := conn.UIDFetch(seq, "INTERNALDATE", "FLAGS", "BODY.PEEK[]", "UID")
+	if err != nil {
+		return err
+	}
+	for cmd.InProgress() {
+		if err = conn.Recv(-1); err != nil {
+			return err
+		}
+		for _, rsp := range cmd.Data {
+			info := rsp.MessageInfo()
+			if info == nil {
+				continue
+			}
+			id, exists := uids[info.UID]
+			if !exists {
+				continue
+			}
+			msg := MessageData{InternalDate: imap.AsDateTime(info.Attrs["INTERNALDATE"]), Flags: flagList(imap.AsFlagSet(info.Attrs["FLAGS"])), Body: imap.AsBytes(info.Attrs["BODY[]"])}
+			limiter.Wait(len(msg.Body))
+			if transform != nil {
+				if msg, err = transform.Transform(msg); err != nil {
+					continue
+				}
+			}
+			record(id, sha256.Sum256(msg.Body))
+		}
+		cmd.Data = nil
+	}
+	conn.Data = nil
+	_, err = cmd.Result(imap.OK)
+	return err
+}
@@ -0,0 +1,160 @@
+package copycat
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-imap/go1/imap"
+)
+
+// WarmCache has every message to be stored pulled into the Cache, on all of the source
+// connections at once, before the destinations are searched. Without it, messages are
+// fetched as the storers ask for them, so a few slow destinations can leave the source
+// connections mostly idle.
+var WarmCache bool
+
+// how many messages each source connection fetches at a time while warming the cache
+const warmBatch = 25
+
+// warmCache lists the messages in seq of the folder selected on the source connections
+// and fetches any that aren't in the cache and are missing from a destination or sink,
+// in batches spread over the connections. Messages without a Message-Id are left to be
+// fetched when they're stored.
+func warmCache(src []*imap.Client, dsts map[string][]*imap.Client, sinks []Sink, seq *imap.SeqSet, cache *Cache) error {
+	folder := src[0].Mailbox.Name
+	cmd, err := imap.Wait(src[0].Fetch(seq, messageIdFetch, "UID", "RFC822.SIZE"))
+	if err != nil {
+		return err
+	}
+	// message id by UID
+	missing := make(map[uint32]string)
+	for _, rsp := range cmd.Data {
+		info := rsp.MessageInfo()
+		// messages that won't be stored or cached aren't worth fetching
+		if info == nil || !cacheable(info.Size) || (MaxMessageSize > 0 && int(info.Size) > MaxMessageSize) {
+			continue
+		}
+		id := messageHeader(src[0], info).Get("Message-Id")
+		if len(id) == 0 {
+			continue
+		}
+		if cached, _ := cache.db.Has([]byte(id), nil); !cached {
+			missing[info.UID] = id
+		}
+	}
+	src[0].Data = nil
+	if missing = notStored(dsts, sinks, folder, missing); len(missing) == 0 {
+		return nil
+	}
+
+	log.Printf("warming the cache with %d messages from the source %s", len(missing), folder)
+	start := time.Now()
+	batches := make(chan map[uint32]string)
+	var fetchers sync.WaitGroup
+	for _, conn := range src {
+		fetchers.Add(1)
+		go func(conn *imap.Client) {
+			defer fetchers.Done()
+			for batch := range batches {
+				if err := warmBatchInto(conn, batch, cache); err != nil {
+					log.Printf("Unable to warm the cache with %d messages: %s. they'll be fetched when stored", len(batch), err.Error())
+				}
+			}
+		}(conn)
+	}
+
+	batch := make(map[uint32]string)
+	for uid, id := range missing {
+		batch[uid] = id
+		if len(batch) == warmBatch {
+			Controls.Wait()
+			if Controls.Stopped(folder) {
+				break
+			}
+			batches <- batch
+			batch = make(map[uint32]string)
+		}
+	}
+	if len(batch) > 0 && !Controls.Stopped(folder) {
+		batches <- batch
+	}
+	close(batches)
+	fetchers.Wait()
+	log.Printf("warmed the cache with the source %s in %s", folder, time.Since(start))
+	return nil
+}
+
+// notStored keeps the messages at least one of the destinations or sinks doesn't have
+// yet, as they're the only ones the storers will fetch. The destinations' folder has to
+// be selected on their connections and nothing else using them.
+func notStored(dsts map[string][]*imap.Client, sinks []Sink, folder string, ids map[uint32]string) map[uint32]string {
+	var requests []WorkRequest
+	for uid, id := range ids {
+		requests = append(requests, WorkRequest{Value: id, Header: "Message-Id", UID: uid})
+	}
+	needed := make(map[uint32]string)
+	for _, sink := range sinks {
+		for _, request := range requests {
+			if has, err := sink.Has(folder, request.Value); err == nil && !has {
+				needed[request.UID] = request.Value
+			}
+		}
+	}
+	for _, conns := range dsts {
+		// only what every destination so far has is worth looking for
+		var unknown []WorkRequest
+		for _, request := range requests {
+			if _, exists := needed[request.UID]; !exists {
+				unknown = append(unknown, request)
+			}
+		}
+		for start := 0; start < len(unknown); start += SearchPipelineDepth {
+			end := start + SearchPipelineDepth
+			if end > len(unknown) {
+				end = len(unknown)
+			}
+			missing, _ := searchPipelined(conns[0], unknown[start:end])
+			for _, request := range missing {
+				needed[request.UID] = request.Value
+			}
+		}
+	}
+	return needed
+}
+
+// warmBatchInto fetches the messages in the batch and puts them in the cache as they arrive.
+func warmBatchInto(conn *imap.Client, batch map[uint32]string, cache *Cache) error {
+	seq, _ := imap.NewSeqSet("")
+	for uid := range batch {
+		seq.AddNum(uid)
+	}
+	cmd, err := conn.UIDFetch(seq, "INTERNALDATE", "FLAGS", "BODY.PEEK[]", "UID")
+	if err != nil {
+		return err
+	}
+	for cmd.InProgress() {
+		if err = conn.Recv(-1); err != nil {
+			return err
+		}
+		for _, rsp := range cmd.Data {
+			info := rsp.MessageInfo()
+			if info == nil {
+				continue
+			}
+			id, exists := batch[info.UID]
+			if !exists {
+				continue
+			}
+			data := MessageData{InternalDate: imap.AsDateTime(info.Attrs["INTERNALDATE"]), Flags: flagList(imap.AsFlagSet(info.Attrs["FLAGS"])), Body: imap.AsBytes(info.Attrs["BODY[]"])}
+			if err = cache.Put(id, data); err != nil {
+				log.Printf("Unable to add message (%s) to cache: %s", id, err.Error())
+			}
+			Stats.Add("warmed", 1)
+		}
+		cmd.Data = nil
+	}
+	conn.Data = nil
+	_, err = cmd.Result(imap.OK)
+	return err
+}
@@ -0,0 +1,113 @@
+package copycat
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// TimeWindow is the part of each day, in local time, a sync is allowed to run in.
+// End can be before Start for a window that runs past midnight (ex. 22:00-06:00).
+type TimeWindow struct {
+	// Start and End are the time since midnight
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseTimeWindow parses a window like "22:00-06:00".
+func ParseTimeWindow(s string) (TimeWindow, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return TimeWindow{}, fmt.Errorf("expected start-end, ex. 22:00-06:00, not %q", s)
+	}
+	var w TimeWindow
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return TimeWindow{}, fmt.Errorf("invalid time %q, expected hh:mm", part)
+		}
+		since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			w.Start = since
+		} else {
+			w.End = since
+		}
+	}
+	if w.Start == w.End {
+		return TimeWindow{}, fmt.Errorf("the window %q is empty", s)
+	}
+	return w, nil
+}
+
+func (w TimeWindow) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+	}
+	return clock(w.Start) + "-" + clock(w.End)
+}
+
+// sinceMidnight is how far into its day t is.
+func sinceMidnight(t time.Time) time.Duration {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return t.Sub(midnight)
+}
+
+// Contains is true if t is in the window.
+func (w TimeWindow) Contains(t time.Time) bool {
+	since := sinceMidnight(t)
+	if w.Start < w.End {
+		return since >= w.Start && since < w.End
+	}
+	return since >= w.Start || since < w.End
+}
+
+// Next returns when the window next opens or closes after t.
+func (w TimeWindow) Next(t time.Time) time.Time {
+	edge := w.Start
+	if w.Contains(t) {
+		edge = w.End
+	}
+	wait := edge - sinceMidnight(t)
+	if wait <= 0 {
+		wait += 24 * time.Hour
+	}
+	return t.Add(wait)
+}
+
+// Schedule pauses the sync whenever it's outside the window and resumes it once the
+// window opens again, starting the Budget over, until the sync is canceled. Pausing or
+// resuming by hand still works in between; the schedule only steps in as the window
+// opens or closes, or Reschedule changes it.
+func (c *RunControls) Schedule(w TimeWindow) {
+	for {
+		now := time.Now()
+		if w.Contains(now) {
+			Budget.Reset()
+			c.Resume()
+		} else {
+			log.Printf("outside the sync window %s", w)
+			c.Pause()
+		}
+		timer := time.NewTimer(time.Until(w.Next(now)))
+		select {
+		case <-timer.C:
+		case w = <-c.schedule:
+			timer.Stop()
+			log.Printf("the sync window is now %s", w)
+		case <-c.Canceled():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Reschedule has Schedule keep the sync in the new window from now on.
+func (c *RunControls) Reschedule(w TimeWindow) {
+	// only the latest window matters
+	select {
+	case <-c.schedule:
+	default:
+	}
+	c.schedule <- w
+}
@@ -6,7 +6,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	_ "net/http/pprof"
 	"os"
+	"os/exec"
+	"strings"
+	gosync "sync"
+	"time"
 
 	"copycat-imap/copycat"
 
@@ -19,11 +25,30 @@ var (
 	srcPw   = flag.String("src-pw", "", "The login password for the source mailbox.")
 	srcHost = flag.String("src-host", "", "The imap host for the source mailbox.")
 
+	// or an Exchange server over EWS
+	srcEWS = flag.String("src-ews", "", "EWS endpoint (ex. https://mail.example.com/EWS/Exchange.asmx) of an Exchange mailbox to copy every mail folder from instead of an IMAP source. Logs in with -src-id and -src-pw.")
+
+	// or a POP3-only provider
+	srcPOP3 = flag.String("src-pop3", "", "POP3 host:port (ex. pop.example.com:995) to copy the maildrop into the destination INBOXes from instead of an IMAP source. Logs in with -src-id and -src-pw. Copied messages are remembered in the -db so later runs skip them.")
+
+	// or newsgroups
+	srcNNTP    = flag.String("src-nntp", "", "News server host:port (ex. news.example.com:563) to archive the -nntp-groups from instead of an IMAP source. Logs in with -src-id and -src-pw if they're set.")
+	nntpGroups = flag.String("nntp-groups", "", "Comma separated list of the newsgroups to archive with -src-nntp. Each is copied to a folder of the same name.")
+
+	// or to and from Microsoft 365 over Graph
+	graphTenant = flag.String("graph-tenant", "", "Microsoft 365 tenant (ex. contoso.onmicrosoft.com) of -src-graph and -dst-graph. The app's credentials are read from GRAPH_CLIENT_ID and GRAPH_CLIENT_SECRET and it needs the Mail.ReadWrite application permission.")
+	srcGraph    = flag.String("src-graph", "", "Microsoft 365 user (ex. fred@contoso.com) to copy every mail folder from with the Graph API instead of an IMAP source.")
+	dstGraph    = flag.String("dst-graph", "", "Microsoft 365 user to copy the source messages into with the Graph API. Can be used with or without destination inboxes.")
+
 	// and single dest id/pw/host
 	dstId   = flag.String("dst-id", "", "The login ID for the destincation mailbox.")
 	dstPw   = flag.String("dst-pw", "", "The login password for the destincation mailbox.")
 	dstHost = flag.String("dst-host", "", "The imap host for the destincation mailbox.")
 
+	// logging in as an admin for the user, without their password
+	srcAdmin = flag.String("src-admin", "", "Admin login (ex. a Dovecot master user or Cyrus admin) to log in to the source as -src-id with SASL PLAIN. -src-pw is then the admin's password.")
+	dstAdmin = flag.String("dst-admin", "", "Admin login (ex. a Dovecot master user or Cyrus admin) to log in to the destination as -dst-id with SASL PLAIN. -dst-pw is then the admin's password.")
+
 	// or multiple dest inbox by config file
 	configFile    = flag.String("config-file", "", "Location of a config file to pass in source and destination login information. Use -example-config to see the format.")
 	exampleConfig = flag.Bool("example-config", false, "View an example layout for a json config file meant to hold multiple destination accounts.")
@@ -35,18 +60,304 @@ var (
 	quicksync  = flag.Bool("quick", false, "Starts a quick sync that will only look to 'sync' the last 'quick-count' messages.")
 	quickcount = flag.Int("quick-count", 500, "The number of messages to look for with a quick scan.")
 
+	// message fixups and external programs to run each message through before appending
+	byteExact   = flag.Bool("byte-exact", false, "Copy messages byte for byte. By default bare line endings are converted to CRLF and NUL bytes are stripped so strict servers will accept them.")
+	generateIds = flag.Bool("generate-ids", false, "Give messages without a Message-Id a stable one derived from a hash of their header so they can be synced and deduplicated.")
+	repairMIME  = flag.Bool("repair-mime", false, "Repair broken MIME structure, 8-bit headers and line endings before appending messages to destinations that reject them.")
+	filters     = flag.String("filter", "", "Comma separated list of programs each message will be passed through before it is appended to a destination. See the README for the protocol.")
+
+	// what to do with headers that can't be parsed
+	headerParsing = flag.String("header-parsing", copycat.HeaderLenient, "How to handle messages whose header can't be parsed: 'lenient' scans it for whatever fields it can, 'strict' skips the message. Either way they're listed in the report.")
+
+	// where other migration tools keep the original Message-Id
+	dedupHeaders = flag.String("dedup-headers", "", "Comma separated list of other headers (ex. 'X-MS-Exchange-Organization-OriginalMessageId,Resent-Message-ID') to look for each message's Message-Id in, so copies other tools made in the destinations aren't copied again.")
+
+	// which flags copied messages get
+	preserveFlags = flag.Bool("preserve-flags", false, "Copy each message's flags from the source instead of appending it as unseen.")
+	addFlags      = flag.String("add-flags", "", "Comma separated list of flags to set on every copied message (ex. '\\Seen,Imported').")
+	removeFlags   = flag.String("remove-flags", "", "Comma separated list of flags to clear on every copied message.")
+	keywordMap    = flag.String("keyword-map", "", "Location of a file of 'keyword=new keyword' lines to rename (or drop, with nothing after the '=') keywords on copied messages.")
+
+	// how many failed appends to put up with
+	maxFailures = flag.Float64("max-failures", 100, "The percent of appends to a destination that can fail before the run is aborted. Until then, messages that fail are skipped. 0 to abort on the first failure, 100 to never abort.")
+
+	// how servers are connected to
+	preferIP      = flag.String("prefer-ip", copycat.PreferAuto, "Which IP family to connect to servers over first: auto (the order DNS gives), ipv4 or ipv6. The other is tried too if it's slow or fails. ipv4-only or ipv6-only never try the other.")
+	fallbackDelay = flag.Int("fallback-delay", 300, "How long (in ms) the preferred IP family gets to connect before the other is tried alongside it.")
+	dnsCache      = flag.Int("dns-cache", 300, "How long (in seconds) to keep the addresses of each server. 0 to look them up for every connection.")
+
+	// servers found for logins without a host
+	allowDiscoveredHost = flag.Bool("allow-discovered-host", false, "Use a server discovery finds outside the login's domain (or its registrable parent, ex. example.com for mail.example.com), ex. imap.gmail.com for a domain hosted by Gmail. Otherwise it's refused, since its login would go to whoever answered the lookup.")
+
+	// back off when a server throttles us
+	throttleCooldown = flag.Int("throttle-cooldown", 60, "How long (in seconds) an account's connections wait after the server throttles them, when it doesn't say how long to back off for.")
+
+	// copy order and source cleanup
+	expungeSource = flag.Bool("expunge-source", false, "After syncing, expunge messages already flagged \\Deleted in the source once they are confirmed to be in every destination (or were left out on purpose by a folder policy).")
+	threadOrder   = flag.Bool("thread-order", false, "Copy messages a conversation at a time, with replies after the messages they reply to, so clients show whole threads during a live migration.")
+
+	// export messages to a local archive
+	archiveDir    = flag.String("archive", "", "Directory to export the source messages into as a point-in-time backup. Can be used with or without destination inboxes.")
+	archiveFormat = flag.String("archive-format", "eml", "Format of the messages in the archive. 'eml' for a file per message or 'jsonl' for a single file of JSON lines with base64 bodies.")
+	archiveKeys   = flag.String("archive-encrypt", "", "Comma separated list of the full fingerprints of OpenPGP keys to encrypt archived messages (in the archive directory and bucket) to. Requires gpg and the keys in its keyring.")
+	importDir     = flag.String("import", "", "Directory of an archive to restore into the destination inboxes instead of syncing from a source inbox.")
+
+	// or to an S3 compatible object store
+	bucket         = flag.String("bucket", "", "S3 compatible bucket to archive raw messages into. Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. Can be used with or without destination inboxes.")
+	bucketEndpoint = flag.String("bucket-endpoint", "https://s3.amazonaws.com", "Endpoint of the object store. Use https://storage.googleapis.com with HMAC keys for GCS.")
+	bucketRegion   = flag.String("bucket-region", "us-east-1", "Region of the bucket.")
+	bucketPrefix   = flag.String("bucket-prefix", "", "Prefix to add to the key of every message written to the bucket.")
+
+	// and/or a search index
+	indexURL = flag.String("index", "", "URL of an Elasticsearch index (ex. http://localhost:9200/mail) to feed copied messages into. Use the 'search' command to query it. Can be used with or without destination inboxes.")
+
+	// and/or a local maildir
+	maildir      = flag.String("maildir", "", "Maildir to deliver the source messages into. Can be used with or without destination inboxes.")
+	maildirIndex = flag.String("maildir-index", "", "Indexer to run after messages are delivered to the maildir so local mail tools pick them up. 'notmuch' or 'mu'.")
+	dovecot      = flag.Bool("maildir-dovecot", false, "Write the -maildir the way Dovecot keeps one, with keywords, message sizes and subscriptions, so it can be brought in with doveadm import.")
+
 	// # of IMAP connections per mailbox
 	conns = flag.Int("c", 2, "The number of concurrent IMAP connections for each inbox during Syncing. Large #s may run faster but you may risk reaching connection/bandwidth limits for you email provider.")
 
+	// sync every folder, not just the INBOX
+	folders         = flag.Bool("folders", false, "Sync every folder in the source mailbox instead of just the INBOX. Missing folders are created in the destinations. Idling still only watches the INBOX.")
+	skipUnchanged   = flag.Bool("skip-unchanged", false, "Skip folders that haven't changed in the source or destinations since they were last synced when using -folders. Their state is kept in the -db.")
+	subscribe       = flag.Bool("subscribe", true, "Subscribe to each folder in the destinations when using -folders so clients that only show subscribed folders list them.")
+	parallelFolders = flag.Int("parallel-folders", 2, "The number of folders to sync at once when using -folders. Each uses -c connections per inbox.")
+	maxConns        = flag.Int("max-conns", 10, "The most IMAP connections to open to any one server at a time when using -folders.")
+	fairFolders     = flag.Bool("fair-folders", true, "Sync the smallest folders first when using -folders, with up to -c connections per inbox depending on their size, and give freed connections to the smallest waiting folder.")
+	maxFolderDepth  = flag.Int("max-folder-depth", 0, "The most levels of folders to create in the destinations when using -folders. Deeper folders are flattened. 0 to use the provider's limit, if it has one.")
+	folderPolicies  = flag.String("folder-policies", "", "Location of a file of folder patterns and how to sync them (ex. 'Junk skip' or 'Trash newer=30d') when using -folders. See the README for the format.")
+	maxFolderLength = flag.Int("max-folder-length", 0, "The most characters in each level of a folder name created in the destinations when using -folders. 0 to use the provider's limit, if it has one.")
+
+	// shared folders, their permissions and annotations
+	sharedFolders = flag.String("shared-folders", "", "Comma separated list of the source's shared namespaces to sync when using -folders: 'shared' for shared and public folders, 'other' for other users' folders or a namespace prefix (ex. '#public/'). Shared folders are left out otherwise.")
+	copyACLs      = flag.Bool("copy-acls", false, "Give each folder created in the destinations the same ACL as the source folder when using -folders, if both servers have the ACL extension. ACLs that can't be copied are listed in the run report.")
+	copyMetadata  = flag.Bool("copy-metadata", false, "Copy each folder's annotations (ex. its color or comment) to the destinations when using -folders, if both servers have the METADATA extension. Annotations a destination won't take are listed in the run report.")
+
+	// calendar, contacts and tasks folders
+	groupware    = flag.String("groupware", "", "What to do with calendar, contacts and tasks folders (ex. on Exchange) when using -folders: 'skip' to leave them out or 'export' to write their items to .ics and .vcf files in -groupware-dir instead. Either way they're listed in the run report. They're synced like mail by default.")
+	groupwareDir = flag.String("groupware-dir", "groupware", "Directory -groupware=export writes the items of each calendar and contacts folder into.")
+
+	// send some messages to other folders
+	routes = flag.String("routes", "", "Location of a file of 'folder conditions -> destination folder' lines (ex. 'INBOX from:*@oldcorp.com -> OldCorp') sending matching messages to other destination folders. Use the 'route' command for a dry run. See the README for the format.")
+
+	// memcached servers the purge clears deleted messages from
+	memcacheServers    = flag.String("memcache", copycat.MemcacheServer, "Comma separated list of the memcached servers (host:port or a unix socket path) the -purge clears deleted messages from.")
+	memcacheTimeout    = flag.Int("memcache-timeout", 500, "Milliseconds to wait on a memcached read or write.")
+	memcacheDial       = flag.Int("memcache-dial-timeout", 0, "Milliseconds to wait on a connection to a memcached server. 0 to use -memcache-timeout.")
+	memcacheIdle       = flag.Int("memcache-idle", 2, "The most idle connections to keep open to each memcached server.")
+	memcacheConsistent = flag.Bool("memcache-consistent", false, "Spread keys over the -memcache servers with consistent hashing, so adding or removing a server only moves the keys near it.")
+
+	// pull everything from the source before the destinations slow it down
+	warmCache = flag.Bool("warm-cache", false, "Fetch every message that's missing from a destination and not already in the -db from the source, on all -c connections at once, before storing any of them. Keeps slow destinations from holding up the source connections.")
+
+	// hand messages to every destination without the -db
+	broker = flag.Int("broker", 0, "Fetch each message once and hold it, using up to this much memory (in MB) and spilling the rest to $TMPDIR, until every destination and sink has stored it, instead of keeping it in the -db. 0 to use the -db.")
+
+	// limit the memory used by messages waiting to be stored
+	maxMemory = flag.Int("max-memory", 0, "The most memory (in MB) to use for message bodies waiting to be stored. Once reached, messages are spilled to temporary files in $TMPDIR. 0 for no limit.")
+
+	// leave out messages that are too large, before they're downloaded
+	maxMessageSize = flag.Int("max-message-size", 0, "Skip messages larger than this (in MB), going by the size the source lists them with, so they're never downloaded. They're listed in the report. 0 for no limit.")
+
+	// stop once a day's quota is used up
+	maxMessages = flag.Int("max-messages", 0, "Stop the run cleanly once this many messages have been copied (counting each destination). 0 for no limit.")
+	maxBytes    = flag.Int("max-bytes", 0, "Stop the run cleanly once this much (in MB) has been copied (counting each destination). 0 for no limit.")
+	maxMinutes  = flag.Int("max-minutes", 0, "Stop the run cleanly after this many minutes. 0 for no limit.")
+
+	// only sync off-peak
+	window = flag.String("window", "", "Only sync during this time of day (local time), ex. 22:00-06:00. The sync is paused outside it and resumed once it opens again.")
+
+	// break things on purpose in staging
+	faults = flag.String("faults", "", "Comma separated faults to inject, for testing how a run copes in staging: drop=RATE to drop connections, delay=DURATION to slow down reads, append=RATE to refuse appends and seed=N to repeat them. Never use it for a real migration.")
+
+	// serve pprof and expvar for live debugging
+	httpAddr = flag.String("http", "", "Address (ex. localhost:6060) to serve pprof profiles at /debug/pprof, pipeline stats at /debug/vars and the pause, resume and cancel controls at /control on.")
+
+	// show progress on the terminal or send it to another program
+	progress = flag.String("progress", "", "Where to write progress events (folder started, message copied, error, checkpoint) as JSON lines: '-' for stdout, or unix:/path/to.sock or tcp:host:port to connect to.")
+	tui      = flag.Bool("tui", false, "Show each folder's progress, the throughput and recent errors on the terminal instead of the log (unless -log is set). Keys: j/k to select a folder, s to skip it and p to pause or resume.")
+
+	// send traces of the sync pipeline to an OpenTelemetry collector
+	otlpEndpoint = flag.String("otlp", "", "OTLP/HTTP endpoint (ex. http://localhost:4318) of an OpenTelemetry collector to send traces of each message's search, fetch, cache and append steps to.")
+
+	// move to a new server
+	cutover    = flag.Bool("cutover", false, "Copy everything, run -freeze-cmd, wait for mail to stop arriving in the source and then copy whatever came in during the first pass. See the README.")
+	freezeCmd  = flag.String("freeze-cmd", "", "Shell command the cutover runs after the bulk copy to stop new mail reaching the source (ex. a script that updates MX records or makes the source read-only).")
+	drainQuiet = flag.Int("drain-quiet", 60, "Seconds the source INBOX has to go without changing after -freeze-cmd before the cutover's final pass. 0 to not wait.")
+
+	// check copies while idling
+	verifyInterval = flag.Int("verify-interval", 0, "Minutes between checks of a random sample of copied messages while idling. A sync that isn't idling checks a sample once it's done. Missing or changed copies are alerted on. 0 to never check.")
+	verifySample   = flag.Int("verify-sample", 20, "The number of messages to check each -verify-interval.")
+	notifyURL      = flag.String("notify-url", "", "Webhook to POST alerts (ex. from -verify-interval) to as JSON. Alerts are always logged.")
+
+	// how hard the verify command works
+	verifyConns = flag.Int("verify-conns", 4, "The number of connections the verify command opens to each side of a folder.")
+	verifyRate  = flag.Int("verify-rate", 0, "The most KB a second the verify command fetches from each folder it's verifying. 0 for no limit.")
+
+	// checksums command output
+	checksumFormat = flag.String("checksum-format", copycat.ChecksumsCSV, "Format of the manifest written by the checksums command. 'csv' or 'jsonl'.")
+
+	// how many jobs the serve command runs at once, and for whom
+	jobs         = flag.Int("jobs", 2, "The most sync jobs the serve command runs at once.")
+	tenantLimits = flag.String("tenant-limits", "", "Location of a file of 'tenant jobs=N conns=N bandwidth=N' lines limiting each tenant's jobs in the serve command. A tenant of '*' applies to the rest.")
+	apiTokens    = flag.String("api-tokens", "", "Location of a file of 'token tenant' lines. The serve command requires one of the tokens as a bearer token on every request and runs each job as its token's tenant. A tenant of '*' can act for every tenant and use /control, which then needs one with -http too.")
+	jobKey       = flag.String("job-key", "", "Key (or an env: or file: reference to one) the serve command seals jobs' passwords in the -db with, so they can resume after a restart. Without it, the passwords are left out.")
+	grpcAddr     = flag.String("grpc", "", "Address (ex. localhost:9090) for the serve command to also accept jobs on over gRPC, with the same tokens and rules as its REST API. See copycat/jobspb/jobs.proto for the service.")
+	jobFilters   = flag.String("job-filters", "", "Comma separated programs jobs submitted to the serve command may name as filters. Jobs naming any others are refused.")
+
+	// sizes of the messages created by the loadgen command
+	sizes = flag.String("sizes", copycat.DefaultSizeDistribution, "Comma separated size:weight pairs for the messages created by the loadgen command. Sizes can end in k or m.")
+
 	// accept log file too
 	logFile = flag.String("log", "", "Location to write logs to. stderr by default. If set, a HUP signal will handle logrotate.")
 	dbFile  = flag.String("db", "/var/copycat/messages", "path for message storage")
+
+	// or send it to the host's logging
+	logTarget = flag.String("log-target", "", "Send the log to 'syslog' (the local daemon), 'syslog://host:514' (over UDP), 'journald' or 'eventlog' (Windows) instead of stderr or -log, with each line's priority going by what it says.")
+
+	// keep repeated log lines down
+	logSample         = flag.Int("log-sample", 0, "The most times a kind of log line (ignoring its ids and numbers) is logged each -log-sample-interval. The rest are counted, summarized once the interval is up and kept in the run's journal for the logs command. 0 to log every line.")
+	logSampleInterval = flag.Int("log-sample-interval", 60, "Seconds -log-sample counts log lines over.")
+
+	// smaller message storage
+	compressCache = flag.Bool("compress-db", false, "Same as -compress=deflate.")
+	compress      = flag.String("compress", "", "Compress messages with deflate, gzip or zstd before storing them in the -db or spilling them to $TMPDIR (see -max-memory). Saves disk at the cost of some CPU.")
+	compressLevel = flag.Int("compress-level", -1, "How hard to -compress, from 1 (fastest) to 9 (smallest). -1 for the default.")
+
+	// keep huge messages out of the -db
+	cacheMaxSize = flag.Int("cache-max-size", 0, "Don't keep messages larger than this (in MB) in the -db, going by the size the source lists them with. 0 for no limit.")
+
+	// group cached messages for the cache command
+	cacheNamespace = flag.String("cache-namespace", "", "The namespace messages put in the -db are recorded under, for the cache command. The source account by default, or 'run' for the -run-id.")
+
+	// tie retries and shards of a sync together
+	runId = flag.String("run-id", "", "The id of this run in the log, report, progress events and traces. A new UUID by default. Retries and shards of the same sync can share one.")
+
+	// how the report at the end of a run is written
+	reportFormat = flag.String("report-format", "text", "Format of the report at the end of a run: 'text' to log it, with a table of each folder and destination, or 'json' to write it to stdout.")
+
+	// flags that can be changed while running
+	flagsFile = flag.String("flags-file", "", "Location of a file of flags, one a line (ex. '-window=22:00-06:00'), for those not given on the command line. It's read again on a HUP signal or a POST to /control/reload.")
+
+	// how messages are appended to the destinations
+	appendMode  = flag.String("append-mode", copycat.AppendAuto, "How messages are appended to each destination: 'single' waits on each append, 'pipelined' sends a batch of APPENDs before waiting and 'multiappend' sends a batch in one APPEND (on servers with MULTIAPPEND). 'auto' picks one by the destination's round trip time. The choice is logged and in the run report.")
+	appendBatch = flag.Int("append-batch", 10, "The most MB of messages appended to a destination in one batch, kept under its APPENDLIMIT.")
+
+	// for servers that won't list a huge folder in one go
+	enumerateWindow = flag.Int("enumerate-window", 0, "The number of UIDs listed with each FETCH when listing a folder, for servers that cap or time out on fetching everything at once. 0 (the default) to list each folder with a single FETCH.")
+
+	// mail that arrives in the source during a sync
+	lateArrivals = flag.String("late-arrivals", copycat.LateCatchUp, "What to do about messages that arrive in a source folder while it's being synced: 'catch-up' copies them once the rest of the folder is done, 'next-run' leaves them for the next run and lists them in the run report.")
+
+	// for consolidating several accounts into one
+	dstRoot = flag.String("dst-root", "", "A folder to put every synced folder under in the destination, ex. 'Migrated/olduser@example.com', with '/' between its levels. Set \"root\" on a destination in the config file to give each its own.")
+
+	// messages that will never make it
+	skipAfter = flag.Int("skip-after", 3, "Pass over a message in a destination once it has failed in this many runs for a reason it always will (too large, content rejected), remembered in the -db. 0 to try every message every run.")
+
+	// for privacy-sensitive copies
+	redactHeaders = flag.String("redact-headers", "", "Comma separated headers whose values are replaced with '[redacted]' in the copies, ex. 'Subject,X-Originating-IP'.")
+	hashHeaders   = flag.String("hash-headers", "", "Comma separated headers whose values are replaced with a hash in the copies, each address separately in address headers, ex. 'From,To,Cc'.")
+	stripReceived = flag.Bool("strip-received", false, "Drop the Received headers from the copies.")
+	redactionKey  = flag.String("redaction-key", "", "A secret mixed into the -hash-headers hashes so they can't be guessed, or where to read it (env:NAME or file:path).")
+	redactionMap  = flag.String("redaction-map", "", "A file each -hash-headers hash and the value it stands for are added to, to re-identify the copies. Keep it safe.")
+
+	// keeping automated mail out of archives
+	skipAutomated = flag.String("skip-automated", "", "Comma separated kinds of automated messages to leave out: 'bounces', 'calendar-replies' (responses to invitations) and 'auto-replies' (ex. out of office), or 'all'.")
+
+	// junk that isn't worth copying
+	maxSpamScore = flag.Float64("max-spam-score", 0, "Skip messages the source's spam filter scored above this (X-Spam-Score or the score in X-Spam-Status) or flagged (X-Spam-Flag: YES), without downloading them. They're listed in the report. 0 to copy everything.")
+
+	// attachment policy
+	skipAttachments  = flag.String("skip-attachments", "", "Comma separated attachment types (extensions like '.iso', MIME types like 'video/*', or 'executables') that keep a message from being copied.")
+	stripAttachments = flag.String("strip-attachments", "", "Comma separated attachment types (extensions like '.exe', MIME types like 'application/x-msdownload', or 'executables') to remove from messages, leaving a note in their place.")
+	detachOver       = flag.Int("detach-over", 0, "Save attachments larger than this (in MB) to -detach-dir and remove them from the messages, leaving a note of where they went. 0 to keep them.")
+	detachDir        = flag.String("detach-dir", "", "Directory to save the attachments taken out by -detach-over to.")
 )
 
 func main() {
+	// first, so everything else reloaded sees the new flags
+	copycat.Controls.OnReload(reloadFlags)
+
+	// check for a command before the flags
+	if len(os.Args) > 1 {
+		if command, exists := commands[os.Args[1]]; exists {
+			flag.CommandLine.Parse(os.Args[2:])
+			loadFlags()
+			command(flag.Args())
+			return
+		}
+	}
 
 	flag.Parse()
+	loadFlags()
+	run()
+}
+
+// cmdlineFlags are the flags given on the command line, which the -flags-file leaves alone.
+var cmdlineFlags = make(map[string]bool)
+
+// fileFlags are the flags the -flags-file last set, so the ones taken out of it can be
+// put back on a reload.
+var fileFlags = make(map[string]bool)
+
+// flagsMu is held to change the flags on a reload, and to read them from anything that
+// runs alongside one, ex. the serve command's jobs.
+var flagsMu gosync.RWMutex
+
+// loadFlags sets the flags that weren't given on the command line from the -flags-file
+// and then their COPYCAT_ variables. The -flags-file is read again on a reload.
+func loadFlags() {
+	flag.Visit(func(f *flag.Flag) {
+		cmdlineFlags[f.Name] = true
+	})
+	if len(*flagsFile) > 0 {
+		set, err := copycat.FlagsFromFile(flag.CommandLine, *flagsFile, cmdlineFlags)
+		errCheck(err, "Flags File")
+		fileFlags = set
+	}
+	unknown, err := copycat.FlagsFromEnv(flag.CommandLine, os.Environ())
+	errCheck(err, "Environment")
+	for _, name := range unknown {
+		log.Printf("%s isn't a flag or part of the config, ignoring it", name)
+	}
+	// hosts are discovered as the logins are read, before setOptions
+	copycat.AllowDiscoveredHost = *allowDiscoveredHost
+}
+
+// reloadFlags reads the -flags-file again, and puts the flags taken out of it back to
+// their COPYCAT_ variable or default. Most flags are only looked at as a sync, job or
+// connection starts, so changes to them are picked up from the next one.
+func reloadFlags() {
+	if len(*flagsFile) == 0 {
+		return
+	}
+	flagsMu.Lock()
+	defer flagsMu.Unlock()
+	set, err := copycat.FlagsFromFile(flag.CommandLine, *flagsFile, cmdlineFlags)
+	if err != nil {
+		log.Printf("Unable to reload the flags: %s", err.Error())
+		for name := range set {
+			fileFlags[name] = true
+		}
+		return
+	}
+	var removed []string
+	for name := range fileFlags {
+		if !set[name] {
+			removed = append(removed, name)
+		}
+	}
+	if err = copycat.ResetFlags(flag.CommandLine, removed, os.Environ()); err != nil {
+		log.Printf("Unable to reset the flags: %s", err.Error())
+	}
+	fileFlags = set
+}
 
+// run does what the flags say, a sync unless they say otherwise.
+func run() {
 	if *exampleConfig {
 		fmt.Print(getExampleConfig())
 		return
@@ -59,46 +370,323 @@ func main() {
 	var srcInfo copycat.InboxInfo
 	var dstInfos []copycat.InboxInfo
 
-	if len(*configFile) == 0 {
+	if len(*configFile) == 0 && !copycat.ConfigInEnv(os.Environ()) {
 		// put together info from input
-		var err error
-		srcInfo, err = copycat.NewInboxInfo(*srcId, *srcPw, *srcHost)
-		errCheck(err, "Source Info")
+		// no source is needed when importing an archive, and EWS only needs the login
+		if len(*importDir) == 0 && len(*srcEWS) == 0 && len(*srcGraph) == 0 && len(*srcPOP3) == 0 && len(*srcNNTP) == 0 {
+			srcInfo = copycat.InboxInfo{User: *srcId, Pw: *srcPw, Host: *srcHost, Admin: *srcAdmin}
+			errCheck(srcInfo.DiscoverHost(), "Source Host")
+			errCheck(srcInfo.Validate(), "Source Info")
+		}
+		if len(*srcEWS) > 0 || len(*srcPOP3) > 0 || len(*srcNNTP) > 0 {
+			srcInfo = copycat.InboxInfo{User: *srcId, Pw: *srcPw}
+		}
 
-		var dstInfo copycat.InboxInfo
-		dstInfo, err = copycat.NewInboxInfo(*dstId, *dstPw, *dstHost)
-		errCheck(err, "Destination Info")
-		dstInfos = append(dstInfos, dstInfo)
+		// a destination is optional if we're archiving
+		archiving := len(*archiveDir) > 0 || len(*bucket) > 0 || len(*indexURL) > 0 || len(*maildir) > 0 || len(*dstGraph) > 0
+		if !archiving || len(*dstId) > 0 || len(*dstHost) > 0 {
+			dstInfo := copycat.InboxInfo{User: *dstId, Pw: *dstPw, Host: *dstHost, Admin: *dstAdmin, Root: *dstRoot}
+			errCheck(dstInfo.DiscoverHost(), "Destination Host")
+			errCheck(dstInfo.Validate(), "Destination Info")
+			dstInfos = append(dstInfos, dstInfo)
+		}
 
 	} else {
-		//READ THE CONFIG FILE
-		cFile, err := os.Open(*configFile)
-		errCheck(err, "Config File")
+		var config copycat.Config
+		if len(*configFile) > 0 {
+			//READ THE CONFIG FILE
+			cFile, err := os.Open(*configFile)
+			errCheck(err, "Config File")
 
-		configBytes, err := ioutil.ReadAll(cFile)
-		errCheck(err, "Config File")
-		cFile.Close()
+			configBytes, err := ioutil.ReadAll(cFile)
+			errCheck(err, "Config File")
+			cFile.Close()
 
-		var config copycat.Config
-		err = json.Unmarshal(configBytes, &config)
-		errCheck(err, "Config File")
+			err = json.Unmarshal(configBytes, &config)
+			errCheck(err, "Config File")
+		}
+		// the environment overrides the file
+		errCheck(config.ApplyEnv(os.Environ()), "Environment")
 
 		srcInfo = config.Source
-		err = srcInfo.Validate()
-		errCheck(err, "Source Creds")
+		if len(*importDir) == 0 && len(*srcEWS) == 0 && len(*srcGraph) == 0 && len(*srcPOP3) == 0 && len(*srcNNTP) == 0 {
+			errCheck(srcInfo.DiscoverHost(), "Source Host")
+			errCheck(srcInfo.Validate(), "Source Creds")
+		}
 
 		dstInfos = config.Dest
-		for _, info := range dstInfos {
-			err = info.Validate()
-			errCheck(err, "Destination Creds")
+		for i := range dstInfos {
+			errCheck(dstInfos[i].DiscoverHost(), "Destination Host")
+			errCheck(dstInfos[i].Validate(), "Destination Creds")
 		}
 	}
 
+	var sampler *copycat.LogSampler
+	if *logSample > 0 {
+		sampler = copycat.NewLogSampler(*logSample, time.Duration(*logSampleInterval)*time.Second)
+	}
+
 	// check log flag, setup logger if set.
 	if len(*logFile) > 0 {
-		logger := utils.DefaultLogSetup{LogFile: *logFile}
+		var logger utils.LogSetup = utils.DefaultLogSetup{LogFile: *logFile}
+		if sampler != nil {
+			logger = sampledLogs{logger, sampler}
+		}
 		logger.SetupLogging()
 		go utils.ListenForLogSignal(logger)
+	} else if len(*logTarget) > 0 {
+		target, err := copycat.NewLogTarget(*logTarget, "copycat-imap")
+		errCheck(err, "Log Target")
+		log.SetOutput(target)
+	}
+
+	if len(*progress) > 0 {
+		stream, err := copycat.NewProgressStream(*progress)
+		errCheck(err, "Progress")
+		defer stream.Close()
+		copycat.Progress = copycat.Progress.And(stream.Handle)
+	}
+	if *tui {
+		stopTUI = startTUI()
+		defer stopTUI()
+	}
+	if sampler != nil {
+		// after the TUI, which takes over the log
+		sampler.Wrap()
+		defer sampler.Flush()
+	}
+
+	handleSignals()
+	notifySystemd()
+	defer copycat.Systemd.Stopping()
+
+	if len(*httpAddr) > 0 {
+		if len(*apiTokens) > 0 {
+			tokens, err := copycat.LoadAPITokens(*apiTokens)
+			errCheck(err, "API Tokens")
+			http.Handle("/control/", tokens.Admin(copycat.Controls))
+		} else {
+			http.Handle("/control/", copycat.Controls)
+			// adding a destination hands over its password, so it always needs a token
+			http.Handle("/control/destinations", copycat.APITokens(nil).Admin(copycat.Controls))
+		}
+		go func() {
+			log.Printf("serving debug endpoints on %s", *httpAddr)
+			if err := http.ListenAndServe(*httpAddr, nil); err != nil {
+				log.Printf("Problems serving debug endpoints: %s", err.Error())
+			}
+		}()
+	}
+
+	var sinks []copycat.Sink
+	if len(*archiveDir) > 0 && len(*importDir) == 0 {
+		archive, err := copycat.NewArchiveSink(*archiveDir, *archiveFormat)
+		errCheck(err, "Archive")
+		defer archive.Close()
+		archive.Encrypted = len(*archiveKeys) > 0
+		sinks = append(sinks, archive)
+	}
+
+	if len(*bucket) > 0 && len(*importDir) == 0 {
+		objects, err := copycat.NewObjectSink(*bucketEndpoint, *bucketRegion, *bucket, *bucketPrefix, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+		errCheck(err, "Bucket")
+		objects.Encrypted = len(*archiveKeys) > 0
+		sinks = append(sinks, objects)
+	}
+
+	if len(*archiveKeys) > 0 {
+		recipients := strings.Split(*archiveKeys, ",")
+		for _, recipient := range recipients {
+			_, err := copycat.GPGFingerprint(recipient)
+			errCheck(err, "Archive Encrypt")
+		}
+		for i, sink := range sinks {
+			sinks[i] = &copycat.EncryptedSink{Sink: sink, Recipients: recipients}
+		}
+	}
+
+	// the index and maildir need plain text so they are never encrypted
+	if len(*indexURL) > 0 && len(*importDir) == 0 {
+		index, err := copycat.NewIndexSink(*indexURL)
+		errCheck(err, "Index")
+		sinks = append(sinks, index)
+	}
+
+	if len(*maildir) > 0 && len(*importDir) == 0 {
+		box, err := copycat.NewMaildirSink(*maildir, *maildirIndex)
+		errCheck(err, "Maildir")
+		box.Dovecot = *dovecot
+		defer box.Close()
+		sinks = append(sinks, box)
+	}
+
+	var graph *copycat.GraphClient
+	if len(*srcGraph) > 0 || len(*dstGraph) > 0 {
+		var err error
+		graph, err = copycat.NewGraphClient(*graphTenant, os.Getenv("GRAPH_CLIENT_ID"), os.Getenv("GRAPH_CLIENT_SECRET"))
+		errCheck(err, "Graph")
+	}
+
+	if len(*dstGraph) > 0 && len(*importDir) == 0 {
+		sinks = append(sinks, copycat.NewGraphSink(graph, *dstGraph))
+	}
+
+	setOptions()
+	if len(copycat.CacheNamespace) == 0 {
+		copycat.CacheNamespace = srcInfo.User
+	}
+	log.Printf("starting run %s", copycat.RunID)
+
+	if *maxMemory > 0 {
+		copycat.InFlight = copycat.NewSpool(int64(*maxMemory)*1024*1024, "")
+	}
+
+	if len(*otlpEndpoint) > 0 {
+		copycat.Tracing = copycat.NewTracer(*otlpEndpoint, "copycat-imap")
+		defer copycat.Tracing.Close()
+	}
+
+	report := copycat.NewReport()
+	copycat.RunReport = report
+	copycat.Progress = copycat.Progress.And(report.Handle)
+
+	var execFilters []string
+	if len(*filters) > 0 {
+		execFilters = strings.Split(*filters, ",")
+	}
+	transform := transformers(report, execFilters)
+
+	if len(*notifyURL) > 0 {
+		copycat.Notifications = copycat.NewNotifier(*notifyURL)
+	}
+
+	limits := copycat.RunLimits{Messages: *maxMessages, Bytes: int64(*maxBytes) * 1024 * 1024, Duration: time.Duration(*maxMinutes) * time.Minute}
+	if limits != (copycat.RunLimits{}) {
+		// with a window, the run waits for the next one instead of stopping
+		copycat.Budget = copycat.NewRunBudget(limits, len(*window) > 0)
+	}
+	if len(*window) > 0 {
+		syncWindow, err := copycat.ParseTimeWindow(*window)
+		errCheck(err, "Window")
+		go copycat.Controls.Schedule(syncWindow)
+	}
+	scheduled := len(*window) > 0
+	copycat.Controls.OnReload(func() {
+		flagsMu.RLock()
+		windowFlag := *window
+		flagsMu.RUnlock()
+		if len(windowFlag) == 0 {
+			if scheduled {
+				log.Print("the sync window can only be removed with a restart")
+			}
+			return
+		}
+		syncWindow, err := copycat.ParseTimeWindow(windowFlag)
+		if err != nil {
+			log.Printf("Invalid Window: %s", err.Error())
+			return
+		}
+		if scheduled {
+			copycat.Controls.Reschedule(syncWindow)
+			return
+		}
+		scheduled = true
+		go copycat.Controls.Schedule(syncWindow)
+	})
+
+	if len(*importDir) > 0 {
+		if err := copycat.ImportArchive(*importDir, dstInfos, sinks, *conns, transform); err != nil {
+			log.Printf("Problems importing archive: %s", err.Error())
+		}
+		printReport(report)
+		return
+	}
+
+	if len(*srcEWS) > 0 {
+		if err := copycat.ImportSource(copycat.NewEWSSource(*srcEWS, srcInfo.User, srcInfo.Pw), dstInfos, sinks, *conns, transform); err != nil {
+			log.Printf("Problems copying from EWS: %s", err.Error())
+		}
+		printReport(report)
+		return
+	}
+
+	if len(*srcPOP3) > 0 {
+		cache, err := copycat.NewCache(*dbFile)
+		errCheck(err, "Cache")
+		defer cache.Close()
+		source, err := copycat.NewPOP3Source(*srcPOP3, srcInfo.User, srcInfo.Pw, cache)
+		errCheck(err, "POP3")
+		defer source.Close()
+		if err = copycat.ImportSource(source, dstInfos, sinks, *conns, transform); err != nil {
+			log.Printf("Problems copying from POP3: %s", err.Error())
+		}
+		printReport(report)
+		return
+	}
+
+	if len(*srcNNTP) > 0 {
+		var groups []string
+		if len(*nntpGroups) > 0 {
+			groups = strings.Split(*nntpGroups, ",")
+		}
+		source, err := copycat.NewNNTPSource(*srcNNTP, srcInfo.User, srcInfo.Pw, groups)
+		errCheck(err, "NNTP")
+		defer source.Close()
+		if err = copycat.ImportSource(source, dstInfos, sinks, *conns, transform); err != nil {
+			log.Printf("Problems archiving newsgroups: %s", err.Error())
+		}
+		printReport(report)
+		return
+	}
+
+	if len(*srcGraph) > 0 {
+		if err := copycat.ImportSource(copycat.NewGraphSource(graph, *srcGraph), dstInfos, sinks, *conns, transform); err != nil {
+			log.Printf("Problems copying from Graph: %s", err.Error())
+		}
+		printReport(report)
+		return
+	}
+
+	if *cutover {
+		pass := func() error {
+			if *folders {
+				return copycat.SyncFolders(srcInfo, dstInfos, sinks, *conns, *parallelFolders, *maxConns, *purge, *dbFile, transform, *generateIds)
+			}
+			cat, err := copycat.NewCopyCat(srcInfo, dstInfos, *conns, true, false)
+			defer cat.Close()
+			if err != nil {
+				return err
+			}
+			return cat.Sync(sinks, *purge, *dbFile, 0, transform, *generateIds)
+		}
+		cut := copycat.Cutover{Source: srcInfo, Sync: pass, FreezeCommand: *freezeCmd, Quiet: time.Duration(*drainQuiet) * time.Second}
+		if err := cut.Run(); err != nil {
+			log.Printf("Problems with the cutover: %s", err.Error())
+		}
+		printReport(report)
+		return
+	}
+
+	if *folders && *sync {
+		journal := openJournal(dstInfos)
+		err := copycat.SyncFolders(srcInfo, dstInfos, sinks, *conns, *parallelFolders, *maxConns, *purge, *dbFile, transform, *generateIds)
+		if err != nil {
+			log.Printf("Problems syncing folders: %s", err.Error())
+		}
+		journal.Close(err)
+		if !*idle {
+			if *verifyInterval > 0 {
+				copycat.VerifyOnce(srcInfo, dstInfos, *verifySample, transform)
+			}
+			printReport(report)
+			return
+		}
+		// the folders are synced, we only need to idle on the INBOX now
+		*sync = false
+	}
+
+	if *idle && *verifyInterval > 0 {
+		go copycat.Verify(srcInfo, dstInfos, time.Duration(*verifyInterval)*time.Minute, *verifySample, transform, nil)
 	}
 
 start:
@@ -113,22 +701,300 @@ start:
 
 	switch {
 	case *idle:
-		cat.Idle(*sync, *purge, *dbFile)
+		// so a destination added while idling gets every folder too
+		cat.Folders, cat.ParallelFolders, cat.MaxConns = *folders, *parallelFolders, *maxConns
+		cat.Idle(sinks, *sync, *purge, *dbFile, transform, *generateIds)
+		if copycat.Controls.Stopped("") {
+			cat.Close()
+			printReport(report)
+			return
+		}
 		// if idle ended, something's up. just restart.
 		log.Printf("Idle unexpectedly quit. attempting to close conns...")
+		printReport(report)
+		// keeping any destinations added while idling
+		dstInfos = append(dstInfos, cat.Added()...)
 		cat.Close()
 		log.Print("Conns closed. restarting process.")
 		goto start
 	case *sync:
-		cat.Sync(*purge, *dbFile, *quickcount)
+		journal := openJournal(dstInfos)
+		journal.Close(cat.Sync(sinks, *purge, *dbFile, *quickcount, transform, *generateIds))
 		cat.Close()
+		if *verifyInterval > 0 {
+			copycat.VerifyOnce(srcInfo, dstInfos, *verifySample, transform)
+		}
+		printReport(report)
+	}
+}
+
+// credentialFlags are left out of the journal. The recover command takes them again.
+var credentialFlags = []string{"src-pw", "dst-pw", "redaction-key", "job-key"}
+
+// openJournal starts recording the run for the recover command. If it's picking up a run
+// that crashed, the appends that were under way are checked first.
+func openJournal(dstInfos []copycat.InboxInfo) *copycat.RunJournal {
+	journal, err := copycat.OpenJournal(*dbFile, copycat.RunID, copycat.StripFlags(os.Args[1:], credentialFlags))
+	if err != nil {
+		log.Printf("Unable to open the run journal: %s. the run can't be recovered", err.Error())
+		return nil
+	}
+	copycat.Journal = journal
+	journal.VerifyUncertain(dstInfos)
+	return journal
+}
+
+// notifySystemd tells systemd copycat has started and keeps it posted on the sync, if
+// it was started by a Type=notify service.
+func notifySystemd() {
+	notifier, err := copycat.NewSystemdNotifier()
+	errCheck(err, "Systemd")
+	if notifier == nil {
+		return
+	}
+	copycat.Systemd = notifier
+	copycat.Progress = copycat.Progress.And(notifier.Handle)
+	notifier.Ready()
+}
+
+// setOptions sets the copycat package's options from the flags.
+func setOptions() {
+	copycat.ThreadOrder = *threadOrder
+	copycat.MaxAppendFailures = *maxFailures / 100
+	copycat.ThrottleCooldown = time.Duration(*throttleCooldown) * time.Second
+	preference, err := copycat.ParseAddressPreference(*preferIP)
+	errCheck(err, "IP Preference")
+	copycat.AddressPreference = preference
+	copycat.FallbackDelay = time.Duration(*fallbackDelay) * time.Millisecond
+	copycat.DNSCacheTTL = time.Duration(*dnsCache) * time.Second
+	copycat.ExpungeSource = *expungeSource
+	copycat.SubscribeFolders = *subscribe
+	copycat.FairFolders = *fairFolders
+	copycat.EnumerateWindow = uint32(*enumerateWindow)
+	copycat.SkipUnchanged = *skipUnchanged
+	copycat.FolderLimits = copycat.FolderRules{MaxDepth: *maxFolderDepth, MaxLength: *maxFolderLength}
+	if len(*folderPolicies) > 0 {
+		policies, err := copycat.LoadFolderPolicies(*folderPolicies)
+		errCheck(err, "Folder Policies")
+		copycat.FolderPolicies = policies
+	}
+	copycat.SharedNamespaces = copycat.ParseFlags(*sharedFolders)
+	copycat.DedupHeaders = copycat.ParseFlags(*dedupHeaders)
+	copycat.CopyACLs = *copyACLs
+	copycat.CopyMetadata = *copyMetadata
+	algorithm := *compress
+	if *compressCache && len(algorithm) == 0 {
+		algorithm = "deflate"
+	}
+	compression, err := copycat.NewCompression(algorithm, *compressLevel)
+	errCheck(err, "Compression")
+	copycat.Compress = compression
+	copycat.RunID = *runId
+	if len(copycat.RunID) == 0 {
+		copycat.RunID = copycat.NewRunID()
+	}
+	copycat.CacheNamespace = *cacheNamespace
+	copycat.CacheMaxSize = *cacheMaxSize * 1024 * 1024
+	copycat.MaxMessageSize = *maxMessageSize * 1024 * 1024
+	copycat.SkipAfter = *skipAfter
+	copycat.MaxSpamScore = *maxSpamScore
+	if copycat.CacheNamespace == "run" {
+		copycat.CacheNamespace = copycat.RunID
+	}
+	copycat.WarmCache = *warmCache
+	if len(*faults) > 0 {
+		injected, err := copycat.NewFaultInjection(*faults)
+		errCheck(err, "Faults")
+		copycat.Faults = injected
+		log.Printf("injecting faults: %s", *faults)
+	}
+	copycat.BrokerMemory = int64(*broker) * 1024 * 1024
+	copycat.Memcache = copycat.MemcacheConfig{
+		Servers:      strings.Split(*memcacheServers, ","),
+		DialTimeout:  time.Duration(*memcacheDial) * time.Millisecond,
+		Timeout:      time.Duration(*memcacheTimeout) * time.Millisecond,
+		MaxIdleConns: *memcacheIdle,
+		Consistent:   *memcacheConsistent,
+	}
+	switch *groupware {
+	case copycat.GroupwareSync, copycat.GroupwareSkip, copycat.GroupwareExport:
+		copycat.GroupwareFolders = *groupware
+		copycat.GroupwareDir = *groupwareDir
+	default:
+		errCheck(fmt.Errorf("expected 'skip' or 'export', not %q", *groupware), "Groupware")
+	}
+	switch *appendMode {
+	case copycat.AppendAuto, copycat.AppendSingle, copycat.AppendPipelined, copycat.AppendMulti:
+		copycat.AppendMode = *appendMode
+		copycat.AppendBatchBytes = *appendBatch * 1024 * 1024
+	default:
+		errCheck(fmt.Errorf("expected 'auto', 'single', 'pipelined' or 'multiappend', not %q", *appendMode), "Append Mode")
+	}
+	switch *lateArrivals {
+	case copycat.LateCatchUp, copycat.LateNextRun:
+		copycat.LateArrivals = *lateArrivals
+	default:
+		errCheck(fmt.Errorf("expected 'catch-up' or 'next-run', not %q", *lateArrivals), "Late Arrivals")
+	}
+	switch *headerParsing {
+	case copycat.HeaderLenient, copycat.HeaderStrict:
+		copycat.HeaderParsing = *headerParsing
+	default:
+		errCheck(fmt.Errorf("expected 'lenient' or 'strict', not %q", *headerParsing), "Header Parsing")
+	}
+	if *reportFormat != "text" && *reportFormat != "json" {
+		errCheck(fmt.Errorf("expected 'text' or 'json', not %q", *reportFormat), "Report Format")
+	}
+	if len(*routes) > 0 {
+		loaded, err := copycat.LoadRoutes(*routes)
+		errCheck(err, "Routes")
+		copycat.Routes = loaded
+	}
+}
+
+// redactions is the -redaction-map, opened once for every job's transformers.
+var redactions *copycat.RedactionMap
+
+// transformers builds the chain each copied message is passed through from the flags,
+// with the exec filters run after the built in repairs and before the flags are set.
+func transformers(report *copycat.Report, execFilters []string) copycat.Transformers {
+	var transform copycat.Transformers
+	if !*byteExact {
+		transform = append(transform, copycat.Normalizer{Report: report})
+	}
+	if *generateIds {
+		transform = append(transform, copycat.MessageIdGenerator{Report: report})
+	}
+	if *repairMIME {
+		transform = append(transform, copycat.MIMERepairer{})
+	}
+	if len(*skipAutomated) > 0 {
+		kinds, err := copycat.ParseAutomatedKinds(*skipAutomated)
+		errCheck(err, "Skip Automated")
+		transform = append(transform, copycat.AutomatedFilter{Kinds: kinds})
+	}
+	if len(*skipAttachments) > 0 || len(*stripAttachments) > 0 || *detachOver > 0 {
+		policy, err := copycat.NewAttachmentPolicy(copycat.ParseFlags(*skipAttachments), copycat.ParseFlags(*stripAttachments), *detachOver*1024*1024, *detachDir)
+		errCheck(err, "Attachment Policy")
+		policy.Report = report
+		transform = append(transform, policy)
+	}
+	if len(execFilters) > 0 {
+		transform = append(transform, copycat.NewExecTransformers(execFilters)...)
+	}
+	if *preserveFlags || len(*addFlags) > 0 || len(*removeFlags) > 0 {
+		transform = append(transform, copycat.FlagPolicy{Preserve: *preserveFlags, Add: copycat.ParseFlags(*addFlags), Remove: copycat.ParseFlags(*removeFlags)})
+	}
+	if len(*keywordMap) > 0 {
+		keywords, err := copycat.LoadKeywordMap(*keywordMap)
+		errCheck(err, "Keyword Map")
+		transform = append(transform, copycat.KeywordMap{Map: keywords, Report: report})
+	}
+	if len(*redactHeaders) > 0 || len(*hashHeaders) > 0 || *stripReceived {
+		key, err := copycat.ResolveCredential(*redactionKey)
+		errCheck(err, "Redaction Key")
+		redactor, err := copycat.NewRedactor(copycat.ParseFlags(*redactHeaders), copycat.ParseFlags(*hashHeaders), *stripReceived, []byte(key))
+		errCheck(err, "Redaction")
+		if len(*redactionMap) > 0 && redactions == nil {
+			redactions, err = copycat.OpenRedactionMap(*redactionMap)
+			errCheck(err, "Redaction Map")
+		}
+		redactor.Mapping, redactor.Report = redactions, report
+		transform = append(transform, redactor)
+	}
+	return transform
+}
+
+// stopTUI puts the terminal back if the TUI was started. See exit.
+var stopTUI = func() {}
+
+// exit quits with the code, putting the terminal back first.
+func exit(code int) {
+	stopTUI()
+	os.Exit(code)
+}
+
+// startTUI will draw the progress of the sync on the terminal and read key presses
+// for it. The func it returns stops it and puts the terminal back, only the first time
+// it's called.
+func startTUI() func() {
+	ui := copycat.NewTUI(os.Stdout)
+	copycat.Progress = copycat.Progress.And(ui.Handle)
+	if len(*logFile) == 0 {
+		log.SetOutput(ui)
+	}
+
+	// get keys as they're pressed, without echoing them
+	stty := func(args ...string) string {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		out, _ := cmd.Output()
+		return strings.TrimSpace(string(out))
+	}
+	saved := stty("-g")
+	stty("cbreak", "-echo")
+	go func() {
+		key := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(key); err != nil {
+				return
+			}
+			ui.Key(key[0])
+		}
+	}()
+
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		ui.Run(time.Second, stop)
+		close(stopped)
+	}()
+
+	var once gosync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-stopped
+			if len(*logFile) == 0 {
+				log.SetOutput(os.Stderr)
+			}
+			ui.Close()
+			if len(saved) > 0 {
+				stty(saved)
+			}
+		})
+	}
+}
+
+// sampledLogs samples the log again each time it's set up, ex. after logrotate.
+type sampledLogs struct {
+	utils.LogSetup
+	sampler *copycat.LogSampler
+}
+
+func (s sampledLogs) SetupLogging() {
+	s.LogSetup.SetupLogging()
+	s.sampler.Wrap()
+}
+
+// printReport logs the report, or writes it to stdout as JSON with -report-format=json.
+func printReport(report *copycat.Report) {
+	if *reportFormat != "json" {
+		log.Print(report)
+		return
+	}
+	raw, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Printf("Unable to write the report: %s", err.Error())
+		return
 	}
+	fmt.Println(string(raw))
 }
 
 func errCheck(err error, msg string) {
 	if err != nil {
 		log.Printf("Invalid %s: %s", msg, err.Error())
-		os.Exit(1)
+		exit(1)
 	}
 }
 
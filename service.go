@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// serviceCommand is only for Windows. Elsewhere, run copycat with systemd (see -idle).
+func serviceCommand(args []string) {
+	log.Print("the service command is only available on Windows")
+	os.Exit(1)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"copycat-imap/copycat"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "copycat-imap"
+
+// serviceCommand installs copycat as a Windows service that runs with the flags given
+// to install, removes it, or is what the service control manager runs:
+//
+//	copycat-imap service install [flags]
+//	copycat-imap service uninstall
+//	copycat-imap service run [flags]
+//
+// The service starts automatically and is restarted a minute after it fails. It runs
+// in the directory copycat is in, and logs to the event log unless -log is given.
+func serviceCommand(args []string) {
+	if len(args) == 0 {
+		log.Print("usage: copycat-imap service install|uninstall|run [flags]")
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "install":
+		installService(args[1:])
+	case "uninstall":
+		uninstallService()
+	case "run":
+		flag.CommandLine.Parse(args[1:])
+		loadFlags()
+		runService()
+	default:
+		log.Printf("unknown service command %q, expected install, uninstall or run", args[0])
+		os.Exit(1)
+	}
+}
+
+func installService(args []string) {
+	// check the flags now, rather than once the service starts
+	errCheck(flag.CommandLine.Parse(args), "Flags")
+	exe, err := os.Executable()
+	errCheck(err, "Executable")
+
+	m, err := mgr.Connect()
+	errCheck(err, "Service Manager")
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		log.Printf("the %s service is already installed, uninstall it first", serviceName)
+		os.Exit(1)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "copycat-imap",
+		Description: "Copies mail from one IMAP inbox to others.",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"service", "run"}, args...)...)
+	errCheck(err, "Service")
+	defer s.Close()
+	if err = s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: time.Minute}}, uint32((24 * time.Hour).Seconds())); err != nil {
+		log.Printf("Unable to have the service restarted when it fails: %s", err.Error())
+	}
+	if err = copycat.InstallEventSource(serviceName); err != nil {
+		log.Printf("Unable to log to the event log: %s. use -log", err.Error())
+	}
+	log.Printf("installed the %s service, start it with: sc start %s", serviceName, serviceName)
+}
+
+func uninstallService() {
+	m, err := mgr.Connect()
+	errCheck(err, "Service Manager")
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	errCheck(err, "Service")
+	defer s.Close()
+	errCheck(s.Delete(), "Service")
+	if err = copycat.RemoveEventSource(serviceName); err != nil {
+		log.Printf("Unable to remove the event log source: %s", err.Error())
+	}
+	log.Printf("uninstalled the %s service", serviceName)
+}
+
+func runService() {
+	// services start in System32, so relative paths are taken from copycat's directory
+	if exe, err := os.Executable(); err == nil {
+		os.Chdir(filepath.Dir(exe))
+	}
+	if len(*logFile) == 0 && len(*logTarget) == 0 {
+		*logTarget = copycat.LogEventlog
+	}
+	if err := svc.Run(serviceName, windowsService{}); err != nil {
+		log.Printf("Problems running the service: %s", err.Error())
+		os.Exit(1)
+	}
+}
+
+// windowsService runs the sync until it's done or the service is stopped, which
+// cancels it cleanly like an interrupt. A paramchange reloads the settings.
+type windowsService struct{}
+
+func (windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan struct{})
+	go func() {
+		run()
+		close(done)
+	}()
+	accepts := svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue | svc.AcceptParamChange
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case <-done:
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.ParamChange:
+				copycat.Controls.Reload()
+				status <- request.CurrentStatus
+			case svc.Pause:
+				copycat.Controls.Pause()
+				status <- svc.Status{State: svc.Paused, Accepts: accepts}
+			case svc.Continue:
+				copycat.Controls.Resume()
+				status <- svc.Status{State: svc.Running, Accepts: accepts}
+			case svc.Stop, svc.Shutdown:
+				log.Print("Service stopping. finishing the messages being copied")
+				status <- svc.Status{State: svc.StopPending, WaitHint: 30000}
+				copycat.Controls.Cancel()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
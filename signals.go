@@ -0,0 +1,51 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"copycat-imap/copycat"
+)
+
+// handleSignals lets a running sync be controlled with signals: USR1 pauses it, USR2
+// resumes it and INT or TERM cancels it cleanly. A second INT or TERM quits right away.
+// HUP reloads the settings, see reloadOnHangup.
+func handleSignals() {
+	reloadOnHangup()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGUSR1:
+				copycat.Controls.Pause()
+			case syscall.SIGUSR2:
+				copycat.Controls.Resume()
+			default:
+				if copycat.Controls.Stopped("") {
+					log.Printf("Received %s again. quitting!", sig)
+					exit(1)
+				}
+				log.Printf("Received %s. finishing the messages being copied, send it again to quit now", sig)
+				copycat.Controls.Cancel()
+				copycat.Systemd.Stopping()
+			}
+		}
+	}()
+}
+
+// reloadOnHangup reloads the settings (see RunControls.Reload) on a HUP signal.
+func reloadOnHangup() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			copycat.Controls.Reload()
+		}
+	}()
+}
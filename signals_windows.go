@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+
+	"copycat-imap/copycat"
+)
+
+// handleSignals cancels a running sync cleanly on an interrupt. A second interrupt
+// quits right away. Windows has no signals for pausing, so use the -http controls.
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		for range signals {
+			if copycat.Controls.Stopped("") {
+				log.Print("Received an interrupt again. quitting!")
+				exit(1)
+			}
+			log.Print("Received an interrupt. finishing the messages being copied, send it again to quit now")
+			copycat.Controls.Cancel()
+		}
+	}()
+}
+
+// reloadOnHangup does nothing since Windows has no HUP. Reload with a POST to
+// /control/reload, or by sending the service a paramchange (sc control copycat-imap paramchange).
+func reloadOnHangup() {}